@@ -7,20 +7,58 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime/pprof"
+	"strings"
 
+	"github.com/google/codesearch/index"
 	"github.com/google/codesearch/regexp"
 )
 
-var usageMessage = `usage: cgrep [-c] [-h] [-i] [-l] [-n] regexp [file...]
+var usageMessage = `usage: cgrep [-c] [-count-matches] [-line-range m:n] [-h] [-i] [-l] [-n] [-o] [-q] [-v] [-w] [-x] [-A n] [-B n] [-C n]
+             [--color when] [--heading] [-max-columns n] [--include glob] [--exclude glob] [-pcre-compat] regexp [file...]
 
 Cgrep behaves like grep, searching for regexp, an RE2 (nearly PCRE) regular expression.
 
-The -c, -h, -i, -l, and -n flags are as in grep, although note that as per Go's
-flag parsing convention, they cannot be combined: the option pair -i -n 
-cannot be abbreviated to -in.
+The -c, -h, -i, -l, -n, -o, -q, -v, -w, and -x flags are as in grep,
+although note that as per Go's flag parsing convention, they cannot be
+combined: the option pair -i -n cannot be abbreviated to -in.
+The -w flag matches whole words as the regexp \b(regexp)\b does, and the
+-x flag matches whole lines as ^(regexp)$ does.  The -o flag prints
+each match on its own line, without context lines.  The -q flag prints
+nothing and stops at the first match; only the exit status reports
+whether anything matched.
+The -count-matches flag is like -c, but counts every match on each
+line rather than the matching lines.
+
+The -pcre-compat flag takes regexp to be a PCRE regular expression, as
+grep -P does, translating it to RE2 as described in csearch -help.
+
+The -A, -B, and -C flags print n lines of trailing, leading, or both
+kinds of context around each match, as in grep.
+
+The -line-range flag reports only matches in lines m through n of each
+file, as described in csearch -help.
+
+The --color flag highlights file names, line numbers, and matches using
+ANSI escape sequences, as in grep.  The value when is always, never (the
+default), or auto, which colors the output only if it is a terminal.
+
+The --heading flag prints each file name once, on a line of its own
+above the file's lines, which are numbered, as ripgrep --heading does.
+
+The -max-columns flag truncates printed lines longer than n bytes to
+the n bytes around the first match, as described in csearch -help.
+
+The --include and --exclude flags, which may be repeated, restrict the
+search to the named files matching one of the --include glob patterns,
+if any, and none of the --exclude ones, as in grep.  Patterns such as
+*.go match the last element of a file name; see csearch -help for the
+full syntax.  Standard input is always searched.
+
+Cgrep exits with status 0 if any line was selected, or 1 otherwise.
 `
 
 func usage() {
@@ -28,14 +66,38 @@ func usage() {
 	os.Exit(2)
 }
 
+// A stringsFlag is a flag that may be repeated,
+// each use adding to a list of strings.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 var (
 	iflag      = flag.Bool("i", false, "case-insensitive match")
+	wflag      = flag.Bool("w", false, "match whole words only")
+	xflag      = flag.Bool("x", false, "match whole lines only")
+	qflag      = flag.Bool("q", false, "print nothing; exit at the first match")
+	pcreFlag   = flag.Bool("pcre-compat", false, "translate PCRE syntax in regexp to RE2")
 	cpuProfile = flag.String("cpuprofile", "", "write cpu profile to this file")
+
+	includeFlags stringsFlag
+	excludeFlags stringsFlag
 )
 
 func main() {
 	var g regexp.Grep
 	g.AddFlags()
+	flag.BoolVar(&g.V, "v", false, "select non-matching lines")
+	flag.BoolVar(&g.O, "o", false, "print only the matching parts of lines")
+	flag.Var(&includeFlags, "include", "search only files matching `glob`")
+	flag.Var(&excludeFlags, "exclude", "skip files matching `glob`")
 	g.Stdout = os.Stdout
 	g.Stderr = os.Stderr
 	flag.Usage = usage
@@ -55,10 +117,36 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	pat := "(?m)" + args[0]
+	pat := args[0]
+	if *pcreFlag {
+		p, err := regexp.TranslatePCRE(pat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pat = p
+	}
+	switch {
+	case *xflag:
+		pat = "^(?:" + pat + ")$"
+	case *wflag:
+		pat = `\b(?:` + pat + `)\b`
+	}
+	pat = "(?m)" + pat
 	if *iflag {
 		pat = "(?i)" + pat
 	}
+	if *qflag {
+		g.Stdout = ioutil.Discard
+		g.Max = 1
+	}
+	globs := append([]string(nil), includeFlags...)
+	for _, glob := range excludeFlags {
+		globs = append(globs, "!"+glob)
+	}
+	filter, err := index.NewGlobFilter(globs)
+	if err != nil {
+		log.Fatal(err)
+	}
 	re, err := regexp.Compile(pat)
 	if err != nil {
 		log.Fatal(err)
@@ -68,7 +156,12 @@ func main() {
 		g.Reader(os.Stdin, "<standard input>")
 	} else {
 		for _, arg := range args[1:] {
-			g.File(arg)
+			if g.Done() {
+				break
+			}
+			if filter.Match(arg) {
+				g.File(arg)
+			}
 		}
 	}
 	if !g.Match {
@@ -0,0 +1,86 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/codesearch/index"
+)
+
+// indexedAttached returns the names of the indexes attached to the index.
+func indexedAttached() []string {
+	file := index.File()
+	if _, err := os.Stat(file); err != nil || index.IsSharded(file) {
+		return nil
+	}
+	return index.Open(file).Attached()
+}
+
+// setAttached implements -attach and -detach, changing the list of
+// indexes attached to the index, which it creates if need be.
+func setAttached() {
+	file := index.File()
+	if index.IsSharded(file) {
+		log.Fatal("-attach and -detach do not support sharded indexes")
+	}
+	if _, err := os.Stat(file); err != nil {
+		if len(attachFiles) == 0 {
+			log.Fatalf("-detach: %v", err)
+		}
+		ix := index.Create(file)
+		ix.Flush()
+	}
+	self, err := filepath.Abs(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	attached := index.Open(file).Attached()
+
+	for _, f := range detachFiles {
+		f = absIndex(f)
+		i := 0
+		for i < len(attached) && attached[i] != f {
+			i++
+		}
+		if i == len(attached) {
+			log.Fatalf("-detach: %s is not attached to the index", f)
+		}
+		attached = append(attached[:i], attached[i+1:]...)
+	}
+Add:
+	for _, f := range attachFiles {
+		f = absIndex(f)
+		for _, a := range attached {
+			if a == f {
+				continue Add
+			}
+		}
+		if _, err := os.Stat(f); err != nil {
+			log.Fatalf("-attach: %v", err)
+		}
+		// An index that attaches this one, directly or not,
+		// would make searches go around in circles.
+		for _, g := range index.AttachedFiles([]string{f}, index.Open) {
+			if g == self {
+				log.Fatalf("-attach: %s is or attaches the index %s", f, self)
+			}
+		}
+		attached = append(attached, f)
+	}
+	index.SetAttached(file, attached)
+}
+
+// absIndex returns the absolute name of the index file f,
+// as recorded in the list of attached indexes.
+func absIndex(f string) string {
+	a, err := filepath.Abs(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return a
+}
@@ -0,0 +1,189 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/google/codesearch/index"
+)
+
+// A journal records the progress of a build with -checkpoint,
+// in the file named by adding .checkpoint to the index's name.
+// The files indexed so far are in the partial index, named by
+// adding .partial to the index's name.
+type journal struct {
+	Paths      []string `json:"paths"`      // paths being indexed
+	Last       string   `json:"last"`       // last file in the partial index
+	Checkpoint int64    `json:"checkpoint"` // -checkpoint size, in bytes
+}
+
+// A checkpoints tracks the checkpoints of a build of an index.
+type checkpoints struct {
+	master  string  // index being built
+	journal journal // progress so far
+	partial string  // partial index
+	resumed bool    // resuming from a checkpoint
+	arg     int     // index in journal.Paths of the path holding journal.Last, or -1
+	cur     int     // index in journal.Paths of the path being indexed
+	last    string  // last file, or archive holding it, in the partial index
+	within  bool    // files can be skipped within the path holding last
+}
+
+// startCheckpoints returns the checkpoints for the build of master
+// that indexes paths, or nil if neither -checkpoint nor -resume is set.
+// With -resume, it reads the journal of the build being resumed;
+// otherwise it discards any left by an earlier build.
+func startCheckpoints(master string, paths []string) *checkpoints {
+	c := &checkpoints{
+		master:  master,
+		partial: master + ".partial",
+		arg:     -1,
+		journal: journal{Paths: paths, Checkpoint: int64(checkpointLen)},
+	}
+	if !*resumeFlag {
+		if checkpointLen <= 0 {
+			return nil
+		}
+		c.discard()
+		return c
+	}
+
+	data, err := os.ReadFile(master + ".checkpoint")
+	if os.IsNotExist(err) {
+		slog.Warn("no checkpoint to resume from; indexing from the start", "index", master)
+		c.discard()
+		if checkpointLen <= 0 {
+			return nil
+		}
+		return c
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		log.Fatalf("-resume: %s.checkpoint: %v", master, err)
+	}
+	if !slices.Equal(j.Paths, paths) {
+		log.Fatalf("-resume: the checkpoint is of a build of other paths: %q", j.Paths)
+	}
+	if _, err := os.Stat(c.partial); err != nil {
+		log.Fatalf("-resume: %v", err)
+	}
+	if checkpointLen <= 0 {
+		checkpointLen = byteSizeFlag(j.Checkpoint)
+	}
+	c.journal = j
+	c.journal.Checkpoint = int64(checkpointLen)
+	c.resumed = true
+	// A file in an archive is indexed along with the rest of the
+	// archive, which must be indexed again.
+	c.last = j.Last
+	if archive, _, ok := index.SplitArchiveName(c.last); ok {
+		c.last = archive
+	}
+	for i, p := range paths {
+		if index.InTree(c.last, p) {
+			c.arg = i
+			break
+		}
+	}
+	slog.Info("resume", "index", master, "after", j.Last)
+	return c
+}
+
+// setup prepares ix, which writes the index of the build, to write
+// checkpoints and to hold only the files after the last one.
+func (c *checkpoints) setup(ix *index.IndexWriter) {
+	ix.CheckpointBytes = c.journal.Checkpoint
+	ix.Checkpoint = c.add
+	ix.Partial = c.resumed
+}
+
+// begin notes that the build is starting to index
+// the path with the given index in the list of paths.
+func (c *checkpoints) begin(i int) {
+	c.cur = i
+	if i == c.arg {
+		// The order in which files come out of a tar stream or git
+		// tree is theirs, so such a path is indexed again in full.
+		p := c.journal.Paths[i]
+		_, _, git := index.ParseGitTree(p)
+		c.within = !index.IsTarStream(p) && !git
+	}
+}
+
+// skip reports whether the file or directory path, in the path being
+// indexed, is in the partial index already, so that the build need not
+// index it again.
+func (c *checkpoints) skip(path string, info os.FileInfo) bool {
+	switch {
+	case c.arg < 0 || c.cur > c.arg:
+		return false
+	case c.cur < c.arg:
+		return true
+	case !c.within:
+		return false
+	case info.IsDir():
+		return index.WalkBefore(path, c.last) && !index.InTree(c.last, path)
+	}
+	return index.WalkBefore(path, c.last) || path == c.last && c.last == c.journal.Last
+}
+
+// skipPath reports whether the path with the given index in the
+// list of paths is in the partial index already.
+func (c *checkpoints) skipPath(i int) bool {
+	return i < c.arg
+}
+
+// add adds the files in the checkpoint index file, the last of which
+// is named last, to the partial index, and records the progress.
+func (c *checkpoints) add(file, last string) {
+	if _, err := os.Stat(c.partial); err == nil {
+		index.Update(c.partial+"~", c.partial, file, func(string) bool { return false })
+		os.Remove(file)
+		file = c.partial + "~"
+	}
+	if err := index.Rename(file, c.partial); err != nil {
+		log.Fatal(err)
+	}
+	c.journal.Last = last
+	data, err := json.Marshal(&c.journal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tmp := c.master + ".checkpoint~"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		log.Fatal(err)
+	}
+	if err := index.Rename(tmp, c.master+".checkpoint"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// finish merges the partial index, if any, into the index file, which
+// holds the files indexed after the last checkpoint.
+func (c *checkpoints) finish(file string) {
+	if _, err := os.Stat(c.partial); err != nil {
+		return
+	}
+	slog.Info("merge checkpoints", "index", file)
+	index.Update(file+"~partial", c.partial, file, func(string) bool { return false })
+	if err := index.Rename(file+"~partial", file); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// discard removes the journal and partial index of the build,
+// once it is done or when a new build starts over.
+func (c *checkpoints) discard() {
+	os.Remove(c.master + ".checkpoint")
+	os.Remove(c.partial)
+}
@@ -5,22 +5,46 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime/pprof"
 	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/google/codesearch/cmd/internal/logging"
 	"github.com/google/codesearch/index"
 	"github.com/google/codesearch/regexp"
 )
 
-var usageMessage = `usage: cindex [-list] [-reset] [path...]
+var usageMessage = `usage: cindex [-list] [-reset] [-incremental] [-watch] [-use-gitignore] [-use-csearchignore=false] [-git] [-git-submodules] [-hidden] [-follow-symlinks] [-symbols=false] [-identifiers] [-regions] [-archives]
+              [-compress] [-store-content] [-name-trigrams] [-nfc] [-dedupe] [-stop-trigrams fraction] [-pairs n] [-repo name] [-progress[=json]]
+              [-max-filesize size] [-chunk-size size] [-max-mem size] [-checkpoint size] [-resume]
+              [-exclude pattern] [-add-exclude pattern] [-remove-exclude pattern]
+              [-files-from file] [-filter-cmd command] [-git-ref ref] [-tar file [-tar-name name]] [-bazel-external] [-skip-list file] [path...]
+       cindex -remove path...
+       cindex -list-excludes
+       cindex [-attach file] [-detach file]
+       cindex -list-attached
+       cindex -compact
+       cindex -verify [index...]
+       cindex -stats [index...]
+       cindex -dump[=json] [index...]
+       cindex -diff old new
+       cindex -merge out index...
 
 Cindex prepares the trigram index for use by csearch.  The index is the
-file named by $CSEARCHINDEX, or else $HOME/.csearchindex.
+file named by $CSEARCHINDEX, or else $HOME/.csearchindex (on Windows,
+%USERPROFILE%\.csearchindex if $HOME is unset).  If $CSEARCHINDEX
+lists several indexes for csearch to search, cindex uses the first.
 
 The simplest invocation is
 
@@ -40,6 +64,11 @@ If cindex is invoked with no paths, it reindexes the paths that have
 already been added, in case the files have changed.  Thus, 'cindex' by
 itself is a useful command to run in a nightly cron job.
 
+When reindexing, cindex only rereads files whose size or modification
+time differ from those recorded in the index, and it drops files that
+no longer exist.  The -incremental flag requests the same behavior when
+paths are named explicitly.
+
 The -list flag causes cindex to list the paths it has indexed and exit.
 
 By default cindex adds the named paths to the index but preserves
@@ -47,7 +76,449 @@ information about other paths that might already be indexed
 (the ones printed by cindex -list).  The -reset flag causes cindex to
 delete the existing index before indexing the new paths.
 With no path arguments, cindex -reset removes the index.
-`
+
+The -files-from flag names a file listing files to index, one per line
+or, if the list contains NUL bytes, separated by NULs; a file of - means
+standard input.  The listed files are added to the index along with any
+named paths, which gives exact control over what is indexed, as in
+
+	git ls-files -z | cindex -files-from -
+
+Cindex indexes each listed file as if it were named as an argument:
+it records the file itself as an indexed path, so that adding the list
+again replaces just those files, and it ignores the exclusion patterns
+and the rule against hidden files for it.  Listed directories are
+ignored, so that the output of find can be used as is.  Indexes built
+this way are best kept up to date by listing the files again, with
+-reset to drop files that no longer belong; a sharded index cannot
+be given a file list.
+
+The -tar flag indexes the files in a tar stream, compressed with gzip
+or not, read from the named file or, for -tar -, from standard input,
+without unpacking it to disk, as for the layers of a container image
+or the artifacts of a CI job:
+
+	docker save myimage | tar -xOf - some/layer.tar | cindex -tar - -tar-name layer1
+
+Cindex indexes each file of the stream as tar:name!/path, where path is
+its path in the stream and name is set by -tar-name, which defaults to
+the base name of the file, and records tar:name as an indexed path, so
+that indexing a stream of the same name again replaces its files and
+'cindex -remove tar:name' removes them.  Since the stream cannot be
+read again, cindex stores the text of its files in the index (see
+-store-content), and reindexing leaves them as they are.
+
+The -filter-cmd flag names a program, followed by any arguments, that
+decides which files to index, such as one that enforces a policy of
+leaving out files holding secrets.  Cindex starts the program once and
+writes to its standard input the name of each file it would otherwise
+index, one per line, after applying the other rules, including those of
+-files-from; for each name, the program must write a line to its
+standard output: skip to leave the file out, or anything else, such as
+index, to index it.  For example, a shell script could answer with
+
+	while read f; do grep -q 'BEGIN PRIVATE KEY' "$f" && echo skip || echo index; done
+
+If the program fails, cindex stops rather than index unapproved files.
+
+The -repo flag records that the files in the named paths belong to
+the named repository, so that csearch -repo can restrict a search
+to them, as in:
+
+	cindex -repo kernel $HOME/src/linux
+	cindex -repo tools $HOME/src/tools
+	csearch -repo kernel 'func \w+Init'
+
+Cindex remembers the repository of each path when reindexing it later.
+
+The -remove flag causes cindex to remove the named paths, and all the
+files in them, from the index, leaving the other indexed paths as they
+are.  For example, after
+
+	cindex $HOME/src/old
+
+'cindex -remove $HOME/src/old' undoes the addition.  Removing a
+directory inside an indexed path removes its files only until that
+path is next reindexed; use -exclude to skip the directory for good.
+
+Cindex skips directories whose names match any of a list of RE2
+regular expressions: by default /.git$, /node_modules, /bazel-(bin|out|testlogs),
+/venv, /.csearchindex, and .*/go/pkg/mod.  The patterns match names
+written with slashes, even on Windows, where cindex also records the
+names of files with slashes and compares them without regard to case.
+The -exclude flag, which may be repeated, adds a pattern to the list.  Cindex records the patterns
+added by -exclude in the index, so that later runs, such as a reindex
+by 'cindex' alone, continue to skip the same directories.  The
+-list-excludes flag lists the recorded patterns and exits.  The
+-add-exclude flag is a synonym for -exclude, and the -remove-exclude
+flag removes a recorded pattern.  Both may be repeated, and both
+take effect in the index that cindex then writes, so that
+
+	cindex -remove-exclude /vendor
+
+reindexes the indexed paths, this time including vendor directories.
+The -reset flag discards the recorded patterns along with the index.
+
+Cindex also skips hidden and temporary files and directories: those
+whose names begin with a dot, #, or ~, or end with ~.  The -hidden flag
+causes it to index the ones beginning with a dot, such as .github and
+.config, except that the default exclusion patterns still skip .git
+directories.  A path named as an argument is indexed even if it looks
+hidden.  Like -use-gitignore, -hidden applies only to the run that
+names it.
+
+In a Bazel workspace (a directory holding a WORKSPACE, WORKSPACE.bazel,
+or MODULE.bazel file), cindex skips the symbolic links named bazel-*
+that Bazel leaves there, whatever their names, even with
+-follow-symlinks, since they lead to copies of the sources and to build
+outputs.  The -bazel-external flag also indexes the external
+repositories that Bazel fetched for each named workspace, which it
+keeps in its output tree; Bazel must have built something in the
+workspace first.  Csearch -query can then restrict a search to Bazel
+packages, as in pkg://net/... or pkg:@dep//x, finding the package of
+each file from the BUILD files in the index.
+
+The -use-gitignore flag causes cindex to skip files and directories
+ignored by .gitignore files (and .git/info/exclude) in the indexed trees,
+following git's rules.
+
+Whatever the flags, cindex skips the files and directories ignored by
+.csearchignore files, which use the syntax of .gitignore files, so that
+what to leave out of an index can be written down in the trees
+themselves rather than in the flags of every run.  The rules in a
+.csearchignore file apply to the tree beneath its directory, and
+those in deeper directories take precedence; unlike .gitignore files,
+they apply across the tops of git repositories, so a .csearchignore
+file in a directory holding many checkouts covers them all.  The
+-use-csearchignore=false flag disables them.  A change to a
+.csearchignore file takes effect for the files it covers when they
+are next indexed, so a full reindex applies it everywhere.
+
+The -git flag causes cindex to index only the files that git tracks
+in the checkouts holding the indexed trees, as listed by git ls-files,
+leaving out build outputs and other untracked files without the need
+to exclude them.  Tracked files missing from a sparse checkout are not
+indexed, and files in submodules are indexed only with -git-submodules,
+which implies -git.  A tree that is not in a git checkout is not
+indexed at all.  Like -use-gitignore, -git applies only to the run that
+names it, so reindexing should name it again.
+
+By default cindex skips symbolic links.  The -follow-symlinks flag
+causes it to follow them, as many build layouts link source trees
+together, indexing the files they lead to under the names of the links.
+A file or directory reachable by several names, through symbolic or hard
+links, is indexed only once, under the first of its names that cindex
+reaches, visiting the indexed paths in order and each directory in
+lexical order; a link to a directory enclosing it is not followed.
+Like -use-gitignore, -follow-symlinks applies only to the run that
+names it, so reindexing should name it again, and cindex -watch does
+not watch the linked trees.
+
+The -watch flag causes cindex to keep running after indexing, watching
+the indexed trees for changes and updating the index as files are
+created, modified, or removed.
+
+By default cindex also records where the symbols (functions, types,
+and so on) in each file are defined, for use by csearch -sym.  Go files
+are parsed; files in other common languages are scanned with regular
+expressions.  The -symbols=false flag turns this off.
+
+The -identifiers flag causes cindex to record the words of the
+identifiers in the code of each file, for use by csearch -id.  Cindex
+scans each file in a common programming language, skipping its comments
+and string literals, and splits each identifier into words at
+underscores and changes of case, so that FooBar, fooBar, foo_bar, and
+FOO_BAR are all the words foo and bar.  The index grows by a list of
+the files using each word.  Like -compress, the setting sticks.
+
+The -regions flag causes cindex to record the comments and string
+literals in each file, as found by the same scan, for use by csearch
+-in, which reports only matches in code, comments, or strings.
+Csearch can find them itself, but recording them spares it lexing every
+file it greps.  Like -compress, the setting sticks.
+
+A path may also name a git repository, typically a bare one, as either
+repo or repo@ref.  Cindex then indexes the files in the tree of the named
+revision (by default HEAD), reading them from the repository with git
+rather than from a checkout, under names of the form repo@ref:path.
+Csearch reads such files back from the repository when searching them.
+Files in git trees are reread whenever the index is updated, and
+cindex -watch does not watch them for changes.
+
+The -git-ref flag indexes a past revision, such as a release tag, in an
+index of its own, so that it can be searched with csearch -ref:
+
+	cindex -git-ref v1.2.3 $HOME/src/tool
+	csearch -ref v1.2.3 'func \w+Init'
+
+Each path must name a git repository or the top of a checkout, whose
+files cindex reads from the tree of the named revision, as above.
+The index, which records the revision, is the usual index file with
+@ref appended (with any slashes in ref escaped as %2F), so that indexes
+of several revisions are kept side by side.  All the other flags apply
+to it as usual: cindex -git-ref v1.2.3 -list lists its paths, and
+cindex -git-ref v1.2.3 alone reindexes them.  A revision named by a
+branch rather than a tag moves on as commits are added, and csearch
+reads the files it shows from the revision as it then is, so that
+the indexes of tags, or of commit hashes, are the ones to keep.
+
+The -archives flag causes cindex to index the files inside the zip
+and tar archives it finds (.zip, .jar, .war, .ear, .tar, .tar.gz, and
+.tgz files), under names of the form archive!/path, such as
+lib/foo.jar!/com/x/Y.java.  Csearch reads such files back from the
+archive when searching them.  Cindex reads each tar archive into
+memory to index it, and archives inside archives are not opened.
+
+Cindex indexes compressed files, those whose names end in .gz, .bz2,
+or .xz, by the text of the file inside, such as the log in
+app.log.gz, and csearch decompresses them to search them, printing
+lines of the decompressed text under the file's own name.  The
+language of such a file, and the file types that csearch -type
+matches, are those of the file named without the suffix, app.log.
+Xz files are decompressed with the xz command, which must be
+installed.  Compressed tar archives (.tar.gz, .tgz, .tar.bz2, and
+.tar.xz files) are not decompressed this way; see -archives.
+
+Cindex indexes documents by their text.  Markdown files (.md, .markdown,
+and .mdx) are indexed without their front matter, the metadata between
+--- or +++ lines at the top, which counts as blank lines so that the
+line numbers csearch prints stay right.  Other documents, such as PDF
+files, are indexed by the text that converters listed in
+$CSEARCHEXTRACT write, as pattern=command entries separated by
+semicolons, where pattern matches the base name of a file and command
+reads the file on standard input and writes its text:
+
+	export CSEARCHEXTRACT='*.pdf=pdftotext -layout - -;*.docx=pandoc -f docx -t plain'
+	cindex $HOME/docs
+	csearch -i 'retention policy'
+
+Csearch reads the files through the same converters, which must be
+listed in its environment too, and prints the lines of their text.
+
+The -compress flag causes cindex to compress the list of file names
+in the index with zstd.  File names make up much of the index for
+trees of many small files, and compressing them typically shrinks
+that part of the index by half or more, at the cost of some time
+spent decompressing names when searching.
+
+The -store-content flag causes cindex to store the text of each indexed
+file in the index, compressed with zstd, so that csearchd can show
+search results and files without reading the files themselves.  The
+index grows by the compressed size of the text, often a third or so.
+
+The -name-trigrams flag causes cindex to record the trigrams of the
+indexed file names as well, so that searches limited to files whose
+names match a regexp, as by csearch -f or a file: term, need not match
+the regexp against the name of every indexed file.  The index grows
+by about the size of the list of names.
+
+The -nfc flag causes cindex to index the text of each file in Unicode
+normalization form NFC, in which accented letters are written as one
+character, such as é, rather than as a letter followed by a combining
+accent.  Csearch then normalizes its pattern and the text it searches
+the same way, so that a search finds the letter however a file writes
+it.  The lines csearch prints are normalized too.  An existing index
+must be rebuilt with -reset to be normalized.
+
+The -dedupe flag causes cindex to index each distinct text once: a file
+with the same text as one indexed before it in the same run, such as
+a vendored copy of a package or a hard link, shares that file's entries
+in the index instead of adding its own.  Trees holding many copies of
+the same code get much smaller indexes.  Csearch still reports every
+copy of a match, unless run with -dedupe itself.
+
+Once an index is built with -compress, -store-content, -name-trigrams,
+-identifiers, -regions, -nfc, or -dedupe, later runs of cindex that
+update it continue to compress it, store contents, record name
+trigrams, identifiers, or regions, normalize text, or share the entries
+of identical files, until it is rebuilt with -reset.
+
+Cindex skips files that do not look like text: files longer than 1 GB,
+files with lines longer than 2000 bytes, files with more than 20000
+distinct trigrams, and files containing invalid UTF-8.  These limits
+also skip some text that is worth searching, such as minified JavaScript.
+The -max-filesize (or -max-file-len), -max-line-len, and -max-trigrams
+flags change the limits, and a limit of -1 disables the check.  Sizes
+may be given in bytes or with a unit, as in 512k, 64M, or 2G.
+
+The -chunk-size flag indexes files longer than -max-filesize instead
+of skipping them, reading them in segments of the given size, such as
+16M, and applying the -max-trigrams limit to the new trigrams of each
+segment rather than to the whole file.  Huge generated files, which
+look like text in every part but have too many distinct trigrams in
+all, remain searchable this way.  The segments only bound the checks:
+a file is still indexed, and found by csearch, as a single file.  The -allow-invalid-utf8
+flag indexes files even if they contain invalid UTF-8.  Files in UTF-16
+with a byte order mark, and files that look like Latin-1 text, are
+converted to UTF-8 and indexed; csearch converts them again when
+searching them.
+
+Cindex says what it skips and why.  With -verbose, it logs each file or
+directory it skips, with a reason code: binary (too many trigrams to be
+text), too-large, long-lines, invalid-utf8, unreadable, hidden, excluded,
+gitignored, csearchignored, untracked, filtered (by -filter-cmd), duplicate (reached
+before by another name), or symlink-cycle.  After indexing, it logs the
+number skipped for each reason, as in "skipped files total=15 binary=12
+too-large=3".  The -skip-list flag writes the full list to a file, one
+line per skipped file or directory, holding the reason code, a tab, and
+the name.
+
+The -stop-trigrams flag sets a fraction of the files, such as 0.5,
+above which a trigram becomes a stop trigram: one so common that the
+index leaves out the list of files containing it and treats it as
+found in every file.  Searches then take no time reading those long
+lists, and the index is smaller, at the cost of narrowing searches for
+text made of such trigrams a little less.  The fraction is recorded in
+the index, and later updates keep applying it; changing it requires
+-reset.  Cindex -stats reports the number of stop trigrams.
+
+The -pairs flag causes cindex to precompute, for the n trigrams found
+in the most files, the files holding each pair of them, and to write
+the lists to a file beside the index, named by adding .pairs to its
+name.  A broad search, such as one for a common identifier, usually
+needs several such trigrams, and starting from the list of a pair
+spares it reading their long lists, which on a large index is most of
+the time spent choosing the files to search.  The file holds n(n-1)/2
+lists, so n is best kept to a few dozen, such as 32.  Later runs of
+cindex that update the index rewrite the file for the same n, until
+the index is rebuilt with -reset; a file left beside an index that has
+changed since is ignored.  Sharded indexes have no pairs file.
+
+The -checkpoint flag causes cindex to save its progress after indexing
+each given size of files, such as 1G, so that a long build that crashes
+or is killed need not start over: running the same cindex command again
+with -resume added skips the files indexed before the last checkpoint
+and indexes only the rest.  Cindex keeps the files indexed so far in a
+partial index beside the index, named by adding .partial to its name,
+and records the last of them in a journal named by adding .checkpoint;
+it removes both once the build is done.  Each checkpoint merges the new
+files into the partial index, which takes time in proportion to its
+size, so checkpoints a gigabyte or more apart suit the builds worth
+checkpointing.  A resumed build keeps checkpointing at the same size.
+Sharded indexes do not support checkpoints.
+
+The -progress flag causes cindex to report its progress every second
+while indexing: how many files and bytes it has indexed out of the
+total, how fast, the estimated time remaining, and the file it has just
+finished.  To know the total, cindex first walks the trees to count
+their files, which takes a little extra time.  The reports go to
+standard error, or with -progress=json to standard output as one JSON
+object per line, with fields path, files, total_files, bytes,
+total_bytes, files_per_sec, bytes_per_sec, elapsed_sec, and eta_sec
+(-1 if not yet known); the last report has "done": true.  Files in
+git trees are not counted.
+
+The -j flag sets the number of files cindex reads and indexes
+concurrently.  Larger values speed up indexing on multi-core machines
+at the cost of about 64 MB of memory per file.
+
+The -max-mem flag bounds the memory cindex uses to gather the entries
+of the index, 256 MB by default.  Cindex sorts the entries in batches
+that fit, writes each to a temporary file, and merges the files, a
+bounded number at a time, so that a smaller bound, such as 64M, makes
+indexing a huge tree slower but keeps it from running out of memory.
+The bound does not cover the memory used by -j or by the symbols and
+identifiers that cindex records.
+
+Cindex writes each new index to a temporary file, flushes it to disk,
+and then renames it into place, so that csearch never sees a partially
+written index, even after a crash or power failure, and concurrent runs
+of cindex on the same index wait for each other.
+
+If $CSEARCHINDEX names a directory, the index is sharded: cindex
+writes each tree it indexes to its own index file, or shard, in that
+directory rather than rewriting a single large index, and csearch
+searches all the shards.  Newer shards take precedence over older ones
+for the paths they cover, and cindex removes the shards whose paths
+are all covered by newer ones, so that reindexing one tree, as in
+
+	CSEARCHINDEX=$HOME/.csearch cindex $HOME/src/project
+
+rewrites only that tree's shard and leaves the others alone.
+When the directory holds more than 64 shards, cindex starts a
+background process to merge them into one.  The -compact flag merges
+the shards immediately.  Sharded indexes are always reindexed in
+full, and they cannot be watched.
+
+If $CSEARCHINDEX is the URL of a remote index, such as s3://bucket/key,
+gs://bucket/key, or an https:// URL accepting PUT, cindex updates the
+copy that csearch keeps in its cache, downloading the index first if
+the copy is out of date, and then uploads the result, so that a nightly
+job can publish an index for a team to search:
+
+	CSEARCHINDEX=s3://team-indexes/src.csearchindex cindex -store-content $HOME/src
+
+Requests to S3 are signed with the credentials in $AWS_ACCESS_KEY_ID,
+$AWS_SECRET_ACCESS_KEY, and $AWS_SESSION_TOKEN for $AWS_REGION, and
+$AWS_ENDPOINT_URL names another S3-compatible service to use.  Requests
+to Cloud Storage carry the token in $GOOGLE_OAUTH_ACCESS_TOKEN or else
+the one printed by gcloud auth print-access-token.  Remote indexes
+cannot be watched.
+
+The -verify flag checks the index for damage, such as that left by a
+crash, and exits.  It checks the structure of the index: its header and
+trailer, the offsets of its parts, the order of the paths, file names, and
+posting lists, the file IDs in each posting list, and the checksums that
+cindex records for each part of the index.  It reports each
+problem with the byte offset in the index at which it was found and then
+exits with status 1; a damaged index should be removed and rebuilt.
+Cindex -verify checks the index files named as arguments, or else the
+index (all of its shards, if it is sharded).
+
+The -stats flag prints statistics about the index and exits: the number
+of files and their total size, the number of distinct trigrams and of
+postings (pairs of trigram and file), how many posting lists have 1-9
+files, 10-99 files, and so on, the largest indexed files, and the size
+of each part of the index file.  Trigrams found in many files make for
+long posting lists that narrow searches little; a few very large files,
+such as generated code or data, can contribute many of them, and
+excluding those files may shrink the index considerably.  Like -verify,
+-stats reports on the index files named as arguments, or else on the
+index or each of its shards.
+
+The -dump flag prints the structure of the index and exits, for
+debugging: the version of its format, the offset, size, and purpose of
+each of its parts, the indexed paths, each entry of the name index (file
+ID, offset of the name, and name), and each posting list (trigram,
+number of files, offset, size, and whether it is a roaring bitmap).
+With -dump=json, it prints one JSON object per line instead, each with
+a "kind" field of index, part, path, name, or posting.  Like -stats,
+-dump reads the index files named as arguments, or else the index or
+each of its shards.
+
+The -diff flag compares two index files, such as copies of the index
+saved before and after a nightly reindex, and exits.  It prints a line
+for each file that differs between them, in order by name: A for a file
+only in the new index, D for one only in the old, and M for one in both
+whose content differs, as judged by the content hashes that cindex
+records (or by the stored text, for indexes too old to record hashes).
+It prints a count of each kind of difference to standard error and,
+like diff, exits with status 1 if the indexes differ and 0 if not.
+
+The -merge flag merges existing index files into a new one, writing the
+index out from the indexes that follow it.  The result covers all the
+paths covered by the inputs.  The inputs are taken to be in order from
+oldest to newest: where several of them cover the same path, the files
+under that path come from the last of them.  Cindex -merge does not
+use $CSEARCHINDEX unless it is named explicitly.
+
+The -attach flag, which may be repeated, attaches another index file
+to the index, so that csearch searches it whenever it searches the
+index, without copying its files into the index.  The attached index
+is kept up to date on its own, by running cindex with $CSEARCHINDEX
+naming it, and may itself attach others.  The -detach flag, which may
+also be repeated, undoes an attachment, and the -list-attached flag
+lists the attached indexes.  Cindex changes only the list of attached
+indexes and exits.  If there is no index, cindex -attach creates an
+empty one that only attaches the others, as a manifest of the indexes
+to search:
+
+	CSEARCHINDEX=$HOME/all.csearchindex cindex -attach $HOME/src/.csearchindex \
+		-attach /usr/include/.csearchindex
+
+Sharded indexes can be attached but cannot attach others.
+
+` + logging.Usage
 
 func usage() {
 	fmt.Fprintf(os.Stderr, usageMessage)
@@ -66,38 +537,213 @@ func (a *arrayStringFlags) Set(value string) error {
 	return nil
 }
 
+// A byteSizeFlag is a flag giving a number of bytes,
+// optionally followed by a unit: k, M, G, or T, for powers of 1024.
+type byteSizeFlag int64
+
+func (b *byteSizeFlag) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSizeFlag) Set(s string) error {
+	unit := int64(1)
+	t := strings.TrimSuffix(strings.TrimSuffix(s, "B"), "i")
+	if t != "" {
+		if i := strings.IndexByte("kKMGT", t[len(t)-1]); i >= 0 {
+			unit = 1 << (10 * max(i, 1))
+			t = t[:len(t)-1]
+		}
+	}
+	n, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || n > math.MaxInt64/unit || n < -1 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSizeFlag(n * unit)
+	return nil
+}
+
+// defaultExcludes are the exclusion patterns that cindex always uses.
+// They are not recorded in the index.
+var defaultExcludes = []string{
+	"/.git$",
+	"/node_modules",
+	"/bazel-(bin|out|testlogs)",
+	"/venv",
+	"/.csearchindex",
+	".*/go/pkg/mod",
+}
+
 var (
-	excludePatterns arrayStringFlags
+	excludePatterns arrayStringFlags // -exclude and -add-exclude
+	removeExcludes  arrayStringFlags // -remove-exclude
+	attachFiles     arrayStringFlags // -attach
+	detachFiles     arrayStringFlags // -detach
+	excludeRegexp   []*regexp.Regexp
+	progressMode    progressFlag // -progress
+	dumpMode        dumpFlag     // -dump
+	maxFileLen      byteSizeFlag // -max-filesize
+	chunkLen        byteSizeFlag // -chunk-size
+	checkpointLen   byteSizeFlag // -checkpoint
+	maxMem          byteSizeFlag // -max-mem
 
-	listFlag    = flag.Bool("list", false, "list indexed paths and exit")
-	resetFlag   = flag.Bool("reset", false, "discard existing index")
-	verboseFlag = flag.Bool("verbose", false, "print extra information")
-	cpuProfile  = flag.String("cpuprofile", "", "write cpu profile to this file")
+	// checks tracks the checkpoints of the build, if any.
+	checks *checkpoints
+
+	// recordedExcludes are the exclusion patterns to record in the index:
+	// those already recorded, plus -exclude, minus -remove-exclude.
+	recordedExcludes []string
+
+	// pathRepos maps each path being indexed to its repository, if any.
+	pathRepos map[string]string
+
+	listFlag        = flag.Bool("list", false, "list indexed paths and exit")
+	listExcludes    = flag.Bool("list-excludes", false, "list exclusion patterns recorded in the index and exit")
+	listAttached    = flag.Bool("list-attached", false, "list the indexes attached to the index and exit")
+	resetFlag       = flag.Bool("reset", false, "discard existing index")
+	resumeFlag      = flag.Bool("resume", false, "continue an interrupted build from its last -checkpoint")
+	removeFlag      = flag.Bool("remove", false, "remove the named paths from the index")
+	repoFlag        = flag.String("repo", "", "record that the named paths belong to repository `name`")
+	incrementalFlag = flag.Bool("incremental", false, "only reindex files that have changed")
+	verboseFlag     = flag.Bool("verbose", false, "print extra information")
+	jobsFlag        = flag.Int("j", 1, "read and index up to `n` files concurrently")
+	watchFlag       = flag.Bool("watch", false, "keep running and update the index as files change")
+	gitignoreFlag   = flag.Bool("use-gitignore", false, "skip files ignored by .gitignore files")
+	csignoreFlag    = flag.Bool("use-csearchignore", true, "skip files ignored by .csearchignore files")
+	gitFlag         = flag.Bool("git", false, "index only files tracked by git")
+	hiddenFlag      = flag.Bool("hidden", false, "index hidden files and directories, whose names begin with a dot")
+	submodulesFlag  = flag.Bool("git-submodules", false, "index only files tracked by git, including those in submodules")
+	symlinksFlag    = flag.Bool("follow-symlinks", false, "follow symbolic links to files and directories")
+	compactFlag     = flag.Bool("compact", false, "merge the shards of a sharded index and exit")
+	mergeFlag       = flag.Bool("merge", false, "merge the indexes named by the arguments and exit")
+	verifyFlag      = flag.Bool("verify", false, "check the index for corruption and exit")
+	statsFlag       = flag.Bool("stats", false, "print statistics about the index and exit")
+	diffFlag        = flag.Bool("diff", false, "print the files that differ between two indexes and exit")
+	maxLineLen      = flag.Int("max-line-len", 0, "skip files with lines longer than `n` bytes (0 for the default, 2000; -1 for no limit)")
+	maxTrigrams     = flag.Int("max-trigrams", 0, "skip files with more than `n` distinct trigrams (0 for the default, 20000; -1 for no limit)")
+	allowInvalid    = flag.Bool("allow-invalid-utf8", false, "index files containing invalid UTF-8")
+	symbolsFlag     = flag.Bool("symbols", true, "record symbol definitions for csearch -sym")
+	identsFlag      = flag.Bool("identifiers", false, "record the words of identifiers in code for csearch -id")
+	regionsFlag     = flag.Bool("regions", false, "record the comments and strings in files for csearch -in")
+	archivesFlag    = flag.Bool("archives", false, "index the files in zip, jar, and tar archives")
+	compressFlag    = flag.Bool("compress", false, "compress the list of file names in the index")
+	storeFlag       = flag.Bool("store-content", false, "store the text of indexed files in the index")
+	nameTrisFlag    = flag.Bool("name-trigrams", false, "record the trigrams of file names, to narrow searches by file name")
+	nfcFlag         = flag.Bool("nfc", false, "index text in Unicode normalization form NFC")
+	dedupeFlag      = flag.Bool("dedupe", false, "share the index entries of files with identical text")
+	filesFrom       = flag.String("files-from", "", "also index the files listed in `file` (- for standard input)")
+	filterFlag      = flag.String("filter-cmd", "", "ask the program `command` whether to index each file")
+	skipListFlag    = flag.String("skip-list", "", "write the files skipped while indexing, and why, to `file`")
+	gitRefFlag      = flag.String("git-ref", "", "index revision `ref` of the named git repositories, in an index of its own")
+	tarFlag         = flag.String("tar", "", "also index the files in the tar stream read from `file` (- for standard input)")
+	tarNameFlag     = flag.String("tar-name", "", "index the -tar stream's files under tar:`name`!/ (default the base name of the file)")
+	bazelExternal   = flag.Bool("bazel-external", false, "also index the external repositories that Bazel fetched for the named workspaces")
+	stopFlag        = flag.Float64("stop-trigrams", 0, "omit the posting lists of trigrams found in more than `fraction` of the files")
+	pairsFlag       = flag.Int("pairs", 0, "precompute the files holding each pair of the `n` most common trigrams, to speed up broad searches")
+	cpuProfile      = flag.String("cpuprofile", "", "write cpu profile to this file")
 )
 
 func main() {
-	excludePatterns = append(excludePatterns, []string{
-		"/.git$",
-		"/node_modules",
-		"/bazel-(bin|out|testlogs)",
-		"/venv",
-		"/.csearchindex",
-		".*/go/pkg/mod",
-	}...)
-	flag.Var(&excludePatterns, "exclude", "re2 patterns to ignore")
+	flag.Var(&excludePatterns, "exclude", "skip directories matching the re2 `pattern`, now and in later runs")
+	flag.Var(&excludePatterns, "add-exclude", "same as -exclude")
+	flag.Var(&removeExcludes, "remove-exclude", "stop skipping directories matching the recorded `pattern`")
+	flag.Var(&attachFiles, "attach", "attach the index in `file`, so that csearch searches it too, and exit")
+	flag.Var(&detachFiles, "detach", "detach the attached index in `file` and exit")
+	flag.Var(&progressMode, "progress", "report progress while indexing (-progress=json for JSON lines)")
+	flag.Var(&dumpMode, "dump", "print the structure of the index and exit (-dump=json for JSON lines)")
+	flag.Var(&maxFileLen, "max-filesize", "skip files longer than `size`, such as 64M (0 for the default, 1G; -1 for no limit)")
+	flag.Var(&maxFileLen, "max-file-len", "same as -max-filesize")
+	flag.Var(&chunkLen, "chunk-size", "index files longer than -max-filesize in segments of `size` instead of skipping them")
+	flag.Var(&maxMem, "max-mem", "use about `size` of memory for the index entries, spilling them to temporary files (default 256M)")
+	flag.Var(&checkpointLen, "checkpoint", "save the progress of the build after each `size` of files indexed, for -resume")
 
+	logging.AddFlags()
 	// flag.Usage = usage
 	flag.Parse()
+	logging.Setup(os.Stderr)
 	args := flag.Args()
 
+	if *gitRefFlag != "" {
+		// The revision has an index of its own.  Naming it in
+		// $CSEARCHINDEX makes the rest of cindex use it, as well as
+		// any cindex that this one starts to compact shards.
+		os.Setenv("CSEARCHINDEX", index.RefFile(index.File(), *gitRefFlag))
+	}
+
 	if *listFlag {
-		ix := index.Open(index.File())
-		for _, arg := range ix.Paths() {
+		for _, arg := range indexedPaths() {
 			fmt.Printf("%s\n", arg)
 		}
 		return
 	}
 
+	if *listExcludes {
+		for _, pattern := range indexedExcludes() {
+			fmt.Printf("%s\n", pattern)
+		}
+		return
+	}
+
+	if *listAttached {
+		for _, file := range indexedAttached() {
+			fmt.Printf("%s\n", file)
+		}
+		return
+	}
+
+	// Apart from -verify, -stats, -dump, -diff, and -merge, which name
+	// their own files, what follows writes the index.
+	if !*verifyFlag && !*statsFlag && dumpMode == "" && !*diffFlag && !*mergeFlag {
+		useRemoteIndex()
+	}
+
+	if len(attachFiles) > 0 || len(detachFiles) > 0 {
+		if len(args) > 0 {
+			usage()
+		}
+		setAttached()
+		publish()
+		return
+	}
+
+	if *compactFlag {
+		if !index.IsSharded(index.File()) {
+			log.Fatalf("-compact: %s is not a sharded index", index.File())
+		}
+		index.CompactShards(index.File())
+		return
+	}
+
+	if *verifyFlag {
+		verifyIndexes(args)
+		return
+	}
+
+	if *statsFlag {
+		printStats(args)
+		return
+	}
+
+	if dumpMode != "" {
+		dumpIndexes(args)
+		return
+	}
+
+	if *diffFlag {
+		if len(args) != 2 {
+			usage()
+		}
+		diffIndexes(args[0], args[1])
+		return
+	}
+
+	if *mergeFlag {
+		if len(args) < 2 {
+			usage()
+		}
+		mergeIndexes(args[0], args[1:])
+		return
+	}
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -109,34 +755,115 @@ func main() {
 	}
 
 	if *resetFlag && len(args) == 0 {
+		if index.IsSharded(index.File()) {
+			for _, file := range index.ShardFiles(index.File()) {
+				os.Remove(file)
+			}
+			return
+		}
 		os.Remove(index.File())
+		index.WritePairs(index.File(), 0)
 		return
 	}
-	if len(args) == 0 {
-		ix := index.Open(index.File())
-		for _, arg := range ix.Paths() {
-			args = append(args, arg)
+	if *filesFrom != "" {
+		if index.IsSharded(index.File()) {
+			log.Fatal("-files-from does not support sharded indexes")
+		}
+		list := readFileList(*filesFrom)
+		if len(args) == 0 && len(list) == 0 {
+			log.Fatalf("-files-from: %s lists no files", *filesFrom)
+		}
+		args = append(args, list...)
+	}
+	if len(args) == 0 && *tarFlag == "" {
+		if *repoFlag != "" {
+			log.Fatal("-repo requires paths to index")
 		}
+		args = withoutTarStreams(indexedPaths())
+		*incrementalFlag = true
 	}
 
 	// Translate paths to absolute paths so that we can
 	// generate the file list in sorted order.
 	for i, arg := range args {
+		if index.IsTarStream(arg) {
+			continue
+		}
 		a, err := filepath.Abs(arg)
 		if err != nil {
-			log.Printf("%s: %s", arg, err)
+			slog.Warn("cannot resolve path", "path", arg, "error", err)
 			args[i] = ""
 			continue
 		}
 		args[i] = a
 	}
+	if *bazelExternal {
+		args = append(args, bazelExternalPaths(args)...)
+	}
+	if *tarFlag != "" {
+		if *gitRefFlag != "" || *watchFlag {
+			log.Fatal("-tar cannot be combined with -git-ref or -watch")
+		}
+		// The stream cannot be read again when searching.
+		*storeFlag = true
+		args = append(args, tarRoot())
+	}
+	for i, arg := range args {
+		if *gitRefFlag != "" && arg != "" {
+			args[i] = gitRefTree(arg, *gitRefFlag)
+			continue
+		}
+		// A git repository stands for the tree of its HEAD.
+		if repo, ref, ok := index.ParseGitTree(arg); ok {
+			args[i] = index.GitTree(repo, ref)
+		}
+	}
 	sort.Strings(args)
 
 	for len(args) > 0 && args[0] == "" {
 		args = args[1:]
 	}
+	// A file list may name a file that is also an argument.
+	n := 0
+	for _, arg := range args {
+		if n == 0 || arg != args[n-1] {
+			args[n] = arg
+			n++
+		}
+	}
+	args = args[:n]
 
+	if *removeFlag {
+		if len(args) == 0 {
+			usage()
+		}
+		removePaths(index.File(), args)
+		publish()
+		return
+	}
+
+	setExcludes()
+	setStorage()
+	setRepos(args)
+
+	// Hold the index lock until the new index is in place,
+	// so that concurrent runs of cindex take turns.
 	master := index.File()
+	unlock := index.Lock(master)
+	if index.IsSharded(master) {
+		if *watchFlag {
+			log.Fatal("-watch does not support sharded indexes")
+		}
+		if *pairsFlag > 0 {
+			log.Fatal("-pairs does not support sharded indexes")
+		}
+		if checkpointLen > 0 || *resumeFlag {
+			log.Fatal("-checkpoint and -resume do not support sharded indexes")
+		}
+		addShard(master, args)
+		unlock()
+		return
+	}
 	if _, err := os.Stat(master); err != nil {
 		// Does not exist.
 		*resetFlag = true
@@ -144,72 +871,562 @@ func main() {
 	file := master
 	if !*resetFlag {
 		file += "~"
+		// The new index is merged into the existing one,
+		// which decides the stop trigrams for both.
+		*stopFlag = 0
 	}
 
-	excludeRegexp := make([]*regexp.Regexp, len(excludePatterns))
-	for i, pattern := range excludePatterns {
-		r, err := regexp.Compile(pattern)
-		if err != nil {
-			panic(err)
+	// In incremental mode, consult the existing index to find
+	// the files that have not changed and need not be reindexed.
+	var old *index.Index
+	seen := make(map[string]bool)
+	// A new -repo applies to the unchanged files too.
+	if *incrementalFlag && !*resetFlag && *repoFlag == "" {
+		old = index.Open(master)
+	}
+	unchanged := func(path string, info os.FileInfo) bool {
+		if old == nil {
+			return false
 		}
-
-		excludeRegexp[i] = r
+		fileid, ok := old.Lookup(path)
+		if !ok || !old.Meta(fileid).Unchanged(info) {
+			return false
+		}
+		seen[filepath.ToSlash(path)] = true
+		return true
 	}
 
-	anyRegexpMatches := func(p string) bool {
-		var anyMatches = false
-		for _, r := range excludeRegexp {
-			if r.MatchString(p, true, true) > 0 {
-				anyMatches = true
-				break
+	checks = startCheckpoints(master, args)
+	writeIndex(file, args, unchanged)
+
+	if old != nil {
+		// Drop the files in the reindexed trees that were not kept
+		// unchanged: those that have disappeared, and those that
+		// changed but were not indexed again, such as a file that
+		// has become binary.  The files indexed again replace their
+		// old entries in any event.
+		removed := func(name string) bool {
+			if seen[name] {
+				return false
 			}
+			for _, arg := range args {
+				if index.InTree(name, arg) {
+					return true
+				}
+			}
+			return false
+		}
+		slog.Info("update", "index", master, "from", file)
+		index.Update(file+"~", master, file, removed)
+		os.Remove(file)
+		index.Rename(file+"~", master)
+	} else if !*resetFlag {
+		slog.Info("merge", "index", master, "from", file)
+		index.Merge(file+"~", master, file)
+		os.Remove(file)
+		index.Rename(file+"~", master)
+	}
+	if checks != nil {
+		checks.discard()
+	}
+	writePairs(master)
+	unlock()
+	publish()
+	slog.Info("done")
+
+	if *watchFlag {
+		watch(master, args)
+	}
+}
+
+// mergeIndexes merges the index files srcs, from oldest to newest,
+// into a new index file out.
+func mergeIndexes(out string, srcs []string) {
+	for _, src := range srcs {
+		if index.IsSharded(src) {
+			log.Fatalf("-merge: %s is a sharded index; use -compact", src)
+		}
+		if _, err := os.Stat(src); err != nil {
+			log.Fatal(err)
 		}
+	}
+	defer index.Lock(out)()
+	slog.Info("merge", "index", out, "from", strings.Join(srcs, " "))
+	index.MergeAll(out+"~", srcs)
+	if err := index.Rename(out+"~", out); err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("done")
+}
+
+// verifyIndexes checks the index files named by args, or else the
+// index or its shards, exiting with status 1 if any is corrupt.
+func verifyIndexes(args []string) {
+	files := args
+	if len(files) == 0 {
+		files = []string{index.File()}
+		if index.IsSharded(index.File()) {
+			files = index.ShardFiles(index.File())
+		}
+	}
+	bad := false
+	for _, file := range files {
+		if err := index.Verify(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			bad = true
+			continue
+		}
+		if *verboseFlag {
+			slog.Info("ok", "index", file)
+		}
+	}
+	if bad {
+		os.Exit(1)
+	}
+}
 
-		return anyMatches
+// gitRefTree returns the index path naming the tree of revision ref in
+// the git repository or checkout path, for cindex -git-ref.  The path
+// may already name that tree, as when reindexing.
+func gitRefTree(path, ref string) string {
+	if repo, r, ok := index.ParseGitTree(path); ok && path == index.GitTree(repo, r) {
+		if r != ref {
+			log.Fatalf("-git-ref %s: %s names revision %s", ref, path, r)
+		}
+		return path
 	}
+	repo, ok := index.GitDir(path)
+	if !ok {
+		log.Fatalf("-git-ref %s: %s is not a git repository or checkout", ref, path)
+	}
+	return index.GitTree(repo, ref)
+}
 
-	ix := index.Create(file)
-	ix.Verbose = *verboseFlag
-	ix.AddPaths(args)
-	for _, arg := range args {
-		log.Printf("index %s", arg)
-		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
-			// Does it match any of our exclude regexes?
-			if info.IsDir() && anyRegexpMatches(path) {
-				if *verboseFlag {
-					log.Printf("skipping dir (due to exclusion): %v\n", path)
-				}
-				return filepath.SkipDir
-			}
+// diffIndexes implements cindex -diff, printing the files that differ
+// between the index files old and new and exiting with status 1 if any do.
+func diffIndexes(old, new string) {
+	for _, file := range []string{old, new} {
+		if index.IsSharded(file) {
+			log.Fatalf("-diff: %s is a sharded index; use -compact", file)
+		}
+		if _, err := os.Stat(file); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ix1, ix2 := index.Open(old), index.Open(new)
+	diffs, unchecked := index.Diff(ix1, ix2)
+	w := bufio.NewWriter(os.Stdout)
+	n := make(map[index.DiffOp]int)
+	for _, d := range diffs {
+		fmt.Fprintf(w, "%s\t%s\n", d.Op, d.Name)
+		n[d.Op]++
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%d added, %d removed, %d changed\n", n[index.DiffAdded], n[index.DiffRemoved], n[index.DiffChanged])
+	if unchecked > 0 {
+		fmt.Fprintf(os.Stderr, "cindex: could not compare the content of %d files: the indexes record neither hashes nor text\n", unchecked)
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
 
-			if _, elem := filepath.Split(path); elem != "" {
-				// Skip various temporary or "hidden" files or directories.
-				if elem[0] == '.' || elem[0] == '#' || elem[0] == '~' || elem[len(elem)-1] == '~' {
-					if info.IsDir() {
-						return filepath.SkipDir
-					}
-					return nil
-				}
+// removePaths removes the trees rooted at roots from the index
+// in the file master, rewriting each of its shards if it is sharded.
+func removePaths(master string, roots []string) {
+	paths := indexedPaths()
+	for _, root := range roots {
+		covers, within := "", ""
+		for _, p := range paths {
+			if index.InTree(p, root) {
+				covers = p
+			} else if index.InTree(root, p) {
+				within = p
 			}
-			if err != nil {
-				log.Printf("%s: %s", path, err)
-				return nil
+		}
+		switch {
+		case covers == "" && within == "":
+			log.Fatalf("-remove: %s is not indexed", root)
+		case covers == "":
+			slog.Warn("path is inside an indexed path; its files will return when that path is reindexed", "path", root, "indexed_path", within)
+		}
+	}
+
+	defer index.Lock(master)()
+	files := []string{master}
+	if index.IsSharded(master) {
+		files = index.ShardFiles(master)
+	}
+	for _, file := range files {
+		slog.Info("remove", "index", file, "paths", strings.Join(roots, " "))
+		index.Remove(file+"~", file, roots)
+		if err := index.Rename(file+"~", file); err != nil {
+			log.Fatal(err)
+		}
+		writePairs(file)
+	}
+	slog.Info("done")
+}
+
+// readFileList returns the files listed in the named file, or standard
+// input for -, separated by NULs if the list contains any and otherwise
+// by newlines.  It omits directories.
+func readFileList(name string) []string {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		log.Fatalf("-files-from: %v", err)
+	}
+	sep := "\n"
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = "\x00"
+	}
+	var files []string
+	for _, f := range strings.Split(string(data), sep) {
+		if f == "" {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil && info.IsDir() {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// indexedPaths returns the paths covered by the index.
+func indexedPaths() []string {
+	if index.IsSharded(index.File()) {
+		return index.OpenSharded(index.File()).Paths()
+	}
+	return index.Open(index.File()).Paths()
+}
+
+// indexedExcludes returns the exclusion patterns recorded in the index.
+func indexedExcludes() []string {
+	file := index.File()
+	if _, err := os.Stat(file); err != nil {
+		return nil
+	}
+	if index.IsSharded(file) {
+		return index.OpenSharded(file).Excludes()
+	}
+	return index.Open(file).Excludes()
+}
+
+// writePairs writes the pairs file of the index file for -pairs, or,
+// if -pairs is not set, for the number of trigrams the existing pairs
+// file was written for, so that updates keep it up to date until the
+// index is reset.  If there is to be no pairs file, writePairs removes
+// any stale one.
+func writePairs(file string) {
+	n := *pairsFlag
+	if n == 0 && !*resetFlag {
+		n = index.PairTrigrams(file)
+	}
+	if n > 0 {
+		slog.Info("precompute pairs", "index", file, "trigrams", n)
+	}
+	if err := index.WritePairs(file, n); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setStorage sets the -compress, -store-content, -name-trigrams,
+// -identifiers, -regions, -nfc, and -dedupe flags if the existing index
+// compresses names, stores contents, records name trigrams, identifiers,
+// or regions, normalizes text, or shares the entries of identical
+// files, so that updates keep
+// doing so until the index is reset, and rejects -nfc for an index
+// holding text that is not normalized.  It also sets
+// -stop-trigrams to the stop fraction recorded in a sharded index,
+// for its new shards, and rejects a different one for an index file.
+func setStorage() {
+	file := index.File()
+	if *stopFlag < 0 || *stopFlag >= 1 {
+		log.Fatalf("-stop-trigrams: fraction %g is not between 0 and 1", *stopFlag)
+	}
+	if *resetFlag {
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		return
+	}
+	var ixs []*index.Index
+	if index.IsSharded(file) {
+		ixs = index.OpenSharded(file).Shards
+	} else {
+		ixs = []*index.Index{index.Open(file)}
+	}
+	for _, ix := range ixs {
+		if ix.Compressed() {
+			*compressFlag = true
+		}
+		if ix.HasContent() {
+			*storeFlag = true
+		}
+		if ix.HasNameTrigrams() {
+			*nameTrisFlag = true
+		}
+		if ix.HasIdentifiers() {
+			*identsFlag = true
+		}
+		if ix.HasRegions() {
+			*regionsFlag = true
+		}
+		if ix.Deduped() {
+			*dedupeFlag = true
+		}
+	}
+	normalized, unnormalized := false, false
+	for _, ix := range ixs {
+		if ix.Normalized() {
+			normalized = true
+		} else if ix.NumFiles() > 0 {
+			unnormalized = true
+		}
+	}
+	switch {
+	case normalized:
+		*nfcFlag = true
+	case unnormalized && *nfcFlag:
+		log.Fatal("-nfc: index holds text that is not normalized; use -reset to normalize it")
+	}
+	if len(ixs) == 0 {
+		return
+	}
+	stop := ixs[len(ixs)-1].StopFraction()
+	switch {
+	case index.IsSharded(file):
+		if *stopFlag == 0 {
+			*stopFlag = stop
+		}
+	case *stopFlag != 0 && *stopFlag != stop:
+		log.Fatalf("-stop-trigrams: index records stop fraction %g; use -reset to change it", stop)
+	}
+}
+
+// setExcludes sets recordedExcludes and excludeRegexp
+// according to the index and the exclusion flags.
+func setExcludes() {
+	recordedExcludes = []string{}
+	if !*resetFlag {
+		recordedExcludes = append(recordedExcludes, indexedExcludes()...)
+	}
+	for _, pattern := range removeExcludes {
+		i := 0
+		for i < len(recordedExcludes) && recordedExcludes[i] != pattern {
+			i++
+		}
+		if i == len(recordedExcludes) {
+			log.Fatalf("-remove-exclude: %s is not recorded in the index", pattern)
+		}
+		recordedExcludes = append(recordedExcludes[:i], recordedExcludes[i+1:]...)
+	}
+Add:
+	for _, pattern := range excludePatterns {
+		for _, p := range recordedExcludes {
+			if p == pattern {
+				continue Add
 			}
-			if info != nil && info.Mode()&os.ModeType == 0 {
-				ix.AddFile(path)
+		}
+		recordedExcludes = append(recordedExcludes, pattern)
+	}
+
+	patterns := append(append([]string{}, defaultExcludes...), recordedExcludes...)
+	excludeRegexp = make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("exclusion pattern %s: %v", pattern, err)
+		}
+		excludeRegexp[i] = r
+	}
+}
+
+// writeIndex writes to file a new index of the trees rooted at paths.
+// If unchanged is not nil, it reports files that need not be indexed.
+func writeIndex(file string, paths []string, unchanged func(path string, info os.FileInfo) bool) {
+	ix := index.Create(file)
+	ix.Verbose = *verboseFlag
+	ix.LogSkip = *verboseFlag
+	ix.UseGitignore = *gitignoreFlag
+	ix.UseCsearchignore = *csignoreFlag
+	ix.FollowSymlinks = *symlinksFlag
+	setHidden(ix)
+	ix.GitTracked = *gitFlag || *submodulesFlag
+	ix.GitSubmodules = *submodulesFlag
+	ix.GitRef = *gitRefFlag
+	ix.Symbols = *symbolsFlag
+	ix.Identifiers = *identsFlag
+	ix.Regions = *regionsFlag
+	ix.Archives = *archivesFlag
+	ix.Compress = *compressFlag
+	ix.StoreContent = *storeFlag
+	ix.NameTrigrams = *nameTrisFlag
+	ix.Normalize = *nfcFlag
+	ix.Dedupe = *dedupeFlag
+	ix.StopFraction = *stopFlag
+	ix.Excludes = recordedExcludes
+	ix.Filter = filterFunc()
+	setLimits(ix)
+	addRepos(ix)
+	named := make(map[string]bool)
+	for _, p := range paths {
+		named[p] = true
+	}
+	if checks != nil {
+		checks.setup(ix)
+	}
+	ix.Skip = func(path string, info os.FileInfo) bool {
+		if checks != nil && checks.skip(path, info) {
+			return true
+		}
+		// A file named explicitly is indexed even if it is excluded.
+		if !(named[path] && info.Mode().IsRegular()) && skip(path, info) {
+			ix.ReportSkip(path, index.SkipExcluded)
+			return true
+		}
+		return unchanged != nil && info.Mode().IsRegular() && unchanged(path, info)
+	}
+	skips := trackSkips(ix)
+	ix.SetConcurrency(*jobsFlag)
+	var p *progress
+	if progressMode != "" {
+		p = startProgress(ix, paths)
+	}
+	ix.AddPaths(paths)
+	for i, arg := range paths {
+		if checks != nil {
+			if checks.skipPath(i) {
+				continue
 			}
-			return nil
-		})
+			checks.begin(i)
+		}
+		slog.Info("index", "path", arg)
+		if index.IsTarStream(arg) {
+			addTarStream(ix, arg)
+			continue
+		}
+		if repo, ref, ok := index.ParseGitTree(arg); ok {
+			ix.AddGitTree(repo, ref)
+			continue
+		}
+		ix.AddTree(arg)
 	}
-	log.Printf("flush index")
+	slog.Info("flush index")
 	ix.Flush()
+	if checks != nil {
+		checks.finish(file)
+	}
+	if p != nil {
+		p.done()
+	}
+	skips.report()
+}
 
-	if !*resetFlag {
-		log.Printf("merge %s %s", master, file)
-		index.Merge(file+"~", master, file)
-		os.Remove(file)
-		os.Rename(file+"~", master)
+// setRepos sets pathRepos for the given paths according to the
+// -repo flag, or else the repositories recorded in the index.
+func setRepos(paths []string) {
+	pathRepos = make(map[string]string)
+	if *repoFlag != "" {
+		for _, p := range paths {
+			pathRepos[p] = *repoFlag
+		}
+		return
+	}
+	file := index.File()
+	if _, err := os.Stat(file); err != nil || *resetFlag {
+		return
+	}
+	var ix interface{ PathRepo(path string) string }
+	if index.IsSharded(file) {
+		ix = index.OpenSharded(file)
+	} else {
+		ix = index.Open(file)
+	}
+	for _, p := range paths {
+		if repo := ix.PathRepo(p); repo != "" {
+			pathRepos[p] = repo
+		}
+	}
+}
+
+// addRepos records pathRepos in ix.
+func addRepos(ix *index.IndexWriter) {
+	for p, repo := range pathRepos {
+		ix.SetRepo(p, repo)
+	}
+}
+
+// setLimits applies the limits set by flags to ix.
+func setLimits(ix *index.IndexWriter) {
+	ix.MaxFileLen = int64(maxFileLen)
+	ix.ChunkLen = int64(chunkLen)
+	ix.MaxMem = int64(maxMem)
+	ix.MaxLineLen = *maxLineLen
+	ix.MaxTextTrigrams = *maxTrigrams
+	ix.AllowInvalidUTF8 = *allowInvalid
+}
+
+// setHidden sets the names that ix skips as hidden or temporary:
+// the defaults, less dot files with -hidden.
+func setHidden(ix *index.IndexWriter) {
+	ix.SkipPrefixes = nil
+	for _, p := range index.DefaultSkipPrefixes {
+		if p == "." && *hiddenFlag {
+			continue
+		}
+		ix.SkipPrefixes = append(ix.SkipPrefixes, p)
+	}
+	ix.SkipSuffixes = index.DefaultSkipSuffixes
+}
+
+// hidden reports whether cindex skips the file or directory path
+// as hidden or temporary.
+func hidden(path string) bool {
+	var ix index.IndexWriter
+	setHidden(&ix)
+	return ix.Hidden(filepath.Base(path))
+}
+
+// skip reports whether the walk should skip the file or directory path
+// because it matches an exclusion pattern.
+func skip(path string, info os.FileInfo) bool {
+	// Does it match any of our exclude regexes?
+	return info.IsDir() && anyRegexpMatches(path)
+}
+
+func anyRegexpMatches(p string) bool {
+	// Patterns use slashes, whatever the system.
+	p = filepath.ToSlash(p)
+	for _, r := range excludeRegexp {
+		if r.MatchString(p, true, true) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// bazelExternalPaths returns the directories holding the external
+// repositories that Bazel fetched for the workspaces among paths.
+func bazelExternalPaths(paths []string) []string {
+	var ext []string
+	for _, p := range paths {
+		if p == "" || !index.IsBazelWorkspace(p) {
+			continue
+		}
+		dir, ok := index.BazelExternal(p)
+		if !ok {
+			slog.Warn("no Bazel external repositories; build in the workspace first", "path", p)
+			continue
+		}
+		ext = append(ext, dir)
 	}
-	log.Printf("done")
-	return
+	return ext
 }
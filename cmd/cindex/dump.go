@@ -0,0 +1,141 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/codesearch/index"
+)
+
+// A dumpFlag is the value of the -dump flag:
+// "" for no dump, "text", or "json".
+type dumpFlag string
+
+func (f *dumpFlag) String() string {
+	return string(*f)
+}
+
+func (f *dumpFlag) Set(s string) error {
+	switch s {
+	case "true", "text":
+		*f = "text"
+	case "false":
+		*f = ""
+	case "json":
+		*f = "json"
+	default:
+		return fmt.Errorf("want text or json")
+	}
+	return nil
+}
+
+// IsBoolFlag allows -dump alone to mean -dump=text.
+func (f *dumpFlag) IsBoolFlag() bool {
+	return true
+}
+
+// A dumpRecord is a line printed by -dump=json.
+type dumpRecord struct {
+	Kind    string `json:"kind"` // index, part, path, name, or posting
+	File    string `json:"file,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Doc     string `json:"doc,omitempty"`
+	FileID  *int   `json:"fileid,omitempty"`
+	Trigram string `json:"trigram,omitempty"`
+	Hex     string `json:"hex,omitempty"` // the trigram in hexadecimal
+	Files   int    `json:"files,omitempty"`
+	Offset  *int64 `json:"offset,omitempty"`
+	Size    *int64 `json:"size,omitempty"`
+	Roaring bool   `json:"roaring,omitempty"`
+}
+
+// dumpIndexes implements cindex -dump: it prints the structure of the
+// index files named by args, or else the index (each of its shards,
+// if it is sharded).
+func dumpIndexes(args []string) {
+	files := args
+	if len(files) == 0 {
+		files = []string{index.File()}
+		if index.IsSharded(index.File()) {
+			files = index.ShardFiles(index.File())
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for i, file := range files {
+		if i > 0 && dumpMode == "text" {
+			fmt.Fprintln(w)
+		}
+		ix := index.Open(file)
+		if dumpMode == "json" {
+			dumpJSON(w, file, ix)
+		} else {
+			dumpText(w, file, ix)
+		}
+		ix.Close()
+	}
+}
+
+// dumpText writes the structure of ix, read from the named file, to w.
+func dumpText(w io.Writer, file string, ix *index.Index) {
+	st := ix.Stats(0)
+	fmt.Fprintf(w, "%s: version %d, %d bytes\n", file, ix.Version(), st.Size)
+	fmt.Fprintf(w, "parts:\n")
+	for _, p := range st.Parts {
+		fmt.Fprintf(w, "\t@%-10d %10d  %s: %s\n", p.Offset, p.Size, p.Name, index.PartDoc(p.Name))
+	}
+	fmt.Fprintf(w, "paths:\n")
+	for _, p := range ix.Paths() {
+		fmt.Fprintf(w, "\t%s\n", p)
+	}
+	fmt.Fprintf(w, "names:\n")
+	for e := range ix.NameEntries() {
+		fmt.Fprintf(w, "\t%-8d @%-10d %s\n", e.FileID, e.Offset, e.Name)
+	}
+	fmt.Fprintf(w, "posting lists:\n")
+	for p := range ix.Postings() {
+		roaring := ""
+		if p.Roaring {
+			roaring = "  roaring"
+		}
+		fmt.Fprintf(w, "\t%-14q %8d files  @%-10d %8d bytes%s\n", p.Trigram, p.Files, p.Offset, p.Size, roaring)
+	}
+}
+
+// dumpJSON writes the structure of ix, read from the named file,
+// to w as JSON lines.
+func dumpJSON(w io.Writer, file string, ix *index.Index) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	st := ix.Stats(0)
+	enc.Encode(&dumpRecord{Kind: "index", File: file, Version: ix.Version(), Size: &st.Size})
+	for _, p := range st.Parts {
+		enc.Encode(&dumpRecord{Kind: "part", Name: p.Name, Doc: index.PartDoc(p.Name), Offset: &p.Offset, Size: &p.Size})
+	}
+	for _, p := range ix.Paths() {
+		enc.Encode(&dumpRecord{Kind: "path", Name: p})
+	}
+	for e := range ix.NameEntries() {
+		id := int(e.FileID)
+		enc.Encode(&dumpRecord{Kind: "name", FileID: &id, Name: e.Name, Offset: &e.Offset})
+	}
+	for p := range ix.Postings() {
+		enc.Encode(&dumpRecord{
+			Kind:    "posting",
+			Trigram: p.Trigram,
+			Hex:     fmt.Sprintf("%x", p.Trigram),
+			Files:   p.Files,
+			Offset:  &p.Offset,
+			Size:    &p.Size,
+			Roaring: p.Roaring,
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Filter commands.
+//
+// Cindex -filter-cmd runs a program that decides which files to index,
+// so that an organization can enforce its own policies, such as leaving
+// out files that hold secrets, without changing cindex.  Cindex starts
+// the program once and writes to its standard input the name of each
+// file that it would otherwise index, one per line.  For each name,
+// the program must write a line to its standard output: skip to leave
+// the file out of the index, or anything else, such as index, to index
+// it.  If the program fails, cindex stops rather than index files the
+// program has not approved.
+
+// A filterCmd is a running -filter-cmd program.
+type filterCmd struct {
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	w     *bufio.Writer
+	r     *bufio.Reader
+}
+
+var filter *filterCmd
+
+// filterFunc returns the function that consults the -filter-cmd
+// program about a file, starting the program if need be,
+// or nil if there is no -filter-cmd.
+func filterFunc() func(path string, info os.FileInfo) bool {
+	if *filterFlag == "" {
+		return nil
+	}
+	if filter == nil {
+		filter = startFilter(*filterFlag)
+	}
+	return filter.skip
+}
+
+// startFilter starts the filter program given by command,
+// a program name followed by its arguments, separated by spaces.
+func startFilter(command string) *filterCmd {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		log.Fatal("-filter-cmd: no command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatalf("-filter-cmd: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Fatalf("-filter-cmd: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("-filter-cmd: %v", err)
+	}
+	return &filterCmd{
+		cmd:   cmd,
+		stdin: stdin,
+		w:     bufio.NewWriter(stdin),
+		r:     bufio.NewReader(stdout),
+	}
+}
+
+// skip reports whether the filter program rejects the file path.
+// A name containing a newline cannot be sent to the program,
+// so such a file is always skipped.
+func (f *filterCmd) skip(path string, info os.FileInfo) bool {
+	if strings.ContainsAny(path, "\r\n") {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.w.WriteString(path)
+	f.w.WriteByte('\n')
+	if err := f.w.Flush(); err != nil {
+		f.fail(err)
+	}
+	line, err := f.r.ReadString('\n')
+	if err != nil {
+		f.fail(err)
+	}
+	return strings.TrimSpace(line) == "skip"
+}
+
+// fail reports that the filter program failed, with err,
+// and exits.
+func (f *filterCmd) fail(err error) {
+	f.stdin.Close()
+	if werr := f.cmd.Wait(); werr != nil {
+		err = werr
+	}
+	log.Fatalf("-filter-cmd %s: %v", f.cmd.Path, err)
+}
@@ -0,0 +1,170 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/google/codesearch/index"
+)
+
+// A progressFlag is the value of the -progress flag:
+// "" for no reports, "text", or "json".
+type progressFlag string
+
+func (f *progressFlag) String() string {
+	return string(*f)
+}
+
+func (f *progressFlag) Set(s string) error {
+	switch s {
+	case "true", "text":
+		*f = "text"
+	case "false":
+		*f = ""
+	case "json":
+		*f = "json"
+	default:
+		return fmt.Errorf("want text or json")
+	}
+	return nil
+}
+
+// IsBoolFlag allows -progress alone to mean -progress=text.
+func (f *progressFlag) IsBoolFlag() bool {
+	return true
+}
+
+// progressInterval is the time between progress reports.
+const progressInterval = time.Second
+
+// A progress reports on the progress of indexing.
+type progress struct {
+	start      time.Time
+	last       time.Time // time of the last report
+	files      int       // files finished so far
+	bytes      int64     // total size of files finished so far
+	totalFiles int       // files to index, counted before indexing
+	totalBytes int64
+}
+
+// A progressReport is a report printed by -progress=json.
+type progressReport struct {
+	Path        string  `json:"path,omitempty"` // file just finished
+	Files       int     `json:"files"`
+	TotalFiles  int     `json:"total_files"`
+	Bytes       int64   `json:"bytes"`
+	TotalBytes  int64   `json:"total_bytes"`
+	FilesPerSec float64 `json:"files_per_sec"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+	Elapsed     float64 `json:"elapsed_sec"`
+	ETA         float64 `json:"eta_sec"` // -1 if not yet known
+	Done        bool    `json:"done,omitempty"`
+}
+
+// startProgress counts the files in paths that ix will index and
+// arranges for ix to report its progress through them.
+func startProgress(ix *index.IndexWriter, paths []string) *progress {
+	p := new(progress)
+	for _, path := range paths {
+		if _, _, ok := index.ParseGitTree(path); ok {
+			continue
+		}
+		n, size := ix.CountTree(path)
+		p.totalFiles += n
+		p.totalBytes += size
+	}
+	p.start = time.Now()
+	p.last = p.start
+	ix.Progress = p.add
+	return p
+}
+
+// add records that the named file has been indexed.
+func (p *progress) add(name string, size int64) {
+	p.files++
+	p.bytes += size
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.report(name, false)
+	}
+}
+
+// done prints the final report.
+func (p *progress) done() {
+	p.report("", true)
+}
+
+// report prints a report, in the form requested by -progress.
+func (p *progress) report(name string, done bool) {
+	r := &progressReport{
+		Path:       name,
+		Files:      p.files,
+		TotalFiles: p.totalFiles,
+		Bytes:      p.bytes,
+		TotalBytes: p.totalBytes,
+		Elapsed:    time.Since(p.start).Seconds(),
+		ETA:        -1,
+		Done:       done,
+	}
+	if r.Elapsed > 0 {
+		r.FilesPerSec = float64(r.Files) / r.Elapsed
+		r.BytesPerSec = float64(r.Bytes) / r.Elapsed
+	}
+	// Most of the time goes to reading files, so estimate the time
+	// remaining from the bytes left to read, or else the files left.
+	switch {
+	case done:
+		r.ETA = 0
+	case r.BytesPerSec > 0 && r.TotalBytes > 0:
+		r.ETA = float64(max(r.TotalBytes-r.Bytes, 0)) / r.BytesPerSec
+	case r.FilesPerSec > 0:
+		r.ETA = float64(max(r.TotalFiles-r.Files, 0)) / r.FilesPerSec
+	}
+
+	if progressMode == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	percent := 100.0
+	if r.TotalBytes > 0 {
+		percent = 100 * float64(min(r.Bytes, r.TotalBytes)) / float64(r.TotalBytes)
+	}
+	left := "?"
+	if r.ETA >= 0 {
+		left = time.Duration(r.ETA * float64(time.Second)).Round(time.Second).String()
+	}
+	msg := fmt.Sprintf("%d/%d files, %s/%s (%.0f%%), %.0f files/s, %s/s, %s left",
+		r.Files, r.TotalFiles, formatBytes(float64(r.Bytes)), formatBytes(float64(r.TotalBytes)),
+		percent, r.FilesPerSec, formatBytes(r.BytesPerSec), left)
+	if done {
+		msg = fmt.Sprintf("indexed %d files, %s, in %v", r.Files, formatBytes(float64(r.Bytes)),
+			time.Since(p.start).Round(time.Millisecond))
+	} else if name != "" {
+		msg += ": " + name
+	}
+	slog.Info(msg)
+}
+
+// formatBytes formats the byte count n for people to read.
+func formatBytes(n float64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	suffix := "KMGTPE"
+	i := 0
+	for n /= unit; n >= unit && i < len(suffix)-1; n /= unit {
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", n, suffix[i])
+}
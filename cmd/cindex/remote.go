@@ -0,0 +1,48 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/google/codesearch/index"
+)
+
+// remoteIndex is the remote index that cindex is updating, if any.
+var remoteIndex string
+
+// useRemoteIndex arranges for cindex to update the remote index named
+// by $CSEARCHINDEX, if it is one, by working on its cached copy, which
+// publish then stores back.
+func useRemoteIndex() {
+	file := index.File()
+	if !index.IsRemote(file) {
+		return
+	}
+	if *watchFlag {
+		log.Fatal("-watch does not support remote indexes")
+	}
+	local, err := index.Fetch(file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+	remoteIndex = file
+	os.Setenv("CSEARCHINDEX", local)
+}
+
+// publish stores the updated index as the remote index, if any.
+func publish() {
+	if remoteIndex == "" {
+		return
+	}
+	slog.Info("publish", "index", remoteIndex)
+	if err := index.Publish(index.File(), remoteIndex); err != nil {
+		log.Fatal(err)
+	}
+}
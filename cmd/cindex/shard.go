@@ -0,0 +1,59 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/google/codesearch/index"
+)
+
+// maxShards is the number of shards a sharded index can hold
+// before cindex starts a background compaction.  Each indexed tree
+// has its own shard, and shards replaced by newer ones are removed,
+// so the limit is on the number of trees, not of runs of cindex.
+const maxShards = 64
+
+// addShard indexes each of the trees rooted at paths into a new shard
+// of the sharded index in dir, and then removes the shards that the
+// new ones replace.
+func addShard(dir string, paths []string) {
+	old := index.ShardFiles(dir)
+	for _, path := range paths {
+		file := index.NextShard(dir)
+		writeIndex(file+"~", []string{path}, nil)
+		if err := index.Rename(file+"~", file); err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("added shard", "index", file)
+	}
+
+	if *resetFlag {
+		// The new shards replace all the old ones.
+		for _, f := range old {
+			os.Remove(f)
+		}
+		return
+	}
+	index.RemoveShadowedShards(dir)
+	if len(index.ShardFiles(dir)) > maxShards {
+		compactBackground()
+	}
+}
+
+// compactBackground starts a new cindex process to compact the
+// sharded index, leaving it running after this process exits.
+func compactBackground() {
+	cmd := exec.Command(os.Args[0], "-compact")
+	if err := cmd.Start(); err != nil {
+		slog.Warn("cannot start compaction", "error", err)
+		return
+	}
+	slog.Info("compacting shards in background", "pid", cmd.Process.Pid)
+	cmd.Process.Release()
+}
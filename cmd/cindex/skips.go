@@ -0,0 +1,71 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+
+	"github.com/google/codesearch/index"
+)
+
+// skipListFile is the file opened by -skip-list, if any.
+var skipListFile *bufio.Writer
+
+// A skipTally counts the files and directories
+// an IndexWriter skips, by reason.
+type skipTally map[index.SkipReason]int
+
+// trackSkips sets ix to count the files and directories it skips in
+// the returned tally, listing them in the -skip-list file if any.
+func trackSkips(ix *index.IndexWriter) skipTally {
+	if *skipListFlag != "" && skipListFile == nil {
+		f, err := os.Create(*skipListFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		skipListFile = bufio.NewWriter(f)
+	}
+	tally := make(skipTally)
+	ix.OnSkip = func(path string, reason index.SkipReason) {
+		tally[reason]++
+		if skipListFile != nil {
+			fmt.Fprintf(skipListFile, "%s\t%s\n", reason, path)
+		}
+	}
+	return tally
+}
+
+// report logs the tally, in decreasing order of count,
+// and flushes the -skip-list file.
+func (t skipTally) report() {
+	if skipListFile != nil {
+		if err := skipListFile.Flush(); err != nil {
+			log.Fatalf("-skip-list: %v", err)
+		}
+	}
+	if len(t) == 0 {
+		return
+	}
+	var reasons []index.SkipReason
+	total := 0
+	for r, n := range t {
+		reasons = append(reasons, r)
+		total += n
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		ri, rj := reasons[i], reasons[j]
+		return t[ri] > t[rj] || t[ri] == t[rj] && ri < rj
+	})
+	args := []any{"total", total}
+	for _, r := range reasons {
+		args = append(args, string(r), t[r])
+	}
+	slog.Info("skipped files", args...)
+}
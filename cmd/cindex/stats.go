@@ -0,0 +1,87 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/codesearch/index"
+)
+
+// numLargest is the number of largest files that cindex -stats lists.
+const numLargest = 10
+
+// printStats implements cindex -stats: it prints statistics about the
+// index files named by args, or else the index (each of its shards,
+// if it is sharded).
+func printStats(args []string) {
+	files := args
+	if len(files) == 0 {
+		files = []string{index.File()}
+		if index.IsSharded(index.File()) {
+			files = index.ShardFiles(index.File())
+		}
+	}
+	for i, file := range files {
+		if i > 0 {
+			fmt.Println()
+		}
+		ix := index.Open(file)
+		writeStats(os.Stdout, file, ix.Stats(numLargest))
+		ix.Close()
+	}
+}
+
+// writeStats writes st, the statistics for the named index, to w.
+func writeStats(w io.Writer, file string, st *index.Stats) {
+	fmt.Fprintf(w, "%s: %s\n", file, formatBytes(float64(st.Size)))
+	if st.Bytes > 0 {
+		fmt.Fprintf(w, "files: %d, %s (index is %s of indexed size)\n",
+			st.Files, formatBytes(float64(st.Bytes)), percent(st.Size, st.Bytes))
+	} else {
+		fmt.Fprintf(w, "files: %d\n", st.Files)
+	}
+	perTrigram := 0.0
+	if st.Trigrams > 0 {
+		perTrigram = float64(st.Postings) / float64(st.Trigrams)
+	}
+	fmt.Fprintf(w, "trigrams: %d distinct, %d postings, %.1f files per trigram\n",
+		st.Trigrams, st.Postings, perTrigram)
+	if st.StopFraction > 0 {
+		fmt.Fprintf(w, "stop trigrams: %d, found in more than %g%% of files\n",
+			st.StopTrigrams, 100*st.StopFraction)
+	}
+	if st.Aliases > 0 {
+		fmt.Fprintf(w, "aliases: %d files share the entries of identical files\n", st.Aliases)
+	}
+
+	fmt.Fprintf(w, "posting lists:\n")
+	lo := 1
+	for _, n := range st.PostingSizes {
+		fmt.Fprintf(w, "\t%d-%d files: %d trigrams (%s)\n", lo, 10*lo-1, n, percent(int64(n), int64(st.Trigrams)))
+		lo *= 10
+	}
+
+	if len(st.Largest) > 0 {
+		fmt.Fprintf(w, "largest files:\n")
+		for _, f := range st.Largest {
+			fmt.Fprintf(w, "\t%10s  %s\n", formatBytes(float64(f.Size)), f.Name)
+		}
+	}
+
+	fmt.Fprintf(w, "index parts:\n")
+	for _, p := range st.Parts {
+		fmt.Fprintf(w, "\t%10s  %5s  %s\n", formatBytes(float64(p.Size)), percent(p.Size, st.Size), p.Name)
+	}
+}
+
+func percent(n, total int64) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
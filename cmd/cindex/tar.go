@@ -0,0 +1,67 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/codesearch/index"
+)
+
+// tarRoot returns the indexed path under which -tar indexes the
+// files of the tar stream: tar:label, where the label is set by
+// -tar-name or else is the base name of the -tar file.
+func tarRoot() string {
+	label := *tarNameFlag
+	if label == "" {
+		if *tarFlag == "-" {
+			log.Fatal("-tar -: use -tar-name to name the stream")
+		}
+		label = filepath.Base(*tarFlag)
+	}
+	if strings.Contains(label, "!/") {
+		log.Fatalf("-tar-name: invalid name %q", label)
+	}
+	return index.TarStream(label)
+}
+
+// tarInput returns the tar stream named by -tar.
+func tarInput() io.Reader {
+	if *tarFlag == "-" {
+		return os.Stdin
+	}
+	f, err := os.Open(*tarFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+// addTarStream indexes the tar stream named by -tar in ix under root.
+func addTarStream(ix *index.IndexWriter, root string) {
+	r := tarInput()
+	if err := ix.AddTarStream(root, r); err != nil {
+		log.Fatalf("-tar: %v", err)
+	}
+	if c, ok := r.(io.Closer); ok && r != os.Stdin {
+		c.Close()
+	}
+}
+
+// withoutTarStreams returns the paths other than tar streams, which
+// cannot be read again to reindex them, so that reindexing keeps them.
+func withoutTarStreams(paths []string) []string {
+	var keep []string
+	for _, p := range paths {
+		if !index.IsTarStream(p) {
+			keep = append(keep, p)
+		}
+	}
+	return keep
+}
@@ -0,0 +1,202 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/codesearch/index"
+)
+
+// watchDelay is how long the watcher waits for file system activity
+// to settle before updating the index.
+const watchDelay = 1 * time.Second
+
+// watch watches the trees rooted at roots for changes and applies
+// them to the index in the file master.  It never returns.
+func watch(master string, roots []string) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, root := range roots {
+		if _, _, ok := index.ParseGitTree(root); ok {
+			continue
+		}
+		addWatches(w, root, nil)
+	}
+	slog.Info("watching for changes", "paths", len(roots))
+
+	var (
+		changed = make(map[string]bool)
+		timer   = time.NewTimer(watchDelay)
+	)
+	timer.Stop()
+	for {
+		select {
+		case ev := <-w.Events:
+			if *verboseFlag {
+				slog.Info("watch", "event", ev.Op.String(), "path", ev.Name)
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+					// Watch the new directory and index anything
+					// created in it before the watch was in place.
+					addWatches(w, ev.Name, changed)
+				}
+			}
+			changed[ev.Name] = true
+			timer.Reset(watchDelay)
+
+		case err := <-w.Errors:
+			slog.Warn("watch", "error", err)
+
+		case <-timer.C:
+			var paths []string
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			changed = make(map[string]bool)
+			update(master, paths)
+		}
+	}
+}
+
+// addWatches adds watches for root and all the directories beneath it.
+// If files is not nil, addWatches records in it the files it finds.
+func addWatches(w *fsnotify.Watcher, root string, files map[string]bool) {
+	ignored := newIgnored()
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			slog.Warn("cannot read", "path", path, "error", err)
+			return nil
+		}
+		if path != root && (skip(path, info) || hidden(path) || ignored(path, info.IsDir())) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := w.Add(path); err != nil {
+				slog.Warn("cannot watch", "path", path, "error", err)
+			}
+		} else if files != nil {
+			files[path] = true
+		}
+		return nil
+	})
+}
+
+// newIgnored returns a function reporting whether a file or directory
+// is ignored by the .gitignore files, if cindex is respecting them,
+// or by the .csearchignore files, if it is respecting those.
+func newIgnored() func(path string, isDir bool) bool {
+	var sets []*index.Gitignore
+	if *gitignoreFlag {
+		sets = append(sets, index.NewGitignore())
+	}
+	if *csignoreFlag {
+		sets = append(sets, index.NewCsearchignore())
+	}
+	return func(path string, isDir bool) bool {
+		for _, g := range sets {
+			if g.Ignored(path, isDir) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// update applies changes to the named paths to the index in the file master.
+// Each path may name a file or directory that was created, modified, or removed.
+func update(master string, paths []string) {
+	defer index.Lock(master)()
+	sort.Strings(paths)
+	file := master + "~"
+	ix := index.Create(file)
+	ix.Verbose = *verboseFlag
+	ix.LogSkip = *verboseFlag
+	skips := trackSkips(ix)
+	ix.Symbols = *symbolsFlag
+	ix.Identifiers = *identsFlag
+	ix.Regions = *regionsFlag
+	ix.Compress = *compressFlag
+	ix.StoreContent = *storeFlag
+	ix.NameTrigrams = *nameTrisFlag
+	ix.Normalize = *nfcFlag
+	ix.Dedupe = *dedupeFlag
+	ix.Excludes = recordedExcludes
+	ix.Filter = filterFunc()
+	setHidden(ix)
+	setLimits(ix)
+	addRepos(ix)
+	ignored := newIgnored()
+	n := 0
+	changed := make(map[string]bool)
+	gone := make(map[string]bool)
+	for _, path := range paths {
+		// The index names files with slashes (see index.InTree).
+		changed[filepath.ToSlash(path)] = true
+		info, err := os.Lstat(path)
+		if err != nil {
+			gone[filepath.ToSlash(path)] = true
+			continue
+		}
+		if info.Mode()&os.ModeType != 0 || skip(path, info) || hidden(path) || ignored(path, false) {
+			continue
+		}
+		if (*gitFlag || *submodulesFlag) && !index.IsGitTracked(path) {
+			continue
+		}
+		if ix.Filter != nil && ix.Filter(path, info) {
+			continue
+		}
+		if *archivesFlag && index.IsArchive(path) {
+			ix.AddArchive(path)
+		} else {
+			ix.AddFile(path)
+		}
+		n++
+	}
+	ix.Flush()
+	skips.report()
+
+	// Drop the old entries for every changed path, along with any
+	// files beneath a removed path that might have been a directory
+	// and the old members of changed archives.
+	// Files that still exist were just reindexed and replace
+	// their old entries anyway.
+	removed := func(name string) bool {
+		if changed[name] {
+			return true
+		}
+		if archive, _, ok := index.SplitArchiveName(name); ok && changed[archive] {
+			return true
+		}
+		for {
+			dir := filepath.ToSlash(filepath.Dir(name))
+			if dir == name {
+				return false
+			}
+			if gone[dir] {
+				return true
+			}
+			name = dir
+		}
+	}
+	index.Update(file+"~", master, file, removed)
+	os.Remove(file)
+	index.Rename(file+"~", master)
+	writePairs(master)
+	slog.Info("updated index", "paths_changed", len(paths), "files_reindexed", n)
+}
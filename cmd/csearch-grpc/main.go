@@ -0,0 +1,143 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/google/codesearch/cmd/internal/logging"
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/search"
+	pb "github.com/google/codesearch/search/searchpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var usageMessage = `usage: csearch-grpc [-listen addr] [-index file] [-timeout d]
+
+Csearch-grpc serves searches over a trigram index using gRPC.
+Like csearchd, it opens the index once and keeps it mapped into memory.
+
+The index is the file named by the -index flag, or else $CSEARCHINDEX,
+or else $HOME/.csearchindex.
+
+Csearch-grpc implements the CodeSearch service defined in
+github.com/google/codesearch/search/searchpb/search.proto.
+Its Search method streams each matching line to the client as soon
+as it is found, so that clients can show the results of a search
+that matches many lines without waiting for the search to finish.
+A client that stops reading, or cancels the call, ends the search.
+The -timeout flag ends each search that runs longer than the duration
+given, such as 5s, failing the call with code DeadlineExceeded, so
+that a search that reads every indexed file cannot tie up the server.
+A deadline that the client sets on the call ends the search too.
+
+` + logging.Usage
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var (
+	listenFlag  = flag.String("listen", "localhost:8081", "serve gRPC on `addr`")
+	indexFlag   = flag.String("index", "", "use index `file` instead of $CSEARCHINDEX")
+	verboseFlag = flag.Bool("verbose", false, "print extra information")
+	timeoutFlag = flag.Duration("timeout", 0, "stop each search after `d` (0 means no limit)")
+)
+
+// A server implements the CodeSearch service over an index.
+type server struct {
+	pb.UnimplementedCodeSearchServer
+	ix *index.Index
+}
+
+func main() {
+	logging.AddFlags()
+	flag.Usage = usage
+	flag.Parse()
+	logging.Setup(os.Stderr)
+	if flag.NArg() != 0 {
+		usage()
+	}
+
+	file := *indexFlag
+	if file == "" {
+		file = index.File()
+	}
+	s := &server{ix: index.Open(file)}
+	s.ix.Verbose = *verboseFlag
+
+	l, err := net.Listen("tcp", *listenFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g := grpc.NewServer()
+	pb.RegisterCodeSearchServer(g, s)
+	slog.Info("serving", "index", file, "addr", l.Addr().String())
+	log.Fatal(g.Serve(l))
+}
+
+// Search implements the CodeSearch Search method.
+func (s *server) Search(req *pb.SearchRequest, stream pb.CodeSearch_SearchServer) error {
+	if req.Pattern == "" {
+		return status.Error(codes.InvalidArgument, "missing pattern")
+	}
+	sq, err := search.Compile(req.Pattern, &search.Options{
+		IgnoreCase: req.IgnoreCase,
+		File:       req.File,
+		Types:      req.Types,
+		MaxResults: int(req.MaxResults),
+	})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if *verboseFlag {
+		slog.Info("query", "pattern", req.Pattern, "query", sq.Index.String())
+	}
+
+	ctx := stream.Context()
+	if *timeoutFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutFlag)
+		defer cancel()
+	}
+	r := sq.Run(ctx, s.ix)
+	defer r.Close()
+	for r.Next() {
+		m := r.Match()
+		res := &pb.SearchResult{
+			File:   m.File,
+			Line:   int32(m.Line),
+			Text:   m.Text,
+			Offset: m.Offset,
+			Column: int32(m.Column),
+		}
+		for _, sp := range m.Spans {
+			res.Spans = append(res.Spans, &pb.Span{Start: int32(sp[0]), End: int32(sp[1])})
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	md := metadata.Pairs("files", strconv.Itoa(r.Files()))
+	if r.Truncated() {
+		md.Append("truncated", "true")
+	}
+	stream.SetTrailer(md)
+	return nil
+}
@@ -0,0 +1,527 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	stdregexp "regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/codesearch/cmd/internal/logging"
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/search"
+)
+
+var usageMessage = `usage: csearch-lsp [-index file] [-verbose]
+
+Csearch-lsp is a language server: it answers Language Server Protocol
+requests from an editor, such as VS Code or Neovim, on its standard
+input and output, using a trigram index built by cindex.  Like
+csearchd, it opens the index once and keeps it mapped into memory.
+
+The index is the file named by the -index flag, or else $CSEARCHINDEX,
+or else $HOME/.csearchindex.
+
+Csearch-lsp implements two requests:
+
+	workspace/symbol
+		Find the definitions of the symbols whose names contain the
+		query, ignoring case, as recorded by cindex (see cindex -symbols).
+
+	textDocument/references
+		Find the uses of the identifier at the cursor: every match of
+		the identifier as a whole word in the indexed files.  The
+		definitions recorded by cindex are omitted unless the editor
+		asks for declarations to be included.
+
+Because the answers come from the index, they cover every indexed
+tree, not only the editor's workspace, and are as current as the
+index: run cindex (or cindex -watch) to keep it up to date.  The
+references found are textual, so a name used for several things
+finds them all.
+
+To use csearch-lsp from Neovim, for example:
+
+	vim.lsp.start({name = 'csearch', cmd = {'csearch-lsp'}})
+
+Csearch-lsp logs to standard error.  The -verbose flag logs each
+request and the trigram query used to answer it.
+
+` + logging.Usage
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var (
+	indexFlag   = flag.String("index", "", "use index `file` instead of $CSEARCHINDEX")
+	verboseFlag = flag.Bool("verbose", false, "print extra information")
+)
+
+const (
+	maxSymbols    = 1000 // most symbols returned for a workspace/symbol request
+	maxReferences = 5000 // most references returned for a references request
+)
+
+// A server answers LSP requests using an index.
+type server struct {
+	ix   *index.Index
+	conn *conn
+
+	mu       sync.Mutex
+	utf8     bool                          // positions count UTF-8 bytes, not UTF-16 code units
+	docs     map[string]string             // text of documents open in the editor, by URI
+	running  map[string]context.CancelFunc // cancellation of running requests, by ID
+	started  bool                          // initialize received
+	shutdown bool                          // shutdown received
+}
+
+func main() {
+	logging.AddFlags()
+	flag.Usage = usage
+	flag.Parse()
+	logging.Setup(os.Stderr)
+	if flag.NArg() != 0 {
+		usage()
+	}
+	log.SetPrefix("csearch-lsp: ")
+
+	file := *indexFlag
+	if file == "" {
+		file = index.File()
+	}
+	s := &server{
+		ix:      index.Open(file),
+		conn:    &conn{w: os.Stdout},
+		docs:    make(map[string]string),
+		running: make(map[string]context.CancelFunc),
+	}
+	s.ix.Verbose = *verboseFlag
+	if *verboseFlag {
+		slog.Info("serving", "index", file)
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	for {
+		req, err := readMessage(r)
+		if err == io.EOF {
+			os.Exit(1)
+		}
+		if e, ok := err.(*rpcError); ok {
+			s.conn.reply(json.RawMessage("null"), nil, e)
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.handle(req)
+	}
+}
+
+// handle handles a single request or notification.
+// The searches run in their own goroutines, so that
+// they can be canceled; other requests are quick.
+func (s *server) handle(req *request) {
+	if *verboseFlag {
+		slog.Info("request", "method", req.Method, "params", string(req.Params))
+	}
+	s.mu.Lock()
+	started, shutdown := s.started, s.shutdown
+	s.mu.Unlock()
+	if req.ID == nil {
+		s.notify(req)
+		return
+	}
+	if !started && req.Method != "initialize" {
+		s.reply(req, nil, &rpcError{codeNotInitialized, "server not initialized"})
+		return
+	}
+	if shutdown {
+		s.reply(req, nil, &rpcError{codeInvalidRequest, "server is shutting down"})
+		return
+	}
+
+	switch req.Method {
+	case "initialize":
+		var p initializeParams
+		if !s.decode(req, &p) {
+			return
+		}
+		res := &initializeResult{
+			Capabilities: serverCapabilities{
+				PositionEncoding:        "utf-16",
+				TextDocumentSync:        1,
+				WorkspaceSymbolProvider: true,
+				ReferencesProvider:      true,
+			},
+			ServerInfo: serverInfo{Name: "csearch-lsp"},
+		}
+		s.mu.Lock()
+		for _, enc := range p.Capabilities.General.PositionEncodings {
+			if enc == "utf-8" {
+				s.utf8 = true
+				res.Capabilities.PositionEncoding = enc
+			}
+		}
+		s.started = true
+		s.mu.Unlock()
+		s.reply(req, res, nil)
+
+	case "shutdown":
+		s.mu.Lock()
+		s.shutdown = true
+		s.mu.Unlock()
+		s.reply(req, nil, nil)
+
+	case "workspace/symbol":
+		var p workspaceSymbolParams
+		if s.decode(req, &p) {
+			s.start(req, func(ctx context.Context) (interface{}, error) {
+				return s.symbols(ctx, p.Query)
+			})
+		}
+
+	case "textDocument/references":
+		var p referenceParams
+		if s.decode(req, &p) {
+			s.start(req, func(ctx context.Context) (interface{}, error) {
+				return s.references(ctx, &p)
+			})
+		}
+
+	default:
+		s.reply(req, nil, &rpcError{codeMethodNotFound, "method not supported: " + req.Method})
+	}
+}
+
+// notify handles a notification.
+func (s *server) notify(req *request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.Method {
+	case "exit":
+		if s.shutdown {
+			os.Exit(0)
+		}
+		os.Exit(1)
+
+	case "$/cancelRequest":
+		var p cancelParams
+		if json.Unmarshal(req.Params, &p) == nil {
+			if cancel := s.running[string(p.ID)]; cancel != nil {
+				cancel()
+			}
+		}
+
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if json.Unmarshal(req.Params, &p) == nil {
+			s.docs[p.TextDocument.URI] = p.TextDocument.Text
+		}
+
+	case "textDocument/didChange":
+		var p didChangeParams
+		if json.Unmarshal(req.Params, &p) == nil && len(p.ContentChanges) > 0 {
+			s.docs[p.TextDocument.URI] = p.ContentChanges[len(p.ContentChanges)-1].Text
+		}
+
+	case "textDocument/didClose":
+		var p didCloseParams
+		if json.Unmarshal(req.Params, &p) == nil {
+			delete(s.docs, p.TextDocument.URI)
+		}
+	}
+}
+
+// decode decodes the parameters of req into v.
+// If they are invalid, it replies with an error and returns false.
+func (s *server) decode(req *request, v interface{}) bool {
+	if err := json.Unmarshal(req.Params, v); err != nil {
+		s.reply(req, nil, &rpcError{codeInvalidParams, err.Error()})
+		return false
+	}
+	return true
+}
+
+// reply replies to req.
+func (s *server) reply(req *request, result interface{}, err error) {
+	if err := s.conn.reply(req.ID, result, err); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// start runs f in a new goroutine to answer req,
+// canceling it if the client cancels req.
+func (s *server) start(req *request, f func(ctx context.Context) (interface{}, error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	id := string(req.ID)
+	s.mu.Lock()
+	s.running[id] = cancel
+	s.mu.Unlock()
+	go func() {
+		result, err := f(ctx)
+		if ctx.Err() != nil {
+			result, err = nil, &rpcError{codeRequestCancelled, "request canceled"}
+		}
+		s.mu.Lock()
+		delete(s.running, id)
+		s.mu.Unlock()
+		cancel()
+		s.reply(req, result, err)
+	}()
+}
+
+// symbols answers a workspace/symbol request.
+func (s *server) symbols(ctx context.Context, query string) ([]symbolInformation, error) {
+	res := []symbolInformation{}
+	if query == "" || !s.ix.HasSymbols() {
+		return res, nil
+	}
+	query = strings.ToLower(query)
+	syms := s.ix.MatchSymbols("", func(name string) bool {
+		return strings.Contains(strings.ToLower(name), query)
+	})
+	files := make(map[uint32][]string)
+	for _, sym := range syms {
+		if len(res) >= maxSymbols || ctx.Err() != nil {
+			break
+		}
+		lines, ok := files[sym.Fileid]
+		if !ok {
+			lines = s.fileLines(sym.Fileid)
+			files[sym.Fileid] = lines
+		}
+		var text string
+		if sym.Line-1 < len(lines) {
+			text = lines[sym.Line-1]
+		}
+		col := wordIndex(text, sym.Name)
+		start := s.char(text, max(col, 0))
+		end := start
+		if col >= 0 {
+			end = s.char(text, col+len(sym.Name))
+		}
+		res = append(res, symbolInformation{
+			Name: sym.Name,
+			Kind: symbolKind(text, sym.Name),
+			Location: location{
+				URI: pathToURI(s.ix.Name(sym.Fileid)),
+				Range: lspRange{
+					Start: position{sym.Line - 1, start},
+					End:   position{sym.Line - 1, end},
+				},
+			},
+		})
+	}
+	return res, nil
+}
+
+// references answers a textDocument/references request.
+func (s *server) references(ctx context.Context, p *referenceParams) ([]location, error) {
+	text, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(text, "\n")
+	res := []location{}
+	if p.Position.Line < 0 || p.Position.Line >= len(lines) {
+		return res, nil
+	}
+	line := lines[p.Position.Line]
+	word := identAt(line, s.col(line, p.Position.Character))
+	if word == "" {
+		return res, nil
+	}
+
+	sq, err := search.Compile(`\b`+stdregexp.QuoteMeta(word)+`\b`, &search.Options{
+		MaxResults: maxReferences,
+		Stored:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if *verboseFlag {
+		slog.Info("references", "word", word, "query", sq.Index.String())
+	}
+
+	// Note the definitions, to leave them out.
+	type fileLine struct {
+		name string
+		line int
+	}
+	defs := make(map[fileLine]bool)
+	if !p.Context.IncludeDeclaration {
+		for _, sym := range s.ix.LookupSymbol(word) {
+			defs[fileLine{s.ix.Name(sym.Fileid), sym.Line}] = true
+		}
+	}
+
+	r := sq.Run(ctx, s.ix)
+	defer r.Close()
+	for r.Next() {
+		m := r.Match()
+		if defs[fileLine{m.File, m.Line}] {
+			continue
+		}
+		for _, sp := range m.Spans {
+			res = append(res, location{
+				URI: pathToURI(m.File),
+				Range: lspRange{
+					Start: position{m.Line - 1, s.char(m.Text, sp[0])},
+					End:   position{m.Line - 1, s.char(m.Text, sp[1])},
+				},
+			})
+		}
+	}
+	return res, r.Err()
+}
+
+// document returns the text of the document with the given URI:
+// the editor's copy if the document is open, or else the indexed
+// copy if the index stores it, or else the file itself.
+func (s *server) document(uri string) (string, error) {
+	s.mu.Lock()
+	text, ok := s.docs[uri]
+	s.mu.Unlock()
+	if ok {
+		return text, nil
+	}
+	name, err := uriToPath(uri)
+	if err != nil {
+		return "", &rpcError{codeInvalidParams, err.Error()}
+	}
+	if fileid, ok := s.ix.Lookup(name); ok {
+		if data, ok := s.ix.Content(fileid); ok {
+			return string(data), nil
+		}
+	}
+	data, err := index.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// fileLines returns the lines of the indexed file with the given fileid.
+// If the file cannot be read, fileLines returns nil.
+func (s *server) fileLines(fileid uint32) []string {
+	data, ok := s.ix.Content(fileid)
+	if !ok {
+		var err error
+		data, err = index.ReadFile(s.ix.Name(fileid))
+		if err != nil {
+			return nil
+		}
+	}
+	return strings.Split(string(data), "\n")
+}
+
+// char converts the byte offset col in line to a position character.
+func (s *server) char(line string, col int) int {
+	s.mu.Lock()
+	utf8Enc := s.utf8
+	s.mu.Unlock()
+	return columnToChar(line, col, utf8Enc)
+}
+
+// col converts the position character char in line to a byte offset.
+func (s *server) col(line string, char int) int {
+	s.mu.Lock()
+	utf8Enc := s.utf8
+	s.mu.Unlock()
+	return charToColumn(line, char, utf8Enc)
+}
+
+func isIdent(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// identAt returns the identifier in line at or just before
+// the byte offset col, or "" if there is none.
+func identAt(line string, col int) string {
+	start, end := col, col
+	for end < len(line) {
+		r, size := utf8.DecodeRuneInString(line[end:])
+		if !isIdent(r) {
+			break
+		}
+		end += size
+	}
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(line[:start])
+		if !isIdent(r) {
+			break
+		}
+		start -= size
+	}
+	return line[start:end]
+}
+
+// wordIndex returns the byte offset of the first use of word as a whole
+// word in line, or -1 if there is none.
+func wordIndex(line, word string) int {
+	for i := 0; ; {
+		j := strings.Index(line[i:], word)
+		if j < 0 {
+			return -1
+		}
+		j += i
+		before, _ := utf8.DecodeLastRuneInString(line[:j])
+		after, _ := utf8.DecodeRuneInString(line[j+len(word):])
+		if (j == 0 || !isIdent(before)) && (j+len(word) == len(line) || !isIdent(after)) {
+			return j
+		}
+		i = j + len(word)
+	}
+}
+
+// symbolKind guesses the kind of the symbol name defined by line.
+func symbolKind(line, name string) int {
+	fields := strings.FieldsFunc(line, func(r rune) bool { return !isIdent(r) && r != '#' })
+	for _, f := range fields {
+		if f == name {
+			break
+		}
+		switch f {
+		case "func":
+			if strings.HasPrefix(strings.TrimSpace(line), "func (") {
+				return kindMethod
+			}
+			return kindFunction
+		case "def", "fn", "function", "sub", "proc":
+			return kindFunction
+		case "class", "type", "typedef", "enum", "module", "trait", "impl":
+			if strings.Contains(line, "interface") {
+				return kindInterface
+			}
+			if strings.Contains(line, "struct") {
+				return kindStruct
+			}
+			return kindClass
+		case "interface", "protocol":
+			return kindInterface
+		case "struct", "union":
+			return kindStruct
+		case "const", "#define", "define":
+			return kindConstant
+		}
+	}
+	if strings.Contains(line, name+"(") {
+		return kindFunction
+	}
+	return kindVariable
+}
@@ -0,0 +1,276 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// The Language Server Protocol is JSON-RPC 2.0, with each message
+// preceded by a header giving its length, as in
+//
+//	Content-Length: 52\r\n
+//	\r\n
+//	{"jsonrpc":"2.0","id":1,"method":"shutdown"}
+//
+// See https://microsoft.github.io/language-server-protocol/.
+// Only the parts of the protocol used by csearch-lsp are defined here.
+
+// A request is a JSON-RPC request or, if ID is nil, a notification.
+type request struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// A response is a JSON-RPC response.
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// An rpcError is a JSON-RPC error.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// JSON-RPC and LSP error codes.
+const (
+	codeParseError       = -32700
+	codeInvalidRequest   = -32600
+	codeInvalidParams    = -32602
+	codeMethodNotFound   = -32601
+	codeInternalError    = -32603
+	codeNotInitialized   = -32002
+	codeRequestCancelled = -32800
+)
+
+// readMessage reads the next message from r.
+func readMessage(r *bufio.Reader) (*request, error) {
+	h, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(h.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid Content-Length %q", h.Get("Content-Length"))
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	req := new(request)
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, &rpcError{codeParseError, err.Error()}
+	}
+	return req, nil
+}
+
+// A conn writes messages to the client.
+// It is safe for concurrent use.
+type conn struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// reply sends the response to the request with the given id:
+// result if err is nil, and otherwise err.
+func (c *conn) reply(id json.RawMessage, result interface{}, err error) error {
+	resp := &response{JSONRPC: "2.0", ID: id}
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		e, ok := err.(*rpcError)
+		if !ok {
+			e = &rpcError{codeInternalError, err.Error()}
+		}
+		resp.Result, resp.Error = nil, e
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(data)); err != nil {
+		return err
+	}
+	_, err = c.w.Write(data)
+	return err
+}
+
+// LSP types.
+
+type initializeParams struct {
+	Capabilities struct {
+		General struct {
+			PositionEncodings []string `json:"positionEncodings"`
+		} `json:"general"`
+	} `json:"capabilities"`
+}
+
+type initializeResult struct {
+	Capabilities serverCapabilities `json:"capabilities"`
+	ServerInfo   serverInfo         `json:"serverInfo"`
+}
+
+type serverCapabilities struct {
+	PositionEncoding        string `json:"positionEncoding"`
+	TextDocumentSync        int    `json:"textDocumentSync"` // 1 means full text
+	WorkspaceSymbolProvider bool   `json:"workspaceSymbolProvider"`
+	ReferencesProvider      bool   `json:"referencesProvider"`
+}
+
+type serverInfo struct {
+	Name string `json:"name"`
+}
+
+type position struct {
+	Line      int `json:"line"`      // starting at 0
+	Character int `json:"character"` // in units of the position encoding
+}
+
+type lspRange struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type location struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type textDocumentItem struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type textDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type didOpenParams struct {
+	TextDocument textDocumentItem `json:"textDocument"`
+}
+
+type didChangeParams struct {
+	TextDocument   textDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type didCloseParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+type cancelParams struct {
+	ID json.RawMessage `json:"id"`
+}
+
+type workspaceSymbolParams struct {
+	Query string `json:"query"`
+}
+
+type symbolInformation struct {
+	Name     string   `json:"name"`
+	Kind     int      `json:"kind"`
+	Location location `json:"location"`
+}
+
+// Symbol kinds.
+const (
+	kindClass     = 5
+	kindMethod    = 6
+	kindInterface = 11
+	kindFunction  = 12
+	kindVariable  = 13
+	kindConstant  = 14
+	kindStruct    = 23
+)
+
+type referenceParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+	Position     position               `json:"position"`
+	Context      struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+// uriToPath returns the file name for a file: URI.
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported URI %s", uri)
+	}
+	name := u.Path
+	if len(name) >= 3 && name[0] == '/' && name[2] == ':' {
+		// file:///C:/x names C:\x.
+		name = name[1:]
+	}
+	return filepath.FromSlash(name), nil
+}
+
+// pathToURI returns the file: URI for a file name.
+func pathToURI(name string) string {
+	name = filepath.ToSlash(name)
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	return (&url.URL{Scheme: "file", Path: name}).String()
+}
+
+// columnToChar converts the byte offset col in line to a character
+// offset in the position encoding: UTF-8 bytes or UTF-16 code units.
+func columnToChar(line string, col int, utf8Enc bool) int {
+	if utf8Enc {
+		return col
+	}
+	n := 0
+	for _, r := range line[:col] {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// charToColumn converts the character offset char in line,
+// in the position encoding, to a byte offset.
+func charToColumn(line string, char int, utf8Enc bool) int {
+	if utf8Enc {
+		if char > len(line) {
+			char = len(line)
+		}
+		return char
+	}
+	n := 0
+	for i, r := range line {
+		if n >= char {
+			return i
+		}
+		n += utf16.RuneLen(r)
+	}
+	return len(line)
+}
@@ -0,0 +1,161 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/search"
+)
+
+// A batchSearch is one of the searches listed in a -batch file.
+type batchSearch struct {
+	label   string
+	pattern string
+}
+
+// readBatch reads the searches listed in the named -batch file,
+// or standard input if the name is -.
+func readBatch(file string) []batchSearch {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	var list []batchSearch
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSuffix(s.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		label, pattern, ok := strings.Cut(line, "\t")
+		if !ok {
+			label, pattern = line, line
+		}
+		list = append(list, batchSearch{label, pattern})
+	}
+	if err := s.Err(); err != nil {
+		fatalf("-batch: %v", err)
+	}
+	if len(list) == 0 {
+		fatalf("-batch: no searches in %s", file)
+	}
+	return list
+}
+
+// searchBatch implements csearch -batch: it runs the searches listed
+// in the -batch file together, compiling each with compile and opts,
+// reading each candidate file once, and prints each matching line
+// preceded by the label of the search it matches.
+func searchBatch(g *regexp.Grep, compile func(string, *search.Options) (*search.Query, error), opts *search.Options) {
+	list := readBatch(*batchFlag)
+	if g.Max > 0 {
+		o := *opts
+		o.MaxResults = g.Max
+		opts = &o
+	}
+	qs := make([]*search.Query, len(list))
+	for i, b := range list {
+		q, err := compile(b.pattern, opts)
+		if err != nil {
+			fatalf("-batch: %s: %v", b.label, err)
+		}
+		qs[i] = q
+	}
+
+	// A file in several indexes is searched only in the first.
+	seen := make(map[string]bool)
+	run := func(ix *index.Index, shadowed func(fileid uint32) bool) {
+		found := make(map[string]bool)
+		keep := func(fileid uint32) bool {
+			if shadowed != nil && shadowed(fileid) {
+				return false
+			}
+			name := ix.Name(fileid)
+			if seen[name] {
+				return false
+			}
+			found[name] = true
+			return true
+		}
+		printBatch(g, list, search.RunBatch(g.Context, ix, qs, keep))
+		for name := range found {
+			seen[name] = true
+		}
+	}
+	for _, file := range searchFiles() {
+		if index.IsSharded(file) {
+			s := openSharded(file)
+			for i, ix := range s.Shards {
+				i := i
+				run(ix, func(fileid uint32) bool { return s.Shadowed(i, fileid) })
+			}
+			continue
+		}
+		run(openIndex(file), nil)
+	}
+	g.Match = matches
+}
+
+// printBatch prints the matches in r, as -l, -c, -h, and -n direct,
+// each preceded by the label of the search in list that it matches.
+func printBatch(g *regexp.Grep, list []batchSearch, r *search.Results) {
+	defer r.Close()
+	var b bytes.Buffer
+	var last search.Match // last match, for -l and -c
+	count := 0
+	flush := func() {
+		if count > 0 {
+			fmt.Fprintf(&b, "%s:%s: %d\n", list[last.Query].label, last.File, count)
+			count = 0
+		}
+	}
+	for r.Next() {
+		m := r.Match()
+		matches = true
+		same := last.File == m.File && last.Query == m.Query && last.File != ""
+		switch {
+		case g.L:
+			if !same {
+				fmt.Fprintf(&b, "%s:%s\n", list[m.Query].label, m.File)
+			}
+		case g.C:
+			if !same {
+				flush()
+			}
+			count++
+		default:
+			b.WriteString(list[m.Query].label)
+			b.WriteString(":")
+			if !g.H {
+				b.WriteString(m.File)
+				b.WriteString(":")
+			}
+			if g.N {
+				fmt.Fprintf(&b, "%d:", m.Line)
+			}
+			b.WriteString(m.Text)
+			b.WriteString("\n")
+		}
+		last = m
+		if b.Len() >= 64<<10 {
+			b.WriteTo(g.Stdout)
+		}
+	}
+	flush()
+	b.WriteTo(g.Stdout)
+}
@@ -5,28 +5,324 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
+	stdregexp "regexp"
+	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/google/codesearch/cmd/internal/logging"
 	"github.com/google/codesearch/index"
 	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/search"
+	"golang.org/x/text/unicode/norm"
 )
 
-var usageMessage = `usage: csearch [-c] [-f fileregexp] [-h] [-i] [-l] [-n] regexp
+var usageMessage = `usage: csearch [-c] [-f fileregexp] [-g glob] [-F] [-h] [-i] [-l] [-n] [-q] [-A n] [-B n] [-C n]
+	[-type t] [-type-add name:glob] [-type-list] [-sym] [-id] [-in regions] [-dedupe] [-rank] [-m n] [-max-results n]
+	[-o template] [-heading] [-max-columns n] [-output text|ndjson] [-sort path|modified] [-count-matches] [-line-range m:n]
+	[-j n] [-repo name] [-lang name] [-index file] [-wait d] [-timeout d] [-multiline] [-stats]
+	[-color when] [-pcre-compat] [-verify-fresh] [-ref ref] [-no-daemon]
+	[-force-index] [-force-scan] regexp
+       csearch -query [flags] query
+       csearch -save name [flags] regexp
+       csearch -run name [flags]
+       csearch -list-saved
+       csearch -daemon [-index file] [-verbose]
+       csearch -repl [flags] [regexp]
+       csearch -patch file|a..b [flags] regexp
+       csearch -batch file [flags]
 
 Csearch behaves like grep over all indexed files, searching for regexp,
-an RE2 (nearly PCRE) regular expression.
+an RE2 (nearly PCRE) regular expression.  As with grep, the exit status
+is 0 if a line matched, 1 if none did, and 2 if an error occurred, such
+as a bad flag, a missing index, or a file that could not be read.
+
+The -q flag makes csearch print nothing and stop at the first match,
+grepping no more files, so that it can serve as a test in a shell
+script or a CI job:
+
+	if csearch -q -f '\.go$' 'TODO\(release\)'; then echo 'release TODOs remain'; fi
+
+With -q, a match gives exit status 0 even if an error occurred.
 
 The -c, -h, -i, -l, and -n flags are as in grep, although note that as per Go's
 flag parsing convention, they cannot be combined: the option pair -i -n 
 cannot be abbreviated to -in.
 
+The -count-matches flag is like -c, but counts every match rather than
+every matching line, as ripgrep --count-matches does.  When counting,
+csearch skips from each matching line to the next without formatting
+any lines, so -c and -count-matches are faster than printing the lines.
+
+The -A, -B, and -C flags print n lines of trailing, leading, or both
+kinds of context around each match, as in grep.
+
+The -o flag prints only the matches, each on its own line, formatted by
+template, in which $1 or ${1} stands for the text matched by the first
+parenthesized group of regexp, ${name} for that of the group named by
+(?P<name>re), $0 for the whole match, and $$ for a dollar sign, so
+that a search can extract what it finds rather than print whole lines:
+
+	csearch -h -o '$1' 'import "([^"]+)"' | sort | uniq -c
+
+A group that did not match stands for the empty string, and context
+lines are not printed.  The -o flag cannot be combined with -sym, -id,
+or -batch.
+
+The -line-range flag reports only matches in lines m through n of each
+file, counting from 1, such as -line-range 1:20 to search only license
+headers, package declarations, and imports.  The range may also be
+given as m for line m alone, m: for line m onward, or :n for the first
+n lines.  Csearch stops reading each file after line n.
+
+The -color flag highlights the output using ANSI escape sequences, as
+grep --color does: file names, line numbers, and the matches within
+each matching line are printed in color.  The value when is always,
+never (the default), or auto, which colors the output only if it is a
+terminal; -color alone means -color=auto.  The output of -sym is not
+colored.
+
 The -f flag restricts the search to files whose names match the RE2 regular
 expression fileregexp.
 
+The -g (or -glob) flag restricts the search to files whose names match
+a glob pattern, such as -g '*.go' or -g 'src/**/*.go'.  A pattern
+beginning with ! excludes the files it matches instead, as in
+-g '!**/testdata/**'.  The flag may be repeated: csearch searches the
+files that match any of the include patterns (or all files, if there
+are none) and none of the exclude patterns.  As in .gitignore files,
+* and ? do not match a slash, while ** matches any number of directories.
+A pattern matches starting at any directory in a file's name unless it
+begins with a slash.  A pattern ending in a slash, or one without
+wildcards in its last element, such as -g '!testdata', also matches
+every file in the directories it matches; -g '*.go' matches only files.
+
+The -F flag searches for regexp as a fixed string rather than a regular
+expression, as in grep -F.  Fixed strings are searched for directly,
+which is faster than matching a regular expression.
+
+The -pcre-compat flag takes regexp, and the fileregexp of -f, to be PCRE
+regular expressions, as used by grep -P and ripgrep, translating the
+PCRE constructs that RE2 lacks, such as \h, \e, (?<name>re), and (?x),
+into their RE2 equivalents.  Constructs that RE2 cannot express, such as
+lookahead and backreferences, are rejected with an error suggesting
+what to write instead.
+
+The -type flag restricts the search to files of type t, such as go or py,
+as identified by their names.  It may be repeated, or given a comma-separated
+list, to search files of any of several types.  The -type-add flag defines
+a new type, or adds to an existing one, using comma-separated glob patterns
+that match the final element of a file name, as in -type-add 'web:*.html,*.css'.
+A compressed file, such as x.log.gz, is also of the types of the file it
+holds, x.log; csearch searches its decompressed text, as cindex indexed it.
+The -type-list flag prints the known types and exits.
+
+The -repo flag restricts the search to files in the named repository,
+as assigned by cindex -repo.  Like -type, it may be repeated, or given
+a comma-separated list, to search several repositories.
+
+The -ref flag searches the code as it was at a past git revision, such
+as a release tag, using the index of that revision built by cindex
+-git-ref (see cindex -help) in place of each index to search.
+
+The -patch flag searches the lines that a patch adds instead of the
+indexed files, so that a check of a proposed change can ask whether it
+introduces text matching regexp:
+
+	git diff main... | csearch -patch - -n 'TODO\(\w+\)'
+	csearch -patch main..HEAD -n 'TODO\(\w+\)'
+
+The patch is a unified diff in the named file (- for standard input)
+or, given a revision range a..b, the output of git diff a..b.  Csearch
+indexes the added lines in memory, without needing an index of its
+own, and greps the files the index selects, reporting only matches on
+added lines, numbered as in the new version of each file.  The lines
+shown as context serve only as context.  The exit status is 0 if the
+patch adds a matching line, as usual.
+
+The -batch flag runs many searches at once, such as the signatures of a
+security scan, listed one per line in the named file (- for standard
+input) in place of regexp.  A line may give a label for its search,
+followed by a tab, before the regexp; otherwise the regexp labels
+itself.  Blank lines and lines beginning with # are ignored:
+
+	# label<TAB>regexp
+	aws-key	AKIA[0-9A-Z]{16}
+	private-key	-----BEGIN [A-Z ]*PRIVATE KEY-----
+
+Csearch finds the candidate files of every search, reads each file
+once, however many searches select it, and prints each matching line
+preceded by the label of the search it matches, as in
+aws-key:file:text.  The -c, -h, -l, and -n flags apply to each search,
+-m limits the matching lines of each search, and the flags restricting
+the files searched and how regexps match, such as -f, -lang, -i, and
+-query, apply to all of them.
+
+The -lang flag restricts the search to files in the named language, as
+detected by cindex from each file's name, its #! line, an Emacs or Vim
+mode line, or, for .h files, whether it looks like C++.  Languages are
+named by their usual extensions, such as go, py, or cpp, although common
+names such as python or c++ are accepted too.  Like -repo, it may be
+repeated or given a comma-separated list.
+
+The -multiline flag matches regexp against whole files instead of single
+lines, so that it can find text spanning several lines, as in
+csearch -multiline 'func Foo\(\)\s*{\n\s*return'.  Csearch prints all the
+lines that each match spans.  As usual, . does not match a newline
+unless the regexp begins with (?s).  The -A, -B, and -C flags are
+ignored in this mode.
+
+The -sym flag searches only symbol definitions, as recorded by cindex:
+it prints each definition of a symbol whose entire name matches regexp,
+in the form file:line:text.  For example, csearch -sym 'New.*' finds the
+functions, types, and other symbols whose names begin with New.
+The -c, -h, -i, -l, -f, -g, -type, -repo, and -lang flags apply as usual.
+
+The -id flag searches for uses of the identifier given in place of
+regexp, in the code of files whose index was built with cindex
+-identifiers: it prints the lines using the identifier in any case
+convention, leaving out those where it appears only in comments or
+string literals.  For example, csearch -id fooBar finds FooBar, fooBar,
+foo_bar, and FOO_BAR.  The -c, -l, -f, -g, -type, -repo, -lang, and
+-max-results flags apply as usual.
+
+The -in flag reports only matches that begin in the given kind of
+region of each file: code, comments, or strings, meaning string
+literals, as classified by lexing each file in its language.  For
+example, csearch -in comments TODO finds TODOs in comments but not in
+strings or identifiers, and csearch -in code 'password' leaves out
+mentions in comments and messages.  Everything in a file in a language
+that csearch cannot lex counts as code.  Cindex -regions records the
+regions in the index, so that csearch need not lex the files itself
+unless they have changed since they were indexed.
+
+The -dedupe flag searches only one of each set of files that cindex
+-dedupe found to hold the same text, such as vendored copies of a
+package, so that a match in them is reported once, in the first of
+them that the other flags allow.  Without it, csearch reports the
+match in every copy.
+
+Csearch normally searches files in order by name, as -sort path does.
+The -sort modified flag searches them in order by the modification times
+recorded in the index, least recently modified first.  The -rank flag
+causes it to search the files most likely to be relevant first:
+files near the top of the indexed trees, files whose own names match
+regexp, files that do not look like tests, and recently modified files.
+The -max-results flag stops the search after n files have matched,
+which combined with -rank prints only the n most relevant files.
+The -m flag stops the search after n matching lines in total, as
+counted by -c, or after n files with -l, without reading any further
+candidate files.
+
+The -timeout flag stops the search after the duration d, such as 5s,
+so that a search that would run too long, such as one for .* that
+reads every indexed file, is cancelled cleanly rather than tying up
+the machine.  The matches found by then are printed, followed by a
+message that the search timed out, and the exit status is 2.
+
+The -heading flag prints the name of each file with matches once, on a
+line of its own, followed by the file's matching lines, each numbered,
+and a blank line separating it from the next file, as ripgrep --heading
+does, instead of printing the name at the start of every line.
+
+The -max-columns flag truncates each printed line longer than n bytes,
+such as the single line of a minified JavaScript file, to the n bytes
+around its first match, or the first n bytes of a context line, rather
+than printing the whole line or leaving the match out.  An ellipsis
+marks each end cut off, and the line is followed by the columns
+printed, counted in bytes from 1, as in "[columns 10201-10400 of
+524288]".  Lines are still matched in full.
+
+The -output ndjson flag prints the results as a stream of events, one
+JSON object per line, for CI jobs and other programs to turn into
+annotations, such as those of GitHub checks.  Each event has a type
+field.  The stream begins with a query-start event, holding the
+pattern, the parsed regexp, and the trigram query.  Each file with
+matches then has a file-begin event, holding its path, a match event
+for each matching line, and a file-end event counting the matching
+lines.  A match event holds the path; the line number, from 1; the
+column of the first match, counted in bytes from 1; the byte offset of
+the line in the file; the text of the line; and a list of submatches,
+each with its text, its start and end byte offsets in the line, and
+the groups of the regexp, each with its name, if any, text, start, and
+end, or null if it did not match:
+
+	{"type":"match","path":"/src/x.go","line":12,"column":7,"offset":301,"text":"\tx := f(1)","submatches":[{"text":"f(1)","start":6,"end":10,"groups":[{"text":"1","start":8,"end":9}]}]}
+
+A summary event ends the stream, counting the candidate files, the
+files searched, the files with matches, and the matching lines, and
+giving the time taken in elapsed_sec.  Context lines are not reported,
+and -output ndjson cannot be combined with -l, -c, -q, -sym, -id,
+-patch, or -batch.  Text that is not valid UTF-8 is printed with
+U+FFFD replacement characters, but the offsets are those of the bytes
+in the file.  Errors are still reported on standard error.
+
+Csearch greps several candidate files at once, as many as the -j flag
+allows (by default, the number of CPUs), buffering the output of each
+file to print it in order, so that the output is the same as if it had
+searched the files one at a time.
+
+The -stats flag prints to standard error how csearch searched: the
+parsed regexp, the trigram query derived from it, how many files the
+index holds, how many of them the query selected as candidates, how
+many were searched and matched, and how long each phase took.  A query
+of "+" matches every file, meaning that the regexp offered no trigrams
+to narrow the search, which then reads every indexed file.
+
+Csearch also searches every indexed file when the index estimates,
+from the lengths of the posting lists of the query's trigrams, that
+reading those lists would take longer than searching the files the
+query could leave out, as for a regexp like [a-z]+_[0-9]+ whose query
+ORs many common trigrams, or in an index of a few files.  The results
+are the same either way.  The -force-index flag always uses the query,
+and the -force-scan flag (or -brute) always searches every file.
+
+The -query flag treats the argument as a query combining several
+patterns and restrictions instead of a single regexp.  Terms separated
+by spaces must all match a file, OR between terms allows either to
+match, a leading - (or NOT) requires a term not to match, and
+parentheses group terms.  A term is a regexp matched against the text
+of the file, or it restricts the search using a prefix: file:regexp
+matches file names, lang:name matches the language (see -lang),
+repo:name matches the repository (see -repo), pkg://dir matches the
+Bazel package (see cindex -help), with pkg://dir/... matching the
+packages beneath too, and content:regexp is the same as regexp alone.  Quotes allow spaces in a term.  For example:
+
+	csearch -query 'mutex AND (Lock OR Unlock) -file:_test\.go lang:go'
+
+searches the Go files, other than tests, that use a mutex and call
+Lock or Unlock.  Csearch prints the lines matching any of the regexps
+that are not negated, or every line if there are none, as with
+csearch -query -l 'lang:go file:^/src/net/'.  The other flags apply
+as usual, except for -sym, which cannot be combined with -query.
+
+The -save flag saves the search given by the other flags and the regexp
+under a name instead of running it, and the -run flag runs the saved
+search with that name, such as a sweep that a team runs often:
+
+	csearch -save todo-security -i -lang go 'TODO.*(security|auth)'
+	csearch -run todo-security -l
+
+Flags given with -run add to or override those of the saved search,
+as -l does here, and -save records them too, so that -run and -save
+together derive one saved search from another.  The -list-saved flag
+lists the saved searches.  They are kept in a JSON file beside the
+(first) index, named by adding .searches to the index's name, so that
+everyone sharing an index shares its saved searches; the file may be
+edited by hand.  Flags that choose where or how to search, such as
+-index, -color, and -wait, are not saved.
+
 Csearch relies on the existence of an up-to-date index created ahead of time.
 To build or rebuild the index that csearch uses, run:
 
@@ -37,111 +333,811 @@ If no index exists, this command creates one.  If an index already exists, cinde
 overwrites it.  Run cindex -help for more.
 
 Csearch uses the index stored in $CSEARCHINDEX or, if that variable is unset or
-empty, $HOME/.csearchindex.
-`
+empty, $HOME/.csearchindex.  If the index is a directory of index shards,
+as written by cindex, csearch searches them all.
+
+$CSEARCHINDEX may also list several indexes, separated by colons (semicolons
+on Windows), such as indexes maintained separately for different
+repositories.  Csearch searches them all, printing the matches in a file
+only once even if several indexes include it.  The -index flag names an
+index to search instead of those in $CSEARCHINDEX; it may be repeated.
+An index may also attach other indexes (see cindex -attach), which
+csearch then searches as if they were listed too.
+
+An index may also be a URL, such as that of an index built nightly and
+published for a team to share: an http:// or https:// URL, or one of an
+object in a cloud storage bucket, s3://bucket/key or gs://bucket/key (see
+cindex for the credentials used).  Csearch downloads the index into
+$CSEARCHCACHE, or else the csearch directory in the user's cache
+directory, and later downloads it again only if the storage reports that
+it has changed.  If the storage cannot be reached, csearch searches the
+copy it has.  Files not present on this machine are read from the index
+if it stores their text (see cindex -store-content):
+
+	CSEARCHINDEX=https://example.com/src.csearchindex csearch 'func main'
+
+Csearch searches Markdown files without their front matter, and other
+documents, such as PDF files, by the text that the converters listed in
+$CSEARCHEXTRACT extract from them, as cindex indexes them (see cindex).
+
+Files that change after they are indexed can make the index miss them:
+csearch always greps the current text of each candidate file, but a
+file that now matches may not be a candidate.  The -verify-fresh flag
+checks the size and modification time of every indexed file against
+those recorded in the index, greps each file that has changed whether
+or not the index selects it, and then prints a warning counting the
+changed and removed files, as a hint to run cindex.  Checking every
+file takes time in a large index.
+
+If cindex is rewriting an index when csearch starts, csearch normally
+searches the old index.  The -wait flag makes csearch wait up to the
+given duration, such as 30s, for cindex to finish, and then search
+the new index.
+
+The -daemon flag starts a long-lived csearch that keeps the indexes
+open and remembers the compiled regexps and trigram queries of recent
+searches, so that repeated searches, as from an editor, start at once.
+It listens on a Unix domain socket named by $CSEARCHSOCKET or, if that
+is unset, by adding .sock to the name of the (first) index, such as
+$HOME/.csearchindex.sock.  While it runs, csearch sends each search of
+the same indexes to it and prints the results, unless given -no-daemon,
+-cpuprofile, or -type-list.  The daemon runs one search at a time, and
+it reopens an index when cindex replaces it.  If the daemon is not
+running, or stops, csearch searches by itself.
+
+The -repl flag makes csearch read searches from standard input, one
+regexp per line, running each with the other flags given and printing
+the matches in each file as soon as it is searched.  Like -daemon, it
+keeps the indexes open and remembers recent queries between searches.
+At the prompt, :i toggles -i, :f regexp sets -f, :flags sets other
+flags for later searches, :history lists the earlier searches, !n runs
+search n again, and :help lists the commands.  The searches are
+recorded beside the (first) index, in a file named by adding .history
+to its name, such as $HOME/.csearchindex.history.
+
+` + logging.Usage
 
 func usage() {
-	fmt.Fprintf(os.Stderr, usageMessage)
-	os.Exit(2)
+	fmt.Fprintf(flag.CommandLine.Output(), usageMessage)
+	exit(2)
+}
+
+// exit exits the program.  Csearch -daemon replaces it
+// so as to end only the search that it is serving.
+var exit = os.Exit
+
+// fatal prints its arguments, as log.Fatal does, and exits
+// with status 2, as grep does on errors.
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	exit(2)
+}
+
+// fatalf prints its arguments, as log.Fatalf does, and exits
+// with status 2.
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	exit(2)
 }
 
 var (
-	fFlag       = flag.String("f", "", "search only files with names matching this regexp")
-	iFlag       = flag.Bool("i", false, "case-insensitive search")
-	verboseFlag = flag.Bool("verbose", false, "print extra information")
-	bruteFlag   = flag.Bool("brute", false, "brute force - search all files in index")
-	cpuProfile  = flag.String("cpuprofile", "", "write cpu profile to this file")
+	fFlag       *string
+	fixedFlag   *bool
+	iFlag       *bool
+	verboseFlag *bool
+	bruteFlag   *bool
+	forceIndex  *bool
+	cpuProfile  *string
+	typeList    *bool
+	symFlag     *bool
+	rankFlag    *bool
+	statsFlag   *bool
+	multiline   *bool
+	queryFlag   *bool
+	maxResults  *int
+	jobsFlag    *int
+	waitFlag    *time.Duration
+	timeoutFlag *time.Duration
+	daemonFlag  *bool
+	replFlag    *bool
+	noDaemon    *bool
+	freshFlag   *bool
+	saveFlag    *string
+	runFlag     *string
+	listFlag    *bool
+	pcreFlag    *bool
+	refFlag     *string
+	sortFlag    *string
+	patchFlag   *string
+	quietFlag   *bool
+	idFlag      *bool
+	inFlag      *string
+	dedupeFlag  *bool
+	batchFlag   *string
+	outputFlag  *string
+	oFlag       *string
+
+	indexFlags   stringsFlag
+	typeFlags    stringsFlag
+	typeAddFlags stringsFlag
+	globFlags    stringsFlag
+	repoFlags    stringsFlag
+	langFlags    stringsFlag
 
 	matches bool
+	failed  bool // an error was reported while searching
+
+	// fileRefs records where candidate files are indexed, for
+	// searches that consult the index while grepping and for files
+	// read from the index: those of tar streams (see cindex -tar)
+	// and those missing here, as with a remote index.
+	fileRefs map[string]fileRef
+
+	// inKind is the kind of region to report matches in, if -in is set.
+	inKind index.RegionKind
 )
 
+// A fileRef identifies a file in an index.
+type fileRef struct {
+	ix     *index.Index
+	fileid uint32
+}
+
+// A stringsFlag is a flag that may be repeated,
+// each use adding to a list of strings.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// defineFlags defines the flags in flag.CommandLine,
+// binding the grep flags to g.
+func defineFlags(g *regexp.Grep) {
+	fFlag = flag.String("f", "", "search only files with names matching this regexp")
+	fixedFlag = flag.Bool("F", false, "search for a fixed string, not a regexp")
+	iFlag = flag.Bool("i", false, "case-insensitive search")
+	verboseFlag = flag.Bool("verbose", false, "print extra information")
+	logging.AddFlags()
+	bruteFlag = flag.Bool("brute", false, "brute force - search all files in index")
+	flag.BoolVar(bruteFlag, "force-scan", false, "same as -brute")
+	forceIndex = flag.Bool("force-index", false, "always narrow the search with the index, even when searching every file looks faster")
+	cpuProfile = flag.String("cpuprofile", "", "write cpu profile to this file")
+	typeList = flag.Bool("type-list", false, "list file types and exit")
+	symFlag = flag.Bool("sym", false, "search for definitions of symbols matching regexp")
+	rankFlag = flag.Bool("rank", false, "search the most relevant files first")
+	sortFlag = flag.String("sort", "path", "search the files in `order` path or modified")
+	statsFlag = flag.Bool("stats", false, "print the query plan and search statistics")
+	multiline = flag.Bool("multiline", false, "allow matches to span lines")
+	queryFlag = flag.Bool("query", false, "treat the argument as a query expression, not a regexp")
+	maxResults = flag.Int("max-results", 0, "stop after `n` matching files (0 means no limit)")
+	jobsFlag = flag.Int("j", runtime.GOMAXPROCS(0), "grep `n` files at once")
+	waitFlag = flag.Duration("wait", 0, "wait up to `d` for cindex to finish writing the index")
+	timeoutFlag = flag.Duration("timeout", 0, "stop the search after `d` (0 means no limit)")
+	daemonFlag = flag.Bool("daemon", false, "serve searches from a long-lived process")
+	replFlag = flag.Bool("repl", false, "read searches from standard input, keeping the indexes open between them")
+	noDaemon = flag.Bool("no-daemon", false, "search without delegating to a csearch -daemon")
+	freshFlag = flag.Bool("verify-fresh", false, "also grep files changed since they were indexed, and warn about them")
+	saveFlag = flag.String("save", "", "save the search under `name` instead of running it")
+	runFlag = flag.String("run", "", "run the search saved under `name`")
+	listFlag = flag.Bool("list-saved", false, "list the saved searches and exit")
+	pcreFlag = flag.Bool("pcre-compat", false, "translate PCRE syntax in regexp to RE2")
+	refFlag = flag.String("ref", "", "search the index of git revision `ref`, as built by cindex -git-ref")
+	patchFlag = flag.String("patch", "", "search the lines added by the unified diff in `file` (- for standard input) or by git revision range a..b")
+	quietFlag = flag.Bool("q", false, "print nothing and stop at the first match")
+	idFlag = flag.Bool("id", false, "search for uses of the identifier in code, in any case convention")
+	inFlag = flag.String("in", "", "report only matches in `regions` code, comments, or strings")
+	dedupeFlag = flag.Bool("dedupe", false, "search only one of the indexed files holding the same text")
+	batchFlag = flag.String("batch", "", "run the searches listed in `file`, one per line, at once")
+	outputFlag = flag.String("output", "text", "print the results in `format` text or ndjson")
+	oFlag = flag.String("o", "", "print only the matches, as formatted by `template`, such as $0 or $1")
+
+	indexFlags, typeFlags, typeAddFlags, globFlags, repoFlags, langFlags = nil, nil, nil, nil, nil, nil
+	g.AddFlags()
+	flag.IntVar(&g.Max, "m", 0, "stop after `n` matching lines (0 means no limit)")
+	flag.Var(&indexFlags, "index", "search the index in `file` instead of $CSEARCHINDEX")
+	flag.Var(&typeFlags, "type", "search only files of `type`")
+	flag.Var(&typeAddFlags, "type-add", "add file type `name:glob`")
+	flag.Var(&globFlags, "g", "search only files matching `glob` (or not matching !glob)")
+	flag.Var(&globFlags, "glob", "same as -g")
+	flag.Var(&repoFlags, "repo", "search only files in repository `name`")
+	flag.Var(&langFlags, "lang", "search only files in language `name`")
+	flag.Usage = usage
+}
+
 func Main() {
 	g := regexp.Grep{
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
 	}
-	g.AddFlags()
+	defineFlags(&g)
+	args, _ := parseFlags(&g, os.Args[1:])
+	logging.Setup(os.Stderr)
+	if *daemonFlag {
+		serveDaemon()
+		return
+	}
+	if *replFlag {
+		serveRepl(args)
+		return
+	}
+	if *listFlag {
+		listSaved(&g)
+		exit(0)
+	}
+	if *saveFlag != "" {
+		saveSearch(&g, *saveFlag, args)
+		exit(0)
+	}
+	if !*noDaemon && *cpuProfile == "" && !*typeList && *patchFlag == "" && *batchFlag == "" {
+		delegate(os.Args[1:], g.Color)
+	}
+	run(&g, args)
+}
 
-	flag.Usage = usage
-	flag.Parse()
-	args := flag.Args()
+// run runs the search given by the arguments left after flag parsing.
+func run(g *regexp.Grep, args []string) {
+	fileTypes := index.DefaultFileTypes()
+	for _, def := range typeAddFlags {
+		if err := fileTypes.Add(def); err != nil {
+			fatal(err)
+		}
+	}
+	if *typeList {
+		var names []string
+		for name := range fileTypes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(g.Stdout, "%s: %s\n", name, strings.Join(fileTypes[name], ", "))
+		}
+		return
+	}
+	var types []string
+	for _, list := range typeFlags {
+		types = append(types, strings.Split(list, ",")...)
+	}
+	var repos []string
+	for _, list := range repoFlags {
+		repos = append(repos, strings.Split(list, ",")...)
+	}
+	var langs []string
+	for _, list := range langFlags {
+		langs = append(langs, strings.Split(list, ",")...)
+	}
 
-	if len(args) != 1 {
+	if *batchFlag != "" {
+		if len(args) != 0 {
+			usage()
+		}
+	} else if len(args) != 1 {
 		usage()
 	}
 
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		defer f.Close()
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
 
-	pat := "(?m)" + args[0]
-	if *iFlag {
-		pat = "(?i)" + pat
+	if *queryFlag && *symFlag {
+		fatal("-sym cannot be combined with -query")
+	}
+	if *patchFlag != "" && *symFlag {
+		fatal("-sym cannot be combined with -patch")
+	}
+	if *idFlag && (*symFlag || *queryFlag || *patchFlag != "") {
+		fatal("-id cannot be combined with -sym, -query, or -patch")
+	}
+	if *inFlag != "" {
+		k, ok := index.ParseRegionKind(*inFlag)
+		if !ok {
+			fatalf("invalid -in %q: want code, comments, or strings", *inFlag)
+		}
+		if *symFlag || *idFlag || *patchFlag != "" {
+			fatal("-in cannot be combined with -sym, -id, or -patch")
+		}
+		inKind = k
+	}
+	if *batchFlag != "" && (*symFlag || *idFlag || *patchFlag != "" || *inFlag != "") {
+		fatal("-batch cannot be combined with -sym, -id, -patch, or -in")
+	}
+	switch *sortFlag {
+	case "path", "modified":
+	default:
+		fatalf("invalid -sort %q: want path or modified", *sortFlag)
+	}
+	if *rankFlag && *sortFlag != "path" {
+		fatal("-rank cannot be combined with -sort")
+	}
+	if *oFlag != "" {
+		if *symFlag || *idFlag || *batchFlag != "" {
+			fatal("-o cannot be combined with -sym, -id, or -batch")
+		}
+		g.O, g.Template = true, *oFlag
+	}
+	switch *outputFlag {
+	case "text":
+	case "ndjson":
+		if *symFlag || *idFlag || *patchFlag != "" || *batchFlag != "" || g.L || g.C || *quietFlag || *oFlag != "" {
+			fatal("-output ndjson cannot be combined with -sym, -id, -patch, -batch, -l, -c, -q, or -o")
+		}
+		// Matches are reported without context.
+		g.A, g.B, g.Heading = 0, 0, false
+	default:
+		fatalf("invalid -output %q: want text or ndjson", *outputFlag)
+	}
+	if *quietFlag {
+		// Listing a file stops grepping it at its first match,
+		// and -max-results stops the search there.
+		g.Stdout = ioutil.Discard
+		g.L, g.C, g.Heading = true, false, false
+		*maxResults = 1
+	}
+	// Errors reported while searching, such as files that
+	// cannot be read, make the exit status 2.
+	stderr := g.Stderr
+	g.Stderr = errorWriter{stderr}
+	defer func() { g.Stderr = stderr }()
+
+	// With -timeout, g stops grepping once the time is up, and the
+	// index queries and batch searches stop with it.
+	ctx := context.Background()
+	if *timeoutFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutFlag)
+		defer cancel()
+		defer func() {
+			if ctx.Err() != nil {
+				fmt.Fprintf(g.Stderr, "csearch: search timed out after %v; results are incomplete\n", *timeoutFlag)
+			}
+		}()
+	}
+	g.Context = ctx
+
+	start := time.Now()
+	compile := search.Compile
+	if *queryFlag {
+		compile = search.CompileQuery
+	}
+	opts := &search.Options{
+		IgnoreCase: *iFlag,
+		Literal:    *fixedFlag,
+		File:       *fFlag,
+		Types:      types,
+		FileTypes:  fileTypes,
+		Globs:      globFlags,
+		Repos:      repos,
+		Langs:      langs,
+		Brute:      *bruteFlag,
+		ForceIndex: *forceIndex,
+		Multiline:  *multiline,
+		PCRECompat: *pcreFlag,
+		Normalize:  *patchFlag == "" && normalizedIndexes(),
 	}
-	re, err := regexp.Compile(pat)
+	if *batchFlag != "" {
+		searchBatch(g, compile, opts)
+		return
+	}
+	newQuery := queryCompiler(compile, args[0], opts)
+	sq, err := newQuery()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	if *symFlag {
+		pat := args[0]
+		if *fixedFlag {
+			pat = stdregexp.QuoteMeta(pat)
+		} else if *pcreFlag {
+			if pat, err = regexp.TranslatePCRE(pat); err != nil {
+				fatal(err)
+			}
+		}
+		searchSymbols(g, pat, sq)
+		matches = g.Match
+		return
+	}
+
+	if *idFlag {
+		searchIdentifiers(g, args[0], sq)
+		matches = g.Match
+		return
 	}
+
+	if *patchFlag != "" {
+		searchPatch(g, sq)
+		matches = g.Match
+		return
+	}
+
+	re := sq.Regexp
 	g.Regexp = re
-	var fre *regexp.Regexp
-	if *fFlag != "" {
-		fre, err = regexp.Compile(*fFlag)
-		if err != nil {
-			log.Fatal(err)
+	g.Multiline = *multiline
+	g.Normalize = opts.Normalize
+	q := sq.Index
+	if *verboseFlag {
+		slog.Info("query", "query", q.String())
+		if sq.Names != nil {
+			slog.Info("file name query", "query", sq.Names.String())
 		}
 	}
-	q := index.RegexpQuery(re.Syntax)
+	stats.regexp = re.Syntax.String()
+	stats.query = q
+	stats.compile = time.Since(start)
+	if *outputFlag == "ndjson" {
+		startStream(g.Stdout, args[0], re, q)
+	}
+
+	start = time.Now()
+	names, mtime := candidates(ctx, sq)
 	if *verboseFlag {
-		log.Printf("query: %s\n", q)
+		slog.Info("post query identified possible files", "files", len(names))
 	}
+	stats.candidates = len(names)
+	stats.lookup = time.Since(start)
 
-	ix := index.Open(index.File())
-	ix.Verbose = *verboseFlag
-	var post []uint32
-	if *bruteFlag {
-		post = ix.PostingQuery(&index.Query{Op: index.QAll})
-	} else {
-		post = ix.PostingQuery(q)
+	start = time.Now()
+	if *fFlag != "" || types != nil || globFlags != nil {
+		fnames := make([]string, 0, len(names))
+		for _, name := range names {
+			if sq.Keep(name) {
+				fnames = append(fnames, name)
+			}
+		}
+		if *verboseFlag {
+			slog.Info("file name, type, and glob filters matched files", "files", len(fnames))
+		}
+		names = fnames
 	}
-	if *verboseFlag {
-		log.Printf("post query identified %d possible files\n", len(post))
+
+	if *rankFlag {
+		rankFiles(names, re, mtime)
+	} else if *sortFlag == "modified" {
+		sortModified(names, mtime)
+	}
+	stats.filtered = len(names)
+	stats.filter = time.Since(start)
+
+	start = time.Now()
+	grepFiles(g, sq, names, func() *search.Query {
+		q, _ := newQuery()
+		return q
+	})
+	stats.grep = time.Since(start)
+	if *outputFlag == "ndjson" {
+		endStream(g.Stdout)
+	}
+
+	if stats.stale > 0 || stats.gone > 0 {
+		fmt.Fprintf(stderr, "csearch: %d files changed and %d removed since they were indexed; run cindex to update the index\n", stats.stale, stats.gone)
+	}
+	if *statsFlag {
+		stats.print(stderr)
 	}
+}
 
-	if fre != nil {
-		fnames := make([]uint32, 0, len(post))
+// candidates returns the names of the indexed files that might match sq,
+// considering its trigram query and the restrictions on repository
+// and language recorded in the index.
+// If the search results are to be ranked or sorted by modification
+// time, candidates also returns the times recorded in the index for
+// those files.
+// If there are several indexes, or the index is sharded, candidates
+// queries them all, in parallel in the case of shards, and returns
+// each name only once.  With -verify-fresh, the candidates also
+// include every file that has changed since it was indexed.
+func candidates(ctx context.Context, sq *search.Query) ([]string, map[string]time.Time) {
+	var names []string
+	var mtime map[string]time.Time
+	if *rankFlag || *sortFlag == "modified" {
+		mtime = make(map[string]time.Time)
+	}
+	fileRefs = make(map[string]fileRef)
+	// With -dedupe, canon records the canonical files
+	// whose text is among the candidates already.
+	// The first file with a text that the file name
+	// filters keep stands for the others.
+	var canon map[fileRef]bool
+	if *dedupeFlag {
+		canon = make(map[fileRef]bool)
+	}
+	add := func(ix *index.Index, fileid uint32) {
+		if !sq.KeepFile(ix, fileid) {
+			return
+		}
+		if canon != nil {
+			if !sq.Keep(ix.Name(fileid)) {
+				return
+			}
+			ref := fileRef{ix, ix.Canonical(fileid)}
+			if canon[ref] {
+				return
+			}
+			canon[ref] = true
+		}
+		name := ix.Name(fileid)
+		names = append(names, name)
+		if _, ok := fileRefs[name]; !ok {
+			fileRefs[name] = fileRef{ix, fileid}
+		}
+		if _, ok := mtime[name]; mtime != nil && !ok {
+			mtime[name] = ix.Meta(fileid).ModTime
+		}
+	}
 
+	// indexQuery returns the query to run against the index in file,
+	// whose EstimateQuery method is estimate, noting in the statistics
+	// if searching every file looks cheaper than sq's query.
+	indexQuery := func(file string, estimate func(*index.Query) index.QueryCost) *index.Query {
+		q := sq.IndexQuery(estimate)
+		if q != sq.Index {
+			stats.scans++
+			if *verboseFlag {
+				c := estimate(sq.Index)
+				slog.Info("searching every file: query costs more", "index", file,
+					"files", c.Files, "candidates", c.Candidates, "postings", c.Postings)
+			}
+		}
+		return q
+	}
+
+	var searched []*index.Index
+	// shadowed reports, for each shard searched, whether newer shards
+	// shadow a file in it, so that -verify-fresh passes over the file.
+	shadowed := make(map[*index.Index]func(fileid uint32) bool)
+	files := searchFiles()
+	for _, file := range files {
+		if index.IsSharded(file) {
+			s := openSharded(file)
+			for i, ix := range s.Shards {
+				stats.indexed += ix.NumFiles()
+				shadowed[ix] = func(fileid uint32) bool { return s.Shadowed(i, fileid) }
+			}
+			searched = append(searched, s.Shards...)
+			post, err := s.PostingQueryNamesContext(ctx, indexQuery(file, s.EstimateQuery), sq.Names)
+			if err != nil {
+				break
+			}
+			for i, post := range post {
+				for _, fileid := range post {
+					add(s.Shards[i], fileid)
+				}
+			}
+			continue
+		}
+		ix := openIndex(file)
+		ix.Verbose = *verboseFlag
+		stats.indexed += ix.NumFiles()
+		searched = append(searched, ix)
+		post, err := ix.PostingQueryNamesContext(ctx, indexQuery(file, ix.EstimateQuery), sq.Names)
+		if err != nil {
+			break
+		}
 		for _, fileid := range post {
-			name := ix.Name(fileid)
-			if fre.MatchString(name, true, true) < 0 {
-				continue
+			add(ix, fileid)
+		}
+	}
+	if *freshFlag {
+		// Files changed since they were indexed
+		// no longer hold the text of their copies.
+		canon = nil
+		for _, ix := range searched {
+			for fileid := uint32(0); fileid < uint32(ix.NumFiles()); fileid++ {
+				if shadowed[ix] != nil && shadowed[ix](fileid) {
+					continue
+				}
+				switch changed, gone := ix.Changed(fileid); {
+				case gone:
+					stats.gone++
+				case changed:
+					stats.stale++
+					add(ix, fileid)
+				}
 			}
-			fnames = append(fnames, fileid)
 		}
+	}
+	if len(files) == 1 && !index.IsSharded(files[0]) && stats.stale == 0 {
+		return names, mtime
+	}
 
-		if *verboseFlag {
-			log.Printf("filename regexp matched %d files\n", len(fnames))
+	sort.Strings(names)
+	w := 0
+	for _, name := range names {
+		if w == 0 || names[w-1] != name {
+			names[w] = name
+			w++
 		}
-		post = fnames
 	}
+	return names[:w], mtime
+}
 
-	for _, fileid := range post {
-		name := ix.Name(fileid)
-		g.File(name)
+// indexFiles returns the names of the indexes to search:
+// those given by -index flags, or else those listed in $CSEARCHINDEX,
+// or their indexes of the revision named by -ref, or, in csearch
+// -daemon, those that it serves.
+func indexFiles() []string {
+	if served != nil {
+		return served
+	}
+	files := namedIndexFiles()
+	if ref := *refFlag; ref != "" {
+		for i, f := range files {
+			files[i] = index.RefFile(f, ref)
+			if _, err := os.Stat(files[i]); err != nil {
+				fatalf("-ref %s: no index of the revision: %v (see cindex -git-ref)", ref, err)
+			}
+		}
+	}
+	if *waitFlag == 0 {
+		// Report a missing index as an error here, rather than
+		// leave index.Open to exit with the status for no match.
+		for _, f := range files {
+			if _, err := os.Stat(f); err != nil && !index.IsRemote(f) {
+				fatal(err)
+			}
+		}
 	}
+	return files
+}
 
-	matches = g.Match
+// searchFiles returns the names of the indexes to search: those
+// returned by indexFiles and the indexes they attach (see cindex -attach).
+func searchFiles() []string {
+	return index.AttachedFiles(indexFiles(), openIndex)
+}
+
+// normalizedIndexes reports whether any of the indexes to search holds
+// text in Unicode normalization form NFC (see cindex -nfc), in which
+// case the search normalizes its pattern and the text it reads.
+func normalizedIndexes() bool {
+	for _, file := range searchFiles() {
+		if index.IsSharded(file) {
+			for _, ix := range openSharded(file).Shards {
+				if ix.Normalized() {
+					return true
+				}
+			}
+			continue
+		}
+		if openIndex(file).Normalized() {
+			return true
+		}
+	}
+	return false
+}
+
+// namedIndexFiles returns the names of the indexes given by -index
+// flags, or else those listed in $CSEARCHINDEX.
+func namedIndexFiles() []string {
+	var files []string
+	for _, list := range indexFlags {
+		files = append(files, index.SplitList(list)...)
+	}
+	if len(files) == 0 {
+		files = index.Files()
+	}
+	return files
+}
+
+// openIndex opens the index in file, waiting for a writer
+// to finish with it if -wait is set.
+func openIndex(file string) *index.Index {
+	if indexes != nil {
+		return indexes.open(file).ix
+	}
+	if *waitFlag > 0 {
+		return index.OpenWait(file, *waitFlag)
+	}
+	return index.Open(file)
+}
+
+// openSharded opens the sharded index in the directory file.
+func openSharded(file string) *index.ShardedIndex {
+	if indexes != nil {
+		return indexes.open(file).s
+	}
+	return index.OpenSharded(file)
+}
+
+// grepFile searches the named indexed file using g,
+// if its content matches sq.
+func grepFile(g *regexp.Grep, sq *search.Query, name string) {
+	var f io.ReadCloser
+	var err error
+	ref, ok := fileRefs[name]
+	if !index.IsTarStream(name) {
+		f, err = index.OpenFile(name)
+	}
+	// The files of tar streams can only be read from the index,
+	// and files not on this machine, as with a remote index,
+	// can be if the index stores their text (see cindex -store-content).
+	if ok && (index.IsTarStream(name) || os.IsNotExist(err)) {
+		data, stored := ref.ix.Content(ref.fileid)
+		if !stored {
+			if index.IsTarStream(name) {
+				fmt.Fprintf(g.Stderr, "%s: text not stored in index\n", name)
+				return
+			}
+		} else {
+			f, err = ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(g.Stderr, "%s\n", err)
+		return
+	}
+	defer f.Close()
+	if sq.NeedContent() || *inFlag != "" {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
+			return
+		}
+		if g.Normalize {
+			data = norm.NFC.Bytes(data)
+		}
+		if ref := fileRefs[name]; sq.NeedContent() && !sq.KeepContent(ref.ix, ref.fileid, data) {
+			return
+		}
+		if *inFlag != "" {
+			g.Offsets = inRegions(name, data)
+		}
+		g.Reader(bytes.NewReader(data), name)
+		return
+	}
+	g.Reader(f, name)
+}
+
+// inRegions returns a function reporting whether a byte offset in data,
+// the text of the named file, lies in a region of the kind -in selects.
+// The regions are those the index records, if it does and the file is
+// unchanged, or else those found by lexing data.
+func inRegions(name string, data []byte) func(off int64) bool {
+	var regions []index.Region
+	if ref, ok := fileRefs[name]; ok {
+		regions = ref.ix.Regions(ref.fileid, data)
+	}
+	return func(off int64) bool {
+		return index.RegionAt(regions, int(off)) == inKind
+	}
+}
+
+// status returns the exit status of the search just run, as grep
+// would: 0 if it found a match, 1 if not, and 2 if an error occurred,
+// except that with -q a match wins over errors.
+func status() int {
+	switch {
+	case failed && !(matches && *quietFlag):
+		return 2
+	case matches:
+		return 0
+	}
+	return 1
+}
+
+// An errorWriter writes the errors reported while searching to w,
+// noting in failed that there were some.
+type errorWriter struct {
+	w io.Writer
+}
+
+func (e errorWriter) Write(p []byte) (int, error) {
+	failed = true
+	return e.w.Write(p)
 }
 
 func main() {
 	Main()
-	if !matches {
-		os.Exit(1)
-	}
-	os.Exit(0)
+	os.Exit(status())
 }
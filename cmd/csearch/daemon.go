@@ -0,0 +1,401 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/codesearch/cmd/internal/logging"
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/search"
+)
+
+// Daemon mode.
+//
+// Csearch -daemon listens on a Unix domain socket and runs the searches
+// that other csearch processes send it, one at a time.  It keeps the
+// indexes it serves open, reopening them when cindex replaces them,
+// and it keeps the compiled regexps and trigram queries of recent
+// searches, so that repeating a search skips both steps.
+//
+// A client sends a daemonRequest as JSON.  The daemon replies with a
+// sequence of frames, each a tag byte, a 4-byte big-endian length,
+// and that much data: the search's standard output ('o') and standard
+// error ('e'), and finally its exit status in decimal ('x').  If the
+// client names different indexes than the daemon serves, the daemon
+// replies with a single 'r' frame instead, refusing the search.
+
+// A daemonRequest asks csearch -daemon to run a search.
+type daemonRequest struct {
+	Args  []string // command-line arguments
+	Index []string // absolute names of the indexes to search
+	Color bool     // color the output, as the client resolved -color
+}
+
+// An exitCode is the panic value with which exit ends a search
+// being served by csearch -daemon.
+type exitCode int
+
+const maxCachedQueries = 100
+
+var (
+	// served lists the indexes that csearch -daemon serves.
+	served []string
+
+	// indexes and queries hold the indexes and compiled queries
+	// that csearch -daemon keeps between searches.
+	indexes *indexCache
+	queries *queryCache
+)
+
+// socketFile returns the name of the daemon's socket: $CSEARCHSOCKET,
+// or else the name of the first index to search with .sock appended.
+func socketFile() string {
+	if file := os.Getenv("CSEARCHSOCKET"); file != "" {
+		return file
+	}
+	return indexFiles()[0] + ".sock"
+}
+
+// absFiles returns the absolute names of files.
+func absFiles(files []string) []string {
+	var abs []string
+	for _, file := range files {
+		if a, err := filepath.Abs(file); err == nil {
+			file = a
+		}
+		abs = append(abs, file)
+	}
+	return abs
+}
+
+// serveDaemon implements csearch -daemon.
+func serveDaemon() {
+	file := socketFile()
+	if c, err := net.Dial("unix", file); err == nil {
+		c.Close()
+		log.Fatalf("%s: csearch -daemon is already running", file)
+	}
+	os.Remove(file)
+	l, err := net.Listen("unix", file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close() // removes the socket
+		os.Exit(0)
+	}()
+
+	served = absFiles(indexFiles())
+	indexes = &indexCache{entries: make(map[string]*cachedIndex)}
+	queries = &queryCache{entries: make(map[string][]*search.Query)}
+	// Each search redefines the flags, so remember -verbose.
+	verbose := *verboseFlag
+	if verbose {
+		slog.Info("serving", "index", strings.Join(served, string(filepath.ListSeparator)), "socket", file)
+	}
+	exit = func(code int) {
+		panic(exitCode(code))
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		serveConn(c, verbose)
+	}
+}
+
+// serveConn runs the search requested on c,
+// logging it if verbose is set.
+func serveConn(c net.Conn, verbose bool) {
+	defer c.Close()
+	var req daemonRequest
+	if err := json.NewDecoder(c).Decode(&req); err != nil {
+		slog.Warn("cannot read request", "error", err)
+		return
+	}
+	if !sameFiles(req.Index, served) {
+		writeFrame(c, 'r', nil)
+		return
+	}
+	start := time.Now()
+	code := runRequest(c, &req)
+	writeFrame(c, 'x', []byte(strconv.Itoa(code)))
+	if verbose {
+		slog.Info("search", "args", req.Args, "exit", code, "elapsed", time.Since(start))
+	}
+}
+
+func sameFiles(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// runRequest runs the search requested by req,
+// sending its output to c, and returns its exit status.
+func runRequest(c net.Conn, req *daemonRequest) (code int) {
+	stdout := bufio.NewWriter(&frameWriter{c, 'o'})
+	stderr := io.MultiWriter(flushWriter{stdout}, &frameWriter{c, 'e'})
+	logger := slog.Default()
+	defer func() {
+		if e := recover(); e != nil {
+			ec, ok := e.(exitCode)
+			if !ok {
+				panic(e)
+			}
+			code = int(ec)
+		}
+		slog.SetDefault(logger)
+	}()
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.SetOutput(stderr)
+	g := regexp.Grep{
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	defineFlags(&g)
+	// Log to the client: as the defaults direct while parsing
+	// the search's flags, and then as those flags direct.
+	logging.Setup(stderr)
+	args, err := parseFlags(&g, req.Args)
+	if err != nil {
+		return 2
+	}
+	logging.Setup(stderr)
+	// The daemon's output is not a terminal, so -color=auto
+	// must be decided by the client.
+	g.Color = req.Color
+	matches, failed, fileRefs, stats = false, false, nil, searchStats{}
+	run(&g, args)
+	if err := stdout.Flush(); err != nil {
+		return 2
+	}
+	return status()
+}
+
+// A frameWriter writes data to a client in frames with the given tag.
+// If the client has gone away, it ends the search.
+type frameWriter struct {
+	w   io.Writer
+	tag byte
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	if err := writeFrame(f.w, f.tag, p); err != nil {
+		exit(1)
+	}
+	return len(p), nil
+}
+
+// A flushWriter flushes w before each write,
+// so that standard output and standard error stay in order.
+type flushWriter struct {
+	w *bufio.Writer
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	return len(p), f.w.Flush()
+}
+
+func writeFrame(w io.Writer, tag byte, data []byte) error {
+	var hdr [5]byte
+	hdr[0] = tag
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(data)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader) (tag byte, data []byte, err error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	data = make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], data, nil
+}
+
+// delegate sends the search given by args to csearch -daemon, if it
+// is running and serves the indexes to search, and exits with the
+// search's status.  Color reports whether to color the output.
+// If the daemon cannot run the search, delegate returns,
+// and csearch searches by itself.
+func delegate(args []string, color bool) {
+	c, err := net.Dial("unix", socketFile())
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	req := daemonRequest{Args: args, Index: absFiles(indexFiles()), Color: color}
+	if err := json.NewEncoder(c).Encode(&req); err != nil {
+		return
+	}
+	r := bufio.NewReader(c)
+	printed := false
+	for {
+		tag, data, err := readFrame(r)
+		if err != nil {
+			if !printed {
+				// The daemon went away before starting the search.
+				return
+			}
+			log.Fatalf("csearch -daemon: %v", err)
+		}
+		switch tag {
+		case 'o':
+			os.Stdout.Write(data)
+		case 'e':
+			os.Stderr.Write(data)
+		case 'x':
+			code, _ := strconv.Atoi(string(data))
+			os.Exit(code)
+		case 'r':
+			return
+		}
+		printed = true
+	}
+}
+
+// An indexCache holds the indexes opened by csearch -daemon.
+type indexCache struct {
+	entries map[string]*cachedIndex
+}
+
+// A cachedIndex is an open index, either a single file (ix)
+// or a directory of shards (s).
+type cachedIndex struct {
+	info os.FileInfo // index file or directory, when opened
+	ix   *index.Index
+	s    *index.ShardedIndex
+}
+
+// open returns the open index in file, opening it if it is not already
+// open or if it has changed since, as when cindex replaces it or, for
+// a sharded index, adds or removes shards.
+func (c *indexCache) open(file string) *cachedIndex {
+	if *waitFlag > 0 {
+		index.Wait(file, *waitFlag)
+	}
+	// For a remote index, the cached copy changes
+	// when a download brings a new index.
+	info, err := os.Stat(index.Local(file))
+	e := c.entries[file]
+	if e != nil && err == nil && os.SameFile(e.info, info) &&
+		e.info.ModTime().Equal(info.ModTime()) && e.info.Size() == info.Size() {
+		return e
+	}
+	if e != nil {
+		if e.ix != nil {
+			e.ix.Close()
+		} else {
+			e.s.Close()
+		}
+		delete(c.entries, file)
+	}
+	e = &cachedIndex{info: info}
+	if err == nil && info.IsDir() {
+		e.s = index.OpenSharded(file)
+	} else {
+		e.ix = index.Open(file)
+	}
+	if err == nil {
+		c.entries[file] = e
+	}
+	return e
+}
+
+// A queryCache holds the compiled queries of recent searches made by
+// csearch -daemon: for each search, as many copies as it has used
+// at once, since a compiled regexp is not safe for concurrent use.
+type queryCache struct {
+	mu      sync.Mutex
+	entries map[string][]*search.Query
+	order   []string // keys of entries, least recently used first
+}
+
+// queryCompiler returns a function that compiles pattern with opts
+// using compile, returning a new copy of the query each time it is
+// called.  In csearch -daemon, the copies come from the queries made
+// for earlier searches, if possible.
+func queryCompiler(compile func(string, *search.Options) (*search.Query, error), pattern string, opts *search.Options) func() (*search.Query, error) {
+	if queries == nil {
+		return func() (*search.Query, error) {
+			return compile(pattern, opts)
+		}
+	}
+	key := fmt.Sprintf("%t %q %+v", *queryFlag, pattern, *opts)
+	n := 0
+	return func() (*search.Query, error) {
+		c := queries
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		i := n
+		n++
+		list, ok := c.entries[key]
+		if ok && i == 0 {
+			c.touch(key)
+		}
+		if i < len(list) {
+			return list[i], nil
+		}
+		q, err := compile(pattern, opts)
+		if err != nil {
+			return nil, err
+		}
+		c.entries[key] = append(list, q)
+		if !ok {
+			c.order = append(c.order, key)
+			if len(c.order) > maxCachedQueries {
+				delete(c.entries, c.order[0])
+				c.order = c.order[1:]
+			}
+		}
+		return q, nil
+	}
+}
+
+// touch marks key as the most recently used.
+func (c *queryCache) touch(key string) {
+	for i, k := range c.order {
+		if k == key {
+			copy(c.order[i:], c.order[i+1:])
+			c.order[len(c.order)-1] = key
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/search"
+)
+
+// A grepResult is the outcome of grepping one file ahead of printing.
+type grepResult struct {
+	match   bool
+	matches int // matching lines streamed, with -output ndjson
+	stdout  bytes.Buffer
+	stderr  bytes.Buffer
+	done    chan struct{} // closed when the grep finishes
+}
+
+// grepFiles greps the named files in order using g, stopping once -m
+// or -max-results is satisfied.  Unless -j is 1, it greps up to -j files
+// at a time, each goroutine using its own copy of g and of the query,
+// made by newQuery, since a compiled regexp is not safe for concurrent
+// use.  The output of each file is buffered and printed in order, so it
+// is the same as that of grepping the files one at a time.  GrepFiles
+// returns only after the goroutines have finished, so that csearch
+// -daemon can give their queries to the next search.
+func grepFiles(g *regexp.Grep, sq *search.Query, names []string, newQuery func() *search.Query) {
+	var results <-chan *grepResult
+	if *jobsFlag > 1 && len(names) > 1 {
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		defer close(stop)
+		results = grepAhead(g, names, newQuery, stop, &wg)
+	}
+
+	// A file grepped on its own prints no separator before its
+	// first group of context lines, or with -heading, no blank line
+	// before its heading, so print one here instead.
+	sep := ""
+	switch {
+	case g.Heading && !g.H && !g.L && !g.C:
+		sep = "\n"
+	case (g.A > 0 || g.B > 0) && !g.L && !g.C && !g.Multiline:
+		sep = "--\n"
+	}
+	printed := false
+	for _, name := range names {
+		if g.Done() {
+			break
+		}
+		g.Match = false
+		if results == nil {
+			s := newStream(g, name)
+			grepFile(g, sq, name)
+			stats.reported += s.end()
+		} else {
+			r := <-results
+			<-r.done
+			switch {
+			case r.match && g.Max > 0:
+				// Only g knows how many more lines -m allows,
+				// so grep the file again to print them.
+				s := newStream(g, name)
+				grepFile(g, sq, name)
+				stats.reported += s.end()
+			default:
+				if sep != "" && printed && r.stdout.Len() > 0 {
+					fmt.Fprint(g.Stdout, sep)
+				}
+				printed = printed || r.stdout.Len() > 0
+				r.stdout.WriteTo(g.Stdout)
+				r.stderr.WriteTo(g.Stderr)
+				g.Match = r.match
+				stats.reported += r.matches
+			}
+		}
+		stats.grepped++
+		if g.Match {
+			matches = true
+			if stats.matched++; stats.matched == *maxResults {
+				break
+			}
+		}
+	}
+}
+
+// grepAhead greps the named files on -j goroutines, returning
+// a channel of the results in the order of names.  To bound the
+// output held in memory, it starts at most -j greps ahead of those
+// taken from the channel.  It stops starting greps when stop is closed,
+// and it calls wg.Done once each goroutine has finished.
+func grepAhead(g *regexp.Grep, names []string, newQuery func() *search.Query, stop <-chan struct{}, wg *sync.WaitGroup) <-chan *grepResult {
+	type job struct {
+		name string
+		r    *grepResult
+	}
+	results := make(chan *grepResult, *jobsFlag)
+	jobs := make(chan job)
+	tmpl := *g
+	wg.Add(*jobsFlag)
+	for i := 0; i < *jobsFlag; i++ {
+		go func() {
+			defer wg.Done()
+			sq := newQuery()
+			g := tmpl
+			g.Regexp = sq.Regexp
+			for j := range jobs {
+				g.Reset()
+				g.Stdout = &j.r.stdout
+				g.Stderr = &j.r.stderr
+				s := newStream(&g, j.name)
+				grepFile(&g, sq, j.name)
+				j.r.matches = s.end()
+				j.r.match = g.Match
+				close(j.r.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, name := range names {
+			r := &grepResult{done: make(chan struct{})}
+			select {
+			case results <- r:
+			case <-stop:
+				return
+			}
+			jobs <- job{name, r}
+		}
+	}()
+	return results
+}
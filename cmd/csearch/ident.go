@@ -0,0 +1,88 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/search"
+)
+
+// searchIdentifiers implements csearch -id: it prints the lines of the
+// files accepted by sq whose code uses the identifier id, spelled in
+// any case convention, leaving out comments and string literals.
+func searchIdentifiers(g *regexp.Grep, id string, sq *search.Query) {
+	words := index.IdentifierWords(id)
+	if len(words) == 0 {
+		fatalf("-id: %q is not an identifier", id)
+	}
+
+	// The index lists the files using all the words;
+	// reading them tells which use the identifier.
+	type candidate struct {
+		name, lang string
+	}
+	var files []candidate
+	seen := make(map[string]bool)
+	add := func(file string, ix *index.Index, shadowed func(fileid uint32) bool) {
+		if !ix.HasIdentifiers() {
+			fatalf("%s: index records no identifiers; rerun cindex with -identifiers to record them", file)
+		}
+		for _, fileid := range ix.IdentifierFiles(words) {
+			if shadowed != nil && shadowed(fileid) || !sq.KeepFile(ix, fileid) {
+				continue
+			}
+			name := ix.Name(fileid)
+			if !seen[name] && sq.Keep(name) {
+				seen[name] = true
+				files = append(files, candidate{name, ix.Meta(fileid).Lang})
+			}
+		}
+	}
+	for _, file := range searchFiles() {
+		if index.IsSharded(file) {
+			s := openSharded(file)
+			for i, ix := range s.Shards {
+				i := i
+				add(file, ix, func(fileid uint32) bool { return s.Shadowed(i, fileid) })
+			}
+			continue
+		}
+		add(file, openIndex(file), nil)
+	}
+	if *verboseFlag {
+		slog.Info("files using identifier words", "words", words, "files", len(files))
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	matched := 0
+	for _, f := range files {
+		data, err := index.ReadFile(f.name)
+		if err != nil {
+			fmt.Fprintf(g.Stderr, "%s\n", err)
+			continue
+		}
+		lines := index.IdentifierLines(f.lang, data, words)
+		if len(lines) == 0 {
+			continue
+		}
+		g.Match = true
+		switch {
+		case g.L:
+			fmt.Fprintf(g.Stdout, "%s\n", f.name)
+		case g.C:
+			fmt.Fprintf(g.Stdout, "%s: %d\n", f.name, len(lines))
+		default:
+			printLines(g, f.name, data, lines)
+		}
+		if matched++; matched == *maxResults {
+			break
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+)
+
+// With -output ndjson, csearch prints its results as a stream of
+// events, one JSON object per line, for programs such as CI jobs that
+// turn matches into annotations.  Each event has a type: query-start,
+// then file-begin, match, and file-end for each file with matches, and
+// finally summary.  The events of a file are printed as soon as it has
+// been searched, in the usual order of the files.
+
+// A queryStartEvent begins the stream.
+type queryStartEvent struct {
+	Type    string `json:"type"`    // "query-start"
+	Pattern string `json:"pattern"` // the regexp or query as given
+	Regexp  string `json:"regexp"`  // the parsed regexp
+	Query   string `json:"query"`   // the trigram query
+}
+
+// A fileBeginEvent precedes the matches in a file.
+type fileBeginEvent struct {
+	Type string `json:"type"` // "file-begin"
+	Path string `json:"path"`
+}
+
+// A matchEvent reports a matching line.
+type matchEvent struct {
+	Type       string     `json:"type"` // "match"
+	Path       string     `json:"path"`
+	Line       int        `json:"line"`   // line number, starting at 1
+	Column     int        `json:"column"` // byte offset of the first match in text, plus 1
+	Offset     int64      `json:"offset"` // byte offset of the line in the file
+	Text       string     `json:"text"`   // the line, without its newline
+	Submatches []submatch `json:"submatches"`
+}
+
+// A submatch is one match within a matching line.
+type submatch struct {
+	Text   string   `json:"text"`
+	Start  int      `json:"start"` // byte offset in the line
+	End    int      `json:"end"`
+	Groups []*group `json:"groups,omitempty"` // nil for a group that did not match
+}
+
+// A group is the text matched by a parenthesized group of the regexp.
+type group struct {
+	Name  string `json:"name,omitempty"`
+	Text  string `json:"text"`
+	Start int    `json:"start"` // byte offset in the line
+	End   int    `json:"end"`
+}
+
+// A fileEndEvent follows the matches in a file.
+type fileEndEvent struct {
+	Type    string `json:"type"` // "file-end"
+	Path    string `json:"path"`
+	Matches int    `json:"matches"` // matching lines
+}
+
+// A summaryEvent ends the stream.
+type summaryEvent struct {
+	Type          string  `json:"type"` // "summary"
+	Candidates    int     `json:"candidates"`
+	FilesSearched int     `json:"files_searched"`
+	FilesMatched  int     `json:"files_matched"`
+	Matches       int     `json:"matches"` // matching lines
+	Elapsed       float64 `json:"elapsed_sec"`
+}
+
+// startStream prints the query-start event for the search
+// for pattern, which uses re and the trigram query q.
+func startStream(w io.Writer, pattern string, re *regexp.Regexp, q *index.Query) {
+	writeEvent(w, &queryStartEvent{"query-start", pattern, re.Syntax.String(), q.String()})
+}
+
+// endStream prints the summary event.
+func endStream(w io.Writer) {
+	writeEvent(w, &summaryEvent{
+		Type:          "summary",
+		Candidates:    stats.candidates,
+		FilesSearched: stats.grepped,
+		FilesMatched:  stats.matched,
+		Matches:       stats.reported,
+		Elapsed:       round(stats.compile + stats.lookup + stats.filter + stats.grep).Seconds(),
+	})
+}
+
+// A stream prints the events for the matches in one file.
+type stream struct {
+	w       io.Writer
+	re      *regexp.Regexp // finds the groups of each match
+	name    string
+	matches int
+}
+
+// newStream returns a stream for the named file and arranges for g
+// to report the matches in it there, or returns nil if the output is
+// not ndjson.  It must be called after g.Stdout is set.
+func newStream(g *regexp.Grep, name string) *stream {
+	if *outputFlag != "ndjson" {
+		return nil
+	}
+	s := &stream{w: g.Stdout, re: g.Regexp, name: name}
+	g.OnMatch = s.match
+	return s
+}
+
+// match prints the event for m, after the file-begin event
+// if m is the first match.
+func (s *stream) match(m *regexp.Match) {
+	if s.matches == 0 {
+		writeEvent(s.w, &fileBeginEvent{"file-begin", s.name})
+	}
+	s.matches++
+	writeEvent(s.w, &matchEvent{
+		Type:       "match",
+		Path:       s.name,
+		Line:       m.Lineno,
+		Column:     m.Column,
+		Offset:     m.Offset,
+		Text:       string(m.Line),
+		Submatches: submatches(s.re, m.Line, m.Spans),
+	})
+}
+
+// end prints the file-end event, if the file had any matches,
+// and returns the number of matching lines.
+func (s *stream) end() int {
+	if s == nil {
+		return 0
+	}
+	if s.matches > 0 {
+		writeEvent(s.w, &fileEndEvent{"file-end", s.name, s.matches})
+	}
+	return s.matches
+}
+
+// submatches returns the matches of re at spans in line,
+// with the groups of each.
+func submatches(re *regexp.Regexp, line []byte, spans [][]int) []submatch {
+	subs := make([]submatch, 0, len(spans))
+	var all [][]int
+	if re.NumSubexp() > 0 {
+		all = re.FindAllSubmatchIndex(line, -1)
+	}
+	for _, sp := range spans {
+		sub := submatch{Text: string(line[sp[0]:sp[1]]), Start: sp[0], End: sp[1]}
+		for _, loc := range all {
+			if loc[0] != sp[0] {
+				continue
+			}
+			names := re.SubexpNames()
+			for i := 1; i < len(names); i++ {
+				var g *group
+				if lo, hi := loc[2*i], loc[2*i+1]; lo >= 0 {
+					g = &group{names[i], string(line[lo:hi]), lo, hi}
+				}
+				sub.Groups = append(sub.Groups, g)
+			}
+			break
+		}
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// writeEvent prints the event e to w as a line of JSON,
+// leaving characters such as < and > in the text unescaped.
+func writeEvent(w io.Writer, e any) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+}
@@ -0,0 +1,249 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/search"
+)
+
+// Patch searches.
+//
+// Csearch -patch searches the lines that a patch adds, rather than
+// the indexed files, so that a check run on a proposed change, such
+// as one in continuous integration, can ask whether the change
+// introduces text matching a regexp.  The patch is a unified diff,
+// read from a file, from standard input (-patch -), or from git diff
+// run on a revision range, such as main..HEAD.  Csearch indexes the
+// added lines of each file in memory and then greps the files the
+// index selects, reporting matches only on added lines, numbered as
+// in the new version of the file.
+
+// A patchFile holds what a patch shows of the new version of a file.
+type patchFile struct {
+	name  string
+	lines map[int]string // text of the added and context lines, by line number
+	added map[int]bool   // the line numbers of the added lines
+	last  int            // the largest line number in lines
+}
+
+// text returns the text of the lines of the new file that the
+// patch shows, with the lines it does not show left empty.
+func (f *patchFile) text() []byte {
+	var b bytes.Buffer
+	for n := 1; n <= f.last; n++ {
+		b.WriteString(f.lines[n])
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// addedText returns the text of the added lines.
+func (f *patchFile) addedText() []byte {
+	var ns []int
+	for n := range f.added {
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+	var b bytes.Buffer
+	for _, n := range ns {
+		b.WriteString(f.lines[n])
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// readPatch returns the patch named by the -patch flag:
+// a file, - for standard input, or a git revision range.
+func readPatch(arg string) []byte {
+	if arg == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fatal(err)
+		}
+		return data
+	}
+	data, err := os.ReadFile(arg)
+	if err == nil {
+		return data
+	}
+	if !os.IsNotExist(err) || !strings.Contains(arg, "..") {
+		fatal(err)
+	}
+	data, err = exec.Command("git", "diff", "--no-color", "--no-ext-diff", arg).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			fatalf("-patch: git diff %s: %s", arg, bytes.TrimSpace(ee.Stderr))
+		}
+		fatalf("-patch: git diff %s: %v", arg, err)
+	}
+	return data
+}
+
+// parsePatch returns the files that the unified diff in data adds
+// lines to, in the order the diff lists them.  Files that the diff
+// deletes, and binary files, are left out.
+func parsePatch(data []byte) []*patchFile {
+	var (
+		files   []*patchFile
+		f       *patchFile
+		oldName string
+		lineno  int // line number of the next new line in the hunk
+		left    int // new lines left in the hunk
+		oldLeft int // old lines left in the hunk
+	)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		line := s.Text()
+		if left > 0 || oldLeft > 0 {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				if f != nil {
+					f.lines[lineno] = line[1:]
+					f.added[lineno] = true
+					f.last = lineno
+				}
+				lineno++
+				left--
+			case strings.HasPrefix(line, " ") || line == "":
+				if f != nil {
+					f.lines[lineno] = strings.TrimPrefix(line, " ")
+					f.last = lineno
+				}
+				lineno++
+				left--
+				oldLeft--
+			case strings.HasPrefix(line, "-"):
+				oldLeft--
+			case strings.HasPrefix(line, `\`):
+				// \ No newline at end of file
+			default:
+				left, oldLeft = 0, 0
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "--- "):
+			oldName = patchName(line[4:])
+		case strings.HasPrefix(line, "+++ "):
+			name := patchName(line[4:])
+			f = nil
+			if name == "/dev/null" {
+				continue
+			}
+			if strings.HasPrefix(name, "b/") && strings.HasPrefix(oldName, "a/") || oldName == "/dev/null" && strings.HasPrefix(name, "b/") {
+				name = name[2:]
+			}
+			f = &patchFile{name: name, lines: make(map[int]string), added: make(map[int]bool)}
+			files = append(files, f)
+		case strings.HasPrefix(line, "@@ "):
+			var ok bool
+			lineno, left, oldLeft, ok = parseHunk(line)
+			if !ok {
+				fatalf("-patch: malformed hunk header: %s", line)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		fatal(err)
+	}
+	w := 0
+	for _, f := range files {
+		if len(f.added) > 0 {
+			files[w] = f
+			w++
+		}
+	}
+	return files[:w]
+}
+
+// patchName returns the file name in a ---/+++ line of a diff,
+// without the timestamp that diff -u appends after a tab.
+func patchName(s string) string {
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// parseHunk parses a hunk header, @@ -l,s +l,s @@, returning the
+// number of the first new line and the counts of new and old lines.
+func parseHunk(line string) (lineno, count, oldCount int, ok bool) {
+	f := strings.Fields(line)
+	if len(f) < 4 || !strings.HasPrefix(f[1], "-") || !strings.HasPrefix(f[2], "+") {
+		return 0, 0, 0, false
+	}
+	_, oldCount, ok1 := parseRange(f[1][1:])
+	lineno, count, ok2 := parseRange(f[2][1:])
+	return lineno, count, oldCount, ok1 && ok2
+}
+
+// parseRange parses l,s or l, the range of lines in a hunk header.
+func parseRange(s string) (start, count int, ok bool) {
+	a, b, found := strings.Cut(s, ",")
+	start, err := strconv.Atoi(a)
+	if err != nil {
+		return 0, 0, false
+	}
+	count = 1
+	if found {
+		if count, err = strconv.Atoi(b); err != nil {
+			return 0, 0, false
+		}
+	}
+	if start == 0 && count == 0 {
+		// An empty range names the line before it.
+		start = 1
+	}
+	return start, count, true
+}
+
+// searchPatch implements csearch -patch: it greps the lines added by
+// the patch for the regexp of sq, in the files that sq accepts.
+func searchPatch(g *regexp.Grep, sq *search.Query) {
+	files := parsePatch(readPatch(*patchFlag))
+	w := index.NewMemWriter()
+	w.AllowInvalidUTF8 = true
+	w.MaxLineLen = -1
+	w.MaxTextTrigrams = -1
+	byName := make(map[string]*patchFile)
+	for _, f := range files {
+		byName[f.name] = f
+		w.Add(f.name, bytes.NewReader(f.addedText()))
+	}
+	w.Flush()
+	ix := index.OpenBytes(w.Bytes())
+	g.Regexp = sq.Regexp
+	g.Multiline = *multiline
+	post, _ := ix.PostingQueryContext(g.Context, sq.Index)
+	for _, fileid := range post {
+		name := ix.Name(fileid)
+		f := byName[name]
+		if f == nil || !sq.Keep(name) {
+			continue
+		}
+		text := f.text()
+		if sq.NeedContent() && !sq.KeepContent(ix, fileid, text) {
+			continue
+		}
+		g.Lines = func(n int) bool { return f.added[n] }
+		g.Reader(bytes.NewReader(text), name)
+		if g.Done() {
+			break
+		}
+	}
+	g.Lines = nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/codesearch/regexp"
+)
+
+// Ranking weights.  A file's score starts at zero; the files with
+// the highest scores are searched, and so printed, first.
+const (
+	depthPenalty  = 1  // per directory level below the shallowest candidate
+	nameBoost     = 10 // file name matches the search regexp
+	testPenalty   = 5  // file looks like a test
+	recencyBoost  = 5  // maximum, for the most recently modified candidate
+	recencyHalves = 30 // days over which the recency boost halves
+)
+
+// rankFiles sorts names so that the files most likely to be relevant
+// to a search for re come first.  Files are preferred if they are
+// near the top of their trees, if their names match re, if they do
+// not look like tests, and if they were modified recently, according
+// to mtime, which may be nil.  Files with equal scores keep their order.
+func rankFiles(names []string, re *regexp.Regexp, mtime map[string]time.Time) {
+	minDepth := -1
+	var newest time.Time
+	for _, name := range names {
+		if d := pathDepth(name); minDepth < 0 || d < minDepth {
+			minDepth = d
+		}
+		if t := mtime[name]; t.After(newest) {
+			newest = t
+		}
+	}
+
+	score := make(map[string]float64, len(names))
+	for _, name := range names {
+		s := -float64(depthPenalty * (pathDepth(name) - minDepth))
+		if re.MatchString(filepath.Base(name), true, true) >= 0 {
+			s += nameBoost
+		}
+		if isTestFile(name) {
+			s -= testPenalty
+		}
+		if t := mtime[name]; !t.IsZero() {
+			days := newest.Sub(t).Hours() / 24
+			s += recencyBoost / (1 + days/recencyHalves)
+		}
+		score[name] = s
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return score[names[i]] > score[names[j]]
+	})
+}
+
+// sortModified sorts names for -sort modified, so that the files
+// modified least recently, according to mtime, come first.
+// Files modified at the same time keep their order, by name.
+func sortModified(names []string, mtime map[string]time.Time) {
+	sort.SliceStable(names, func(i, j int) bool {
+		return mtime[names[i]].Before(mtime[names[j]])
+	})
+}
+
+// pathDepth returns the number of directories in the file name.
+func pathDepth(name string) int {
+	return strings.Count(filepath.ToSlash(name), "/")
+}
+
+// isTestFile reports whether the named file looks like a test,
+// judging by its name or the name of a directory holding it.
+func isTestFile(name string) bool {
+	name = filepath.ToSlash(name)
+	for _, dir := range strings.Split(path.Dir(name), "/") {
+		switch dir {
+		case "test", "tests", "testdata", "__tests__", "spec":
+			return true
+		}
+	}
+	base := path.Base(name)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	return strings.HasPrefix(base, "test_") ||
+		strings.HasSuffix(base, "_test") ||
+		strings.HasSuffix(base, "_spec") ||
+		strings.HasSuffix(base, ".test") ||
+		strings.HasSuffix(base, ".spec") ||
+		strings.HasSuffix(base, "Test") ||
+		strings.HasSuffix(base, "Tests")
+}
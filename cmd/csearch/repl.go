@@ -0,0 +1,247 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/search"
+)
+
+// Interactive mode.
+//
+// Csearch -repl reads searches from standard input, one regexp per
+// line, and runs each with the flags given on the command line and
+// those set at the prompt.  Like csearch -daemon, it keeps the indexes
+// open and the compiled queries of recent searches, so that searches
+// after the first start at once, and it prints the matches in each
+// file as soon as the file has been searched.  A line beginning with
+// a colon is a command (see replHelp), and a line beginning with !
+// runs an earlier search again.  The searches are recorded beside
+// the (first) index, in a file named by adding .history to its name,
+// so that they can be run again in later sessions.
+
+const replHelp = `Type a regexp to search for it, or a command:
+	:i              toggle case-insensitive search (-i)
+	:f [regexp]     search only files with names matching regexp (-f),
+	                or all files if regexp is omitted
+	:flags [flags]  add flags to later searches, replacing those
+	                added before, or remove them if flags is omitted
+	:history        list earlier searches
+	!!              repeat the last search
+	!n              repeat search n in the history
+	:help           print this message
+	:q              quit
+To search for a regexp beginning with : or !, escape it, as in \:=.
+`
+
+// maxHistory is the number of earlier searches
+// that csearch -repl reads from the history file.
+const maxHistory = 1000
+
+// replOmitted lists the flags set on the command line
+// that csearch -repl does not pass on to each search.
+var replOmitted = map[string]bool{
+	"repl":       true,
+	"daemon":     true,
+	"save":       true,
+	"run":        true,
+	"list-saved": true,
+	"cpuprofile": true,
+}
+
+// A replState holds the flags set at the csearch -repl prompt.
+type replState struct {
+	base       []string // flags given on the command line
+	ignoreCase bool     // :i
+	file       string   // :f
+	flags      []string // :flags
+}
+
+// args returns the arguments of a search for pattern.
+func (s *replState) args(pattern string) []string {
+	args := append(s.base[:len(s.base):len(s.base)], s.flags...)
+	if s.ignoreCase {
+		args = append(args, "-i")
+	}
+	if s.file != "" {
+		args = append(args, "-f="+s.file)
+	}
+	return append(args, "--", pattern)
+}
+
+// prompt returns the prompt, which shows the flags set at the prompt.
+func (s *replState) prompt() string {
+	p := "csearch"
+	for _, f := range s.flags {
+		p += " " + f
+	}
+	if s.ignoreCase {
+		p += " -i"
+	}
+	if s.file != "" {
+		p += " -f=" + s.file
+	}
+	return p + "> "
+}
+
+// historyFile returns the name of the file holding the searches
+// made with csearch -repl.
+func historyFile() string {
+	return namedIndexFiles()[0] + ".history"
+}
+
+// readHistory returns the most recent searches in the history file,
+// oldest first.
+func readHistory() []string {
+	data, err := ioutil.ReadFile(historyFile())
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+	}
+	return lines
+}
+
+// serveRepl implements csearch -repl.  Args are the arguments left
+// after the command-line flags: a regexp to search for first, if any.
+func serveRepl(args []string) {
+	if len(args) > 1 {
+		usage()
+	}
+	s := &replState{base: flagArgs(replOmitted)}
+	indexes = &indexCache{entries: make(map[string]*cachedIndex)}
+	queries = &queryCache{entries: make(map[string][]*search.Query)}
+	history := readHistory()
+	hf, err := os.OpenFile(historyFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "csearch: not recording history: %v\n", err)
+	} else {
+		defer hf.Close()
+	}
+	interactive := false
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		interactive = true
+		fmt.Fprintf(os.Stderr, "csearch: type :help for help\n")
+	}
+	exit = func(code int) {
+		panic(exitCode(code))
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(nil, 1<<20)
+	for {
+		var line string
+		if len(args) > 0 {
+			line, args = args[0], nil
+		} else {
+			if interactive {
+				fmt.Fprint(os.Stderr, s.prompt())
+			}
+			if !in.Scan() {
+				break
+			}
+			line = in.Text()
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!") {
+			n := len(history)
+			if line != "!!" {
+				var err error
+				if n, err = strconv.Atoi(line[1:]); err != nil {
+					fmt.Fprintf(os.Stderr, "csearch: %s: not a search number\n", line)
+					continue
+				}
+			}
+			if n < 1 || n > len(history) {
+				fmt.Fprintf(os.Stderr, "csearch: %s: no such search\n", line)
+				continue
+			}
+			line = history[n-1]
+			fmt.Fprintf(os.Stderr, "%s\n", line)
+		} else if strings.HasPrefix(line, ":") {
+			cmd, arg, _ := strings.Cut(line[1:], " ")
+			arg = strings.TrimSpace(arg)
+			switch cmd {
+			case "i":
+				s.ignoreCase = !s.ignoreCase
+			case "f":
+				s.file = arg
+			case "flags":
+				s.flags = strings.Fields(arg)
+			case "history":
+				for i, h := range history {
+					fmt.Fprintf(os.Stdout, "%5d  %s\n", i+1, h)
+				}
+			case "help":
+				fmt.Fprint(os.Stderr, replHelp)
+			case "q", "quit":
+				return
+			default:
+				fmt.Fprintf(os.Stderr, "csearch: unknown command :%s; type :help for help\n", cmd)
+			}
+			continue
+		}
+
+		if len(history) == 0 || history[len(history)-1] != line {
+			history = append(history, line)
+			if hf != nil {
+				fmt.Fprintf(hf, "%s\n", line)
+			}
+		}
+		replSearch(s.args(line))
+	}
+	if err := in.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if interactive {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// replSearch runs the search given by args, with its own flags,
+// and returns its exit status.
+func replSearch(args []string) (code int) {
+	defer func() {
+		if e := recover(); e != nil {
+			ec, ok := e.(exitCode)
+			if !ok {
+				panic(e)
+			}
+			code = int(ec)
+		}
+	}()
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	g := regexp.Grep{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	defineFlags(&g)
+	// A mistyped flag needs only the error, not the whole usage message.
+	flag.CommandLine.Usage = func() {}
+	args, err := parseFlags(&g, args)
+	if err != nil {
+		return 2
+	}
+	matches, failed, fileRefs, stats = false, false, nil, searchStats{}
+	run(&g, args)
+	return status()
+}
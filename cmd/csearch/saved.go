@@ -0,0 +1,168 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/codesearch/regexp"
+)
+
+// Saved searches.
+//
+// Csearch -save name records the search given by the rest of the
+// command line, its flags and its regexp, under name, and csearch -run
+// name runs it again.  The saved searches are kept beside the (first)
+// index, in a file named by adding .searches to its name, so that
+// everyone sharing an index shares its saved searches.  The file holds
+// a JSON object mapping each name to a savedSearch.
+
+// A savedSearch is a search saved by csearch -save.
+type savedSearch struct {
+	Flags   []string `json:"flags"`   // flag arguments, as -name=value
+	Pattern string   `json:"pattern"` // regexp or query
+}
+
+// unsavedFlags lists the flags that csearch -save does not record,
+// because they choose where or how to run a search, not what to find.
+var unsavedFlags = map[string]bool{
+	"save":       true,
+	"run":        true,
+	"index":      true,
+	"wait":       true,
+	"daemon":     true,
+	"no-daemon":  true,
+	"cpuprofile": true,
+	"verbose":    true,
+	"color":      true,
+	"type-list":  true,
+	"list-saved": true,
+	"repl":       true,
+}
+
+// savedFile returns the name of the file holding the saved searches,
+// which are shared by the indexes of all revisions (see -ref).
+func savedFile() string {
+	return namedIndexFiles()[0] + ".searches"
+}
+
+// readSaved returns the saved searches, which are none if the file
+// holding them does not exist.
+func readSaved() map[string]*savedSearch {
+	file := savedFile()
+	saved := make(map[string]*savedSearch)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return saved
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		fatalf("%s: %v", file, err)
+	}
+	return saved
+}
+
+// saveSearch implements csearch -save, recording the search given by
+// the flags set on the command line and args under name.
+func saveSearch(g *regexp.Grep, name string, args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+	s := &savedSearch{Flags: flagArgs(unsavedFlags), Pattern: args[0]}
+	saved := readSaved()
+	saved[name] = s
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		fatal(err)
+	}
+	file := savedFile()
+	if err := ioutil.WriteFile(file, append(data, '\n'), 0666); err != nil {
+		fatal(err)
+	}
+	fmt.Fprintf(g.Stderr, "csearch: saved %s: %s\n", name, s)
+}
+
+// flagArgs returns the flags set on the command line, other than
+// those named in omit, as arguments of the form -name=value.
+func flagArgs(omit map[string]bool) []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if omit[f.Name] {
+			return
+		}
+		if list, ok := f.Value.(*stringsFlag); ok {
+			for _, v := range *list {
+				args = append(args, "-"+f.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	return args
+}
+
+// String returns the search as a csearch command line would give it.
+func (s *savedSearch) String() string {
+	args := append(s.Flags[:len(s.Flags):len(s.Flags)], s.Pattern)
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$*?[]{}()|&;<>`!#~") {
+			args[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// listSaved prints the saved searches, in order by name.
+func listSaved(g *regexp.Grep) {
+	saved := readSaved()
+	var names []string
+	for name := range saved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(g.Stdout, "%s: %s\n", name, saved[name])
+	}
+}
+
+// parseFlags parses the command-line arguments args, binding the grep
+// flags to g, and returns the arguments left after the flags.  Given
+// -run, it parses the flags of the saved search first, so that those
+// in args add to or override them, and it returns the saved pattern.
+func parseFlags(g *regexp.Grep, args []string) ([]string, error) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+	name := *runFlag
+	if name == "" {
+		return flag.Args(), nil
+	}
+	s := readSaved()[name]
+	if s == nil {
+		fatalf("no saved search %q in %s", name, savedFile())
+	}
+	if flag.NArg() > 0 {
+		fatalf("-run %s: unexpected arguments %q", name, flag.Args())
+	}
+	old := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet(old.Name(), old.ErrorHandling())
+	flag.CommandLine.SetOutput(old.Output())
+	defineFlags(g)
+	if err := flag.CommandLine.Parse(s.Flags); err != nil {
+		return nil, err
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+	return []string{s.Pattern}, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/codesearch/index"
+)
+
+// searchStats records statistics about a search, printed by -stats.
+type searchStats struct {
+	regexp string       // parsed regexp
+	query  *index.Query // trigram query
+
+	indexed    int // files in the indexes searched
+	scans      int // indexes searched in full, the query costing more
+	candidates int // files returned by the trigram query
+	filtered   int // candidates left after -f and -type
+	grepped    int // files searched with the regexp
+	matched    int // files containing a match
+	reported   int // matching lines reported, with -output ndjson
+	stale      int // files changed since indexing, with -verify-fresh
+	gone       int // files removed since indexing, with -verify-fresh
+
+	compile time.Duration // parsing regexp and building query
+	lookup  time.Duration // running trigram query
+	filter  time.Duration // applying -f and -type
+	grep    time.Duration // searching files
+}
+
+var stats searchStats
+
+// print prints the statistics to w.
+func (s *searchStats) print(w io.Writer) {
+	fmt.Fprintf(w, "regexp: %s\n", s.regexp)
+	fmt.Fprintf(w, "query: %s\n", s.query)
+	if s.query.Op == index.QAll {
+		fmt.Fprintf(w, "query matches all files: searching every indexed file\n")
+	} else if s.scans > 0 {
+		fmt.Fprintf(w, "query costs more than searching every file: searching %d indexes in full\n", s.scans)
+	}
+	fmt.Fprintf(w, "files: %d indexed, %d candidates (%s), %d after filters, %d grepped, %d matched\n",
+		s.indexed, s.candidates, percent(s.candidates, s.indexed), s.filtered, s.grepped, s.matched)
+	if *freshFlag {
+		fmt.Fprintf(w, "freshness: %d files changed, %d removed since indexing\n", s.stale, s.gone)
+	}
+	fmt.Fprintf(w, "time: %v compile, %v index, %v filter, %v grep, %v total\n",
+		round(s.compile), round(s.lookup), round(s.filter), round(s.grep),
+		round(s.compile+s.lookup+s.filter+s.grep))
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,157 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"regexp/syntax"
+	"sort"
+
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/search"
+)
+
+// searchSymbols implements csearch -sym: it prints the definitions
+// of the symbols whose names match pat in the files accepted by sq.
+func searchSymbols(g *regexp.Grep, pat string, sq *search.Query) {
+	if *iFlag {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile("^(?:" + pat + ")$")
+	if err != nil {
+		fatal(err)
+	}
+	prefix, exact := symbolPrefix(pat)
+	match := func(name string) bool {
+		return re.MatchString(name, true, true) >= 0
+	}
+
+	defs := make(map[string][]int)
+	add := func(file string, ix *index.Index, shadowed func(fileid uint32) bool) {
+		if !ix.HasSymbols() {
+			fatalf("%s: index records no symbols; rerun cindex to record them", file)
+		}
+		var syms []index.Symbol
+		if exact {
+			syms = ix.LookupSymbol(prefix)
+		} else {
+			syms = ix.MatchSymbols(prefix, match)
+		}
+		for _, s := range syms {
+			if shadowed != nil && shadowed(s.Fileid) || !sq.KeepFile(ix, s.Fileid) {
+				continue
+			}
+			if name := ix.Name(s.Fileid); sq.Keep(name) {
+				defs[name] = append(defs[name], s.Line)
+			}
+		}
+	}
+
+	for _, file := range searchFiles() {
+		if index.IsSharded(file) {
+			s := openSharded(file)
+			for i, ix := range s.Shards {
+				i := i
+				add(file, ix, func(fileid uint32) bool { return s.Shadowed(i, fileid) })
+			}
+			continue
+		}
+		add(file, openIndex(file), nil)
+	}
+	if *verboseFlag {
+		slog.Info("symbols defined", "files", len(defs))
+	}
+
+	var names []string
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines := defs[name]
+		sort.Ints(lines)
+		printDefs(g, name, lines)
+	}
+}
+
+// printDefs prints the definitions found at the given lines of
+// the named file, which are sorted, in the form file:line:text.
+func printDefs(g *regexp.Grep, name string, lines []int) {
+	g.Match = true
+	if g.L {
+		fmt.Fprintf(g.Stdout, "%s\n", name)
+		return
+	}
+	if g.C {
+		fmt.Fprintf(g.Stdout, "%s: %d\n", name, len(lines))
+		return
+	}
+	data, err := index.ReadFile(name)
+	if err != nil {
+		fmt.Fprintf(g.Stderr, "%s\n", err)
+		return
+	}
+	printLines(g, name, data, lines)
+}
+
+// printLines prints the given lines of data, the text of the named
+// file, which are sorted, in the form file:line:text.
+func printLines(g *regexp.Grep, name string, data []byte, lines []int) {
+	lineno := 1
+	last := 0
+	for _, want := range lines {
+		if want == last {
+			continue
+		}
+		last = want
+		for lineno < want && len(data) > 0 {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				data = data[i+1:]
+			} else {
+				data = nil
+			}
+			lineno++
+		}
+		if len(data) == 0 {
+			// The file has changed since it was indexed.
+			break
+		}
+		line := data
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		if g.H {
+			fmt.Fprintf(g.Stdout, "%d:%s\n", want, line)
+		} else {
+			fmt.Fprintf(g.Stdout, "%s:%d:%s\n", name, want, line)
+		}
+	}
+}
+
+// symbolPrefix returns a literal prefix of every symbol name matching
+// the regexp pat.  The boolean result reports whether pat matches
+// only that prefix itself, allowing an exact lookup.
+func symbolPrefix(pat string) (string, bool) {
+	re, err := syntax.Parse(pat, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune), true
+	case syntax.OpConcat:
+		if sub := re.Sub[0]; sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+			return string(sub.Rune), false
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,148 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/codesearch/index"
+)
+
+// Access control.
+//
+// Csearchd -acl file requires every /search and /file request to carry
+// a token, and limits what each token can see.  The file holds a JSON
+// list of aclUser entries, each giving a user's name, the tokens that
+// identify the user, and the path prefixes and repositories (see cindex
+// -repo) of the files the user may search:
+//
+//	[
+//		{"user": "alice", "tokens": ["s3cret"], "paths": ["/src/public"], "repos": ["web"]},
+//		{"user": "ci", "tokens": ["t0ken"], "paths": ["/"]}
+//	]
+//
+// A request gives its token in an Authorization header, either as a
+// bearer token or as the password of HTTP basic authentication, which
+// browsers prompt for and then send with each request of the search
+// page.  Searches drop the files a user may not see from the candidate
+// files before reading any of them, so that matches, counts, and
+// timings reveal nothing of the others, and /file answers requests
+// for such files as it does for files not in the index.
+
+// An aclUser is an entry in the -acl file.
+type aclUser struct {
+	User   string   `json:"user"`
+	Tokens []string `json:"tokens"`
+	Paths  []string `json:"paths"` // allowed path prefixes
+	Repos  []string `json:"repos"` // allowed repositories
+}
+
+// An acl is the list of users read from the -acl file.
+type acl []*aclUser
+
+// readACL reads the -acl file.
+func readACL(file string) (acl, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var a acl
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if a == nil {
+		// A nil acl lets everyone search, so a file holding
+		// null must not turn access control off.
+		return nil, fmt.Errorf("%s: not a JSON array of users", file)
+	}
+	for i, u := range a {
+		if u == nil || u.User == "" {
+			return nil, fmt.Errorf("%s: entry %d: missing user", file, i+1)
+		}
+		for _, t := range u.Tokens {
+			if t == "" {
+				return nil, fmt.Errorf("%s: user %s: empty token", file, u.User)
+			}
+		}
+	}
+	return a, nil
+}
+
+// lookup returns the user identified by token, if any.
+func (a acl) lookup(token string) *aclUser {
+	var found *aclUser
+	for _, u := range a {
+		for _, t := range u.Tokens {
+			// Compare every token in constant time, so that the time
+			// taken does not reveal how much of a token was right.
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 && found == nil {
+				found = u
+			}
+		}
+	}
+	return found
+}
+
+// allowed reports whether u may see the file with the given fileid in ix.
+func (u *aclUser) allowed(ix *index.Index, fileid uint32) bool {
+	name := ix.Name(fileid)
+	for _, p := range u.Paths {
+		if hasPathPrefix(name, p) {
+			return true
+		}
+	}
+	if len(u.Repos) > 0 {
+		repo := ix.Meta(fileid).Repo
+		for _, r := range u.Repos {
+			if r == repo {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports whether name is the path prefix
+// or a path inside it.
+func hasPathPrefix(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	return len(name) == len(prefix) || strings.HasSuffix(prefix, "/") || name[len(prefix)] == '/'
+}
+
+// authorize returns the user making the request, or nil if csearchd
+// is not checking access.  If the request does not carry a known
+// token, authorize responds with status 401 and returns ok=false.
+func (s *server) authorize(w http.ResponseWriter, req *http.Request) (u *aclUser, ok bool) {
+	if s.acl == nil {
+		return nil, true
+	}
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		_, token, found = req.BasicAuth()
+	}
+	if found && token != "" {
+		if u := s.acl.lookup(token); u != nil {
+			return u, true
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="csearchd"`)
+	httpError(w, http.StatusUnauthorized, fmt.Errorf("missing or unknown token"))
+	return nil, false
+}
+
+// userName returns the name of u, for logging.
+func userName(u *aclUser) string {
+	if u == nil {
+		return ""
+	}
+	return u.User
+}
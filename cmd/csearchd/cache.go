@@ -0,0 +1,204 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/codesearch/index"
+)
+
+// Caching.
+//
+// Csearchd keeps the results of recent searches, so that dashboards and
+// bots repeating the same searches do not redo them.  It caches two
+// things for each search, keyed by the query and the options that
+// affect it: the list of candidate files selected by the index, which
+// does not depend on the limit on results, and the final results.
+// Each index that csearchd opens has a new generation number, which is
+// part of every key, and reopening the index empties the caches.
+
+// An lruCache is a cache holding up to max entries,
+// discarding the least recently used entry to make room for a new one.
+type lruCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	order   *list.List // of *lruEntry, most recently used first
+
+	hits, misses int64
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(max int) *lruCache {
+	return &lruCache{max: max, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the value cached for key, if any.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// add caches value for key.
+func (c *lruCache) add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max <= 0 {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value})
+	for c.order.Len() > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*lruEntry).key)
+	}
+}
+
+// clear empties the cache.
+func (c *lruCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// stats returns the number of entries and the hits and misses so far.
+func (c *lruCache) stats() (n int, hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len(), c.hits, c.misses
+}
+
+// acquire returns the index to search and its generation, first
+// reopening the index if cindex has replaced it since it was opened,
+// or, for a remote index, if a newer one has been downloaded
+// or, when reading the index in place, published.
+// The caller must call release when done with the index.
+func (s *server) acquire() (*index.Index, int) {
+	info, err := s.stat()
+	s.mu.RLock()
+	if err != nil || sameIndexFile(s.info, info) {
+		return s.ix, s.gen
+	}
+	s.mu.RUnlock()
+
+	// Wait for the searches of the old index to finish.
+	s.mu.Lock()
+	if !sameIndexFile(s.info, info) {
+		if *verboseFlag {
+			slog.Info("reopening", "index", s.indexFile)
+		}
+		s.ix.Close()
+		s.open(info)
+		s.results.clear()
+		s.candidates.clear()
+	}
+	s.mu.Unlock()
+	return s.acquire()
+}
+
+// release releases the index returned by acquire.
+func (s *server) release() {
+	s.mu.RUnlock()
+}
+
+// open opens the index file, described by info,
+// as the next generation of the index.
+func (s *server) open(info os.FileInfo) {
+	if s.inPlace() {
+		ix, err := index.OpenRange(s.indexFile, *blockCacheFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.ix = ix
+	} else {
+		s.ix = index.Open(s.indexFile)
+	}
+	s.ix.Verbose = *verboseFlag
+	if *preloadFlag {
+		s.ix.Preload()
+	}
+	s.info = info
+	s.gen++
+}
+
+// inPlace reports whether csearchd reads the index in place,
+// as -block-cache directs for a remote index, instead of downloading it.
+func (s *server) inPlace() bool {
+	return *blockCacheFlag > 0 && index.IsRemote(s.indexFile)
+}
+
+// remoteStatInterval is how long csearchd goes without asking
+// whether a remote index it reads in place has been replaced.
+const remoteStatInterval = 10 * time.Second
+
+// stat describes the index file as it is now.
+func (s *server) stat() (os.FileInfo, error) {
+	if !s.inPlace() {
+		return os.Stat(index.Local(s.indexFile))
+	}
+	s.statMu.Lock()
+	defer s.statMu.Unlock()
+	if s.remote != nil && time.Since(s.remoteChecked) < remoteStatInterval {
+		return s.remote, nil
+	}
+	s.remoteChecked = time.Now()
+	info, err := index.RemoteStat(s.indexFile)
+	if err != nil {
+		if s.remote != nil {
+			// Keep searching the version we have.
+			return s.remote, nil
+		}
+		return nil, err
+	}
+	s.remote = &remoteFileInfo{s.indexFile, info}
+	return s.remote, nil
+}
+
+// A remoteFileInfo describes a version of a remote index.
+type remoteFileInfo struct {
+	url  string
+	info index.RemoteInfo
+}
+
+func (fi *remoteFileInfo) Name() string       { return fi.url }
+func (fi *remoteFileInfo) Size() int64        { return fi.info.Size }
+func (fi *remoteFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi *remoteFileInfo) ModTime() time.Time { return fi.info.ModTime }
+func (fi *remoteFileInfo) IsDir() bool        { return false }
+func (fi *remoteFileInfo) Sys() interface{}   { return nil }
+
+// sameIndexFile reports whether the index files described
+// by old and new are the same, unchanged file.
+func sameIndexFile(old, new os.FileInfo) bool {
+	if old, ok := old.(*remoteFileInfo); ok {
+		new, ok := new.(*remoteFileInfo)
+		return ok && old.info.ETag == new.info.ETag && old.info.Size == new.info.Size
+	}
+	return os.SameFile(old, new) && old.ModTime().Equal(new.ModTime()) && old.Size() == new.Size()
+}
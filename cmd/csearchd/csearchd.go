@@ -0,0 +1,617 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/codesearch/cmd/internal/logging"
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/search"
+)
+
+var usageMessage = `usage: csearchd [-http addr] [-index file] [-preload] [-cache n] [-acl file] [-timeout d]
+	[-max-candidates n] [-max-bytes n] [-max-matches n] [-max-queries n] [-queue n]
+	[-block-cache n]
+
+Csearchd serves searches over a trigram index using HTTP.  It opens the
+index once and keeps it mapped into memory, avoiding the cost of
+reopening it for every query as csearch does.
+
+The index is the file named by the -index flag, or else $CSEARCHINDEX,
+or else $HOME/.csearchindex.  It may also be the URL of a remote index,
+as for csearch, in which case csearchd checks for a newer index at most
+once a minute, when searching.
+
+The -block-cache flag has csearchd read a remote index in place rather
+than download it, fetching only the parts of the index that searches
+use, with HTTP range requests, and keeping up to n bytes of them in
+memory, so that a server can search an index larger than its disk or
+start without waiting for a download.  Csearchd then checks for a newer
+index at most every ten seconds.  An index replaced in between cannot be
+read any further, so a search needing a part of it not yet in memory
+makes csearchd exit; run it under a supervisor that restarts it.
+
+The -preload flag reads the parts of the index used by every search
+into memory at startup, so that the first searches after csearchd
+starts are as fast as later ones even on a cold cache.
+
+Csearchd notices when cindex replaces the index and reopens it,
+letting searches already running on the old index finish first.
+
+Csearchd caches the results of the most recent searches, along with
+the candidate files that the index selected for them, so that
+repeated searches, as from dashboards and bots, are answered at once.
+The -cache flag sets how many searches each cache holds (default 1000);
+-cache=0 turns caching off.  Reopening the index empties the caches.
+Cached results do not reflect edits to the indexed files
+until the index is rebuilt.
+
+The -timeout flag stops each /search and /batch request that runs
+longer than the duration given, such as 5s, so that a search that reads
+every indexed file, as one for .* does, cannot tie up the server; the
+request fails with status 503 (Service Unavailable).  A search also
+stops when its client goes away.
+
+Other flags limit the work of each search, so that one pathological
+regexp cannot starve the other users of a shared server.  The
+-max-candidates flag fails, with status 400 (Bad Request), a search for
+which the index selects more than n candidate files, before any is
+read, and -max-bytes fails one that would read more than n bytes of
+files, counting the candidate files of every query in a batch together.
+The -max-matches flag lowers the max parameter of a request to n, so
+that a response holds at most n matching lines per search; the rest
+are left for the next page.  The -max-queries flag runs at most n
+searches at once, across /search and /batch; up to -queue more (default
+100) wait their turn, within -timeout, and any beyond those fail at once
+with status 503 and a Retry-After header.  Cached results are returned
+without waiting.  By default there are no limits.
+
+Csearchd serves a web page for searching at /, along with
+these endpoints, each of which returns JSON:
+
+	/search?q=regexp[&f=fileregexp][&repo=name][&i=1][&query=1][&max=n][&cursor=c]
+		Search the indexed files for regexp, as csearch does.
+		The f parameter restricts the search to files whose names
+		match fileregexp, the repo parameter, which may be repeated,
+		restricts it to files in the named repositories (see
+		cindex -repo), i=1 makes the search case-insensitive,
+		query=1 takes q to be a query expression, as for
+		csearch -query, rather than a single regexp,
+		and max limits the number of matching lines returned
+		(default 1000).  If there are more, the response holds
+		a cursor, next, and repeating the request with cursor
+		set to it returns the next page of matching lines.
+
+	/batch?q=regexp&q=regexp...[&f=fileregexp][&repo=name][&i=1][&query=1][&max=n]
+		Run several searches at once, one for each q parameter,
+		reading each candidate file only once however many of the
+		searches select it.  The other parameters are as for /search
+		and apply to every search, max limiting the matching lines of
+		each.  The response lists the results of each search in the
+		order given, each with its query, matching lines, and whether
+		they were truncated, and counts the candidate files searched
+		once for the whole batch.
+		Batch results are not cached.
+
+	/file?path=name
+		Return the content of the indexed file name.
+
+Paging through results with cursors saves repeating the work of
+earlier pages: the cursor records where in the list of candidate files
+the previous page stopped, and the next page resumes the search there,
+reusing the cached list.  A cursor is good only for the search that
+returned it and only until the index is reopened; after that, a request
+using it fails with status 410 (Gone) and the search must start again.
+
+It also serves /metrics, for monitoring with Prometheus: counts of
+requests by endpoint and status code, histograms of search latency
+and of the number of candidate files the index selected for each
+search, the number of matching lines returned, the hits and misses of
+the caches, and the number of files in the index along with its size
+and age.
+
+The -acl flag makes csearchd require a token with every /search and
+/file request and limits each token to the files under given paths or
+in given repositories, so that an index shared across a company does
+not show anyone the repositories they may not read.  The file holds a
+JSON list of users, such as
+
+	[
+		{"user": "alice", "tokens": ["s3cret"], "paths": ["/src/public"], "repos": ["web"]},
+		{"user": "ci", "tokens": ["t0ken"], "paths": ["/"]}
+	]
+
+A request gives its token in the Authorization header, as a bearer
+token (Authorization: Bearer s3cret) or as the password of HTTP basic
+authentication, which is how the search page's users give it.
+Searches leave out the files the user may not see before searching
+any file, and /file treats them as not in the index.  The search page
+itself and /metrics, which reports only counts, need no token.
+
+If the index stores the text of the indexed files (see cindex
+-store-content), csearchd searches and serves that text rather than
+reading the files, so that it can run on a machine where the indexed
+trees have since moved or been deleted.  Files whose text is not
+stored are read from the file system as usual.
+
+` + logging.Usage
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var (
+	httpFlag    = flag.String("http", "localhost:8080", "serve HTTP on `addr`")
+	indexFlag   = flag.String("index", "", "use index `file` instead of $CSEARCHINDEX")
+	verboseFlag = flag.Bool("verbose", false, "print extra information")
+	preloadFlag = flag.Bool("preload", false, "read the index into memory at startup")
+	cacheFlag   = flag.Int("cache", 1000, "cache the results of the last `n` searches")
+	aclFlag     = flag.String("acl", "", "require tokens and limit each to the paths and repos listed in `file`")
+	timeoutFlag = flag.Duration("timeout", 0, "stop each search after `d` (0 means no limit)")
+
+	maxCandidatesFlag = flag.Int("max-candidates", 0, "fail searches with more than `n` candidate files (0 means no limit)")
+	maxBytesFlag      = flag.Int64("max-bytes", 0, "fail searches that read more than `n` bytes of files (0 means no limit)")
+	maxMatchesFlag    = flag.Int("max-matches", 0, "return at most `n` matching lines per search and page (0 means no limit)")
+	maxQueriesFlag    = flag.Int("max-queries", 0, "run at most `n` searches at once (0 means no limit)")
+	queueFlag         = flag.Int("queue", 100, "with -max-queries, queue up to `n` more searches")
+	blockCacheFlag    = flag.Int64("block-cache", 0, "read a remote index in place, keeping up to `n` bytes of it in memory (0 means download it)")
+)
+
+const defaultMaxResults = 1000
+
+// The ui directory holds the search page, which uses
+// the /search and /file endpoints.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// A server serves searches over an index.
+type server struct {
+	indexFile string
+	start     time.Time // when csearchd started
+	stats     *metrics
+
+	// The index, guarded by mu: searches hold it for reading,
+	// and acquire holds it for writing to reopen the index.
+	mu   sync.RWMutex
+	ix   *index.Index
+	info os.FileInfo // index file, when opened
+	gen  int         // generation, counting the times the index was opened
+
+	// The version of a remote index read in place that stat
+	// last saw, and when it asked, guarded by statMu.
+	statMu        sync.Mutex
+	remote        *remoteFileInfo
+	remoteChecked time.Time
+
+	results    *lruCache // *searchResult by search and generation
+	candidates *lruCache // []uint32 candidate file IDs by query and generation
+
+	acl acl // users allowed to search, or nil to allow everyone
+
+	limit *limiter // searches running and queued, or nil for no limit
+}
+
+// A searchResult is the JSON response to a /search request.
+type searchResult struct {
+	Query     string        `json:"query"`
+	Files     int           `json:"files"` // number of candidate files searched
+	Matches   []searchMatch `json:"matches"`
+	Truncated bool          `json:"truncated,omitempty"`
+	Next      string        `json:"next,omitempty"` // cursor for the next page, if truncated
+}
+
+// A batchResult is the JSON response to a /batch request.
+type batchResult struct {
+	Files   int                  `json:"files"` // number of candidate files searched
+	Results []*batchSearchResult `json:"results"`
+}
+
+// A batchSearchResult holds the results of one search in a batch.
+type batchSearchResult struct {
+	Query     string        `json:"query"`
+	Matches   []searchMatch `json:"matches"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+// A searchMatch is a single matching line.
+type searchMatch struct {
+	File   string  `json:"file"`
+	Line   int     `json:"line"`
+	Text   string  `json:"text"`
+	Offset int64   `json:"offset"` // byte offset of line in file
+	Column int     `json:"column"` // byte column of first match, starting at 1
+	Spans  [][]int `json:"spans"`  // byte ranges of matches in text
+}
+
+// A fileResult is the JSON response to a /file request.
+type fileResult struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+func main() {
+	logging.AddFlags()
+	flag.Usage = usage
+	flag.Parse()
+	logging.Setup(os.Stderr)
+	if flag.NArg() != 0 {
+		usage()
+	}
+
+	file := *indexFlag
+	if file == "" {
+		file = index.File()
+	}
+	s := &server{
+		indexFile:  file,
+		start:      time.Now(),
+		stats:      newMetrics(),
+		results:    newLRUCache(*cacheFlag),
+		candidates: newLRUCache(*cacheFlag),
+		limit:      newLimiter(*maxQueriesFlag, *queueFlag),
+	}
+	info, err := s.stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *aclFlag != "" {
+		if s.acl, err = readACL(*aclFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	s.open(info)
+
+	ui, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/", http.FileServer(http.FS(ui)))
+	http.HandleFunc("/search", s.counted("search", s.search))
+	http.HandleFunc("/batch", s.counted("batch", s.batch))
+	http.HandleFunc("/file", s.counted("file", s.file))
+	http.HandleFunc("/metrics", s.metrics)
+	slog.Info("serving", "index", file, "addr", *httpFlag)
+	log.Fatal(http.ListenAndServe(*httpFlag, nil))
+}
+
+func (s *server) search(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	q := req.FormValue("q")
+	if q == "" {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("missing q parameter"))
+		return
+	}
+	max, err := maxParam(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	user, ok := s.authorize(w, req)
+	if !ok {
+		return
+	}
+	var cur cursor
+	if v := req.FormValue("cursor"); v != "" {
+		c, err := parseCursor(v)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		cur = c
+	}
+
+	ix, gen := s.acquire()
+	defer s.release()
+	key := fmt.Sprintf("%d %q f=%q repo=%q i=%t query=%t", gen, q, req.FormValue("f"), req.Form["repo"], req.FormValue("i") == "1", req.FormValue("query") == "1")
+	if user != nil {
+		// Each user has a candidate list of their own.
+		key += fmt.Sprintf(" user=%q", user.User)
+	}
+	sum := searchSum(key)
+	if req.FormValue("cursor") != "" {
+		if cur.gen != gen {
+			httpError(w, http.StatusGone, fmt.Errorf("cursor is for an index since reopened; repeat the search"))
+			return
+		}
+		if cur.sum != sum {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("cursor is for a different search"))
+			return
+		}
+	}
+	resultKey := fmt.Sprintf("%s max=%d cursor=%d.%d", key, max, cur.file, cur.skip)
+	if v, ok := s.results.get(resultKey); ok {
+		res := v.(*searchResult)
+		s.stats.search(time.Since(start), res.Files, len(res.Matches), res.Truncated)
+		writeJSON(w, res)
+		return
+	}
+
+	compile := search.Compile
+	if req.FormValue("query") == "1" {
+		compile = search.CompileQuery
+	}
+	sq, err := compile(q, &search.Options{
+		IgnoreCase: req.FormValue("i") == "1",
+		File:       req.FormValue("f"),
+		Repos:      req.Form["repo"],
+		MaxResults: cur.skip + max, // counting the matches skipped below
+		Stored:     true,
+
+		MaxCandidates: *maxCandidatesFlag,
+		MaxBytes:      *maxBytesFlag,
+	})
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	if *verboseFlag {
+		slog.Info("query", "q", q, "query", sq.Index.String(), "user", userName(user))
+	}
+
+	ctx, cancel := searchContext(req)
+	defer cancel()
+	if err := s.limit.acquire(ctx); err != nil {
+		s.searchError(w, err)
+		return
+	}
+	defer s.limit.release()
+	var ids []uint32
+	if v, ok := s.candidates.get(key); ok {
+		ids = v.([]uint32)
+	} else {
+		ids, err = sq.CandidateIDsContext(ctx, ix)
+		if err != nil {
+			s.searchError(w, err)
+			return
+		}
+		if user != nil {
+			w := 0
+			for _, fileid := range ids {
+				if user.allowed(ix, fileid) {
+					ids[w] = fileid
+					w++
+				}
+			}
+			ids = ids[:w]
+		}
+		s.candidates.add(key, ids)
+	}
+	if cur.file > len(ids) {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("cursor is for a different search"))
+		return
+	}
+
+	// Resume at the cursor, skipping the matches that earlier pages
+	// returned from its file, and note where this page stops:
+	// at the match number n of the file at position pos in page.
+	res := &searchResult{Query: q, Matches: []searchMatch{}}
+	page := ids[cur.file:]
+	pos, n := 0, 0
+	r := sq.RunCandidates(ctx, ix, page)
+	defer r.Close()
+	for r.Next() {
+		m := r.Match()
+		for ix.Name(page[pos]) != m.File {
+			pos, n = pos+1, 0
+		}
+		n++
+		if pos == 0 && n <= cur.skip {
+			continue
+		}
+		res.Matches = append(res.Matches, searchMatch{
+			File:   m.File,
+			Line:   m.Line,
+			Text:   m.Text,
+			Offset: m.Offset,
+			Column: m.Column,
+			Spans:  m.Spans,
+		})
+	}
+	if err := r.Err(); err != nil {
+		s.searchError(w, err)
+		return
+	}
+	res.Files = r.Files()
+	res.Truncated = r.Truncated()
+	if res.Truncated {
+		res.Next = cursor{gen: gen, file: cur.file + pos, skip: n, sum: sum}.String()
+	}
+	s.stats.search(time.Since(start), res.Files, len(res.Matches), res.Truncated)
+	s.results.add(resultKey, res)
+	writeJSON(w, res)
+}
+
+func (s *server) batch(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	req.ParseForm()
+	patterns := req.Form["q"]
+	if len(patterns) == 0 {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("missing q parameter"))
+		return
+	}
+	max, err := maxParam(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	user, ok := s.authorize(w, req)
+	if !ok {
+		return
+	}
+
+	compile := search.Compile
+	if req.FormValue("query") == "1" {
+		compile = search.CompileQuery
+	}
+	opts := &search.Options{
+		IgnoreCase: req.FormValue("i") == "1",
+		File:       req.FormValue("f"),
+		Repos:      req.Form["repo"],
+		MaxResults: max,
+		Stored:     true,
+
+		MaxCandidates: *maxCandidatesFlag,
+		MaxBytes:      *maxBytesFlag,
+	}
+	res := &batchResult{}
+	var qs []*search.Query
+	for _, q := range patterns {
+		sq, err := compile(q, opts)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("%s: %v", q, err))
+			return
+		}
+		qs = append(qs, sq)
+		res.Results = append(res.Results, &batchSearchResult{Query: q, Matches: []searchMatch{}})
+	}
+	if *verboseFlag {
+		slog.Info("batch", "searches", len(qs), "user", userName(user))
+	}
+
+	ix, _ := s.acquire()
+	defer s.release()
+	var keep func(fileid uint32) bool
+	if user != nil {
+		keep = func(fileid uint32) bool { return user.allowed(ix, fileid) }
+	}
+	ctx, cancel := searchContext(req)
+	defer cancel()
+	if err := s.limit.acquire(ctx); err != nil {
+		s.searchError(w, err)
+		return
+	}
+	defer s.limit.release()
+	r := search.RunBatch(ctx, ix, qs, keep)
+	defer r.Close()
+	for r.Next() {
+		m := r.Match()
+		sr := res.Results[m.Query]
+		sr.Matches = append(sr.Matches, searchMatch{
+			File:   m.File,
+			Line:   m.Line,
+			Text:   m.Text,
+			Offset: m.Offset,
+			Column: m.Column,
+			Spans:  m.Spans,
+		})
+	}
+	if err := r.Err(); err != nil {
+		s.searchError(w, err)
+		return
+	}
+	res.Files = r.Files()
+	n := 0
+	for i, sr := range res.Results {
+		sr.Truncated = r.QueryTruncated(i)
+		n += len(sr.Matches)
+	}
+	s.stats.search(time.Since(start), res.Files, n, r.Truncated())
+	writeJSON(w, res)
+}
+
+func (s *server) file(w http.ResponseWriter, req *http.Request) {
+	path := req.FormValue("path")
+	user, ok := s.authorize(w, req)
+	if !ok {
+		return
+	}
+	ix, _ := s.acquire()
+	defer s.release()
+	// Only serve files that are in the index,
+	// not arbitrary files on the server.
+	fileid, ok := ix.Lookup(path)
+	if !ok || user != nil && !user.allowed(ix, fileid) {
+		httpError(w, http.StatusNotFound, fmt.Errorf("%s: not in index", path))
+		return
+	}
+	if data, ok := ix.Content(fileid); ok {
+		writeJSON(w, &fileResult{Path: path, Content: string(data)})
+		return
+	}
+	data, err := index.ReadFile(path)
+	if err != nil {
+		httpError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, &fileResult{Path: path, Content: string(data)})
+}
+
+// searchContext returns the context of the search requested by req,
+// which ends when the client goes away or after -timeout.
+func searchContext(req *http.Request) (context.Context, context.CancelFunc) {
+	if *timeoutFlag > 0 {
+		return context.WithTimeout(req.Context(), *timeoutFlag)
+	}
+	return context.WithCancel(req.Context())
+}
+
+// maxParam returns the limit on matching lines that req asks for
+// in its max parameter, lowered to -max-matches.
+func maxParam(req *http.Request) (int, error) {
+	max := defaultMaxResults
+	if v := req.FormValue("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid max parameter %q", v)
+		}
+		max = n
+	}
+	if *maxMatchesFlag > 0 && max > *maxMatchesFlag {
+		max = *maxMatchesFlag
+	}
+	return max, nil
+}
+
+// searchError reports err, which ended a search early,
+// noting in the metrics the limits that searches exceed.
+func (s *server) searchError(w http.ResponseWriter, err error) {
+	code := http.StatusServiceUnavailable
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		s.stats.limited("timeout")
+		err = fmt.Errorf("search timed out after %v", *timeoutFlag)
+	case err == errBusy:
+		s.stats.limited("queue")
+		w.Header().Set("Retry-After", "1")
+	case err == search.ErrTooManyCandidates:
+		s.stats.limited("candidates")
+		code = http.StatusBadRequest
+		err = fmt.Errorf("search has more than %d candidate files; narrow it", *maxCandidatesFlag)
+	case err == search.ErrTooManyBytes:
+		s.stats.limited("bytes")
+		code = http.StatusBadRequest
+		err = fmt.Errorf("search reads more than %d bytes of files; narrow it", *maxBytesFlag)
+	}
+	httpError(w, code, err)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("cannot write response", "error", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,63 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+)
+
+// Pagination.
+//
+// A /search response stopped at the limit on results carries a cursor,
+// an opaque token that a client passes back to fetch the next page.
+// The cursor records where the page stopped in the list of candidate
+// files: the position of the file holding the last match returned and
+// the number of matches in that file already returned.  The next page
+// resumes the search there, taking the candidate list from the cache
+// rather than running the trigram query again, instead of searching
+// every file before that position.  The cursor also records the
+// generation of the index, since positions in the candidate list of
+// one index mean nothing in another, and a checksum of the search, so
+// that a cursor cannot be used with a different one.
+
+// A cursor is a position in the results of a search.
+type cursor struct {
+	gen  int    // generation of the index searched
+	file int    // position in the candidate list of the next file to search
+	skip int    // matches in that file already returned
+	sum  uint32 // checksum of the search, as computed by searchSum
+}
+
+// String returns the token encoding c.
+func (c cursor) String() string {
+	s := fmt.Sprintf("%d.%d.%d.%08x", c.gen, c.file, c.skip, c.sum)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// parseCursor parses the token returned by cursor.String.
+func parseCursor(token string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		var n int
+		n, err = fmt.Sscanf(string(data), "%d.%d.%d.%x", &c.gen, &c.file, &c.skip, &c.sum)
+		if err == nil && (n != 4 || c.file < 0 || c.skip < 0) {
+			err = fmt.Errorf("malformed")
+		}
+	}
+	if err != nil {
+		return cursor{}, fmt.Errorf("invalid cursor parameter %q", token)
+	}
+	return c, nil
+}
+
+// searchSum returns the checksum of the search with the given cache key.
+func searchSum(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
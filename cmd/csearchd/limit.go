@@ -0,0 +1,81 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Limits.
+//
+// A server shared by many users must not let one search take all of it.
+// The -max-candidates, -max-bytes, and -max-matches flags bound the
+// work and the response of each search, and -max-queries bounds the
+// searches running at once: the searches beyond it wait in a queue of
+// -queue searches for a turn, and those beyond the queue fail at once,
+// so that a burst of slow searches delays the others only so long.
+
+// errBusy is the error for a search that finds the queue full.
+var errBusy = errors.New("too many searches running; try again later")
+
+// A limiter bounds the searches running at once, queuing the rest.
+// A nil limiter has no bound.
+type limiter struct {
+	running chan struct{} // holds a token for each search running
+	waiting chan struct{} // holds a token for each search running or queued
+}
+
+// newLimiter returns a limiter that runs n searches at once and queues
+// up to queue more, or nil if n is not positive.
+func newLimiter(n, queue int) *limiter {
+	if n <= 0 {
+		return nil
+	}
+	return &limiter{
+		running: make(chan struct{}, n),
+		waiting: make(chan struct{}, n+max(queue, 0)),
+	}
+}
+
+// acquire waits for a turn to run a search.  It returns errBusy
+// if the queue is full, or ctx.Err() if ctx is done first.
+// If acquire returns nil, the caller must call release
+// when the search finishes.
+func (l *limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.waiting <- struct{}{}:
+	default:
+		return errBusy
+	}
+	select {
+	case l.running <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		<-l.waiting
+		return ctx.Err()
+	}
+}
+
+// release ends a turn taken by acquire.
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.running
+	<-l.waiting
+}
+
+// counts returns the numbers of searches running and queued.
+func (l *limiter) counts() (running, queued int) {
+	if l == nil {
+		return 0, 0
+	}
+	running = len(l.running)
+	return running, len(l.waiting) - running
+}
@@ -0,0 +1,215 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics.
+//
+// Csearchd serves /metrics in the Prometheus text exposition format,
+// so that operators of a shared server can monitor it: how many
+// searches it serves and how long they take, how many candidate files
+// the index selects for them, and the size and age of the index.
+
+var (
+	// latencyBuckets are the upper bounds, in seconds,
+	// of the buckets of the search latency histogram.
+	latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// candidateBuckets are the upper bounds of the buckets
+	// of the histogram of candidate files per search.
+	candidateBuckets = []float64{0, 1, 10, 100, 1000, 10000, 100000, 1000000}
+)
+
+// A metrics records the activity of the server.
+type metrics struct {
+	mu         sync.Mutex
+	requests   map[[2]string]int64 // requests by endpoint and status code
+	latency    *histogram          // search latency in seconds
+	candidates *histogram          // candidate files per search
+	matches    int64               // matching lines returned
+	truncated  int64               // searches stopped at the result limit
+	limits     map[string]int64    // searches failed by a limit, by limit
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:   make(map[[2]string]int64),
+		limits:     make(map[string]int64),
+		latency:    newHistogram(latencyBuckets),
+		candidates: newHistogram(candidateBuckets),
+	}
+}
+
+// request records a request to endpoint answered with status code.
+func (m *metrics) request(endpoint string, code int) {
+	m.mu.Lock()
+	m.requests[[2]string{endpoint, strconv.Itoa(code)}]++
+	m.mu.Unlock()
+}
+
+// search records a completed search that took elapsed time,
+// searched files candidate files, and returned matches lines.
+func (m *metrics) search(elapsed time.Duration, files, matches int, truncated bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency.observe(elapsed.Seconds())
+	m.candidates.observe(float64(files))
+	m.matches += int64(matches)
+	if truncated {
+		m.truncated++
+	}
+}
+
+// limited records a search failed by the named limit:
+// timeout, queue, candidates, or bytes.
+func (m *metrics) limited(limit string) {
+	m.mu.Lock()
+	m.limits[limit]++
+	m.mu.Unlock()
+}
+
+// A histogram counts observations in buckets,
+// as a Prometheus histogram does.
+type histogram struct {
+	bounds []float64 // upper bounds of the buckets, in increasing order
+	counts []int64   // counts[i] is the number of observations <= bounds[i], not cumulative
+	count  int64     // number of observations
+	sum    float64   // sum of observations
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// write writes the histogram named name in the text exposition format.
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var n int64
+	for i, b := range h.bounds {
+		n += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metrics serves /metrics.
+func (s *server) metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	// Acquire the index before locking m,
+	// as searches do, to avoid deadlock.
+	ix, gen := s.acquire()
+	defer s.release()
+	m := s.stats
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP csearchd_requests_total Requests served, by endpoint and status code.\n")
+	fmt.Fprintf(w, "# TYPE csearchd_requests_total counter\n")
+	var keys [][2]string
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "csearchd_requests_total{endpoint=%q,code=%q} %d\n", k[0], k[1], m.requests[k])
+	}
+
+	m.latency.write(w, "csearchd_search_duration_seconds", "Time taken by successful searches.")
+	m.candidates.write(w, "csearchd_search_candidate_files", "Candidate files selected by the index per search.")
+	counter(w, "csearchd_search_matches_total", "Matching lines returned by searches.", m.matches)
+	counter(w, "csearchd_search_truncated_total", "Searches stopped at the limit on matching lines.", m.truncated)
+
+	fmt.Fprintf(w, "# HELP csearchd_search_limited_total Searches failed by a limit, by limit.\n")
+	fmt.Fprintf(w, "# TYPE csearchd_search_limited_total counter\n")
+	for _, limit := range []string{"timeout", "queue", "candidates", "bytes"} {
+		fmt.Fprintf(w, "csearchd_search_limited_total{limit=%q} %d\n", limit, m.limits[limit])
+	}
+	running, queued := s.limit.counts()
+	gauge(w, "csearchd_searches_running", "Searches running.", float64(running))
+	gauge(w, "csearchd_searches_queued", "Searches waiting for a turn to run.", float64(queued))
+
+	// Each metric's samples must follow its own HELP and TYPE lines,
+	// so the caches are listed once for each metric.
+	caches := []struct {
+		name  string
+		cache *lruCache
+	}{{"results", s.results}, {"candidates", s.candidates}}
+	fmt.Fprintf(w, "# HELP csearchd_cache_requests_total Cache lookups, by cache and result.\n")
+	fmt.Fprintf(w, "# TYPE csearchd_cache_requests_total counter\n")
+	for _, c := range caches {
+		_, hits, misses := c.cache.stats()
+		fmt.Fprintf(w, "csearchd_cache_requests_total{cache=%q,result=\"hit\"} %d\n", c.name, hits)
+		fmt.Fprintf(w, "csearchd_cache_requests_total{cache=%q,result=\"miss\"} %d\n", c.name, misses)
+	}
+	fmt.Fprintf(w, "# HELP csearchd_cache_entries Entries in each cache.\n")
+	fmt.Fprintf(w, "# TYPE csearchd_cache_entries gauge\n")
+	for _, c := range caches {
+		n, _, _ := c.cache.stats()
+		fmt.Fprintf(w, "csearchd_cache_entries{cache=%q} %d\n", c.name, n)
+	}
+
+	gauge(w, "csearchd_index_generation", "Number of times the index has been opened.", float64(gen))
+	gauge(w, "csearchd_index_files", "Files in the index.", float64(ix.NumFiles()))
+	gauge(w, "csearchd_index_size_bytes", "Size of the index file.", float64(s.info.Size()))
+	gauge(w, "csearchd_index_age_seconds", "Time since the index was written.", time.Since(s.info.ModTime()).Seconds())
+	gauge(w, "csearchd_uptime_seconds", "Time since csearchd started.", time.Since(s.start).Seconds())
+}
+
+func counter(w io.Writer, name, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+func gauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// counted returns a handler that runs h and records
+// the request to endpoint along with its status code.
+func (s *server) counted(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		sw := &statusWriter{w, http.StatusOK}
+		h(sw, req)
+		s.stats.request(endpoint, sw.code)
+	}
+}
+
+// A statusWriter is a ResponseWriter that remembers the status code.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,238 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The search page keeps its state in the URL fragment, as
+// #q=pattern&f=fileregexp&re=0&i=1 for a search or
+// #file=name&line=n for a file, so that the browser's back button
+// works and results can be shared by link.
+
+var $ = function(id) { return document.getElementById(id); };
+
+function escapeHTML(s) {
+	return s.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
+}
+
+function quoteMeta(s) {
+	return s.replace(/[\\.+*?()|[\]{}^$]/g, "\\$&");
+}
+
+// A rough highlighter, good enough for most C-like languages,
+// scripts, and Go: it finds comments, strings, and keywords.
+var tokenRE = /(\/\/.*|#.*|\/\*.*?(\*\/|$))|("(\\.|[^"\\])*"?|'(\\.|[^'\\])*'?|`[^`]*`?)|\b(break|case|chan|class|const|continue|def|default|defer|do|else|enum|export|extends|for|func|function|go|goto|if|import|in|interface|let|map|new|package|private|public|range|return|select|static|struct|switch|throw|try|type|var|void|while)\b/g;
+
+function tokens(text) {
+	var toks = [];
+	var m;
+	tokenRE.lastIndex = 0;
+	while ((m = tokenRE.exec(text)) !== null) {
+		var cls = m[1] ? "com" : m[3] ? "str" : "kw";
+		if (m[1] && m[1][0] == "#" && m.index > 0 && /\S/.test(text.slice(0, m.index))) {
+			// # in the middle of a line is more often not a comment.
+			tokenRE.lastIndex = m.index + 1;
+			continue;
+		}
+		toks.push({start: m.index, end: m.index + m[0].length, cls: cls});
+	}
+	return toks;
+}
+
+// matchRanges returns the ranges of text matched by re, if any.
+function matchRanges(text, re) {
+	var ranges = [];
+	if (!re) {
+		return ranges;
+	}
+	var m;
+	re.lastIndex = 0;
+	while ((m = re.exec(text)) !== null) {
+		if (m[0].length == 0) {
+			re.lastIndex++;
+			continue;
+		}
+		ranges.push({start: m.index, end: m.index + m[0].length});
+	}
+	return ranges;
+}
+
+// spanRanges converts the byte offsets of the match spans
+// reported by the server into offsets in the JavaScript string text.
+function spanRanges(text, spans) {
+	var index = [];  // index[byte offset] = string offset
+	var b = 0;
+	for (var i = 0; i < text.length; i++) {
+		index[b] = i;
+		var c = text.codePointAt(i);
+		b += c < 0x80 ? 1 : c < 0x800 ? 2 : c < 0x10000 ? 3 : 4;
+		if (c >= 0x10000) {
+			i++;
+		}
+	}
+	index[b] = text.length;
+	return spans.map(function(s) {
+		return {start: index[s[0]] || 0, end: index[s[1]] || text.length};
+	});
+}
+
+// render returns the HTML for a line of text, with syntax
+// highlighting and with the given ranges marked.
+function render(text, marks) {
+	var toks = tokens(text);
+	var cuts = [0, text.length];
+	toks.concat(marks).forEach(function(r) { cuts.push(r.start, r.end); });
+	cuts.sort(function(a, b) { return a - b; });
+	var html = "";
+	for (var i = 0; i + 1 < cuts.length; i++) {
+		var start = cuts[i], end = cuts[i + 1];
+		if (start == end) {
+			continue;
+		}
+		var s = escapeHTML(text.slice(start, end));
+		var inside = function(r) { return r.start <= start && end <= r.end; };
+		var tok = toks.filter(inside)[0];
+		if (tok) {
+			s = '<span class="' + tok.cls + '">' + s + "</span>";
+		}
+		if (marks.some(inside)) {
+			s = "<mark>" + s + "</mark>";
+		}
+		html += s;
+	}
+	return html;
+}
+
+// jsRegexp converts the search pattern to a JavaScript RegExp
+// for marking matches.  RE2 and JavaScript syntax differ only in
+// corners, so on failure the matches are simply left unmarked.
+function jsRegexp(pattern, ignoreCase) {
+	pattern = pattern.replace(/^\(\?([a-z]+)\)/, function(_, flags) {
+		if (flags.indexOf("i") >= 0) {
+			ignoreCase = true;
+		}
+		return "";
+	});
+	try {
+		return new RegExp(pattern, ignoreCase ? "gi" : "g");
+	} catch (e) {
+		return null;
+	}
+}
+
+function params() {
+	var p = {};
+	location.hash.slice(1).split("&").forEach(function(kv) {
+		var i = kv.indexOf("=");
+		if (i > 0) {
+			p[decodeURIComponent(kv.slice(0, i))] = decodeURIComponent(kv.slice(i + 1));
+		}
+	});
+	return p;
+}
+
+function setHash(p) {
+	var parts = [];
+	for (var k in p) {
+		if (p[k] !== "" && p[k] !== undefined) {
+			parts.push(k + "=" + encodeURIComponent(p[k]));
+		}
+	}
+	location.hash = parts.join("&");
+}
+
+function fileLink(name, line) {
+	return "#file=" + encodeURIComponent(name) + "&line=" + line;
+}
+
+function search(p) {
+	$("q").value = p.q;
+	$("f").value = p.f || "";
+	$("re").checked = p.re != "0";
+	$("i").checked = p.i == "1";
+	$("file").hidden = true;
+	$("results").hidden = false;
+
+	var pattern = p.re == "0" ? quoteMeta(p.q) : p.q;
+	var url = "search?q=" + encodeURIComponent(pattern);
+	if (p.f) {
+		url += "&f=" + encodeURIComponent(p.f);
+	}
+	if (p.i == "1") {
+		url += "&i=1";
+	}
+	$("status").textContent = "Searching...";
+	fetch(url).then(function(resp) { return resp.json(); }).then(function(res) {
+		if (res.error) {
+			$("status").textContent = res.error;
+			$("results").innerHTML = "";
+			return;
+		}
+		var re = jsRegexp(pattern, p.i == "1");
+		var html = "";
+		var last = null;
+		res.matches.forEach(function(m) {
+			if (m.file != last) {
+				if (last !== null) {
+					html += "</table>";
+				}
+				html += '<div class="filename"><a href="' + fileLink(m.file, m.line) + '">' + escapeHTML(m.file) + "</a></div><table>";
+				last = m.file;
+			}
+			html += '<tr><td class="line"><a href="' + fileLink(m.file, m.line) + '">' + m.line + "</a></td><td>" + render(m.text, m.spans ? spanRanges(m.text, m.spans) : matchRanges(m.text, re)) + "</td></tr>";
+		});
+		if (last !== null) {
+			html += "</table>";
+		}
+		$("results").innerHTML = html;
+		$("status").textContent = res.matches.length + " matching lines in " + res.files + " files searched" +
+			(res.truncated ? " (truncated)" : "");
+	}).catch(function(err) {
+		$("status").textContent = String(err);
+	});
+}
+
+function showFile(p) {
+	var line = parseInt(p.line, 10) || 0;
+	$("results").hidden = true;
+	$("file").hidden = false;
+	$("filename").textContent = p.file;
+	$("status").textContent = "";
+	fetch("file?path=" + encodeURIComponent(p.file)).then(function(resp) { return resp.json(); }).then(function(res) {
+		if (res.error) {
+			$("status").textContent = res.error;
+			$("content").innerHTML = "";
+			return;
+		}
+		var re = $("q").value ? jsRegexp($("re").checked ? $("q").value : quoteMeta($("q").value), $("i").checked) : null;
+		var lines = res.content.replace(/\n$/, "").split("\n");
+		$("content").innerHTML = lines.map(function(text, i) {
+			var n = i + 1;
+			return '<tr id="L' + n + '"' + (n == line ? ' class="hit"' : "") + '><td class="line"><a href="' +
+				fileLink(p.file, n) + '">' + n + "</a></td><td>" + render(text, matchRanges(text, re)) + "</td></tr>";
+		}).join("");
+		var hit = $("L" + line);
+		if (hit) {
+			hit.scrollIntoView({block: "center"});
+		}
+	}).catch(function(err) {
+		$("status").textContent = String(err);
+	});
+}
+
+function route() {
+	var p = params();
+	if (p.file) {
+		showFile(p);
+	} else if (p.q) {
+		search(p);
+	} else {
+		$("results").innerHTML = "";
+		$("file").hidden = true;
+	}
+}
+
+$("form").addEventListener("submit", function(e) {
+	e.preventDefault();
+	setHash({q: $("q").value, f: $("f").value, re: $("re").checked ? "" : "0", i: $("i").checked ? "1" : ""});
+});
+window.addEventListener("hashchange", route);
+route();
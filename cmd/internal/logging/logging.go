@@ -0,0 +1,181 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logging sets up the logging shared by the codesearch
+// commands.
+//
+// The commands and the index package log through log/slog, recording
+// the details of each event, such as the path of a file that could not
+// be read and the error, as attributes.  The -log-format flag chooses
+// how the log is written: as text, one line per event in the form that
+// package log writes, followed by the attributes as key=value pairs, or
+// as JSON, one object per line, for programs to read.  The -log-level
+// flag sets the least severe level logged: debug, info (the default),
+// warn, or error.  Messages logged with package log, which the commands
+// use only for fatal errors, are logged at level error.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Usage is a paragraph describing the flags,
+// for the usage messages of the commands.
+const Usage = `The -log-format flag sets the format of the messages logged to standard
+error: text (the default), or json for one JSON object per line, with
+fields time, level, msg, and details such as path and error.  The
+-log-level flag sets the least severe level of message logged: debug,
+info (the default), warn, or error.
+`
+
+var (
+	format = "text"
+	level  = slog.LevelInfo
+)
+
+// AddFlags defines the -log-format and -log-level flags
+// in flag.CommandLine, so that parsing rejects invalid values.
+func AddFlags() {
+	format, level = "text", slog.LevelInfo
+	flag.Func("log-format", "log messages as `format` text (the default) or json", func(s string) error {
+		if s != "text" && s != "json" {
+			return errors.New("format must be text or json")
+		}
+		format = s
+		return nil
+	})
+	flag.TextVar(&level, "log-level", slog.LevelInfo, "log messages at `level` debug, info, warn, or error and above")
+}
+
+// Setup makes the default slog logger, and with it package log,
+// write to w as the flags direct.
+func Setup(w io.Writer) {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = newTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	slog.SetLogLoggerLevel(slog.LevelError)
+}
+
+// A textHandler is a slog.Handler that writes each record as a line
+// of text in the form package log uses by default, with the date and
+// time first, then the level, unless it is info, then the message,
+// and finally the attributes as key=value pairs.
+type textHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	opts  slog.HandlerOptions
+	attrs []byte // preformatted attributes from WithAttrs
+	group string // group prefix for later attributes, ending in "."
+}
+
+// newTextHandler returns a textHandler writing to w,
+// using opts, which may be nil, only for the level.
+func newTextHandler(w io.Writer, opts *slog.HandlerOptions) *textHandler {
+	h := &textHandler{mu: new(sync.Mutex), w: w}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+func (h *textHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	min := slog.LevelInfo
+	if h.opts.Level != nil {
+		min = h.opts.Level.Level()
+	}
+	return level >= min
+}
+
+func (h *textHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	buf.WriteString(t.Format("2006/01/02 15:04:05 "))
+	if r.Level != slog.LevelInfo {
+		buf.WriteString(r.Level.String())
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(r.Message)
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.group, a)
+		return true
+	})
+	buf.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h1 := *h
+	var buf bytes.Buffer
+	buf.Write(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&buf, h.group, a)
+	}
+	h1.attrs = buf.Bytes()
+	return &h1
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h1 := *h
+	h1.group = h.group + name + "."
+	return &h1
+}
+
+// appendAttr appends the attribute a to buf as " key=value",
+// with the key prefixed by group.
+func appendAttr(buf *bytes.Buffer, group string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			group += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			appendAttr(buf, group, ga)
+		}
+		return
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(group + a.Key)
+	buf.WriteByte('=')
+	s := v.String()
+	if needsQuote(s) {
+		s = strconv.Quote(s)
+	}
+	buf.WriteString(s)
+}
+
+// needsQuote reports whether s must be quoted
+// to be read back as a single value.
+func needsQuote(s string) bool {
+	return s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r)
+	}) >= 0
+}
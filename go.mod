@@ -1,3 +1,17 @@
 module github.com/google/codesearch
 
-go 1.13
+go 1.23
+
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/sys v0.24.0
+	golang.org/x/text v0.17.0
+	google.golang.org/grpc v1.67.1
+	google.golang.org/protobuf v1.35.1
+)
+
+require (
+	golang.org/x/net v0.28.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
+)
@@ -0,0 +1,409 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Archives.
+//
+// If IndexWriter.Archives is set, AddTree indexes the members of the
+// zip and tar archives it finds instead of the archives themselves.
+// (Java .jar, .war, and .ear files are zip archives.)  A member is
+// named in the index as archive!/member, where archive is the name of
+// the archive file and member is the member's slash-separated path
+// within it.  OpenFile and ReadFile read such files back from the
+// archive, so that they can be searched.  Archives inside archives
+// are not opened.
+
+// archiveExts lists the file name extensions of the supported archives.
+var archiveExts = []string{".zip", ".jar", ".war", ".ear", ".tar", ".tar.gz", ".tgz"}
+
+// IsArchive reports whether name has the extension of an archive
+// whose members AddArchive can index.
+func IsArchive(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) && len(lower) > len(ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchiveMember returns the index name of the file member
+// in the archive file archive.
+func ArchiveMember(archive, member string) string {
+	return archive + "!/" + member
+}
+
+// SplitArchiveName splits the index name of a member of an archive
+// into the name of the archive file and the member's path within it.
+func SplitArchiveName(name string) (archive, member string, ok bool) {
+	for i := 0; ; i += 2 {
+		j := strings.Index(name[i:], "!/")
+		if j < 0 {
+			return "", "", false
+		}
+		i += j
+		if IsArchive(name[:i]) {
+			return name[:i], name[i+2:], true
+		}
+	}
+}
+
+// AddArchive adds the regular files in the archive file name to the
+// index, in lexical order.  Files and directories in the archive for
+// which ix.Skip returns true are not indexed, nor are hidden ones
+// (see IndexWriter.SkipPrefixes).
+// It logs errors using package slog.
+func (ix *IndexWriter) AddArchive(name string) {
+	err := readArchive(name, ix.maxFileLen(), ix.memberAdder(name))
+	if err != nil {
+		slog.Warn("cannot read", "path", name, "error", err)
+		ix.logSkip(name, SkipUnreadable)
+	}
+}
+
+// AddTarStream adds the regular files in the tar stream read from r,
+// which may be compressed with gzip, to the index, as AddArchive adds
+// those of an archive file, naming them root!/member.  Since the
+// stream cannot be read again, the files can only be searched if
+// ix.StoreContent is set.  A root made by TarStream marks the files as
+// coming from a stream, not from an archive file of that name.
+func (ix *IndexWriter) AddTarStream(root string, r io.Reader) error {
+	// readTar reads the archive twice, so keep a copy of the stream.
+	tmp, err := ioutil.TempFile("", "csearch-tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+	open := func() (io.ReadCloser, error) {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		br := bufio.NewReader(tmp)
+		if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			return gzip.NewReader(br)
+		}
+		return ioutil.NopCloser(br), nil
+	}
+	return readTar(root, open, ix.maxFileLen(), ix.memberAdder(root))
+}
+
+// TarStream returns the root under which cindex -tar indexes the
+// files of a tar stream with the given label, such as tar:layer1,
+// which is not the name of a file.
+func TarStream(label string) string {
+	return "tar:" + label
+}
+
+// IsTarStream reports whether the indexed path is a root
+// returned by TarStream.
+func IsTarStream(path string) bool {
+	return strings.HasPrefix(path, "tar:")
+}
+
+// memberAdder returns a function that adds the members
+// of the archive named name to the index.
+func (ix *IndexWriter) memberAdder(name string) func(member string, info os.FileInfo, r io.Reader) {
+	skipped := make(map[string]bool)
+	skipDir := func(dir string) bool {
+		if dir == "." || dir == "/" {
+			return false
+		}
+		s, ok := skipped[dir]
+		if !ok {
+			info := gitFileInfo{name: path.Base(dir), mode: os.ModeDir | 0755}
+			s = ix.skipEntry(ArchiveMember(name, dir), info)
+			skipped[dir] = s
+		}
+		return s
+	}
+	return func(member string, info os.FileInfo, r io.Reader) {
+		for dir := path.Dir(member); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if skipDir(dir) {
+				return
+			}
+		}
+		if ix.skipEntry(ArchiveMember(name, member), info) {
+			return
+		}
+		ix.add(ArchiveMember(name, member), r, info.ModTime())
+	}
+}
+
+// maxFileLen returns the limit on the length of indexed files,
+// which is none if ix.ChunkLen is set.
+func (ix *IndexWriter) maxFileLen() int64 {
+	if ix.ChunkLen > 0 {
+		return math.MaxInt64
+	}
+	maxFile, _, _ := ix.limits()
+	return maxFile
+}
+
+// readArchive calls f for each regular file in the archive file name,
+// in lexical order by name.  Members of tar archives longer than maxFile
+// bytes, which are too long to index, are passed to f cut short after
+// maxFile+1 bytes, so that they need not be held in memory in full.
+func readArchive(name string, maxFile int64, f func(member string, info os.FileInfo, r io.Reader)) error {
+	if isZip(name) {
+		z, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		files := append([]*zip.File(nil), z.File...)
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+		for _, zf := range files {
+			if !zf.Mode().IsRegular() || strings.HasSuffix(zf.Name, "/") {
+				continue
+			}
+			r, err := zf.Open()
+			if err != nil {
+				slog.Warn("cannot read", "path", ArchiveMember(name, zf.Name), "error", err)
+				continue
+			}
+			f(zf.Name, zf.FileInfo(), r)
+			r.Close()
+		}
+		return nil
+	}
+	return readTar(name, func() (io.ReadCloser, error) { return openTar(name) }, maxFile, f)
+}
+
+// readTar calls f for each regular file in the tar archive named name,
+// which open opens for reading from the start, as readArchive does.
+//
+// Tar archives can only be read in order, and they are not always
+// sorted, so readTar reads the archive twice: first to list the
+// members, and then to pass each to f in turn as it reaches them.
+// Only the members that come before their turn are held in memory
+// until it comes, so that sorted archives of any size need none.
+func readTar(name string, open func() (io.ReadCloser, error), maxFile int64, f func(member string, info os.FileInfo, r io.Reader)) error {
+	walk := func(f func(hdr *tar.Header, r io.Reader) bool) error {
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return walkTarReader(r, f)
+	}
+
+	// A later copy of a file replaces an earlier one.
+	last := make(map[string]int) // index of each member's last copy
+	n := 0
+	err := walk(func(hdr *tar.Header, r io.Reader) bool {
+		last[hdr.Name] = n
+		n++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	var order []string
+	for name := range last {
+		order = append(order, name)
+	}
+	sort.Strings(order)
+
+	type member struct {
+		info os.FileInfo
+		data []byte
+	}
+	held := make(map[string]*member) // nil for members that cannot be read
+	next := 0                        // index in order of the member to pass to f next
+	flush := func() {
+		for next < len(order) {
+			m, ok := held[order[next]]
+			if !ok {
+				break
+			}
+			delete(held, order[next])
+			if m != nil {
+				f(order[next], m.info, bytes.NewReader(m.data))
+			}
+			next++
+		}
+	}
+	i := -1
+	err = walk(func(hdr *tar.Header, r io.Reader) bool {
+		i++
+		if j, ok := last[hdr.Name]; !ok || j != i {
+			return true
+		}
+		if maxFile < math.MaxInt64 {
+			r = io.LimitReader(r, maxFile+1)
+		}
+		if next < len(order) && order[next] == hdr.Name {
+			f(hdr.Name, hdr.FileInfo(), r)
+			next++
+			flush()
+			return true
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			slog.Warn("cannot read", "path", ArchiveMember(name, hdr.Name), "error", err)
+			held[hdr.Name] = nil
+		} else {
+			held[hdr.Name] = &member{hdr.FileInfo(), data}
+		}
+		flush()
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// Pass on any members held for one that was not found again,
+	// as when the archive changed between the two readings.
+	for ; next < len(order); next++ {
+		if m := held[order[next]]; m != nil {
+			f(order[next], m.info, bytes.NewReader(m.data))
+		}
+	}
+	return nil
+}
+
+// walkTar calls f for each regular file in the tar archive file name,
+// in the order they appear in the archive, until f returns false.
+func walkTar(name string, f func(hdr *tar.Header, r io.Reader) bool) error {
+	file, err := openTar(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return walkTarReader(file, f)
+}
+
+// openTar opens the tar archive file name, which is read
+// through gzip if its name says it is compressed.
+func openTar(name string) (io.ReadCloser, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if lower := strings.ToLower(name); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return gzipFile{gz, file}, nil
+	}
+	return file, nil
+}
+
+// A gzipFile reads a file through gzip.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// walkTarReader calls f for each regular file in the tar archive
+// read from r, as walkTar does.
+func walkTarReader(r io.Reader, f func(hdr *tar.Header, r io.Reader) bool) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		hdr.Name = strings.TrimPrefix(hdr.Name, "./")
+		if !f(hdr, tr) {
+			return nil
+		}
+	}
+}
+
+// isZip reports whether the archive file name is a zip archive
+// rather than a tar archive.
+func isZip(name string) bool {
+	lower := strings.ToLower(name)
+	return !strings.HasSuffix(lower, ".tar") && !strings.HasSuffix(lower, ".tar.gz") && !strings.HasSuffix(lower, ".tgz")
+}
+
+// readArchiveMember returns the content of the file member
+// in the archive file archive.
+func readArchiveMember(archive, member string) ([]byte, error) {
+	if isZip(archive) {
+		z, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		for _, zf := range z.File {
+			if zf.Name == member {
+				r, err := zf.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer r.Close()
+				return ioutil.ReadAll(r)
+			}
+		}
+		return nil, os.ErrNotExist
+	}
+
+	// Keep the last copy of the file, as readArchive does.
+	var data []byte
+	var readErr error
+	found := false
+	err := walkTar(archive, func(hdr *tar.Header, r io.Reader) bool {
+		if hdr.Name != member {
+			return true
+		}
+		data, readErr = ioutil.ReadAll(r)
+		found = true
+		return readErr == nil
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+// openArchiveMember opens the archive member with the given index name.
+func openArchiveMember(name, archive, member string) (io.ReadCloser, error) {
+	data, err := readArchiveMember(archive, member)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
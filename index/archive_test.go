@@ -0,0 +1,231 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var archiveFiles = []struct {
+	name, data string
+}{
+	{"com/x/Y.java", "class Y { String hello; }\n"},
+	{"README", "hello from the archive\n"},
+	{"skip/z", "hello from skip\n"},
+	{"bin/b.class", "\xca\xfe\xba\xbe\x00\x00\x00\x32\x00\xff\xfe"},
+	{"README", "hello again\n"}, // replaces the first README in tar files
+}
+
+func writeZip(t *testing.T, file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	for _, af := range archiveFiles[:4] {
+		fw, err := w.Create(af.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(af.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func writeTarGz(t *testing.T, file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	w := tar.NewWriter(gz)
+	w.WriteHeader(&tar.Header{Name: "./com/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, af := range archiveFiles {
+		w.WriteHeader(&tar.Header{Name: "./" + af.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(af.data))})
+		w.Write([]byte(af.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	f.Close()
+}
+
+func TestArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jar := filepath.Join(dir, "foo.jar")
+	tgz := filepath.Join(dir, "foo.tar.gz")
+	writeZip(t, jar)
+	writeTarGz(t, tgz)
+	ioutil.WriteFile(filepath.Join(dir, "plain.txt"), []byte("hello, plain\n"), 0666)
+
+	if a, m, ok := SplitArchiveName(jar + "!/com/x/Y.java"); !ok || a != jar || m != "com/x/Y.java" {
+		t.Errorf("SplitArchiveName = %q, %q, %v", a, m, ok)
+	}
+	if _, _, ok := SplitArchiveName(filepath.Join(dir, "x!/y")); ok {
+		t.Errorf("SplitArchiveName succeeded for a name without an archive")
+	}
+
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	ix := Create(f.Name())
+	ix.Archives = true
+	ix.Skip = func(path string, info os.FileInfo) bool {
+		return info.IsDir() && info.Name() == "skip"
+	}
+	ix.AddPaths([]string{dir})
+	ix.AddTree(dir)
+	ix.Flush()
+
+	rd := Open(f.Name())
+	var names []string
+	for i := 0; i < rd.NumFiles(); i++ {
+		names = append(names, rd.Name(uint32(i)))
+	}
+	want := []string{
+		jar + "!/README",
+		jar + "!/com/x/Y.java",
+		tgz + "!/README",
+		tgz + "!/com/x/Y.java",
+		filepath.Join(dir, "plain.txt"),
+	}
+	if !equalStrings(names, want) {
+		t.Fatalf("indexed %q, want %q", names, want)
+	}
+
+	for _, tt := range []struct{ name, data string }{
+		{jar + "!/com/x/Y.java", archiveFiles[0].data},
+		{jar + "!/README", archiveFiles[1].data},
+		{tgz + "!/README", archiveFiles[4].data},
+	} {
+		data, err := ReadFile(tt.name)
+		if err != nil || string(data) != tt.data {
+			t.Errorf("ReadFile(%q) = %q, %v, want %q", tt.name, data, err, tt.data)
+		}
+	}
+	if _, err := ReadFile(jar + "!/missing"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile(missing) error = %v, want not exist", err)
+	}
+	if _, err := ReadFile(tgz + "!/missing"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile(missing) error = %v, want not exist", err)
+	}
+}
+
+func TestAddTarStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tgz := filepath.Join(dir, "foo.tar.gz")
+	writeTarGz(t, tgz)
+
+	root := TarStream("layer")
+	if !IsTarStream(root) || IsTarStream(dir) {
+		t.Errorf("IsTarStream(%q), IsTarStream(%q) = %v, %v, want true, false", root, dir, IsTarStream(root), IsTarStream(dir))
+	}
+
+	out := filepath.Join(dir, "ix")
+	ix := Create(out)
+	ix.StoreContent = true
+	ix.Skip = func(path string, info os.FileInfo) bool {
+		return info.IsDir() && info.Name() == "skip"
+	}
+	ix.AddPaths([]string{root})
+	f, err := os.Open(tgz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.AddTarStream(root, f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	ix.Flush()
+
+	rd := Open(out)
+	defer rd.Close()
+	var names []string
+	for i := 0; i < rd.NumFiles(); i++ {
+		names = append(names, rd.Name(uint32(i)))
+	}
+	if want := []string{root + "!/README", root + "!/com/x/Y.java"}; !equalStrings(names, want) {
+		t.Fatalf("indexed %q, want %q", names, want)
+	}
+	if data, ok := rd.Content(0); !ok || string(data) != archiveFiles[4].data {
+		t.Errorf("Content(README) = %q, %v, want %q", data, ok, archiveFiles[4].data)
+	}
+	if !InTree(names[0], root) {
+		t.Errorf("InTree(%q, %q) = false", names[0], root)
+	}
+
+	if err := Create(out+"2").AddTarStream(root, strings.NewReader("not a tar stream")); err == nil {
+		t.Errorf("AddTarStream of garbage succeeded")
+	}
+}
+
+func TestReadTarStreams(t *testing.T) {
+	dir := t.TempDir()
+	tgz := filepath.Join(dir, "foo.tar.gz")
+	writeTarGz(t, tgz)
+	sorted := filepath.Join(dir, "sorted.tar")
+	f, err := os.Create(sorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tar.NewWriter(f)
+	for _, name := range []string{"a", "b/c", "d"} {
+		w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+		w.Write([]byte("x"))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Members are passed in order, the last copy of each, and only
+	// those that come before their turn are held in memory.
+	for _, tt := range []struct {
+		file  string
+		names []string
+		held  []string
+	}{
+		{sorted, []string{"a", "b/c", "d"}, nil},
+		{tgz, []string{"README", "bin/b.class", "com/x/Y.java", "skip/z"}, []string{"bin/b.class", "com/x/Y.java", "skip/z"}},
+	} {
+		var names, held []string
+		err := readArchive(tt.file, 1<<20, func(member string, info os.FileInfo, r io.Reader) {
+			names = append(names, member)
+			if _, ok := r.(*bytes.Reader); ok {
+				held = append(held, member)
+			}
+			data, _ := ioutil.ReadAll(r)
+			if member == "README" && string(data) != archiveFiles[4].data {
+				t.Errorf("%s: README = %q, want %q", tt.file, data, archiveFiles[4].data)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(names, tt.names) || !equalStrings(held, tt.held) {
+			t.Errorf("%s: read %q, holding %q, want %q, holding %q", tt.file, names, held, tt.names, tt.held)
+		}
+	}
+}
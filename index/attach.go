@@ -0,0 +1,155 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Attached indexes.
+//
+// An index can attach other index files, so that searching it also
+// searches them, composing indexes built separately, perhaps by
+// different people or on different schedules, without merging them
+// into one file.  The attached indexes are listed in the optional
+// "attach" section, a sequence of NUL-terminated file names, and may
+// themselves attach others.  An index listing only attached indexes,
+// with no files of its own, serves as a manifest of the indexes to
+// search.  The index package records the names as given; cindex makes
+// them absolute.
+
+const attachSection = "attach"
+
+// attachSectionData returns the attach section listing files.
+func attachSectionData(files []string) sectionData {
+	w := bufCreateMem()
+	for _, f := range files {
+		w.writeString(f)
+		w.writeString("\x00")
+	}
+	return sectionData{attachSection, w}
+}
+
+// Attached returns the names of the index files that the index
+// attaches, as set by SetAttached.
+func (ix *Index) Attached() []string {
+	var x []string
+	d := ix.section(attachSection)
+	for len(d) > 0 {
+		i := bytes.IndexByte(d, 0)
+		if i < 0 {
+			corrupt()
+		}
+		x = append(x, string(d[:i]))
+		d = d[i+1:]
+	}
+	return x
+}
+
+// mergeAttached returns the attach section for the merge of ix1
+// and the newer ix2, if either attaches other indexes.
+// The list of the newer index, if any, replaces that of the older one.
+func mergeAttached(ix1, ix2 *Index) []sectionData {
+	files := ix2.Attached()
+	if len(files) == 0 {
+		files = ix1.Attached()
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	return []sectionData{attachSectionData(files)}
+}
+
+// SetAttached changes the index file named file to attach the index
+// files named by files, replacing those it attached before.  It leaves
+// the rest of the index unchanged.
+func SetAttached(file string, files []string) {
+	defer Lock(file)()
+	ix := Open(file)
+	if ix.version < 2 {
+		log.Fatalf("%s: index format too old to attach indexes; reindex with -reset", file)
+	}
+
+	out := bufCreateTemp(file)
+	out.write(ix.slice(0, len(magic)))
+	n := uint32(ix.size() - len(trailerMagic) - 6*4)
+	end := ix.uint32(n + 20)
+	off := []uint32{ix.pathData, ix.nameData, ix.postData, ix.nameIndex, ix.postIndex, end}
+	var sums []uint32
+	out.startSum()
+	for i := 0; i+1 < len(off); i++ {
+		out.write(ix.slice(off[i], int(off[i+1]-off[i])))
+		sums = append(sums, out.sum())
+	}
+
+	// Copy the other sections in the order they appear in the file,
+	// except the crc section, which writeSections writes anew.
+	var names []string
+	for name := range ix.sections {
+		if name != crcSection && name != attachSection {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return ix.sections[names[i]].off < ix.sections[names[j]].off
+	})
+	var secs []sectionData
+	for _, name := range names {
+		w := newTempBuf(false)
+		w.write(ix.section(name))
+		secs = append(secs, sectionData{name, w})
+	}
+	if len(files) > 0 {
+		secs = append(secs, attachSectionData(files))
+	}
+	writeSections(out, secs, sums)
+	for _, v := range off {
+		out.writeUint32(v)
+	}
+	out.writeString(trailerMagic)
+	ix.Close()
+	out.commit(file)
+}
+
+// AttachedFiles returns the index files named by files followed by
+// the indexes they attach, directly or through other attached indexes,
+// each listed once, in depth-first order.  It opens each index with
+// open, which may return a cached index.  Sharded indexes attach no
+// others, and attached indexes that do not exist are skipped, with a
+// warning, so that one missing index does not stop all searches.
+func AttachedFiles(files []string, open func(file string) *Index) []string {
+	var list []string
+	seen := make(map[string]bool)
+	var add func(file, parent string)
+	add = func(file, parent string) {
+		key := filepath.Clean(file)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		if parent != "" {
+			if _, err := os.Stat(file); err != nil {
+				slog.Warn("attached index", "parent", parent, "error", err)
+				return
+			}
+		}
+		list = append(list, file)
+		if IsSharded(file) {
+			return
+		}
+		for _, child := range open(file).Attached() {
+			add(child, file)
+		}
+	}
+	for _, f := range files {
+		add(f, "")
+	}
+	return list
+}
@@ -0,0 +1,69 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAttached(t *testing.T) {
+	a := buildExcludeIndex(t, []string{"/a"}, []string{"/vendor"}, "/a/x")
+	defer os.Remove(a)
+	b := buildExcludeIndex(t, []string{"/b"}, nil, "/b/x")
+	defer os.Remove(b)
+	c := buildExcludeIndex(t, []string{"/c"}, nil, "/c/x")
+	defer os.Remove(c)
+
+	if x := Open(a).Attached(); x != nil {
+		t.Errorf("Attached() = %q, want none", x)
+	}
+
+	// Attaching rewrites only the list, keeping the index intact.
+	SetAttached(a, []string{b})
+	SetAttached(b, []string{c, a, c + ".missing"})
+	ix := Open(a)
+	if x := ix.Attached(); !equalStrings(x, []string{b}) {
+		t.Errorf("Attached() = %q, want [%s]", x, b)
+	}
+	if x := ix.Excludes(); !equalStrings(x, []string{"/vendor"}) {
+		t.Errorf("Excludes() = %q, want [/vendor]", x)
+	}
+	if ix.NumFiles() != 1 || ix.Name(0) != "/a/x" {
+		t.Errorf("after SetAttached, index lists %d files, first %q, want /a/x", ix.NumFiles(), ix.Name(0))
+	}
+	if post := ix.PostingQuery(&Query{Op: QAll}); len(post) != 1 {
+		t.Errorf("after SetAttached, PostingQuery(QAll) = %v, want [0]", post)
+	}
+	ix.Close()
+	for _, f := range []string{a, b} {
+		if err := Verify(f); err != nil {
+			t.Errorf("Verify(%s): %v", f, err)
+		}
+	}
+
+	// The graph is followed depth-first, listing each index once,
+	// even around the cycle from b back to a, and skipping the
+	// missing index.
+	if x := AttachedFiles([]string{a}, Open); !equalStrings(x, []string{a, b, c}) {
+		t.Errorf("AttachedFiles(%s) = %q, want [%s %s %s]", a, x, a, b, c)
+	}
+	if x := AttachedFiles([]string{c, b}, Open); !equalStrings(x, []string{c, b, a}) {
+		t.Errorf("AttachedFiles(%s %s) = %q, want [%s %s %s]", c, b, x, c, b, a)
+	}
+
+	// Merging keeps the list.
+	out := c + ".merge"
+	defer os.Remove(out)
+	Merge(out, a, c)
+	if x := Open(out).Attached(); !equalStrings(x, []string{b}) {
+		t.Errorf("Merge: Attached() = %q, want [%s]", x, b)
+	}
+
+	SetAttached(a, nil)
+	if x := Open(a).Attached(); x != nil {
+		t.Errorf("after detaching all, Attached() = %q, want none", x)
+	}
+}
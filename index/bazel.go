@@ -0,0 +1,137 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Bazel workspaces.
+//
+// A Bazel workspace is a directory holding a WORKSPACE, WORKSPACE.bazel,
+// or MODULE.bazel file.  Bazel leaves convenience symbolic links named
+// bazel-* in it, such as bazel-bin and bazel-<workspace>, pointing into
+// its output tree, which holds copies of the sources and the outputs of
+// builds; AddTree skips them, as not worth indexing twice.  The output
+// tree also holds the external repositories that Bazel fetches, each a
+// workspace of its own (see BazelExternal).
+//
+// Each directory of a workspace holding a BUILD or BUILD.bazel file is
+// a package, named by a label such as //net/http, or @dep//net/http in
+// an external repository.  Since the index lists those files along with
+// the rest, Index.BazelPackage can find the package of an indexed file
+// from the index alone.
+
+var (
+	bazelWorkspaceFiles = []string{"MODULE.bazel", "WORKSPACE", "WORKSPACE.bazel"}
+	bazelBuildFiles     = []string{"BUILD", "BUILD.bazel"}
+)
+
+// IsBazelWorkspace reports whether dir is the root of a Bazel workspace.
+func IsBazelWorkspace(dir string) bool {
+	for _, f := range bazelWorkspaceFiles {
+		if info, err := os.Stat(filepath.Join(dir, f)); err == nil && info.Mode().IsRegular() {
+			return true
+		}
+	}
+	return false
+}
+
+// isBazelLink reports whether path is one of the convenience symbolic
+// links that Bazel leaves in the root of a workspace.
+func isBazelLink(path string) bool {
+	if !strings.HasPrefix(filepath.Base(path), "bazel-") {
+		return false
+	}
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0 && IsBazelWorkspace(filepath.Dir(path))
+}
+
+// BazelExternal returns the directory holding the external
+// repositories fetched by Bazel for the workspace dir, which Bazel
+// keeps in its output tree, reporting whether there is one.
+// Bazel must have built something in the workspace for the
+// directory to exist.
+func BazelExternal(dir string) (string, bool) {
+	// bazel-out leads to <output_base>/execroot/<name>/bazel-out,
+	// and the external repositories are in <output_base>/external.
+	out, err := filepath.EvalSymlinks(filepath.Join(dir, "bazel-out"))
+	if err != nil {
+		return "", false
+	}
+	slash := filepath.ToSlash(out)
+	i := strings.LastIndex(slash, "/execroot/")
+	if i < 0 {
+		return "", false
+	}
+	ext := filepath.Join(filepath.FromSlash(slash[:i]), "external")
+	if info, err := os.Stat(ext); err != nil || !info.IsDir() {
+		return "", false
+	}
+	return ext, true
+}
+
+// BazelPackage returns the label of the Bazel package holding the
+// indexed file name, such as //net/http, or the empty string if the
+// file is not in a package of an indexed workspace.
+func (ix *Index) BazelPackage(name string) string {
+	name = slashName(name)
+	ix.bazelMu.Lock()
+	defer ix.bazelMu.Unlock()
+	if ix.bazelDirs == nil {
+		ix.bazelDirs = make(map[string]bazelDir)
+	}
+	d := ix.bazelDir(path.Dir(name))
+	if d.root == "" || d.pkg == "" {
+		return ""
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(d.pkg, d.root), "/")
+	repo := ""
+	if path.Base(path.Dir(d.root)) == "external" {
+		repo = "@" + path.Base(d.root)
+	}
+	return repo + "//" + rel
+}
+
+// A bazelDir records the innermost workspace root and package
+// directory enclosing a directory, either of which may be empty.
+type bazelDir struct {
+	root, pkg string
+}
+
+// bazelDir returns the bazelDir for dir, caching the results for dir
+// and its parents in ix.bazelDirs.  The caller must hold ix.bazelMu.
+func (ix *Index) bazelDir(dir string) bazelDir {
+	if d, ok := ix.bazelDirs[dir]; ok {
+		return d
+	}
+	var d bazelDir
+	if parent := path.Dir(dir); parent != dir {
+		d = ix.bazelDir(parent)
+	}
+	if ix.hasAny(dir, bazelWorkspaceFiles) {
+		// A nested workspace, such as an external repository,
+		// starts afresh.
+		d = bazelDir{root: dir}
+	}
+	if d.root != "" && ix.hasAny(dir, bazelBuildFiles) {
+		d.pkg = dir
+	}
+	ix.bazelDirs[dir] = d
+	return d
+}
+
+// hasAny reports whether the index lists any of the files in dir.
+func (ix *Index) hasAny(dir string, files []string) bool {
+	for _, f := range files {
+		if _, ok := ix.Lookup(path.Join(dir, f)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var bazelPackageTests = []struct {
+	file string
+	pkg  string
+}{
+	{"README", ""},
+	{"ws/main.go", "//"},
+	{"ws/net/http/server.go", "//net/http"},
+	{"ws/net/http/internal/x.go", "//net/http"},
+	{"ws/net/nopkg.go", "//"},
+	{"ws/ext/external/dep/lib/a.go", "@dep//lib"},
+	{"ws/ext/external/dep/top.go", ""},
+}
+
+func TestBazel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"README",
+		"ws/MODULE.bazel",
+		"ws/BUILD.bazel",
+		"ws/main.go",
+		"ws/net/nopkg.go",
+		"ws/net/http/BUILD",
+		"ws/net/http/server.go",
+		"ws/net/http/internal/x.go",
+		"ws/ext/external/dep/WORKSPACE",
+		"ws/ext/external/dep/top.go",
+		"ws/ext/external/dep/lib/BUILD",
+		"ws/ext/external/dep/lib/a.go",
+		"out/execroot/ws/bazel-out/gen.go",
+	} {
+		file := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(file), 0777)
+		if err := ioutil.WriteFile(file, []byte("hello world\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws := filepath.Join(dir, "ws")
+	if err := os.Symlink(filepath.Join(dir, "out/execroot/ws"), filepath.Join(ws, "bazel-ws")); err != nil {
+		t.Skipf("cannot create symbolic links: %v", err)
+	}
+	os.Symlink(filepath.Join(dir, "out/execroot/ws/bazel-out"), filepath.Join(ws, "bazel-out"))
+	os.MkdirAll(filepath.Join(dir, "out/external"), 0777)
+
+	if !IsBazelWorkspace(ws) || IsBazelWorkspace(dir) {
+		t.Errorf("IsBazelWorkspace(ws), IsBazelWorkspace(dir) = %v, %v, want true, false", IsBazelWorkspace(ws), IsBazelWorkspace(dir))
+	}
+	if ext, ok := BazelExternal(ws); !ok || ext != filepath.Join(dir, "out/external") {
+		t.Errorf("BazelExternal = %q, %v, want %q, true", ext, ok, filepath.Join(dir, "out/external"))
+	}
+
+	// The links into the output tree are skipped even when following links.
+	out := filepath.Join(dir, "ix")
+	ix := Create(out)
+	ix.FollowSymlinks = true
+	var links []string
+	ix.OnSkip = func(path string, reason SkipReason) {
+		if reason == SkipBazelLink {
+			links = append(links, filepath.Base(path))
+		}
+	}
+	ix.AddPaths([]string{dir})
+	ix.AddTree(dir)
+	ix.Flush()
+	if !equalStrings(links, []string{"bazel-out", "bazel-ws"}) {
+		t.Errorf("skipped links %q, want [bazel-out bazel-ws]", links)
+	}
+
+	r := Open(out)
+	defer r.Close()
+	if _, ok := r.Lookup(filepath.Join(ws, "bazel-ws/bazel-out/gen.go")); ok {
+		t.Errorf("indexed a file through bazel-ws")
+	}
+	for _, tt := range bazelPackageTests {
+		if pkg := r.BazelPackage(filepath.Join(dir, tt.file)); pkg != tt.pkg {
+			t.Errorf("BazelPackage(%s) = %q, want %q", tt.file, pkg, tt.pkg)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Character sets.
+//
+// The index holds trigrams of UTF-8 text, but some source files are
+// written in other encodings: files from Windows are often UTF-16
+// with a byte order mark, and older files are often Latin-1.  Such
+// files are converted to UTF-8 both when they are indexed and when
+// they are searched (see OpenFile), so that they can be matched and
+// their matching lines printed like any other.  A file is taken to be
+// UTF-16 if it begins with a byte order mark, and Latin-1 if its first
+// sniffLen bytes are not valid UTF-8 but contain no control characters
+// other than white space, which would suggest a binary file instead.
+
+const sniffLen = 64 << 10
+
+// newTextReader returns a reader that reads the text in br as UTF-8,
+// converting it from UTF-16 or Latin-1 if necessary.
+// The buffer of br must hold at least sniffLen bytes.
+func newTextReader(br *bufio.Reader) io.Reader {
+	head, _ := br.Peek(sniffLen)
+	switch {
+	case bytes.HasPrefix(head, []byte("\xff\xfe")):
+		br.Discard(2)
+		return &decodeReader{r: br, decode: decodeUTF16LE}
+	case bytes.HasPrefix(head, []byte("\xfe\xff")):
+		br.Discard(2)
+		return &decodeReader{r: br, decode: decodeUTF16BE}
+	case isLatin1(head, len(head) == sniffLen):
+		return &decodeReader{r: br, decode: decodeLatin1}
+	}
+	return br
+}
+
+// isLatin1 reports whether the text at the start of a file looks like
+// Latin-1 rather than UTF-8 or binary data.  If more is true, head
+// may end in the middle of a UTF-8 sequence.
+func isLatin1(head []byte, more bool) bool {
+	if more {
+		// Drop an incomplete UTF-8 sequence at the end.
+		for i := len(head) - 1; i >= 0 && i >= len(head)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(head[i]) {
+				if !utf8.FullRune(head[i:]) {
+					head = head[:i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(head) {
+		return false
+	}
+	for _, c := range head {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\v' && c != '\f' && c != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// A decodeReader reads text in some other encoding from r as UTF-8.
+type decodeReader struct {
+	r io.Reader
+	// decode appends the UTF-8 encoding of the text at the start of src
+	// to dst and returns the result along with the number of bytes of src
+	// consumed.  If final is false, it may leave an incomplete sequence
+	// at the end of src for the next call.
+	decode func(dst, src []byte, final bool) ([]byte, int)
+	raw    [8192]byte // input not yet decoded is raw[:nraw]
+	nraw   int
+	out    []byte // decoded output not yet returned
+	outbuf []byte // buffer holding out
+	err    error
+}
+
+func (d *decodeReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		n, err := d.r.Read(d.raw[d.nraw:])
+		d.nraw += n
+		d.err = err
+		out, used := d.decode(d.outbuf[:0], d.raw[:d.nraw], err != nil)
+		d.out, d.outbuf = out, out
+		d.nraw = copy(d.raw[:], d.raw[used:d.nraw])
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func decodeLatin1(dst, src []byte, final bool) ([]byte, int) {
+	for _, c := range src {
+		if c < utf8.RuneSelf {
+			dst = append(dst, c)
+		} else {
+			dst = append(dst, 0xC0|c>>6, 0x80|c&0x3F)
+		}
+	}
+	return dst, len(src)
+}
+
+func decodeUTF16LE(dst, src []byte, final bool) ([]byte, int) {
+	return decodeUTF16(dst, src, final, func(b []byte) rune { return rune(b[0]) | rune(b[1])<<8 })
+}
+
+func decodeUTF16BE(dst, src []byte, final bool) ([]byte, int) {
+	return decodeUTF16(dst, src, final, func(b []byte) rune { return rune(b[0])<<8 | rune(b[1]) })
+}
+
+func decodeUTF16(dst, src []byte, final bool, unit func([]byte) rune) ([]byte, int) {
+	var buf [utf8.UTFMax]byte
+	i := 0
+	for i+2 <= len(src) {
+		r, size := unit(src[i:]), 2
+		if utf16.IsSurrogate(r) {
+			if i+4 > len(src) && !final {
+				break
+			}
+			r = utf8.RuneError
+			if i+4 <= len(src) {
+				if r2 := utf16.DecodeRune(unit(src[i:]), unit(src[i+2:])); r2 != utf8.RuneError {
+					r, size = r2, 4
+				}
+			}
+		}
+		dst = append(dst, buf[:utf8.EncodeRune(buf[:], r)]...)
+		i += size
+	}
+	if final && i < len(src) {
+		// Odd byte at end of file.
+		dst = append(dst, buf[:utf8.EncodeRune(buf[:], utf8.RuneError)]...)
+		i = len(src)
+	}
+	return dst, i
+}
@@ -0,0 +1,71 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf16"
+)
+
+func utf16Bytes(s string, big bool) string {
+	var b []byte
+	if big {
+		b = append(b, 0xfe, 0xff)
+	} else {
+		b = append(b, 0xff, 0xfe)
+	}
+	for _, u := range utf16.Encode([]rune(s)) {
+		if big {
+			b = append(b, byte(u>>8), byte(u))
+		} else {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	return string(b)
+}
+
+var charsetTests = []struct {
+	in, out string
+}{
+	{"plain text\n", "plain text\n"},
+	{"caf\xc3\xa9\n", "café\n"},
+	{"caf\xe9\n", "café\n"},
+	{"bin\x00\xe9\n", "bin\x00\xe9\n"},
+	{utf16Bytes("héllo, 世界 \U0001F600\r\n", false), "héllo, 世界 \U0001F600\r\n"},
+	{utf16Bytes("héllo, 世界 \U0001F600\r\n", true), "héllo, 世界 \U0001F600\r\n"},
+	{utf16Bytes("x", false) + "\x00", "x�"},
+	{utf16Bytes("x", false)[:2] + "\x3d\xd8a\x00", "�a"},
+	{strings.Repeat("x", sniffLen-1) + "\xc3\xa9 \xe9", strings.Repeat("x", sniffLen-1) + "é \xe9"},
+}
+
+func TestTextReader(t *testing.T) {
+	for i, tt := range charsetTests {
+		// Read one byte at a time to exercise partial sequences.
+		r := newTextReader(bufio.NewReaderSize(strings.NewReader(tt.in), sniffLen))
+		out, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		if err != nil || string(out) != tt.out {
+			t.Errorf("#%d: read %+q, %v, want %+q", i, out, err, tt.out)
+		}
+	}
+}
+
+func TestIndexUTF16(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	data := utf16Bytes("// Copyright\r\npackage windows\r\n", false)
+	buildIndex(f.Name(), nil, map[string]string{"/a/x.go": data})
+	ix := Open(f.Name())
+	if l := ix.PostingList(tri('w', 'i', 'n')); !equalList(l, []uint32{0}) {
+		t.Errorf("PostingList(win) = %v, want [0]", l)
+	}
+	if m := ix.Meta(0); m.Size != int64(len(data)) {
+		t.Errorf("Meta(0).Size = %d, want %d", m.Size, len(data))
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// Checkpoints.
+//
+// Building the index of a large tree can take hours, and a build that
+// crashes or is killed loses all its work.  If IndexWriter.Checkpoint
+// is set, then after each CheckpointBytes bytes of files the writer
+// writes the files added since the last checkpoint to an index of
+// their own, named by adding "~checkpoint" to the name of the index
+// file, and calls Checkpoint with its name and that of the last file
+// in it.  It then starts afresh, with no files, so that the index
+// Flush writes holds only the files added after the last checkpoint.
+// The caller keeps the checkpoint indexes, typically by merging each
+// with Update into one partial index, and records the last file, so
+// that after a crash a new build can skip the files up to it, in the
+// order WalkBefore gives, and merge its index with the partial one.
+//
+// The checkpoint indexes record no stop fraction, and the index that
+// Flush writes after a checkpoint is marked as partial (see Partial),
+// so that the stop trigrams are chosen once, by the final merge.
+
+// checkpoint writes the files added since the last checkpoint,
+// the last of which is named last, to a checkpoint index, passes it
+// to ix.Checkpoint, and starts a new, empty index.
+func (ix *IndexWriter) checkpoint(last string) {
+	file := ix.file + "~checkpoint"
+	main, fraction := ix.main, ix.StopFraction
+	ix.main = bufCreateTemp(file)
+	ix.StopFraction = 0
+	ix.Partial = true
+	ix.write()
+	ix.main.commit(file)
+	ix.main, ix.StopFraction = main, fraction
+	slog.Info("checkpoint", "index", ix.file, "files", ix.numName, "last", last)
+
+	ix.nameData = bufCreate("")
+	ix.nameIndex = bufCreate("")
+	ix.names = nil
+	ix.meta = newMetaWriter(false)
+	ix.syms = newSymWriter(false)
+	ix.idents = newIdentWriter(false)
+	ix.nameTris = nil
+	ix.content = nil
+	ix.regions = nil
+	ix.numName = 0
+	ix.checkBytes = 0
+	ix.dupes = nil
+	ix.aliases = nil
+	ix.post = ix.post[:0]
+	ix.stop = nil
+	ix.postFile = nil
+	ix.postIndex = bufCreate("")
+
+	ix.Checkpoint(file, last)
+}
+
+// WalkBefore reports whether AddTree visits the file or directory
+// named a before the one named b: whether, comparing their names
+// element by element, a comes first.  It differs from comparing the
+// names as strings when an element of one is a prefix of the other's,
+// as in a-b/c and a/b, of which AddTree visits a/b first.
+func WalkBefore(a, b string) bool {
+	a, b = slashName(a), slashName(b)
+	for a != "" && b != "" {
+		ea, ra, _ := strings.Cut(a, "/")
+		eb, rb, _ := strings.Cut(b, "/")
+		if ea != eb {
+			return ea < eb
+		}
+		a, b = ra, rb
+	}
+	return a == "" && b != ""
+}
@@ -0,0 +1,134 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWalkBefore(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"/a/b", "/a/c", true},
+		{"/a/c", "/a/b", false},
+		{"/a/b", "/a/b", false},
+		{"/a", "/a/b", true},
+		{"/a/b", "/a", false},
+		{"/a/b", "/a-b/c", true},
+		{"/a-b/c", "/a/b", false},
+		{"/a/z/y", "/a-b", true},
+		{"/x/f9", "/x/f10", false},
+	} {
+		if got := WalkBefore(tt.a, tt.b); got != tt.want {
+			t.Errorf("WalkBefore(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// checkpointFiles returns n files under dir, all containing "the cat"
+// and every fourth "dog" too.
+func checkpointFiles(dir string, n int) map[string]string {
+	files := make(map[string]string)
+	for i := 0; i < n; i++ {
+		data := fmt.Sprintf("the cat %d\n", i)
+		if i%4 == 0 {
+			data += "dog\n"
+		}
+		files[fmt.Sprintf("%s/f%02d", dir, i)] = data
+	}
+	return files
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	files := checkpointFiles("/src", 20)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ref := filepath.Join(dir, "ref")
+	buildIndexWith(ref, []string{"/src"}, files, stopFraction(0.5))
+
+	// Build the same index with a checkpoint every 60 bytes,
+	// merging the checkpoints into a partial index.
+	out := filepath.Join(dir, "index")
+	partial := filepath.Join(dir, "partial")
+	keep := func(string) bool { return false }
+	var lasts []string
+	ix := Create(out)
+	ix.StopFraction = 0.5
+	ix.CheckpointBytes = 60
+	ix.Checkpoint = func(file, last string) {
+		if _, err := os.Stat(file); err != nil {
+			t.Fatalf("checkpoint: %v", err)
+		}
+		if lasts == nil {
+			os.Rename(file, partial)
+		} else {
+			Update(partial+"~", partial, file, keep)
+			os.Rename(partial+"~", partial)
+		}
+		lasts = append(lasts, last)
+	}
+	ix.AddPaths([]string{"/src"})
+	for _, name := range names {
+		ix.Add(name, strings.NewReader(files[name]))
+	}
+	ix.Flush()
+	if len(lasts) < 3 {
+		t.Fatalf("got %d checkpoints, want several", len(lasts))
+	}
+	if !sort.StringsAreSorted(lasts) || lasts[0] == names[0] || lasts[len(lasts)-1] == names[len(names)-1] {
+		t.Errorf("checkpoints after %q", lasts)
+	}
+
+	// The last index holds just the files after the last checkpoint
+	// and, like the checkpoints, has no stop trigrams.
+	last := Open(out)
+	if n, want := last.NumFiles(), len(names)-sort.SearchStrings(names, lasts[len(lasts)-1])-1; n != want {
+		t.Errorf("last index has %d files, want %d", n, want)
+	}
+	if last.StopFraction() != 0.5 || len(last.StopTrigrams()) != 0 {
+		t.Errorf("last index has stop fraction %v, stop trigrams %q; want 0.5, none", last.StopFraction(), last.StopTrigrams())
+	}
+	last.Close()
+	p := Open(partial)
+	if p.StopFraction() != 0 {
+		t.Errorf("partial index has stop fraction %v, want 0", p.StopFraction())
+	}
+	p.Close()
+
+	// Merging it with the partial index makes the same index as
+	// building it in one go.
+	merged := filepath.Join(dir, "merged")
+	Update(merged, partial, out, keep)
+	ix1, ix2 := Open(ref), Open(merged)
+	defer ix1.Close()
+	defer ix2.Close()
+	var got []string
+	for _, name := range ix2.Files("") {
+		got = append(got, name)
+	}
+	if !equalStrings(got, names) {
+		t.Errorf("merged index has files %q, want %q", got, names)
+	}
+	if s1, s2 := ix1.StopTrigrams(), ix2.StopTrigrams(); !equalStrings(s1, s2) {
+		t.Errorf("merged index has stop trigrams %q, want %q", s2, s1)
+	}
+	for _, tt := range stopQueryTests {
+		if got, want := queryFiles(t, ix2, tt.re), queryFiles(t, ix1, tt.re); !equalList(got, want) {
+			t.Errorf("%#q: merged index finds %v, want %v", tt.re, got, want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "hash/crc32"
+
+// Checksums.
+//
+// The writer ends the section index with a "crc" section holding a
+// CRC-32 checksum of each part of the index before it (see read.go), so
+// that Verify can find damage that leaves the structure of the index
+// intact, such as a block of zeros left by a crash.  Readers do not
+// check the checksums, which would mean reading the whole index every
+// time it is opened; cindex -verify does.
+
+const crcSection = "crc"
+
+// castagnoli is the table for the CRC-32 checksums in the crc section.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// indexParts names the parts of an index that precede the sections,
+// in the order that both the trailer and the crc section list them.
+var indexParts = []string{
+	"path list",
+	"name list",
+	"posting lists",
+	"name index",
+	"posting list index",
+	"section index",
+}
@@ -0,0 +1,171 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed name lists.
+//
+// The list of names in an index is made up of long, sorted file names
+// that mostly repeat the directories of the names before them, so it
+// compresses well.  An IndexWriter with Compress set writes a version 4
+// index, in which the names are grouped into blocks of nameBlockSize
+// consecutive file IDs and each block is compressed separately with
+// zstd (see read.go).  Reading a name decompresses its block, and the
+// Index keeps the most recently used block, so that reading names in
+// order, as most callers do, decompresses each block only once.
+
+// nameBlockSize is the number of names in each compressed block.
+const nameBlockSize = 64
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// zstdCodec returns the shared zstd encoder and decoder, whose
+// EncodeAll and DecodeAll methods are safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEnc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithZeroFrames(true))
+		if err != nil {
+			log.Fatal(err)
+		}
+		zstdDec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return zstdEnc, zstdDec
+}
+
+// A nameListWriter writes the list of names to out and the
+// corresponding name index to index, compressing the names
+// if compress is set.
+type nameListWriter struct {
+	out      *bufWriter
+	index    *bufWriter
+	base     uint32 // offset of the name list in out
+	compress bool
+	block    []byte // names waiting to be compressed
+	pending  int    // number of names in block
+}
+
+func newNameListWriter(out, index *bufWriter, compress bool) *nameListWriter {
+	return &nameListWriter{out: out, index: index, base: out.offset(), compress: compress}
+}
+
+// add adds name to the list.
+func (w *nameListWriter) add(name string) {
+	if !w.compress {
+		w.index.writeUint32(w.out.offset() - w.base)
+		w.out.writeString(name)
+		w.out.writeByte(0)
+		return
+	}
+	w.block = append(w.block, name...)
+	w.block = append(w.block, 0)
+	if w.pending++; w.pending == nameBlockSize {
+		w.flushBlock()
+	}
+}
+
+// flushBlock compresses and writes the pending block of names.
+func (w *nameListWriter) flushBlock() {
+	if w.pending == 0 {
+		return
+	}
+	off := w.out.offset() - w.base
+	for i := 0; i < w.pending; i++ {
+		w.index.writeUint32(off)
+	}
+	enc, _ := zstdCodec()
+	w.out.write(enc.EncodeAll(w.block, nil))
+	w.block = w.block[:0]
+	w.pending = 0
+}
+
+// finish ends the list, writing the final name index entry.
+// In an uncompressed list, that entry refers to an empty name,
+// and in a compressed one, to the end of the list.
+func (w *nameListWriter) finish() {
+	if !w.compress {
+		w.add("")
+		return
+	}
+	w.flushBlock()
+	w.index.writeUint32(w.out.offset() - w.base)
+}
+
+// A nameBlock is a decompressed block of names.
+type nameBlock struct {
+	block int      // block number
+	names [][]byte // the names in the block
+}
+
+// compressedName returns the name of the given fileid
+// in an index with a compressed name list.
+func (ix *Index) compressedName(fileid uint32) []byte {
+	if int(fileid) >= ix.numName {
+		corrupt()
+	}
+	b := int(fileid) / nameBlockSize
+	ix.nameMu.Lock()
+	nb := ix.nameBlock
+	ix.nameMu.Unlock()
+	if nb == nil || nb.block != b {
+		nb = ix.readNameBlock(b)
+		ix.nameMu.Lock()
+		ix.nameBlock = nb
+		ix.nameMu.Unlock()
+	}
+	i := int(fileid) - b*nameBlockSize
+	if i >= len(nb.names) {
+		corrupt()
+	}
+	return nb.names[i]
+}
+
+// readNameBlock reads and decompresses block number b of the name list.
+func (ix *Index) readNameBlock(b int) *nameBlock {
+	first := b * nameBlockSize
+	last := first + nameBlockSize
+	if last > ix.numName {
+		last = ix.numName
+	}
+	off := ix.uint32(ix.nameIndex + 4*uint32(first))
+	end := ix.uint32(ix.nameIndex + 4*uint32(last))
+	if end < off {
+		corrupt()
+	}
+	_, dec := zstdCodec()
+	data, err := dec.DecodeAll(ix.slice(ix.nameData+off, int(end-off)), nil)
+	if err != nil {
+		corrupt()
+	}
+	nb := &nameBlock{block: b}
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, 0)
+		if i < 0 {
+			corrupt()
+		}
+		nb.names = append(nb.names, data[:i:i])
+		data = data[i+1:]
+	}
+	return nb
+}
+
+// Compressed reports whether the index's list of names is compressed.
+func (ix *Index) Compressed() bool {
+	return ix.version >= 4
+}
@@ -0,0 +1,85 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// compressFiles returns n files, enough to fill several compressed blocks.
+func compressFiles(n int) map[string]string {
+	files := make(map[string]string)
+	for i := 0; i < n; i++ {
+		files[fmt.Sprintf("/src/pkg/dir%d/file%03d.go", i%7, i)] = fmt.Sprintf("package dir%d // file %d\n", i%7, i)
+	}
+	return files
+}
+
+// compressed configures an IndexWriter to compress the name list.
+func compressed(ix *IndexWriter) {
+	ix.Compress = true
+}
+
+func TestCompressedNames(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	files := compressFiles(3*nameBlockSize + 5)
+	buildIndex(f1.Name(), []string{"/src"}, files)
+	buildIndexWith(f2.Name(), []string{"/src"}, files, compressed)
+
+	ix1 := Open(f1.Name())
+	ix2 := Open(f2.Name())
+	if ix1.Version() != 3 || ix1.Compressed() {
+		t.Errorf("uncompressed index: Version() = %d, Compressed() = %v", ix1.Version(), ix1.Compressed())
+	}
+	if ix2.Version() != 4 || !ix2.Compressed() {
+		t.Errorf("compressed index: Version() = %d, Compressed() = %v", ix2.Version(), ix2.Compressed())
+	}
+	if ix2.nameIndex-ix2.nameData >= ix1.nameIndex-ix1.nameData {
+		t.Errorf("compressed names take %d bytes, uncompressed %d", ix2.nameIndex-ix2.nameData, ix1.nameIndex-ix1.nameData)
+	}
+
+	checkNames := func(ix *Index) {
+		if ix.NumFiles() != ix1.NumFiles() {
+			t.Fatalf("NumFiles() = %d, want %d", ix.NumFiles(), ix1.NumFiles())
+		}
+		// Read the names out of order to exercise the block cache.
+		for _, i := range []int{0, ix.NumFiles() - 1, nameBlockSize, nameBlockSize - 1, 5, 2 * nameBlockSize} {
+			if name, want := ix.Name(uint32(i)), ix1.Name(uint32(i)); name != want {
+				t.Errorf("Name(%d) = %q, want %q", i, name, want)
+			}
+		}
+		for i := 0; i < ix.NumFiles(); i++ {
+			name := ix1.Name(uint32(i))
+			if id, ok := ix.Lookup(name); !ok || id != uint32(i) {
+				t.Errorf("Lookup(%q) = %d, %v, want %d, true", name, id, ok, i)
+			}
+		}
+		if _, ok := ix.Lookup("/src/pkg/missing"); ok {
+			t.Errorf("Lookup(missing) succeeded")
+		}
+		trig := tri('d', 'i', 'r')
+		if l, want := ix.PostingList(trig), ix1.PostingList(trig); !equalList(l, want) {
+			t.Errorf("PostingList(dir) = %v, want %v", l, want)
+		}
+	}
+	checkNames(ix2)
+
+	// Merging a compressed index keeps it compressed.
+	Merge(f3.Name(), f1.Name(), f2.Name())
+	ix3 := Open(f3.Name())
+	if !ix3.Compressed() {
+		t.Errorf("merged index is not compressed")
+	}
+	checkNames(ix3)
+}
@@ -0,0 +1,116 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+)
+
+// Stored file contents.
+//
+// An IndexWriter with StoreContent set records the text of each file
+// it indexes in the index's "content" section, compressed with zstd
+// (see read.go), so that programs such as csearchd can show the files
+// and the lines matching a search without reading the files themselves,
+// which may since have changed, moved, or been deleted.  The stored
+// text is the text that was indexed: files converted to UTF-8 for
+// indexing are stored converted.
+
+const contentSection = "content"
+
+// A contentWriter accumulates the content section, or another
+// section with the same layout, holding data for each file ID,
+// such as the region section (see region.go).
+type contentWriter struct {
+	name    string     // section name
+	offsets []uint32   // offset of each file's content in data
+	data    *bufWriter // compressed contents
+	mem     bool       // build the section in memory
+}
+
+func newContentWriter(mem bool) *contentWriter {
+	return &contentWriter{name: contentSection, data: newTempBuf(mem), mem: mem}
+}
+
+// add adds the compressed content of the next file ID,
+// which is empty if the content is not stored.
+func (w *contentWriter) add(frame []byte) {
+	w.offsets = append(w.offsets, w.data.offset())
+	w.data.write(frame)
+}
+
+// section returns the content section holding the stored contents.
+func (w *contentWriter) section() sectionData {
+	out := newTempBuf(w.mem)
+	base := uint32(4 + 4*(len(w.offsets)+1))
+	out.writeUint32(uint32(len(w.offsets)))
+	for _, off := range w.offsets {
+		out.writeUint32(base + off)
+	}
+	out.writeUint32(base + w.data.offset())
+	copyFile(out, w.data)
+	w.data.remove()
+	return sectionData{w.name, out}
+}
+
+// compressContent returns the compressed form of data for the content section.
+func compressContent(data []byte) []byte {
+	enc, _ := zstdCodec()
+	return enc.EncodeAll(data, nil)
+}
+
+// HasContent reports whether the index stores the contents of files.
+func (ix *Index) HasContent() bool {
+	_, ok := ix.sections[contentSection]
+	return ok
+}
+
+// contentFrame returns the compressed content stored for fileid,
+// or nil if there is none.
+func (ix *Index) contentFrame(fileid uint32) []byte {
+	return ix.fileEntry(contentSection, fileid)
+}
+
+// fileEntry returns the data for fileid in the named section,
+// which has the layout of the content section,
+// or nil if there is none.
+func (ix *Index) fileEntry(name string, fileid uint32) []byte {
+	d := ix.section(name)
+	if d == nil {
+		return nil
+	}
+	if len(d) < 4 || int(fileid) >= ix.numName || binary.BigEndian.Uint32(d) != uint32(ix.numName) {
+		corrupt()
+	}
+	off := 4 + 4*int(fileid)
+	if len(d) < off+8 {
+		corrupt()
+	}
+	lo := binary.BigEndian.Uint32(d[off:])
+	hi := binary.BigEndian.Uint32(d[off+4:])
+	if lo > hi || int(hi) > len(d) {
+		corrupt()
+	}
+	if lo == hi {
+		return nil
+	}
+	return d[lo:hi]
+}
+
+// Content returns the content of the file with the given fileid, as
+// stored in the index by an IndexWriter with StoreContent set.
+// It reports whether the index stores the content of that file.
+func (ix *Index) Content(fileid uint32) ([]byte, bool) {
+	frame := ix.contentFrame(fileid)
+	if frame == nil {
+		return nil, false
+	}
+	_, dec := zstdCodec()
+	data, err := dec.DecodeAll(frame, nil)
+	if err != nil {
+		corrupt()
+	}
+	return data, true
+}
@@ -0,0 +1,67 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var contentFiles = map[string]string{
+	"/src/a.go":    "package a\n\nfunc hello() {}\n",
+	"/src/b/empty": "",
+	"/src/b/x.txt": "hello, world\n",
+}
+
+func TestContent(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	w := Create(f1.Name())
+	w.StoreContent = true
+	w.AddPaths([]string{"/src"})
+	var names []string
+	for name := range contentFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.Add(name, strings.NewReader(contentFiles[name]))
+	}
+	w.Flush()
+	buildIndex(f2.Name(), mergePaths2, mergeFiles2)
+
+	ix := Open(f1.Name())
+	if !ix.HasContent() {
+		t.Fatalf("HasContent() = false, want true")
+	}
+	if Open(f2.Name()).HasContent() {
+		t.Errorf("HasContent() = true for index without stored content")
+	}
+
+	// Merging keeps the stored content, and files from an
+	// index without stored content have none.
+	Merge(f3.Name(), f1.Name(), f2.Name())
+	ix3 := Open(f3.Name())
+	for _, ix := range []*Index{ix, ix3} {
+		for name, want := range contentFiles {
+			id, _ := ix.Lookup(name)
+			if data, ok := ix.Content(id); !ok || string(data) != want {
+				t.Errorf("Content(%q) = %q, %v, want %q, true", name, data, ok, want)
+			}
+		}
+	}
+	id, _ := ix3.Lookup("/cc")
+	if data, ok := ix3.Content(id); ok {
+		t.Errorf("Content(/cc) = %q, true, want not stored", data)
+	}
+}
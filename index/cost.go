@@ -0,0 +1,105 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// Query cost estimation.
+//
+// Running a trigram query costs time reading posting lists, which pays
+// off only if the query leaves out enough files that need not then be
+// searched.  A regexp such as [a-z]+_[0-9]+ makes a query ORing many
+// trigrams, whose posting lists together name nearly every file, and
+// in a small index the lists of even a narrow query may name most of
+// the files.  The posting list index records the length of each list,
+// so the cost of a query can be estimated without reading any lists,
+// and a searcher can decide to search every file instead.
+
+// fileCost is the estimated cost of searching one file,
+// in units of the cost of reading one posting list entry.
+const fileCost = 1000
+
+// A QueryCost is an estimate of the cost of running a query
+// with PostingQuery, as returned by EstimateQuery.
+type QueryCost struct {
+	Files      int // files in the index
+	Candidates int // most files the query can select
+	Postings   int // posting list entries the query reads, at most
+}
+
+// ScanCheaper reports whether searching every file in the index is
+// likely to take less time than running the query and searching only
+// the candidates: whether reading the posting lists costs more than
+// searching the files that the query can at best leave out.
+func (c QueryCost) ScanCheaper() bool {
+	return int64(c.Files-c.Candidates)*fileCost <= int64(c.Postings)
+}
+
+// EstimateQuery estimates the cost of running q with PostingQuery,
+// from the lengths of the posting lists of its trigrams.
+func (ix *Index) EstimateQuery(q *Query) QueryCost {
+	c := QueryCost{Files: ix.numName}
+	c.Candidates = ix.estimate(q, &c.Postings)
+	return c
+}
+
+// estimate returns the most files that q can select,
+// adding to *postings the lengths of the posting lists it reads.
+func (ix *Index) estimate(q *Query, postings *int) int {
+	n := ix.numName
+	switch q.Op {
+	case QNone:
+		return 0
+	case QAll:
+		return n
+	case QAnd:
+		est := n
+		for _, t := range q.Trigram {
+			est = min(est, ix.estimateTrigram(t, q.Fold, postings))
+		}
+		for _, sub := range q.Sub {
+			est = min(est, ix.estimate(sub, postings))
+		}
+		return est
+	case QOr:
+		est := 0
+		for _, t := range q.Trigram {
+			est += ix.estimateTrigram(t, q.Fold, postings)
+		}
+		for _, sub := range q.Sub {
+			est += ix.estimate(sub, postings)
+		}
+		return min(est, n)
+	}
+	return n
+}
+
+// estimateTrigram returns the most files that can contain the trigram t,
+// in any case if fold is set, adding to *postings the lengths of the
+// posting lists read to find them.
+func (ix *Index) estimateTrigram(t string, fold bool, postings *int) int {
+	tris := trigramVariants(t, fold)
+	if ix.anyStop(tris) {
+		return ix.numName
+	}
+	est := 0
+	for _, tri := range tris {
+		count, _, _ := ix.findList(tri)
+		est += count
+		*postings += count
+	}
+	return min(est, ix.numName)
+}
+
+// EstimateQuery estimates the cost of running q with PostingQuery,
+// summing the estimates for the shards.
+func (s *ShardedIndex) EstimateQuery(q *Query) QueryCost {
+	var c QueryCost
+	for _, ix := range s.Shards {
+		c1 := ix.EstimateQuery(q)
+		c.Files += c1.Files
+		c.Candidates += c1.Candidates
+		c.Postings += c1.Postings
+	}
+	return c
+}
@@ -0,0 +1,47 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"regexp/syntax"
+	"testing"
+)
+
+var estimateTests = []struct {
+	re   string
+	cost QueryCost
+	scan bool
+}{
+	{`hello`, QueryCost{4, 2, 8}, false},
+	{`hello|world`, QueryCost{4, 4, 14}, true},
+	{`(?i)hello`, QueryCost{4, 3, 9}, false},
+	{`gopher`, QueryCost{4, 1, 5}, false},
+	{`nothing`, QueryCost{4, 0, 0}, false},
+	{`.`, QueryCost{4, 4, 0}, true},
+}
+
+func TestEstimateQuery(t *testing.T) {
+	ix := memIndex(map[string]string{
+		"/a/1": "hello world\n",
+		"/a/2": "hello there\n",
+		"/a/3": "Hello, gopher\n",
+		"/a/4": "goodbye, world\n",
+	}, false)
+	for _, tt := range estimateTests {
+		re, err := syntax.Parse(tt.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := ix.EstimateQuery(RegexpQuery(re))
+		if c != tt.cost || c.ScanCheaper() != tt.scan {
+			t.Errorf("EstimateQuery(%#q) = %+v, ScanCheaper %v, want %+v, %v", tt.re, c, c.ScanCheaper(), tt.cost, tt.scan)
+		}
+	}
+
+	// Posting lists long enough to outweigh the files left out.
+	if c := (QueryCost{Files: 10, Candidates: 9, Postings: 100 * fileCost}); !c.ScanCheaper() {
+		t.Errorf("%+v: ScanCheaper = false, want true", c)
+	}
+}
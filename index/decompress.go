@@ -0,0 +1,102 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Compressed files.
+//
+// Logs and build artifacts are often kept compressed, one file to a
+// compressed file, as foo.log.gz is.  The IndexWriter and OpenFile read
+// a file whose name ends in .gz, .bz2, or .xz through the matching
+// decompressor, so that the text indexed and searched is that of the
+// file inside.  They treat it as the file named without the suffix,
+// foo.log, as UncompressedName gives it: its language and its extractor
+// (see extract.go) are those of foo.log, and so are the file types it
+// matches.  The file keeps its own name in the index, and the metadata
+// recorded for it, such as its size and checksum, are those of the
+// compressed file.
+//
+// Gzip and bzip2 files are decompressed in process; xz files are
+// decompressed by the xz command, which must be installed.  Compressed
+// tar archives, such as .tar.gz and .tgz files, are not decompressed as
+// single files: they are archives (see archive.go).
+
+// A decompressor decompresses the files whose names end in ext.
+type decompressor struct {
+	ext string
+	e   Extractor
+}
+
+// decompressors lists the supported compressed file formats.
+var decompressors = []decompressor{
+	{".gz", ExtractorFunc(gunzip)},
+	{".bz2", ExtractorFunc(bunzip2)},
+	{".xz", CommandExtractor("xz -dc")},
+}
+
+// decompressorFor returns the decompressor for the named file,
+// or nil if it is not a compressed single file.
+func decompressorFor(name string) *decompressor {
+	lower := strings.ToLower(name)
+	for i := range decompressors {
+		d := &decompressors[i]
+		if !strings.HasSuffix(lower, d.ext) || len(filepath.Base(lower)) <= len(d.ext) {
+			continue
+		}
+		if base := lower[:len(lower)-len(d.ext)]; strings.HasSuffix(base, ".tar") || IsArchive(lower) {
+			return nil
+		}
+		return d
+	}
+	return nil
+}
+
+// UncompressedName returns the name of the file held by the compressed
+// file with the given name, which is the name without its compression
+// suffix, such as foo.log for foo.log.gz.  If name is not the name of
+// a compressed file, UncompressedName returns name.
+func UncompressedName(name string) string {
+	if d := decompressorFor(name); d != nil {
+		return name[:len(name)-len(d.ext)]
+	}
+	return name
+}
+
+// decompress returns a reader for the text of the named file, whose
+// contents r reads, decompressed if the file is compressed, along with
+// the name of the file it holds, as given by UncompressedName.
+func decompress(name string, r io.Reader) (io.Reader, string, error) {
+	d := decompressorFor(name)
+	if d == nil {
+		return r, name, nil
+	}
+	text, err := d.e.Extract(name, r)
+	if err != nil {
+		return nil, name, fmt.Errorf("decompressing %s file: %v", d.ext, err)
+	}
+	return text, name[:len(name)-len(d.ext)], nil
+}
+
+// gunzip is the decompressor for gzip files.
+func gunzip(name string, r io.Reader) (io.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+// bunzip2 is the decompressor for bzip2 files.
+func bunzip2(name string, r io.Reader) (io.Reader, error) {
+	return bzip2.NewReader(r), nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var uncompressedNameTests = []struct {
+	in, out string
+}{
+	{"foo.log.gz", "foo.log"},
+	{"/a/b/x.GO.GZ", "/a/b/x.GO"},
+	{"x.c.bz2", "x.c"},
+	{"x.txt.xz", "x.txt"},
+	{"a.zip!/doc/x.md.gz", "a.zip!/doc/x.md"},
+	{"x.gz", "x"},
+	{".gz", ".gz"},
+	{"/a/.xz", "/a/.xz"},
+	{"x.tar.gz", "x.tar.gz"},
+	{"x.tgz", "x.tgz"},
+	{"x.tar.bz2", "x.tar.bz2"},
+	{"x.tar.xz", "x.tar.xz"},
+	{"x.go", "x.go"},
+}
+
+func TestUncompressedName(t *testing.T) {
+	for _, tt := range uncompressedNameTests {
+		if out := UncompressedName(tt.in); out != tt.out {
+			t.Errorf("UncompressedName(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("---\ntitle: secret\n---\nfunc Hello() {}\n"))
+	zw.Close()
+	write("hello.md.gz", gz.Bytes())
+	gz.Reset()
+	zw = gzip.NewWriter(&gz)
+	zw.Write([]byte("package x\nfunc Hello() {}\n"))
+	zw.Close()
+	write("x.go.gz", gz.Bytes())
+	write("bad.log.gz", []byte("func Hello() {}\n"))
+	want := []string{"hello.md.gz", "x.go.gz"}
+
+	// The other formats are decompressed by, or written with, commands.
+	for _, c := range []struct{ cmd, ext string }{{"bzip2", ".bz2"}, {"xz", ".xz"}} {
+		if _, err := exec.LookPath(c.cmd); err != nil {
+			t.Logf("no %s command", c.cmd)
+			continue
+		}
+		cmd := exec.Command(c.cmd, "-c")
+		cmd.Stdin = bytes.NewReader([]byte("func Hello() {}\n"))
+		data, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		write("y.txt"+c.ext, data)
+		want = append(want, "y.txt"+c.ext)
+	}
+
+	ix := NewMemWriter()
+	ix.AddPaths([]string{dir})
+	ix.AddTree(dir)
+	ix.Flush()
+	r := OpenBytes(ix.Bytes())
+	for _, tt := range []struct {
+		re   string
+		want []string
+	}{
+		{`func Hello`, want},
+		{`secret`, nil},
+	} {
+		var got []string
+		for _, fileid := range queryFiles(t, r, tt.re) {
+			got = append(got, filepath.Base(r.Name(fileid)))
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("%#q: found %q, want %q", tt.re, got, tt.want)
+		}
+	}
+
+	// The files are read back decompressed, and each is of the
+	// language and file types of the file it holds.
+	name := filepath.Join(dir, "x.go.gz")
+	data, err := ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "package x\nfunc Hello() {}\n" {
+		t.Errorf("ReadFile(x.go.gz) = %q", data)
+	}
+	id, _ := r.Lookup(name)
+	if m := r.Meta(id); m.Lang != "go" {
+		t.Errorf("Meta(x.go.gz).Lang = %q, want go", m.Lang)
+	}
+	if !DefaultFileTypes().Match(name, []string{"go"}) {
+		t.Errorf("x.go.gz does not match -type go")
+	}
+	if _, err := ReadFile(filepath.Join(dir, "bad.log.gz")); err == nil {
+		t.Errorf("ReadFile(bad.log.gz) succeeded on a file that is not gzip")
+	}
+}
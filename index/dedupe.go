@@ -0,0 +1,199 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc64"
+	"slices"
+	"sort"
+)
+
+// Deduplication.
+//
+// Vendored copies of packages and hard links fill many trees with
+// files whose text is the same, each adding the same entries to the
+// posting lists.  If IndexWriter.Dedupe is set, a file whose text, and
+// so whose trigrams, are the same as those of a file added earlier in
+// the same build gets no posting entries of its own.  The writer
+// records it instead as an alias of the earlier file, its canonical
+// file, in the "alias" section, and PostingQuery and PostingQueryNames
+// report the aliases of the files they find along with them.  Aliases
+// keep their own names and metadata, symbols, identifiers, and stored
+// contents.  See read.go for the format.
+//
+// Merging keeps the aliases of each index.  If a merge drops the
+// canonical file of some aliases that it keeps, the first of them
+// takes its place in the posting lists and the others become its
+// aliases.  Identical files from different indexes keep their own
+// posting entries.
+
+const aliasSection = "alias"
+
+// A dupeKey identifies the text of a file for deduplication:
+// its length, its checksum, and a checksum of its trigrams.
+// Requiring the trigrams to match too means that two files with
+// different text and the same checksum cannot share posting entries.
+type dupeKey struct {
+	size int64
+	hash uint64
+	tris uint64
+}
+
+// dupe returns the ID of the file added earlier that the scanned file
+// r, given the ID fileid, duplicates, or records r as the first file
+// with its text and returns ok == false.
+func (ix *IndexWriter) dupe(r *scanResult, fileid uint32) (canon uint32, ok bool) {
+	if len(r.trigram) == 0 {
+		// There are no posting entries to share.
+		return 0, false
+	}
+	var b [3]byte
+	tris := crc64.New(crcTable)
+	for _, t := range r.trigram {
+		b[0], b[1], b[2] = byte(t>>16), byte(t>>8), byte(t)
+		tris.Write(b[:])
+	}
+	key := dupeKey{r.meta.Size, r.meta.Hash, tris.Sum64()}
+	if canon, ok := ix.dupes[key]; ok {
+		return canon, true
+	}
+	if ix.dupes == nil {
+		ix.dupes = make(map[dupeKey]uint32)
+	}
+	ix.dupes[key] = fileid
+	return 0, false
+}
+
+// aliasSectionData returns the alias section listing the pairs of
+// alias and canonical file IDs in aliases, in order of alias.
+func aliasSectionData(aliases [][2]uint32) sectionData {
+	w := bufCreateMem()
+	for _, a := range aliases {
+		w.writeUint32(a[0])
+		w.writeUint32(a[1])
+	}
+	return sectionData{aliasSection, w}
+}
+
+// Deduped reports whether the index was written with
+// IndexWriter.Dedupe set, whether or not it found any duplicates.
+func (ix *Index) Deduped() bool {
+	return ix.section(aliasSection) != nil
+}
+
+// NumAliases returns the number of files in the index that
+// share the posting entries of another file.
+func (ix *Index) NumAliases() int {
+	return len(ix.section(aliasSection)) / 8
+}
+
+// Canonical returns the ID of the file whose posting entries the file
+// with the given fileid shares, or fileid if it is not an alias.
+func (ix *Index) Canonical(fileid uint32) uint32 {
+	d := ix.section(aliasSection)
+	n := len(d) / 8
+	i := sort.Search(n, func(i int) bool { return binary.BigEndian.Uint32(d[8*i:]) >= fileid })
+	if i < n && binary.BigEndian.Uint32(d[8*i:]) == fileid {
+		return binary.BigEndian.Uint32(d[8*i+4:])
+	}
+	return fileid
+}
+
+// Aliases returns the IDs of the aliases of the file
+// with the given fileid, in increasing order.
+func (ix *Index) Aliases(fileid uint32) []uint32 {
+	return ix.aliasMap()[fileid]
+}
+
+// aliasMap returns the aliases of each canonical file,
+// reading them from the alias section the first time.
+func (ix *Index) aliasMap() map[uint32][]uint32 {
+	ix.aliasOnce.Do(func() {
+		d := ix.section(aliasSection)
+		if len(d) < 8 {
+			return
+		}
+		ix.aliases = make(map[uint32][]uint32)
+		for ; len(d) >= 8; d = d[8:] {
+			alias, canon := binary.BigEndian.Uint32(d), binary.BigEndian.Uint32(d[4:])
+			ix.aliases[canon] = append(ix.aliases[canon], alias)
+		}
+	})
+	return ix.aliases
+}
+
+// aliasQuery is like postingQuery, but it also returns the aliases
+// of the files found.  A restricted query consults the posting entries
+// of the canonical files of the files in restrict, even if they are
+// not in restrict themselves.
+func (ix *Index) aliasQuery(ctx context.Context, q *Query, restrict []uint32) []uint32 {
+	m := ix.aliasMap()
+	if len(m) == 0 {
+		return ix.postingQuery(ctx, q, restrict)
+	}
+	var canon []uint32
+	for _, fileid := range restrict {
+		if c := ix.Canonical(fileid); c != fileid {
+			canon = append(canon, c)
+		}
+	}
+	all := restrict
+	if len(canon) > 0 {
+		slices.Sort(canon)
+		all = mergeOr(restrict, slices.Compact(canon))
+	}
+	list := ix.postingQuery(ctx, q, all)
+	var extra []uint32
+	for _, fileid := range list {
+		extra = append(extra, m[fileid]...)
+	}
+	if len(extra) > 0 {
+		slices.Sort(extra)
+		list = mergeOr(list, extra)
+	}
+	if restrict != nil {
+		list = intersect(list, restrict)
+	}
+	return list
+}
+
+// mapID returns the ID to which the docid map m maps old,
+// or ok == false if m drops it.
+func mapID(m []idrange, old uint32) (new uint32, ok bool) {
+	i := sort.Search(len(m), func(i int) bool { return m[i].hi > old })
+	if i < len(m) && m[i].lo <= old {
+		return m[i].new + old - m[i].lo, true
+	}
+	return 0, false
+}
+
+// mergeAliases adds to aliases the aliases of ix that the docid map m
+// keeps, translated to the new IDs.  It returns the updated list and
+// a map from each canonical file that m drops but that has an alias
+// m keeps to the new ID of the first such alias, which takes its place.
+func mergeAliases(aliases [][2]uint32, ix *Index, m []idrange) ([][2]uint32, map[uint32]uint32) {
+	var promote map[uint32]uint32
+	for d := ix.section(aliasSection); len(d) >= 8; d = d[8:] {
+		alias, ok := mapID(m, binary.BigEndian.Uint32(d))
+		if !ok {
+			continue
+		}
+		old := binary.BigEndian.Uint32(d[4:])
+		canon, ok := mapID(m, old)
+		if !ok {
+			if canon, ok = promote[old]; !ok {
+				if promote == nil {
+					promote = make(map[uint32]uint32)
+				}
+				promote[old] = alias
+				continue
+			}
+		}
+		aliases = append(aliases, [2]uint32{alias, canon})
+	}
+	return aliases, promote
+}
@@ -0,0 +1,168 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"path/filepath"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+var dedupeFiles = map[string]string{
+	"/src/a/x.go":        "package x\nfunc Hello() {}\n",
+	"/src/b/vendor/x.go": "package x\nfunc Hello() {}\n",
+	"/src/c/x.go":        "package x\nfunc Hello() {}\n",
+	"/src/d/y.go":        "package y\nfunc World() {}\n",
+	"/src/e/y.go":        "package y\nfunc World() {}\n",
+	"/src/f/z.go":        "package z\nfunc Hello2() {}\n",
+}
+
+var dedupeQueries = []string{
+	`func Hello`,
+	`func Hello\(`,
+	`package (x|y)`,
+	`World|Hello2`,
+	`package`,
+	`xyzzy`,
+}
+
+// dedupe returns a function that configures an IndexWriter to index
+// file name trigrams and to share the postings of identical files
+// if on is set.
+func dedupe(on bool) func(ix *IndexWriter) {
+	return func(ix *IndexWriter) {
+		ix.Dedupe = on
+		ix.NameTrigrams = true
+	}
+}
+
+// queryNames returns the names of the files in ix that might match re,
+// among those whose names match nameRE, if it is not empty.
+func queryNames(t *testing.T, ix *Index, re, nameRE string) []string {
+	parse := func(re string) *Query {
+		r, err := syntax.Parse(re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return RegexpQuery(r)
+	}
+	var names *Query
+	if nameRE != "" {
+		names = parse(nameRE)
+	}
+	var list []string
+	for _, fileid := range ix.PostingQueryNames(parse(re), names) {
+		if nameRE == "" || strings.Contains(ix.Name(fileid), nameRE) {
+			list = append(list, ix.Name(fileid))
+		}
+	}
+	return list
+}
+
+// checkDedupe checks that ix, which has the given number of aliases,
+// finds the same files as the index ref, written without Dedupe.
+func checkDedupe(t *testing.T, file string, ix, ref *Index, aliases int) {
+	t.Helper()
+	if err := Verify(file); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if !ix.Deduped() || ix.NumAliases() != aliases {
+		t.Errorf("Deduped() = %v, NumAliases() = %d, want true, %d", ix.Deduped(), ix.NumAliases(), aliases)
+	}
+	for _, re := range dedupeQueries {
+		for _, nameRE := range []string{"", "vendor", "/c/"} {
+			got, want := queryNames(t, ix, re, nameRE), queryNames(t, ref, re, nameRE)
+			if !equalStrings(got, want) {
+				t.Errorf("%#q in files matching %#q: found %q, want %q", re, nameRE, got, want)
+			}
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	dir := t.TempDir()
+	out, plain := filepath.Join(dir, "index"), filepath.Join(dir, "plain")
+	buildIndexWith(out, []string{"/src"}, dedupeFiles, dedupe(true))
+	buildIndexWith(plain, []string{"/src"}, dedupeFiles, dedupe(false))
+	ix, ref := Open(out), Open(plain)
+	defer ix.Close()
+	defer ref.Close()
+	if ref.Deduped() || ref.NumAliases() != 0 {
+		t.Errorf("index without Dedupe: Deduped() = %v, NumAliases() = %d", ref.Deduped(), ref.NumAliases())
+	}
+	checkDedupe(t, out, ix, ref, 3)
+
+	a, _ := ix.Lookup("/src/a/x.go")
+	b, _ := ix.Lookup("/src/b/vendor/x.go")
+	c, _ := ix.Lookup("/src/c/x.go")
+	d, _ := ix.Lookup("/src/d/y.go")
+	e, _ := ix.Lookup("/src/e/y.go")
+	f, _ := ix.Lookup("/src/f/z.go")
+	for _, tt := range []struct{ fileid, canon uint32 }{{a, a}, {b, a}, {c, a}, {d, d}, {e, d}, {f, f}} {
+		if got := ix.Canonical(tt.fileid); got != tt.canon {
+			t.Errorf("Canonical(%s) = %s, want %s", ix.Name(tt.fileid), ix.Name(got), ix.Name(tt.canon))
+		}
+	}
+	if got := ix.Aliases(a); !equalList(got, []uint32{b, c}) {
+		t.Errorf("Aliases(%s) = %v, want %v", ix.Name(a), got, []uint32{b, c})
+	}
+	if st, st0 := ix.Stats(0), ref.Stats(0); st.Aliases != 3 || st.Postings >= st0.Postings {
+		t.Errorf("Stats: %d aliases, %d postings; want 3, fewer than %d", st.Aliases, st.Postings, st0.Postings)
+	}
+}
+
+func TestDedupeMerge(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "index")
+	buildIndexWith(src, []string{"/src"}, dedupeFiles, dedupe(true))
+	changed := map[string]string{
+		"/src/a/x.go": "package x\nfunc Goodbye() {}\n",
+		"/src/d/y.go": "package y\nfunc World() {}\n",
+	}
+	update := filepath.Join(dir, "update")
+	buildIndexWith(update, []string{"/src"}, changed, dedupe(false))
+	files := make(map[string]string)
+	for name, data := range dedupeFiles {
+		files[name] = data
+	}
+	for name, data := range changed {
+		files[name] = data
+	}
+
+	// Replacing /src/a/x.go drops the canonical file of its copies, the
+	// first of which takes its place.  Replacing /src/d/y.go with the
+	// same text from an index without aliases leaves /src/e/y.go with
+	// its canonical file dropped and no copy to share entries with.
+	out := filepath.Join(dir, "out")
+	Update(out, src, update, func(string) bool { return false })
+	plain := filepath.Join(dir, "plain")
+	buildIndexWith(plain, []string{"/src"}, files, dedupe(false))
+	ix, ref := Open(out), Open(plain)
+	defer ix.Close()
+	defer ref.Close()
+	checkDedupe(t, out, ix, ref, 1)
+	b, _ := ix.Lookup("/src/b/vendor/x.go")
+	c, _ := ix.Lookup("/src/c/x.go")
+	if got := ix.Canonical(c); got != b {
+		t.Errorf("Canonical(%s) = %s, want %s", ix.Name(c), ix.Name(got), ix.Name(b))
+	}
+
+	// Removing the files of a tree keeps the aliases outside it.
+	out2 := filepath.Join(dir, "out2")
+	Remove(out2, src, []string{"/src/c"})
+	delete(files, "/src/c/x.go")
+	for name, data := range dedupeFiles {
+		if name != "/src/c/x.go" {
+			files[name] = data
+		}
+	}
+	plain2 := filepath.Join(dir, "plain2")
+	buildIndexWith(plain2, []string{"/src"}, files, dedupe(false))
+	ix2, ref2 := Open(out2), Open(plain2)
+	defer ix2.Close()
+	defer ref2.Close()
+	checkDedupe(t, out2, ix2, ref2, 2)
+}
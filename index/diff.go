@@ -0,0 +1,86 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "bytes"
+
+// A DiffOp says how a file differs between two indexes.
+type DiffOp byte
+
+const (
+	DiffAdded   DiffOp = 'A' // only in the new index
+	DiffRemoved DiffOp = 'D' // only in the old index
+	DiffChanged DiffOp = 'M' // in both, with different content
+)
+
+func (op DiffOp) String() string {
+	return string(rune(op))
+}
+
+// A FileDiff describes a file that differs between two indexes.
+type FileDiff struct {
+	Op   DiffOp
+	Name string
+}
+
+// Diff compares the files indexed by old and new, as cindex -diff does,
+// returning the differences in order by file name.  A file in both
+// indexes has changed if the content hashes recorded for it differ,
+// or, if either index records no metadata, if the content stored for
+// it differs.  Unchecked counts the files in both whose content could
+// not be compared either way.
+func Diff(old, new *Index) (diffs []FileDiff, unchecked int) {
+	byMeta := old.HasMeta() && new.HasMeta()
+	byContent := old.HasContent() && new.HasContent()
+	i, j := 0, 0
+	for i < old.numName || j < new.numName {
+		var cmp int
+		switch {
+		case i == old.numName:
+			cmp = 1
+		case j == new.numName:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(old.NameBytes(uint32(i)), new.NameBytes(uint32(j)))
+		}
+		switch {
+		case cmp < 0:
+			diffs = append(diffs, FileDiff{DiffRemoved, old.Name(uint32(i))})
+			i++
+		case cmp > 0:
+			diffs = append(diffs, FileDiff{DiffAdded, new.Name(uint32(j))})
+			j++
+		default:
+			same, ok := sameContent(old, uint32(i), new, uint32(j), byMeta, byContent)
+			if !ok {
+				unchecked++
+			} else if !same {
+				diffs = append(diffs, FileDiff{DiffChanged, new.Name(uint32(j))})
+			}
+			i++
+			j++
+		}
+	}
+	return diffs, unchecked
+}
+
+// sameContent reports whether file id1 in ix1 and file id2 in ix2 have
+// the same content, comparing their recorded hashes if byMeta is set
+// or else their stored content if byContent is set.  The boolean ok
+// reports whether the content could be compared.
+func sameContent(ix1 *Index, id1 uint32, ix2 *Index, id2 uint32, byMeta, byContent bool) (same, ok bool) {
+	if byMeta {
+		m1, m2 := ix1.Meta(id1), ix2.Meta(id2)
+		return m1.Size == m2.Size && m1.Hash == m2.Hash, true
+	}
+	if byContent {
+		c1, ok1 := ix1.Content(id1)
+		c2, ok2 := ix2.Content(id2)
+		if ok1 && ok2 {
+			return bytes.Equal(c1, c2), true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,53 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+// memIndex returns an in-memory index of files,
+// storing their content if store is set.
+func memIndex(files map[string]string, store bool) *Index {
+	ix := NewMemWriter()
+	ix.StoreContent = store
+	addFiles(ix, files)
+	ix.Flush()
+	return OpenBytes(ix.Bytes())
+}
+
+func TestDiff(t *testing.T) {
+	old := map[string]string{
+		"/a/gone.go":   "package gone\n",
+		"/a/same.go":   "package same\n",
+		"/a/edited.go": "package edited\n",
+		"/b/same.go":   "package same\n",
+	}
+	new := map[string]string{
+		"/a/same.go":   "package same\n",
+		"/a/edited.go": "package edited // now\n",
+		"/a/new.go":    "package new\n",
+		"/b/same.go":   "package same\n",
+		"/c/new.go":    "package new\n",
+	}
+	want := []FileDiff{
+		{DiffChanged, "/a/edited.go"},
+		{DiffRemoved, "/a/gone.go"},
+		{DiffAdded, "/a/new.go"},
+		{DiffAdded, "/c/new.go"},
+	}
+	for _, store := range []bool{false, true} {
+		diffs, unchecked := Diff(memIndex(old, store), memIndex(new, store))
+		if !reflect.DeepEqual(diffs, want) || unchecked != 0 {
+			t.Errorf("store=%v: Diff = %v, %d, want %v, 0", store, diffs, unchecked, want)
+		}
+	}
+
+	diffs, unchecked := Diff(memIndex(old, false), memIndex(old, false))
+	if len(diffs) != 0 || unchecked != 0 {
+		t.Errorf("Diff(old, old) = %v, %d, want none", diffs, unchecked)
+	}
+}
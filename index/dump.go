@@ -0,0 +1,120 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"iter"
+	"strings"
+)
+
+// Introspection.
+//
+// Besides the summary that Stats gives, an index can list its posting
+// lists and name index entries one by one, as cindex -dump prints them,
+// so that the layout of an index can be examined without decoding it
+// by hand.  PartDoc describes each part of the format in a line, as
+// documented in full in read.go.
+
+// A PostingInfo describes the posting list of one trigram.
+type PostingInfo struct {
+	Trigram string // the three bytes of the trigram
+	Files   int    // number of files in the list
+	Offset  int64  // offset of the list in the index file
+	Size    int64  // length of the list, including its trigram, in bytes
+	Roaring bool   // the list is a roaring bitmap
+}
+
+// Postings returns an iterator over the posting lists in the index,
+// in order by trigram.  The lists of stop trigrams, which the index
+// omits, are not included.
+func (ix *Index) Postings() iter.Seq[PostingInfo] {
+	return func(yield func(PostingInfo) bool) {
+		end := ix.nameIndex - ix.postData
+		for i := 0; i < ix.numPost; i++ {
+			tri, count, off := ix.listAt(uint32(i * postEntrySize))
+			if tri == 1<<24-1 && count == 0 {
+				// End marker.
+				continue
+			}
+			next := end
+			if i+1 < ix.numPost {
+				_, _, next = ix.listAt(uint32((i + 1) * postEntrySize))
+			}
+			d := ix.slice(ix.postData+off, int(next-off))
+			p := PostingInfo{
+				Trigram: string(d[:3]),
+				Files:   int(count),
+				Offset:  int64(ix.postData + off),
+				Size:    int64(next - off),
+				Roaring: len(d) > 3 && d[3] == 0,
+			}
+			if !yield(p) {
+				return
+			}
+		}
+	}
+}
+
+// A NameEntry is an entry of the name index.
+type NameEntry struct {
+	FileID uint32
+	Name   string
+
+	// Offset is the offset in the index file of the name or,
+	// in a version 4 index, of the compressed block holding it.
+	Offset int64
+}
+
+// NameEntries returns an iterator over the entries of the name index,
+// in order by file ID.
+func (ix *Index) NameEntries() iter.Seq[NameEntry] {
+	return func(yield func(NameEntry) bool) {
+		for i := 0; i < ix.numName; i++ {
+			off := ix.uint32(ix.nameIndex + 4*uint32(i))
+			if !yield(NameEntry{uint32(i), ix.Name(uint32(i)), int64(ix.nameData + off)}) {
+				return
+			}
+		}
+	}
+}
+
+// partDocs describes the parts of an index file, by the names that
+// Stats gives them in IndexPart.Name, with sections named alone.
+var partDocs = map[string]string{
+	"header":             "magic string naming the version of the format",
+	"path list":          "sorted NUL-terminated roots of the indexed trees",
+	"name list":          "sorted NUL-terminated names of the indexed files, or zstd blocks of them (version 4)",
+	"posting lists":      "for each trigram, the IDs of the files containing it, as deltas or a roaring bitmap",
+	"name index":         "offset of each file's name, or of its block of names, in the name list",
+	"posting list index": "trigram, file count, and offset of each posting list, sorted by trigram",
+	"section index":      "name, offset, and length of each section",
+	"trailer":            "offsets of the lists and indexes, and the trailer magic string",
+
+	metaSection:        "size, modification time, checksum, language, and repository of each file",
+	langSection:        "names of the languages of the files",
+	repoSection:        "names of the repositories of the files",
+	symSection:         "files and lines defining each symbol",
+	identSection:       "files using each identifier word in code",
+	excludeSection:     "exclusion patterns recorded by the writer",
+	stopSection:        "stop trigrams, whose posting lists are omitted, and their file fraction",
+	nameTrigramSection: "posting lists of the trigrams of the file names",
+	gitRefSection:      "git revision whose files the index holds",
+	attachSection:      "other indexes to search along with this one",
+	normSection:        "Unicode normalization form of the indexed text",
+	crcSection:         "CRC-32 checksums of the other parts",
+	contentSection:     "zstd-compressed text of each file",
+	regionSection:      "comments and string literals in each file",
+	aliasSection:       "files sharing the posting entries of identical files",
+}
+
+// PartDoc returns a one-line description of the part of an index file
+// with the given name, as given by IndexPart.Name, or the empty string
+// if the part is unknown.
+func PartDoc(name string) string {
+	if s, ok := strings.CutPrefix(name, `section "`); ok {
+		name = strings.TrimSuffix(s, `"`)
+	}
+	return partDocs[name]
+}
@@ -0,0 +1,75 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "bytes"
+
+// Exclusion patterns.
+//
+// An index can record the patterns that the program that built it
+// used to exclude files, so that the next run of the program can
+// exclude the same files without being told again.  The patterns are
+// stored in the optional "exclude" section, a sequence of
+// NUL-terminated strings.  The index package does not interpret them.
+
+const excludeSection = "exclude"
+
+// excludeSectionData returns the exclude section listing pats,
+// which are few enough to hold in memory.
+func excludeSectionData(pats []string) sectionData {
+	w := bufCreateMem()
+	for _, p := range pats {
+		w.writeString(p)
+		w.writeString("\x00")
+	}
+	return sectionData{excludeSection, w}
+}
+
+// Excludes returns the exclusion patterns recorded in the index,
+// as set by IndexWriter.Excludes.
+func (ix *Index) Excludes() []string {
+	var x []string
+	d := ix.section(excludeSection)
+	for len(d) > 0 {
+		i := bytes.IndexByte(d, 0)
+		if i < 0 {
+			corrupt()
+		}
+		x = append(x, string(d[:i]))
+		d = d[i+1:]
+	}
+	return x
+}
+
+// hasExcludes reports whether the index records exclusion patterns,
+// even an empty list of them.
+func (ix *Index) hasExcludes() bool {
+	_, ok := ix.sections[excludeSection]
+	return ok
+}
+
+// mergeExcludes returns the exclude section for the merge of ix1
+// and the newer ix2, if either records exclusion patterns.
+// The patterns of the newer index replace those of the older one,
+// so that patterns removed since ix1 was written stay removed.
+func mergeExcludes(ix1, ix2 *Index) []sectionData {
+	switch {
+	case ix2.hasExcludes():
+		return []sectionData{excludeSectionData(ix2.Excludes())}
+	case ix1.hasExcludes():
+		return []sectionData{excludeSectionData(ix1.Excludes())}
+	}
+	return nil
+}
+
+// Excludes returns the exclusion patterns recorded in the newest shard.
+func (s *ShardedIndex) Excludes() []string {
+	for i := len(s.Shards) - 1; i >= 0; i-- {
+		if s.Shards[i].hasExcludes() {
+			return s.Shards[i].Excludes()
+		}
+	}
+	return nil
+}
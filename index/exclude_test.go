@@ -0,0 +1,64 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// buildExcludeIndex builds a temporary index of paths, holding only
+// the file name, which records the given exclude patterns.
+// It returns the name of the index file.
+func buildExcludeIndex(t *testing.T, paths, excludes []string, name string) string {
+	f, err := ioutil.TempFile("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	buildIndexWith(f.Name(), paths, map[string]string{name: "hello world\n"}, excluding(excludes))
+	return f.Name()
+}
+
+// excluding returns a function that configures an IndexWriter
+// to record the given exclude patterns.
+func excluding(excludes []string) func(ix *IndexWriter) {
+	return func(ix *IndexWriter) { ix.Excludes = excludes }
+}
+
+func TestExcludes(t *testing.T) {
+	none := buildExcludeIndex(t, []string{"/a"}, nil, "/a/x")
+	defer os.Remove(none)
+	empty := buildExcludeIndex(t, []string{"/b"}, []string{}, "/b/x")
+	defer os.Remove(empty)
+	two := buildExcludeIndex(t, []string{"/c"}, []string{"/testdata$", "/vendor"}, "/c/x")
+	defer os.Remove(two)
+
+	if x := Open(none).Excludes(); x != nil {
+		t.Errorf("Excludes() = %q, want none", x)
+	}
+	if x := Open(two).Excludes(); !equalStrings(x, []string{"/testdata$", "/vendor"}) {
+		t.Errorf("Excludes() = %q, want [/testdata$ /vendor]", x)
+	}
+
+	// Merging keeps the patterns of the newer index,
+	// even if it lists none.
+	out := none + ".merge"
+	defer os.Remove(out)
+	for _, tt := range []struct {
+		src1, src2 string
+		want       []string
+	}{
+		{none, two, []string{"/testdata$", "/vendor"}},
+		{two, none, []string{"/testdata$", "/vendor"}},
+		{two, empty, nil},
+	} {
+		Merge(out, tt.src1, tt.src2)
+		if x := Open(out).Excludes(); !equalStrings(x, tt.want) {
+			t.Errorf("Merge: Excludes() = %q, want %q", x, tt.want)
+		}
+	}
+}
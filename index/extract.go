@@ -0,0 +1,188 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Text extraction.
+//
+// Documentation is often kept in files whose text is not what a search
+// should see: Markdown files open with front matter of metadata, and
+// PDF files hold their text compressed.  An Extractor turns the contents
+// of such a file into the plain text to index and search.  Extractors
+// are registered by file name pattern with RegisterExtractor, and both
+// the IndexWriter and OpenFile read a file with a registered pattern
+// through its extractor, so that the lines a search prints are lines
+// of the extracted text.  The metadata recorded for the file, such as
+// its size and checksum, are those of the file itself.
+//
+// Markdown front matter is blanked out line for line, so that the line
+// numbers of the rest of the file are unchanged.  The text of other
+// documents comes from external converters, listed in $CSEARCHEXTRACT
+// as pattern=command entries separated by semicolons, such as
+//
+//	CSEARCHEXTRACT='*.pdf=pdftotext -layout - -;*.docx=pandoc -f docx -t plain'
+//
+// Each command, a program name followed by its arguments, separated by
+// spaces, is run with the file on its standard input and must write the
+// text to its standard output.  The line numbers of
+// its output are as good as the converter's line breaks.  Cindex and
+// csearch must see the same $CSEARCHEXTRACT.
+
+// An Extractor extracts the plain text of a file.
+type Extractor interface {
+	// Extract returns a reader for the plain text of the file
+	// with the given name, whose contents r reads.
+	Extract(name string, r io.Reader) (io.Reader, error)
+}
+
+// An ExtractorFunc is a function used as an Extractor.
+type ExtractorFunc func(name string, r io.Reader) (io.Reader, error)
+
+func (f ExtractorFunc) Extract(name string, r io.Reader) (io.Reader, error) {
+	return f(name, r)
+}
+
+// An extractorEntry is a registered Extractor.
+type extractorEntry struct {
+	pattern string
+	e       Extractor
+}
+
+// extractors holds the registered Extractors,
+// starting with the built-in ones for Markdown.
+var extractors = struct {
+	mu      sync.Mutex
+	list    []extractorEntry
+	envOnce sync.Once
+}{
+	list: []extractorEntry{
+		{"*.md", ExtractorFunc(stripFrontMatter)},
+		{"*.markdown", ExtractorFunc(stripFrontMatter)},
+		{"*.mdx", ExtractorFunc(stripFrontMatter)},
+	},
+}
+
+// RegisterExtractor arranges for files whose base names match the glob
+// pattern, in the syntax of filepath.Match, to be read through e.
+// A later registration takes precedence over an earlier one, and
+// a nil e leaves files matching pattern as they are.
+func RegisterExtractor(pattern string, e Extractor) {
+	extractors.mu.Lock()
+	defer extractors.mu.Unlock()
+	extractors.list = append(extractors.list, extractorEntry{pattern, e})
+}
+
+// extractorFor returns the Extractor for the file with
+// the given name, or nil if it has none.
+func extractorFor(name string) Extractor {
+	extractors.envOnce.Do(registerEnvExtractors)
+	extractors.mu.Lock()
+	defer extractors.mu.Unlock()
+	base := filepath.Base(name)
+	if _, member, ok := SplitArchiveName(name); ok {
+		base = filepath.Base(member)
+	}
+	for i := len(extractors.list) - 1; i >= 0; i-- {
+		if ok, _ := filepath.Match(extractors.list[i].pattern, base); ok {
+			return extractors.list[i].e
+		}
+	}
+	return nil
+}
+
+// extract returns a reader for the text of the file with the given
+// name, whose contents r reads, decompressed if it is a compressed file
+// (see decompress.go) and extracted by its Extractor, if any.
+func extract(name string, r io.Reader) (io.Reader, error) {
+	r, name, err := decompress(name, r)
+	if err != nil {
+		return nil, err
+	}
+	if e := extractorFor(name); e != nil {
+		return e.Extract(name, r)
+	}
+	return r, nil
+}
+
+// registerEnvExtractors registers the converters listed in $CSEARCHEXTRACT.
+func registerEnvExtractors() {
+	for _, entry := range strings.Split(os.Getenv("CSEARCHEXTRACT"), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		pattern, command, ok := strings.Cut(entry, "=")
+		pattern, command = strings.TrimSpace(pattern), strings.TrimSpace(command)
+		if _, err := filepath.Match(pattern, ""); !ok || err != nil || pattern == "" || len(strings.Fields(command)) == 0 {
+			slog.Warn("invalid $CSEARCHEXTRACT entry; want pattern=command", "entry", entry)
+			continue
+		}
+		RegisterExtractor(pattern, CommandExtractor(command))
+	}
+}
+
+// CommandExtractor returns an Extractor that runs command, a program
+// name followed by its arguments, separated by spaces, passing it the
+// contents of a file on its standard input and taking its standard
+// output as the text of the file.
+func CommandExtractor(command string) Extractor {
+	args := strings.Fields(command)
+	return ExtractorFunc(func(name string, r io.Reader) (io.Reader, error) {
+		// Read the whole file first, so that it is all counted
+		// in its size and checksum even if the command stops early.
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		var stderr bytes.Buffer
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("extracting text with %q: %v: %s", command, err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return bytes.NewReader(out), nil
+	})
+}
+
+// stripFrontMatter is the Extractor for Markdown files.  It replaces
+// the YAML (---) or TOML (+++) front matter at the start of a file,
+// if any, with as many empty lines.
+func stripFrontMatter(name string, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	first, err := br.ReadBytes('\n')
+	delim := string(bytes.TrimRight(first, "\r\n"))
+	if err != nil || delim != "---" && delim != "+++" {
+		return io.MultiReader(bytes.NewReader(first), br), nil
+	}
+	held := first
+	lines := 1
+	for {
+		line, err := br.ReadBytes('\n')
+		held = append(held, line...)
+		if len(line) > 0 {
+			lines++
+		}
+		if end := string(bytes.TrimRight(line, "\r\n")); end == delim || delim == "---" && end == "..." {
+			return io.MultiReader(bytes.NewReader(bytes.Repeat([]byte("\n"), lines)), br), nil
+		}
+		if err != nil {
+			// No end to the front matter: leave the file as it is.
+			return bytes.NewReader(held), nil
+		}
+	}
+}
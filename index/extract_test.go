@@ -0,0 +1,113 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var frontMatterTests = []struct {
+	in, out string
+}{
+	{"# Title\ntext\n", "# Title\ntext\n"},
+	{"---\ntitle: x\ntags: [a]\n---\n# Title\n", "\n\n\n\n# Title\n"},
+	{"---\r\ntitle: x\r\n...\r\nbody\r\n", "\n\n\nbody\r\n"},
+	{"+++\ntitle = 'x'\n+++\nbody\n", "\n\n\nbody\n"},
+	{"+++\ntitle: x\n---\nbody\n", "+++\ntitle: x\n---\nbody\n"},
+	{"---\nno end\n", "---\nno end\n"},
+	{"---", "---"},
+	{"", ""},
+}
+
+func TestStripFrontMatter(t *testing.T) {
+	for _, tt := range frontMatterTests {
+		r, err := stripFrontMatter("x.md", strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := io.ReadAll(r)
+		if string(out) != tt.out {
+			t.Errorf("stripFrontMatter(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	RegisterExtractor("*.uptest", ExtractorFunc(func(name string, r io.Reader) (io.Reader, error) {
+		data, err := io.ReadAll(r)
+		return bytes.NewReader(bytes.ToUpper(data)), err
+	}))
+	dir := t.TempDir()
+	files := map[string]string{
+		filepath.Join(dir, "doc.md"):     "---\ntitle: secret\n---\n# Usage\n",
+		filepath.Join(dir, "a.uptest"):   "hello world\n",
+		filepath.Join(dir, "b.txt"):      "hello world\n",
+		filepath.Join(dir, "z.uptest!x"): "hello world\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix := NewMemWriter()
+	ix.AddPaths([]string{dir})
+	ix.AddTree(dir)
+	ix.Flush()
+	r := OpenBytes(ix.Bytes())
+	for _, tt := range []struct {
+		re   string
+		want []string
+	}{
+		{`secret`, nil},
+		{`# Usage`, []string{"doc.md"}},
+		{`HELLO WORLD`, []string{"a.uptest"}},
+		{`hello world`, []string{"b.txt", "z.uptest!x"}},
+	} {
+		var got []string
+		for _, fileid := range queryFiles(t, r, tt.re) {
+			got = append(got, filepath.Base(r.Name(fileid)))
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("%#q: found %q, want %q", tt.re, got, tt.want)
+		}
+	}
+
+	// OpenFile reads the same text, keeping the line numbers
+	// of the rest of a Markdown file, and the metadata recorded
+	// are those of the file itself.
+	data, err := ReadFile(filepath.Join(dir, "doc.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "\n\n\n# Usage\n" {
+		t.Errorf("ReadFile(doc.md) = %q", data)
+	}
+	id, _ := r.Lookup(filepath.Join(dir, "doc.md"))
+	if m := r.Meta(id); m.Size != int64(len(files[filepath.Join(dir, "doc.md")])) {
+		t.Errorf("Meta(doc.md).Size = %d, want %d", m.Size, len(files[filepath.Join(dir, "doc.md")]))
+	}
+}
+
+func TestCommandExtractor(t *testing.T) {
+	if _, err := exec.LookPath("tr"); err != nil {
+		t.Skip("no tr command")
+	}
+	r, err := CommandExtractor("tr a-z A-Z").Extract("x", strings.NewReader("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := io.ReadAll(r); string(out) != "HELLO\n" {
+		t.Errorf("tr a-z A-Z extracted %q, want %q", out, "HELLO\n")
+	}
+	if _, err := CommandExtractor("false").Extract("x", strings.NewReader("hello\n")); err == nil {
+		t.Errorf("failing command extracted text")
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package index
+
+import (
+	"os"
+	"syscall"
+)
+
+// A fileKey identifies a file, whatever its name.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// statKey returns the key identifying the file described by info,
+// which must come from os.Stat or os.Lstat.
+func statKey(info os.FileInfo) (fileKey, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{uint64(st.Dev), uint64(st.Ino)}, true
+}
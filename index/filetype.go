@@ -0,0 +1,113 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileTypes maps file type names, like "go" or "py", to the glob
+// patterns identifying files of that type.  The patterns are matched
+// against the final element of a file name, as by path.Match.
+type FileTypes map[string][]string
+
+// defaultFileTypes lists the built-in file types.
+var defaultFileTypes = FileTypes{
+	"asm":      {"*.asm", "*.s", "*.S"},
+	"awk":      {"*.awk"},
+	"bazel":    {"BUILD", "BUILD.bazel", "WORKSPACE", "WORKSPACE.bazel", "*.bzl", "*.bazel"},
+	"c":        {"*.c", "*.h"},
+	"cmake":    {"CMakeLists.txt", "*.cmake"},
+	"cpp":      {"*.cc", "*.cpp", "*.cxx", "*.c++", "*.hh", "*.hpp", "*.hxx", "*.h++", "*.h", "*.inl"},
+	"cs":       {"*.cs"},
+	"css":      {"*.css", "*.scss", "*.sass", "*.less"},
+	"dart":     {"*.dart"},
+	"docker":   {"Dockerfile", "*.dockerfile"},
+	"elixir":   {"*.ex", "*.exs"},
+	"erlang":   {"*.erl", "*.hrl"},
+	"go":       {"*.go"},
+	"haskell":  {"*.hs", "*.lhs"},
+	"html":     {"*.htm", "*.html"},
+	"java":     {"*.java"},
+	"js":       {"*.js", "*.jsx", "*.mjs", "*.cjs"},
+	"json":     {"*.json"},
+	"kotlin":   {"*.kt", "*.kts"},
+	"lua":      {"*.lua"},
+	"make":     {"Makefile", "makefile", "GNUmakefile", "*.mk", "*.mak"},
+	"markdown": {"*.md", "*.markdown"},
+	"md":       {"*.md", "*.markdown"},
+	"ml":       {"*.ml", "*.mli"},
+	"objc":     {"*.m", "*.h"},
+	"perl":     {"*.pl", "*.pm", "*.t"},
+	"php":      {"*.php"},
+	"proto":    {"*.proto"},
+	"py":       {"*.py", "*.pyi"},
+	"r":        {"*.R", "*.r"},
+	"rst":      {"*.rst"},
+	"ruby":     {"*.rb", "Gemfile", "Rakefile", "*.gemspec"},
+	"rust":     {"*.rs"},
+	"scala":    {"*.scala", "*.sbt"},
+	"sh":       {"*.sh", "*.bash", "*.zsh"},
+	"sql":      {"*.sql"},
+	"swift":    {"*.swift"},
+	"tex":      {"*.tex", "*.sty", "*.cls", "*.bib"},
+	"toml":     {"*.toml"},
+	"ts":       {"*.ts", "*.tsx", "*.mts", "*.cts"},
+	"txt":      {"*.txt"},
+	"vim":      {"*.vim"},
+	"xml":      {"*.xml", "*.xsd", "*.xsl", "*.xslt"},
+	"yaml":     {"*.yaml", "*.yml"},
+}
+
+// DefaultFileTypes returns a new FileTypes holding the built-in types.
+// The caller may add to it without affecting other callers.
+func DefaultFileTypes() FileTypes {
+	t := make(FileTypes)
+	for name, globs := range defaultFileTypes {
+		t[name] = append([]string(nil), globs...)
+	}
+	return t
+}
+
+// Add adds the globs in the definition def to a file type,
+// creating the type if needed.  The definition has the form
+// name:glob[,glob...], as in "web:*.html,*.css".
+func (t FileTypes) Add(def string) error {
+	i := strings.Index(def, ":")
+	if i <= 0 || i == len(def)-1 {
+		return fmt.Errorf("invalid file type definition %q: want name:glob", def)
+	}
+	name := def[:i]
+	for _, glob := range strings.Split(def[i+1:], ",") {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid file type definition %q: %v", def, err)
+		}
+		t[name] = append(t[name], glob)
+	}
+	return nil
+}
+
+// Match reports whether the file name is of any of the named types.
+// A compressed file, such as foo.go.gz, is also of the types of the
+// file it holds (see UncompressedName).
+func (t FileTypes) Match(name string, types []string) bool {
+	elems := []string{filepath.Base(name)}
+	if u := UncompressedName(name); u != name {
+		elems = append(elems, filepath.Base(u))
+	}
+	for _, typ := range types {
+		for _, glob := range t[typ] {
+			for _, elem := range elems {
+				if ok, _ := path.Match(glob, elem); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
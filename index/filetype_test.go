@@ -0,0 +1,45 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "testing"
+
+var fileTypeTests = []struct {
+	name  string
+	types []string
+	match bool
+}{
+	{"/src/main.go", []string{"go"}, true},
+	{"/src/main.go", []string{"py"}, false},
+	{"/src/main.go", []string{"py", "go"}, true},
+	{"/src/go/README", []string{"go"}, false},
+	{"/src/Makefile", []string{"make"}, true},
+	{"/src/x.mk", []string{"make"}, true},
+	{"/src/x.h", []string{"c"}, true},
+	{"/src/x.h", []string{"cpp"}, true},
+	{"/src/page.tmpl", []string{"web"}, true},
+	{"/src/page.css", []string{"web"}, true},
+	{"/src/page.tmpl", []string{"nosuchtype"}, false},
+}
+
+func TestFileTypes(t *testing.T) {
+	types := DefaultFileTypes()
+	if err := types.Add("web:*.tmpl,*.css"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range fileTypeTests {
+		if match := types.Match(tt.name, tt.types); match != tt.match {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.name, tt.types, match, tt.match)
+		}
+	}
+	if len(DefaultFileTypes()["web"]) != 0 {
+		t.Errorf("Add modified the default file types")
+	}
+	for _, def := range []string{"web", ":*.x", "web:", "web:[x"} {
+		if err := types.Add(def); err == nil {
+			t.Errorf("Add(%q) succeeded, want error", def)
+		}
+	}
+}
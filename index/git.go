@@ -0,0 +1,290 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Git repositories.
+//
+// AddGitTree indexes the files in a revision of a git repository,
+// usually a bare one, reading them from the repository with the git
+// command instead of from a checkout.  A file read this way is named
+// in the index as repo@ref:path, where repo is the repository
+// directory, ref is the revision as given to AddGitTree, and path is
+// the file's path within the revision's tree.  The index path covering
+// the revision is repo@ref.  OpenFile and ReadFile read such files back
+// from the repository, so that they can be searched.
+
+// GitTree returns the index path naming the tree of revision ref
+// in the git repository repo.
+func GitTree(repo, ref string) string {
+	return repo + "@" + ref
+}
+
+// ParseGitTree reports whether path names a tree in a git repository,
+// either as repo@ref or as a repository directory, meaning its HEAD.
+func ParseGitTree(path string) (repo, ref string, ok bool) {
+	if isGitDir(path) {
+		return path, "HEAD", true
+	}
+	for i := strings.LastIndex(path, "@"); i > 0; i = strings.LastIndex(path[:i], "@") {
+		if ref := path[i+1:]; ref != "" && !strings.Contains(ref, ":") && isGitDir(path[:i]) {
+			return path[:i], ref, true
+		}
+	}
+	return "", "", false
+}
+
+// splitGitName splits the name of a file read from a git repository
+// into the repository directory, revision, and path within the tree.
+func splitGitName(name string) (repo, ref, path string, ok bool) {
+	for i := 0; ; i++ {
+		j := strings.Index(name[i:], "@")
+		if j < 0 {
+			return "", "", "", false
+		}
+		i += j
+		rest := name[i+1:]
+		if k := strings.Index(rest, ":"); k > 0 && isGitDir(name[:i]) {
+			return name[:i], rest[:k], rest[k+1:], true
+		}
+	}
+}
+
+var gitDirCache struct {
+	sync.Mutex
+	m map[string]bool
+}
+
+// isGitDir reports whether dir is a git repository directory,
+// such as a bare repository or the .git directory of a checkout.
+func isGitDir(dir string) bool {
+	gitDirCache.Lock()
+	defer gitDirCache.Unlock()
+	if ok, found := gitDirCache.m[dir]; found {
+		return ok
+	}
+	head, err1 := os.Stat(filepath.Join(dir, "HEAD"))
+	objects, err2 := os.Stat(filepath.Join(dir, "objects"))
+	ok := err1 == nil && head.Mode().IsRegular() && err2 == nil && objects.IsDir()
+	if gitDirCache.m == nil {
+		gitDirCache.m = make(map[string]bool)
+	}
+	gitDirCache.m[dir] = ok
+	return ok
+}
+
+// A gitEntry is a file or directory listed by git ls-tree.
+type gitEntry struct {
+	name string // name in the index
+	sha  string
+	info gitFileInfo
+}
+
+// A gitFileInfo describes a file or directory in a git tree.
+type gitFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi gitFileInfo) Name() string       { return fi.name }
+func (fi gitFileInfo) Size() int64        { return fi.size }
+func (fi gitFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi gitFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi gitFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi gitFileInfo) Sys() interface{}   { return nil }
+
+// AddGitTree adds the regular files in the tree of revision ref
+// in the git repository repo to the index, in lexical order.
+// Files and directories for which ix.Skip returns true are not indexed,
+// nor are hidden ones (see IndexWriter.SkipPrefixes).
+// It logs errors using package slog.
+func (ix *IndexWriter) AddGitTree(repo, ref string) {
+	files, err := ix.gitFiles(repo, ref)
+	if err != nil {
+		slog.Warn("cannot list git files", "path", GitTree(repo, ref), "error", err)
+		return
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	// Read the files with a single git cat-file process.
+	cmd := exec.Command("git", "--git-dir="+repo, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		slog.Warn("cannot run git cat-file", "repo", repo, "error", err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		slog.Warn("cannot run git cat-file", "repo", repo, "error", err)
+		return
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		slog.Warn("cannot run git cat-file", "repo", repo, "error", err)
+		return
+	}
+	go func() {
+		w := bufio.NewWriter(stdin)
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\n", f.sha)
+		}
+		w.Flush()
+		stdin.Close()
+	}()
+	r := bufio.NewReaderSize(stdout, 64<<10)
+	for _, f := range files {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			slog.Warn("cannot read", "path", f.name, "error", err)
+			break
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 || fields[0] != f.sha {
+			slog.Warn("unexpected git cat-file output", "repo", repo, "output", header)
+			break
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			slog.Warn("unexpected git cat-file output", "repo", repo, "output", header)
+			break
+		}
+		blob := io.LimitReader(r, size)
+		ix.add(f.name, blob, time.Time{})
+		io.Copy(ioutil.Discard, blob)
+		r.ReadByte() // newline after content
+	}
+	io.Copy(ioutil.Discard, r)
+	if err := cmd.Wait(); err != nil {
+		slog.Warn("git cat-file failed", "repo", repo, "error", err)
+	}
+}
+
+// gitFiles returns the regular files in the tree of revision ref
+// in the git repository repo, omitting those that ix.Skip rejects
+// and hidden ones.
+func (ix *IndexWriter) gitFiles(repo, ref string) ([]gitEntry, error) {
+	out, err := exec.Command("git", "--git-dir="+repo, "ls-tree", "-r", "-t", "-l", "-z", "--full-tree", ref).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			err = fmt.Errorf("%s", bytes.TrimSpace(ee.Stderr))
+		}
+		return nil, err
+	}
+	prefix := GitTree(repo, ref) + ":"
+	var files []gitEntry
+	var skipDir string
+	for _, line := range strings.Split(string(out), "\x00") {
+		// Each line has the form "mode type sha size\tpath".
+		tab := strings.Index(line, "\t")
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:tab])
+		path := line[tab+1:]
+		if len(fields) != 4 {
+			continue
+		}
+		if skipDir != "" && strings.HasPrefix(path, skipDir) {
+			continue
+		}
+		e := gitEntry{name: prefix + path, sha: fields[2]}
+		e.info.name = path[strings.LastIndex(path, "/")+1:]
+		switch fields[1] {
+		case "tree":
+			e.info.mode = os.ModeDir | 0755
+			if ix.skipEntry(e.name, e.info) {
+				skipDir = path + "/"
+			}
+			continue
+		case "blob":
+			// Skip symbolic links.
+			if fields[0] == "120000" {
+				continue
+			}
+			e.info.mode = 0644
+			e.info.size, _ = strconv.ParseInt(fields[3], 10, 64)
+		default:
+			// Submodule commits.
+			continue
+		}
+		if ix.skipEntry(e.name, e.info) {
+			continue
+		}
+		files = append(files, e)
+	}
+	return files, nil
+}
+
+// OpenFile opens the indexed file with the given name for reading.
+// If the file was read from a git repository by AddGitTree, OpenFile
+// reads it from the repository, and if it is a member of an archive
+// indexed by AddArchive, OpenFile reads it from the archive;
+// otherwise it uses os.Open.
+// Like the index writer, OpenFile decompresses compressed files (see
+// decompress.go), reads files through their extractors, if any (see
+// extract.go), and converts files written in UTF-16 or Latin-1 to UTF-8
+// as they are read.
+func OpenFile(name string) (io.ReadCloser, error) {
+	var f io.ReadCloser
+	if repo, ref, path, ok := splitGitName(name); ok {
+		data, err := exec.Command("git", "--git-dir="+repo, "cat-file", "blob", ref+":"+path).Output()
+		if err != nil {
+			return nil, &os.PathError{Op: "git cat-file", Path: name, Err: err}
+		}
+		f = ioutil.NopCloser(bytes.NewReader(data))
+	} else if archive, member, ok := SplitArchiveName(name); ok {
+		var err error
+		f, err = openArchiveMember(name, archive, member)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		f, err = os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	text, err := extract(name, f)
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "extract", Path: name, Err: err}
+	}
+	return textReadCloser{newTextReader(bufio.NewReaderSize(text, sniffLen)), f}, nil
+}
+
+// A textReadCloser reads converted text from a file.
+type textReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ReadFile reads the indexed file with the given name, as for OpenFile.
+func ReadFile(name string) ([]byte, error) {
+	f, err := OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,128 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gitCmd(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@b",
+		"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@b")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestGitTree(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "index-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	work := filepath.Join(dir, "work")
+	os.MkdirAll(filepath.Join(work, "a.b"), 0777)
+	os.MkdirAll(filepath.Join(work, "a", "skip"), 0777)
+	files := map[string]string{
+		"a.b/x":      "hello from a.b\n",
+		"a/y":        "hello from a\n",
+		"a/skip/z":   "hello from skip\n",
+		"a0":         "hello from a0\n",
+		"binary.dat": "\x00\xff binary\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(work, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitCmd(t, work, "init", "-q")
+	gitCmd(t, work, "add", ".")
+	gitCmd(t, work, "commit", "-q", "-m", "first")
+	gitCmd(t, work, "tag", "v1")
+	ioutil.WriteFile(filepath.Join(work, "a0"), []byte("changed\n"), 0666)
+	gitCmd(t, work, "commit", "-q", "-a", "-m", "second")
+	repo := filepath.Join(dir, "repo.git")
+	gitCmd(t, dir, "clone", "-q", "--bare", work, repo)
+
+	if r, ref, ok := ParseGitTree(repo); !ok || r != repo || ref != "HEAD" {
+		t.Errorf("ParseGitTree(%q) = %q, %q, %v", repo, r, ref, ok)
+	}
+	if r, ref, ok := ParseGitTree(repo + "@v1"); !ok || r != repo || ref != "v1" {
+		t.Errorf("ParseGitTree(%q) = %q, %q, %v", repo+"@v1", r, ref, ok)
+	}
+	if _, _, ok := ParseGitTree(work); ok {
+		t.Errorf("ParseGitTree(%q) succeeded for a working tree", work)
+	}
+	if d, ok := GitDir(work); !ok || d != filepath.Join(work, ".git") {
+		t.Errorf("GitDir(%q) = %q, %v, want its .git", work, d, ok)
+	}
+	if d, ok := GitDir(repo); !ok || d != repo {
+		t.Errorf("GitDir(%q) = %q, %v, want itself", repo, d, ok)
+	}
+	if d, ok := GitDir(dir); ok {
+		t.Errorf("GitDir(%q) = %q, want failure", dir, d)
+	}
+
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	tree := GitTree(repo, "v1")
+	ix := Create(f.Name())
+	ix.Skip = func(path string, info os.FileInfo) bool {
+		return info.IsDir() && info.Name() == "skip"
+	}
+	ix.GitRef = "v1"
+	ix.AddPaths([]string{tree})
+	ix.AddGitTree(repo, "v1")
+	ix.Flush()
+
+	rd := Open(f.Name())
+	var names []string
+	for i := 0; i < rd.NumFiles(); i++ {
+		names = append(names, rd.Name(uint32(i)))
+	}
+	want := []string{tree + ":a.b/x", tree + ":a/y", tree + ":a0"}
+	if !equalStrings(names, want) {
+		t.Fatalf("indexed %q, want %q", names, want)
+	}
+	data, err := ReadFile(tree + ":a0")
+	if err != nil || string(data) != files["a0"] {
+		t.Errorf("ReadFile(a0) = %q, %v, want %q", data, err, files["a0"])
+	}
+	if fileid, ok := rd.Lookup(tree + ":a/y"); !ok || rd.Meta(fileid).Size != int64(len(files["a/y"])) {
+		t.Errorf("Lookup(a/y) = %d, %v or wrong size", fileid, ok)
+	}
+	if ref := rd.GitRef(); ref != "v1" {
+		t.Errorf("GitRef() = %q, want v1", ref)
+	}
+	if err := Verify(f.Name()); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+func TestRefFile(t *testing.T) {
+	file := filepath.Join("x", ".csearchindex")
+	for ref, want := range map[string]string{
+		"v1.2.3":        file + "@v1.2.3",
+		"release/2024":  file + "@release%2F2024",
+		"HEAD~2":        file + "@HEAD~2",
+		"refs/tags/a b": file + "@refs%2Ftags%2Fa%20b",
+	} {
+		if f := RefFile(file, ref); f != want {
+			t.Errorf("RefFile(%q, %q) = %q, want %q", file, ref, f, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A Gitignore reports whether files are ignored by the .gitignore files
+// in the directories above them, as git would.  The rules in a
+// repository's .git/info/exclude file apply too.  Rules are loaded
+// as directories are first consulted and are cached after that.
+//
+// A Gitignore made by NewCsearchignore reads .csearchignore files
+// instead, in the same syntax, so that the rules for what to leave out
+// of an index can be kept with the code.  The rules in every directory
+// above a file apply, at the top of a git repository or not.
+type Gitignore struct {
+	file    string // name of the ignore files
+	git     bool   // read .git/info/exclude and stop at repository tops
+	dirs    map[string]*ignoreDir
+	ignored map[string]bool // cached results for directories
+}
+
+// An ignoreDir holds the ignore rules defined in a directory.
+type ignoreDir struct {
+	rules []ignoreRule
+	repo  bool // directory is the top of a git repository
+}
+
+// An ignoreRule is a single pattern from an ignore file.
+type ignoreRule struct {
+	re      *regexp.Regexp // matches slash-separated paths relative to the rule's directory
+	negate  bool           // pattern began with !
+	dirOnly bool           // pattern ended with /
+}
+
+// NewGitignore returns a new Gitignore.
+func NewGitignore() *Gitignore {
+	return &Gitignore{
+		file:    ".gitignore",
+		git:     true,
+		dirs:    make(map[string]*ignoreDir),
+		ignored: make(map[string]bool),
+	}
+}
+
+// NewCsearchignore returns a new Gitignore that
+// reads .csearchignore files instead of .gitignore files.
+func NewCsearchignore() *Gitignore {
+	return &Gitignore{
+		file:    ".csearchignore",
+		dirs:    make(map[string]*ignoreDir),
+		ignored: make(map[string]bool),
+	}
+}
+
+// Ignored reports whether the file or directory with the given
+// absolute path is ignored, either directly or because one of
+// the directories containing it is ignored.
+func (g *Gitignore) Ignored(path string, isDir bool) bool {
+	if dir := filepath.Dir(path); dir != path && !g.dir(dir).repo {
+		ignored, ok := g.ignored[dir]
+		if !ok {
+			ignored = g.Ignored(dir, true)
+			g.ignored[dir] = ignored
+		}
+		if ignored {
+			return true
+		}
+	}
+	return g.match(path, isDir)
+}
+
+// match reports whether the rules in the directories
+// above path say that it is ignored.
+func (g *Gitignore) match(path string, isDir bool) bool {
+	// Collect the directories whose rules apply, innermost first,
+	// stopping at the top of the repository.
+	var dirs []string
+	for dir := filepath.Dir(path); ; {
+		dirs = append(dirs, dir)
+		if g.dir(dir).repo {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	// Later rules override earlier ones, and rules in deeper
+	// directories override those in shallower ones.
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, r := range g.dir(dirs[i]).rules {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if r.re.MatchString(rel) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// dir returns the rules for the named directory, loading them if needed.
+func (g *Gitignore) dir(name string) *ignoreDir {
+	d := g.dirs[name]
+	if d != nil {
+		return d
+	}
+	d = new(ignoreDir)
+	if g.git {
+		if info, err := os.Stat(filepath.Join(name, ".git")); err == nil && info.IsDir() {
+			d.repo = true
+			d.rules = append(d.rules, readIgnore(filepath.Join(name, ".git", "info", "exclude"))...)
+		}
+	}
+	d.rules = append(d.rules, readIgnore(filepath.Join(name, g.file))...)
+	g.dirs[name] = d
+	return d
+}
+
+// readIgnore returns the rules in the named ignore file.
+// A missing or unreadable file has no rules.
+func readIgnore(file string) []ignoreRule {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	return parseIgnore(data)
+}
+
+// parseIgnore parses the rules in an ignore file.
+// Invalid patterns are ignored, as git does.
+func parseIgnore(data []byte) []ignoreRule {
+	var rules []ignoreRule
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		// Trailing spaces are ignored unless escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		var r ignoreRule
+		if line[0] == '!' {
+			r.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' && len(line) > 1 && (line[1] == '!' || line[1] == '#') {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		re, err := regexp.Compile(globRegexp(line))
+		if err != nil {
+			continue
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// globRegexp translates a gitignore glob pattern into a regular
+// expression matching the slash-separated paths relative to the
+// directory holding the pattern.
+func globRegexp(pat string) string {
+	// A pattern without a slash matches a name at any depth.
+	// Otherwise it is anchored to the directory.
+	var buf bytes.Buffer
+	if strings.Contains(pat, "/") {
+		buf.WriteString("^")
+		pat = strings.TrimPrefix(pat, "/")
+	} else {
+		buf.WriteString("(^|/)")
+	}
+	writeGlob(&buf, pat)
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// writeGlob writes to buf a regular expression matching the
+// same slash-separated paths as the glob pattern pat.
+func writeGlob(buf *bytes.Buffer, pat string) {
+	for i := 0; i < len(pat); i++ {
+		c := pat[i]
+		switch {
+		case strings.HasPrefix(pat[i:], "**/"):
+			buf.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pat[i:], "**") && i+2 == len(pat):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(pat[i+1:], ']')
+			if j < 0 {
+				buf.WriteString(`\[`)
+				break
+			}
+			class := pat[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(pat):
+			i++
+			buf.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var globTests = []struct {
+	pat   string
+	path  string
+	match bool
+}{
+	{"*.o", "x.o", true},
+	{"*.o", "a/b/x.o", true},
+	{"*.o", "x.oo", false},
+	{"build", "build", true},
+	{"build", "src/build", true},
+	{"/build", "src/build", false},
+	{"doc/*.txt", "doc/a.txt", true},
+	{"doc/*.txt", "doc/x/a.txt", false},
+	{"doc/*.txt", "x/doc/a.txt", false},
+	{"**/foo", "foo", true},
+	{"**/foo", "a/b/foo", true},
+	{"a/**/b", "a/b", true},
+	{"a/**/b", "a/x/y/b", true},
+	{"a/**", "a/x/y", true},
+	{"a/**", "b/a/x", false},
+	{"file?.[ch]", "file1.c", true},
+	{"file?.[!ch]", "file1.c", false},
+	{"file?.[!ch]", "file1.s", true},
+	{`\#notcomment`, "#notcomment", true},
+}
+
+func TestGlobRegexp(t *testing.T) {
+	for _, tt := range globTests {
+		rules := parseIgnore([]byte(tt.pat))
+		if len(rules) != 1 {
+			t.Errorf("parseIgnore(%q) = %d rules, want 1", tt.pat, len(rules))
+			continue
+		}
+		if m := rules[0].re.MatchString(tt.path); m != tt.match {
+			t.Errorf("pattern %q on %q: match = %v, want %v", tt.pat, tt.path, m, tt.match)
+		}
+	}
+}
+
+func TestGitignore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".git/info/exclude": "*.secret\n",
+		".gitignore":        "# comment\n*.o\nbuild/\n!keep.o\n",
+		"sub/.gitignore":    "*.txt\n!important.txt\n/local\n",
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"main.c", false, false},
+		{"main.o", false, true},
+		{"keep.o", false, false},
+		{"sub/x.o", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/out.c", false, true},
+		{"a.secret", false, true},
+		{"notes.txt", false, false},
+		{"sub/notes.txt", false, true},
+		{"sub/important.txt", false, false},
+		{"sub/local", true, true},
+		{"sub/deeper/local", true, false},
+	}
+	g := NewGitignore()
+	for _, tt := range tests {
+		if ign := g.Ignored(filepath.Join(dir, tt.path), tt.isDir); ign != tt.ignored {
+			t.Errorf("Ignored(%s, %v) = %v, want %v", tt.path, tt.isDir, ign, tt.ignored)
+		}
+	}
+}
+
+func TestCsearchignore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".csearchignore":          "third_party/\n*.pb.go\n",
+		".gitignore":              "*.go\n",
+		"repo/.git/info/exclude":  "",
+		"repo/.csearchignore":     "!keep.pb.go\ngen/\n",
+		"repo/main.go":            "package main\n",
+		"repo/keep.pb.go":         "package main\n",
+		"repo/x.pb.go":            "package main\n",
+		"repo/gen/y.go":           "package gen\n",
+		"repo/third_party/z.go":   "package z\n",
+		"repo/sub/third_party.go": "package sub\n",
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := os.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rules above the repository apply within it,
+	// and .gitignore files play no part.
+	g := NewCsearchignore()
+	for _, tt := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"repo/main.go", false, false},
+		{"repo/x.pb.go", false, true},
+		{"repo/keep.pb.go", false, false},
+		{"repo/gen", true, true},
+		{"repo/gen/y.go", false, true},
+		{"repo/third_party/z.go", false, true},
+		{"repo/sub/third_party.go", false, false},
+	} {
+		if ign := g.Ignored(filepath.Join(dir, tt.path), tt.isDir); ign != tt.ignored {
+			t.Errorf("Ignored(%s, %v) = %v, want %v", tt.path, tt.isDir, ign, tt.ignored)
+		}
+	}
+
+	var skipped []string
+	ix := NewMemWriter()
+	ix.UseCsearchignore = true
+	ix.OnSkip = func(path string, reason SkipReason) {
+		if reason == SkipCsearchignored {
+			rel, _ := filepath.Rel(dir, path)
+			skipped = append(skipped, filepath.ToSlash(rel))
+		}
+	}
+	ix.AddPaths([]string{dir})
+	ix.AddTree(dir)
+	ix.Flush()
+	want := []string{"repo/gen", "repo/third_party", "repo/x.pb.go"}
+	if !equalStrings(skipped, want) {
+		t.Errorf("skipped %q, want %q", skipped, want)
+	}
+}
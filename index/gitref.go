@@ -0,0 +1,78 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Indexes of git revisions.
+//
+// An index can hold the files of one revision, such as a release tag,
+// of one or more git repositories, as indexed by AddGitTree, so that
+// code can be searched as it was at that revision.  Such an index
+// records the revision in the optional "gitref" section, a single
+// NUL-terminated string, and is kept beside the usual index, in the
+// file named by RefFile, so that the indexes of several revisions can
+// be kept side by side.
+
+const gitRefSection = "gitref"
+
+// gitRefSectionData returns the gitref section recording ref.
+func gitRefSectionData(ref string) sectionData {
+	w := bufCreateMem()
+	w.writeString(ref)
+	w.writeString("\x00")
+	return sectionData{gitRefSection, w}
+}
+
+// GitRef returns the git revision whose files the index holds, as set
+// by IndexWriter.GitRef, or the empty string if it records none.
+func (ix *Index) GitRef() string {
+	d := ix.section(gitRefSection)
+	if len(d) == 0 {
+		return ""
+	}
+	if d[len(d)-1] != 0 {
+		corrupt()
+	}
+	return string(d[:len(d)-1])
+}
+
+// mergeGitRef returns the gitref section for the merge of ix1
+// and the newer ix2, if either records a revision.
+func mergeGitRef(ix1, ix2 *Index) []sectionData {
+	ref := ix2.GitRef()
+	if ref == "" {
+		ref = ix1.GitRef()
+	}
+	if ref == "" {
+		return nil
+	}
+	return []sectionData{gitRefSectionData(ref)}
+}
+
+// RefFile returns the name of the index file holding the files
+// of git revision ref, kept beside the index file named file.
+// It is file@ref, with any slashes in ref escaped.
+func RefFile(file, ref string) string {
+	return filepath.Clean(file) + "@" + url.PathEscape(ref)
+}
+
+// GitDir returns the git repository directory for path: path itself,
+// if it is a repository directory, such as a bare repository, or else
+// the .git directory of the checkout rooted at path.
+func GitDir(path string) (dir string, ok bool) {
+	if isGitDir(path) {
+		return path, true
+	}
+	dir = filepath.Join(path, ".git")
+	if info, err := os.Stat(dir); err == nil && info.IsDir() && isGitDir(dir) {
+		return dir, true
+	}
+	return "", false
+}
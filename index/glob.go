@@ -0,0 +1,88 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A GlobFilter selects file names using include and exclude glob
+// patterns, such as src/**/*.go and !**/testdata/**.
+//
+// A pattern beginning with ! excludes the files it matches;
+// any other pattern includes them.  A name passes the filter if it
+// matches none of the exclude patterns and, when there are include
+// patterns, at least one of them.
+//
+// Patterns use the gitignore syntax: * and ? match within a single
+// path element, ** matches any number of path elements, and [...]
+// matches a character class.  A pattern beginning with / must match
+// from the start of a name.  Any other pattern may match starting at
+// any path element, so that src/**/*.go matches /home/rsc/src/x/y.go.
+// A pattern ending in / or naming a directory without wildcards,
+// such as src or testdata, also matches the files in the directory;
+// other patterns, such as *.go, match only the last element of a name,
+// and so not the files in a directory x.go.
+type GlobFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewGlobFilter returns a GlobFilter using the given patterns.
+func NewGlobFilter(globs []string) (*GlobFilter, error) {
+	f := new(GlobFilter)
+	for _, glob := range globs {
+		pat, list := glob, &f.include
+		if strings.HasPrefix(pat, "!") {
+			pat, list = pat[1:], &f.exclude
+		}
+		if pat == "" {
+			return nil, fmt.Errorf("empty glob %q", glob)
+		}
+		var buf bytes.Buffer
+		if strings.HasPrefix(pat, "/") {
+			buf.WriteString("^")
+		} else {
+			buf.WriteString("(^|/)")
+		}
+		body := strings.TrimRight(pat, "/")
+		writeGlob(&buf, body)
+		last := body[strings.LastIndex(body, "/")+1:]
+		if strings.HasSuffix(pat, "/") || !strings.ContainsAny(last, "*?[") {
+			buf.WriteString("(/|$)")
+		} else {
+			buf.WriteString("$")
+		}
+		re, err := regexp.Compile(buf.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q", glob)
+		}
+		*list = append(*list, re)
+	}
+	return f, nil
+}
+
+// Match reports whether name passes the filter.
+func (f *GlobFilter) Match(name string) bool {
+	name = filepath.ToSlash(name)
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
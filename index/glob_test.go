@@ -0,0 +1,54 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "testing"
+
+var globFilterTests = []struct {
+	globs []string
+	name  string
+	match bool
+}{
+	{nil, "/home/u/src/x.go", true},
+	{[]string{"*.go"}, "/home/u/src/x.go", true},
+	{[]string{"*.go"}, "/home/u/src/x.py", false},
+	{[]string{"*.go"}, "/home/u/src/x.go/README", false},
+	{[]string{"*.go/"}, "/home/u/src/x.go/README", true},
+	{[]string{"!*.go"}, "/home/u/src/x.go/README", true},
+	{[]string{"src/**"}, "/home/u/src/x.go/README", true},
+	{[]string{"*.go", "*.py"}, "/home/u/src/x.py", true},
+	{[]string{"src/**/*.go"}, "/home/u/src/x.go", true},
+	{[]string{"src/**/*.go"}, "/home/u/src/a/b/x.go", true},
+	{[]string{"src/**/*.go"}, "/home/u/lib/x.go", false},
+	{[]string{"src/*.go"}, "/home/u/src/a/x.go", false},
+	{[]string{"/home/u/src/*.go"}, "/home/u/src/x.go", true},
+	{[]string{"/src/*.go"}, "/home/u/src/x.go", false},
+	{[]string{"src"}, "/home/u/src/a/x.go", true},
+	{[]string{"!**/testdata/**"}, "/home/u/src/x.go", true},
+	{[]string{"!**/testdata/**"}, "/home/u/src/testdata/x.go", false},
+	{[]string{"!testdata"}, "/home/u/src/testdata/a/x.go", false},
+	{[]string{"*.go", "!*_test.go"}, "/home/u/src/x_test.go", false},
+	{[]string{"*.go", "!*_test.go"}, "/home/u/src/x.go", true},
+	{[]string{"x.[ch]"}, "/home/u/src/x.h", true},
+	{[]string{"x.[!ch]"}, "/home/u/src/x.h", false},
+}
+
+func TestGlobFilter(t *testing.T) {
+	for _, tt := range globFilterTests {
+		f, err := NewGlobFilter(tt.globs)
+		if err != nil {
+			t.Errorf("NewGlobFilter(%q): %v", tt.globs, err)
+			continue
+		}
+		if match := f.Match(tt.name); match != tt.match {
+			t.Errorf("NewGlobFilter(%q).Match(%q) = %v, want %v", tt.globs, tt.name, match, tt.match)
+		}
+	}
+	for _, glob := range []string{"", "!"} {
+		if _, err := NewGlobFilter([]string{glob}); err == nil {
+			t.Errorf("NewGlobFilter(%q) succeeded, want error", glob)
+		}
+	}
+}
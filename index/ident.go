@@ -0,0 +1,408 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Identifier indexing.
+//
+// If IndexWriter.Identifiers is set, the writer records the words of
+// the identifiers in the code of each file it indexes, in the "ident"
+// section.  A code-aware scanner finds the identifiers, skipping the
+// comments and string literals of the file's language, and splits each
+// into words at underscores and changes of case, so that FooBar,
+// fooBar, foo_bar, and FOO_BAR are all the words foo and bar.  Only
+// files in the languages listed in identSyntaxes are scanned.
+// See read.go for the format.
+//
+// The section lists the files holding each word, as a posting list
+// does for a trigram, so that IdentifierFiles can find the files that
+// might use an identifier without reading any, and IdentifierLines
+// then finds where a file does.
+
+const identSection = "ident"
+
+// An identSyntax describes the comments and string literals of
+// a language, which the scan for identifiers skips and which
+// region.go records as the file's regions.
+type identSyntax struct {
+	block  [][2]string // block comment delimiters
+	raw    [][2]string // delimiters of strings that may span lines, without escapes
+	line   []string    // line comment starts
+	quotes string      // quotes of single-line strings, with backslash escapes
+}
+
+var (
+	cSyntax  = &identSyntax{block: [][2]string{{"/*", "*/"}}, line: []string{"//"}, quotes: `"'`}
+	goSyntax = &identSyntax{block: [][2]string{{"/*", "*/"}}, raw: [][2]string{{"`", "`"}}, line: []string{"//"}, quotes: `"'`}
+	shSyntax = &identSyntax{line: []string{"#"}, quotes: `"'`}
+
+	// identSyntaxes lists the syntax of each language whose
+	// identifiers and regions are indexed.  Rust's quote is omitted because
+	// it also marks lifetimes, as in 'a.
+	identSyntaxes = map[string]*identSyntax{
+		"c":      cSyntax,
+		"cpp":    cSyntax,
+		"cs":     cSyntax,
+		"dart":   cSyntax,
+		"go":     goSyntax,
+		"java":   cSyntax,
+		"js":     goSyntax,
+		"kotlin": cSyntax,
+		"lua":    {block: [][2]string{{"--[[", "]]"}}, line: []string{"--"}, quotes: `"'`},
+		"objc":   cSyntax,
+		"perl":   shSyntax,
+		"php":    {block: [][2]string{{"/*", "*/"}}, line: []string{"//", "#"}, quotes: `"'`},
+		"proto":  cSyntax,
+		"py":     {raw: [][2]string{{`"""`, `"""`}, {"'''", "'''"}}, line: []string{"#"}, quotes: `"'`},
+		"ruby":   shSyntax,
+		"rust":   {block: [][2]string{{"/*", "*/"}}, line: []string{"//"}, quotes: `"`},
+		"scala":  cSyntax,
+		"sh":     shSyntax,
+		"swift":  cSyntax,
+		"ts":     goSyntax,
+	}
+)
+
+// hasSyntax reports whether identifiers and regions
+// are indexed in files in the given language.
+func hasSyntax(lang string) bool {
+	return identSyntaxes[lang] != nil
+}
+
+// scan lexes data, which holds text in the language syn describes,
+// calling ident, if non-nil, for each identifier, other than numbers,
+// and region, if non-nil, for each comment or string literal, in order,
+// with the offsets in data of its start and end.
+func (syn *identSyntax) scan(data []byte, ident func(start, end int), region func(start, end int, kind RegionKind)) {
+	for i := 0; i < len(data); {
+		c := data[i]
+		if r, _ := utf8.DecodeRune(data[i:]); isIdentRune(r) {
+			j := i
+			for j < len(data) {
+				r, size := utf8.DecodeRune(data[j:])
+				if !isIdentRune(r) {
+					break
+				}
+				j += size
+			}
+			if ident != nil && !('0' <= c && c <= '9') {
+				ident(i, j)
+			}
+			i = j
+			continue
+		}
+		if end, kind := syn.skip(data, i); end > i {
+			if region != nil {
+				region(i, end, kind)
+			}
+			i = end
+			continue
+		}
+		i++
+	}
+}
+
+// scanIdentifiers calls f for each identifier in the code of data,
+// which holds text in the given language, with the number of the line
+// holding it.  It skips comments, string literals, and numbers.
+func scanIdentifiers(lang string, data []byte, f func(id []byte, line int)) {
+	syn := identSyntaxes[lang]
+	if syn == nil {
+		return
+	}
+	line, pos := 1, 0
+	syn.scan(data, func(start, end int) {
+		line += bytes.Count(data[pos:start], []byte("\n"))
+		pos = start
+		f(data[start:end], line)
+	}, nil)
+}
+
+// isIdentRune reports whether r can appear in an identifier.
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// skip returns the offset in data just past the comment or string
+// literal beginning at data[i], and which it is, or i if there is none.
+// An unterminated comment or string ends the data, except that a
+// single-line string ends at the end of the line.
+func (syn *identSyntax) skip(data []byte, i int) (int, RegionKind) {
+	rest := data[i:]
+	for _, d := range syn.block {
+		if bytes.HasPrefix(rest, []byte(d[0])) {
+			return skipPast(data, i+len(d[0]), d[1]), RegionComment
+		}
+	}
+	for _, d := range syn.raw {
+		if bytes.HasPrefix(rest, []byte(d[0])) {
+			return skipPast(data, i+len(d[0]), d[1]), RegionString
+		}
+	}
+	for _, l := range syn.line {
+		if bytes.HasPrefix(rest, []byte(l)) {
+			if j := bytes.IndexByte(rest, '\n'); j >= 0 {
+				return i + j, RegionComment
+			}
+			return len(data), RegionComment
+		}
+	}
+	if q := rest[0]; strings.IndexByte(syn.quotes, q) >= 0 {
+		for j := i + 1; j < len(data); j++ {
+			switch data[j] {
+			case '\\':
+				j++
+			case q:
+				return j + 1, RegionString
+			case '\n':
+				return j, RegionString
+			}
+		}
+		return len(data), RegionString
+	}
+	return i, RegionCode
+}
+
+// skipPast returns the offset in data just past the first
+// instance of end at or after i, or len(data) if there is none.
+func skipPast(data []byte, i int, end string) int {
+	if j := bytes.Index(data[i:], []byte(end)); j >= 0 {
+		return i + j + len(end)
+	}
+	return len(data)
+}
+
+// IdentifierWords splits the identifier id into its words, in lower
+// case, breaking it at underscores and wherever a lower-case letter or
+// digit is followed by an upper-case letter, or an upper-case letter is
+// followed by one starting a word of its own, as in HTTPServer.
+// Digits stay with the letters before them, as in utf8 or sha256.
+func IdentifierWords(id string) []string {
+	var words []string
+	runes := []rune(id)
+	start := -1
+	for i, r := range runes {
+		if !isIdentRune(r) || r == '_' {
+			if start >= 0 {
+				words = append(words, strings.ToLower(string(runes[start:i])))
+				start = -1
+			}
+			continue
+		}
+		if start >= 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+				words = append(words, strings.ToLower(string(runes[start:i])))
+				start = i
+			}
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, strings.ToLower(string(runes[start:])))
+	}
+	return words
+}
+
+// fileIdentWords returns the distinct words of the identifiers
+// in data, which holds text in the given language.
+func fileIdentWords(lang string, data []byte) []string {
+	seen := make(map[string]bool)
+	var words []string
+	scanIdentifiers(lang, data, func(id []byte, line int) {
+		for _, w := range IdentifierWords(string(id)) {
+			if !seen[w] {
+				seen[w] = true
+				words = append(words, w)
+			}
+		}
+	})
+	return words
+}
+
+// IdentifierLines returns the numbers of the lines of data, which holds
+// text in the given language, using an identifier made of the given
+// words, as returned by IdentifierWords, in any case convention.
+func IdentifierLines(lang string, data []byte, words []string) []int {
+	var lines []int
+	want := strings.Join(words, "_")
+	scanIdentifiers(lang, data, func(id []byte, line int) {
+		if len(lines) > 0 && lines[len(lines)-1] == line {
+			return
+		}
+		if strings.Join(IdentifierWords(string(id)), "_") == want {
+			lines = append(lines, line)
+		}
+	})
+	return lines
+}
+
+// An identWriter accumulates the files holding each
+// identifier word for the ident section.
+type identWriter struct {
+	files map[string][]uint32
+	mem   bool // build the section in memory
+}
+
+func newIdentWriter(mem bool) *identWriter {
+	return &identWriter{files: make(map[string][]uint32), mem: mem}
+}
+
+// add records that fileid uses word.
+// Files must be added in increasing order of file ID.
+func (w *identWriter) add(word string, fileid uint32) {
+	list := w.files[word]
+	if len(list) == 0 || list[len(list)-1] != fileid {
+		w.files[word] = append(list, fileid)
+	}
+}
+
+// addIndex records the identifier words in ix,
+// renumbering their file IDs using idmap.
+// Files missing from idmap are dropped.
+func (w *identWriter) addIndex(ix *Index, idmap []idrange) {
+	for i, n := 0, ix.numIdentWords(); i < n; i++ {
+		word, files := ix.identWordAt(i)
+		for _, fileid := range files {
+			j := sort.Search(len(idmap), func(j int) bool { return idmap[j].hi > fileid })
+			if j < len(idmap) && idmap[j].lo <= fileid {
+				w.add(word, idmap[j].new+fileid-idmap[j].lo)
+			}
+		}
+	}
+}
+
+// section returns the ident section holding the recorded words.
+func (w *identWriter) section() sectionData {
+	words := make([]string, 0, len(w.files))
+	for word := range w.files {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+
+	// Word entries, preceded by their offsets.
+	entries := newTempBuf(w.mem)
+	offsets := make([]uint32, len(words))
+	base := uint32(4 + 4*len(words))
+	for i, word := range words {
+		files := w.files[word]
+		sort.Slice(files, func(i, j int) bool { return files[i] < files[j] })
+		offsets[i] = base + entries.offset()
+		entries.writeString(word)
+		entries.writeString("\x00")
+		entries.writeUvarint(uint32(len(files)))
+		last := uint32(0)
+		for _, fileid := range files {
+			entries.writeUvarint(fileid - last)
+			last = fileid
+		}
+	}
+	out := newTempBuf(w.mem)
+	out.writeUint32(uint32(len(words)))
+	for _, off := range offsets {
+		out.writeUint32(off)
+	}
+	copyFile(out, entries)
+	entries.remove()
+	return sectionData{identSection, out}
+}
+
+// HasIdentifiers reports whether the index records identifier words.
+func (ix *Index) HasIdentifiers() bool {
+	return ix.section(identSection) != nil
+}
+
+// numIdentWords returns the number of distinct identifier words in the index.
+func (ix *Index) numIdentWords() int {
+	d := ix.section(identSection)
+	if len(d) < 4 {
+		return 0
+	}
+	n := int(binary.BigEndian.Uint32(d))
+	if 4+4*n > len(d) {
+		corrupt()
+	}
+	return n
+}
+
+// identWordEntry returns the data for the i'th word,
+// split into the word and its encoded file list.
+func (ix *Index) identWordEntry(i int) (string, []byte) {
+	d := ix.section(identSection)
+	off := binary.BigEndian.Uint32(d[4+4*i:])
+	if int(off) >= len(d) {
+		corrupt()
+	}
+	d = d[off:]
+	j := bytes.IndexByte(d, 0)
+	if j < 0 {
+		corrupt()
+	}
+	return string(d[:j]), d[j+1:]
+}
+
+// identWordAt returns the i'th word and the files using it.
+func (ix *Index) identWordAt(i int) (string, []uint32) {
+	word, d := ix.identWordEntry(i)
+	next := func() uint32 {
+		v, n := binary.Uvarint(d)
+		if n <= 0 {
+			corrupt()
+		}
+		d = d[n:]
+		return uint32(v)
+	}
+	files := make([]uint32, next())
+	fileid := uint32(0)
+	for k := range files {
+		fileid += next()
+		files[k] = fileid
+	}
+	return word, files
+}
+
+// identWordFiles returns the files using word.
+func (ix *Index) identWordFiles(word string) []uint32 {
+	n := ix.numIdentWords()
+	i := sort.Search(n, func(i int) bool {
+		w, _ := ix.identWordEntry(i)
+		return w >= word
+	})
+	if i >= n {
+		return nil
+	}
+	w, files := ix.identWordAt(i)
+	if w != word {
+		return nil
+	}
+	return files
+}
+
+// IdentifierFiles returns the IDs of the files whose code uses all
+// of the identifier words, as returned by IdentifierWords.  The files
+// may not use them in a single identifier; IdentifierLines says.
+func (ix *Index) IdentifierFiles(words []string) []uint32 {
+	var list []uint32
+	for i, w := range words {
+		files := ix.identWordFiles(w)
+		if i == 0 {
+			list = files
+			continue
+		}
+		list = mergeAnd(list, files)
+	}
+	return list
+}
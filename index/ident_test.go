@@ -0,0 +1,132 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var identWordsTests = []struct {
+	id   string
+	want []string
+}{
+	{"FooBar", []string{"foo", "bar"}},
+	{"fooBar", []string{"foo", "bar"}},
+	{"foo_bar", []string{"foo", "bar"}},
+	{"FOO_BAR", []string{"foo", "bar"}},
+	{"HTTPServer", []string{"http", "server"}},
+	{"utf8Decode", []string{"utf8", "decode"}},
+	{"_x", []string{"x"}},
+	{"", nil},
+}
+
+func TestIdentifierWords(t *testing.T) {
+	for _, tt := range identWordsTests {
+		if have := IdentifierWords(tt.id); !equalStrings(have, tt.want) {
+			t.Errorf("IdentifierWords(%q) = %v, want %v", tt.id, have, tt.want)
+		}
+	}
+}
+
+var scanIdentTests = []struct {
+	lang string
+	data string
+	want []string
+}{
+	{
+		"go",
+		"// FooBar here\nx := fooBar(\"foo_bar\", `FOO\nBAR`) /* a\nb */ + 12e3\ny := 'z'\n",
+		[]string{"x:2", "fooBar:2", "y:5"},
+	},
+	{
+		"py",
+		"# comment\ndef f(a):\n    \"\"\"doc\n    string\"\"\"\n    return a\n",
+		[]string{"def:2", "f:2", "a:2", "return:5", "a:5"},
+	},
+	{
+		"txt",
+		"foo bar\n",
+		nil,
+	},
+}
+
+func TestScanIdentifiers(t *testing.T) {
+	for _, tt := range scanIdentTests {
+		var have []string
+		scanIdentifiers(tt.lang, []byte(tt.data), func(id []byte, line int) {
+			have = append(have, fmt.Sprintf("%s:%d", id, line))
+		})
+		if !equalStrings(have, tt.want) {
+			t.Errorf("%s: identifiers = %v, want %v", tt.lang, have, tt.want)
+		}
+	}
+}
+
+func identFileNames(ix *Index, id string) []string {
+	var names []string
+	for _, fileid := range ix.IdentifierFiles(IdentifierWords(id)) {
+		names = append(names, ix.Name(fileid))
+	}
+	return names
+}
+
+func TestIdentifierIndex(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+	identifiers := func(ix *IndexWriter) { ix.Identifiers = true }
+	buildIndexWith(f1.Name(), []string{"/a", "/c"}, map[string]string{
+		"/a/a.go": "package a\n\nfunc FooBar() {}\n",
+		"/a/b.go": "package a\n\n// FooBar\nvar s = \"foo_bar\"\n",
+		"/c/c.py": "foo_bar = 1\n",
+	}, identifiers)
+	buildIndexWith(f2.Name(), []string{"/b", "/c"}, map[string]string{
+		"/b/b.go": "package b\n\nvar x = bar.Foo\n",
+		"/c/d.py": "FOO_BAR = 2\n",
+	}, identifiers)
+
+	ix1 := Open(f1.Name())
+	if !ix1.HasIdentifiers() {
+		t.Fatalf("index has no identifiers")
+	}
+	have := identFileNames(ix1, "fooBar")
+	want := []string{"/a/a.go", "/c/c.py"}
+	if !equalStrings(have, want) {
+		t.Errorf("IdentifierFiles(fooBar) = %v, want %v", have, want)
+	}
+	if have := identFileNames(ix1, "FooBaz"); have != nil {
+		t.Errorf("IdentifierFiles(FooBaz) = %v, want none", have)
+	}
+
+	// Merging drops /c/c.py, which lies under /c in f2.
+	// /b/b.go uses both words but not FooBar.
+	Merge(f3.Name(), f1.Name(), f2.Name())
+	if err := Verify(f3.Name()); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	ix3 := Open(f3.Name())
+	have = identFileNames(ix3, "FOO_BAR")
+	want = []string{"/a/a.go", "/b/b.go", "/c/d.py"}
+	if !equalStrings(have, want) {
+		t.Errorf("merged IdentifierFiles(FOO_BAR) = %v, want %v", have, want)
+	}
+	if lines := IdentifierLines("go", []byte("package b\n\nvar x = bar.Foo\n"), IdentifierWords("FooBar")); lines != nil {
+		t.Errorf("IdentifierLines(b.go) = %v, want none", lines)
+	}
+	if lines := IdentifierLines("go", []byte("package a\n\nfunc FooBar() { fooBar(); foo_bar() }\nvar foo_bar int\n"), IdentifierWords("FooBar")); fmt.Sprint(lines) != "[3 4]" {
+		t.Errorf("IdentifierLines(a.go) = %v, want [3 4]", lines)
+	}
+
+	buildIndex(f2.Name(), nil, map[string]string{"/x.go": "package x\n\nfunc X() {}\n"})
+	if Open(f2.Name()).HasIdentifiers() {
+		t.Errorf("index written without Identifiers has identifiers")
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Languages are named as in the file types (see filetype.go),
+// so that a file's recorded language is also one of its types.
+
+// langNames maps file names that identify a language by themselves.
+var langNames = map[string]string{
+	"BUILD":           "bazel",
+	"BUILD.bazel":     "bazel",
+	"CMakeLists.txt":  "cmake",
+	"Dockerfile":      "docker",
+	"GNUmakefile":     "make",
+	"Gemfile":         "ruby",
+	"Makefile":        "make",
+	"Rakefile":        "ruby",
+	"WORKSPACE":       "bazel",
+	"WORKSPACE.bazel": "bazel",
+	"makefile":        "make",
+}
+
+// langExts maps file name extensions to languages.
+var langExts = map[string]string{
+	".asm":      "asm",
+	".awk":      "awk",
+	".bash":     "sh",
+	".bazel":    "bazel",
+	".bzl":      "bazel",
+	".c":        "c",
+	".c++":      "cpp",
+	".cc":       "cpp",
+	".cjs":      "js",
+	".cmake":    "cmake",
+	".cpp":      "cpp",
+	".cs":       "cs",
+	".css":      "css",
+	".cts":      "ts",
+	".cxx":      "cpp",
+	".dart":     "dart",
+	".erl":      "erlang",
+	".ex":       "elixir",
+	".exs":      "elixir",
+	".go":       "go",
+	".h":        "c",
+	".h++":      "cpp",
+	".hh":       "cpp",
+	".hpp":      "cpp",
+	".hrl":      "erlang",
+	".hs":       "haskell",
+	".htm":      "html",
+	".html":     "html",
+	".hxx":      "cpp",
+	".java":     "java",
+	".js":       "js",
+	".json":     "json",
+	".jsx":      "js",
+	".kt":       "kotlin",
+	".kts":      "kotlin",
+	".less":     "css",
+	".lhs":      "haskell",
+	".lua":      "lua",
+	".m":        "objc",
+	".mak":      "make",
+	".markdown": "md",
+	".md":       "md",
+	".mjs":      "js",
+	".mk":       "make",
+	".ml":       "ml",
+	".mli":      "ml",
+	".mts":      "ts",
+	".php":      "php",
+	".pl":       "perl",
+	".pm":       "perl",
+	".proto":    "proto",
+	".py":       "py",
+	".pyi":      "py",
+	".r":        "r",
+	".rb":       "ruby",
+	".rs":       "rust",
+	".rst":      "rst",
+	".s":        "asm",
+	".sass":     "css",
+	".sbt":      "scala",
+	".scala":    "scala",
+	".scss":     "css",
+	".sh":       "sh",
+	".sql":      "sql",
+	".swift":    "swift",
+	".tex":      "tex",
+	".toml":     "toml",
+	".ts":       "ts",
+	".tsx":      "ts",
+	".txt":      "txt",
+	".vim":      "vim",
+	".xml":      "xml",
+	".xsd":      "xml",
+	".yaml":     "yaml",
+	".yml":      "yaml",
+	".zsh":      "sh",
+}
+
+// detectLanguage returns the language of the named file,
+// judging by its name, or "" if the language is unknown.
+func detectLanguage(name string) string {
+	elem := filepath.Base(name)
+	if lang, ok := langNames[elem]; ok {
+		return lang
+	}
+	return langExts[strings.ToLower(filepath.Ext(elem))]
+}
+
+// detectContentLanguage refines lang, the language of the named file
+// judging by its name, using data, the beginning of the file's text.
+// Files whose names do not identify a language are identified by a
+// #! line naming an interpreter or by an Emacs or Vim modeline
+// naming a mode, and C header files that look like C++ are taken
+// to be C++.
+func detectContentLanguage(name, lang string, data []byte) string {
+	switch lang {
+	case "":
+		if l := shebangLanguage(data); l != "" {
+			return l
+		}
+		return modelineLanguage(data)
+	case "c":
+		if strings.HasSuffix(strings.ToLower(name), ".h") && looksLikeCPP(data) {
+			return "cpp"
+		}
+	}
+	return lang
+}
+
+// interpreterLangs maps the interpreters named by #! lines to languages.
+var interpreterLangs = map[string]string{
+	"ash":        "sh",
+	"awk":        "awk",
+	"bash":       "sh",
+	"dash":       "sh",
+	"deno":       "ts",
+	"elixir":     "elixir",
+	"escript":    "erlang",
+	"gawk":       "awk",
+	"ksh":        "sh",
+	"lua":        "lua",
+	"luajit":     "lua",
+	"make":       "make",
+	"mawk":       "awk",
+	"node":       "js",
+	"nodejs":     "js",
+	"perl":       "perl",
+	"php":        "php",
+	"pypy":       "py",
+	"python":     "py",
+	"Rscript":    "r",
+	"ruby":       "ruby",
+	"runhaskell": "haskell",
+	"scala":      "scala",
+	"sh":         "sh",
+	"swift":      "swift",
+	"ts-node":    "ts",
+	"zsh":        "sh",
+}
+
+// shebangLanguage returns the language of the interpreter named by
+// the #! line at the start of data, or "" if there is none.
+func shebangLanguage(data []byte) string {
+	if !bytes.HasPrefix(data, []byte("#!")) {
+		return ""
+	}
+	line := data[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	args := strings.Fields(string(line))
+	if len(args) > 0 && path.Base(args[0]) == "env" {
+		// #!/usr/bin/env [-S] [VAR=value...] interpreter
+		args = args[1:]
+		for len(args) > 0 && (strings.HasPrefix(args[0], "-") || strings.Contains(args[0], "=")) {
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	// Drop version numbers, as in python3.11.
+	interp := strings.TrimRight(path.Base(args[0]), "0123456789.")
+	return interpreterLangs[interp]
+}
+
+// Emacs modelines, as in -*- mode: python -*- or -*- python -*-,
+// and Vim modelines, as in vim: set ft=python: or vi: filetype=sh.
+var (
+	emacsModeRE = regexp.MustCompile(`-\*-\s*(?:.*;\s*)?(?i:mode:\s*)?([\w+-]+)\s*(?:;.*)?-\*-`)
+	vimModeRE   = regexp.MustCompile(`\b(?:vim?|ex):.*\b(?:ft|filetype|syntax)=([\w+-]+)`)
+)
+
+// modelineLanguage returns the language named by an editor modeline
+// in the first five lines of data, or "" if there is none.
+func modelineLanguage(data []byte) string {
+	for i := 0; i < 5 && len(data) > 0; i++ {
+		line := data
+		if j := bytes.IndexByte(data, '\n'); j >= 0 {
+			line, data = data[:j], data[j+1:]
+		} else {
+			data = nil
+		}
+		for _, re := range []*regexp.Regexp{emacsModeRE, vimModeRE} {
+			if m := re.FindSubmatch(line); m != nil {
+				if lang, ok := LookupLanguage(string(m[1])); ok {
+					return lang
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// cppRE matches constructs found in C++ but not C.
+var cppRE = regexp.MustCompile(`(?m)^\s*(?:namespace\s+\w*\s*\{|template\s*<|class\s+\w+[^;]*$|(?:public|private|protected):|using\s+namespace\b|#include\s*<(?:string|vector|map|memory|iostream)>)`)
+
+// looksLikeCPP reports whether the header file text data looks like C++.
+func looksLikeCPP(data []byte) bool {
+	return cppRE.Match(data)
+}
+
+// langAliases maps other common names for languages to the names
+// used in the index.
+var langAliases = map[string]string{
+	"bourne":      "sh",
+	"bash":        "sh",
+	"c#":          "cs",
+	"c++":         "cpp",
+	"csharp":      "cs",
+	"docker":      "docker",
+	"dockerfile":  "docker",
+	"golang":      "go",
+	"javascript":  "js",
+	"makefile":    "make",
+	"markdown":    "md",
+	"node":        "js",
+	"objective-c": "objc",
+	"objectivec":  "objc",
+	"ocaml":       "ml",
+	"python":      "py",
+	"python3":     "py",
+	"rb":          "ruby",
+	"rs":          "rust",
+	"shell":       "sh",
+	"typescript":  "ts",
+	"yml":         "yaml",
+	"zsh":         "sh",
+}
+
+// LookupLanguage returns the name used in the index for the
+// language called name, which may be either that name or another
+// common name for the language, such as python for py or c++ for cpp.
+// It reports whether the language is one that the index records.
+func LookupLanguage(name string) (lang string, ok bool) {
+	name = strings.ToLower(name)
+	if alias, ok := langAliases[name]; ok {
+		name = alias
+	}
+	return name, knownLanguages()[name]
+}
+
+var (
+	knownLangsOnce sync.Once
+	knownLangs     map[string]bool
+)
+
+// knownLanguages returns the set of languages the index can record.
+func knownLanguages() map[string]bool {
+	knownLangsOnce.Do(func() {
+		knownLangs = make(map[string]bool)
+		for _, m := range []map[string]string{langNames, langExts, interpreterLangs} {
+			for _, lang := range m {
+				knownLangs[lang] = true
+			}
+		}
+		knownLangs["cpp"] = true
+	})
+	return knownLangs
+}
@@ -0,0 +1,59 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "testing"
+
+var detectLanguageTests = []struct {
+	name string
+	data string
+	want string
+}{
+	{"x.go", "package x\n", "go"},
+	{"Makefile", "all:\n", "make"},
+	{"notes", "nothing\n", ""},
+	{"run", "#!/bin/sh\necho hi\n", "sh"},
+	{"run", "#!/usr/bin/env python3\nprint(1)\n", "py"},
+	{"run", "#!/usr/bin/env -S PYTHONPATH=. python3.11 -u\n", "py"},
+	{"run", "#!/usr/local/bin/node\n", "js"},
+	{"run", "#!/usr/bin/frobnicate\n", ""},
+	{"x.txt", "#!/bin/sh\n", "txt"},
+	{"config", "# -*- mode: ruby -*-\n", "ruby"},
+	{"config", "// -*- c++ -*-\n", "cpp"},
+	{"config", "# -*- coding: utf-8; mode: python -*-\n", "py"},
+	{"config", "line 1\n\n# vim: set ft=sh:\n", "sh"},
+	{"config", "line 1\n2\n3\n4\n5\n# vim: ft=sh\n", ""},
+	{"x.h", "int x;\n", "c"},
+	{"x.h", "namespace foo {\nint x;\n}\n", "cpp"},
+	{"x.h", "template <typename T> T max(T, T);\n", "cpp"},
+	{"x.h", "struct s {\n\tint public_x;\n};\n", "c"},
+}
+
+func TestDetectLanguage(t *testing.T) {
+	for _, tt := range detectLanguageTests {
+		lang := detectContentLanguage(tt.name, detectLanguage(tt.name), []byte(tt.data))
+		if lang != tt.want {
+			t.Errorf("language of %s %q = %q, want %q", tt.name, tt.data, lang, tt.want)
+		}
+	}
+}
+
+func TestLookupLanguage(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"go", "go", true},
+		{"Python", "py", true},
+		{"c++", "cpp", true},
+		{"sh", "sh", true},
+		{"klingon", "klingon", false},
+	} {
+		if lang, ok := LookupLanguage(tt.name); lang != tt.want || ok != tt.ok {
+			t.Errorf("LookupLanguage(%q) = %q, %v, want %q, %v", tt.name, lang, ok, tt.want, tt.ok)
+		}
+	}
+}
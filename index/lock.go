@@ -0,0 +1,156 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Concurrent access.
+//
+// An index is never modified in place.  Create and Merge write the new
+// index to a temporary file in the same directory and then rename it
+// onto the index file, so that a reader sees either the old index or
+// the new one, never a partial one, and a reader that already has the
+// old index open (and mapped into memory) can keep using it.  The new
+// index is flushed to stable storage before the rename, and the directory
+// after it, so that a crash or power failure also leaves either the old
+// index or the new one in place (see Rename).
+//
+// To keep two writers from replacing the same index at once, a writer
+// holds an advisory lock (flock on Unix) on the index's lock file,
+// the index file name with ".lock" appended, or the file "index.lock"
+// in the directory of a sharded index, while it writes.  The lock file
+// is removed when the lock is released.  Programs that
+// update an index in several steps, such as cindex, can hold the lock
+// across all of them with Lock.  Readers need no lock, but OpenWait
+// waits for a writer to finish before opening the index.
+
+// A heldLock is a lock held by this process.
+type heldLock struct {
+	f *os.File
+	n int // number of calls to Lock not yet released
+}
+
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]*heldLock)
+)
+
+// lockName returns the name of the lock file for the index in file.
+func lockName(file string) string {
+	if IsSharded(file) {
+		return filepath.Join(file, "index.lock")
+	}
+	return file + ".lock"
+}
+
+// Lock acquires the writer's lock on the index in file, waiting for
+// any other process holding it to release it, and returns a function
+// that releases the lock.  Locks are held by the process, not the
+// calling goroutine, so a process may lock an index it already holds
+// (as when Create is called for an index locked by Lock); the lock is
+// released when every Lock has been matched by a release.
+func Lock(file string) (unlock func()) {
+	name := lockName(file)
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	l := locks[name]
+	if l == nil {
+		l = &heldLock{f: lockExclusive(name)}
+		locks[name] = l
+	}
+	l.n++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			locksMu.Lock()
+			defer locksMu.Unlock()
+			if l.n--; l.n == 0 {
+				delete(locks, name)
+				os.Remove(name)
+				l.f.Close()
+			}
+		})
+	}
+}
+
+// lockExclusive opens the lock file name and locks it exclusively.
+// Because Lock removes the lock file when releasing it, the file locked
+// may have been removed, and then lockExclusive must try again.
+func lockExclusive(name string) *os.File {
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := lockFile(f, true, true); err != nil {
+			log.Fatalf("locking %s: %v", name, err)
+		}
+		info1, err1 := f.Stat()
+		info2, err2 := os.Stat(name)
+		if err1 == nil && err2 == nil && os.SameFile(info1, info2) {
+			return f
+		}
+		f.Close()
+	}
+}
+
+// writing reports whether another process holds the writer's lock on
+// the index in file.
+func writing(file string) bool {
+	name := lockName(file)
+	locksMu.Lock()
+	held := locks[name] != nil
+	locksMu.Unlock()
+	if held {
+		return false
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return lockFile(f, false, false) != nil
+}
+
+// OpenWait is like Open, but if the index in file is being written,
+// or does not exist yet, it waits up to timeout for the writer to
+// finish, so that the caller sees the new index rather than the old one.
+func OpenWait(file string, timeout time.Duration) *Index {
+	Wait(file, timeout)
+	return Open(file)
+}
+
+// Wait waits up to timeout for the index in file to exist and for any
+// writer of it to finish, as OpenWait does before opening it.
+func Wait(file string, timeout time.Duration) {
+	if IsRemote(file) {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(file); err == nil && !writing(file) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Rename renames the index file oldpath to newpath, as os.Rename does,
+// and then flushes the directory holding newpath to stable storage,
+// so that the rename survives a crash or power failure.  The data in
+// oldpath should already be on stable storage, as it is for the files
+// written by Create and Merge.
+func Rename(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newpath))
+}
@@ -0,0 +1,78 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	f.Close()
+	file := f.Name()
+	defer os.Remove(file)
+
+	unlock1 := Lock(file)
+	unlock2 := Lock(file) // already held by this process
+	if writing(file) {
+		t.Errorf("writing reports own lock")
+	}
+	unlock2()
+	unlock2()
+	if _, err := os.Stat(lockName(file)); err != nil {
+		t.Errorf("lock file removed while still held: %v", err)
+	}
+	unlock1()
+	if _, err := os.Stat(lockName(file)); !os.IsNotExist(err) {
+		t.Errorf("lock file not removed after release: %v", err)
+	}
+
+	buildIndex(file, nil, map[string]string{"/a/x": "hello world\n"})
+
+	// Simulate another process holding the lock.
+	lf, err := os.Create(lockName(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(lf.Name())
+	if err := lockFile(lf, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if !writing(file) {
+		t.Errorf("writing does not report other lock")
+	}
+	start := time.Now()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		lf.Close()
+	}()
+	ix := OpenWait(file, 10*time.Second)
+	if d := time.Since(start); d < 200*time.Millisecond || d > 5*time.Second {
+		t.Errorf("OpenWait returned after %v, want just after 200ms", d)
+	}
+	if ix.NumFiles() != 1 {
+		t.Errorf("OpenWait: NumFiles() = %d, want 1", ix.NumFiles())
+	}
+}
+
+func TestReplaceOpenIndex(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	f.Close()
+	defer os.Remove(f.Name())
+	buildIndex(f.Name(), nil, map[string]string{"/a/x": "hello world\n"})
+	old := Open(f.Name())
+
+	// Rewriting the index must not disturb a reader of the old one.
+	buildIndex(f.Name(), nil, map[string]string{"/b/x": "goodbye\n", "/b/y": "again\n"})
+	if old.NumFiles() != 1 || old.Name(0) != "/a/x" {
+		t.Errorf("old index changed: %d files, first %q", old.NumFiles(), old.Name(0))
+	}
+	if ix := Open(f.Name()); ix.NumFiles() != 2 {
+		t.Errorf("new index has %d files, want 2", ix.NumFiles())
+	}
+}
@@ -27,12 +27,15 @@ package index
 // During the merge, translate the docid numbers to the new C docid space.
 // Also during the merge, write the posting list index to a temporary file as usual.
 // 
-// Copy the name index and posting list index into C's index and write the trailer.
+// Copy the name index, posting list index, and sections into C's index and write the trailer.
 // Rename C's index onto the new index.
 
 import (
 	"encoding/binary"
+	"fmt"
 	"os"
+	"slices"
+	"sort"
 	"strings"
 )
 
@@ -53,7 +56,8 @@ type postIndex struct {
 func Merge(dst, src1, src2 string) {
 	ix1 := Open(src1)
 	ix2 := Open(src2)
-	paths1 := ix1.Paths()
+	defer ix1.Close()
+	defer ix2.Close()
 	paths2 := ix2.Paths()
 
 	// Build docid maps.
@@ -102,13 +106,127 @@ func Merge(dst, src1, src2 string) {
 	if i2 < uint32(ix2.numName) {
 		panic("merge: inconsistent index")
 	}
-	numName := new
+	mergeMaps(dst, ix1, ix2, mergePaths(ix1.Paths(), paths2), map1, map2, new)
+}
 
-	ix3 := bufCreate(dst)
-	ix3.writeString(magic)
+// MergeAll creates a new index in the file dst that corresponds to
+// merging the indexes srcs, which are taken to be in order from oldest
+// to newest: as in Merge, if several indexes claim responsibility for
+// a path, the newest is given preference.  MergeAll writes intermediate
+// results to temporary files named by appending ~ and a number to dst.
+func MergeAll(dst string, srcs []string) {
+	if len(srcs) == 0 {
+		panic("merge: no indexes")
+	}
+	if len(srcs) == 1 {
+		// Merging an index with itself copies it.
+		Merge(dst, srcs[0], srcs[0])
+		return
+	}
+	src := srcs[0]
+	for i, file := range srcs[1:] {
+		out := dst
+		if i < len(srcs)-2 {
+			out = fmt.Sprintf("%s~%d", dst, i)
+		}
+		Merge(out, src, file)
+		if src != srcs[0] {
+			os.Remove(src)
+		}
+		src = out
+	}
+}
 
-	// Merged list of paths.
-	pathData := ix3.offset()
+// Update creates a new index in the file dst that corresponds to
+// updating the index src1 with the newer files recorded in src2.
+// Unlike Merge, Update does not discard the files in src1 that lie
+// under src2's paths: a file in src1 is discarded only if src2 has a
+// file with the same name or if remove(name) returns true.
+// This lets src2 hold just the files that have changed since src1
+// was written.
+func Update(dst, src1, src2 string, remove func(name string) bool) {
+	ix1 := Open(src1)
+	ix2 := Open(src2)
+	defer ix1.Close()
+	defer ix2.Close()
+
+	// Build docid maps by merging the two sorted name lists.
+	var i1, i2, new uint32
+	var map1, map2 []idrange
+	n1, n2 := uint32(ix1.numName), uint32(ix2.numName)
+	for i1 < n1 || i2 < n2 {
+		var name1, name2 string
+		if i1 < n1 {
+			name1 = ix1.Name(i1)
+		}
+		if i2 < n2 {
+			name2 = ix2.Name(i2)
+		}
+		switch {
+		case i2 >= n2 || i1 < n1 && name1 < name2:
+			if !remove(name1) {
+				map1 = addIdrange(map1, i1, new)
+				new++
+			}
+			i1++
+		default:
+			if i1 < n1 && name1 == name2 {
+				i1++
+			}
+			map2 = addIdrange(map2, i2, new)
+			new++
+			i2++
+		}
+	}
+	mergeMaps(dst, ix1, ix2, mergePaths(ix1.Paths(), ix2.Paths()), map1, map2, new)
+}
+
+// Remove creates a new index in the file dst that corresponds to
+// removing from the index src the files in the trees rooted at roots,
+// as reported by InTree.  The roots, and any indexed paths inside them,
+// are removed from the list of indexed paths too.
+func Remove(dst, src string, roots []string) {
+	ix := Open(src)
+	inRoots := func(name string) bool {
+		for _, root := range roots {
+			if InTree(name, root) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var paths []string
+	for _, p := range ix.Paths() {
+		if !inRoots(p) {
+			paths = append(paths, p)
+		}
+	}
+	var new uint32
+	var map1 []idrange
+	for i := uint32(0); i < uint32(ix.numName); i++ {
+		if !inRoots(ix.Name(i)) {
+			map1 = addIdrange(map1, i, new)
+			new++
+		}
+	}
+	mergeMaps(dst, ix, ix, paths, map1, nil, new)
+}
+
+// addIdrange records in m that old maps to new,
+// extending the last range in m if possible.
+func addIdrange(m []idrange, old, new uint32) []idrange {
+	if n := len(m); n > 0 && m[n-1].hi == old && m[n-1].new+m[n-1].hi-m[n-1].lo == new {
+		m[n-1].hi++
+		return m
+	}
+	return append(m, idrange{old, old + 1, new})
+}
+
+// mergePaths returns the merged list of the sorted path lists
+// paths1 and paths2, omitting paths that lie inside earlier ones.
+func mergePaths(paths1, paths2 []string) []string {
+	var paths []string
 	mi1 := 0
 	mi2 := 0
 	last := "\x00" // not a prefix of anything
@@ -125,6 +243,30 @@ func Merge(dst, src1, src2 string) {
 			continue
 		}
 		last = p
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// mergeMaps writes to dst the index covering paths made up of the
+// files of ix1 and ix2 selected by the docid maps map1 and map2,
+// which together cover the new docids [0, numName).
+// The merged list of names is compressed if either input's is.
+func mergeMaps(dst string, ix1, ix2 *Index, paths []string, map1, map2 []idrange, numName uint32) {
+	unlock := Lock(dst)
+	defer unlock()
+	compress := ix1.Compressed() || ix2.Compressed()
+	ix3 := bufCreateTemp(dst)
+	if compress {
+		ix3.writeString(magicV4)
+	} else {
+		ix3.writeString(magic)
+	}
+
+	// Merged list of paths.
+	pathData := ix3.offset()
+	ix3.startSum()
+	for _, p := range paths {
 		ix3.writeString(p)
 		ix3.writeString("\x00")
 	}
@@ -132,26 +274,54 @@ func Merge(dst, src1, src2 string) {
 
 	// Merged list of names.
 	nameData := ix3.offset()
+	sums := []uint32{ix3.sum()}
 	nameIndexFile := bufCreate("")
-	new = 0
-	mi1 = 0
-	mi2 = 0
+	names := newNameListWriter(ix3, nameIndexFile, compress)
+	metaFile := newMetaWriter(false)
+	nameTris := mergeNameTrigrams(ix1, ix2)
+	var content *contentWriter
+	if ix1.HasContent() || ix2.HasContent() {
+		content = newContentWriter(false)
+	}
+	var regions *contentWriter
+	if ix1.HasRegions() || ix2.HasRegions() {
+		regions = newRegionWriter(false)
+	}
+	new := uint32(0)
+	mi1 := 0
+	mi2 := 0
 	for new < numName {
 		if mi1 < len(map1) && map1[mi1].new == new {
 			for i := map1[mi1].lo; i < map1[mi1].hi; i++ {
 				name := ix1.Name(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
-				ix3.writeString(name)
-				ix3.writeString("\x00")
+				names.add(name)
+				if nameTris != nil {
+					nameTris.add(name)
+				}
+				metaFile.write(ix1.Meta(i))
+				if content != nil {
+					content.add(ix1.contentFrame(i))
+				}
+				if regions != nil {
+					regions.add(ix1.fileEntry(regionSection, i))
+				}
 				new++
 			}
 			mi1++
 		} else if mi2 < len(map2) && map2[mi2].new == new {
 			for i := map2[mi2].lo; i < map2[mi2].hi; i++ {
 				name := ix2.Name(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
-				ix3.writeString(name)
-				ix3.writeString("\x00")
+				names.add(name)
+				if nameTris != nil {
+					nameTris.add(name)
+				}
+				metaFile.write(ix2.Meta(i))
+				if content != nil {
+					content.add(ix2.contentFrame(i))
+				}
+				if regions != nil {
+					regions.add(ix2.fileEntry(regionSection, i))
+				}
 				new++
 			}
 			mi2++
@@ -159,19 +329,24 @@ func Merge(dst, src1, src2 string) {
 			panic("merge: inconsistent index")
 		}
 	}
-	if new*4 != nameIndexFile.offset() {
+	names.finish()
+	if (new+1)*4 != nameIndexFile.offset() {
 		panic("merge: inconsistent index")
 	}
-	nameIndexFile.writeUint32(ix3.offset())
 
 	// Merged list of posting lists.
 	postData := ix3.offset()
+	sums = append(sums, ix3.sum())
+	var aliases [][2]uint32
 	var r1 postMapReader
 	var r2 postMapReader
 	var w postDataWriter
+	aliases, r1.promote = mergeAliases(aliases, ix1, map1)
+	aliases, r2.promote = mergeAliases(aliases, ix2, map2)
 	r1.init(ix1, map1)
 	r2.init(ix2, map2)
 	w.init(ix3)
+	w.stop = newStopMerger(ix1, ix2, numName)
 	for {
 		if r1.trigram < r2.trigram {
 			w.trigram(r1.trigram)
@@ -213,22 +388,61 @@ func Merge(dst, src1, src2 string) {
 
 	// Name index
 	nameIndex := ix3.offset()
+	sums = append(sums, ix3.sum())
 	copyFile(ix3, nameIndexFile)
 
 	// Posting list index
 	postIndex := ix3.offset()
+	sums = append(sums, ix3.sum())
 	copyFile(ix3, w.postIndexFile)
 
+	// Sections
+	sectionIndex := ix3.offset()
+	sums = append(sums, ix3.sum())
+	secs := metaFile.sections()
+	if ix1.HasSymbols() || ix2.HasSymbols() {
+		syms := newSymWriter(false)
+		syms.addIndex(ix1, map1)
+		syms.addIndex(ix2, map2)
+		secs = append(secs, syms.section())
+	}
+	if ix1.HasIdentifiers() || ix2.HasIdentifiers() {
+		idents := newIdentWriter(false)
+		idents.addIndex(ix1, map1)
+		idents.addIndex(ix2, map2)
+		secs = append(secs, idents.section())
+	}
+	if content != nil {
+		secs = append(secs, content.section())
+	}
+	if regions != nil {
+		secs = append(secs, regions.section())
+	}
+	if nameTris != nil {
+		secs = append(secs, nameTris.section())
+	}
+	secs = append(secs, mergeExcludes(ix1, ix2)...)
+	secs = append(secs, mergeGitRef(ix1, ix2)...)
+	secs = append(secs, mergeAttached(ix1, ix2)...)
+	secs = append(secs, mergeNorm(ix1, ix2)...)
+	if ix1.Deduped() || ix2.Deduped() {
+		sort.Slice(aliases, func(i, j int) bool { return aliases[i][0] < aliases[j][0] })
+		secs = append(secs, aliasSectionData(aliases))
+	}
+	secs = append(secs, w.stop.sections()...)
+	writeSections(ix3, secs, sums)
+
 	ix3.writeUint32(pathData)
 	ix3.writeUint32(nameData)
 	ix3.writeUint32(postData)
 	ix3.writeUint32(nameIndex)
 	ix3.writeUint32(postIndex)
+	ix3.writeUint32(sectionIndex)
 	ix3.writeString(trailerMagic)
-	ix3.flush()
+	ix3.commit(dst)
 
-	os.Remove(nameIndexFile.name)
-	os.Remove(w.postIndexFile.name)
+	nameIndexFile.remove()
+	w.postIndexFile.remove()
 }
 
 type postMapReader struct {
@@ -242,6 +456,14 @@ type postMapReader struct {
 	oldid   uint32
 	fileid  uint32
 	i       int
+	ids     []uint32 // decoded roaring list, if any
+
+	// promote maps the IDs of dropped canonical files to the new IDs
+	// of the aliases that take their places (see mergeAliases).
+	// If it is set, load translates each list in full into mapped.
+	promote map[uint32]uint32
+	mapped  []uint32
+	buf     []uint32
 }
 
 func (r *postMapReader) init(ix *Index, idmap []idrange) {
@@ -257,6 +479,7 @@ func (r *postMapReader) nextTrigram() {
 }
 
 func (r *postMapReader) load() {
+	r.mapped = nil
 	if r.triNum >= uint32(r.ix.numPost) {
 		r.trigram = ^uint32(0)
 		r.count = 0
@@ -271,11 +494,39 @@ func (r *postMapReader) load() {
 	r.d = r.ix.slice(r.ix.postData+r.offset+3, -1)
 	r.oldid = ^uint32(0)
 	r.i = 0
+	r.ids = nil
+	if len(r.d) > 0 && r.d[0] == 0 {
+		r.ids = parseRoaring(r.d[1:]).appendIDs(make([]uint32, 0, r.count))
+		if len(r.ids) != int(r.count) {
+			corrupt()
+		}
+	}
+	if r.promote != nil {
+		// The aliases taking the places of dropped files can
+		// come anywhere in the list, so translate it in full.
+		r.buf = r.buf[:0]
+		for r.nextOld() {
+			if id, ok := mapID(r.idmap, r.oldid); ok {
+				r.buf = append(r.buf, id)
+			} else if id, ok := r.promote[r.oldid]; ok {
+				r.buf = append(r.buf, id)
+			}
+		}
+		slices.Sort(r.buf)
+		r.mapped = r.buf
+	}
 }
 
-func (r *postMapReader) nextId() bool {
-	for r.count > 0 {
-		r.count--
+// nextOld advances r.oldid to the next ID in the list, if any.
+func (r *postMapReader) nextOld() bool {
+	if r.count == 0 {
+		return false
+	}
+	r.count--
+	if r.ids != nil {
+		r.oldid = r.ids[0]
+		r.ids = r.ids[1:]
+	} else {
 		delta64, n := binary.Uvarint(r.d)
 		delta := uint32(delta64)
 		if n <= 0 || delta == 0 {
@@ -283,6 +534,21 @@ func (r *postMapReader) nextId() bool {
 		}
 		r.d = r.d[n:]
 		r.oldid += delta
+	}
+	return true
+}
+
+func (r *postMapReader) nextId() bool {
+	if r.promote != nil {
+		if len(r.mapped) > 0 {
+			r.fileid = r.mapped[0]
+			r.mapped = r.mapped[1:]
+			return true
+		}
+		r.fileid = ^uint32(0)
+		return false
+	}
+	for r.nextOld() {
 		for r.i < len(r.idmap) && r.idmap[r.i].hi <= r.oldid {
 			r.i++
 		}
@@ -304,11 +570,11 @@ func (r *postMapReader) nextId() bool {
 type postDataWriter struct {
 	out           *bufWriter
 	postIndexFile *bufWriter
-	buf           [10]byte
 	base          uint32
-	count, offset uint32
-	last          uint32
+	ids           []uint32
+	buf           []byte
 	t             uint32
+	stop          *stopMerger
 }
 
 func (w *postDataWriter) init(out *bufWriter) {
@@ -318,27 +584,22 @@ func (w *postDataWriter) init(out *bufWriter) {
 }
 
 func (w *postDataWriter) trigram(t uint32) {
-	w.offset = w.out.offset()
-	w.count = 0
+	w.ids = w.ids[:0]
 	w.t = t
-	w.last = ^uint32(0)
 }
 
 func (w *postDataWriter) fileid(id uint32) {
-	if w.count == 0 {
-		w.out.writeTrigram(w.t)
-	}
-	w.out.writeUvarint(id - w.last)
-	w.last = id
-	w.count++
+	w.ids = append(w.ids, id)
 }
 
 func (w *postDataWriter) endTrigram() {
-	if w.count == 0 {
+	if len(w.ids) == 0 || w.stop.isStop(w.t, len(w.ids)) {
 		return
 	}
-	w.out.writeUvarint(0)
+	offset := w.out.offset()
+	w.out.writeTrigram(w.t)
+	w.buf = writePostList(w.out, w.ids, w.buf)
 	w.postIndexFile.writeTrigram(w.t)
-	w.postIndexFile.writeUint32(w.count)
-	w.postIndexFile.writeUint32(w.offset - w.base)
+	w.postIndexFile.writeUint32(uint32(len(w.ids)))
+	w.postIndexFile.writeUint32(offset - w.base)
 }
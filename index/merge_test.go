@@ -5,6 +5,7 @@
 package index
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -100,3 +101,158 @@ func TestMerge(t *testing.T) {
 	check(ix3, "now", 3, 4, 6)
 	check(ix3, "pot", 4, 5, 7)
 }
+
+var updateFiles2 = map[string]string{
+	"/b/xx": "no, not now",
+	"/b/zz": "first potatoes, now liberty?",
+}
+
+func TestUpdate(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	out1 := f1.Name()
+	out2 := f2.Name()
+	out3 := f3.Name()
+
+	buildIndex(out1, mergePaths1, mergeFiles1)
+	buildIndex(out2, []string{"/b"}, updateFiles2)
+
+	Update(out3, out1, out2, func(name string) bool {
+		return name == "/c/de"
+	})
+
+	ix3 := Open(out3)
+	names := []string{"/a/x", "/a/y", "/b/xx", "/b/xy", "/b/zz", "/c/ab"}
+	if ix3.NumFiles() != len(names) {
+		t.Errorf("NumFiles() = %d, want %d", ix3.NumFiles(), len(names))
+	}
+	for i, s := range names {
+		if n := ix3.Name(uint32(i)); n != s {
+			t.Errorf("Name(%d) = %s, want %s", i, n, s)
+		}
+		data, ok := updateFiles2[s]
+		if !ok {
+			data = mergeFiles1[s]
+		}
+		if m := ix3.Meta(uint32(i)); m.Size != int64(len(data)) {
+			t.Errorf("Meta(%d).Size = %d, want %d", i, m.Size, len(data))
+		}
+	}
+	if id, ok := ix3.Lookup("/b/zz"); !ok || id != 4 {
+		t.Errorf("Lookup(/b/zz) = %d, %v, want 4, true", id, ok)
+	}
+	if _, ok := ix3.Lookup("/c/de"); ok {
+		t.Errorf("Lookup(/c/de) found removed file")
+	}
+
+	check := func(trig string, l ...uint32) {
+		l1 := ix3.PostingList(tri(trig[0], trig[1], trig[2]))
+		if !equalList(l1, l) {
+			t.Errorf("PostingList(%s) = %v, want %v", trig, l1, l)
+		}
+	}
+	check("now", 2, 4)
+	check("tim")
+	check("all", 3, 5)
+	check("pot", 4, 5)
+	check("dea")
+}
+
+func TestRemove(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+
+	buildIndex(f1.Name(), mergePaths1, mergeFiles1)
+	Remove(f2.Name(), f1.Name(), []string{"/b", "/c/de", "/x"})
+
+	ix := Open(f2.Name())
+	if paths, want := ix.Paths(), []string{"/a", "/c"}; !equalStrings(paths, want) {
+		t.Errorf("Paths() = %v, want %v", paths, want)
+	}
+	names := []string{"/a/x", "/a/y", "/c/ab"}
+	var have []string
+	for i := 0; i < ix.NumFiles(); i++ {
+		have = append(have, ix.Name(uint32(i)))
+	}
+	if !equalStrings(have, names) {
+		t.Errorf("names = %v, want %v", have, names)
+	}
+	if l := ix.PostingList(tri('w', 'o', 'r')); !equalList(l, []uint32{0, 1}) {
+		t.Errorf("PostingList(wor) = %v, want [0 1]", l)
+	}
+	if l := ix.PostingList(tri('a', 'l', 'l')); !equalList(l, []uint32{2}) {
+		t.Errorf("PostingList(all) = %v, want [2]", l)
+	}
+	if l := ix.PostingList(tri('n', 'o', 'w')); len(l) != 0 {
+		t.Errorf("PostingList(now) = %v, want []", l)
+	}
+
+	for _, tt := range []struct {
+		name, root string
+		in         bool
+	}{
+		{"/b", "/b", true},
+		{"/b/x", "/b", true},
+		{"/bb/x", "/b", false},
+		{"/r.git@HEAD:x", "/r.git@HEAD", true},
+		{"/a/x.jar!/y", "/a/x.jar", true},
+		{"/a/x.jar!/y", "/a/x", false},
+	} {
+		if in := InTree(tt.name, tt.root); in != tt.in {
+			t.Errorf("InTree(%q, %q) = %v, want %v", tt.name, tt.root, in, tt.in)
+		}
+	}
+}
+
+func TestMergeAll(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	f4, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+	defer os.Remove(f4.Name())
+
+	buildIndex(f1.Name(), mergePaths1, mergeFiles1)
+	buildIndex(f2.Name(), mergePaths2, mergeFiles2)
+	buildIndex(f3.Name(), []string{"/c", "/d"}, map[string]string{
+		"/c/ab": "potatoes again",
+		"/d/x":  "new world",
+	})
+	MergeAll(f4.Name(), []string{f1.Name(), f2.Name(), f3.Name()})
+
+	ix := Open(f4.Name())
+	if paths, want := ix.Paths(), []string{"/a", "/b", "/c", "/d"}; !equalStrings(paths, want) {
+		t.Errorf("Paths() = %v, want %v", paths, want)
+	}
+	names := []string{"/a/x", "/a/y", "/b/www", "/b/xx", "/b/yy", "/c/ab", "/d/x"}
+	var have []string
+	for i := 0; i < ix.NumFiles(); i++ {
+		have = append(have, ix.Name(uint32(i)))
+	}
+	if !equalStrings(have, names) {
+		t.Errorf("names = %v, want %v", have, names)
+	}
+	if l := ix.PostingList(tri('p', 'o', 't')); !equalList(l, []uint32{4, 5}) {
+		t.Errorf("PostingList(pot) = %v, want [4 5]", l)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := os.Stat(fmt.Sprintf("%s~%d", f4.Name(), i)); err == nil {
+			t.Errorf("temporary file %s~%d not removed", f4.Name(), i)
+		}
+	}
+
+	// Merging a single index copies it.
+	MergeAll(f4.Name(), []string{f2.Name()})
+	if ix := Open(f4.Name()); ix.NumFiles() != len(mergeFiles2) {
+		t.Errorf("copy has %d files, want %d", ix.NumFiles(), len(mergeFiles2))
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc64"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Per-file metadata.  See read.go for the on-disk format of the
+// "meta", "lang", and "repo" sections.
+
+const (
+	metaSection    = "meta"
+	langSection    = "lang"
+	repoSection    = "repo"
+	metaRecordSize = 8 + 8 + 8 + 4 + 4
+
+	// minMetaRecordSize is the size of the records written
+	// before they recorded the repository.
+	minMetaRecordSize = 8 + 8 + 8 + 4
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// A FileMeta records information about a file at the time it was indexed.
+type FileMeta struct {
+	Size    int64     // length in bytes
+	ModTime time.Time // modification time; zero if unknown
+	Hash    uint64    // CRC-64 (ECMA) of the file content
+	Lang    string    // language, such as "go" or "py"; empty if unknown
+	Repo    string    // repository holding the file; empty if none (see SetRepo)
+}
+
+// Unchanged reports whether the file described by info appears
+// to be unchanged since it was indexed with metadata m.
+func (m FileMeta) Unchanged(info os.FileInfo) bool {
+	return !m.ModTime.IsZero() && m.Size == info.Size() && m.ModTime.Equal(info.ModTime())
+}
+
+// Changed reports whether the indexed file with the given fileid has
+// changed on disk since it was indexed, judging by its size and
+// modification time, and gone whether it no longer exists.  Files read
+// from git trees or archives, and the files of indexes recording no
+// metadata, are not checked and are reported as unchanged.
+func (ix *Index) Changed(fileid uint32) (changed, gone bool) {
+	m := ix.Meta(fileid)
+	if m.ModTime.IsZero() {
+		return false, false
+	}
+	name := ix.Name(fileid)
+	if _, _, _, ok := splitGitName(name); ok {
+		return false, false
+	}
+	if _, _, ok := SplitArchiveName(name); ok {
+		return false, false
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return os.IsNotExist(err), os.IsNotExist(err)
+	}
+	return !m.Unchanged(info), false
+}
+
+// HasMeta reports whether the index records metadata about its files.
+func (ix *Index) HasMeta() bool {
+	return ix.section(metaSection) != nil
+}
+
+// Meta returns the metadata recorded for the given fileid.
+// If the index has no metadata, Meta returns a zero FileMeta.
+func (ix *Index) Meta(fileid uint32) FileMeta {
+	rec := ix.metaRecord(fileid)
+	if rec == nil {
+		return FileMeta{}
+	}
+	m := decodeMeta(rec)
+	m.Lang = ix.sectionName(langSection, &ix.langs, binary.BigEndian.Uint32(rec[24:]))
+	if len(rec) >= 32 {
+		m.Repo = ix.sectionName(repoSection, &ix.repos, binary.BigEndian.Uint32(rec[28:]))
+	}
+	return m
+}
+
+// Repos returns the names of the repositories holding the indexed files.
+func (ix *Index) Repos() []string {
+	return append([]string(nil), ix.sectionNames(repoSection, &ix.repos)...)
+}
+
+// PathRepo returns the repository holding the files in the tree
+// rooted at the indexed path, as recorded for the first of them,
+// or the empty string if there are no such files.
+func (ix *Index) PathRepo(path string) string {
+	path = slashName(path)
+	i := sort.Search(ix.numName, func(i int) bool { return ix.Name(uint32(i)) >= path })
+	if i < ix.numName && InTree(ix.Name(uint32(i)), path) {
+		return ix.Meta(uint32(i)).Repo
+	}
+	return ""
+}
+
+// A sectionList caches the names listed in a section of an index.
+// An Index is shared by concurrent searches, so the names are read
+// once, the first time they are needed, under once.
+type sectionList struct {
+	once  sync.Once
+	names []string
+}
+
+// sectionName returns the n'th name (counting from 1) listed in the
+// named section, or the empty string if n is 0.  The names are read
+// into cache the first time they are needed.
+func (ix *Index) sectionName(name string, cache *sectionList, n uint32) string {
+	if n == 0 {
+		return ""
+	}
+	names := ix.sectionNames(name, cache)
+	if int(n) > len(names) {
+		corrupt()
+	}
+	return names[n-1]
+}
+
+// sectionNames returns the NUL-terminated names listed in the named
+// section, reading them into cache if they have not been read yet.
+func (ix *Index) sectionNames(name string, cache *sectionList) []string {
+	cache.once.Do(func() {
+		var names []string
+		d := ix.section(name)
+		for len(d) > 0 {
+			i := bytes.IndexByte(d, 0)
+			if i < 0 {
+				corrupt()
+			}
+			names = append(names, string(d[:i]))
+			d = d[i+1:]
+		}
+		cache.names = names
+	})
+	return cache.names
+}
+
+// metaRecord returns the raw metadata record for the given fileid,
+// or nil if the index has no metadata.
+func (ix *Index) metaRecord(fileid uint32) []byte {
+	d := ix.section(metaSection)
+	if len(d) < 4 {
+		return nil
+	}
+	size := binary.BigEndian.Uint32(d)
+	off := 4 + uint64(fileid)*uint64(size)
+	if size < minMetaRecordSize || off+uint64(size) > uint64(len(d)) {
+		corrupt()
+	}
+	return d[off : off+uint64(size)]
+}
+
+// decodeMeta decodes the fields of a metadata record other than
+// the language and repository, which require the lang and repo sections.
+func decodeMeta(rec []byte) FileMeta {
+	m := FileMeta{
+		Size: int64(binary.BigEndian.Uint64(rec)),
+		Hash: binary.BigEndian.Uint64(rec[16:]),
+	}
+	if t := int64(binary.BigEndian.Uint64(rec[8:])); t != 0 {
+		m.ModTime = time.Unix(0, t)
+	}
+	return m
+}
+
+// A metaWriter writes the meta section and the lang and repo
+// sections listing the languages and repositories that its
+// records refer to.
+type metaWriter struct {
+	meta  *bufWriter // temp file holding meta section
+	langs nameIDs
+	repos nameIDs
+}
+
+func newMetaWriter(mem bool) *metaWriter {
+	w := &metaWriter{
+		meta: newTempBuf(mem),
+	}
+	w.meta.writeUint32(metaRecordSize)
+	return w
+}
+
+// write writes the metadata record m.
+func (w *metaWriter) write(m FileMeta) {
+	var t int64
+	if !m.ModTime.IsZero() {
+		t = m.ModTime.UnixNano()
+	}
+	w.meta.writeUint64(uint64(m.Size))
+	w.meta.writeUint64(uint64(t))
+	w.meta.writeUint64(m.Hash)
+	w.meta.writeUint32(w.langs.id(m.Lang))
+	w.meta.writeUint32(w.repos.id(m.Repo))
+}
+
+// sections returns the meta, lang, and repo sections for writeSections.
+func (w *metaWriter) sections() []sectionData {
+	return []sectionData{{metaSection, w.meta}, w.langs.section(langSection), w.repos.section(repoSection)}
+}
+
+// A nameIDs assigns ids, counting from 1, to the names
+// listed in a section such as the lang section.
+type nameIDs struct {
+	ids   map[string]uint32 // name to id
+	names []string          // names, in id order
+}
+
+// id returns the id for name, or 0 if name is empty.
+func (t *nameIDs) id(name string) uint32 {
+	if name == "" {
+		return 0
+	}
+	id := t.ids[name]
+	if id == 0 {
+		if t.ids == nil {
+			t.ids = make(map[string]uint32)
+		}
+		t.names = append(t.names, name)
+		id = uint32(len(t.names))
+		t.ids[name] = id
+	}
+	return id
+}
+
+// section returns the named section listing the names,
+// which are few enough to hold in memory.
+func (t *nameIDs) section(name string) sectionData {
+	d := bufCreateMem()
+	for _, s := range t.names {
+		d.writeString(s)
+		d.writeString("\x00")
+	}
+	return sectionData{name, d}
+}
+
+// A sectionData is a named section waiting to be written to an index.
+type sectionData struct {
+	name string
+	data *bufWriter
+}
+
+// writeSections writes the section index followed by the given
+// sections to out, removing any temporary files holding them.
+// The last section is the crc section, listing sums, the checksums of
+// the parts of the index already written, and then the checksums of
+// the section index and of each section.  Out must be computing
+// checksums (see startSum), and sums must hold one per part.
+func writeSections(out *bufWriter, secs []sectionData, sums []uint32) {
+	off := out.offset() + 1
+	for _, s := range secs {
+		off += uint32(len(s.name)) + 1 + 8
+	}
+	off += uint32(len(crcSection)) + 1 + 8
+	for _, s := range secs {
+		n := s.data.offset()
+		out.writeString(s.name)
+		out.writeString("\x00")
+		out.writeUint32(off)
+		out.writeUint32(n)
+		off += n
+	}
+	out.writeString(crcSection)
+	out.writeString("\x00")
+	out.writeUint32(off)
+	out.writeUint32(uint32(4 * (len(sums) + 1 + len(secs))))
+	out.writeString("\x00")
+	sums = append(sums, out.sum())
+	for _, s := range secs {
+		copyFile(out, s.data)
+		s.data.remove()
+		sums = append(sums, out.sum())
+	}
+	for _, sum := range sums {
+		out.writeUint32(sum)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"log"
 	"os"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 // missing from package syscall on freebsd, openbsd
@@ -37,3 +39,22 @@ func mmapFile(f *os.File) mmapData {
 	}
 	return mmapData{f, data[:n]}
 }
+
+// close unmaps the data and closes the file.
+func (m *mmapData) close() error {
+	var err error
+	if m.d != nil {
+		err = syscall.Munmap(m.d)
+		m.d = nil
+	}
+	if e := m.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// willNeed advises the kernel that b, which must begin on a page
+// boundary, will be needed soon, so that it can start reading it in.
+func willNeed(b []byte) {
+	unix.Madvise(b, unix.MADV_WILLNEED)
+}
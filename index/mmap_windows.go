@@ -32,6 +32,32 @@ func mmapFile(f *os.File) mmapData {
 	if err != nil {
 		log.Fatalf("MapViewOfFile %s: %v", f.Name(), err)
 	}
+	// The view keeps the mapping open.
+	syscall.CloseHandle(h)
 	data := (*[1 << 30]byte)(unsafe.Pointer(addr))
 	return mmapData{f, data[:size]}
 }
+
+// close unmaps the data and closes the file.
+func (m *mmapData) close() error {
+	var err error
+	if m.d != nil {
+		err = syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&m.d[0])))
+		m.d = nil
+	}
+	if e := m.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// willNeed reads b, which must begin on a page boundary, into memory.
+// Windows has no equivalent of madvise(MADV_WILLNEED) in package
+// syscall, so willNeed touches each page itself.
+func willNeed(b []byte) {
+	for i := 0; i < len(b); i += 4096 {
+		touched += b[i]
+	}
+}
+
+var touched byte
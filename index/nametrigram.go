@@ -0,0 +1,250 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+)
+
+// File name trigrams.
+//
+// A search limited to files whose names match a regexp, as by csearch
+// -f, would otherwise have to match the regexp against the name of
+// every file the content query selects, which is every indexed file
+// for a query that narrows the search little.  An index can instead
+// record the trigrams of the file names, in the optional "nametri"
+// section, so that the trigram query for the name regexp narrows the
+// files as the content query does, and only the names of files that
+// pass both need be matched.  The section has the form:
+//
+//	trigram count [4]
+//	index entries, in order by trigram:
+//		trigram [3]
+//		file count [4]
+//		offset [4], relative to the section start
+//	posting lists
+//
+// Each posting list is a delta list, as in the main posting lists,
+// of the files whose names contain the trigram.
+
+const nameTrigramSection = "nametri"
+
+// A nameTrigramWriter collects the trigrams of the file names
+// added to an index, in file ID order.
+type nameTrigramWriter struct {
+	lists  map[uint32]*nameTrigramList
+	fileid uint32 // ID of the next file
+}
+
+// A nameTrigramList is a posting list being built.
+type nameTrigramList struct {
+	count uint32
+	next  uint32 // one more than the last file ID added
+	data  []byte // deltas
+}
+
+func newNameTrigramWriter() *nameTrigramWriter {
+	return &nameTrigramWriter{lists: make(map[uint32]*nameTrigramList)}
+}
+
+// add records the trigrams of the name of the next file.
+func (w *nameTrigramWriter) add(name string) {
+	id := w.fileid
+	w.fileid++
+	for i := 0; i+3 <= len(name); i++ {
+		t := uint32(name[i])<<16 | uint32(name[i+1])<<8 | uint32(name[i+2])
+		l := w.lists[t]
+		if l == nil {
+			l = new(nameTrigramList)
+			w.lists[t] = l
+		} else if l.next == id+1 {
+			// Already seen in this name.
+			continue
+		}
+		l.data = binary.AppendUvarint(l.data, uint64(id+1-l.next))
+		l.next = id + 1
+		l.count++
+	}
+}
+
+// section returns the nametri section listing the trigrams collected.
+func (w *nameTrigramWriter) section() sectionData {
+	tris := make([]uint32, 0, len(w.lists))
+	for t := range w.lists {
+		tris = append(tris, t)
+	}
+	sort.Slice(tris, func(i, j int) bool { return tris[i] < tris[j] })
+
+	out := bufCreateMem()
+	out.writeUint32(uint32(len(tris)))
+	off := uint32(4 + len(tris)*postEntrySize)
+	for _, t := range tris {
+		l := w.lists[t]
+		out.writeTrigram(t)
+		out.writeUint32(l.count)
+		out.writeUint32(off)
+		off += uint32(len(l.data)) + 1
+	}
+	for _, t := range tris {
+		out.write(w.lists[t].data)
+		out.writeByte(0)
+	}
+	return sectionData{nameTrigramSection, out}
+}
+
+// HasNameTrigrams reports whether the index records
+// the trigrams of its file names (see IndexWriter.NameTrigrams).
+func (ix *Index) HasNameTrigrams() bool {
+	_, ok := ix.sections[nameTrigramSection]
+	return ok
+}
+
+// nameTrigramList returns the files whose names contain trigram.
+func (ix *Index) nameTrigramList(trigram uint32) []uint32 {
+	d := ix.section(nameTrigramSection)
+	if len(d) < 4 {
+		corrupt()
+	}
+	n := int(binary.BigEndian.Uint32(d))
+	if len(d) < 4+n*postEntrySize {
+		corrupt()
+	}
+	entry := func(i int) []byte { return d[4+i*postEntrySize:] }
+	i := sort.Search(n, func(i int) bool {
+		e := entry(i)
+		return uint32(e[0])<<16|uint32(e[1])<<8|uint32(e[2]) >= trigram
+	})
+	if i == n {
+		return nil
+	}
+	e := entry(i)
+	if uint32(e[0])<<16|uint32(e[1])<<8|uint32(e[2]) != trigram {
+		return nil
+	}
+	count := binary.BigEndian.Uint32(e[3:])
+	off := binary.BigEndian.Uint32(e[7:])
+	if int(off) > len(d) {
+		corrupt()
+	}
+	d = d[off:]
+	list := make([]uint32, 0, count)
+	fileid := ^uint32(0)
+	for {
+		delta, n := binary.Uvarint(d)
+		if n <= 0 {
+			corrupt()
+		}
+		d = d[n:]
+		if delta == 0 {
+			break
+		}
+		fileid += uint32(delta)
+		list = append(list, fileid)
+	}
+	return list
+}
+
+// nameQuery returns the files whose names may match q, according to
+// the trigrams of their names.  The index must record them.
+func (ix *Index) nameQuery(q *Query) []uint32 {
+	var list []uint32
+	switch q.Op {
+	case QAll:
+		return ix.allFiles(nil)
+	case QAnd:
+		all := true
+		and := func(l []uint32) {
+			if all {
+				list, all = l, false
+			} else {
+				list = mergeAnd(list, l)
+			}
+		}
+		for _, t := range q.Trigram {
+			var l []uint32
+			for _, tri := range trigramVariants(t, q.Fold) {
+				l = mergeOr(l, ix.nameTrigramList(tri))
+			}
+			if and(l); len(list) == 0 {
+				return nil
+			}
+		}
+		for _, sub := range q.Sub {
+			if and(ix.nameQuery(sub)); len(list) == 0 {
+				return nil
+			}
+		}
+		if all {
+			return ix.allFiles(nil)
+		}
+	case QOr:
+		for _, t := range q.Trigram {
+			for _, tri := range trigramVariants(t, q.Fold) {
+				list = mergeOr(list, ix.nameTrigramList(tri))
+			}
+		}
+		for _, sub := range q.Sub {
+			list = mergeOr(list, ix.nameQuery(sub))
+		}
+	}
+	return list
+}
+
+// mergeAnd returns the file IDs in both of the sorted lists l1 and l2.
+func mergeAnd(l1, l2 []uint32) []uint32 {
+	var l []uint32
+	for i, j := 0, 0; i < len(l1) && j < len(l2); {
+		switch {
+		case l1[i] < l2[j]:
+			i++
+		case l1[i] > l2[j]:
+			j++
+		default:
+			l = append(l, l1[i])
+			i++
+			j++
+		}
+	}
+	return l
+}
+
+// PostingQueryNames is like PostingQuery, but if the index records the
+// trigrams of its file names, it also omits the files whose names
+// cannot match the query names, such as the trigram query for the
+// regexp that the names of the files searched must match.  A nil names
+// query omits no files.
+func (ix *Index) PostingQueryNames(q, names *Query) []uint32 {
+	list, _ := ix.PostingQueryNamesContext(context.Background(), q, names)
+	return list
+}
+
+// PostingQueryNamesContext is like PostingQueryNames, but it gives up
+// and returns ctx.Err() if ctx is done before the query finishes.
+func (ix *Index) PostingQueryNamesContext(ctx context.Context, q, names *Query) ([]uint32, error) {
+	var restrict []uint32
+	if names != nil && names.Op != QAll && ix.HasNameTrigrams() {
+		restrict = ix.nameQuery(names)
+		if len(restrict) == 0 {
+			return nil, nil
+		}
+	}
+	list := ix.aliasQuery(ctx, q, restrict)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// mergeNameTrigrams returns a nameTrigramWriter for the merge
+// of ix1 and ix2 if either records the trigrams of its file names,
+// and otherwise nil.
+func mergeNameTrigrams(ix1, ix2 *Index) *nameTrigramWriter {
+	if ix1.HasNameTrigrams() || ix2.HasNameTrigrams() {
+		return newNameTrigramWriter()
+	}
+	return nil
+}
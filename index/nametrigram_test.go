@@ -0,0 +1,114 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+var nameTrigramFiles = []string{
+	"/src/cmd/main.go",
+	"/src/cmd/main_test.go",
+	"/src/lib/Parse.go",
+	"/src/lib/README",
+	"/src/lib/parse_test.go",
+	"/src/web/index.html",
+}
+
+var nameTrigramTests = []string{
+	`_test\.go$`,
+	`(?i)parse`,
+	`^/src/(cmd|web)/`,
+	`main|index`,
+	`\.go$`,
+	`README`,
+	`nothing`,
+	`.`,
+}
+
+func TestNameTrigrams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(file string, names []string) {
+		ix := Create(file)
+		ix.NameTrigrams = true
+		ix.AddPaths(names)
+		for _, name := range names {
+			ix.Add(name, strings.NewReader("package x\n"))
+		}
+		ix.Flush()
+	}
+	all := filepath.Join(dir, "all")
+	write(all, nameTrigramFiles)
+	half1, half2, merged := filepath.Join(dir, "half1"), filepath.Join(dir, "half2"), filepath.Join(dir, "merged")
+	write(half1, nameTrigramFiles[:3])
+	write(half2, nameTrigramFiles[3:])
+	Merge(merged, half1, half2)
+
+	query := func(re string) *Query {
+		r, err := syntax.Parse(re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return RegexpQuery(r)
+	}
+	content := query("package")
+	for _, file := range []string{all, merged} {
+		if err := Verify(file); err != nil {
+			t.Errorf("Verify(%s): %v", filepath.Base(file), err)
+		}
+		ix := Open(file)
+		if !ix.HasNameTrigrams() {
+			t.Errorf("%s: no name trigrams", filepath.Base(file))
+			continue
+		}
+		for _, pat := range nameTrigramTests {
+			re := regexp.MustCompile(pat)
+			var want, got []string
+			for id := 0; id < ix.NumFiles(); id++ {
+				if name := ix.Name(uint32(id)); re.MatchString(name) {
+					want = append(want, name)
+				}
+			}
+			for _, id := range ix.PostingQueryNames(content, query(pat)) {
+				if name := ix.Name(id); re.MatchString(name) {
+					got = append(got, name)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %#q: found %v, want %v", filepath.Base(file), pat, got, want)
+			}
+		}
+	}
+
+	if ids := Open(all).PostingQueryNames(content, query("README|nothing")); len(ids) != 1 {
+		t.Errorf("with name trigrams: %d files for README|nothing, want 1", len(ids))
+	}
+
+	// Without name trigrams, the names do not narrow the query.
+	ix := Create(all)
+	for _, name := range nameTrigramFiles {
+		ix.Add(name, strings.NewReader("package x\n"))
+	}
+	ix.Flush()
+	r := Open(all)
+	if r.HasNameTrigrams() {
+		t.Errorf("index without NameTrigrams has name trigrams")
+	}
+	if n := len(r.PostingQueryNames(content, query("nothing"))); n != len(nameTrigramFiles) {
+		t.Errorf("without name trigrams: %d files, want %d", n, len(nameTrigramFiles))
+	}
+}
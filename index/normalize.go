@@ -0,0 +1,58 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Unicode normalization.
+//
+// Many accented letters can be written either as one code point, such
+// as é (U+00E9), or as a letter followed by a combining mark, such as
+// e followed by U+0301, and editors and tools differ in which they
+// write.  The two forms share no trigrams, so a search for one misses
+// files holding the other.  An index written with IndexWriter.Normalize
+// set holds the trigrams of the text of each file in Unicode
+// normalization form NFC, which uses the composed forms, and records
+// so in the optional "norm" section, a single NUL-terminated name of
+// the form.  A search of such an index should normalize its pattern,
+// and the text it reads, to the same form (see Index.Normalized).
+
+const normSection = "norm"
+
+// normSectionData returns the norm section recording NFC.
+func normSectionData() sectionData {
+	w := bufCreateMem()
+	w.writeString("NFC\x00")
+	return sectionData{normSection, w}
+}
+
+// Normalized reports whether the index holds the trigrams of text
+// in Unicode normalization form NFC, as set by IndexWriter.Normalize.
+func (ix *Index) Normalized() bool {
+	return string(ix.section(normSection)) == "NFC\x00"
+}
+
+// mergeNorm returns the norm section for the merge of ix1 and ix2,
+// if both are normalized, not counting an index holding no files.
+// A merged index holding the trigrams of files that were not
+// normalized must not claim to be.
+func mergeNorm(ix1, ix2 *Index) []sectionData {
+	n1 := ix1.Normalized() || ix1.numName == 0
+	n2 := ix2.Normalized() || ix2.numName == 0
+	if n1 && n2 && (ix1.Normalized() || ix2.Normalized()) {
+		return []sectionData{normSectionData()}
+	}
+	return nil
+}
+
+// normReader returns a reader for the text read from r
+// in Unicode normalization form NFC.
+func normReader(r io.Reader) io.Reader {
+	return norm.NFC.Reader(r)
+}
@@ -0,0 +1,96 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp/syntax"
+	"testing"
+)
+
+var normFiles = []string{
+	"caf\u00e9 au lait\n",  // composed
+	"cafe\u0301 au lait\n", // decomposed
+}
+
+// buildNormIndex builds a temporary index of path holding files,
+// named path/0, path/1, and so on, normalizing their text if normalize
+// is set.  It returns the name of the index file.
+func buildNormIndex(t *testing.T, normalize bool, path string, files []string) string {
+	f, err := ioutil.TempFile("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fileData := make(map[string]string)
+	for i, text := range files {
+		fileData[path+"/"+string(rune('0'+i))] = text
+	}
+	buildIndexWith(f.Name(), []string{path}, fileData, normalizing(normalize))
+	return f.Name()
+}
+
+// normalizing returns a function that configures an IndexWriter
+// to normalize the text of files to NFC if on is set.
+func normalizing(on bool) func(ix *IndexWriter) {
+	return func(ix *IndexWriter) { ix.Normalize = on }
+}
+
+func TestNormalize(t *testing.T) {
+	plain := buildNormIndex(t, false, "/a", normFiles)
+	defer os.Remove(plain)
+	nfc := buildNormIndex(t, true, "/b", normFiles)
+	defer os.Remove(nfc)
+	nfc2 := buildNormIndex(t, true, "/c", normFiles)
+	defer os.Remove(nfc2)
+	empty := buildNormIndex(t, false, "/d", nil)
+	defer os.Remove(empty)
+
+	re, err := syntax.Parse("caf\u00e9", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := RegexpQuery(re)
+	for _, tt := range []struct {
+		file string
+		norm bool
+		want []uint32
+	}{
+		{plain, false, []uint32{0}},
+		{nfc, true, []uint32{0, 1}},
+	} {
+		ix := Open(tt.file)
+		if ix.Normalized() != tt.norm {
+			t.Errorf("Normalized() = %v, want %v", ix.Normalized(), tt.norm)
+		}
+		if l := ix.PostingQuery(q); !equalList(l, tt.want) {
+			t.Errorf("Normalized() = %v: PostingQuery(%s) = %v, want %v", tt.norm, q, l, tt.want)
+		}
+		if err := Verify(tt.file); err != nil {
+			t.Errorf("Verify: %v", err)
+		}
+	}
+
+	// A merged index is normalized only if all its files are.
+	out := nfc + ".merge"
+	defer os.Remove(out)
+	for _, tt := range []struct {
+		src1, src2 string
+		want       bool
+	}{
+		{nfc, nfc2, true},
+		{plain, nfc, false},
+		{nfc, plain, false},
+		{empty, nfc, true},
+		{nfc, empty, true},
+		{empty, plain, false},
+	} {
+		Merge(out, tt.src1, tt.src2)
+		if n := Open(out).Normalized(); n != tt.want {
+			t.Errorf("Merge: Normalized() = %v, want %v", n, tt.want)
+		}
+	}
+}
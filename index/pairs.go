@@ -0,0 +1,314 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc64"
+	"io"
+	"os"
+	"sort"
+)
+
+// Pair lists.
+//
+// A broad query, such as one for a common identifier, needs the
+// posting lists of common trigrams, and on a large index reading those
+// long lists is most of the time spent finding its candidate files.
+// WritePairs precomputes the intersections of the posting lists of
+// every pair of the most common trigrams in an index and writes them
+// to an auxiliary file beside it, named by adding ".pairs" to the name
+// of the index.  Open loads the file if it is there, and a query that
+// needs both trigrams of a pair starts from their intersection instead
+// of reading both lists.  For n trigrams the file holds n(n-1)/2
+// lists, so n is best kept to a few dozen.
+//
+// The file records the size of the index and a checksum of its last
+// bytes, which hold its section index and checksums, so that a file
+// left beside an index that has since been rewritten is ignored.
+// Its format is:
+//
+//	"csearch pairs 1\n"
+//	index size [8]
+//	index tail checksum, CRC-64 (ECMA) [8]
+//	number of trigrams asked for [4]
+//	number of trigrams, n [4]
+//	trigrams, in increasing order [3]...
+//	pair index: for each pair of trigrams i < j, in order,
+//		number of files [4], offset of list [4]
+//	lists: for each pair, its file IDs as uvarint deltas
+//
+// The offsets of the lists are relative to the end of the pair index.
+// As in a posting list, the first delta is from -1.
+
+const pairsMagic = "csearch pairs 1\n"
+
+// pairsTail is how many bytes at the end of an index
+// the checksum recorded in its pairs file covers.
+const pairsTail = 4096
+
+// pairsFile returns the name of the pairs file of the index file.
+func pairsFile(file string) string {
+	return file + ".pairs"
+}
+
+// tailSum returns the checksum of the end of the index data d.
+func tailSum(d []byte) uint64 {
+	if len(d) > pairsTail {
+		d = d[len(d)-pairsTail:]
+	}
+	return crc64.Checksum(d, crcTable)
+}
+
+// pairLists holds the lists of a pairs file.
+type pairLists struct {
+	tris  []uint32 // trigrams, in increasing order
+	index []byte   // pair index
+	lists []byte   // lists
+}
+
+// pairsHeader returns the fields of the header of the pairs file data,
+// and the rest of data, or ok == false if data is not a pairs file.
+func pairsHeader(data []byte) (size int64, sum uint64, asked, n int, rest []byte, ok bool) {
+	if len(data) < len(pairsMagic)+8+8+4+4 || string(data[:len(pairsMagic)]) != pairsMagic {
+		return 0, 0, 0, 0, nil, false
+	}
+	d := data[len(pairsMagic):]
+	size = int64(binary.BigEndian.Uint64(d))
+	sum = binary.BigEndian.Uint64(d[8:])
+	asked = int(binary.BigEndian.Uint32(d[16:]))
+	n = int(binary.BigEndian.Uint32(d[20:]))
+	return size, sum, asked, n, d[24:], true
+}
+
+// readPairs reads the pairs file of the index ix, held in file.
+// It returns nil if there is none or it does not match the index.
+func readPairs(file string, ix *Index) *pairLists {
+	data, err := os.ReadFile(pairsFile(file))
+	if err != nil {
+		return nil
+	}
+	size, sum, _, n, d, ok := pairsHeader(data)
+	if !ok || size != int64(len(ix.data.d)) || sum != tailSum(ix.data.d) {
+		return nil
+	}
+	npair := n * (n - 1) / 2
+	if len(d) < 3*n+8*npair {
+		return nil
+	}
+	p := &pairLists{tris: make([]uint32, n)}
+	for i := range p.tris {
+		p.tris[i] = uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2])
+		d = d[3:]
+	}
+	p.index = d[:8*npair]
+	p.lists = d[8*npair:]
+	return p
+}
+
+// entry returns the entry in the pair index for trigrams a and b,
+// or nil if the pairs file has no list for them.
+func (p *pairLists) entry(a, b uint32) []byte {
+	i, ok := p.find(a)
+	if !ok {
+		return nil
+	}
+	j, ok := p.find(b)
+	if !ok || i == j {
+		return nil
+	}
+	if i > j {
+		i, j = j, i
+	}
+	n := len(p.tris)
+	k := i*n - i*(i+1)/2 + j - i - 1
+	return p.index[8*k : 8*k+8]
+}
+
+// count returns the number of files holding both trigrams a and b,
+// or -1 if the pairs file has no list for them.
+func (p *pairLists) count(a, b uint32) int {
+	e := p.entry(a, b)
+	if e == nil {
+		return -1
+	}
+	return int(binary.BigEndian.Uint32(e))
+}
+
+// list returns the files holding both trigrams a and b, and whether
+// the pairs file has their list.  The list is the caller's to modify.
+func (p *pairLists) list(a, b uint32) ([]uint32, bool) {
+	e := p.entry(a, b)
+	if e == nil {
+		return nil, false
+	}
+	off := binary.BigEndian.Uint32(e[4:])
+	if int64(off) > int64(len(p.lists)) {
+		return nil, false
+	}
+	d := p.lists[off:]
+	count := binary.BigEndian.Uint32(e)
+	if int64(count) > int64(len(d)) {
+		return nil, false
+	}
+	x := make([]uint32, count)
+	fileid := ^uint32(0)
+	for c := range x {
+		delta, n := binary.Uvarint(d)
+		if n <= 0 || delta == 0 {
+			return nil, false
+		}
+		d = d[n:]
+		fileid += uint32(delta)
+		x[c] = fileid
+	}
+	return x, true
+}
+
+func (p *pairLists) find(t uint32) (int, bool) {
+	i := sort.Search(len(p.tris), func(i int) bool { return p.tris[i] >= t })
+	return i, i < len(p.tris) && p.tris[i] == t
+}
+
+// pairStart returns the list of files that a QAnd query q starts from,
+// restricted to restrict if it is non-nil: the smallest precomputed
+// list of a pair of its trigrams.  It also returns the indexes in
+// q.Trigram of that pair, which q need not check again.  If no pair of
+// q's trigrams has a list, pairStart returns nil and -1, -1.
+func (ix *Index) pairStart(q *Query, restrict []uint32) (list []uint32, t1, t2 int) {
+	if ix.pairs == nil {
+		return nil, -1, -1
+	}
+	// Only a trigram without case variants can be one of a pair.
+	var idx []int
+	var tris []uint32
+	for i, t := range q.Trigram {
+		if v := trigramVariants(t, q.Fold); len(v) == 1 {
+			idx = append(idx, i)
+			tris = append(tris, v[0])
+		}
+	}
+	best, bi, bj := -1, 0, 0
+	for i := range tris {
+		for j := i + 1; j < len(tris); j++ {
+			if c := ix.pairs.count(tris[i], tris[j]); c >= 0 && (best < 0 || c < best) {
+				best, bi, bj = c, i, j
+			}
+		}
+	}
+	if best < 0 {
+		return nil, -1, -1
+	}
+	list, ok := ix.pairs.list(tris[bi], tris[bj])
+	if !ok {
+		return nil, -1, -1
+	}
+	if restrict != nil {
+		list = intersect(list, restrict)
+	}
+	return list, idx[bi], idx[bj]
+}
+
+// intersect returns the files in both of the sorted lists x and y,
+// reusing x to hold them.
+func intersect(x, y []uint32) []uint32 {
+	out := x[:0]
+	j := 0
+	for _, id := range x {
+		for j < len(y) && y[j] < id {
+			j++
+		}
+		if j < len(y) && y[j] == id {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// PairTrigrams returns the number of trigrams that the pairs file
+// of the index file was asked to cover, or 0 if there is none.
+// The file need not match the index, so that a caller rewriting
+// the index can write a new pairs file like the old one.
+func PairTrigrams(file string) int {
+	data, err := os.ReadFile(pairsFile(file))
+	if err != nil {
+		return 0
+	}
+	_, _, asked, _, _, ok := pairsHeader(data)
+	if !ok {
+		return 0
+	}
+	return asked
+}
+
+// WritePairs writes the pairs file of the index file, holding the
+// lists of files with both trigrams of each pair of the n trigrams
+// with the longest posting lists.  If n is 0, WritePairs removes
+// the pairs file instead.
+func WritePairs(file string, n int) error {
+	if n <= 0 {
+		err := os.Remove(pairsFile(file))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	ix := openData(mmap(file))
+	defer ix.Close()
+
+	// The n trigrams with the longest lists.
+	type entry struct {
+		tri   uint32
+		count int
+	}
+	entries := make([]entry, ix.numPost)
+	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
+	for i := range entries {
+		e := d[i*postEntrySize:]
+		entries[i].tri = uint32(e[0])<<16 | uint32(e[1])<<8 | uint32(e[2])
+		entries[i].count = int(binary.BigEndian.Uint32(e[3:]))
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].count > entries[j].count })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tri < entries[j].tri })
+	posts := make([][]uint32, len(entries))
+	for i, e := range entries {
+		posts[i] = ix.postingList(e.tri, nil)
+	}
+
+	var hdr, index, lists bytes.Buffer
+	var buf [8]byte
+	var vbuf [binary.MaxVarintLen64]byte
+	hdr.WriteString(pairsMagic)
+	binary.BigEndian.PutUint64(buf[:], uint64(len(ix.data.d)))
+	hdr.Write(buf[:])
+	binary.BigEndian.PutUint64(buf[:], tailSum(ix.data.d))
+	hdr.Write(buf[:])
+	binary.BigEndian.PutUint32(buf[:], uint32(n))
+	hdr.Write(buf[:4])
+	binary.BigEndian.PutUint32(buf[:], uint32(len(entries)))
+	hdr.Write(buf[:4])
+	for _, e := range entries {
+		hdr.Write([]byte{byte(e.tri >> 16), byte(e.tri >> 8), byte(e.tri)})
+	}
+	var list []uint32
+	for i := range posts {
+		for j := i + 1; j < len(posts); j++ {
+			list = intersect(append(list[:0], posts[i]...), posts[j])
+			binary.BigEndian.PutUint32(buf[:], uint32(len(list)))
+			binary.BigEndian.PutUint32(buf[4:], uint32(lists.Len()))
+			index.Write(buf[:])
+			last := ^uint32(0)
+			for _, fileid := range list {
+				lists.Write(vbuf[:binary.PutUvarint(vbuf[:], uint64(fileid-last))])
+				last = fileid
+			}
+		}
+	}
+	return writeFileAtomic(pairsFile(file), io.MultiReader(&hdr, &index, &lists))
+}
@@ -0,0 +1,131 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"testing"
+)
+
+// pairFiles returns n files under dir, all containing "func main",
+// every other one "return err", and every third one "func Open".
+func pairFiles(dir string, n int) map[string]string {
+	files := make(map[string]string)
+	for i := 0; i < n; i++ {
+		data := fmt.Sprintf("func main() { %d }\n", i)
+		if i%2 == 0 {
+			data += "return err\n"
+		}
+		if i%3 == 0 {
+			data += "func Open\n"
+		}
+		files[fmt.Sprintf("%s/f%02d", dir, i)] = data
+	}
+	return files
+}
+
+var pairQueryTests = []string{
+	`func main\(\) \{`,
+	`func main`,
+	`return err`,
+	`func Open`,
+	`(?i)FUNC main`,
+	`func main.*return err`,
+	`main|Open`,
+	`func 7`,
+	`xyzzy`,
+}
+
+func TestPairs(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index")
+	buildIndex(file, []string{"/src"}, pairFiles("/src", 20))
+	if err := WritePairs(file, 6); err != nil {
+		t.Fatal(err)
+	}
+	if n := PairTrigrams(file); n != 6 {
+		t.Errorf("PairTrigrams = %d, want 6", n)
+	}
+
+	ix := Open(file)
+	defer ix.Close()
+	if ix.pairs == nil {
+		t.Fatal("Open did not load the pairs file")
+	}
+	if len(ix.pairs.tris) != 6 {
+		t.Errorf("pairs file has %d trigrams, want 6", len(ix.pairs.tris))
+	}
+	plain := OpenBytes(ix.data.d)
+	for _, re := range pairQueryTests {
+		r, err := syntax.Parse(re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := RegexpQuery(r)
+		got, want := ix.PostingQuery(q), plain.PostingQuery(q)
+		if len(got) != 0 || len(want) != 0 {
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%#q: with pairs: %v, want %v", re, got, want)
+			}
+		}
+	}
+
+	// The pairs file holds the intersection of the lists of each pair.
+	for i, a := range ix.pairs.tris {
+		for _, b := range ix.pairs.tris[i+1:] {
+			got, ok := ix.pairs.list(a, b)
+			if !ok {
+				t.Fatalf("no list for %q and %q", trigramString(a), trigramString(b))
+			}
+			want := plain.PostingAnd(plain.PostingList(a), b)
+			if !reflect.DeepEqual(got, want) && len(got)+len(want) > 0 {
+				t.Errorf("list for %q and %q = %v, want %v", trigramString(a), trigramString(b), got, want)
+			}
+		}
+	}
+	// Every trigram of "func main() {" is in every file,
+	// so the six with the longest lists are among them.
+	r, _ := syntax.Parse(pairQueryTests[0], syntax.Perl)
+	if _, t1, _ := ix.pairStart(RegexpQuery(r), nil); t1 < 0 {
+		t.Errorf("pairStart(%#q) used no pair", pairQueryTests[0])
+	}
+	if _, t1, _ := ix.pairStart(&Query{Op: QAnd, Trigram: []string{"xyz", "zzy"}}, nil); t1 >= 0 {
+		t.Errorf("pairStart used a pair for trigrams not in the pairs file")
+	}
+}
+
+func TestPairsStale(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index")
+	buildIndex(file, []string{"/src"}, pairFiles("/src", 20))
+	if err := WritePairs(file, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// A pairs file left beside a rewritten index is ignored.
+	buildIndex(file, []string{"/src"}, pairFiles("/src", 10))
+	ix := Open(file)
+	defer ix.Close()
+	if ix.pairs != nil {
+		t.Errorf("Open loaded the pairs file of an older index")
+	}
+	if n := PairTrigrams(file); n != 4 {
+		t.Errorf("PairTrigrams = %d, want 4", n)
+	}
+
+	if err := WritePairs(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pairsFile(file)); !os.IsNotExist(err) {
+		t.Errorf("WritePairs(file, 0) left the pairs file: %v", err)
+	}
+	if err := WritePairs(file, 0); err != nil {
+		t.Errorf("WritePairs(file, 0) without a pairs file: %v", err)
+	}
+}
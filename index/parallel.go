@@ -0,0 +1,109 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "sync"
+
+// Concurrent indexing.
+//
+// Reading a file and computing its trigrams dominates the cost of
+// indexing, and each file can be processed independently, so AddFile
+// can hand that work to a pool of scanning goroutines.  File IDs must
+// still be assigned in the order the files were added, so the results
+// are committed to the index by a single goroutine that waits for them
+// in order.  Every scanner has its own 64 MB trigram set, so memory use
+// grows with the number of scanners.
+
+// SetConcurrency sets the number of goroutines used to read and
+// compute trigrams for the files added with AddFile.  A value of 1
+// or less scans files in the calling goroutine, which is the default.
+// SetConcurrency must be called before any files are added.
+func (ix *IndexWriter) SetConcurrency(n int) {
+	if ix.numName > 0 || ix.work != nil {
+		panic("index: SetConcurrency called after files were added")
+	}
+	if n <= 1 {
+		return
+	}
+	ix.work = newWorkers(ix, n)
+}
+
+// A scanJob is a file waiting to be scanned and committed.
+type scanJob struct {
+	name string
+	size int64 // size to report to IndexWriter.Progress, or -1
+	done chan *scanResult
+}
+
+// workers manages the scanning goroutines and the committing goroutine.
+type workers struct {
+	jobs    chan *scanJob // files waiting for a scanner
+	pending chan *scanJob // files waiting to be committed, in order
+	wg      sync.WaitGroup
+	commit  chan bool // closed when the committer exits
+}
+
+func newWorkers(ix *IndexWriter, n int) *workers {
+	w := &workers{
+		jobs:    make(chan *scanJob, 4*n),
+		pending: make(chan *scanJob, 64*n),
+		commit:  make(chan bool),
+	}
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			s := newScanner()
+			for job := range w.jobs {
+				job.done <- ix.scanFile(s, job.name, true)
+			}
+		}()
+	}
+	go func() {
+		defer close(w.commit)
+		for job := range w.pending {
+			if r := <-job.done; r != nil {
+				ix.commit(r)
+			}
+			ix.progress(job.name, job.size)
+		}
+	}()
+	return w
+}
+
+// addFile queues the named file to be scanned and added to ix,
+// and then reported to ix.Progress if size is not negative.
+func (w *workers) addFile(ix *IndexWriter, name string, size int64) {
+	job := &scanJob{name: name, size: size, done: make(chan *scanResult, 1)}
+	w.pending <- job
+	w.jobs <- job
+}
+
+// addResult queues the already scanned file r to be added to the index
+// after all the files queued before it.
+func (w *workers) addResult(r *scanResult) {
+	if r == nil {
+		return
+	}
+	job := &scanJob{name: r.name, size: -1, done: make(chan *scanResult, 1)}
+	job.done <- r
+	w.pending <- job
+}
+
+// addProgress queues a report of the named file to ix.Progress,
+// to be made after all the files queued before it are added.
+func (w *workers) addProgress(name string, size int64) {
+	job := &scanJob{name: name, size: size, done: make(chan *scanResult, 1)}
+	job.done <- nil
+	w.pending <- job
+}
+
+// wait waits for all queued files to be added to the index.
+func (w *workers) wait() {
+	close(w.jobs)
+	close(w.pending)
+	w.wg.Wait()
+	<-w.commit
+}
@@ -0,0 +1,45 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Path names.
+//
+// The index stores file names and indexed paths with their elements
+// separated by slashes, whatever the operating system, so that names
+// sort, and so compare and merge, the same way everywhere.  On Windows,
+// which accepts slashes as well as backslashes in file names, the writer
+// converts backslashes to slashes, and the functions that take a file or
+// path name (InTree, Lookup, and PathRepo) accept either form.
+
+// FoldPathCase causes InTree to compare names without regard to case,
+// as the file system does, so that C:\Src\x.go lies in the tree c:\src.
+// It is set by default on Windows.
+var FoldPathCase = runtime.GOOS == "windows"
+
+// slashName returns name in the form stored in the index.
+func slashName(name string) string {
+	return filepath.ToSlash(name)
+}
+
+// InTree reports whether the indexed file or path name lies in the
+// tree rooted at root: whether it is root itself, a file beneath the
+// directory root, a file in the git tree root (see AddGitTree), or a
+// member of the archive root (see AddArchive).
+func InTree(name, root string) bool {
+	name, root = slashName(name), slashName(root)
+	if FoldPathCase && len(name) >= len(root) && strings.EqualFold(name[:len(root)], root) {
+		name = root + name[len(root):]
+	}
+	return name == root ||
+		strings.HasPrefix(name, root+"/") ||
+		strings.HasPrefix(name, root+":") ||
+		strings.HasPrefix(name, root+"!/")
+}
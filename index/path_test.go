@@ -0,0 +1,99 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var inTreeTests = []struct {
+	name, root string
+	fold       bool
+	want       bool
+}{
+	{"/src/a.go", "/src", false, true},
+	{"/src", "/src", false, true},
+	{"/srcx/a.go", "/src", false, false},
+	{"/src/repo@HEAD:a.go", "/src/repo@HEAD", false, true},
+	{"/src/lib.jar!/a/B.java", "/src/lib.jar", false, true},
+	{"/Src/a.go", "/src", false, false},
+	{"/Src/a.go", "/src", true, true},
+	{"/SRCX/a.go", "/src", true, false},
+}
+
+func TestInTree(t *testing.T) {
+	defer func(fold bool) { FoldPathCase = fold }(FoldPathCase)
+	for _, tt := range inTreeTests {
+		FoldPathCase = tt.fold
+		if got := InTree(tt.name, tt.root); got != tt.want {
+			t.Errorf("InTree(%q, %q) with FoldPathCase=%v = %v, want %v", tt.name, tt.root, tt.fold, got, tt.want)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		FoldPathCase = true
+		if !InTree(`C:/Src/x/a.go`, `c:\src`) || !InTree(`c:\src\x\a.go`, `C:/SRC/x`) {
+			t.Errorf("InTree does not accept both separators and cases")
+		}
+	}
+}
+
+// TestWalkNames checks that the walker records names with slashes
+// and that the index finds them by their names on the system.
+func TestWalkNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a/b/x.txt", "a/y.txt", "c.txt"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(file), 0777)
+		if err := ioutil.WriteFile(file, []byte("hello "+name+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := dir + ".ix"
+	defer os.Remove(out)
+	ix := Create(out)
+	ix.AddPaths([]string{dir})
+	ix.AddTree(dir)
+	ix.Flush()
+	r := Open(out)
+	defer r.Close()
+
+	root := filepath.ToSlash(dir)
+	if paths := r.Paths(); len(paths) != 1 || paths[0] != root {
+		t.Errorf("Paths() = %q, want [%q]", paths, root)
+	}
+	want := []string{root + "/a/b/x.txt", root + "/a/y.txt", root + "/c.txt"}
+	var names []string
+	for i := 0; i < r.NumFiles(); i++ {
+		names = append(names, r.Name(uint32(i)))
+	}
+	if !equalStrings(names, want) {
+		t.Errorf("names = %q, want %q", names, want)
+	}
+	for i, name := range want {
+		native := filepath.FromSlash(name)
+		if id, ok := r.Lookup(native); !ok || id != uint32(i) {
+			t.Errorf("Lookup(%q) = %d, %v, want %d, true", native, id, ok, i)
+		}
+		if !InTree(name, dir) {
+			t.Errorf("InTree(%q, %q) = false", name, dir)
+		}
+		if strings.Contains(name, `\`) {
+			t.Errorf("name %q contains a backslash", name)
+		}
+	}
+	if err := Verify(out); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
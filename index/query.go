@@ -0,0 +1,231 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Building and encoding queries.
+//
+// RegexpQuery is the usual way to make a Query, but the query tree is
+// plain data, so tools can also inspect it, store it, or build it by
+// hand.  A query built by hand must obey the invariants that
+// RegexpQuery maintains and PostingQuery relies on; the functions below
+// maintain them, and Validate checks them.
+//
+// In JSON, a query is an object with the fields op ("all", "none",
+// "and", or "or"), trigram, sub, and fold, the last three omitted when
+// empty.  For example, the query for abc.*(def|ghi) is
+//
+//	{"op":"and","trigram":["abc"],"sub":[{"op":"or","trigram":["def","ghi"]}]}
+//
+// A trigram is three bytes, which need not be valid UTF-8: the trigrams
+// of a non-ASCII literal split its characters.  So JSON writes each
+// byte of a trigram as the character with the same value, U+0000 to
+// U+00FF, which leaves ASCII trigrams as they are.
+
+var queryOpNames = []string{
+	QAll:  "all",
+	QNone: "none",
+	QAnd:  "and",
+	QOr:   "or",
+}
+
+func (op QueryOp) String() string {
+	if 0 <= op && int(op) < len(queryOpNames) {
+		return queryOpNames[op]
+	}
+	return fmt.Sprintf("QueryOp(%d)", int(op))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (op QueryOp) MarshalText() ([]byte, error) {
+	if op < 0 || int(op) >= len(queryOpNames) {
+		return nil, fmt.Errorf("invalid query op %d", int(op))
+	}
+	return []byte(queryOpNames[op]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (op *QueryOp) UnmarshalText(text []byte) error {
+	for i, name := range queryOpNames {
+		if string(text) == name {
+			*op = QueryOp(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown query op %q", text)
+}
+
+// AllQuery returns a query that matches every file.
+func AllQuery() *Query {
+	return &Query{Op: QAll}
+}
+
+// NoneQuery returns a query that matches no file.
+func NoneQuery() *Query {
+	return &Query{Op: QNone}
+}
+
+// TrigramQuery returns a query that matches files containing all
+// (for QAnd) or any (for QOr) of the given trigrams, each of which
+// must be exactly three bytes long.  With no trigrams, the query
+// matches every file for QAnd and no file for QOr.
+func TrigramQuery(op QueryOp, trigrams ...string) *Query {
+	if op != QAnd && op != QOr {
+		panic("index: TrigramQuery with op " + op.String())
+	}
+	if len(trigrams) == 0 {
+		if op == QAnd {
+			return AllQuery()
+		}
+		return NoneQuery()
+	}
+	for _, t := range trigrams {
+		if len(t) != 3 {
+			panic(fmt.Sprintf("index: TrigramQuery with trigram %q", t))
+		}
+	}
+	t := stringSet(append([]string(nil), trigrams...))
+	t.clean(false)
+	return &Query{Op: op, Trigram: t}
+}
+
+// AndQuery returns a query that matches the files matched by all of qs,
+// simplified as for Query.And.  It may reuse the storage of qs.
+func AndQuery(qs ...*Query) *Query {
+	q := AllQuery()
+	for _, r := range qs {
+		q = q.And(r)
+	}
+	return q
+}
+
+// OrQuery returns a query that matches the files matched by any of qs,
+// simplified as for Query.Or.  It may reuse the storage of qs.
+func OrQuery(qs ...*Query) *Query {
+	q := NoneQuery()
+	for _, r := range qs {
+		q = q.Or(r)
+	}
+	return q
+}
+
+// Validate reports the first way in which q, which may have been built
+// by hand or decoded from JSON, breaks the invariants of a query tree:
+// QAll and QNone have no trigrams or subqueries, a QAnd has at least
+// one of either, trigrams are three bytes long and sorted without
+// duplicates, and a Fold query's trigrams are in lower case.
+func (q *Query) Validate() error {
+	if err := q.check(); err != nil {
+		return err
+	}
+	for i, sub := range q.Sub {
+		if err := sub.Validate(); err != nil {
+			return fmt.Errorf("sub %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// check is Validate without the recursion into q.Sub.
+func (q *Query) check() error {
+	if q == nil {
+		return fmt.Errorf("nil query")
+	}
+	switch q.Op {
+	case QAll, QNone:
+		if len(q.Trigram) > 0 || len(q.Sub) > 0 {
+			return fmt.Errorf("%s query has trigrams or subqueries", q.Op)
+		}
+	case QAnd:
+		if len(q.Trigram) == 0 && len(q.Sub) == 0 {
+			return fmt.Errorf("and query has no trigrams or subqueries")
+		}
+	case QOr:
+	default:
+		return fmt.Errorf("invalid query op %d", int(q.Op))
+	}
+	for i, t := range q.Trigram {
+		if len(t) != 3 {
+			return fmt.Errorf("trigram %q is not three bytes", t)
+		}
+		if i > 0 && t <= q.Trigram[i-1] {
+			return fmt.Errorf("trigram %q out of order after %q", t, q.Trigram[i-1])
+		}
+		if q.Fold && strings.IndexAny(t, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") >= 0 {
+			return fmt.Errorf("trigram %q is not lower case in fold query", t)
+		}
+	}
+	return nil
+}
+
+// jsonQuery is the JSON form of a Query.
+type jsonQuery struct {
+	Op      QueryOp       `json:"op"`
+	Trigram []jsonTrigram `json:"trigram,omitempty"`
+	Sub     []*Query      `json:"sub,omitempty"`
+	Fold    bool          `json:"fold,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (q *Query) MarshalJSON() ([]byte, error) {
+	jq := jsonQuery{Op: q.Op, Sub: q.Sub, Fold: q.Fold}
+	for _, t := range q.Trigram {
+		jq.Trigram = append(jq.Trigram, jsonTrigram(t))
+	}
+	return json.Marshal(&jq)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It rejects queries that fail Validate.
+func (q *Query) UnmarshalJSON(data []byte) error {
+	var jq jsonQuery
+	if err := json.Unmarshal(data, &jq); err != nil {
+		return err
+	}
+	r := Query{Op: jq.Op, Sub: jq.Sub, Fold: jq.Fold}
+	for _, t := range jq.Trigram {
+		r.Trigram = append(r.Trigram, string(t))
+	}
+	if err := r.check(); err != nil {
+		return err
+	}
+	// Decoding checked the subqueries, except that it leaves null ones nil.
+	for i, sub := range r.Sub {
+		if sub == nil {
+			return fmt.Errorf("sub %d: nil query", i)
+		}
+	}
+	*q = r
+	return nil
+}
+
+// A jsonTrigram is a trigram written in JSON one character per byte.
+type jsonTrigram string
+
+func (t jsonTrigram) MarshalText() ([]byte, error) {
+	var buf []byte
+	for i := 0; i < len(t); i++ {
+		buf = utf8.AppendRune(buf, rune(t[i]))
+	}
+	return buf, nil
+}
+
+func (t *jsonTrigram) UnmarshalText(text []byte) error {
+	var buf []byte
+	for _, r := range string(text) {
+		if r > 0xFF {
+			return fmt.Errorf("invalid trigram %q: character %U above U+00FF", text, r)
+		}
+		buf = append(buf, byte(r))
+	}
+	*t = jsonTrigram(buf)
+	return nil
+}
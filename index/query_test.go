@@ -0,0 +1,106 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/json"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+func TestQueryJSON(t *testing.T) {
+	res := []string{`(?i)hello`, "h\xc3\xa9llo", `abc\x00\xff`}
+	for _, tt := range queryTests {
+		res = append(res, tt.re)
+	}
+	for _, re := range res {
+		sre, err := syntax.Parse(re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := RegexpQuery(sre)
+		if err := q.Validate(); err != nil {
+			t.Errorf("RegexpQuery(%#q).Validate() = %v", re, err)
+		}
+		data, err := json.Marshal(q)
+		if err != nil {
+			t.Errorf("RegexpQuery(%#q): json.Marshal: %v", re, err)
+			continue
+		}
+		var q1 Query
+		if err := json.Unmarshal(data, &q1); err != nil {
+			t.Errorf("RegexpQuery(%#q): json.Unmarshal(%s): %v", re, data, err)
+			continue
+		}
+		if q.String() != q1.String() {
+			t.Errorf("RegexpQuery(%#q): JSON %s decodes to %s, want %s", re, data, q1.String(), q.String())
+		}
+	}
+}
+
+var queryJSONTests = []struct {
+	q    *Query
+	json string
+}{
+	{AllQuery(), `{"op":"all"}`},
+	{TrigramQuery(QAnd), `{"op":"all"}`},
+	{TrigramQuery(QOr), `{"op":"none"}`},
+	{TrigramQuery(QOr, "ghi", "def", "ghi"), `{"op":"or","trigram":["def","ghi"]}`},
+	{&Query{Op: QAnd, Trigram: []string{"\xc3\xa9x"}}, `{"op":"and","trigram":["Ã©x"]}`},
+	{
+		AndQuery(TrigramQuery(QAnd, "abc"), TrigramQuery(QOr, "def", "ghi")),
+		`{"op":"and","trigram":["abc"],"sub":[{"op":"or","trigram":["def","ghi"]}]}`,
+	},
+	{
+		OrQuery(TrigramQuery(QAnd, "abc", "bcd"), TrigramQuery(QAnd, "xyz")),
+		`{"op":"or","sub":[{"op":"and","trigram":["abc","bcd"]},{"op":"and","trigram":["xyz"]}]}`,
+	},
+	{AndQuery(NoneQuery(), TrigramQuery(QAnd, "abc")), `{"op":"none"}`},
+}
+
+func TestQueryBuild(t *testing.T) {
+	for _, tt := range queryJSONTests {
+		data, err := json.Marshal(tt.q)
+		if err != nil {
+			t.Errorf("json.Marshal(%s): %v", tt.q, err)
+			continue
+		}
+		if string(data) != tt.json {
+			t.Errorf("json.Marshal(%s) = %s, want %s", tt.q, data, tt.json)
+		}
+	}
+}
+
+var badQueryTests = []struct {
+	json string
+	err  string
+}{
+	{`{"op":"some"}`, `unknown query op "some"`},
+	{`{"op":"all","trigram":["abc"]}`, "all query has trigrams or subqueries"},
+	{`{"op":"and"}`, "and query has no trigrams or subqueries"},
+	{`{"op":"or","trigram":["ab"]}`, `trigram "ab" is not three bytes`},
+	{`{"op":"or","trigram":["def","abc"]}`, `trigram "abc" out of order after "def"`},
+	{`{"op":"or","trigram":["ABC"],"fold":true}`, `trigram "ABC" is not lower case`},
+	{`{"op":"or","trigram":["aĀc"]}`, "character U+0100 above U+00FF"},
+	{`{"op":"or","sub":[{"op":"none","sub":[{"op":"all"}]}]}`, "none query has trigrams or subqueries"},
+	{`{"op":"and","sub":[null]}`, "sub 0: nil query"},
+	{`{"op":"or","sub":[{"op":"all"},{"op":"and","sub":[{"op":"all"},null]}]}`, "sub 1: nil query"},
+}
+
+func TestQueryValidate(t *testing.T) {
+	for _, tt := range badQueryTests {
+		var q Query
+		err := json.Unmarshal([]byte(tt.json), &q)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("json.Unmarshal(%s) = %v, want %q", tt.json, err, tt.err)
+		}
+	}
+
+	q := &Query{Op: QOr, Sub: []*Query{{Op: QAnd, Trigram: []string{"abcd"}}}}
+	if err := q.Validate(); err == nil || err.Error() != `sub 0: trigram "abcd" is not three bytes` {
+		t.Errorf("Validate(%s) = %v", q, err)
+	}
+}
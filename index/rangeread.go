@@ -0,0 +1,210 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reading remote indexes in place.
+//
+// Open downloads a remote index whole before searching it (see
+// remote.go).  A server searching a large index kept in object storage
+// can instead open it with OpenRange, which reads the index in place:
+// it fetches, with HTTP range requests, only the parts of the index that
+// searches touch, in blocks of rangeBlockSize bytes, and keeps the
+// blocks used most recently in memory, up to a limit.  A search then
+// reads little more than the posting lists of its trigrams and the
+// names of its candidate files, and repeated searches read nothing.
+//
+// Every read asks for the version of the index that was opened, by its
+// ETag.  Once the index is replaced, the open copy cannot be read any
+// further, and a search that needs a part of it not yet in memory fails
+// as one reading a corrupt index does.  A server should therefore check
+// for a new version with RemoteStat before searching and reopen the
+// index when there is one, as csearchd does.
+
+// rangeBlockSize is the size of the blocks that OpenRange reads.
+// It is a variable so that tests can use small blocks.
+var rangeBlockSize = 256 << 10
+
+// rangeTries is how many times a read is tried before giving up.
+const rangeTries = 3
+
+// OpenRange opens the remote index at url for reading in place,
+// keeping up to cacheSize bytes of it in memory.
+func OpenRange(url string, cacheSize int64) (*Index, error) {
+	info, err := RemoteStat(url)
+	if err != nil {
+		return nil, err
+	}
+	r := &rangeData{
+		url:   url,
+		s:     StorageFor(url),
+		info:  info,
+		max:   cacheSize,
+		order: list.New(),
+		elems: make(map[rangeKey]*list.Element),
+	}
+	return initIndex(&Index{remote: r}), nil
+}
+
+// A rangeData is the data of an index read in place.
+type rangeData struct {
+	url  string
+	s    Storage
+	info RemoteInfo // version being read
+
+	mu    sync.Mutex
+	max   int64      // bytes of data to keep
+	used  int64      // bytes of data kept
+	order *list.List // of *rangeEntry, most recently used first
+	elems map[rangeKey]*list.Element
+}
+
+// A rangeKey identifies data kept by a rangeData: a block, with n < 0,
+// or a range of n bytes spanning several blocks, kept whole so that
+// it need not be put together again.
+type rangeKey struct {
+	off int
+	n   int
+}
+
+// A rangeEntry is the data kept for a key.
+type rangeEntry struct {
+	key  rangeKey
+	data []byte
+}
+
+// slice returns the n bytes of data at offset off,
+// or the data from off to the end if n < 0.
+func (r *rangeData) slice(off, n int) []byte {
+	if n < 0 {
+		n = int(r.info.Size) - off
+	}
+	if n == 0 {
+		return nil
+	}
+	first, last := off/rangeBlockSize, (off+n-1)/rangeBlockSize
+	if first == last {
+		b := r.blocks(first, last)[0]
+		i := off - first*rangeBlockSize
+		return b[i : i+n]
+	}
+	key := rangeKey{off, n}
+	if d := r.get(key); d != nil {
+		return d
+	}
+	d := make([]byte, 0, n)
+	for _, b := range r.blocks(first, last) {
+		d = append(d, b...)
+	}
+	d = d[off-first*rangeBlockSize:][:n]
+	r.put(key, d)
+	return d
+}
+
+// str returns the NUL-terminated string at offset off.
+func (r *rangeData) str(off int) []byte {
+	for n := 256; ; n *= 2 {
+		n = min(n, int(r.info.Size)-off)
+		d := r.slice(off, n)
+		if i := bytes.IndexByte(d, 0); i >= 0 {
+			return d[:i]
+		}
+		if off+n >= int(r.info.Size) {
+			corrupt()
+		}
+	}
+}
+
+// blocks returns the blocks numbered first through last, reading
+// those it does not have, a run of adjacent blocks in each request.
+func (r *rangeData) blocks(first, last int) [][]byte {
+	bs := make([][]byte, last-first+1)
+	for i := range bs {
+		bs[i] = r.get(rangeKey{(first + i) * rangeBlockSize, -1})
+	}
+	for i := 0; i < len(bs); {
+		if bs[i] != nil {
+			i++
+			continue
+		}
+		j := i
+		for j < len(bs) && bs[j] == nil {
+			j++
+		}
+		lo := (first + i) * rangeBlockSize
+		hi := min((first+j)*rangeBlockSize, int(r.info.Size))
+		d := r.read(lo, hi-lo)
+		for k := i; k < j; k++ {
+			b := d[(k-i)*rangeBlockSize:]
+			b = b[:min(len(b), rangeBlockSize):min(len(b), rangeBlockSize)]
+			bs[k] = b
+			r.put(rangeKey{(first + k) * rangeBlockSize, -1}, b)
+		}
+		i = j
+	}
+	return bs
+}
+
+// read reads n bytes at offset off from the storage.
+func (r *rangeData) read(off, n int) []byte {
+	p := make([]byte, n)
+	var err error
+	for try := 0; try < rangeTries; try++ {
+		if try > 0 {
+			time.Sleep(time.Duration(try) * 100 * time.Millisecond)
+		}
+		var info RemoteInfo
+		info, err = r.s.GetRange(r.url, r.info.ETag, p, int64(off))
+		if err == nil && info.Size != r.info.Size {
+			err = errModified
+		}
+		if err == nil || err == errModified || errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		log.Fatalf("reading %s: %v", r.url, err)
+	}
+	return p
+}
+
+// get returns the data kept for key, or nil if there is none.
+func (r *rangeData) get(key rangeKey) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.elems[key]
+	if !ok {
+		return nil
+	}
+	r.order.MoveToFront(e)
+	return e.Value.(*rangeEntry).data
+}
+
+// put keeps data for key, dropping the data used least recently
+// to stay within the limit.
+func (r *rangeData) put(key rangeKey, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.elems[key]; ok {
+		return
+	}
+	r.elems[key] = r.order.PushFront(&rangeEntry{key, data})
+	r.used += int64(len(data))
+	for r.used > r.max && r.order.Len() > 1 {
+		e := r.order.Back().Value.(*rangeEntry)
+		r.order.Remove(r.order.Back())
+		delete(r.elems, e.key)
+		r.used -= int64(len(e.data))
+	}
+}
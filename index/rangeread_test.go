@@ -0,0 +1,108 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenRange(t *testing.T) {
+	defer func(n int) { rangeBlockSize = n }(rangeBlockSize)
+	rangeBlockSize = 512
+
+	files := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		files[fmt.Sprintf("/src/dir%d/file%03d.go", i%7, i)] = fmt.Sprintf("package p%d\n\nfunc F%d() { println(%q) }\n", i%5, i, "needle"[:i%6+1])
+	}
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(out, []string{"/src"}, files)
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	etag, gets := `"v1"`, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		gets++
+		w.Header().Set("ETag", etag)
+		mu.Unlock()
+		http.ServeContent(w, req, "index", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	url := srv.URL + "/x.csearchindex"
+
+	want := Open(out)
+	defer want.Close()
+	query := func(ix *Index) (names []string, post [][]uint32) {
+		for id := uint32(0); id < uint32(ix.NumFiles()); id++ {
+			names = append(names, ix.Name(id))
+		}
+		for _, re := range []string{"needle", "F1[0-9]\\(", "package p3", "nothing here"} {
+			r, err := syntax.Parse(re, syntax.Perl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			post = append(post, ix.PostingQuery(RegexpQuery(r)))
+		}
+		return
+	}
+	wantNames, wantPost := query(want)
+
+	for _, cacheSize := range []int64{1 << 20, 1024} {
+		ix, err := OpenRange(url, cacheSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, post := query(ix)
+		if !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("cache %d: names = %v, want %v", cacheSize, names, wantNames)
+		}
+		if !reflect.DeepEqual(post, wantPost) {
+			t.Errorf("cache %d: posting lists = %v, want %v", cacheSize, post, wantPost)
+		}
+		if cacheSize < int64(len(data)) {
+			ix.Close()
+			continue
+		}
+
+		// With room for the whole index, searching again reads nothing.
+		mu.Lock()
+		n := gets
+		mu.Unlock()
+		query(ix)
+		if gets != n {
+			t.Errorf("cache %d: searching again made %d requests, want 0", cacheSize, gets-n)
+		}
+		ix.Close()
+	}
+
+	// Reads of a replaced index fail.
+	info, err := RemoteStat(url)
+	if err != nil || info.Size != int64(len(data)) || info.ETag != `"v1"` {
+		t.Fatalf("RemoteStat = %+v, %v, want size %d, ETag \"v1\"", info, err, len(data))
+	}
+	mu.Lock()
+	etag = `"v2"`
+	mu.Unlock()
+	var p [8]byte
+	if _, err := StorageFor(url).GetRange(url, `"v1"`, p[:], 16); err != errModified {
+		t.Errorf("GetRange of replaced index: %v, want errModified", err)
+	}
+	if _, err := (localStorage{}).GetRange("file://"+filepath.ToSlash(out), `"stale"`, p[:], 16); err != errModified {
+		t.Errorf("local GetRange of replaced index: %v, want errModified", err)
+	}
+}
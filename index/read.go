@@ -8,12 +8,14 @@ package index
 //
 // An index stored on disk has the format:
 //
-//	"csearch index 1\n"
+//	"csearch index 3\n"
 //	list of paths
 //	list of names
 //	list of posting lists
 //	name index
 //	posting list index
+//	section index
+//	sections
 //	trailer
 //
 // The list of paths is a sorted sequence of NUL-terminated file or directory names.
@@ -39,6 +41,31 @@ package index
 // not recorded at all.  The list of posting lists ends with an entry
 // with trigram "\xff\xff\xff" and a delta list consisting a single zero.
 //
+// A non-empty posting list whose delta list would begin with a zero
+// is instead a roaring bitmap, which is smaller for lists naming a large
+// fraction of the files.  The bitmap follows the zero and has the form:
+//
+//	container count [v]
+//	containers...
+//
+// Each container holds the file IDs sharing the same high 16 bits,
+// in increasing order of those bits, and has the form:
+//
+//	high 16 bits [2]
+//	kind [1]
+//	count - 1 [2]
+//	data
+//
+// A container of kind 1 (array) has data listing the low 16 bits of
+// count file IDs in increasing order, 2 bytes each.  A container of
+// kind 2 (bitmap) has 8192 bytes of data, a bitmap in which bit i
+// (bit i&7 of byte i>>3) is set if the low 16 bits i are present.
+// A container of kind 3 (runs) has data listing count runs of
+// consecutive IDs in increasing order, each of the form:
+//
+//	low 16 bits of first ID [2]
+//	length - 1 [2]
+//
 // The indexes enable efficient random access to the lists.  The name
 // index is a sequence of 4-byte big-endian values listing the byte
 // offset in the name list where each name begins.  The posting list
@@ -55,6 +82,127 @@ package index
 // of the possible trigrams are never seen, so omitting the missing
 // ones represents a significant storage savings.
 //
+// The section index describes optional named sections holding
+// additional data about the indexed files.  It is a sequence of entries
+// of the form:
+//
+//	name [NUL-terminated]
+//	offset [4]
+//	length [4]
+//
+// ending with an empty name ("\x00").  Readers ignore sections they
+// do not understand.  The "meta" section records information about
+// each file at the time it was indexed:
+//
+//	record size [4]
+//	records, one per file ID:
+//		size [8]
+//		modification time, in nanoseconds since 1970 [8]
+//		content hash (CRC-64, ECMA polynomial) [8]
+//		language [4]
+//		repository [4]
+//
+// A record's language is 0 if the language is unknown and otherwise
+// n, referring to the n'th name (counting from 1) in the "lang"
+// section, which is a sequence of NUL-terminated language names.
+// Similarly, its repository is 0 if the file belongs to no named
+// repository and otherwise refers to the n'th name in the "repo"
+// section.  Indexes written before repositories were recorded have
+// 28-byte records ending with the language.
+// Readers ignore any bytes in a record beyond those they understand.
+//
+// The optional "sym" section records where symbols are defined:
+//
+//	symbol count [4]
+//	symbol offsets [4], one per symbol, relative to the section start
+//	symbols, in sorted order by name:
+//		name [NUL-terminated]
+//		definition count [v]
+//		definitions:
+//			file ID delta [v]
+//			line number [v]
+//
+// The file ID deltas are between successive definitions of the same
+// symbol, starting from file ID 0, so the first delta is the file ID.
+//
+// The optional "ident" section records the files whose code uses
+// each identifier word (see ident.go):
+//
+//	word count [4]
+//	word offsets [4], one per word, relative to the section start
+//	words, in sorted order:
+//		word [NUL-terminated]
+//		file count [v]
+//		file ID deltas [v], one per file
+//
+// The file IDs of a word are in increasing order, and the deltas
+// are between successive IDs, starting from file ID 0.
+//
+// The optional "exclude" section is a sequence of NUL-terminated
+// patterns recorded by the program that wrote the index (see Excludes).
+//
+// The optional "stop" section lists the stop trigrams, whose posting
+// lists the index omits, and the file fraction that made them so
+// (see stop.go).
+//
+// The optional "nametri" section records the trigrams of the file
+// names, with a posting list for each (see nametrigram.go).
+//
+// The optional "gitref" section is a NUL-terminated name of the git
+// revision whose files the index holds (see gitref.go).
+//
+// The optional "attach" section is a sequence of NUL-terminated names
+// of other index files to search along with this one (see attach.go).
+//
+// The optional "norm" section is a NUL-terminated name of the Unicode
+// normalization form, NFC, of the text whose trigrams the index holds
+// (see normalize.go).
+//
+// The "crc" section, which the writer lists last, holds CRC-32
+// checksums (Castagnoli polynomial) of the rest of the index:
+//
+//	checksums [4], one for each of:
+//		the list of paths
+//		the list of names
+//		the list of posting lists
+//		the name index
+//		the posting list index
+//		the section index
+//		each section listed before the crc section, in order
+//
+// Indexes written before checksums were recorded have no crc section.
+//
+// The optional "content" section stores the text of the indexed files:
+//
+//	file count [4]
+//	content offsets [4], one per file ID and a final one,
+//		relative to the section start
+//	contents, in file ID order
+//
+// The content of each file is a zstd frame holding its text, ending
+// where the next file's begins.  An empty content means that the text
+// of that file is not stored.
+//
+// The optional "region" section records the comments and string
+// literals in each file (see region.go), with the same layout as the
+// content section.  The entry of each file is:
+//
+//	region count [v]
+//	regions, in order of offset:
+//		gap since the end of the last region [v]
+//		length [v]
+//		kind [v], 1 for a comment or 2 for a string
+//
+// An empty entry means that the regions of that file are not recorded.
+//
+// The optional "alias" section lists the files that share the posting
+// entries of an identical file, their canonical file (see dedupe.go):
+//
+//	for each alias, in increasing order of file ID:
+//		alias file ID [4], canonical file ID [4]
+//
+// A canonical file comes before its aliases and is not an alias itself.
+//
 // The trailer has the form:
 //
 //	offset of path list [4]
@@ -62,20 +210,41 @@ package index
 //	offset of posting lists [4]
 //	offset of name index [4]
 //	offset of posting list index [4]
+//	offset of section index [4]
 //	"\ncsearch trailr\n"
+//
+// Version 4 indexes, with header "csearch index 4\n", are the same
+// as version 3 except that the list of names is compressed (see
+// IndexWriter.Compress).  The names are grouped into blocks of 64
+// consecutive file IDs, and the list of names is a sequence of the
+// blocks in order, each a zstd frame holding the NUL-terminated
+// names in its block.  Each name index entry gives the offset of the
+// block holding that name, and the final entry gives the offset of the
+// end of the list rather than of an empty name.
+//
+// Version 2 indexes, with header "csearch index 2\n", are the same
+// as version 3 but never use roaring bitmaps.  Version 1 indexes, with header
+// "csearch index 1\n", additionally have no section index and no
+// corresponding trailer entry.  They can still be read,
+// but they record no metadata about the indexed files.
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"iter"
 	"log"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sort"
+	"sync"
 )
 
 const (
-	magic        = "csearch index 1\n"
+	magic        = "csearch index 3\n"
+	magicV4      = "csearch index 4\n"
+	magicV2      = "csearch index 2\n"
+	magicV1      = "csearch index 1\n"
 	trailerMagic = "\ncsearch trailr\n"
 )
 
@@ -83,6 +252,8 @@ const (
 type Index struct {
 	Verbose   bool
 	data      mmapData
+	remote    *rangeData // data read in place, for an index opened by OpenRange
+	version   int
 	pathData  uint32
 	nameData  uint32
 	postData  uint32
@@ -90,40 +261,135 @@ type Index struct {
 	postIndex uint32
 	numName   int
 	numPost   int
+	sections  map[string]section
+	langs     sectionList // language names, read from lang section
+	repos     sectionList // repository names, read from repo section
+	nameMu    sync.Mutex
+	nameBlock *nameBlock // last block of compressed names read
+	bazelMu   sync.Mutex
+	bazelDirs map[string]bazelDir // cache for BazelPackage
+	pairs     *pairLists          // precomputed pair lists, if any (see pairs.go)
+	aliasOnce sync.Once
+	aliases   map[uint32][]uint32 // aliases of each canonical file (see dedupe.go)
+}
+
+// A section records the location of a named section in the index data.
+type section struct {
+	off, n uint32
 }
 
 const postEntrySize = 3 + 4 + 4
 
 func Open(file string) *Index {
-	mm := mmap(file)
-	if len(mm.d) < 4*4+len(trailerMagic) || string(mm.d[len(mm.d)-len(trailerMagic):]) != trailerMagic {
+	local := Local(file)
+	ix := openData(mmap(local))
+	ix.pairs = readPairs(local, ix)
+	return ix
+}
+
+// OpenBytes returns the index held in data, such as one written by
+// an IndexWriter created by NewMemWriter.  Data must not be modified
+// while the index is in use.
+func OpenBytes(data []byte) *Index {
+	return openData(mmapData{d: data})
+}
+
+func openData(mm mmapData) *Index {
+	return initIndex(&Index{data: mm})
+}
+
+// initIndex reads the trailer and the section index of ix,
+// whose data is set, and returns ix.
+func initIndex(ix *Index) *Index {
+	size := ix.size()
+	if size < 4*4+len(trailerMagic) || string(ix.slice(uint32(size-len(trailerMagic)), len(trailerMagic))) != trailerMagic {
 		corrupt()
 	}
-	n := uint32(len(mm.d) - len(trailerMagic) - 5*4)
-	ix := &Index{data: mm}
+	noff := 6
+	switch string(ix.slice(0, len(magic))) {
+	case magicV4:
+		ix.version = 4
+	case magic:
+		ix.version = 3
+	case magicV2:
+		ix.version = 2
+	case magicV1:
+		ix.version = 1
+		noff = 5
+	default:
+		corrupt()
+	}
+	n := uint32(size - len(trailerMagic) - noff*4)
 	ix.pathData = ix.uint32(n)
 	ix.nameData = ix.uint32(n + 4)
 	ix.postData = ix.uint32(n + 8)
 	ix.nameIndex = ix.uint32(n + 12)
 	ix.postIndex = ix.uint32(n + 16)
 	ix.numName = int((ix.postIndex-ix.nameIndex)/4) - 1
-	ix.numPost = int((n - ix.postIndex) / postEntrySize)
+	end := n
+	if ix.version >= 2 {
+		end = ix.uint32(n + 20)
+		ix.readSections(end)
+	}
+	ix.numPost = int((end - ix.postIndex) / postEntrySize)
 	return ix
 }
 
+// Version returns the version of the index format, 1, 2, 3, or 4.
+func (ix *Index) Version() int {
+	return ix.version
+}
+
+// readSections reads the section index starting at off.
+func (ix *Index) readSections(off uint32) {
+	ix.sections = make(map[string]section)
+	for {
+		s := ix.str(off)
+		off += uint32(len(s) + 1)
+		if len(s) == 0 {
+			break
+		}
+		sec := section{ix.uint32(off), ix.uint32(off + 4)}
+		ix.slice(sec.off, int(sec.n)) // check bounds
+		ix.sections[string(s)] = sec
+		off += 8
+	}
+}
+
+// section returns the data for the named section,
+// or nil if the index has no such section.
+func (ix *Index) section(name string) []byte {
+	sec, ok := ix.sections[name]
+	if !ok {
+		return nil
+	}
+	return ix.slice(sec.off, int(sec.n))
+}
+
 // slice returns the slice of index data starting at the given byte offset.
 // If n >= 0, the slice must have length at least n and is truncated to length n.
 func (ix *Index) slice(off uint32, n int) []byte {
 	o := int(off)
-	if uint32(o) != off || n >= 0 && o+n > len(ix.data.d) {
+	if uint32(o) != off || o > ix.size() || n >= 0 && o+n > ix.size() {
 		corrupt()
 	}
+	if ix.remote != nil {
+		return ix.remote.slice(o, n)
+	}
 	if n < 0 {
 		return ix.data.d[o:]
 	}
 	return ix.data.d[o : o+n]
 }
 
+// size returns the length of the index data.
+func (ix *Index) size() int {
+	if ix.remote != nil {
+		return int(ix.remote.info.Size)
+	}
+	return len(ix.data.d)
+}
+
 // uint32 returns the uint32 value at the given offset in the index data.
 func (ix *Index) uint32(off uint32) uint32 {
 	return binary.BigEndian.Uint32(ix.slice(off, 4))
@@ -131,13 +397,31 @@ func (ix *Index) uint32(off uint32) uint32 {
 
 // uvarint returns the varint value at the given offset in the index data.
 func (ix *Index) uvarint(off uint32) uint32 {
-	v, n := binary.Uvarint(ix.slice(off, -1))
+	v, n := binary.Uvarint(ix.slice(off, min(binary.MaxVarintLen64, ix.size()-int(off))))
 	if n <= 0 {
 		corrupt()
 	}
 	return uint32(v)
 }
 
+// Preload asks the operating system to start reading into memory the
+// parts of the index that every search uses: the name and posting
+// lists and their indexes.  Without it they are read a page at a time
+// as searches touch them, which can make the first searches of a large
+// index on a cold cache slow.  The remaining sections, such as the
+// symbol table, are still read only when needed.
+func (ix *Index) Preload() {
+	if ix.data.f == nil {
+		// Already in memory (see OpenBytes).
+		return
+	}
+	end := int(ix.postIndex) + ix.numPost*postEntrySize
+	if end > len(ix.data.d) {
+		end = len(ix.data.d)
+	}
+	willNeed(ix.data.d[:end])
+}
+
 // Paths returns the list of indexed paths.
 func (ix *Index) Paths() []string {
 	off := ix.pathData
@@ -153,13 +437,24 @@ func (ix *Index) Paths() []string {
 	return x
 }
 
+// NumFiles returns the number of files in the index.
+func (ix *Index) NumFiles() int {
+	return ix.numName
+}
+
 // NameBytes returns the name corresponding to the given fileid.
 func (ix *Index) NameBytes(fileid uint32) []byte {
+	if ix.version >= 4 {
+		return ix.compressedName(fileid)
+	}
 	off := ix.uint32(ix.nameIndex + 4*fileid)
 	return ix.str(ix.nameData + off)
 }
 
 func (ix *Index) str(off uint32) []byte {
+	if ix.remote != nil {
+		return ix.remote.str(int(off))
+	}
 	str := ix.slice(off, -1)
 	i := bytes.IndexByte(str, '\x00')
 	if i < 0 {
@@ -173,6 +468,51 @@ func (ix *Index) Name(fileid uint32) string {
 	return string(ix.NameBytes(fileid))
 }
 
+// Lookup returns the fileid of the file with the given name.
+// The boolean result reports whether the name was found.
+func (ix *Index) Lookup(name string) (fileid uint32, ok bool) {
+	name = slashName(name)
+	i := sort.Search(ix.numName, func(i int) bool {
+		return string(ix.NameBytes(uint32(i))) >= name
+	})
+	if i < ix.numName && string(ix.NameBytes(uint32(i))) == name {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+// FileRange returns the fileids of the files whose names begin with
+// prefix, which are lo <= fileid < hi.  The index keeps the names in
+// sorted order, so the files with a common prefix, such as those under
+// a directory named with a trailing slash, have consecutive fileids.
+func (ix *Index) FileRange(prefix string) (lo, hi uint32) {
+	p := []byte(slashName(prefix))
+	i := sort.Search(ix.numName, func(i int) bool {
+		return bytes.Compare(ix.NameBytes(uint32(i)), p) >= 0
+	})
+	j := i + sort.Search(ix.numName-i, func(j int) bool {
+		return !bytes.HasPrefix(ix.NameBytes(uint32(i+j)), p)
+	})
+	return uint32(i), uint32(j)
+}
+
+// Files returns an iterator over the fileids and names of the files
+// whose names begin with prefix, in order by name.  An empty prefix
+// selects every file.  Files finds the range of them with FileRange,
+// so listing the files under a path takes time in proportion to their
+// number rather than to the size of the index.  Meta returns the
+// metadata recorded for each fileid.
+func (ix *Index) Files(prefix string) iter.Seq2[uint32, string] {
+	return func(yield func(uint32, string) bool) {
+		lo, hi := ix.FileRange(prefix)
+		for fileid := lo; fileid < hi; fileid++ {
+			if !yield(fileid, ix.Name(fileid)) {
+				return
+			}
+		}
+	}
+}
+
 // listAt returns the index list entry at the given offset.
 func (ix *Index) listAt(off uint32) (trigram, count, offset uint32) {
 	d := ix.slice(ix.postIndex+off, postEntrySize)
@@ -182,18 +522,9 @@ func (ix *Index) listAt(off uint32) (trigram, count, offset uint32) {
 	return
 }
 
-func (ix *Index) dumpPosting() {
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
-	for i := 0; i < ix.numPost; i++ {
-		j := i * postEntrySize
-		t := uint32(d[j])<<16 | uint32(d[j+1])<<8 | uint32(d[j+2])
-		count := int(binary.BigEndian.Uint32(d[j+3:]))
-		offset := binary.BigEndian.Uint32(d[j+3+4:])
-		log.Printf("%#x: %d at %d", t, count, offset)
-	}
-}
-
-func (ix *Index) findList(trigram uint32) (count int, offset uint32) {
+// findList returns the number of files in the posting list of trigram
+// and the offsets, relative to postData, of the list and of its end.
+func (ix *Index) findList(trigram uint32) (count int, offset, end uint32) {
 	// binary search
 	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
 	i := sort.Search(ix.numPost, func(i int) bool {
@@ -202,15 +533,24 @@ func (ix *Index) findList(trigram uint32) (count int, offset uint32) {
 		return t >= trigram
 	})
 	if i >= ix.numPost {
-		return 0, 0
+		return 0, 0, 0
 	}
-	i *= postEntrySize
-	t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
+	e := d[i*postEntrySize:]
+	t := uint32(e[0])<<16 | uint32(e[1])<<8 | uint32(e[2])
 	if t != trigram {
-		return 0, 0
+		return 0, 0, 0
+	}
+	count = int(binary.BigEndian.Uint32(e[3:]))
+	offset = binary.BigEndian.Uint32(e[3+4:])
+	// The lists are laid out in order by trigram,
+	// followed by the name index.
+	end = ix.nameIndex - ix.postData
+	if i+1 < ix.numPost {
+		end = binary.BigEndian.Uint32(e[postEntrySize+3+4:])
+	}
+	if end < offset+3 {
+		corrupt()
 	}
-	count = int(binary.BigEndian.Uint32(d[i+3:]))
-	offset = binary.BigEndian.Uint32(d[i+3+4:])
 	return
 }
 
@@ -221,19 +561,41 @@ type postReader struct {
 	fileid   uint32
 	d        []byte
 	restrict []uint32
+	roaring  *roaringList // list in roaring encoding, if any
+	ids      []uint32     // decoded roaring list, if not restricted
+	all      bool         // list of a stop trigram: every file
 }
 
 func (r *postReader) init(ix *Index, trigram uint32, restrict []uint32) {
-	count, offset := ix.findList(trigram)
+	count, offset, end := ix.findList(trigram)
 	if count == 0 {
+		if ix.isStop(trigram) {
+			r.ix = ix
+			r.count = ix.numName
+			r.fileid = ^uint32(0)
+			r.restrict = restrict
+			r.all = true
+		}
 		return
 	}
 	r.ix = ix
 	r.count = count
 	r.offset = offset
 	r.fileid = ^uint32(0)
-	r.d = ix.slice(ix.postData+offset+3, -1)
+	r.d = ix.slice(ix.postData+offset+3, int(end-offset-3))
 	r.restrict = restrict
+	if len(r.d) > 0 && r.d[0] == 0 {
+		// Roaring list.  If the list is restricted, test the
+		// restricted files for membership rather than reading
+		// the whole list.
+		r.roaring = parseRoaring(r.d[1:])
+		if restrict == nil {
+			r.ids = r.roaring.appendIDs(make([]uint32, 0, count))
+			if len(r.ids) != count {
+				corrupt()
+			}
+		}
+	}
 }
 
 func (r *postReader) max() int {
@@ -241,6 +603,12 @@ func (r *postReader) max() int {
 }
 
 func (r *postReader) next() bool {
+	if r.roaring != nil {
+		return r.nextRoaring()
+	}
+	if r.all {
+		return r.nextAll()
+	}
 	for r.count > 0 {
 		r.count--
 		delta64, n := binary.Uvarint(r.d)
@@ -270,6 +638,42 @@ func (r *postReader) next() bool {
 	return false
 }
 
+func (r *postReader) nextRoaring() bool {
+	if r.restrict != nil {
+		for len(r.restrict) > 0 {
+			fileid := r.restrict[0]
+			r.restrict = r.restrict[1:]
+			if r.roaring.contains(fileid) {
+				r.fileid = fileid
+				return true
+			}
+		}
+	} else if len(r.ids) > 0 {
+		r.fileid = r.ids[0]
+		r.ids = r.ids[1:]
+		return true
+	}
+	r.fileid = ^uint32(0)
+	return false
+}
+
+// nextAll advances through the list of every file,
+// which stands for the list of a stop trigram.
+func (r *postReader) nextAll() bool {
+	if r.restrict != nil {
+		if len(r.restrict) > 0 {
+			r.fileid = r.restrict[0]
+			r.restrict = r.restrict[1:]
+			return true
+		}
+	} else if r.fileid+1 < uint32(r.count) {
+		r.fileid++
+		return true
+	}
+	r.fileid = ^uint32(0)
+	return false
+}
+
 func (ix *Index) PostingList(trigram uint32) []uint32 {
 	return ix.postingList(trigram, nil)
 }
@@ -291,7 +695,21 @@ func (ix *Index) PostingAnd(list []uint32, trigram uint32) []uint32 {
 func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) []uint32 {
 	var r postReader
 	r.init(ix, trigram, restrict)
+	if r.all {
+		return list
+	}
 	x := list[:0]
+	if r.roaring != nil {
+		// Test the files in list for membership
+		// rather than reading the whole list.
+		// The callers' lists are already restricted.
+		for _, fileid := range list {
+			if r.roaring.contains(fileid) {
+				x = append(x, fileid)
+			}
+		}
+		return x
+	}
 	i := 0
 	for r.next() {
 		fileid := r.fileid
@@ -331,30 +749,69 @@ func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) []u
 }
 
 func (ix *Index) PostingQuery(q *Query) []uint32 {
-	return ix.postingQuery(q, nil)
+	return ix.aliasQuery(context.Background(), q, nil)
+}
+
+// PostingQueryContext is like PostingQuery, but it gives up and returns
+// ctx.Err() if ctx is done before the query finishes, as when a search
+// for a regexp such as .* with no trigrams to narrow it runs too long.
+func (ix *Index) PostingQueryContext(ctx context.Context, q *Query) ([]uint32, error) {
+	list := ix.aliasQuery(ctx, q, nil)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
 }
 
-func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
-	var list []uint32
+// postingQuery returns the files in restrict, or in the whole index if
+// restrict is nil, that might match q.  It checks ctx between posting
+// lists, returning an incomplete list once ctx is done.
+func (ix *Index) postingQuery(ctx context.Context, q *Query, restrict []uint32) (ret []uint32) {
+	var list, list1 []uint32
 	switch q.Op {
 	case QNone:
 		// nothing
 	case QAll:
-		if restrict != nil {
-			return restrict
-		}
-		list = make([]uint32, ix.numName)
-		for i := range list {
-			list[i] = uint32(i)
-		}
-		return list
+		return ix.allFiles(restrict)
 	case QAnd:
-		for _, t := range q.Trigram {
-			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
-			if list == nil {
-				list = ix.postingList(tri, restrict)
+		// Start from the precomputed list of a pair
+		// of the trigrams, if there is one.
+		var t1, t2 int
+		list, t1, t2 = ix.pairStart(q, restrict)
+		if list != nil && len(list) == 0 {
+			return nil
+		}
+		for i, t := range q.Trigram {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if i == t1 || i == t2 {
+				continue
+			}
+			tris := trigramVariants(t, q.Fold)
+			if ix.anyStop(tris) {
+				// Every file has t, as far as the index knows.
+				continue
+			}
+			if len(tris) > 1 {
+				// The file may hold any of the variants,
+				// so OR them, restricted to the files
+				// that matched so far.
+				if list == nil {
+					list = restrict
+				}
+				for i, tri := range tris {
+					if i == 0 {
+						list1 = ix.postingList(tri, list)
+					} else {
+						list1 = ix.postingOr(list1, tri, list)
+					}
+				}
+				list = list1
+			} else if list == nil {
+				list = ix.postingList(tris[0], restrict)
 			} else {
-				list = ix.postingAnd(list, tri, restrict)
+				list = ix.postingAnd(list, tris[0], restrict)
 			}
 			if len(list) == 0 {
 				return nil
@@ -364,28 +821,72 @@ func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
 			if list == nil {
 				list = restrict
 			}
-			list = ix.postingQuery(sub, list)
+			list = ix.postingQuery(ctx, sub, list)
 			if len(list) == 0 {
 				return nil
 			}
 		}
+		if list == nil {
+			// All the trigrams were stop trigrams.
+			return ix.allFiles(restrict)
+		}
 	case QOr:
 		for _, t := range q.Trigram {
-			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
-			if list == nil {
-				list = ix.postingList(tri, restrict)
-			} else {
-				list = ix.postingOr(list, tri, restrict)
+			if ctx.Err() != nil {
+				return nil
+			}
+			tris := trigramVariants(t, q.Fold)
+			if ix.anyStop(tris) {
+				return ix.allFiles(restrict)
+			}
+			for _, tri := range tris {
+				if list == nil {
+					list = ix.postingList(tri, restrict)
+				} else {
+					list = ix.postingOr(list, tri, restrict)
+				}
 			}
 		}
 		for _, sub := range q.Sub {
-			list1 := ix.postingQuery(sub, restrict)
+			list1 := ix.postingQuery(ctx, sub, restrict)
 			list = mergeOr(list, list1)
 		}
 	}
 	return list
 }
 
+// allFiles returns the list of every file in the index,
+// restricted to restrict if it is not nil.
+func (ix *Index) allFiles(restrict []uint32) []uint32 {
+	if restrict != nil {
+		return restrict
+	}
+	list := make([]uint32, ix.numName)
+	for i := range list {
+		list[i] = uint32(i)
+	}
+	return list
+}
+
+// trigramVariants returns the trigrams matching the string t.
+// If fold is set, they include every ASCII case variant of t.
+func trigramVariants(t string, fold bool) []uint32 {
+	tris := []uint32{uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])}
+	if !fold {
+		return tris
+	}
+	for i := 0; i < 3; i++ {
+		c := t[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			shift := uint(16 - 8*i)
+			for _, tri := range tris {
+				tris = append(tris, tri^0x20<<shift)
+			}
+		}
+	}
+	return tris
+}
+
 func mergeOr(l1, l2 []uint32) []uint32 {
 	var l []uint32
 	i := 0
@@ -426,17 +927,39 @@ func mmap(file string) mmapData {
 	return mmapFile(f)
 }
 
+// Close unmaps the index and closes its file.
+// The index must not be used after Close.
+func (ix *Index) Close() error {
+	if ix.data.f == nil {
+		// Opened by OpenBytes.
+		ix.data.d = nil
+		return nil
+	}
+	return ix.data.close()
+}
+
 // File returns the name of the index file to use.
 // It is either $CSEARCHINDEX or $HOME/.csearchindex.
+// If $CSEARCHINDEX lists several indexes, File returns the first.
 func File() string {
-	f := os.Getenv("CSEARCHINDEX")
-	if f != "" {
-		return f
+	return Files()[0]
+}
+
+// Files returns the names of the index files to search.
+// They are listed in $CSEARCHINDEX, separated by the
+// operating system's path list separator, such as ':'
+// (see SplitList; an index may be a URL, as described in remote.go),
+// or, if that is unset, .csearchindex in the home directory:
+// $HOME, or else the directory the system reports, such as
+// %USERPROFILE% on Windows.
+func Files() []string {
+	if files := SplitList(os.Getenv("CSEARCHINDEX")); len(files) > 0 {
+		return files
 	}
-	var home string
-	home = os.Getenv("HOME")
-	if runtime.GOOS == "windows" && home == "" {
-		home = os.Getenv("USERPROFILE")
+	home := os.Getenv("HOME")
+	if home == "" {
+		// Windows sets %USERPROFILE% instead.
+		home, _ = os.UserHomeDir()
 	}
-	return filepath.Clean(home + "/.csearchindex")
+	return []string{filepath.Clean(home + "/.csearchindex")}
 }
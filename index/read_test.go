@@ -5,8 +5,14 @@
 package index
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -27,6 +33,7 @@ func TestTrivialPosting(t *testing.T) {
 	out := f.Name()
 	buildIndex(out, nil, postFiles)
 	ix := Open(out)
+	ix.Preload()
 	if l := ix.PostingList(tri('S', 'e', 'a')); !equalList(l, []uint32{1, 3}) {
 		t.Errorf("PostingList(Sea) = %v, want [1 3]", l)
 	}
@@ -47,6 +54,295 @@ func TestTrivialPosting(t *testing.T) {
 	}
 }
 
+func TestPostingQueryContext(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(out, nil, postFiles)
+	ix := Open(out)
+	defer ix.Close()
+	q := &Query{Op: QAnd, Trigram: []string{"Goo", "Sea"}}
+	l, err := ix.PostingQueryContext(context.Background(), q)
+	if err != nil || !equalList(l, []uint32{1, 3}) {
+		t.Errorf("PostingQueryContext(Goo&Sea) = %v, %v, want [1 3], nil", l, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if l, err := ix.PostingQueryContext(ctx, q); l != nil || err != context.Canceled {
+		t.Errorf("canceled PostingQueryContext = %v, %v, want nil, %v", l, err, context.Canceled)
+	}
+	if l, err := ix.PostingQueryNamesContext(ctx, q, nil); l != nil || err != context.Canceled {
+		t.Errorf("canceled PostingQueryNamesContext = %v, %v, want nil, %v", l, err, context.Canceled)
+	}
+}
+
+func TestFoldPosting(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, nil, map[string]string{
+		"file0": "google code search",
+		"file1": "Google Code Search",
+		"file2": "GOOGLE CODE PROJECT",
+		"file3": "Google Web Search",
+		"file4": "ΣΟΦΌΣ Привет",
+		"file5": "σοφός привет",
+		"file6": "σοφοσ ПРИВЕТ",
+	})
+	ix := Open(out)
+	for _, tt := range []struct {
+		re   string
+		want []uint32
+	}{
+		{`(?i)code`, []uint32{0, 1, 2}},
+		{`(?i)CODE SEARCH`, []uint32{0, 1}},
+		{`(?i)search|project`, []uint32{0, 1, 2, 3}},
+		{`Code`, []uint32{1}},
+		{`(?i)σοφός`, []uint32{4, 5}},
+		{`(?i)ПРИВЕТ`, []uint32{4, 5, 6}},
+		{`(?i)σοφός привет`, []uint32{4, 5}},
+	} {
+		re, err := syntax.Parse(tt.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := RegexpQuery(re)
+		if l := ix.PostingQuery(q); !equalList(l, tt.want) {
+			t.Errorf("PostingQuery(%s) = %v, want %v", q, l, tt.want)
+		}
+	}
+}
+
+// trivialIndexV1 is trivialIndex in the version 1 format,
+// which has no section index or sections.
+var trivialIndexV1 = join(
+	"csearch index 1\n",
+	trivialIndex[16:16+1+38+62+28+132],
+
+	// trailer
+	u32(16),
+	u32(16+1),
+	u32(16+1+38),
+	u32(16+1+38+62),
+	u32(16+1+38+62+28),
+
+	"\ncsearch trailr\n",
+)
+
+func TestReadV1(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	f.WriteString(trivialIndexV1)
+	f.Close()
+
+	ix := Open(f.Name())
+	if v := ix.Version(); v != 1 {
+		t.Errorf("Version() = %d, want 1", v)
+	}
+	if n := ix.NumFiles(); n != 6 {
+		t.Errorf("NumFiles() = %d, want 6", n)
+	}
+	if name := ix.Name(5); name != "thefile2" {
+		t.Errorf("Name(5) = %q, want thefile2", name)
+	}
+	if l := ix.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(abc) = %v, want [0 3]", l)
+	}
+	if ix.HasMeta() {
+		t.Errorf("HasMeta() = true, want false")
+	}
+	if m := ix.Meta(0); m != (FileMeta{}) {
+		t.Errorf("Meta(0) = %+v, want zero FileMeta", m)
+	}
+
+	// Merging with a version 1 index produces a current index.
+	out := f.Name() + "~"
+	defer os.Remove(out)
+	out2 := f.Name() + "~~"
+	defer os.Remove(out2)
+	buildIndex(out, []string{"/src"}, map[string]string{"/src/main.go": "package main\n"})
+	Merge(out2, f.Name(), out)
+	ix = Open(out2)
+	if v := ix.Version(); v != 3 {
+		t.Errorf("merged Version() = %d, want 3", v)
+	}
+	if n := ix.NumFiles(); n != 7 {
+		t.Errorf("merged NumFiles() = %d, want 7", n)
+	}
+	if id, ok := ix.Lookup("/src/main.go"); !ok || ix.Meta(id).Lang != "go" {
+		t.Errorf("merged Meta(/src/main.go) = %+v, want Lang go", ix.Meta(id))
+	}
+	if id, _ := ix.Lookup("file1"); ix.Meta(id) != (FileMeta{}) {
+		t.Errorf("merged Meta(file1) = %+v, want zero FileMeta", ix.Meta(id))
+	}
+}
+
+var langFiles = map[string]string{
+	"/src/Makefile":    "all:\n",
+	"/src/main.go":     "package main\n",
+	"/src/notes":       "nothing\n",
+	"/src/lib/util.py": "import os\n",
+	"/src/lib/x.H":     "int x;\n",
+	"/src/lib/y.go":    "package lib\n",
+	"/src/lib/z.h":     "namespace z {}\n",
+	"/src/run":         "#!/usr/bin/env python3\n",
+}
+
+func TestMetaLang(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, nil, langFiles)
+	ix := Open(out)
+
+	// Concurrent searches share an Index, so the first calls of Meta,
+	// which read the language names, may run at once.
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name, want := range map[string]string{
+				"/src/Makefile":    "make",
+				"/src/main.go":     "go",
+				"/src/notes":       "",
+				"/src/lib/util.py": "py",
+				"/src/lib/x.H":     "c",
+				"/src/lib/y.go":    "go",
+				"/src/lib/z.h":     "cpp",
+				"/src/run":         "py",
+			} {
+				id, ok := ix.Lookup(name)
+				if !ok {
+					t.Errorf("Lookup(%q) failed", name)
+					continue
+				}
+				if lang := ix.Meta(id).Lang; lang != want {
+					t.Errorf("Meta(%q).Lang = %q, want %q", name, lang, want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMetaRepo(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	w := Create(f1.Name())
+	w.AddPaths([]string{"/src"})
+	w.SetRepo("/src", "main")
+	w.SetRepo("/src/lib", "lib")
+	var names []string
+	for name := range langFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.Add(name, strings.NewReader(langFiles[name]))
+	}
+	w.Flush()
+
+	// Merging must preserve the repositories.
+	Merge(f2.Name(), f1.Name(), f1.Name())
+	for _, file := range []string{f1.Name(), f2.Name()} {
+		ix := Open(file)
+		// As in csearchd, where every request checks the repositories
+		// of its files, the repository names may be read concurrently.
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for name, want := range map[string]string{
+					"/src/Makefile":    "main",
+					"/src/lib/util.py": "lib",
+					"/src/lib/y.go":    "lib",
+					"/src/notes":       "main",
+				} {
+					id, _ := ix.Lookup(name)
+					if repo := ix.Meta(id).Repo; repo != want {
+						t.Errorf("Meta(%q).Repo = %q, want %q", name, repo, want)
+					}
+				}
+				if repos, want := ix.Repos(), []string{"main", "lib"}; !equalStrings(repos, want) {
+					t.Errorf("Repos() = %q, want %q", repos, want)
+				}
+				for path, want := range map[string]string{"/src": "main", "/src/lib": "lib", "/src/main.go": "main", "/other": ""} {
+					if repo := ix.PathRepo(path); repo != want {
+						t.Errorf("PathRepo(%q) = %q, want %q", path, repo, want)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestFiles(t *testing.T) {
+	defer os.Setenv("CSEARCHINDEX", os.Getenv("CSEARCHINDEX"))
+	sep := string(filepath.ListSeparator)
+	os.Setenv("CSEARCHINDEX", "/a/index"+sep+sep+"/b/index")
+	if files, want := Files(), []string{"/a/index", "/b/index"}; !equalStrings(files, want) {
+		t.Errorf("Files() = %q, want %q", files, want)
+	}
+	if file := File(); file != "/a/index" {
+		t.Errorf("File() = %q, want %q", file, "/a/index")
+	}
+	os.Setenv("CSEARCHINDEX", "")
+	if files := Files(); len(files) != 1 || filepath.Base(files[0]) != ".csearchindex" {
+		t.Errorf("Files() = %q, want $HOME/.csearchindex", files)
+	}
+}
+
+func TestIndexFiles(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, nil, langFiles)
+	ix := Open(out)
+	for _, tt := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"/src/Makefile", "/src/lib/util.py", "/src/lib/x.H", "/src/lib/y.go", "/src/lib/z.h", "/src/main.go", "/src/notes", "/src/run"}},
+		{"/src/lib/", []string{"/src/lib/util.py", "/src/lib/x.H", "/src/lib/y.go", "/src/lib/z.h"}},
+		{"/src/lib/y", []string{"/src/lib/y.go"}},
+		{"/src/main.go", []string{"/src/main.go"}},
+		{"/src/r", []string{"/src/run"}},
+		{"/src/lib/zz", nil},
+		{"/other", nil},
+		{"/zzz", nil},
+	} {
+		var names []string
+		for fileid, name := range ix.Files(tt.prefix) {
+			if name != ix.Name(fileid) {
+				t.Errorf("Files(%q): fileid %d has name %q, want %q", tt.prefix, fileid, name, ix.Name(fileid))
+			}
+			names = append(names, name)
+		}
+		if !equalStrings(names, tt.want) {
+			t.Errorf("Files(%q) = %q, want %q", tt.prefix, names, tt.want)
+		}
+		lo, hi := ix.FileRange(tt.prefix)
+		if int(hi-lo) != len(tt.want) {
+			t.Errorf("FileRange(%q) = %d, %d, want %d files", tt.prefix, lo, hi, len(tt.want))
+		}
+	}
+
+	// Stopping early stops the iteration.
+	n := 0
+	for range ix.Files("/src/") {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Errorf("Files did not stop after 2 files")
+	}
+}
+
 func equalList(x, y []uint32) bool {
 	if len(x) != len(y) {
 		return false
@@ -58,3 +354,37 @@ func equalList(x, y []uint32) bool {
 	}
 	return true
 }
+
+func TestChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("hello "+name+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := dir + ".ix"
+	defer os.Remove(out)
+	w := Create(out)
+	w.AddPaths([]string{dir})
+	w.AddTree(dir)
+	w.Flush()
+
+	// Change b and remove c.
+	if err := ioutil.WriteFile(filepath.Join(dir, "b"), []byte("goodbye b\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "c"))
+
+	ix := Open(out)
+	defer ix.Close()
+	for i, want := range [][2]bool{{false, false}, {true, false}, {true, true}} {
+		changed, gone := ix.Changed(uint32(i))
+		if changed != want[0] || gone != want[1] {
+			t.Errorf("Changed(%s) = %v, %v, want %v, %v", ix.Name(uint32(i)), changed, gone, want[0], want[1])
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // A Query is a matching machine, like a regular expression,
@@ -19,12 +20,20 @@ import (
 // quite a bit more.  We can then filter target files by whether they match
 // the Query (using a trigram index) before running the comparatively
 // more expensive regexp machinery.
+//
+// A Query can also be built with TrigramQuery, AndQuery, and OrQuery,
+// and it encodes to and decodes from JSON.
 type Query struct {
 	Op      QueryOp
 	Trigram []string
 	Sub     []*Query
+
+	// Fold records that the trigrams match text ignoring ASCII case.
+	// The trigrams themselves are written in lower case.
+	Fold bool
 }
 
+// A QueryOp is the kind of a Query node.
 type QueryOp int
 
 const (
@@ -47,6 +56,29 @@ func (q *Query) or(r *Query) *Query {
 	return q.andOr(r, QOr)
 }
 
+// And returns the query q AND r, possibly reusing q's and r's storage.
+// It can be used to combine the queries for several regexps, all of
+// which must match.
+func (q *Query) And(r *Query) *Query {
+	return q.combine(r, QAnd)
+}
+
+// Or returns the query q OR r, possibly reusing q's and r's storage.
+// It can be used to combine the queries for several regexps, any of
+// which may match.
+func (q *Query) Or(r *Query) *Query {
+	return q.combine(r, QOr)
+}
+
+// combine returns q AND r or q OR r, taking care not to merge the
+// trigrams of queries that differ in case sensitivity.
+func (q *Query) combine(r *Query, op QueryOp) *Query {
+	if q.Fold != r.Fold && q.Op != QAll && q.Op != QNone && r.Op != QAll && r.Op != QNone {
+		return &Query{Op: op, Sub: []*Query{q, r}}
+	}
+	return q.andOr(r, op)
+}
+
 // andOr returns the query q AND r or q OR r, possibly reusing q's and r's storage.
 // It works hard to avoid creating unnecessarily complicated structures.
 func (q *Query) andOr(r *Query, op QueryOp) (out *Query) {
@@ -281,6 +313,13 @@ func (q *Query) andTrigrams(t stringSet) *Query {
 }
 
 func (q *Query) String() string {
+	if q != nil && q.Fold {
+		return "(?i)" + q.string()
+	}
+	return q.string()
+}
+
+func (q *Query) string() string {
 	if q == nil {
 		return "?"
 	}
@@ -320,9 +359,9 @@ func (q *Query) String() string {
 		if len(q.Trigram) > 0 {
 			s += sjoin
 		}
-		s += q.Sub[0].String()
+		s += q.Sub[0].string()
 		for i := 1; i < len(q.Sub); i++ {
-			s += sjoin + q.Sub[i].String()
+			s += sjoin + q.Sub[i].string()
 		}
 	}
 	s += end
@@ -330,13 +369,258 @@ func (q *Query) String() string {
 }
 
 // RegexpQuery returns a Query for the given regexp.
+//
+// If any part of the regexp is case-insensitive, RegexpQuery
+// builds the query from a lower-case copy of the regexp and
+// marks it to match trigrams ignoring ASCII case, rather than
+// listing every case variant of every trigram.  The variants
+// are consulted when the query is evaluated against the index.
+// Letters with forms outside ASCII, whose variants differ in more
+// than one bit, are instead listed in all the forms given by Unicode
+// simple case folding, as the regexp matcher uses (see foldedLiteral).
+//
+// The query lists only trigrams that a matching file must contain,
+// never trigrams it must not.  Such "negative" trigrams cannot be
+// derived soundly: a regexp like foo[^b]ar rules out foobar at the
+// place it matches, but a file that matches may contain foobar
+// somewhere else, so excluding the files with the trigrams of foobar
+// would lose matches.  A negated class therefore contributes no
+// trigrams, and the query relies on the literal text around it.
 func RegexpQuery(re *syntax.Regexp) *Query {
+	fold := hasFoldCase(re)
+	if fold {
+		re = lowerRegexp(re)
+	}
 	info := analyze(re)
 	info.simplify(true)
 	info.addExact()
+	if fold {
+		info.match.setFold()
+	}
 	return info.match
 }
 
+// LiteralQuery returns a Query for files containing the string s,
+// which is the AND of the trigrams in s.  It is equivalent to
+// RegexpQuery for a regexp matching s literally, but does not
+// need the regexp.
+func LiteralQuery(s string) *Query {
+	return allQuery.andTrigrams(stringSet{s})
+}
+
+// setFold marks q and its subqueries as case-insensitive.
+func (q *Query) setFold() {
+	if q.Op != QAnd && q.Op != QOr {
+		// Leave the shared allQuery and noneQuery alone.
+		return
+	}
+	q.Fold = true
+	for _, sub := range q.Sub {
+		sub.setFold()
+	}
+}
+
+// hasFoldCase reports whether re contains any case-insensitive
+// literals or character classes.
+func hasFoldCase(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral, syntax.OpCharClass:
+		return re.Flags&syntax.FoldCase != 0
+	}
+	for _, sub := range re.Sub {
+		if hasFoldCase(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerRegexp returns a copy of re with the ASCII upper-case letters
+// in its literals and character classes replaced by lower case.
+// The result matches the lower-cased version of every string re
+// matches, so its trigrams can be matched against text ignoring
+// ASCII case.  A case-insensitive letter that also folds to a
+// non-ASCII letter (such as k, which folds to the Kelvin sign)
+// becomes a character class holding all its forms, except in a
+// longer literal, which stays case-insensitive for analyze to
+// handle (see foldedLiteral).
+func lowerRegexp(re *syntax.Regexp) *syntax.Regexp {
+	re1 := *re
+	re1.Flags &^= syntax.FoldCase
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			re1.Rune = make([]rune, len(re.Rune))
+			for i, r := range re.Rune {
+				re1.Rune[i] = lowerASCII(r)
+			}
+			return &re1
+		}
+		if len(re.Rune) > 1 && hasUnicodeFold(re.Rune) {
+			re1.Flags |= syntax.FoldCase
+			re1.Rune = make([]rune, len(re.Rune))
+			for i, r := range re.Rune {
+				re1.Rune[i] = lowerASCII(r)
+			}
+			return &re1
+		}
+		// Rewrite into concatenation of the folded
+		// single runes, each a literal or a class.
+		re1.Op = syntax.OpConcat
+		re1.Rune = nil
+		re1.Sub = nil
+		for _, r := range re.Rune {
+			sub := &syntax.Regexp{Op: syntax.OpLiteral, Rune: []rune{lowerASCII(r)}}
+			for r1 := unicode.SimpleFold(r); r1 != r; r1 = unicode.SimpleFold(r1) {
+				if r1 >= utf8.RuneSelf {
+					sub.Op = syntax.OpCharClass
+					sub.Rune = nil
+					for r1 := unicode.SimpleFold(r); ; r1 = unicode.SimpleFold(r1) {
+						r2 := lowerASCII(r1)
+						sub.Rune = append(sub.Rune, r2, r2)
+						if r1 == r {
+							break
+						}
+					}
+					break
+				}
+			}
+			re1.Sub = append(re1.Sub, sub)
+		}
+		return &re1
+
+	case syntax.OpCharClass:
+		re1.Rune = nil
+		for i := 0; i < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if lo > 'Z' || hi < 'A' {
+				re1.Rune = append(re1.Rune, lo, hi)
+				continue
+			}
+			if lo < 'A' {
+				re1.Rune = append(re1.Rune, lo, 'A'-1)
+			}
+			if hi > 'Z' {
+				re1.Rune = append(re1.Rune, 'Z'+1, hi)
+			}
+			if lo < 'A' {
+				lo = 'A'
+			}
+			if hi > 'Z' {
+				hi = 'Z'
+			}
+			re1.Rune = append(re1.Rune, lowerASCII(lo), lowerASCII(hi))
+		}
+		return &re1
+	}
+	if len(re.Sub) > 0 {
+		re1.Sub = make([]*syntax.Regexp, len(re.Sub))
+		for i, sub := range re.Sub {
+			re1.Sub[i] = lowerRegexp(sub)
+		}
+	}
+	return &re1
+}
+
+// hasUnicodeFold reports whether any of runes is or folds to
+// a non-ASCII letter.
+func hasUnicodeFold(runes []rune) bool {
+	for _, r := range runes {
+		if r >= utf8.RuneSelf && unicode.SimpleFold(r) != r {
+			return true
+		}
+		for r1 := unicode.SimpleFold(r); r1 != r; r1 = unicode.SimpleFold(r1) {
+			if r1 >= utf8.RuneSelf {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// foldForms returns the forms of r that a case-insensitive match
+// accepts, as listed in a query that matches ASCII letters ignoring
+// case: r itself and the runes it folds to, with ASCII letters in
+// lower case.
+func foldForms(r rune) stringSet {
+	forms := stringSet{string(lowerASCII(r))}
+	for r1 := unicode.SimpleFold(r); r1 != r; r1 = unicode.SimpleFold(r1) {
+		forms.add(string(lowerASCII(r1)))
+	}
+	forms.clean(false)
+	return forms
+}
+
+// foldedLiteral returns the regexpInfo for the case-insensitive
+// literal runes, at least two of them, whose ASCII letters are in
+// lower case.  Analyzing the literal as a concatenation of character
+// classes, one per letter, would list every way of writing it in
+// upper and lower case, a set growing exponentially with its length
+// when it has letters outside ASCII, such as the Greek and Cyrillic
+// ones, whose forms the query cannot match ignoring case the way it
+// does ASCII letters.  Once there are too many ways to list exactly,
+// foldedLiteral instead requires, at each letter, one of the trigrams
+// that can begin there, which depend only on the forms of that letter
+// and the next two.
+func foldedLiteral(runes []rune) regexpInfo {
+	forms := make([]stringSet, len(runes))
+	n := 1
+	for i, r := range runes {
+		forms[i] = foldForms(r)
+		n = min(n*len(forms[i]), maxExact+1)
+	}
+	var info regexpInfo
+	if n <= maxExact {
+		info.exact = crossForms(forms)
+		info.match = allQuery
+		info.simplify(false)
+		return info
+	}
+
+	info.match = allQuery
+	for i := range forms {
+		var t stringSet
+		for _, s := range crossForms(forms[i:min(i+3, len(forms))]) {
+			if len(s) < 3 {
+				t = nil
+				break
+			}
+			t.add(s[:3])
+		}
+		if t == nil {
+			break
+		}
+		t.clean(false)
+		info.match = info.match.andTrigrams(t)
+	}
+	k := 1
+	if len(forms[0])*len(forms[1]) <= maxSet && len(forms[len(forms)-2])*len(forms[len(forms)-1]) <= maxSet {
+		k = 2
+	}
+	info.prefix = crossForms(forms[:k])
+	info.suffix = crossForms(forms[len(forms)-k:])
+	info.simplify(false)
+	return info
+}
+
+// crossForms returns every concatenation of one string from each of forms.
+func crossForms(forms []stringSet) stringSet {
+	s := stringSet{""}
+	for _, f := range forms {
+		s = s.cross(f, false)
+	}
+	return s
+}
+
+// lowerASCII returns the lower-case form of r if r is
+// an ASCII upper-case letter, or else r itself.
+func lowerASCII(r rune) rune {
+	if 'A' <= r && r <= 'Z' {
+		r += 'a' - 'A'
+	}
+	return r
+}
+
 // A regexpInfo summarizes the results of analyzing a regexp.
 type regexpInfo struct {
 	// canEmpty records whether the regexp matches the empty string
@@ -451,18 +735,8 @@ func analyze(re *syntax.Regexp) (ret regexpInfo) {
 				info = analyze(re1)
 				return info
 			}
-			// Multi-letter case-folded string:
-			// treat as concatenation of single-letter case-folded strings.
-			re1 := &syntax.Regexp{
-				Op:    syntax.OpLiteral,
-				Flags: syntax.FoldCase,
-			}
-			info = emptyString()
-			for i := range re.Rune {
-				re1.Rune = re.Rune[i : i+1]
-				info = concat(info, analyze(re1))
-			}
-			return info
+			// Multi-letter case-folded string, as left by lowerRegexp.
+			return foldedLiteral(re.Rune)
 		}
 		info.exact = stringSet{string(re.Rune)}
 		info.match = allQuery
@@ -35,6 +35,12 @@ var queryTests = []struct {
 	{`.`, `+`},
 	{`()`, `+`},
 
+	// A negated class contributes no trigrams of its own, and in
+	// particular it does not exclude the files containing "oba" and
+	// "bar": a file with foobar may also contain fooxar.
+	{`foo[^b]ar`, `"foo"`},
+	{`foo[^b]bar`, `"bar" "foo"`},
+
 	// No matches.
 	{`[^\s\S]`, `-`},
 
@@ -61,13 +67,25 @@ var queryTests = []struct {
 
 	{`(?s).`, `+`},
 
-	// Expanding case.
-	{`(?i)a~~`, `("A~~"|"a~~")`},
-	{`(?i)ab~`, `("AB~"|"Ab~"|"aB~"|"ab~")`},
-	{`(?i)abc`, `("ABC"|"ABc"|"AbC"|"Abc"|"aBC"|"aBc"|"abC"|"abc")`},
-	{`(?i)abc|def`, `("ABC"|"ABc"|"AbC"|"Abc"|"DEF"|"DEf"|"DeF"|"Def"|"aBC"|"aBc"|"abC"|"abc"|"dEF"|"dEf"|"deF"|"def")`},
-	{`(?i)abcd`, `("ABC"|"ABc"|"AbC"|"Abc"|"aBC"|"aBc"|"abC"|"abc") ("BCD"|"BCd"|"BcD"|"Bcd"|"bCD"|"bCd"|"bcD"|"bcd")`},
-	{`(?i)abc|abc`, `("ABC"|"ABc"|"AbC"|"Abc"|"aBC"|"aBc"|"abC"|"abc")`},
+	// Case-insensitive queries match trigrams ignoring ASCII case.
+	{`(?i)a~~`, `(?i)"a~~"`},
+	{`(?i)ab~`, `(?i)"ab~"`},
+	{`(?i)abc`, `(?i)"abc"`},
+	{`(?i)abc|def`, `(?i)("abc"|"def")`},
+	{`(?i)abcd`, `(?i)"abc" "bcd"`},
+	{`(?i)abc|abc`, `(?i)"abc"`},
+	{`(?i)[a-c]xy`, `(?i)("axy"|"bxy"|"cxy")`},
+	{`(?i)hello world`, `(?i)" wo" "ell" "hel" "llo" "lo " "o w" "orl" "rld" "wor"`},
+	{`(?i:abc)DEF`, `(?i)"abc" "bcd" "cde" "def"`},
+
+	// Letters that fold to non-ASCII letters still expand.
+	{`(?i)sort`, `(?i)"ort" ("sor")|("\xbfor" "ſo")`},
+	{`(?i)éte`, `(?i)("\x89te" "Ét")|("\xa9te" "ét")`},
+
+	// Longer ones require one of the forms of the trigrams
+	// beginning at each letter, rather than listing every way
+	// of writing the whole literal.
+	{`(?i)σοφός`, `(?i)("Σ\xce"|"ς\xce"|"σ\xce") ("Ο\xce"|"Ο\xcf"|"ο\xce"|"ο\xcf") ("Φ\xce"|"Φ\xcf"|"φ\xce"|"φ\xcf"|"ϕ\xce"|"ϕ\xcf") ("Ό\xce"|"Ό\xcf"|"ό\xce"|"ό\xcf") ("Σ\xce" ("\xa3Ο"|"\xa3ο"))|("\x82Ο" "ς\xce")|("\x82ο" "ς\xce")|("\x83Ο" "σ\xce")|("\x83ο" "σ\xce") ("\x8cς" ("Ό\xcf"|"ό\xcf"))|("\x8cσ" "Ό\xcf")|("\x8cσ" "ό\xcf")|("\x8cΣ" "Ό\xce")|("\x8cΣ" "ό\xce")`},
 
 	// Word boundary.
 	{`\b`, `+`},
@@ -78,6 +96,31 @@ var queryTests = []struct {
 	{`abc\B`, `"abc"`},
 	{`ab\bc`, `"abc"`},
 	{`ab\Bc`, `"abc"`},
+
+	// Newlines, for multiline searches.
+	{`(?m)abc\ndef`, `"\nde" "abc" "bc\n" "c\nd" "def"`},
+	{`(?m)abc$\n^def`, `"\nde" "abc" "bc\n" "c\nd" "def"`},
+	{`(?m)abc\s*\n`, `"abc"`},
+}
+
+var literalQueryTests = []struct {
+	s string
+	q string
+}{
+	{``, `+`},
+	{`ab`, `+`},
+	{`abc`, `"abc"`},
+	{`a.b(c)`, `"(c)" ".b(" "a.b" "b(c"`},
+	{`abcabc`, `"abc" "bca" "cab"`},
+	{"x\ny", `"x\ny"`},
+}
+
+func TestLiteralQuery(t *testing.T) {
+	for _, tt := range literalQueryTests {
+		if q := LiteralQuery(tt.s).String(); q != tt.q {
+			t.Errorf("LiteralQuery(%q) = %#q, want %#q", tt.s, q, tt.q)
+		}
+	}
 }
 
 func TestQuery(t *testing.T) {
@@ -0,0 +1,151 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"sort"
+)
+
+// Regions.
+//
+// If IndexWriter.Regions is set, the writer classifies the text of each
+// file it indexes into code, comments, and string literals, using the
+// lexers that the identifier index uses (see ident.go), and records the
+// comments and strings of each file in the "region" section, so that a
+// search can report only matches in one kind of region, such as
+// comments.  Everything else in a file is code, including all of a
+// file in a language the lexers do not know.  See read.go for the format.
+
+const regionSection = "region"
+
+// A RegionKind says what a region of a file holds.
+type RegionKind uint8
+
+const (
+	RegionCode RegionKind = iota
+	RegionComment
+	RegionString
+)
+
+var regionKindNames = []string{
+	RegionCode:    "code",
+	RegionComment: "comments",
+	RegionString:  "strings",
+}
+
+func (k RegionKind) String() string {
+	if int(k) < len(regionKindNames) {
+		return regionKindNames[k]
+	}
+	return fmt.Sprintf("RegionKind(%d)", k)
+}
+
+// ParseRegionKind returns the kind of region named by s,
+// which is code, comments, or strings, as printed by String.
+func ParseRegionKind(s string) (RegionKind, bool) {
+	for k, name := range regionKindNames {
+		if s == name {
+			return RegionKind(k), true
+		}
+	}
+	return 0, false
+}
+
+// A Region is a comment or string literal in a file,
+// from byte offset Start up to End.
+type Region struct {
+	Start, End int
+	Kind       RegionKind
+}
+
+// FileRegions returns the comments and string literals in data,
+// which holds text in the given language, in order.
+// It returns nil if the language has no known lexer.
+func FileRegions(lang string, data []byte) []Region {
+	syn := identSyntaxes[lang]
+	if syn == nil {
+		return nil
+	}
+	var regions []Region
+	syn.scan(data, nil, func(start, end int, kind RegionKind) {
+		regions = append(regions, Region{start, end, kind})
+	})
+	return regions
+}
+
+// RegionAt returns the kind of the region holding byte offset off,
+// given regions as returned by FileRegions.
+func RegionAt(regions []Region, off int) RegionKind {
+	i := sort.Search(len(regions), func(i int) bool { return regions[i].End > off })
+	if i < len(regions) && regions[i].Start <= off {
+		return regions[i].Kind
+	}
+	return RegionCode
+}
+
+// encodeRegions returns the entry of the region section for a file
+// with the given regions: their count and, for each, the gap since
+// the end of the last, its length, and its kind, each a uvarint.
+func encodeRegions(regions []Region) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(regions)))
+	end := 0
+	for _, r := range regions {
+		b = binary.AppendUvarint(b, uint64(r.Start-end))
+		b = binary.AppendUvarint(b, uint64(r.End-r.Start))
+		b = binary.AppendUvarint(b, uint64(r.Kind))
+		end = r.End
+	}
+	return b
+}
+
+// decodeRegions decodes an entry of the region section.
+func decodeRegions(b []byte) []Region {
+	next := func() int {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			corrupt()
+		}
+		b = b[n:]
+		return int(v)
+	}
+	n := next()
+	if n > len(b) {
+		corrupt()
+	}
+	regions := make([]Region, n)
+	end := 0
+	for i := range regions {
+		start := end + next()
+		end = start + next()
+		regions[i] = Region{start, end, RegionKind(next())}
+	}
+	return regions
+}
+
+func newRegionWriter(mem bool) *contentWriter {
+	w := newContentWriter(mem)
+	w.name = regionSection
+	return w
+}
+
+// HasRegions reports whether the index records the regions of files.
+func (ix *Index) HasRegions() bool {
+	return ix.section(regionSection) != nil
+}
+
+// Regions returns the comments and string literals in data, the current
+// text of the file with the given fileid.  If data is the text that was
+// indexed, Regions returns the regions the index records, if any;
+// otherwise, as when the file has changed since, it lexes data itself.
+func (ix *Index) Regions(fileid uint32, data []byte) []Region {
+	m := ix.Meta(fileid)
+	if e := ix.fileEntry(regionSection, fileid); e != nil && int64(len(data)) == m.Size && crc64.Checksum(data, crcTable) == m.Hash {
+		return decodeRegions(e)
+	}
+	return FileRegions(m.Lang, data)
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var regionTests = []struct {
+	lang string
+	data string
+	want []string
+}{
+	{
+		"go",
+		"x := \"a//b\" // c\n/* d\ne */ y := `f\ng` + 'h'\n",
+		[]string{`strings:"a//b"`, "comments:// c", "comments:/* d\ne */", "strings:`f\ng`", "strings:'h'"},
+	},
+	{
+		"py",
+		"s = '''x\n# y''' # z\n",
+		[]string{"strings:'''x\n# y'''", "comments:# z"},
+	},
+	{
+		"c",
+		"s = \"unterminated\nx;\n",
+		[]string{`strings:"unterminated`},
+	},
+	{
+		"txt",
+		"// not a comment\n",
+		nil,
+	},
+}
+
+func TestFileRegions(t *testing.T) {
+	for _, tt := range regionTests {
+		var have []string
+		regions := FileRegions(tt.lang, []byte(tt.data))
+		for _, r := range regions {
+			have = append(have, fmt.Sprintf("%v:%s", r.Kind, tt.data[r.Start:r.End]))
+		}
+		if !equalStrings(have, tt.want) {
+			t.Errorf("%s: regions = %q, want %q", tt.lang, have, tt.want)
+		}
+		if dec := decodeRegions(encodeRegions(regions)); len(regions) > 0 && !reflect.DeepEqual(dec, regions) {
+			t.Errorf("%s: decodeRegions(encodeRegions(%v)) = %v", tt.lang, regions, dec)
+		}
+	}
+}
+
+func TestRegionAt(t *testing.T) {
+	regions := []Region{{2, 4, RegionComment}, {6, 7, RegionString}}
+	want := []RegionKind{RegionCode, RegionCode, RegionComment, RegionComment, RegionCode, RegionCode, RegionString, RegionCode}
+	for off, k := range want {
+		if have := RegionAt(regions, off); have != k {
+			t.Errorf("RegionAt(%d) = %v, want %v", off, have, k)
+		}
+	}
+}
+
+func TestRegionIndex(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+	a := "x := 1 // one\n"
+	ix := Create(f1.Name())
+	ix.Regions = true
+	ix.AddPaths([]string{"/a"})
+	ix.Add("/a/a.go", strings.NewReader(a))
+	ix.Flush()
+	buildIndex(f2.Name(), []string{"/b"}, map[string]string{"/b/b.go": "y := \"two\"\n"})
+
+	ix1 := Open(f1.Name())
+	if !ix1.HasRegions() {
+		t.Fatalf("index has no regions")
+	}
+	want := []Region{{7, 13, RegionComment}}
+	if have := ix1.Regions(0, []byte(a)); !reflect.DeepEqual(have, want) {
+		t.Errorf("Regions = %v, want %v", have, want)
+	}
+	// A changed file is lexed again.
+	want = []Region{{8, 14, RegionComment}}
+	if have := ix1.Regions(0, []byte("x := 10 // one\n")); !reflect.DeepEqual(have, want) {
+		t.Errorf("Regions of changed file = %v, want %v", have, want)
+	}
+
+	// Files merged from an index without regions are lexed.
+	Merge(f3.Name(), f1.Name(), f2.Name())
+	if err := Verify(f3.Name()); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	ix3 := Open(f3.Name())
+	if !ix3.HasRegions() || ix3.fileEntry(regionSection, 1) != nil {
+		t.Fatalf("merged index: HasRegions = %v, entry of /b/b.go = %v", ix3.HasRegions(), ix3.fileEntry(regionSection, 1))
+	}
+	want = []Region{{5, 10, RegionString}}
+	if have := ix3.Regions(1, []byte("y := \"two\"\n")); !reflect.DeepEqual(have, want) {
+		t.Errorf("merged Regions = %v, want %v", have, want)
+	}
+	if Open(f2.Name()).HasRegions() {
+		t.Errorf("index written without Regions has regions")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote indexes.
+//
+// An index may be named by a URL instead of a file, such as an https://
+// URL or that of an object in a cloud storage bucket (see store.go), so
+// that a team can publish an index built nightly and everyone can search
+// it without building one.  Open downloads the index into a cache
+// directory and opens the copy there.  The cache keeps the ETag the
+// storage sent along with the index, and later downloads ask for the
+// index only if it has changed since, so that an index that has not
+// changed is fetched only once.  If the storage cannot be reached, the
+// cached copy, if any, is used, with a warning.
+//
+// The cache directory is $CSEARCHCACHE or, if that is unset,
+// the csearch directory in the user's cache directory, such as
+// $HOME/.cache/csearch on Linux.
+
+// remoteCheckInterval is how long a process uses a downloaded
+// index before asking the storage whether it has changed.
+const remoteCheckInterval = time.Minute
+
+var (
+	remoteMu      sync.Mutex
+	remoteChecked = make(map[string]time.Time) // URL -> time of last download
+)
+
+// remoteSchemes lists the URL schemes of remote indexes.
+var remoteSchemes = []string{"http://", "https://", "s3://", "gs://", "file://"}
+
+// IsRemote reports whether file names a remote index by URL.
+func IsRemote(file string) bool {
+	for _, s := range remoteSchemes {
+		if strings.HasPrefix(file, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Local returns the name of a local file holding the index in file.
+// For a remote index, it downloads the index into the cache if needed
+// and returns the name of the cached copy; otherwise it returns file.
+func Local(file string) string {
+	if !IsRemote(file) {
+		return file
+	}
+	local, err := Fetch(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return local
+}
+
+// remoteCacheDir returns the directory caching remote indexes.
+func remoteCacheDir() (string, error) {
+	if dir := os.Getenv("CSEARCHCACHE"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "csearch"), nil
+}
+
+// remoteCachePath returns the name of the cached copy
+// of the remote index at url.
+func remoteCachePath(url string) (string, error) {
+	dir, err := remoteCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", url, err)
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".csearchindex"), nil
+}
+
+// writeETag records etag as that of the cached copy local.
+func writeETag(local, etag string) {
+	if etag != "" {
+		os.WriteFile(local+".etag", []byte(etag), 0666)
+	} else {
+		os.Remove(local + ".etag")
+	}
+}
+
+// Fetch brings the cached copy of the remote index at url up to date
+// and returns its name.  If there is no index at url, and no cached
+// copy, the error wraps fs.ErrNotExist.  Fetch returns the name even
+// with an error, for a caller that means to build the index there.
+func Fetch(url string) (string, error) {
+	local, err := remoteCachePath(url)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0777); err != nil {
+		return "", err
+	}
+
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+	if t, ok := remoteChecked[url]; ok && time.Since(t) < remoteCheckInterval {
+		return local, nil
+	}
+	_, statErr := os.Stat(local)
+	cached := statErr == nil
+
+	err = download(url, local, cached)
+	if err != nil {
+		if !cached {
+			return local, err
+		}
+		slog.Warn("cannot download index; using cached copy", "url", url, "error", err)
+	}
+	remoteChecked[url] = time.Now()
+	return local, nil
+}
+
+// download fetches the index at url into local, recording its ETag.
+// If cached is set, local holds an earlier copy, and download leaves
+// it alone if the storage reports it unchanged.
+func download(url, local string, cached bool) error {
+	etag := ""
+	if cached {
+		if data, err := os.ReadFile(local + ".etag"); err == nil {
+			etag = string(data)
+		}
+	}
+	r, etag, err := StorageFor(url).Get(url, etag)
+	if err == errNotModified {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// Replacing the cached copy by renaming lets a process
+	// with the old copy open keep reading the old data.
+	if err := writeFileAtomic(local, r); err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	writeETag(local, etag)
+	return nil
+}
+
+// SplitList splits a list of index files, such as $CSEARCHINDEX,
+// separated by the operating system's path list separator, as
+// filepath.SplitList does, except that it keeps the URLs of remote indexes
+// whole even where the separator is ':', including any port number.
+// Empty names are dropped.
+func SplitList(list string) []string {
+	var files []string
+	parts := filepath.SplitList(list)
+	for i := 0; i < len(parts); i++ {
+		f := parts[i]
+		if i+1 < len(parts) && IsRemote(f+":"+parts[i+1]) {
+			f += ":" + parts[i+1]
+			i++
+			if i+1 < len(parts) && !strings.Contains(parts[i][2:], "/") && isPort(parts[i+1]) {
+				f += ":" + parts[i+1]
+				i++
+			}
+		}
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// isPort reports whether s begins with the port number of a URL,
+// digits followed by a slash or the end of s.
+func isPort(s string) bool {
+	port, _, _ := strings.Cut(s, "/")
+	if port == "" {
+		return false
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRemote(t *testing.T) {
+	file := buildExcludeIndex(t, []string{"/a"}, nil, "/a/x")
+	defer os.Remove(file)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gets, sent := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gets++
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		sent++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(data)
+	}))
+	url := srv.URL + "/x.csearchindex"
+	t.Setenv("CSEARCHCACHE", t.TempDir())
+
+	ix := Open(url)
+	if ix.NumFiles() != 1 || ix.Name(0) != "/a/x" {
+		t.Errorf("remote index lists %d files, first %q, want /a/x", ix.NumFiles(), ix.Name(0))
+	}
+	ix.Close()
+
+	// A second open soon after does not ask the server.
+	local := Local(url)
+	if gets != 1 {
+		t.Errorf("after second open, %d requests, want 1", gets)
+	}
+
+	// Later ones ask, and the server does not send the index again.
+	delete(remoteChecked, url)
+	if l := Local(url); l != local {
+		t.Errorf("Local(%s) = %s, then %s", url, local, l)
+	}
+	if gets != 2 || sent != 1 {
+		t.Errorf("after revalidation, %d requests and %d downloads, want 2 and 1", gets, sent)
+	}
+
+	// Without the server, the cached copy is used.
+	srv.Close()
+	delete(remoteChecked, url)
+	ix = Open(url)
+	if ix.NumFiles() != 1 {
+		t.Errorf("cached index lists %d files, want 1", ix.NumFiles())
+	}
+	ix.Close()
+}
+
+var splitListTests = []struct {
+	list string
+	want []string
+}{
+	{"", nil},
+	{"/a:/b", []string{"/a", "/b"}},
+	{"https://example.com/x", []string{"https://example.com/x"}},
+	{"/a:http://localhost:8080/x::/b", []string{"/a", "http://localhost:8080/x", "/b"}},
+	{"https://example.com/x:8080/y", []string{"https://example.com/x", "8080/y"}},
+	{"http:/a", []string{"http", "/a"}},
+	{"s3://b/x:gs://b/y:file:///z", []string{"s3://b/x", "gs://b/y", "file:///z"}},
+}
+
+func TestSplitList(t *testing.T) {
+	if os.PathListSeparator != ':' {
+		t.Skip("path list separator is not ':'")
+	}
+	for _, tt := range splitListTests {
+		if got := SplitList(tt.list); !equalStrings(got, tt.want) {
+			t.Errorf("SplitList(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
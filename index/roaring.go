@@ -0,0 +1,245 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// Roaring posting lists.
+//
+// A posting list for a common trigram can name most of the files in
+// the index.  Such lists are smaller when written as roaring bitmaps,
+// and a query can test whether such a list holds a particular file
+// without reading the whole list.  The writer uses whichever encoding
+// is smaller for each list.  See read.go for the format.
+
+const (
+	roaringArray  = 1 // sorted list of low 16 bits
+	roaringBitmap = 2 // bitmap of 1<<16 bits
+	roaringRuns   = 3 // list of runs of consecutive values
+
+	roaringBitmapSize = 1 << 16 / 8
+
+	// minRoaring is the length of the shortest posting list
+	// for which the writer considers the roaring encoding.
+	minRoaring = 64
+)
+
+// writePostList writes the file IDs ids, which must be sorted,
+// to out as a posting list, not including the trigram.
+// It uses buf as scratch space and returns it for reuse.
+func writePostList(out *bufWriter, ids []uint32, buf []byte) []byte {
+	if len(ids) >= minRoaring {
+		buf = appendRoaring(buf[:0], ids)
+		if 1+len(buf) < deltaSize(ids) {
+			// A zero first delta marks a roaring list.
+			out.writeByte(0)
+			out.write(buf)
+			return buf
+		}
+	}
+	last := ^uint32(0)
+	for _, id := range ids {
+		out.writeUvarint(id - last)
+		last = id
+	}
+	out.writeUvarint(0)
+	return buf
+}
+
+// deltaSize returns the size of the delta encoding of ids,
+// including the terminating zero.
+func deltaSize(ids []uint32) int {
+	var buf [binary.MaxVarintLen32]byte
+	n := 1
+	last := ^uint32(0)
+	for _, id := range ids {
+		n += binary.PutUvarint(buf[:], uint64(id-last))
+		last = id
+	}
+	return n
+}
+
+// appendRoaring appends the roaring encoding of ids to buf.
+func appendRoaring(buf []byte, ids []uint32) []byte {
+	var tmp [binary.MaxVarintLen32]byte
+	n := 0
+	for i := 0; i < len(ids); n++ {
+		i += containerLen(ids[i:])
+	}
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(n))]...)
+
+	for len(ids) > 0 {
+		c := ids[:containerLen(ids)]
+		ids = ids[len(c):]
+
+		nrun := 1
+		for i := 1; i < len(c); i++ {
+			if c[i] != c[i-1]+1 {
+				nrun++
+			}
+		}
+		key := uint16(c[0] >> 16)
+		switch {
+		case 4*nrun <= 2*len(c) && 4*nrun <= roaringBitmapSize:
+			buf = appendRoaringHeader(buf, key, roaringRuns, nrun)
+			start := 0
+			for i := 1; i <= len(c); i++ {
+				if i == len(c) || c[i] != c[i-1]+1 {
+					buf = append(buf, byte(c[start]>>8), byte(c[start]), byte((i-start-1)>>8), byte(i-start-1))
+					start = i
+				}
+			}
+		case 2*len(c) <= roaringBitmapSize:
+			buf = appendRoaringHeader(buf, key, roaringArray, len(c))
+			for _, id := range c {
+				buf = append(buf, byte(id>>8), byte(id))
+			}
+		default:
+			buf = appendRoaringHeader(buf, key, roaringBitmap, len(c))
+			var bm [roaringBitmapSize]byte
+			for _, id := range c {
+				bm[uint16(id)>>3] |= 1 << (id & 7)
+			}
+			buf = append(buf, bm[:]...)
+		}
+	}
+	return buf
+}
+
+// containerLen returns the number of leading entries in ids
+// that share the high 16 bits of ids[0].
+func containerLen(ids []uint32) int {
+	key := ids[0] >> 16
+	return sort.Search(len(ids), func(i int) bool { return ids[i]>>16 != key })
+}
+
+func appendRoaringHeader(buf []byte, key uint16, kind byte, n int) []byte {
+	return append(buf, byte(key>>8), byte(key), kind, byte((n-1)>>8), byte(n-1))
+}
+
+// A roaringList is a posting list in the roaring encoding.
+type roaringList struct {
+	c []roaringContainer
+}
+
+// A roaringContainer holds the entries of a roaring list
+// sharing the same high 16 bits.
+type roaringContainer struct {
+	key  uint32 // high 16 bits, shifted into place
+	kind byte
+	n    int    // number of values or runs
+	d    []byte // encoded values
+}
+
+// parseRoaring parses the roaring list at the start of d.
+func parseRoaring(d []byte) *roaringList {
+	l, err := decodeRoaring(d)
+	if err != nil {
+		corrupt()
+	}
+	return l
+}
+
+// decodeRoaring parses the roaring list at the start of d,
+// returning an error describing the problem if it is malformed.
+func decodeRoaring(d []byte) (*roaringList, error) {
+	n, k := binary.Uvarint(d)
+	if k <= 0 || n > 1<<16 {
+		return nil, errors.New("bad container count")
+	}
+	d = d[k:]
+	l := &roaringList{c: make([]roaringContainer, n)}
+	for i := range l.c {
+		if len(d) < 5 {
+			return nil, fmt.Errorf("container %d: truncated header", i)
+		}
+		c := &l.c[i]
+		c.key = uint32(binary.BigEndian.Uint16(d)) << 16
+		c.kind = d[2]
+		c.n = int(binary.BigEndian.Uint16(d[3:])) + 1
+		d = d[5:]
+		size := 0
+		switch c.kind {
+		case roaringArray:
+			size = 2 * c.n
+		case roaringBitmap:
+			size = roaringBitmapSize
+		case roaringRuns:
+			size = 4 * c.n
+		default:
+			return nil, fmt.Errorf("container %d: unknown kind %d", i, c.kind)
+		}
+		if len(d) < size {
+			return nil, fmt.Errorf("container %d: truncated data", i)
+		}
+		if i > 0 && c.key <= l.c[i-1].key {
+			return nil, fmt.Errorf("container %d: key %#x not above previous key %#x", i, c.key>>16, l.c[i-1].key>>16)
+		}
+		c.d = d[:size]
+		d = d[size:]
+	}
+	return l, nil
+}
+
+// contains reports whether the list holds the file ID id.
+func (l *roaringList) contains(id uint32) bool {
+	key := id &^ 0xFFFF
+	i := sort.Search(len(l.c), func(i int) bool { return l.c[i].key >= key })
+	if i >= len(l.c) || l.c[i].key != key {
+		return false
+	}
+	c := &l.c[i]
+	lo := uint16(id)
+	switch c.kind {
+	case roaringArray:
+		j := sort.Search(c.n, func(j int) bool { return binary.BigEndian.Uint16(c.d[2*j:]) >= lo })
+		return j < c.n && binary.BigEndian.Uint16(c.d[2*j:]) == lo
+	case roaringBitmap:
+		return c.d[lo>>3]&(1<<(lo&7)) != 0
+	case roaringRuns:
+		// Find the last run starting at or before lo.
+		j := sort.Search(c.n, func(j int) bool { return binary.BigEndian.Uint16(c.d[4*j:]) > lo }) - 1
+		if j < 0 {
+			return false
+		}
+		start := binary.BigEndian.Uint16(c.d[4*j:])
+		return uint32(lo-start) <= uint32(binary.BigEndian.Uint16(c.d[4*j+2:]))
+	}
+	return false
+}
+
+// appendIDs appends the file IDs in the list to ids, in order.
+func (l *roaringList) appendIDs(ids []uint32) []uint32 {
+	for i := range l.c {
+		c := &l.c[i]
+		switch c.kind {
+		case roaringArray:
+			for j := 0; j < c.n; j++ {
+				ids = append(ids, c.key|uint32(binary.BigEndian.Uint16(c.d[2*j:])))
+			}
+		case roaringBitmap:
+			for j, b := range c.d {
+				for ; b != 0; b &= b - 1 {
+					ids = append(ids, c.key|uint32(j<<3+bits.TrailingZeros8(b)))
+				}
+			}
+		case roaringRuns:
+			for j := 0; j < c.n; j++ {
+				start := uint32(binary.BigEndian.Uint16(c.d[4*j:]))
+				end := start + uint32(binary.BigEndian.Uint16(c.d[4*j+2:]))
+				for v := start; v <= end; v++ {
+					ids = append(ids, c.key|v)
+				}
+			}
+		}
+	}
+	return ids
+}
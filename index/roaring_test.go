@@ -0,0 +1,126 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+var roaringTests = []struct {
+	name string
+	ids  func() []uint32
+}{
+	{"sparse", func() []uint32 { return randomIDs(1000, 1<<20) }},
+	{"dense", func() []uint32 { return randomIDs(50000, 70000) }},
+	{"runs", func() []uint32 {
+		var ids []uint32
+		for i := uint32(0); i < 200000; i += 1000 {
+			for j := i; j < i+300; j++ {
+				ids = append(ids, j)
+			}
+		}
+		return ids
+	}},
+	{"boundary", func() []uint32 {
+		return []uint32{0, 1, 0xFFFF, 0x10000, 0x1FFFF, 0x20000, 1<<32 - 2}
+	}},
+}
+
+// randomIDs returns n distinct sorted IDs less than max.
+func randomIDs(n, max int) []uint32 {
+	r := rand.New(rand.NewSource(int64(n)))
+	var ids []uint32
+	for _, i := range r.Perm(max)[:n] {
+		ids = append(ids, uint32(i))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestRoaring(t *testing.T) {
+	for _, tt := range roaringTests {
+		ids := tt.ids()
+		l := parseRoaring(appendRoaring(nil, ids))
+		if got := l.appendIDs(nil); !equalList(got, ids) {
+			t.Errorf("%s: appendIDs returned %d IDs, want %d", tt.name, len(got), len(ids))
+			continue
+		}
+		in := make(map[uint32]bool)
+		for _, id := range ids {
+			in[id] = true
+		}
+		for _, id := range ids {
+			for _, x := range []uint32{id - 1, id, id + 1} {
+				if l.contains(x) != in[x] {
+					t.Errorf("%s: contains(%d) = %v, want %v", tt.name, x, !in[x], in[x])
+				}
+			}
+		}
+	}
+}
+
+func TestRoaringIndex(t *testing.T) {
+	// Build two indexes in which common trigrams are dense
+	// enough to be written as roaring bitmaps.
+	files1 := make(map[string]string)
+	files2 := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		data := "common text\n"
+		if i%3 == 0 {
+			data += "fizz\n"
+		}
+		if i%5 == 0 {
+			data += "buzz\n"
+		}
+		files1[fmt.Sprintf("/a/%05d", i)] = data
+		files2[fmt.Sprintf("/b/%05d", i)] = data
+	}
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+	buildIndex(f1.Name(), []string{"/a"}, files1)
+	buildIndex(f2.Name(), []string{"/b"}, files2)
+	Merge(f3.Name(), f1.Name(), f2.Name())
+
+	for _, file := range []string{f1.Name(), f3.Name()} {
+		ix := Open(file)
+		n := uint32(ix.NumFiles())
+		var all, fizz, fizzbuzz []uint32
+		for i := uint32(0); i < n; i++ {
+			all = append(all, i)
+			if i%3000%3 == 0 {
+				fizz = append(fizz, i)
+				if i%3000%5 == 0 {
+					fizzbuzz = append(fizzbuzz, i)
+				}
+			}
+		}
+		var r postReader
+		r.init(ix, tri('m', 'o', 'n'), nil)
+		if r.roaring == nil {
+			t.Errorf("%s: list for mon is not roaring", file)
+		}
+		if l := ix.PostingList(tri('m', 'o', 'n')); !equalList(l, all) {
+			t.Errorf("%s: PostingList(mon) has %d files, want %d", file, len(l), len(all))
+		}
+		if l := ix.PostingList(tri('f', 'i', 'z')); !equalList(l, fizz) {
+			t.Errorf("%s: PostingList(fiz) has %d files, want %d", file, len(l), len(fizz))
+		}
+		if l := ix.PostingAnd(ix.PostingList(tri('b', 'u', 'z')), tri('f', 'i', 'z')); !equalList(l, fizzbuzz) {
+			t.Errorf("%s: PostingList(buz&fiz) has %d files, want %d", file, len(l), len(fizzbuzz))
+		}
+		if l := ix.postingList(tri('f', 'i', 'z'), ix.PostingList(tri('b', 'u', 'z'))); !equalList(l, fizzbuzz) {
+			t.Errorf("%s: postingList(fiz, buz) has %d files, want %d", file, len(l), len(fizzbuzz))
+		}
+	}
+}
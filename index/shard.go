@@ -0,0 +1,290 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sharded indexes.
+//
+// A sharded index is a directory holding ordinary index files, called
+// shards, named shard-N for increasing sequence numbers N.  Adding a
+// new shard is much cheaper than rewriting one large index file, and
+// no single shard need approach the 4 GB limit on index offsets.
+//
+// Newer shards take precedence over older ones.  A file in a shard
+// is ignored if it lies under one of the paths covered by a newer
+// shard, just as Merge would discard it when merging the two.
+// A shard all of whose paths are covered by newer shards contributes
+// nothing, and RemoveShadowedShards removes it.  Keeping each indexed
+// tree in its own shard thus lets the tree be reindexed by writing a new
+// shard for it alone and removing the old one.  CompactShards merges
+// the shards into one.
+
+const (
+	shardPrefix = "shard-"
+	compactLock = "compact.lock"
+)
+
+// A ShardedIndex implements read-only access to a sharded index.
+type ShardedIndex struct {
+	Shards []*Index // shards, from oldest to newest
+
+	newer [][]string // for each shard, paths covered by newer shards
+}
+
+// IsSharded reports whether file names a directory,
+// which is taken to hold a sharded index.
+func IsSharded(file string) bool {
+	info, err := os.Stat(file)
+	return err == nil && info.IsDir()
+}
+
+// OpenSharded opens the sharded index in the directory dir.
+func OpenSharded(dir string) *ShardedIndex {
+	s := new(ShardedIndex)
+	for _, file := range ShardFiles(dir) {
+		s.Shards = append(s.Shards, Open(file))
+	}
+	s.newer = make([][]string, len(s.Shards))
+	var paths []string
+	for i := len(s.Shards) - 1; i >= 0; i-- {
+		s.newer[i] = paths
+		paths = append(paths[:len(paths):len(paths)], s.Shards[i].Paths()...)
+	}
+	return s
+}
+
+// Preload preloads each shard, as described for Index.Preload.
+func (s *ShardedIndex) Preload() {
+	for _, ix := range s.Shards {
+		ix.Preload()
+	}
+}
+
+// Close closes each shard, as described for Index.Close.
+func (s *ShardedIndex) Close() error {
+	var err error
+	for _, ix := range s.Shards {
+		if e := ix.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ShardFiles returns the names of the shard files in dir,
+// from oldest to newest.
+func ShardFiles(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var seqs []int
+	for _, f := range files {
+		if seq, ok := shardSeq(f.Name()); ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	var names []string
+	for _, seq := range seqs {
+		names = append(names, shardFile(dir, seq))
+	}
+	return names
+}
+
+// NextShard returns the name to use for a new shard in dir,
+// one that sorts after all the existing shards.
+func NextShard(dir string) string {
+	seq := 0
+	if files := ShardFiles(dir); len(files) > 0 {
+		seq, _ = shardSeq(filepath.Base(files[len(files)-1]))
+	}
+	return shardFile(dir, seq+1)
+}
+
+// shardSeq returns the sequence number of the shard with the given
+// base name.  The boolean result reports whether name is a shard name.
+func shardSeq(name string) (int, bool) {
+	if !strings.HasPrefix(name, shardPrefix) {
+		return 0, false
+	}
+	digits := name[len(shardPrefix):]
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(digits)
+	return seq, err == nil
+}
+
+func shardFile(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%08d", shardPrefix, seq))
+}
+
+// Paths returns the list of paths covered by any shard.
+func (s *ShardedIndex) Paths() []string {
+	seen := make(map[string]bool)
+	var x []string
+	for _, ix := range s.Shards {
+		for _, p := range ix.Paths() {
+			if !seen[p] {
+				seen[p] = true
+				x = append(x, p)
+			}
+		}
+	}
+	sort.Strings(x)
+	return x
+}
+
+// PathRepo returns the repository holding the files in the tree
+// rooted at path, as recorded by the newest shard holding any of them.
+func (s *ShardedIndex) PathRepo(path string) string {
+	for i := len(s.Shards) - 1; i >= 0; i-- {
+		if repo := s.Shards[i].PathRepo(path); repo != "" {
+			return repo
+		}
+	}
+	return ""
+}
+
+// Shadowed reports whether the file with the given fileid in shard i
+// is superseded by a newer shard.
+func (s *ShardedIndex) Shadowed(i int, fileid uint32) bool {
+	if len(s.newer[i]) == 0 {
+		return false
+	}
+	name := s.Shards[i].Name(fileid)
+	for _, p := range s.newer[i] {
+		if InTree(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// PostingQuery runs the query q against all the shards in parallel.
+// It returns, for each shard, the list of matching fileids in that shard,
+// omitting files superseded by newer shards.
+func (s *ShardedIndex) PostingQuery(q *Query) [][]uint32 {
+	return s.PostingQueryNames(q, nil)
+}
+
+// PostingQueryNames is like PostingQuery but also narrows the files
+// of each shard by the query names, as Index.PostingQueryNames does.
+func (s *ShardedIndex) PostingQueryNames(q, names *Query) [][]uint32 {
+	post, _ := s.PostingQueryNamesContext(context.Background(), q, names)
+	return post
+}
+
+// PostingQueryNamesContext is like PostingQueryNames, but it gives up
+// and returns ctx.Err() if ctx is done before every shard is queried.
+func (s *ShardedIndex) PostingQueryNamesContext(ctx context.Context, q, names *Query) ([][]uint32, error) {
+	post := make([][]uint32, len(s.Shards))
+	var wg sync.WaitGroup
+	for i, ix := range s.Shards {
+		wg.Add(1)
+		go func(i int, ix *Index) {
+			defer wg.Done()
+			list, _ := ix.PostingQueryNamesContext(ctx, q, names)
+			w := 0
+			for _, fileid := range list {
+				if !s.Shadowed(i, fileid) {
+					list[w] = fileid
+					w++
+				}
+			}
+			post[i] = list[:w]
+		}(i, ix)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// RemoveShadowedShards removes the shards in the sharded index in dir
+// all of whose paths are covered by newer shards.  Searches ignore
+// every file in such a shard, so removing it changes no results.
+func RemoveShadowedShards(dir string) {
+	files := ShardFiles(dir)
+	var newer []string
+	for i := len(files) - 1; i >= 0; i-- {
+		ix := Open(files[i])
+		paths := ix.Paths()
+		ix.Close()
+		if i < len(files)-1 && covered(paths, newer) {
+			os.Remove(files[i])
+			continue
+		}
+		newer = append(newer, paths...)
+	}
+}
+
+// covered reports whether every path in paths
+// lies in the tree rooted at one of roots.
+func covered(paths, roots []string) bool {
+Path:
+	for _, p := range paths {
+		for _, root := range roots {
+			if InTree(p, root) {
+				continue Path
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// CompactShards merges all the shards in the sharded index in dir
+// into a single shard.  Searches of the index continue to work while
+// CompactShards runs, and shards added meanwhile are left alone.
+// If another compaction of the index is already running,
+// CompactShards does nothing.
+func CompactShards(dir string) {
+	// The lock file keeps compactions from running at the same time.
+	// If a compaction dies, its lock file must be removed by hand.
+	lock := filepath.Join(dir, compactLock)
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		if os.IsExist(err) {
+			slog.Info("compaction already running", "dir", dir)
+			return
+		}
+		log.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(lock)
+
+	files := ShardFiles(dir)
+	if len(files) < 2 {
+		return
+	}
+	last := files[len(files)-1]
+	MergeAll(last+"~", files)
+
+	// The merged shard replaces the newest one it includes,
+	// which keeps its place in the order.  The older shards
+	// are shadowed by it and can then be removed.
+	if err := Rename(last+"~", last); err != nil {
+		log.Fatal(err)
+	}
+	for _, file := range files[:len(files)-1] {
+		os.Remove(file)
+	}
+}
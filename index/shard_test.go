@@ -0,0 +1,154 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"sort"
+	"testing"
+)
+
+var shardFiles = []struct {
+	paths []string
+	files map[string]string
+}{
+	{
+		[]string{"/a", "/b"},
+		map[string]string{
+			"/a/x": "hello world",
+			"/a/y": "hello there",
+			"/b/z": "goodbye world",
+		},
+	},
+	{
+		[]string{"/a"},
+		map[string]string{
+			"/a/x": "hello again",
+			"/a/w": "hello world",
+		},
+	},
+	{
+		[]string{"/c"},
+		map[string]string{
+			"/c/v": "world peace",
+		},
+	},
+}
+
+// shardMatches returns the names of the files in s matching re.
+func shardMatches(t *testing.T, s *ShardedIndex, re string) []string {
+	r, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for i, list := range s.PostingQuery(RegexpQuery(r)) {
+		for _, fileid := range list {
+			names = append(names, s.Shards[i].Name(fileid))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSharded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if !IsSharded(dir) {
+		t.Fatalf("IsSharded(%q) = false, want true", dir)
+	}
+	for _, shard := range shardFiles {
+		buildIndex(NextShard(dir), shard.paths, shard.files)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "shard-00000009~"), nil, 0666)
+	if n := len(ShardFiles(dir)); n != 3 {
+		t.Fatalf("len(ShardFiles) = %d, want 3", n)
+	}
+
+	check := func(s *ShardedIndex) {
+		if paths := s.Paths(); !equalStrings(paths, []string{"/a", "/b", "/c"}) {
+			t.Errorf("Paths() = %v, want [/a /b /c]", paths)
+		}
+		if names := shardMatches(t, s, "world"); !equalStrings(names, []string{"/a/w", "/b/z", "/c/v"}) {
+			t.Errorf("matches for world = %v, want [/a/w /b/z /c/v]", names)
+		}
+		if names := shardMatches(t, s, "hello"); !equalStrings(names, []string{"/a/w", "/a/x"}) {
+			t.Errorf("matches for hello = %v, want [/a/w /a/x]", names)
+		}
+	}
+	check(OpenSharded(dir))
+
+	CompactShards(dir)
+	files := ShardFiles(dir)
+	if len(files) != 1 || filepath.Base(files[0]) != "shard-00000003" {
+		t.Fatalf("ShardFiles after compaction = %v, want [shard-00000003]", files)
+	}
+	check(OpenSharded(dir))
+
+	if next := filepath.Base(NextShard(dir)); next != "shard-00000004" {
+		t.Errorf("NextShard = %s, want shard-00000004", next)
+	}
+}
+
+func TestShadowedSibling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A newer shard for /src/foo hides nothing in /src/foobar.
+	buildIndex(NextShard(dir), []string{"/src/foobar"}, map[string]string{"/src/foobar/b": "needle"})
+	buildIndex(NextShard(dir), []string{"/src/foo"}, map[string]string{"/src/foo/a": "needle"})
+	if names := shardMatches(t, OpenSharded(dir), "needle"); !equalStrings(names, []string{"/src/foo/a", "/src/foobar/b"}) {
+		t.Errorf("matches for needle = %v, want [/src/foo/a /src/foobar/b]", names)
+	}
+}
+
+func TestRemoveShadowedShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, shard := range shardFiles {
+		buildIndex(NextShard(dir), shard.paths, shard.files)
+	}
+	// Reindexing /b and /c on their own shadows the first and
+	// third shards entirely, leaving the second, for /a.
+	buildIndex(NextShard(dir), []string{"/b"}, map[string]string{"/b/z": "goodbye world"})
+	buildIndex(NextShard(dir), []string{"/c"}, map[string]string{"/c/v": "world peace"})
+	RemoveShadowedShards(dir)
+	var names []string
+	for _, file := range ShardFiles(dir) {
+		names = append(names, filepath.Base(file))
+	}
+	if want := []string{"shard-00000002", "shard-00000004", "shard-00000005"}; !equalStrings(names, want) {
+		t.Fatalf("ShardFiles after RemoveShadowedShards = %v, want %v", names, want)
+	}
+	if names := shardMatches(t, OpenSharded(dir), "world"); !equalStrings(names, []string{"/a/w", "/b/z", "/c/v"}) {
+		t.Errorf("matches for world = %v, want [/a/w /b/z /c/v]", names)
+	}
+}
+
+func equalStrings(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i, xi := range x {
+		if xi != y[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "log/slog"
+
+// Skipped files.
+//
+// An IndexWriter passes over many files without indexing them: some
+// because the walk is told to, such as hidden files and those ignored
+// by .gitignore or .csearchignore files, and others because, once read,
+// they do not look like text.  Each time it does, it reports the file
+// and a SkipReason to IndexWriter.OnSkip, and logs them if
+// IndexWriter.LogSkip is set, so that a program can say what was left
+// out and why.
+
+// A SkipReason is a short code saying why an IndexWriter skipped a
+// file or directory.
+type SkipReason string
+
+const (
+	SkipInvalidUTF8    SkipReason = "invalid-utf8"   // file holds invalid UTF-8
+	SkipTooLarge       SkipReason = "too-large"      // file is longer than MaxFileLen
+	SkipLongLines      SkipReason = "long-lines"     // file has a line longer than MaxLineLen
+	SkipBinary         SkipReason = "binary"         // file has too many distinct trigrams to be text
+	SkipUnreadable     SkipReason = "unreadable"     // file could not be read
+	SkipDuplicate      SkipReason = "duplicate"      // file or directory already reached by another name
+	SkipSymlinkCycle   SkipReason = "symlink-cycle"  // directory encloses itself through symbolic links
+	SkipFiltered       SkipReason = "filtered"       // Filter rejected the file
+	SkipHidden         SkipReason = "hidden"         // name is hidden (see SkipPrefixes)
+	SkipBazelLink      SkipReason = "bazel-link"     // a link to Bazel's output tree (see bazel.go)
+	SkipGitignored     SkipReason = "gitignored"     // a .gitignore file ignores it
+	SkipCsearchignored SkipReason = "csearchignored" // a .csearchignore file ignores it
+	SkipUntracked      SkipReason = "untracked"      // git does not track it (see GitTracked)
+	SkipExcluded       SkipReason = "excluded"       // excluded by the caller, as through Skip
+)
+
+// logSkip reports that the file or directory path is skipped, and the
+// reason why, to ix.OnSkip, and logs it if ix.LogSkip is set.
+// The walks of CountTree report nothing, since AddTree
+// will walk the same files.
+func (ix *IndexWriter) logSkip(path string, reason SkipReason) {
+	if ix.counting {
+		return
+	}
+	if ix.LogSkip {
+		slog.Info("skipped", "path", path, "reason", string(reason))
+	}
+	if ix.OnSkip != nil {
+		ix.skipMu.Lock()
+		defer ix.skipMu.Unlock()
+		ix.OnSkip(path, reason)
+	}
+}
+
+// ReportSkip reports that the file or directory path is skipped for
+// reason just as the writer reports the files it skips itself, for use
+// by a Skip function, whose reasons the writer does not know.
+func (ix *IndexWriter) ReportSkip(path string, reason SkipReason) {
+	ix.logSkip(path, reason)
+}
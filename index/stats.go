@@ -0,0 +1,152 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Stats describes the contents of an index, as printed by cindex -stats.
+type Stats struct {
+	Files int   // number of indexed files
+	Bytes int64 // total length of the indexed files; 0 if not recorded
+	Size  int64 // length of the index file
+
+	Trigrams int   // number of distinct trigrams
+	Postings int64 // number of (trigram, file) pairs in the posting lists
+
+	// StopTrigrams is the number of stop trigrams, which have no
+	// posting lists, and StopFraction the fraction of the files that
+	// made them so (see IndexWriter.StopFraction).
+	StopTrigrams int
+	StopFraction float64
+
+	// Aliases is the number of files sharing the posting
+	// entries of identical files (see IndexWriter.Dedupe).
+	Aliases int
+
+	// PostingSizes counts the posting lists by length:
+	// PostingSizes[i] is the number of trigrams found in
+	// at least 10^i and fewer than 10^(i+1) files.
+	PostingSizes []int
+
+	// Largest lists the largest indexed files, largest first.
+	// It is empty if the index does not record file sizes.
+	Largest []FileSize
+
+	// Parts lists the parts of the index file in order,
+	// from the header to the trailer.
+	Parts []IndexPart
+}
+
+// A FileSize gives the length of an indexed file.
+type FileSize struct {
+	Name string
+	Size int64
+}
+
+// An IndexPart is a part of an index file, such as the posting lists
+// or one of the sections.
+type IndexPart struct {
+	Name   string
+	Offset int64
+	Size   int64
+}
+
+// Stats returns statistics about the index, listing
+// the n largest files in Largest.
+func (ix *Index) Stats(n int) *Stats {
+	st := &Stats{
+		Files: ix.numName,
+		Size:  int64(ix.size()),
+
+		StopTrigrams: len(ix.stopTrigrams()),
+		StopFraction: ix.StopFraction(),
+
+		Aliases: ix.NumAliases(),
+	}
+
+	for i := 0; i < ix.numPost; i++ {
+		tri, count, _ := ix.listAt(uint32(i * postEntrySize))
+		if tri == 1<<24-1 && count == 0 {
+			// End marker.
+			continue
+		}
+		st.Trigrams++
+		st.Postings += int64(count)
+		b := 0
+		for c := count; c >= 10; c /= 10 {
+			b++
+		}
+		for len(st.PostingSizes) <= b {
+			st.PostingSizes = append(st.PostingSizes, 0)
+		}
+		st.PostingSizes[b]++
+	}
+
+	if ix.HasMeta() {
+		for i := 0; i < ix.numName; i++ {
+			size := ix.Meta(uint32(i)).Size
+			st.Bytes += size
+			if len(st.Largest) == n && (n == 0 || size <= st.Largest[n-1].Size) {
+				continue
+			}
+			j := sort.Search(len(st.Largest), func(j int) bool { return st.Largest[j].Size < size })
+			if len(st.Largest) < n {
+				st.Largest = append(st.Largest, FileSize{})
+			}
+			copy(st.Largest[j+1:], st.Largest[j:])
+			st.Largest[j] = FileSize{ix.Name(uint32(i)), size}
+		}
+	}
+
+	// The parts, in the order the writer lays them out:
+	// the lists and indexes named by the trailer, then the sections.
+	noff := 6
+	if ix.version == 1 {
+		noff = 5
+	}
+	trailer := uint32(ix.size() - len(trailerMagic) - noff*4)
+	offs := []uint32{0}
+	for i := 0; i < noff; i++ {
+		offs = append(offs, ix.uint32(trailer+4*uint32(i)))
+	}
+	if ix.version >= 2 {
+		// Find the end of the section index.
+		off := offs[noff]
+		for {
+			s := ix.str(off)
+			off += uint32(len(s) + 1)
+			if len(s) == 0 {
+				break
+			}
+			off += 8
+		}
+		offs = append(offs, off)
+	} else {
+		offs = append(offs, trailer)
+	}
+	names := append([]string{"header"}, indexParts[:noff]...)
+	for i, name := range names {
+		st.Parts = append(st.Parts, IndexPart{name, int64(offs[i]), int64(offs[i+1] - offs[i])})
+	}
+	var secs []IndexPart
+	for name, sec := range ix.sections {
+		secs = append(secs, IndexPart{fmt.Sprintf("section %q", name), int64(sec.off), int64(sec.n)})
+	}
+	sort.Slice(secs, func(i, j int) bool {
+		if secs[i].Offset != secs[j].Offset {
+			return secs[i].Offset < secs[j].Offset
+		}
+		if secs[i].Size != secs[j].Size {
+			return secs[i].Size < secs[j].Size
+		}
+		return secs[i].Name < secs[j].Name
+	})
+	st.Parts = append(st.Parts, secs...)
+	st.Parts = append(st.Parts, IndexPart{"trailer", int64(trailer), int64(ix.size()) - int64(trailer)})
+	return st
+}
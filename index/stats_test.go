@@ -0,0 +1,124 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	buildIndex(f.Name(), nil, trivialFiles)
+	ix := Open(f.Name())
+	defer ix.Close()
+
+	st := ix.Stats(2)
+	off := func(parts ...string) int64 {
+		return int64(len(join(parts...)))
+	}
+	want := &Stats{
+		Files:        6,
+		Bytes:        2 + 3 + 4 + 5 + 6 + 6,
+		Size:         int64(len(trivialIndex)),
+		Trigrams:     11,
+		Postings:     14,
+		PostingSizes: []int{11},
+		Largest:      []FileSize{{"afile4", 6}, {"file5", 6}},
+		Parts: []IndexPart{
+			{"header", 0, 16},
+			{"path list", 16, off(trivialPathList)},
+			{"name list", 17, off(trivialNameList)},
+			{"posting lists", 55, off(trivialPostLists)},
+			{"name index", 117, off(trivialNameIndex)},
+			{"posting list index", 145, off(trivialPostIndex)},
+			{"section index", 277, off(trivialSectionIndex)},
+			{`section "meta"`, 329, off(trivialMetaSection)},
+			{`section "lang"`, 525, 0},
+			{`section "repo"`, 525, 0},
+			{`section "crc"`, 525, 9 * 4},
+			{"trailer", 561, 6*4 + 16},
+		},
+	}
+	if !reflect.DeepEqual(st, want) {
+		t.Errorf("Stats:\nhave %+v\nwant %+v", st, want)
+	}
+
+	// Trigrams in 3000 files count in PostingSizes[3].
+	dense := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		dense[fmt.Sprintf("/a/%05d", i)] = "common text\n"
+	}
+	dense["/a/x"] = "xyzzy\n"
+	buildIndex(f.Name(), []string{"/a"}, dense)
+	ix = Open(f.Name())
+	defer ix.Close()
+	st = ix.Stats(1)
+	if want := []int{4, 0, 0, 10}; !reflect.DeepEqual(st.PostingSizes, want) {
+		t.Errorf("dense index: PostingSizes = %v, want %v", st.PostingSizes, want)
+	}
+	if want := []FileSize{{"/a/00000", 12}}; !reflect.DeepEqual(st.Largest, want) {
+		t.Errorf("dense index: Largest = %v, want %v", st.Largest, want)
+	}
+}
+
+func TestDump(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	buildIndex(f.Name(), nil, trivialFiles)
+	ix := Open(f.Name())
+	defer ix.Close()
+
+	// The posting lists fill their part of the file,
+	// apart from the 4-byte end marker.
+	var n, files int
+	var size int64
+	for p := range ix.Postings() {
+		if n == 0 && p.Offset != 55 {
+			t.Errorf("first posting list at %d, want 55", p.Offset)
+		}
+		n++
+		files += p.Files
+		size += p.Size
+	}
+	if want := int64(len(join(trivialPostLists))) - 4; n != 11 || files != 14 || size != want {
+		t.Errorf("Postings: %d lists of %d files, %d bytes; want 11, 14, %d", n, files, size, want)
+	}
+	var names []string
+	for e := range ix.NameEntries() {
+		if e.FileID == 0 && e.Offset != 17 {
+			t.Errorf("first name at %d, want 17", e.Offset)
+		}
+		names = append(names, e.Name)
+	}
+	if want := []string{"afile4", "f0", "file1", "file3", "file5", "thefile2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("NameEntries: %q, want %q", names, want)
+	}
+	for _, p := range ix.Stats(0).Parts {
+		if PartDoc(p.Name) == "" {
+			t.Errorf("no PartDoc(%q)", p.Name)
+		}
+	}
+
+	// Lists of most of the files are roaring bitmaps.
+	dense := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		dense[fmt.Sprintf("/a/%05d", i)] = "common text\n"
+	}
+	dense["/a/x"] = "xyzzy\n"
+	buildIndex(f.Name(), []string{"/a"}, dense)
+	ix = Open(f.Name())
+	defer ix.Close()
+	for p := range ix.Postings() {
+		tri := uint32(p.Trigram[0])<<16 | uint32(p.Trigram[1])<<8 | uint32(p.Trigram[2])
+		if len(ix.PostingList(tri)) != p.Files || p.Roaring != (p.Files == 3000) {
+			t.Errorf("trigram %q: %d files, roaring %v; PostingList has %d", p.Trigram, p.Files, p.Roaring, len(ix.PostingList(tri)))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Stop trigrams.
+//
+// A trigram found in most files, such as "the" in English text or
+// "ret" in code, has a long posting list that does little to narrow a
+// search.  An index written with IndexWriter.StopFraction set omits the
+// posting lists of trigrams found in more than that fraction of the
+// files and records them in the optional "stop" section instead:
+//
+//	stop fraction, as IEEE 754 double [8]
+//	stop trigrams, in increasing order [3]...
+//
+// A reader treats a stop trigram as found in every file, so that a
+// query needing it ignores it and a query accepting it matches every
+// file.  The result is a larger candidate list, never a missed match.
+//
+// Merging indexes keeps the stop trigrams of both, since their posting
+// lists are gone, and applies the stop fraction recorded by the newer
+// index (or else the older one) to the merged posting lists.
+
+const stopSection = "stop"
+
+// stopLimit returns the largest number of files that a trigram can
+// be found in without being a stop trigram, given the stop fraction
+// and the number of files in the index.
+func stopLimit(fraction float64, numName int) int {
+	if fraction <= 0 {
+		return math.MaxInt
+	}
+	return int(fraction * float64(numName))
+}
+
+// stopSectionData returns the stop section recording fraction and the
+// sorted list of stop trigrams, which are few enough to hold in memory.
+func stopSectionData(fraction float64, stop []uint32) sectionData {
+	w := bufCreateMem()
+	w.writeUint64(math.Float64bits(fraction))
+	for _, t := range stop {
+		w.writeTrigram(t)
+	}
+	return sectionData{stopSection, w}
+}
+
+// StopFraction returns the stop fraction recorded in the index,
+// or 0 if it records none.
+func (ix *Index) StopFraction() float64 {
+	d := ix.section(stopSection)
+	if len(d) < 8 {
+		return 0
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(d))
+}
+
+// StopTrigrams returns the stop trigrams recorded in the index,
+// whose posting lists it omits, in increasing order.
+func (ix *Index) StopTrigrams() []string {
+	var x []string
+	for _, t := range ix.stopTrigrams() {
+		x = append(x, trigramString(t))
+	}
+	return x
+}
+
+func (ix *Index) stopTrigrams() []uint32 {
+	d := ix.section(stopSection)
+	if len(d) < 8 {
+		return nil
+	}
+	d = d[8:]
+	x := make([]uint32, 0, len(d)/3)
+	for ; len(d) >= 3; d = d[3:] {
+		x = append(x, uint32(d[0])<<16|uint32(d[1])<<8|uint32(d[2]))
+	}
+	return x
+}
+
+// isStop reports whether trigram is a stop trigram.
+func (ix *Index) isStop(trigram uint32) bool {
+	d := ix.section(stopSection)
+	if len(d) < 8 {
+		return false
+	}
+	d = d[8:]
+	n := len(d) / 3
+	i := sort.Search(n, func(i int) bool {
+		i *= 3
+		return uint32(d[i])<<16|uint32(d[i+1])<<8|uint32(d[i+2]) >= trigram
+	})
+	if i >= n {
+		return false
+	}
+	i *= 3
+	return uint32(d[i])<<16|uint32(d[i+1])<<8|uint32(d[i+2]) == trigram
+}
+
+// anyStop reports whether any of tris is a stop trigram.
+func (ix *Index) anyStop(tris []uint32) bool {
+	if _, ok := ix.sections[stopSection]; !ok {
+		return false
+	}
+	for _, t := range tris {
+		if ix.isStop(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// A stopMerger decides the stop trigrams of a merged index.
+type stopMerger struct {
+	fraction float64
+	limit    int
+	old      map[uint32]bool // stop trigrams of the inputs
+	stop     []uint32        // stop trigrams of the output
+}
+
+// newStopMerger returns a stopMerger for merging ix1 and the newer ix2
+// into an index of numName files.
+func newStopMerger(ix1, ix2 *Index, numName uint32) *stopMerger {
+	m := &stopMerger{fraction: ix2.StopFraction(), old: make(map[uint32]bool)}
+	if m.fraction == 0 {
+		m.fraction = ix1.StopFraction()
+	}
+	m.limit = stopLimit(m.fraction, int(numName))
+	for _, t := range ix1.stopTrigrams() {
+		m.old[t] = true
+	}
+	for _, t := range ix2.stopTrigrams() {
+		m.old[t] = true
+	}
+	for t := range m.old {
+		m.stop = append(m.stop, t)
+	}
+	return m
+}
+
+// isStop reports whether trigram, found in count files of the merged
+// index, is a stop trigram there, recording it if it has newly become one.
+func (m *stopMerger) isStop(trigram uint32, count int) bool {
+	if m.old[trigram] {
+		return true
+	}
+	if count > m.limit {
+		m.stop = append(m.stop, trigram)
+		return true
+	}
+	return false
+}
+
+// sections returns the stop section for the merged index, if any.
+func (m *stopMerger) sections() []sectionData {
+	if m.fraction == 0 && len(m.stop) == 0 {
+		return nil
+	}
+	sort.Slice(m.stop, func(i, j int) bool { return m.stop[i] < m.stop[j] })
+	return []sectionData{stopSectionData(m.fraction, m.stop)}
+}
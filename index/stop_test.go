@@ -0,0 +1,118 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp/syntax"
+	"testing"
+)
+
+// stopFiles returns n files under dir, all containing "the cat"
+// and the first few "dog" too.
+func stopFiles(dir string, n int) map[string]string {
+	files := make(map[string]string)
+	for i := 0; i < n; i++ {
+		data := fmt.Sprintf("the cat %d\n", i)
+		if i < 3 {
+			data += "dog\n"
+		}
+		files[fmt.Sprintf("%s/f%d", dir, i)] = data
+	}
+	return files
+}
+
+// stopFraction returns a function that configures an IndexWriter
+// to omit trigrams in more than the given fraction of the files.
+func stopFraction(fraction float64) func(ix *IndexWriter) {
+	return func(ix *IndexWriter) { ix.StopFraction = fraction }
+}
+
+// queryFiles returns the IDs of the files in ix matching re.
+func queryFiles(t *testing.T, ix *Index, re string) []uint32 {
+	r, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix.PostingQuery(RegexpQuery(r))
+}
+
+func fileRange(lo, hi uint32) []uint32 {
+	var x []uint32
+	for i := lo; i < hi; i++ {
+		x = append(x, i)
+	}
+	return x
+}
+
+var stopQueryTests = []struct {
+	re   string
+	want []uint32
+}{
+	{`the cat`, fileRange(0, 10)},
+	{`cat.*dog`, []uint32{0, 1, 2}},
+	{`dog|cat`, fileRange(0, 10)},
+	{`(?i)DOG`, []uint32{0, 1, 2}},
+	{`(?i)the CAT 1`, []uint32{1}},
+	{`cat 7|dog`, []uint32{0, 1, 2, 7}},
+}
+
+func TestStopTrigrams(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+
+	buildIndexWith(f1.Name(), []string{"/s"}, stopFiles("/s", 10), stopFraction(0.5))
+	ix := Open(f1.Name())
+	want := []string{" ca", "at ", "cat", "e c", "he ", "the"}
+	if stop := ix.StopTrigrams(); !equalStrings(stop, want) {
+		t.Errorf("StopTrigrams() = %q, want %q", stop, want)
+	}
+	if f := ix.StopFraction(); f != 0.5 {
+		t.Errorf("StopFraction() = %g, want 0.5", f)
+	}
+	if l := ix.PostingList(tri('c', 'a', 't')); !equalList(l, fileRange(0, 10)) {
+		t.Errorf("PostingList(cat) = %v, want all files", l)
+	}
+	for _, tt := range stopQueryTests {
+		if l := queryFiles(t, ix, tt.re); !equalList(l, tt.want) {
+			t.Errorf("PostingQuery(%#q) = %v, want %v", tt.re, l, tt.want)
+		}
+	}
+	if err := Verify(f1.Name()); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// Merging keeps the stop trigrams and applies the stop fraction
+	// to the merged lists: "dog" is now in 13 of 20 files.
+	dogs := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		dogs[fmt.Sprintf("/t/f%d", i)] = fmt.Sprintf("dog %d\n", i)
+	}
+	buildIndexWith(f2.Name(), []string{"/t"}, dogs, stopFraction(0))
+	Merge(f3.Name(), f1.Name(), f2.Name())
+	ix3 := Open(f3.Name())
+	want = []string{" ca", "at ", "cat", "dog", "e c", "he ", "the"}
+	if stop := ix3.StopTrigrams(); !equalStrings(stop, want) {
+		t.Errorf("merged StopTrigrams() = %q, want %q", stop, want)
+	}
+	if f := ix3.StopFraction(); f != 0.5 {
+		t.Errorf("merged StopFraction() = %g, want 0.5", f)
+	}
+	if l := queryFiles(t, ix3, `dog 4`); !equalList(l, []uint32{14}) {
+		t.Errorf("merged PostingQuery(`dog 4`) = %v, want [14]", l)
+	}
+	if l := queryFiles(t, ix3, `the cat`); !equalList(l, fileRange(0, 20)) {
+		t.Errorf("merged PostingQuery(`the cat`) = %v, want all files", l)
+	}
+	if err := Verify(f3.Name()); err != nil {
+		t.Errorf("Verify merged: %v", err)
+	}
+}
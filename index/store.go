@@ -0,0 +1,522 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Index storage.
+//
+// A remote index (see remote.go) lives in a Storage, chosen by the
+// scheme of its URL:
+//
+//	file:///path/to/index            a local or network file system
+//	http://host/path, https://...    a web server, written with PUT
+//	s3://bucket/key                  an Amazon S3 bucket
+//	gs://bucket/key                  a Google Cloud Storage bucket
+//
+// Requests to S3 are signed with the credentials in $AWS_ACCESS_KEY_ID,
+// $AWS_SECRET_ACCESS_KEY, and $AWS_SESSION_TOKEN, if set, for the region
+// in $AWS_REGION or $AWS_DEFAULT_REGION, or else us-east-1.  Setting
+// $AWS_ENDPOINT_URL_S3 or $AWS_ENDPOINT_URL directs them to another
+// S3-compatible service, such as MinIO.  Requests to Cloud Storage carry
+// the access token in $GOOGLE_OAUTH_ACCESS_TOKEN or, if that is unset,
+// the one printed by gcloud auth print-access-token, if gcloud is
+// installed.  Without credentials, requests are anonymous, which is
+// enough to read a public bucket.
+//
+// Open maps an index into memory as a whole, so it fetches whole
+// indexes from a Storage, which the cache then keeps; Publish stores
+// one after cindex builds it.  OpenRange instead reads an index in
+// place, a range of bytes at a time (see rangeread.go).
+
+// A Storage holds indexes, each named by a URL.
+type Storage interface {
+	// Get returns the contents of the index at url and its ETag,
+	// an opaque version string.  If etag is not empty and names the
+	// current version, Get returns errNotModified instead.  If there
+	// is no index at url, the error wraps fs.ErrNotExist.
+	Get(url, etag string) (io.ReadCloser, string, error)
+
+	// Put replaces the index at url with the size bytes read from r
+	// and returns the ETag of the new version, if known.
+	Put(url string, r io.Reader, size int64) (string, error)
+
+	// GetRange reads len(p) bytes of the index at url, starting at
+	// offset off, into p, and describes the version of the index read.
+	// If etag is not empty and does not name the current version,
+	// GetRange returns errModified instead.
+	GetRange(url, etag string, p []byte, off int64) (RemoteInfo, error)
+}
+
+// A RemoteInfo describes a version of a remote index.
+type RemoteInfo struct {
+	Size    int64     // length in bytes
+	ETag    string    // opaque version string, if known
+	ModTime time.Time // time of writing, if known
+}
+
+// errNotModified is returned by Storage.Get when the index has not
+// changed since the version named by the ETag passed to it.
+var errNotModified = errors.New("not modified")
+
+// errModified is returned by Storage.GetRange when the index has
+// changed since the version named by the ETag passed to it.
+var errModified = errors.New("index replaced by a newer version")
+
+// RemoteStat describes the current version of the remote index at url.
+func RemoteStat(url string) (RemoteInfo, error) {
+	var b [1]byte
+	return StorageFor(url).GetRange(url, "", b[:], 0)
+}
+
+// StorageFor returns the Storage holding the index at url,
+// which must be a remote index (see IsRemote).
+func StorageFor(url string) Storage {
+	switch {
+	case strings.HasPrefix(url, "file://"):
+		return localStorage{}
+	case strings.HasPrefix(url, "s3://"):
+		return &httpStorage{endpoint: s3Endpoint, auth: s3Auth}
+	case strings.HasPrefix(url, "gs://"):
+		return &httpStorage{endpoint: gcsEndpoint, auth: gcsAuth}
+	}
+	return &httpStorage{endpoint: parseURL}
+}
+
+// parseURL is the endpoint of an http:// or https:// index.
+func parseURL(u string) (*url.URL, error) {
+	return url.Parse(u)
+}
+
+// Publish stores the index in file as the remote index at url,
+// making it the cached copy of that index if file is the cache's.
+func Publish(file, url string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	etag, err := StorageFor(url).Put(url, f, info.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	if local, err := remoteCachePath(url); err == nil && sameFile(local, file) {
+		// The cache already holds the new version.
+		writeETag(local, etag)
+		remoteMu.Lock()
+		remoteChecked[url] = time.Now()
+		remoteMu.Unlock()
+	}
+	return nil
+}
+
+// sameFile reports whether the files a and b exist and are the same.
+func sameFile(a, b string) bool {
+	ia, err1 := os.Stat(a)
+	ib, err2 := os.Stat(b)
+	return err1 == nil && err2 == nil && os.SameFile(ia, ib)
+}
+
+// localStorage is the Storage for file:// URLs.
+// The ETag of a file is derived from its size and modification time.
+type localStorage struct{}
+
+// localPath returns the file named by the file:// URL u.
+func localPath(u string) (string, error) {
+	p, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if p.Host != "" && p.Host != "localhost" {
+		return "", fmt.Errorf("%s: file URL names a host", u)
+	}
+	return filepath.FromSlash(p.Path), nil
+}
+
+func (localStorage) Get(url, etag string) (io.ReadCloser, string, error) {
+	file, err := localPath(url)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	cur := localETag(info)
+	if cur == etag {
+		f.Close()
+		return nil, "", errNotModified
+	}
+	return f, cur, nil
+}
+
+func (localStorage) Put(url string, r io.Reader, size int64) (string, error) {
+	file, err := localPath(url)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(file, r); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	return localETag(info), nil
+}
+
+func (localStorage) GetRange(url, etag string, p []byte, off int64) (RemoteInfo, error) {
+	file, err := localPath(url)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	info := RemoteInfo{Size: fi.Size(), ETag: localETag(fi), ModTime: fi.ModTime()}
+	if etag != "" && etag != info.ETag {
+		return info, errModified
+	}
+	if _, err := f.ReadAt(p, off); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// localETag returns the ETag of the file described by info,
+// derived from its size and modification time.
+func localETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// writeFileAtomic writes the data read from r to file, by way of a
+// temporary file renamed into place, so that readers of file never
+// see a partial copy and those with the old file open keep reading it.
+// The new file keeps the mode of the one it replaces, if any.
+func writeFileAtomic(file string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	f, err := createTemp(filepath.Dir(file), filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = keepMode(f, file)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// An httpStorage is a Storage reached by HTTP: a web server,
+// or an object store with an HTTP interface.
+type httpStorage struct {
+	endpoint func(url string) (*url.URL, error) // HTTP URL of an index
+	auth     func(req *http.Request) error      // adds credentials, if any, or nil
+}
+
+// do sends the request for the index at u, with the given body,
+// to the storage.
+func (s *httpStorage) do(method, u string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	endpoint, err := s.endpoint(u)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = endpoint
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.auth != nil {
+		if err := s.auth(req); err != nil {
+			return nil, err
+		}
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (s *httpStorage) Get(url, etag string) (io.ReadCloser, string, error) {
+	h := make(http.Header)
+	if etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	resp, err := s.do("GET", url, nil, 0, h)
+	if err != nil {
+		return nil, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.Header.Get("ETag"), nil
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return nil, "", errNotModified
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("%s: %w", url, fs.ErrNotExist)
+	}
+	resp.Body.Close()
+	return nil, "", fmt.Errorf("%s: %s", url, resp.Status)
+}
+
+func (s *httpStorage) GetRange(url, etag string, p []byte, off int64) (RemoteInfo, error) {
+	h := make(http.Header)
+	h.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	if etag != "" {
+		h.Set("If-Match", etag)
+	}
+	resp, err := s.do("GET", url, nil, 0, h)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	defer resp.Body.Close()
+	info := RemoteInfo{ETag: resp.Header.Get("ETag")}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes first-last/size
+		_, size, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if info.Size, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return info, fmt.Errorf("%s: invalid Content-Range %q", url, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// The server ignored the range and sent the whole index.
+		info.Size = resp.ContentLength
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return info, fmt.Errorf("%s: %v", url, err)
+		}
+	case http.StatusPreconditionFailed:
+		return info, errModified
+	case http.StatusNotFound:
+		return info, fmt.Errorf("%s: %w", url, fs.ErrNotExist)
+	default:
+		return info, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if etag != "" && info.ETag != "" && info.ETag != etag {
+		// The server ignored If-Match.
+		return info, errModified
+	}
+	if _, err := io.ReadFull(resp.Body, p); err != nil {
+		return info, fmt.Errorf("%s: %v", url, err)
+	}
+	return info, nil
+}
+
+func (s *httpStorage) Put(url string, r io.Reader, size int64) (string, error) {
+	h := make(http.Header)
+	h.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do("PUT", url, r, size, h)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// splitBucket splits an s3:// or gs:// URL into its bucket and key.
+func splitBucket(u string) (bucket, key string, err error) {
+	_, rest, _ := strings.Cut(u, "://")
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("%s: URL must name a bucket and a key", u)
+	}
+	return bucket, key, nil
+}
+
+// s3Region returns the AWS region to use.
+func s3Region() string {
+	for _, v := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if r := os.Getenv(v); r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+// s3Endpoint returns the HTTP URL of the object named by an s3:// URL.
+func s3Endpoint(u string) (*url.URL, error) {
+	bucket, key, err := splitBucket(u)
+	if err != nil {
+		return nil, err
+	}
+	var endpoint *url.URL
+	for _, v := range []string{"AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"} {
+		if e := os.Getenv(v); e != "" {
+			if endpoint, err = url.Parse(e); err != nil {
+				return nil, fmt.Errorf("$%s: %v", v, err)
+			}
+			break
+		}
+	}
+	if endpoint != nil {
+		// Other services take the bucket in the path.
+		key = bucket + "/" + key
+	} else {
+		endpoint = &url.URL{Scheme: "https", Host: bucket + ".s3." + s3Region() + ".amazonaws.com"}
+	}
+	path := strings.TrimSuffix(endpoint.Path, "/") + "/" + key
+	return &url.URL{
+		Scheme:  endpoint.Scheme,
+		Host:    endpoint.Host,
+		Path:    path,
+		RawPath: awsEscape(path),
+	}, nil
+}
+
+// s3Auth signs req with the credentials in the environment, if any.
+func s3Auth(req *http.Request) error {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	// The index is too large to hash before sending,
+	// and HTTPS protects it anyway.
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	signV4(req, s3Region(), id, secret, time.Now())
+	return nil
+}
+
+// signV4 signs req for S3 in the given region with AWS Signature
+// Version 4, covering the host and all the headers of req.  The
+// X-Amz-Content-Sha256 header must already be set.
+func signV4(req *http.Request, region, id, secret string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canon strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canon, "%s:%s\n", k, headers[k])
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canon.String(),
+		signed,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, s := range []string{date, region, "s3", "aws4_request", toSign} {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		key = h.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		id, scope, signed, key))
+}
+
+// awsEscape escapes path as AWS requires: every byte other than
+// letters, digits, '-', '.', '_', '~', and '/' as %XX.
+func awsEscape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// gcsEndpoint returns the HTTP URL of the object named by a gs:// URL.
+func gcsEndpoint(u string) (*url.URL, error) {
+	bucket, key, err := splitBucket(u)
+	if err != nil {
+		return nil, err
+	}
+	return &url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + bucket + "/" + key}, nil
+}
+
+// gcsAuth adds the access token found in the environment or
+// given by gcloud, if any, to req.
+func gcsAuth(req *http.Request) error {
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		if _, err := exec.LookPath("gcloud"); err == nil {
+			out, err := exec.Command("gcloud", "auth", "print-access-token").Output()
+			if err != nil {
+				return fmt.Errorf("gcloud auth print-access-token: %v", err)
+			}
+			token = strings.TrimSpace(string(out))
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Symbol indexing.
+//
+// If IndexWriter.Symbols is set, the writer records the names of
+// the symbols defined in each file it indexes, along with the line
+// numbers of the definitions, in the "sym" section.  Go files are
+// parsed with go/parser; files in other languages are scanned with
+// regular expressions matching common forms of definitions, much as
+// ctags does.  See read.go for the format.
+
+const symSection = "sym"
+
+// A Symbol records the definition of a symbol in an indexed file.
+type Symbol struct {
+	Name   string
+	Fileid uint32
+	Line   int
+}
+
+// A symDef is a symbol definition found in a file being indexed.
+type symDef struct {
+	name string
+	line int
+}
+
+// A symRef is a reference to a symbol definition in the index.
+type symRef struct {
+	fileid uint32
+	line   int
+}
+
+// symbolPatterns lists, for each language, regular expressions
+// matching a line that defines the symbol named by the first
+// submatch.  Go files are parsed instead.
+var symbolPatterns = map[string][]*regexp.Regexp{
+	"c": {
+		regexp.MustCompile(`^\s*#\s*define\s+(\w+)`),
+		regexp.MustCompile(`^\s*(?:typedef\s+)?(?:struct|union|enum)\s+(\w+)\s*\{`),
+		regexp.MustCompile(`^\s*typedef\b.*?\b(\w+)\s*;`),
+		regexp.MustCompile(`^(?:[\w*]+[\s*]+)*?\**(\w+)\s*\([^;]*$`),
+	},
+	"cpp": {
+		regexp.MustCompile(`^\s*#\s*define\s+(\w+)`),
+		regexp.MustCompile(`^\s*(?:template\s*<.*>\s*)?(?:class|struct|union|enum(?:\s+class)?)\s+(\w+)[^;]*$`),
+		regexp.MustCompile(`^\s*(?:typedef\b.*?\b|using\s+)(\w+)\s*[;=]`),
+		regexp.MustCompile(`^\s*namespace\s+(\w+)`),
+		regexp.MustCompile(`^(?:[\w*&:<>,]+[\s*&]+)*?[*&]*(?:\w+::)*(~?\w+)\s*\([^;]*$`),
+	},
+	"cs": {
+		regexp.MustCompile(`\b(?:class|interface|struct|enum|record)\s+(\w+)`),
+		regexp.MustCompile(`^\s*(?:(?:public|private|protected|internal|static|virtual|override|abstract|async|sealed|extern|unsafe)\s+)+[\w<>\[\],.?]+\s+(\w+)\s*\(`),
+	},
+	"java": {
+		regexp.MustCompile(`\b(?:class|interface|enum|record)\s+(\w+)`),
+		regexp.MustCompile(`^\s*(?:(?:public|private|protected|static|final|abstract|synchronized|native|default)\s+)+[\w<>\[\],.?]+\s+(\w+)\s*\(`),
+	},
+	"js": {
+		regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(\w+)`),
+		regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?class\s+(\w+)`),
+		regexp.MustCompile(`^\s*(?:export\s+)?(?:const|let|var)\s+(\w+)\s*=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*=>|\w+\s*=>)`),
+	},
+	"kotlin": {
+		regexp.MustCompile(`\b(?:class|interface|object)\s+(\w+)`),
+		regexp.MustCompile(`\bfun\s+(?:<[^>]*>\s*)?(?:\w+\.)?(\w+)\s*\(`),
+	},
+	"php": {
+		regexp.MustCompile(`\b(?:class|interface|trait)\s+(\w+)`),
+		regexp.MustCompile(`\bfunction\s+&?(\w+)\s*\(`),
+	},
+	"perl": {
+		regexp.MustCompile(`^\s*sub\s+(\w+)`),
+		regexp.MustCompile(`^\s*package\s+([\w:]+)`),
+	},
+	"proto": {
+		regexp.MustCompile(`^\s*(?:message|service|enum)\s+(\w+)`),
+		regexp.MustCompile(`^\s*rpc\s+(\w+)`),
+	},
+	"py": {
+		regexp.MustCompile(`^\s*(?:async\s+)?def\s+(\w+)`),
+		regexp.MustCompile(`^\s*class\s+(\w+)`),
+		regexp.MustCompile(`^(\w+)\s*(?::[^=]*)?=[^=]`),
+	},
+	"ruby": {
+		regexp.MustCompile(`^\s*def\s+(?:self\.)?(\w+[?!=]?)`),
+		regexp.MustCompile(`^\s*(?:class|module)\s+(?:\w+::)*(\w+)`),
+	},
+	"rust": {
+		regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:(?:const|async|unsafe|extern(?:\s+"[^"]*")?)\s+)*fn\s+(\w+)`),
+		regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:struct|enum|union|trait|type|mod)\s+(\w+)`),
+		regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:const|static)\s+(?:mut\s+)?(\w+)\s*:`),
+		regexp.MustCompile(`^\s*macro_rules!\s*(\w+)`),
+	},
+	"scala": {
+		regexp.MustCompile(`\b(?:class|trait|object)\s+(\w+)`),
+		regexp.MustCompile(`\bdef\s+(\w+)`),
+	},
+	"sh": {
+		regexp.MustCompile(`^\s*(?:function\s+)?(\w+)\s*\(\)`),
+		regexp.MustCompile(`^\s*function\s+(\w+)`),
+	},
+	"swift": {
+		regexp.MustCompile(`\b(?:class|struct|enum|protocol|extension)\s+(\w+)`),
+		regexp.MustCompile(`\bfunc\s+(\w+)`),
+	},
+	"ts": {
+		regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(\w+)`),
+		regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:abstract\s+)?(?:class|interface|enum|type)\s+(\w+)`),
+		regexp.MustCompile(`^\s*(?:export\s+)?(?:const|let|var)\s+(\w+)\s*(?::[^=]*)?=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*(?::[^=]*)?=>|\w+\s*=>)`),
+	},
+}
+
+// hasSymbols reports whether symbols can be extracted from files
+// in the given language.
+func hasSymbols(lang string) bool {
+	return lang == "go" || symbolPatterns[lang] != nil
+}
+
+// extractSymbols returns the symbols defined in the named file,
+// which holds data in the given language.
+func extractSymbols(name, lang string, data []byte) []symDef {
+	if lang == "go" {
+		return goSymbols(name, data)
+	}
+	pats := symbolPatterns[lang]
+	if pats == nil {
+		return nil
+	}
+	var syms []symDef
+	for lineno := 1; len(data) > 0; lineno++ {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		for _, re := range pats {
+			if m := re.FindSubmatch(line); m != nil {
+				syms = append(syms, symDef{string(m[1]), lineno})
+				break
+			}
+		}
+	}
+	return syms
+}
+
+// goSymbols returns the top-level declarations and methods in the Go file.
+// Files that do not parse yield whatever declarations could be parsed.
+func goSymbols(name string, data []byte) []symDef {
+	fset := token.NewFileSet()
+	f, _ := parser.ParseFile(fset, name, data, parser.SkipObjectResolution)
+	if f == nil {
+		return nil
+	}
+	var syms []symDef
+	add := func(id *ast.Ident) {
+		if id != nil && id.Name != "_" {
+			syms = append(syms, symDef{id.Name, fset.Position(id.Pos()).Line})
+		}
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			add(d.Name)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add(s.Name)
+					if st, ok := s.Type.(*ast.StructType); ok {
+						for _, field := range st.Fields.List {
+							for _, id := range field.Names {
+								add(id)
+							}
+						}
+					}
+					if it, ok := s.Type.(*ast.InterfaceType); ok {
+						for _, m := range it.Methods.List {
+							for _, id := range m.Names {
+								add(id)
+							}
+						}
+					}
+				case *ast.ValueSpec:
+					for _, id := range s.Names {
+						add(id)
+					}
+				}
+			}
+		}
+	}
+	return syms
+}
+
+// A symWriter accumulates the symbol definitions for the sym section.
+type symWriter struct {
+	syms map[string][]symRef
+	mem  bool // build the section in memory
+}
+
+func newSymWriter(mem bool) *symWriter {
+	return &symWriter{syms: make(map[string][]symRef), mem: mem}
+}
+
+// add records the definition of name at the given line of fileid.
+func (w *symWriter) add(name string, fileid uint32, line int) {
+	w.syms[name] = append(w.syms[name], symRef{fileid, line})
+}
+
+// addIndex records the symbol definitions in ix,
+// renumbering their file IDs using idmap.
+// Definitions in files missing from idmap are dropped.
+func (w *symWriter) addIndex(ix *Index, idmap []idrange) {
+	for i, n := 0, ix.numSymbols(); i < n; i++ {
+		name, refs := ix.symbolAt(i)
+		for _, r := range refs {
+			j := sort.Search(len(idmap), func(j int) bool { return idmap[j].hi > r.fileid })
+			if j < len(idmap) && idmap[j].lo <= r.fileid {
+				w.add(name, idmap[j].new+r.fileid-idmap[j].lo, r.line)
+			}
+		}
+	}
+}
+
+// section returns the sym section holding the recorded symbols.
+func (w *symWriter) section() sectionData {
+	names := make([]string, 0, len(w.syms))
+	for name := range w.syms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Symbol entries, preceded by their offsets.
+	entries := newTempBuf(w.mem)
+	offsets := make([]uint32, len(names))
+	base := uint32(4 + 4*len(names))
+	for i, name := range names {
+		refs := w.syms[name]
+		sort.Slice(refs, func(i, j int) bool {
+			if refs[i].fileid != refs[j].fileid {
+				return refs[i].fileid < refs[j].fileid
+			}
+			return refs[i].line < refs[j].line
+		})
+		offsets[i] = base + entries.offset()
+		writeSymbol(entries, name, refs)
+	}
+	out := newTempBuf(w.mem)
+	out.writeUint32(uint32(len(names)))
+	for _, off := range offsets {
+		out.writeUint32(off)
+	}
+	copyFile(out, entries)
+	entries.remove()
+	return sectionData{symSection, out}
+}
+
+// writeSymbol writes the entry for name, defined at refs, to out.
+func writeSymbol(out *bufWriter, name string, refs []symRef) {
+	out.writeString(name)
+	out.writeString("\x00")
+	out.writeUvarint(uint32(len(refs)))
+	last := uint32(0)
+	for _, r := range refs {
+		out.writeUvarint(r.fileid - last)
+		out.writeUvarint(uint32(r.line))
+		last = r.fileid
+	}
+}
+
+// HasSymbols reports whether the index records symbol definitions.
+func (ix *Index) HasSymbols() bool {
+	return ix.section(symSection) != nil
+}
+
+// numSymbols returns the number of distinct symbol names in the index.
+func (ix *Index) numSymbols() int {
+	d := ix.section(symSection)
+	if len(d) < 4 {
+		return 0
+	}
+	n := int(binary.BigEndian.Uint32(d))
+	if 4+4*n > len(d) {
+		corrupt()
+	}
+	return n
+}
+
+// symbolEntry returns the data for the i'th symbol,
+// split into its name and the encoded definitions.
+func (ix *Index) symbolEntry(i int) (string, []byte) {
+	d := ix.section(symSection)
+	off := binary.BigEndian.Uint32(d[4+4*i:])
+	if int(off) >= len(d) {
+		corrupt()
+	}
+	d = d[off:]
+	j := bytes.IndexByte(d, 0)
+	if j < 0 {
+		corrupt()
+	}
+	return string(d[:j]), d[j+1:]
+}
+
+// symbolName returns the name of the i'th symbol.
+func (ix *Index) symbolName(i int) string {
+	name, _ := ix.symbolEntry(i)
+	return name
+}
+
+// symbolAt returns the name and definitions of the i'th symbol.
+func (ix *Index) symbolAt(i int) (string, []symRef) {
+	name, d := ix.symbolEntry(i)
+	next := func() uint32 {
+		v, n := binary.Uvarint(d)
+		if n <= 0 {
+			corrupt()
+		}
+		d = d[n:]
+		return uint32(v)
+	}
+	refs := make([]symRef, next())
+	fileid := uint32(0)
+	for k := range refs {
+		fileid += next()
+		refs[k] = symRef{fileid, int(next())}
+	}
+	return name, refs
+}
+
+// LookupSymbol returns the definitions of the symbol with the given name.
+func (ix *Index) LookupSymbol(name string) []Symbol {
+	n := ix.numSymbols()
+	i := sort.Search(n, func(i int) bool { return ix.symbolName(i) >= name })
+	if i >= n || ix.symbolName(i) != name {
+		return nil
+	}
+	return ix.symbols(i, nil)
+}
+
+// MatchSymbols returns the definitions of the symbols whose names
+// satisfy match, in order by name.  If prefix is not empty, only
+// names beginning with prefix are considered.
+func (ix *Index) MatchSymbols(prefix string, match func(name string) bool) []Symbol {
+	n := ix.numSymbols()
+	var syms []Symbol
+	for i := sort.Search(n, func(i int) bool { return ix.symbolName(i) >= prefix }); i < n; i++ {
+		name := ix.symbolName(i)
+		if !strings.HasPrefix(name, prefix) {
+			break
+		}
+		if match(name) {
+			syms = ix.symbols(i, syms)
+		}
+	}
+	return syms
+}
+
+// symbols appends the definitions of the i'th symbol to syms.
+func (ix *Index) symbols(i int, syms []Symbol) []Symbol {
+	name, refs := ix.symbolAt(i)
+	for _, r := range refs {
+		syms = append(syms, Symbol{name, r.fileid, r.line})
+	}
+	return syms
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var symbolTests = []struct {
+	name string
+	data string
+	want []string
+}{
+	{
+		"x.go",
+		"package x\n\ntype T struct {\n\tField int\n}\n\nfunc (T) Method() {}\n\nconst (\n\tA = iota\n\t_\n)\n\nfunc F() {\n\tvar local int\n}\n",
+		[]string{"T:3", "Field:4", "Method:7", "A:10", "F:14"},
+	},
+	{
+		"x.py",
+		"import os\n\nclass Foo(object):\n    def bar(self):\n        pass\n\nVALUE = 1\nasync def baz():\n    x = 1\n",
+		[]string{"Foo:3", "bar:4", "VALUE:7", "baz:8"},
+	},
+	{
+		"x.c",
+		"#define MAX 10\n\nstruct point {\n\tint x;\n};\n\nstatic int\nadd(int a, int b)\n{\n\treturn a + b;\n}\nint f(void);\n",
+		[]string{"MAX:1", "point:3", "add:8"},
+	},
+	{
+		"x.rs",
+		"pub struct S;\n\npub(crate) fn run() {}\nconst N: usize = 1;\n",
+		[]string{"S:1", "run:3", "N:4"},
+	},
+	{
+		"x.txt",
+		"def foo():\n",
+		nil,
+	},
+}
+
+func TestExtractSymbols(t *testing.T) {
+	for _, tt := range symbolTests {
+		var have []string
+		for _, s := range extractSymbols(tt.name, detectLanguage(tt.name), []byte(tt.data)) {
+			have = append(have, fmt.Sprintf("%s:%d", s.name, s.line))
+		}
+		if !equalStrings(have, tt.want) {
+			t.Errorf("%s: symbols = %v, want %v", tt.name, have, tt.want)
+		}
+	}
+}
+
+func symbolStrings(ix *Index, syms []Symbol) []string {
+	var x []string
+	for _, s := range syms {
+		x = append(x, fmt.Sprintf("%s:%s:%d", s.Name, ix.Name(s.Fileid), s.Line))
+	}
+	return x
+}
+
+func TestSymbolIndex(t *testing.T) {
+	f1, _ := ioutil.TempFile("", "index-test")
+	f2, _ := ioutil.TempFile("", "index-test")
+	f3, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f1.Name())
+	defer os.Remove(f2.Name())
+	defer os.Remove(f3.Name())
+	symbols := func(ix *IndexWriter) { ix.Symbols = true }
+	buildIndexWith(f1.Name(), []string{"/a", "/c"}, map[string]string{
+		"/a/a.go": "package a\n\nfunc Foo() {}\n\nfunc FooBar() {}\n",
+		"/c/c.py": "def Foo():\n    pass\n",
+	}, symbols)
+	buildIndexWith(f2.Name(), []string{"/b", "/c"}, map[string]string{
+		"/b/b.go": "package b\n\ntype Foo int\n",
+		"/c/d.py": "def Bar():\n    pass\n",
+	}, symbols)
+
+	ix1 := Open(f1.Name())
+	if !ix1.HasSymbols() {
+		t.Fatalf("index has no symbols")
+	}
+	have := symbolStrings(ix1, ix1.LookupSymbol("Foo"))
+	want := []string{"Foo:/a/a.go:3", "Foo:/c/c.py:1"}
+	if !equalStrings(have, want) {
+		t.Errorf("LookupSymbol(Foo) = %v, want %v", have, want)
+	}
+	if syms := ix1.LookupSymbol("Fo"); syms != nil {
+		t.Errorf("LookupSymbol(Fo) = %v, want none", syms)
+	}
+	have = symbolStrings(ix1, ix1.MatchSymbols("Foo", func(string) bool { return true }))
+	want = []string{"Foo:/a/a.go:3", "Foo:/c/c.py:1", "FooBar:/a/a.go:5"}
+	if !equalStrings(have, want) {
+		t.Errorf("MatchSymbols(Foo) = %v, want %v", have, want)
+	}
+
+	// Merging drops the symbols in /c/c.py, which lies under /c in f2.
+	Merge(f3.Name(), f1.Name(), f2.Name())
+	ix3 := Open(f3.Name())
+	have = symbolStrings(ix3, ix3.MatchSymbols("", func(string) bool { return true }))
+	want = []string{"Bar:/c/d.py:1", "Foo:/a/a.go:3", "Foo:/b/b.go:3", "FooBar:/a/a.go:5"}
+	if !equalStrings(have, want) {
+		t.Errorf("merged symbols = %v, want %v", have, want)
+	}
+
+	buildIndex(f2.Name(), nil, map[string]string{"/x.go": "package x\n\nfunc X() {}\n"})
+	if Open(f2.Name()).HasSymbols() {
+		t.Errorf("index written without Symbols has symbols")
+	}
+}
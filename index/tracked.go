@@ -0,0 +1,97 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Git-tracked files.
+//
+// With IndexWriter.GitTracked set, AddTree indexes only the files that
+// git tracks in the checkout holding the tree, as listed by git
+// ls-files, so that build outputs and other untracked files are left
+// out without having to be excluded one by one.  AddTree still walks
+// the tree, so that the usual rules for skipping files apply, but it
+// does not enter directories holding no tracked files.  A file that
+// is tracked but absent, as in a sparse checkout, is not indexed.
+
+// A gitTracked lists the files that git tracks in a tree.
+type gitTracked struct {
+	root  string          // root of the tree
+	files map[string]bool // tracked files, relative to root, with slashes
+	dirs  map[string]bool // directories holding them
+}
+
+// listTracked returns the files tracked by git in the tree rooted at
+// root, which may be a directory or a single file, including those in
+// submodules if submodules is set.
+func listTracked(root string, submodules bool) (*gitTracked, error) {
+	dir, args := root, []string{"ls-files", "-z"}
+	if submodules {
+		args = append(args, "--recurse-submodules")
+	}
+	if info, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		dir = filepath.Dir(root)
+		args = append(args, "--", filepath.Base(root))
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("git ls-files: %s", msg)
+		}
+		return nil, err
+	}
+	t := &gitTracked{
+		root:  dir,
+		files: make(map[string]bool),
+		dirs:  make(map[string]bool),
+	}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name == "" {
+			continue
+		}
+		t.files[name] = true
+		for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name[:i], "/") {
+			if t.dirs[name[:i]] {
+				break
+			}
+			t.dirs[name[:i]] = true
+		}
+	}
+	return t, nil
+}
+
+// has reports whether path, a file or directory, is tracked
+// or holds tracked files.
+func (t *gitTracked) has(path string, isDir bool) bool {
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if isDir {
+		return rel == "." || t.dirs[rel]
+	}
+	return t.files[rel]
+}
+
+// IsGitTracked reports whether git tracks the file path
+// in the checkout holding it.
+func IsGitTracked(path string) bool {
+	t, err := listTracked(path, false)
+	return err == nil && t.has(path, false)
+}
@@ -0,0 +1,858 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// Index verification.
+//
+// The reader trusts the index: it checks only what it must to avoid
+// reading out of bounds, and it exits with a terse message when a check
+// fails, often in the middle of a search.  Verify instead checks the
+// whole index against the format described in read.go, trusting none
+// of it, and reports where each problem lies, so that a damaged index,
+// such as one left by a crash while merging, can be found and rebuilt.
+
+// maxProblems is the number of problems Verify reports
+// before it stops looking for more.
+const maxProblems = 20
+
+// Verify checks the structure of the named index file: the header and
+// trailer, the offsets of the lists and sections, the order of the paths,
+// names, and posting lists, the contents of each posting list, and the
+// sections that this package writes, and the checksums of each part of
+// the index.  It returns nil if it finds no problems and otherwise an
+// error listing them (at most 20), each giving the byte offset in the
+// file at which it was found.
+//
+// Indexes written before checksums were recorded have none, so in them
+// Verify cannot detect damage that leaves the structure intact, such as
+// a changed byte in a file name.
+func Verify(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v := &verifier{file: file, d: mmapFile(f).d}
+	v.verify()
+	return errors.Join(v.problems...)
+}
+
+// A verifier holds the state of a call to Verify.
+type verifier struct {
+	file     string
+	d        []byte
+	problems []error
+	version  int
+	numName  int
+
+	// Offsets from the trailer.  A version 1 index has no section
+	// index, so sectionIndex is the offset of the trailer.
+	pathData, nameData, postData, nameIndex, postIndex, sectionIndex uint32
+	trailer                                                          uint32
+
+	sectionEnd uint32 // end of the section index
+}
+
+// errorf records a problem found at the given offset in the index.
+func (v *verifier) errorf(off uint32, format string, args ...any) {
+	switch {
+	case len(v.problems) < maxProblems:
+		v.problems = append(v.problems, fmt.Errorf("%s: offset %d: %s", v.file, off, fmt.Sprintf(format, args...)))
+	case len(v.problems) == maxProblems:
+		v.problems = append(v.problems, fmt.Errorf("%s: too many problems", v.file))
+	}
+}
+
+// full reports whether v has found as many problems as it reports.
+func (v *verifier) full() bool {
+	return len(v.problems) >= maxProblems
+}
+
+// str returns the NUL-terminated string at off, which must end before
+// limit.  The boolean result reports whether it does.
+func (v *verifier) str(off, limit uint32) ([]byte, bool) {
+	if off >= limit {
+		return nil, false
+	}
+	i := bytes.IndexByte(v.d[off:limit], 0)
+	if i < 0 {
+		return nil, false
+	}
+	return v.d[off : off+uint32(i)], true
+}
+
+func (v *verifier) uint32(off uint32) uint32 {
+	return binary.BigEndian.Uint32(v.d[off:])
+}
+
+func (v *verifier) verify() {
+	d := v.d
+	if len(d) < len(magic)+5*4+len(trailerMagic) {
+		v.errorf(0, "file too short (%d bytes) to be an index", len(d))
+		return
+	}
+	noff := 6
+	switch string(d[:len(magic)]) {
+	case magicV4:
+		v.version = 4
+	case magic:
+		v.version = 3
+	case magicV2:
+		v.version = 2
+	case magicV1:
+		v.version = 1
+		noff = 5
+	default:
+		v.errorf(0, "bad header %q", d[:len(magic)])
+		return
+	}
+	if len(d) < len(magic)+noff*4+len(trailerMagic) {
+		v.errorf(0, "file too short (%d bytes) to be an index", len(d))
+		return
+	}
+	t := uint32(len(d) - len(trailerMagic))
+	if string(d[t:]) != trailerMagic {
+		v.errorf(t, "bad trailer %q", d[t:])
+		return
+	}
+
+	// The lists must appear in the order the trailer lists them,
+	// between the header and the trailer.
+	t -= uint32(noff * 4)
+	v.trailer = t
+	what := []string{"path list", "name list", "posting lists", "name index", "posting list index", "section index"}
+	offs := []uint32{t, t, t, t, t, t}
+	prev := uint32(len(magic))
+	ok := true
+	for i := 0; i < noff; i++ {
+		off := v.uint32(t + 4*uint32(i))
+		if off < prev || off > t {
+			v.errorf(t+4*uint32(i), "%s offset %d out of range [%d, %d]", what[i], off, prev, t)
+			ok = false
+			continue
+		}
+		offs[i], prev = off, off
+	}
+	if !ok {
+		return
+	}
+	v.pathData, v.nameData, v.postData = offs[0], offs[1], offs[2]
+	v.nameIndex, v.postIndex, v.sectionIndex = offs[3], offs[4], offs[5]
+	if n := v.postIndex - v.nameIndex; n == 0 || n%4 != 0 {
+		v.errorf(v.nameIndex, "name index length %d is not a positive multiple of 4", n)
+		return
+	}
+	v.numName = int((v.postIndex-v.nameIndex)/4) - 1
+
+	v.verifyPaths()
+	v.verifyNames()
+	v.verifyPosts()
+	if v.version >= 2 {
+		v.verifySections()
+	}
+}
+
+// verifyPaths checks the path list.
+func (v *verifier) verifyPaths() {
+	off := v.pathData
+	var prev []byte
+	for i := 0; ; i++ {
+		p, ok := v.str(off, v.nameData)
+		if !ok {
+			v.errorf(off, "path %d runs into the name list", i)
+			return
+		}
+		if len(p) == 0 {
+			off++
+			break
+		}
+		if i > 0 && bytes.Compare(p, prev) <= 0 {
+			v.errorf(off, "path %q out of order after %q", p, prev)
+		}
+		prev = p
+		off += uint32(len(p) + 1)
+	}
+	if off != v.nameData {
+		v.errorf(off, "%d unexpected bytes after path list", v.nameData-off)
+	}
+}
+
+// verifyNames checks the name list and the name index.
+func (v *verifier) verifyNames() {
+	size := v.postData - v.nameData
+	var prev []byte
+	check := func(off uint32, fileid int, name []byte) {
+		if fileid > 0 && nameBefore(name, prev) {
+			v.errorf(off, "file %d: name %q out of order after %q", fileid, name, prev)
+		}
+		prev = name
+	}
+
+	if v.version < 4 {
+		// The names are stored one after another,
+		// ending with an empty name.
+		want := uint32(0)
+		for i := 0; i <= v.numName && !v.full(); i++ {
+			ent := v.nameIndex + 4*uint32(i)
+			off := v.uint32(ent)
+			if off != want {
+				v.errorf(ent, "file %d: name offset %d, want %d", i, off, want)
+				return
+			}
+			name, ok := v.str(v.nameData+off, v.postData)
+			if !ok {
+				v.errorf(v.nameData+off, "file %d: name runs into the posting lists", i)
+				return
+			}
+			if i == v.numName {
+				if len(name) != 0 {
+					v.errorf(v.nameData+off, "name list ends with %q, not an empty name", name)
+				}
+				want++
+				break
+			}
+			if len(name) == 0 {
+				v.errorf(v.nameData+off, "file %d: empty name", i)
+			}
+			check(v.nameData+off, i, name)
+			want += uint32(len(name) + 1)
+		}
+		if want != size && !v.full() {
+			v.errorf(v.nameData+want, "%d unexpected bytes after name list", size-want)
+		}
+		return
+	}
+
+	// The names are stored in compressed blocks.  Every name index entry
+	// in a block gives the offset of the block, and the final entry
+	// gives the end of the list.
+	_, dec := zstdCodec()
+	end := v.uint32(v.nameIndex + 4*uint32(v.numName))
+	if end != size {
+		v.errorf(v.nameIndex+4*uint32(v.numName), "end of name list %d, want %d", end, size)
+		return
+	}
+	want := uint32(0)
+	for first := 0; first < v.numName && !v.full(); first += nameBlockSize {
+		last := min(first+nameBlockSize, v.numName)
+		off := v.uint32(v.nameIndex + 4*uint32(first))
+		if off != want {
+			v.errorf(v.nameIndex+4*uint32(first), "file %d: name block offset %d, want %d", first, off, want)
+			return
+		}
+		for i := first + 1; i < last; i++ {
+			if o := v.uint32(v.nameIndex + 4*uint32(i)); o != off {
+				v.errorf(v.nameIndex+4*uint32(i), "file %d: name block offset %d, want %d", i, o, off)
+				return
+			}
+		}
+		next := end
+		if last < v.numName {
+			next = v.uint32(v.nameIndex + 4*uint32(last))
+		}
+		if next <= off || next > end {
+			v.errorf(v.nameIndex+4*uint32(last), "file %d: name block offset %d out of range (%d, %d]", last, next, off, end)
+			return
+		}
+		data, err := dec.DecodeAll(v.d[v.nameData+off:v.nameData+next], nil)
+		if err != nil {
+			v.errorf(v.nameData+off, "name block for files %d-%d: %v", first, last-1, err)
+		} else {
+			i := first
+			for len(data) > 0 && i < last {
+				j := bytes.IndexByte(data, 0)
+				if j < 0 {
+					break
+				}
+				if j == 0 {
+					v.errorf(v.nameData+off, "file %d: empty name", i)
+				}
+				check(v.nameData+off, i, data[:j])
+				data = data[j+1:]
+				i++
+			}
+			if i != last || len(data) > 0 {
+				v.errorf(v.nameData+off, "name block for files %d-%d holds the wrong number of names", first, last-1)
+			}
+		}
+		want = next
+	}
+}
+
+// nameBefore reports whether the file name a belongs before b in
+// the name list.  Names are listed in the order in which the file trees
+// were walked, which sorts the elements of each path, so that "a/b" comes
+// before "a.go", except that the files in git trees are listed in byte
+// order, so that "a.go" comes first.  A name is in order if it follows
+// the previous one in either order.
+func nameBefore(a, b []byte) bool {
+	if bytes.Compare(a, b) > 0 {
+		return false
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := a[i], b[i]
+		if ca == cb {
+			continue
+		}
+		if ca == '/' {
+			return true
+		}
+		if cb == '/' {
+			return false
+		}
+		return ca < cb
+	}
+	return len(a) <= len(b)
+}
+
+// verifyPosts checks the posting list index and the posting lists.
+func (v *verifier) verifyPosts() {
+	n := v.sectionIndex - v.postIndex
+	if n%postEntrySize != 0 {
+		v.errorf(v.postIndex, "posting list index length %d is not a multiple of %d", n, postEntrySize)
+		return
+	}
+	numPost := int(n / postEntrySize)
+	size := v.nameIndex - v.postData
+	entry := func(i int) (trigram, count, offset uint32) {
+		e := v.d[v.postIndex+uint32(i)*postEntrySize:]
+		return uint32(e[0])<<16 | uint32(e[1])<<8 | uint32(e[2]), binary.BigEndian.Uint32(e[3:]), binary.BigEndian.Uint32(e[7:])
+	}
+
+	var ids []uint32
+	want := uint32(0)
+	for i := 0; i < numPost && !v.full(); i++ {
+		ent := v.postIndex + uint32(i)*postEntrySize
+		trigram, count, off := entry(i)
+		if i > 0 {
+			if t, _, _ := entry(i - 1); trigram <= t {
+				v.errorf(ent, "posting list index entry %d: trigram %q out of order after %q", i, trigramString(trigram), trigramString(t))
+			}
+		}
+		if off != want {
+			v.errorf(ent, "posting list index entry %d: offset %d, want %d", i, off, want)
+			return
+		}
+		next := size
+		if i+1 < numPost {
+			_, _, next = entry(i + 1)
+			if next <= off+3 || next > size {
+				v.errorf(ent+postEntrySize, "posting list index entry %d: offset %d out of range (%d, %d]", i+1, next, off+3, size)
+				return
+			}
+		}
+		start := v.postData + off
+		if start+3 > v.nameIndex {
+			v.errorf(ent, "posting list index entry %d: offset %d beyond posting lists", i, off)
+			return
+		}
+		if t := uint32(v.d[start])<<16 | uint32(v.d[start+1])<<8 | uint32(v.d[start+2]); t != trigram {
+			v.errorf(start, "posting list for %q begins with trigram %q", trigramString(trigram), trigramString(t))
+			want = next
+			continue
+		}
+		var err error
+		ids, err = v.postingList(ids[:0], v.d[start+3:v.postData+next], count)
+		if err != nil {
+			v.errorf(start, "posting list for %q: %v", trigramString(trigram), err)
+		}
+		want = next
+	}
+	if want != size && !v.full() {
+		v.errorf(v.postData+want, "%d unexpected bytes after posting lists", size-want)
+	}
+}
+
+// postingList decodes the posting list d, which should hold count
+// file IDs, appending them to ids.
+func (v *verifier) postingList(ids []uint32, d []byte, count uint32) ([]uint32, error) {
+	if count > 0 && len(d) > 0 && d[0] == 0 {
+		if v.version < 3 {
+			return ids, fmt.Errorf("roaring bitmap in version %d index", v.version)
+		}
+		l, err := decodeRoaring(d[1:])
+		if err != nil {
+			return ids, err
+		}
+		// Count the IDs before expanding the list,
+		// which might otherwise be enormous.
+		if n := l.count(); n != int(count) {
+			return ids, fmt.Errorf("%d file IDs, want %d", n, count)
+		}
+		ids = l.appendIDs(ids)
+		for i, id := range ids {
+			if i > 0 && id <= ids[i-1] {
+				return ids, fmt.Errorf("file ID %d out of order after %d", id, ids[i-1])
+			}
+			if int(id) >= v.numName {
+				return ids, fmt.Errorf("file ID %d out of range (%d files)", id, v.numName)
+			}
+		}
+		return ids, nil
+	}
+
+	fileid := ^uint32(0)
+	for i := uint32(0); ; i++ {
+		delta, n := binary.Uvarint(d)
+		if n <= 0 {
+			return ids, fmt.Errorf("truncated after %d file IDs", i)
+		}
+		d = d[n:]
+		if delta == 0 {
+			if i != count {
+				return ids, fmt.Errorf("%d file IDs, want %d", i, count)
+			}
+			break
+		}
+		if i == count {
+			return ids, fmt.Errorf("more than %d file IDs", count)
+		}
+		if uint64(fileid+1)+delta > uint64(v.numName) {
+			return ids, fmt.Errorf("file ID %d out of range (%d files)", uint64(fileid+1)+delta-1, v.numName)
+		}
+		fileid += uint32(delta)
+		ids = append(ids, fileid)
+	}
+	if len(d) > 0 {
+		return ids, fmt.Errorf("%d unexpected bytes after list", len(d))
+	}
+	return ids, nil
+}
+
+// count returns the number of file IDs in the list.
+func (l *roaringList) count() int {
+	n := 0
+	for i := range l.c {
+		c := &l.c[i]
+		switch c.kind {
+		case roaringArray:
+			n += c.n
+		case roaringBitmap:
+			for _, b := range c.d {
+				n += bits.OnesCount8(b)
+			}
+		case roaringRuns:
+			for j := 0; j < c.n; j++ {
+				n += int(binary.BigEndian.Uint16(c.d[4*j+2:])) + 1
+			}
+		}
+	}
+	return n
+}
+
+// trigramString returns the trigram t as a string.
+func trigramString(t uint32) string {
+	return string([]byte{byte(t >> 16), byte(t >> 8), byte(t)})
+}
+
+// A sectionEntry is an entry in the section index.
+type sectionEntry struct {
+	name   string
+	at     uint32 // offset of the entry
+	off, n uint32
+}
+
+// verifySections checks the section index and the sections it lists.
+func (v *verifier) verifySections() {
+	var list []sectionEntry
+	secs := make(map[string]sectionEntry)
+	off := v.sectionIndex
+	for {
+		name, ok := v.str(off, v.trailer)
+		if !ok {
+			v.errorf(off, "section index runs into the trailer")
+			return
+		}
+		at := off
+		off += uint32(len(name) + 1)
+		if len(name) == 0 {
+			break
+		}
+		if off+8 > v.trailer {
+			v.errorf(at, "section index runs into the trailer")
+			return
+		}
+		s := sectionEntry{string(name), at, v.uint32(off), v.uint32(off + 4)}
+		off += 8
+		if s.off < off || s.off > v.trailer || s.n > v.trailer-s.off {
+			v.errorf(at, "section %q at offset %d, length %d, out of range [%d, %d]", name, s.off, s.n, off, v.trailer)
+			continue
+		}
+		if _, dup := secs[s.name]; dup {
+			v.errorf(at, "duplicate section %q", name)
+			continue
+		}
+		list = append(list, s)
+		secs[s.name] = s
+	}
+	v.sectionEnd = off
+	v.verifyChecksums(list)
+
+	data := func(name string) (uint32, []byte) {
+		s, ok := secs[name]
+		if !ok {
+			return 0, nil
+		}
+		return s.off, v.d[s.off : s.off+s.n]
+	}
+	names := func(name string) int {
+		off, d := data(name)
+		n := 0
+		for len(d) > 0 {
+			i := bytes.IndexByte(d, 0)
+			if i < 0 {
+				v.errorf(off, "%s section: name %d is not NUL-terminated", name, n)
+				break
+			}
+			d = d[i+1:]
+			off += uint32(i + 1)
+			n++
+		}
+		return n
+	}
+	numLang := names(langSection)
+	numRepo := names(repoSection)
+	names(excludeSection)
+	names(attachSection)
+	if names(normSection) > 1 {
+		off, _ := data(normSection)
+		v.errorf(off, "%s section: more than one name", normSection)
+	}
+	if names(gitRefSection) > 1 {
+		off, _ := data(gitRefSection)
+		v.errorf(off, "%s section: more than one name", gitRefSection)
+	}
+	if off, d := data(metaSection); d != nil {
+		v.verifyMeta(off, d, numLang, numRepo)
+	}
+	if off, d := data(symSection); d != nil {
+		v.verifySymbols(off, d)
+	}
+	if off, d := data(identSection); d != nil {
+		v.verifyIdents(off, d)
+	}
+	if off, d := data(contentSection); d != nil {
+		v.verifyContent(contentSection, off, d)
+	}
+	if off, d := data(regionSection); d != nil {
+		v.verifyContent(regionSection, off, d)
+	}
+	if off, d := data(stopSection); d != nil {
+		v.verifyStop(off, d)
+	}
+	if off, d := data(nameTrigramSection); d != nil {
+		v.verifyNameTrigrams(off, d)
+	}
+	if off, d := data(aliasSection); d != nil {
+		v.verifyAliases(off, d)
+	}
+}
+
+// verifyChecksums checks the checksums in the crc section, if any,
+// given the list of sections in the section index.
+func (v *verifier) verifyChecksums(list []sectionEntry) {
+	type part struct {
+		name       string
+		start, end uint32
+	}
+	var parts []part
+	ends := []uint32{v.nameData, v.postData, v.nameIndex, v.postIndex, v.sectionIndex, v.sectionEnd}
+	start := v.pathData
+	for i, end := range ends {
+		parts = append(parts, part{indexParts[i], start, end})
+		start = end
+	}
+	for _, s := range list {
+		if s.name != crcSection {
+			parts = append(parts, part{fmt.Sprintf("section %q", s.name), s.off, s.off + s.n})
+			continue
+		}
+		if s.n != uint32(4*len(parts)) {
+			v.errorf(s.at, "crc section length %d, want %d", s.n, 4*len(parts))
+			return
+		}
+		for i, p := range parts {
+			want := v.uint32(s.off + 4*uint32(i))
+			if sum := crc32.Checksum(v.d[p.start:p.end], castagnoli); sum != want {
+				v.errorf(p.start, "%s (%d bytes): checksum %#08x, want %#08x", p.name, p.end-p.start, sum, want)
+			}
+		}
+		return
+	}
+}
+
+// verifyMeta checks the meta section d, found at off.
+func (v *verifier) verifyMeta(off uint32, d []byte, numLang, numRepo int) {
+	if len(d) < 4 {
+		v.errorf(off, "meta section too short")
+		return
+	}
+	size := v.uint32(off)
+	if size < minMetaRecordSize {
+		v.errorf(off, "meta record size %d too small", size)
+		return
+	}
+	if want := 4 + uint64(size)*uint64(v.numName); uint64(len(d)) != want {
+		v.errorf(off, "meta section length %d, want %d for %d files", len(d), want, v.numName)
+		return
+	}
+	for i := 0; i < v.numName && !v.full(); i++ {
+		rec := off + 4 + uint32(i)*size
+		if lang := v.uint32(rec + 24); lang > uint32(numLang) {
+			v.errorf(rec, "file %d: language %d out of range (%d languages)", i, lang, numLang)
+		}
+		if size < metaRecordSize {
+			continue
+		}
+		if repo := v.uint32(rec + 28); repo > uint32(numRepo) {
+			v.errorf(rec, "file %d: repository %d out of range (%d repositories)", i, repo, numRepo)
+		}
+	}
+}
+
+// verifySymbols checks the sym section d, found at off.
+func (v *verifier) verifySymbols(off uint32, d []byte) {
+	if len(d) < 4 {
+		v.errorf(off, "sym section too short")
+		return
+	}
+	n := uint64(binary.BigEndian.Uint32(d))
+	if 4+4*n > uint64(len(d)) {
+		v.errorf(off, "sym section too short for %d symbols", n)
+		return
+	}
+	var prev []byte
+	for i := 0; i < int(n) && !v.full(); i++ {
+		so := binary.BigEndian.Uint32(d[4+4*i:])
+		if uint64(so) < 4+4*n || int(so) >= len(d) {
+			v.errorf(off+4+4*uint32(i), "symbol %d: offset %d out of range", i, so)
+			continue
+		}
+		e := d[so:]
+		j := bytes.IndexByte(e, 0)
+		if j < 0 {
+			v.errorf(off+so, "symbol %d: name is not NUL-terminated", i)
+			continue
+		}
+		name := e[:j]
+		if i > 0 && bytes.Compare(name, prev) <= 0 {
+			v.errorf(off+so, "symbol %q out of order after %q", name, prev)
+		}
+		prev = name
+		e = e[j+1:]
+		next := func() (uint64, bool) {
+			x, k := binary.Uvarint(e)
+			if k <= 0 {
+				return 0, false
+			}
+			e = e[k:]
+			return x, true
+		}
+		count, ok := next()
+		fileid := uint64(0)
+		for k := uint64(0); ok && k < count; k++ {
+			var delta uint64
+			if delta, ok = next(); ok {
+				fileid += delta
+				_, ok = next()
+			}
+			if ok && fileid >= uint64(v.numName) {
+				v.errorf(off+so, "symbol %q: file ID %d out of range (%d files)", name, fileid, v.numName)
+				break
+			}
+		}
+		if !ok {
+			v.errorf(off+so, "symbol %q: truncated definitions", name)
+		}
+	}
+}
+
+// verifyIdents checks the ident section d, found at off.
+func (v *verifier) verifyIdents(off uint32, d []byte) {
+	if len(d) < 4 {
+		v.errorf(off, "ident section too short")
+		return
+	}
+	n := uint64(binary.BigEndian.Uint32(d))
+	if 4+4*n > uint64(len(d)) {
+		v.errorf(off, "ident section too short for %d words", n)
+		return
+	}
+	var prev []byte
+	for i := 0; i < int(n) && !v.full(); i++ {
+		wo := binary.BigEndian.Uint32(d[4+4*i:])
+		if uint64(wo) < 4+4*n || int(wo) >= len(d) {
+			v.errorf(off+4+4*uint32(i), "identifier word %d: offset %d out of range", i, wo)
+			continue
+		}
+		e := d[wo:]
+		j := bytes.IndexByte(e, 0)
+		if j < 0 {
+			v.errorf(off+wo, "identifier word %d: not NUL-terminated", i)
+			continue
+		}
+		word := e[:j]
+		if i > 0 && bytes.Compare(word, prev) <= 0 {
+			v.errorf(off+wo, "identifier word %q out of order after %q", word, prev)
+		}
+		prev = word
+		e = e[j+1:]
+		count, k := binary.Uvarint(e)
+		ok := k > 0
+		fileid := uint64(0)
+		for x := uint64(0); ok && x < count; x++ {
+			e = e[k:]
+			var delta uint64
+			delta, k = binary.Uvarint(e)
+			if ok = k > 0; !ok {
+				break
+			}
+			if x > 0 && delta == 0 {
+				v.errorf(off+wo, "identifier word %q: file ID %d listed twice", word, fileid)
+				break
+			}
+			if fileid += delta; fileid >= uint64(v.numName) {
+				v.errorf(off+wo, "identifier word %q: file ID %d out of range (%d files)", word, fileid, v.numName)
+				break
+			}
+		}
+		if !ok {
+			v.errorf(off+wo, "identifier word %q: truncated file list", word)
+		}
+	}
+}
+
+// verifyContent checks the named section d, found at off,
+// which has the layout of the content section.
+func (v *verifier) verifyContent(name string, off uint32, d []byte) {
+	if len(d) < 4 {
+		v.errorf(off, "%s section too short", name)
+		return
+	}
+	if n := binary.BigEndian.Uint32(d); n != uint32(v.numName) {
+		v.errorf(off, "%s section lists %d files, want %d", name, n, v.numName)
+		return
+	}
+	start := 4 + 4*(uint64(v.numName)+1)
+	if start > uint64(len(d)) {
+		v.errorf(off, "%s section too short for %d files", name, v.numName)
+		return
+	}
+	prev := uint32(start)
+	for i := 0; i <= v.numName && !v.full(); i++ {
+		o := binary.BigEndian.Uint32(d[4+4*i:])
+		if o < prev || int(o) > len(d) {
+			v.errorf(off+4+4*uint32(i), "file %d: %s offset %d out of range [%d, %d]", i, name, o, prev, len(d))
+			return
+		}
+		prev = o
+	}
+	if int(prev) != len(d) {
+		v.errorf(off+prev, "%s section: %d unexpected bytes after contents", name, len(d)-int(prev))
+	}
+}
+
+// verifyNameTrigrams checks the nametri section d, found at off.
+func (v *verifier) verifyNameTrigrams(off uint32, d []byte) {
+	if len(d) < 4 {
+		v.errorf(off, "nametri section too short")
+		return
+	}
+	n := binary.BigEndian.Uint32(d)
+	if uint64(len(d)) < 4+uint64(n)*postEntrySize {
+		v.errorf(off, "nametri section: %d index entries do not fit in %d bytes", n, len(d))
+		return
+	}
+	entry := func(i uint32) (trigram, count, offset uint32) {
+		e := d[4+i*postEntrySize:]
+		return uint32(e[0])<<16 | uint32(e[1])<<8 | uint32(e[2]), binary.BigEndian.Uint32(e[3:]), binary.BigEndian.Uint32(e[7:])
+	}
+	var ids []uint32
+	want := 4 + n*postEntrySize
+	for i := uint32(0); i < n && !v.full(); i++ {
+		ent := off + 4 + i*postEntrySize
+		trigram, count, o := entry(i)
+		if i > 0 {
+			if t, _, _ := entry(i - 1); trigram <= t {
+				v.errorf(ent, "nametri index entry %d: trigram %q out of order after %q", i, trigramString(trigram), trigramString(t))
+			}
+		}
+		if o != want {
+			v.errorf(ent, "nametri index entry %d: offset %d, want %d", i, o, want)
+			return
+		}
+		next := uint32(len(d))
+		if i+1 < n {
+			_, _, next = entry(i + 1)
+			if next <= o || next > uint32(len(d)) {
+				v.errorf(ent+postEntrySize, "nametri index entry %d: offset %d out of range (%d, %d]", i+1, next, o, len(d))
+				return
+			}
+		}
+		var err error
+		if ids, err = v.postingList(ids[:0], d[o:next], count); err != nil {
+			v.errorf(off+o, "nametri posting list for %q: %v", trigramString(trigram), err)
+		}
+		want = next
+	}
+	if want != uint32(len(d)) && !v.full() {
+		v.errorf(off+want, "%d unexpected bytes after nametri posting lists", uint32(len(d))-want)
+	}
+}
+
+// verifyAliases checks the alias section d, found at off.
+func (v *verifier) verifyAliases(off uint32, d []byte) {
+	if len(d)%8 != 0 {
+		v.errorf(off, "alias section length %d is not a multiple of 8", len(d))
+		return
+	}
+	aliases := make(map[uint32]bool)
+	prev := int64(-1)
+	for i := 0; i < len(d) && !v.full(); i += 8 {
+		alias, canon := binary.BigEndian.Uint32(d[i:]), binary.BigEndian.Uint32(d[i+4:])
+		switch {
+		case int64(alias) <= prev:
+			v.errorf(off+uint32(i), "alias %d out of order after %d", alias, prev)
+		case alias >= uint32(v.numName):
+			v.errorf(off+uint32(i), "alias %d out of range [0, %d)", alias, v.numName)
+		case canon >= alias:
+			v.errorf(off+uint32(i), "alias %d: canonical file %d does not come before it", alias, canon)
+		case aliases[canon]:
+			v.errorf(off+uint32(i), "alias %d: canonical file %d is an alias itself", alias, canon)
+		}
+		aliases[alias] = true
+		prev = int64(alias)
+	}
+}
+
+// verifyStop checks the stop section d, found at off.
+func (v *verifier) verifyStop(off uint32, d []byte) {
+	if len(d) < 8 || (len(d)-8)%3 != 0 {
+		v.errorf(off, "stop section length %d is not 8 plus a multiple of 3", len(d))
+		return
+	}
+	if f := math.Float64frombits(binary.BigEndian.Uint64(d)); !(f > 0) {
+		v.errorf(off, "stop fraction %g is not positive", f)
+	}
+	prev := -1
+	for i := 8; i < len(d) && !v.full(); i += 3 {
+		t := int(d[i])<<16 | int(d[i+1])<<8 | int(d[i+2])
+		if t <= prev {
+			v.errorf(off+uint32(i), "stop trigram %q out of order after %q", trigramString(uint32(t)), trigramString(uint32(prev)))
+		}
+		prev = t
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dense := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		dense[fmt.Sprintf("/a/%05d", i)] = "common text\n"
+	}
+	builds := []struct {
+		name  string
+		build func(file string)
+	}{
+		{"trivial", func(file string) { buildIndex(file, nil, trivialFiles) }},
+		{"compressed", func(file string) { buildIndexWith(file, []string{"/src"}, compressFiles(200), compressed) }},
+		{"roaring", func(file string) { buildIndex(file, []string{"/a"}, dense) }},
+		{"merged", func(file string) {
+			f1, _ := ioutil.TempFile("", "index-test")
+			f2, _ := ioutil.TempFile("", "index-test")
+			defer os.Remove(f1.Name())
+			defer os.Remove(f2.Name())
+			buildIndex(f1.Name(), []string{"/a"}, dense)
+			buildIndex(f2.Name(), []string{"/src"}, compressFiles(200))
+			Merge(file, f1.Name(), f2.Name())
+		}},
+	}
+	for _, b := range builds {
+		f, _ := ioutil.TempFile("", "index-test")
+		f.Close()
+		defer os.Remove(f.Name())
+		b.build(f.Name())
+		if err := Verify(f.Name()); err != nil {
+			t.Errorf("%s: Verify: %v", b.name, err)
+		}
+	}
+}
+
+// Offsets of parts of trivialIndex.
+const (
+	offPostLists = 16 + 1 + 38
+	offPostIndex = offPostLists + 62 + 28
+	offMeta      = offPostIndex + 132 + 52
+	offTrailer   = offMeta + 4 + 6*32 + 9*4
+)
+
+var verifyTests = []struct {
+	off  int    // offset in trivialIndex
+	data string // data to write at off
+	want string // expected problem
+}{
+	{0, "CSEARCH", `offset 0: bad header "CSEARCH index 3\n"`},
+	{len(trivialIndex) - 7, "TRAILR", `bad trailer "\ncsearch TRAILR\n"`},
+	{offTrailer + 12, u32(1000), "offset 573: name index offset 1000 out of range [55, 561]"},
+	{17, "z", `offset 24: file 1: name "f0" out of order after "zfile4"`},
+	{offPostIndex + 11 + 7, "\xff", "offset 156: posting list index entry 1: offset 4278190085 out of range (3, 62]"},
+	{offPostIndex + 11 + 1, "zz", `posting list index entry 2: trigram "\nda" out of order after "\nzz"`},
+	{offPostLists + 5 + 4, "\x40", `offset 60: posting list for "\nab": file ID 67 out of range (6 files)`},
+	{offPostLists + 5 + 5, "\x01", `posting list for "\nab": more than 2 file IDs`},
+	{17 + 7 + 3 + 6 + 4, "4", "offset 17: name list (38 bytes): checksum"},
+	{offMeta + 4 + 24, u32(1), "offset 333: file 0: language 1 out of range (0 languages)"},
+	{offMeta, u32(31), "meta section length 196, want 190 for 6 files"},
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	f.Close()
+	defer os.Remove(f.Name())
+	for _, tt := range verifyTests {
+		data := []byte(trivialIndex)
+		copy(data[tt.off:], tt.data)
+		if err := ioutil.WriteFile(f.Name(), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		err := Verify(f.Name())
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("writing %q at %d: Verify = %v, want %q", tt.data, tt.off, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSkipPrefixes and DefaultSkipSuffixes are the beginnings and
+// endings of the names of files that are usually hidden or temporary:
+// dot files and the backup and autosave files of editors.
+var (
+	DefaultSkipPrefixes = []string{".", "#", "~"}
+	DefaultSkipSuffixes = []string{"~"}
+)
+
+// AddTree adds the regular files in the file tree rooted at root
+// to the index, visiting them in lexical order.  Files and directories
+// for which ix.Skip returns true are not indexed, nor are those ignored
+// by .gitignore files if ix.UseGitignore is set or by .csearchignore
+// files if ix.UseCsearchignore is set, nor, if ix.GitTracked
+// is set, those that git does not track.  If ix.Archives is
+// set, AddTree indexes the members of archives using AddArchive.
+// Hidden files, as decided by ix.SkipPrefixes and ix.SkipSuffixes, are
+// skipped, and so are symbolic links unless ix.FollowSymlinks is set,
+// and the symbolic links that Bazel leaves in workspaces even if it is.
+// Finally, files for which ix.Filter returns true are skipped.
+// It logs errors using package slog.
+func (ix *IndexWriter) AddTree(root string) {
+	if ix.FollowSymlinks && ix.seen == nil {
+		ix.seen = newWalkSeen()
+	}
+	ix.walk(root, true, ix.seen, func(path string, info os.FileInfo) {
+		if ix.filtered(path, info) {
+			ix.finished(path, info.Size())
+			return
+		}
+		if ix.Archives && IsArchive(path) {
+			ix.AddArchive(path)
+			ix.finished(path, info.Size())
+			return
+		}
+		ix.addFile(path, info.Size())
+	})
+}
+
+// CountTree returns the number and total size of the files in the
+// tree rooted at root that AddTree would consider adding to the index,
+// for use in estimating the progress of AddTree (see Progress).
+// The count includes files that AddTree will read but then skip
+// because they do not look like text.
+func (ix *IndexWriter) CountTree(root string) (files int, bytes int64) {
+	if ix.FollowSymlinks && ix.countSeen == nil {
+		ix.countSeen = newWalkSeen()
+	}
+	ix.counting = true
+	defer func() { ix.counting = false }()
+	ix.walk(root, false, ix.countSeen, func(path string, info os.FileInfo) {
+		files++
+		bytes += info.Size()
+	})
+	return files, bytes
+}
+
+// walk calls f for each regular file in the tree rooted at root
+// that is not to be skipped, in lexical order.
+// If logErrors is set, walk logs errors using package slog.
+// If ix.FollowSymlinks is set, walk follows symbolic links, recording
+// the files and directories it visits in seen; otherwise seen is nil.
+func (ix *IndexWriter) walk(root string, logErrors bool, seen *walkSeen, f func(path string, info os.FileInfo)) {
+	if ix.UseGitignore && ix.gitignore == nil {
+		ix.gitignore = NewGitignore()
+	}
+	if ix.UseCsearchignore && ix.csearchignore == nil {
+		ix.csearchignore = NewCsearchignore()
+	}
+	ix.root = root
+	ix.tracked = nil
+	if ix.GitTracked {
+		t, err := listTracked(root, ix.GitSubmodules)
+		if err != nil {
+			if logErrors {
+				slog.Warn("cannot list git files", "path", root, "error", err)
+			}
+			return
+		}
+		ix.tracked = t
+	}
+	if seen != nil {
+		ix.walkFollow(root, seen, nil, logErrors, f)
+		return
+	}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if info != nil && ix.skip(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err != nil {
+			if logErrors {
+				slog.Warn("cannot read", "path", path, "error", err)
+			}
+			return nil
+		}
+		if info != nil && info.Mode()&os.ModeType == 0 {
+			f(path, info)
+		}
+		return nil
+	})
+}
+
+// A walkSeen records the files and directories visited by walks
+// that follow symbolic links.
+type walkSeen struct {
+	keys map[fileKey]bool
+}
+
+func newWalkSeen() *walkSeen {
+	return &walkSeen{keys: make(map[fileKey]bool)}
+}
+
+// visit records that the walk has reached info, reporting
+// whether it had already been reached under another name.
+// If the system does not identify files, visit reports false.
+func (s *walkSeen) visit(info os.FileInfo) bool {
+	key, ok := statKey(info)
+	if !ok {
+		return false
+	}
+	if s.keys[key] {
+		return true
+	}
+	s.keys[key] = true
+	return false
+}
+
+// walkFollow is walk for FollowSymlinks.  It follows symbolic links
+// to files and directories and visits each file or directory once,
+// however many names it has, under the first name it reaches in
+// lexical order.  The first name of a file counts even if the file is
+// then skipped, so that a file skipped because it is already indexed
+// under that name is not indexed again under another one.  Parents
+// lists the directories enclosing path, for finding cycles on systems
+// where visit cannot.
+func (ix *IndexWriter) walkFollow(path string, seen *walkSeen, parents []os.FileInfo, logErrors bool, f func(path string, info os.FileInfo)) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if logErrors {
+			slog.Warn("cannot read", "path", path, "error", err)
+		}
+		return
+	}
+	switch {
+	case info.Mode().IsRegular():
+		if seen.visit(info) {
+			ix.logSkip(path, SkipDuplicate)
+			return
+		}
+		if !ix.skip(path, info) {
+			f(path, info)
+		}
+	case info.IsDir():
+		if ix.skip(path, info) {
+			return
+		}
+		if seen.visit(info) {
+			ix.logSkip(path, SkipDuplicate)
+			return
+		}
+		for _, p := range parents {
+			if os.SameFile(p, info) {
+				ix.logSkip(path, SkipSymlinkCycle)
+				return
+			}
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil && logErrors {
+			slog.Warn("cannot read", "path", path, "error", err)
+		}
+		parents = append(parents, info)
+		for _, e := range entries {
+			ix.walkFollow(filepath.Join(path, e.Name()), seen, parents, logErrors, f)
+		}
+	}
+}
+
+// Hidden reports whether name, the final element of the name of a file
+// or directory, begins with one of ix.SkipPrefixes or ends with one of
+// ix.SkipSuffixes.
+func (ix *IndexWriter) Hidden(name string) bool {
+	for _, p := range ix.SkipPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	for _, s := range ix.SkipSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipEntry reports whether to skip the file or directory name, read
+// from a git tree or an archive, because ix.Skip rejects it, it is
+// hidden, or, for a file, ix.Filter rejects it.
+func (ix *IndexWriter) skipEntry(name string, info os.FileInfo) bool {
+	return ix.Skip != nil && ix.Skip(name, info) || ix.Hidden(info.Name()) ||
+		!info.IsDir() && ix.filtered(name, info)
+}
+
+// filtered reports whether ix.Filter rejects the file path.
+func (ix *IndexWriter) filtered(path string, info os.FileInfo) bool {
+	if ix.Filter != nil && ix.Filter(path, info) {
+		ix.logSkip(path, SkipFiltered)
+		return true
+	}
+	return false
+}
+
+// skip reports whether AddTree should skip the file or directory path.
+func (ix *IndexWriter) skip(path string, info os.FileInfo) bool {
+	if ix.Skip != nil && ix.Skip(path, info) {
+		return true
+	}
+	if path != ix.root && ix.Hidden(info.Name()) {
+		ix.logSkip(path, SkipHidden)
+		return true
+	}
+	if path != ix.root && isBazelLink(path) {
+		ix.logSkip(path, SkipBazelLink)
+		return true
+	}
+	if ix.gitignore != nil && ix.gitignore.Ignored(path, info.IsDir()) {
+		ix.logSkip(path, SkipGitignored)
+		return true
+	}
+	if ix.csearchignore != nil && ix.csearchignore.Ignored(path, info.IsDir()) {
+		ix.logSkip(path, SkipCsearchignored)
+		return true
+	}
+	if ix.tracked != nil && !ix.tracked.has(path, info.IsDir()) {
+		ix.logSkip(path, SkipUntracked)
+		return true
+	}
+	return false
+}
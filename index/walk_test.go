@@ -0,0 +1,304 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// dir/
+	//	a/x		file
+	//	a/loop -> .	cycle
+	//	b -> a		same tree again
+	//	c/y -> ../a/x	same file again
+	//	d -> ../ext	tree reachable only by link
+	//	e/z		hard link to a/x
+	// ext/w		file
+	ext := dir + "-ext"
+	defer os.RemoveAll(ext)
+	for _, d := range []string{"a", "c", "e"} {
+		os.MkdirAll(filepath.Join(dir, d), 0777)
+	}
+	os.MkdirAll(ext, 0777)
+	write := func(name, data string) {
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(dir, "a/x"), "hello world\n")
+	write(filepath.Join(ext, "w"), "goodbye world\n")
+	links := [][2]string{
+		{".", "a/loop"},
+		{"a", "b"},
+		{"../a/x", "c/y"},
+		{ext, "d"},
+	}
+	for _, l := range links {
+		if err := os.Symlink(l[0], filepath.Join(dir, l[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(dir, "a/x"), filepath.Join(dir, "e/z")); err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(follow bool) []string {
+		out := dir + ".ix"
+		defer os.Remove(out)
+		ix := Create(out)
+		ix.FollowSymlinks = follow
+		if follow {
+			if files, _ := ix.CountTree(dir); files != 2 {
+				t.Errorf("CountTree = %d files, want 2", files)
+			}
+		}
+		ix.AddPaths([]string{dir})
+		ix.AddTree(dir)
+		ix.Flush()
+		r := Open(out)
+		defer r.Close()
+		var names []string
+		for i := 0; i < r.NumFiles(); i++ {
+			name, _ := filepath.Rel(dir, r.Name(uint32(i)))
+			names = append(names, filepath.ToSlash(name))
+		}
+		return names
+	}
+
+	if names, want := build(false), []string{"a/x", "e/z"}; !equalStrings(names, want) {
+		t.Errorf("without FollowSymlinks, indexed %q, want %q", names, want)
+	}
+	if names, want := build(true), []string{"a/x", "d/w"}; !equalStrings(names, want) {
+		t.Errorf("with FollowSymlinks, indexed %q, want %q", names, want)
+	}
+}
+
+func TestGitTracked(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	work := filepath.Join(dir, "work")
+	for _, d := range []string{"src", "build", "empty"} {
+		os.MkdirAll(filepath.Join(work, d), 0777)
+	}
+	files := []string{"a.go", "src/b.go", "src/new.go", "build/out.go", "empty/c.go"}
+	for _, name := range files {
+		if err := ioutil.WriteFile(filepath.Join(work, name), []byte("hello world\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitCmd(t, work, "init", "-q")
+	gitCmd(t, work, "add", "a.go", "src/b.go")
+
+	build := func(root string) []string {
+		out := dir + ".ix"
+		defer os.Remove(out)
+		ix := Create(out)
+		ix.GitTracked = true
+		ix.AddPaths([]string{root})
+		ix.AddTree(root)
+		ix.Flush()
+		r := Open(out)
+		defer r.Close()
+		var names []string
+		for i := 0; i < r.NumFiles(); i++ {
+			name, _ := filepath.Rel(work, r.Name(uint32(i)))
+			names = append(names, filepath.ToSlash(name))
+		}
+		return names
+	}
+
+	ix := &IndexWriter{GitTracked: true}
+	if files, _ := ix.CountTree(work); files != 2 {
+		t.Errorf("CountTree = %d files, want 2", files)
+	}
+	if names, want := build(work), []string{"a.go", "src/b.go"}; !equalStrings(names, want) {
+		t.Errorf("AddTree(work) indexed %q, want %q", names, want)
+	}
+	if names, want := build(filepath.Join(work, "src")), []string{"src/b.go"}; !equalStrings(names, want) {
+		t.Errorf("AddTree(work/src) indexed %q, want %q", names, want)
+	}
+	if names := build(filepath.Join(work, "src/new.go")); len(names) != 0 {
+		t.Errorf("AddTree(work/src/new.go) indexed %q, want nothing", names)
+	}
+	if names := build(dir); len(names) != 0 {
+		t.Errorf("AddTree outside a checkout indexed %q, want nothing", names)
+	}
+}
+
+func TestHidden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, ".root")
+	os.MkdirAll(filepath.Join(root, ".github"), 0777)
+	for _, name := range []string{"a.go", ".github/w.yml", "#a.go#", "a.go~", ".env"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte("hello world\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := func(prefixes []string) []string {
+		out := dir + ".ix"
+		defer os.Remove(out)
+		ix := Create(out)
+		ix.SkipPrefixes = prefixes
+		ix.SkipSuffixes = DefaultSkipSuffixes
+		ix.AddPaths([]string{root})
+		ix.AddTree(root)
+		ix.Flush()
+		r := Open(out)
+		defer r.Close()
+		var names []string
+		for i := 0; i < r.NumFiles(); i++ {
+			name, _ := filepath.Rel(root, r.Name(uint32(i)))
+			names = append(names, filepath.ToSlash(name))
+		}
+		return names
+	}
+
+	if names, want := build(DefaultSkipPrefixes), []string{"a.go"}; !equalStrings(names, want) {
+		t.Errorf("with default prefixes, indexed %q, want %q", names, want)
+	}
+	if names, want := build([]string{"#", "~"}), []string{".env", ".github/w.yml", "a.go"}; !equalStrings(names, want) {
+		t.Errorf("indexing dot files, indexed %q, want %q", names, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "src", "secret"), 0777)
+	for _, name := range []string{"src/a.go", "src/b.go", "src/secret/c.go"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("hello world\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "ix")
+	ix := Create(out)
+	root := filepath.Join(dir, "src")
+	var called []string
+	ix.Filter = func(path string, info os.FileInfo) bool {
+		if info.IsDir() {
+			t.Errorf("Filter called for directory %s", path)
+		}
+		name, _ := filepath.Rel(root, path)
+		name = filepath.ToSlash(name)
+		called = append(called, name)
+		return name == "b.go" || name == "secret/c.go"
+	}
+	var progress []string
+	ix.Progress = func(name string, size int64) {
+		progress = append(progress, name)
+	}
+	if files, _ := ix.CountTree(root); files != 3 || len(called) != 0 {
+		t.Errorf("CountTree = %d files, called Filter for %q, want 3, none", files, called)
+	}
+	ix.AddPaths([]string{root})
+	ix.AddTree(root)
+	ix.Flush()
+	if want := []string{"a.go", "b.go", "secret/c.go"}; !equalStrings(called, want) {
+		t.Errorf("Filter called for %q, want %q", called, want)
+	}
+	if len(progress) != 3 {
+		t.Errorf("Progress called for %q, want all 3 files", progress)
+	}
+	r := Open(out)
+	defer r.Close()
+	if n := r.NumFiles(); n != 1 || filepath.Base(r.Name(0)) != "a.go" {
+		t.Errorf("indexed %d files, want only a.go", n)
+	}
+}
+
+func TestOnSkip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(root, ".git"), 0777)
+	os.MkdirAll(filepath.Join(root, "vendor"), 0777)
+	files := map[string]string{
+		"a.go":        "hello world\n",
+		"long.txt":    strings.Repeat("x", 100) + "\n",
+		".git/config": "[core]\n",
+		"vendor/v.go": "hello world\n",
+	}
+	for name, text := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "ix")
+	ix := Create(out)
+	ix.SkipPrefixes = DefaultSkipPrefixes
+	ix.MaxLineLen = 50
+	ix.Skip = func(path string, info os.FileInfo) bool {
+		if info.IsDir() && filepath.Base(path) == "vendor" {
+			ix.ReportSkip(path, SkipExcluded)
+			return true
+		}
+		return false
+	}
+	ix.SetConcurrency(2)
+	skipped := make(map[string]SkipReason)
+	ix.OnSkip = func(path string, reason SkipReason) {
+		name, _ := filepath.Rel(root, path)
+		skipped[filepath.ToSlash(name)] = reason
+	}
+	if files, _ := ix.CountTree(root); files != 2 || len(skipped) != 0 {
+		t.Errorf("CountTree = %d files, reported skips %v, want 2, none", files, skipped)
+	}
+	ix.AddPaths([]string{root})
+	ix.AddTree(root)
+	ix.Flush()
+
+	want := map[string]SkipReason{
+		".git":     SkipHidden,
+		"vendor":   SkipExcluded,
+		"long.txt": SkipLongLines,
+	}
+	if len(skipped) != len(want) {
+		t.Errorf("reported skips %v, want %v", skipped, want)
+	}
+	for name, reason := range want {
+		if skipped[name] != reason {
+			t.Errorf("%s: reported skip %q, want %q", name, skipped[name], reason)
+		}
+	}
+}
@@ -5,11 +5,23 @@
 package index
 
 import (
+	"bufio"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/google/codesearch/sparse"
@@ -26,50 +38,288 @@ import (
 // create the final posting lists by merging the temporary files as we
 // read them back in.
 //
-// It would also be useful to be able to create an index for a subset
-// of the files and then merge that index into an existing one.  This would
-// allow incremental updating of an existing index when a directory changes.
-// But we have not implemented that.
+// To update an existing index incrementally, cindex creates an index for
+// just the files that have changed and then merges it into the existing
+// one using Update (see merge.go).  The per-file metadata recorded in
+// the index tells cindex which files have changed.
+//
+// An IndexWriter created by NewMemWriter keeps everything in memory
+// instead, including the index itself, so that it never touches the
+// disk except to read the files being indexed.
 
 // An IndexWriter creates an on-disk index corresponding to a set of files.
 type IndexWriter struct {
 	LogSkip bool // log information about skipped files
-	Verbose bool // log status using package log
-
-	trigram *sparse.Set // trigrams for the current file
-	buf     [8]byte     // scratch buffer
+	Verbose bool // log status using package slog
+
+	// OnSkip, if non-nil, is called for each file or directory that
+	// the writer skips, with the reason why (see skip.go).  Calls are
+	// made one at a time, even when files are scanned concurrently.
+	OnSkip func(path string, reason SkipReason)
+
+	// Options for AddTree.
+	UseGitignore     bool                                     // skip files ignored by .gitignore files
+	UseCsearchignore bool                                     // skip files ignored by .csearchignore files
+	Skip             func(path string, info os.FileInfo) bool // if non-nil, reports files and directories to skip
+	Archives         bool                                     // index the members of archives (see archive.go)
+
+	// Filter, if non-nil, is consulted for each file that AddTree,
+	// AddGitTree, or AddArchive would otherwise index, after the other
+	// checks, and the file is skipped if it returns true.  Unlike Skip,
+	// it is never called for directories, nor by CountTree, so it may
+	// take its time, as when it asks another program.
+	Filter func(path string, info os.FileInfo) (skip bool)
+
+	// FollowSymlinks causes AddTree to follow symbolic links to files
+	// and directories.  A file or directory reachable by several
+	// names, through symbolic or hard links, is indexed only once,
+	// under the first of its names that AddTree reaches.
+	FollowSymlinks bool
+
+	// SkipPrefixes and SkipSuffixes list the beginnings and endings
+	// of the names of hidden or temporary files and directories, which
+	// AddTree, AddGitTree, and AddArchive skip, as with "." for dot
+	// files.  The root of a tree given to AddTree is never skipped
+	// this way.  Cindex uses DefaultSkipPrefixes and DefaultSkipSuffixes.
+	SkipPrefixes []string
+	SkipSuffixes []string
+
+	// GitTracked causes AddTree to index only the files tracked by
+	// git in the checkout holding the tree (see tracked.go), along
+	// with those in submodules if GitSubmodules is also set.
+	GitTracked    bool
+	GitSubmodules bool
+
+	// Progress, if non-nil, is called as AddTree finishes with each
+	// file, in the order the files were added, with the file's name
+	// and size, whether or not the file turned out to be worth
+	// indexing.  See also CountTree.
+	Progress func(name string, size int64)
+
+	// Limits used to decide whether a file is text, and so worth
+	// indexing.  A zero limit selects the default (see maxFileLen,
+	// maxLineLen, and maxTextTrigrams), and a negative one disables
+	// the check.  Files containing invalid UTF-8 are skipped unless
+	// AllowInvalidUTF8 is set.
+	MaxFileLen       int64 // maximum file length in bytes
+	MaxLineLen       int   // maximum line length in bytes
+	MaxTextTrigrams  int   // maximum number of distinct trigrams
+	AllowInvalidUTF8 bool
+
+	// ChunkLen, if positive, causes the writer to index files longer
+	// than MaxFileLen instead of skipping them, scanning them in
+	// segments of ChunkLen bytes.  The limit on distinct trigrams then
+	// applies to the new trigrams found in each segment rather than to
+	// the whole file, so that huge generated files, whose every part
+	// looks like text, remain searchable.  The file is indexed under its
+	// own name, with the trigrams of all its segments.
+	ChunkLen int64
+
+	// Symbols causes the writer to record the symbols defined
+	// in each file, for use by LookupSymbol and MatchSymbols.
+	Symbols bool
+
+	// Identifiers causes the writer to record the words of the
+	// identifiers in the code of each file, for use by
+	// IdentifierFiles (see ident.go).
+	Identifiers bool
+
+	// Regions causes the writer to record the comments and string
+	// literals in each file, for use by Index.Regions (see region.go).
+	// It must be set before any files are added.
+	Regions bool
+
+	// Excludes, if non-nil, lists patterns describing the files
+	// excluded from the index, to be recorded in the index and
+	// returned by Index.Excludes.  The writer does not use them.
+	Excludes []string
+
+	// StoreContent causes the writer to store the text of each file
+	// in the index, for use by Index.Content (see content.go).
+	// It must be set before any files are added.
+	StoreContent bool
+
+	// Compress causes the writer to compress the list of file names
+	// with zstd, producing a smaller version 4 index (see compress.go).
+	// It must be set before any files are added.
+	Compress bool
+
+	// StopFraction, if positive, causes the writer to omit the
+	// posting lists of trigrams found in more than that fraction
+	// of the files, recording them as stop trigrams (see stop.go).
+	StopFraction float64
+
+	// NameTrigrams causes the writer to record the trigrams of the
+	// file names, so that searches limited to files with names matching
+	// a regexp can use them to narrow the files to search (see
+	// nametrigram.go and Index.PostingQueryNames).
+	NameTrigrams bool
+
+	// GitRef, if non-empty, records in the index that it holds
+	// the files of that git revision, as returned by Index.GitRef.
+	// The writer does not use it.
+	GitRef string
+
+	// Normalize causes the writer to index the text of each file in
+	// Unicode normalization form NFC, so that searches match accented
+	// letters however they are written (see normalize.go).  Stored
+	// contents and symbols are normalized too.
+	Normalize bool
+
+	// Dedupe causes the writer to give a file with the same text as
+	// one added earlier no posting entries of its own, recording it as
+	// an alias of the earlier file instead (see dedupe.go).
+	Dedupe bool
+
+	// CheckpointBytes and Checkpoint, if both set, cause the writer to
+	// write a checkpoint after each CheckpointBytes bytes of files it
+	// adds, so that a long build that dies need not start over (see
+	// checkpoint.go).  They must be set before any files are added.
+	CheckpointBytes int64
+	Checkpoint      func(file, last string)
+
+	// MaxMem, if positive, bounds the memory the writer uses for the
+	// posting entries of the files added, in bytes.  The writer sorts
+	// the entries in batches, spilling each batch to a temporary file,
+	// and merges the files, a bounded number at a time, to write the
+	// posting lists.  The default is 256 MB.  The bound does not count
+	// the 64 MB trigram set of each scanner (see SetConcurrency) or the
+	// symbols and identifiers, which the writer holds in memory.
+	MaxMem int64
+
+	// Partial marks the index as one part of a larger index to be
+	// assembled by merging, as when resuming a build from a checkpoint.
+	// The writer records StopFraction in it but leaves choosing the
+	// stop trigrams to the merges, which see all the files.
+	// Writing a checkpoint sets Partial.
+	Partial bool
+
+	gitignore     *Gitignore
+	csearchignore *Gitignore
+	tracked       *gitTracked // files tracked by git in the tree being walked
+	root          string      // root of the tree being walked
+	seen          *walkSeen   // files and directories visited by AddTree
+	countSeen     *walkSeen   // files and directories visited by CountTree
+	counting      bool        // CountTree is walking
+	skipMu        sync.Mutex  // serializes calls to OnSkip
+	repos         []pathRepo  // repositories set by SetRepo
+
+	scan *scanner // scanner for files added by the calling goroutine
+	buf  [8]byte  // scratch buffer
+
+	work *workers // concurrent scanners, if any
 
 	paths []string
 
-	nameData   *bufWriter // temp file holding list of names
-	nameLen    uint32     // number of bytes written to nameData
-	nameIndex  *bufWriter // temp file holding name index
-	numName    int        // number of names written
+	nameData   *bufWriter         // temp file holding list of names
+	nameIndex  *bufWriter         // temp file holding name index
+	names      *nameListWriter    // writes nameData and nameIndex
+	meta       *metaWriter        // temp files holding meta and lang sections
+	syms       *symWriter         // symbol definitions, if Symbols is set
+	idents     *identWriter       // identifier words, if Identifiers is set
+	nameTris   *nameTrigramWriter // trigrams of names, if NameTrigrams is set
+	content    *contentWriter     // stored contents, if StoreContent is set
+	regions    *contentWriter     // regions, if Regions is set
+	numName    int                // number of names written
 	totalBytes int64
+	checkBytes int64 // bytes added since the last checkpoint
+
+	dupes   map[dupeKey]uint32 // first file with each text, if Dedupe is set
+	aliases [][2]uint32        // alias and canonical file IDs, if Dedupe is set
 
 	post      []postEntry // list of (trigram, file#) pairs
+	stop      []uint32    // stop trigrams, if StopFraction is set
 	postFile  []*os.File  // flushed post entries
 	postIndex *bufWriter  // temp file holding posting list index
 
-	inbuf []byte     // input buffer
-	main  *bufWriter // main index file
+	main   *bufWriter // temp file holding main index, renamed to file by Flush
+	file   string     // index file
+	unlock func()     // releases the lock on file
+	mem    bool       // index in memory (see NewMemWriter)
 }
 
 const npost = 64 << 20 / 8 // 64 MB worth of post entries
 
+// defaultMaxMem is the memory used for post entries if MaxMem is not set:
+// a quarter each for the entries and for sorting them, and half for
+// merging them, as in maxPost and maxRuns.
+const defaultMaxMem = 4 * npost * 8
+
 // Create returns a new IndexWriter that will write the index to file.
+// Create locks the index, waiting for any other writer to finish,
+// and Flush replaces file with the new index and releases the lock.
 func Create(file string) *IndexWriter {
+	unlock := Lock(file)
 	return &IndexWriter{
-		trigram:   sparse.NewSet(1 << 24),
+		scan:      newScanner(),
 		nameData:  bufCreate(""),
 		nameIndex: bufCreate(""),
+		meta:      newMetaWriter(false),
+		syms:      newSymWriter(false),
+		idents:    newIdentWriter(false),
 		postIndex: bufCreate(""),
-		main:      bufCreate(file),
-		post:      make([]postEntry, 0, npost),
-		inbuf:     make([]byte, 16384),
+		main:      bufCreateTemp(file),
+		file:      file,
+		unlock:    unlock,
+	}
+}
+
+// NewMemWriter returns a new IndexWriter that builds the index in
+// memory, without creating any files, as for tests or for indexing a
+// small tree on the fly.  After Flush, Bytes returns the index, which
+// OpenBytes opens for searching.
+func NewMemWriter() *IndexWriter {
+	return &IndexWriter{
+		scan:      newScanner(),
+		nameData:  bufCreateMem(),
+		nameIndex: bufCreateMem(),
+		meta:      newMetaWriter(true),
+		syms:      newSymWriter(true),
+		idents:    newIdentWriter(true),
+		postIndex: bufCreateMem(),
+		main:      bufCreateMem(),
+		mem:       true,
+	}
+}
+
+// Bytes returns the index written by Flush
+// to an IndexWriter created by NewMemWriter.
+func (ix *IndexWriter) Bytes() []byte {
+	if !ix.mem {
+		log.Fatal("Bytes: index not in memory")
+	}
+	ix.main.flush()
+	return ix.main.file.(*memFile).data
+}
+
+// A scanner holds the state for computing the trigrams of a file.
+type scanner struct {
+	trigram *sparse.Set   // trigrams for the current file
+	inbuf   []byte        // input buffer
+	text    *bufio.Reader // buffer for detecting the file's character set
+	data    []byte        // content of the current file, if needed for symbols, identifiers, or regions
+}
+
+func newScanner() *scanner {
+	return &scanner{
+		trigram: sparse.NewSet(1 << 24),
+		inbuf:   make([]byte, 16384),
+		text:    bufio.NewReaderSize(nil, sniffLen),
 	}
 }
 
+// A scanResult holds the trigrams and metadata of a scanned file,
+// ready to be added to the index.
+type scanResult struct {
+	name    string
+	trigram []uint32
+	meta    FileMeta
+	symbols []symDef
+	idents  []string // identifier words, if Identifiers is set
+	content []byte   // compressed content, if StoreContent is set
+	regions []byte   // encoded regions, if Regions is set
+}
+
 // A postEntry is an in-memory (trigram, file#) pair.
 type postEntry uint64
 
@@ -90,6 +340,9 @@ func makePostEntry(trigram, fileid uint32) postEntry {
 // if it contains an invalid UTF-8 sequences, if it is longer than maxFileLength
 // bytes, if it contains a line longer than maxLineLen bytes,
 // or if it contains more than maxTextTrigrams distinct trigrams.
+// The IndexWriter fields MaxFileLen, MaxLineLen, MaxTextTrigrams,
+// and AllowInvalidUTF8 override these defaults, and ChunkLen
+// indexes files that are too long in segments.
 const (
 	maxFileLen      = 1 << 30
 	maxLineLen      = 2000
@@ -98,32 +351,170 @@ const (
 
 // AddPaths adds the given paths to the index's list of paths.
 func (ix *IndexWriter) AddPaths(paths []string) {
-	ix.paths = append(ix.paths, paths...)
+	for _, p := range paths {
+		ix.paths = append(ix.paths, slashName(p))
+	}
 }
 
 // AddFile adds the file with the given name (opened using os.Open)
-// to the index.  It logs errors using package log.
+// to the index.  It logs errors using package slog.
 func (ix *IndexWriter) AddFile(name string) {
-	f, err := os.Open(name)
-	if err != nil {
-		log.Print(err)
+	ix.addFile(name, -1)
+}
+
+// addFile adds the named file to the index and then,
+// if size is not negative, reports it to ix.Progress.
+func (ix *IndexWriter) addFile(name string, size int64) {
+	if ix.work != nil {
+		ix.work.addFile(ix, name, size)
 		return
 	}
-	defer f.Close()
-	ix.Add(name, f)
+	if r := ix.scanFile(ix.scan, name, false); r != nil {
+		ix.commit(r)
+	}
+	ix.progress(name, size)
+}
+
+// finished reports the named file to ix.Progress
+// once the files added before it have been indexed.
+func (ix *IndexWriter) finished(name string, size int64) {
+	if ix.work != nil {
+		ix.work.addProgress(name, size)
+		return
+	}
+	ix.progress(name, size)
+}
+
+// progress calls ix.Progress, if set, unless size is negative.
+func (ix *IndexWriter) progress(name string, size int64) {
+	if ix.Progress != nil && size >= 0 {
+		ix.Progress(name, size)
+	}
+}
+
+// A pathRepo records that the files in the tree rooted at path
+// belong to the named repository.
+type pathRepo struct {
+	path, repo string
+}
+
+// SetRepo records that the files added to the index from the tree
+// rooted at path, in the sense of InTree, belong to the named
+// repository, as reported by FileMeta.Repo.  If several calls name
+// trees containing a file, the innermost tree's repository applies.
+func (ix *IndexWriter) SetRepo(path, repo string) {
+	ix.repos = append(ix.repos, pathRepo{path, repo})
+}
+
+// repo returns the repository holding the named file.
+func (ix *IndexWriter) repo(name string) string {
+	repo, n := "", -1
+	for _, r := range ix.repos {
+		if len(r.path) > n && InTree(name, r.path) {
+			repo, n = r.repo, len(r.path)
+		}
+	}
+	return repo
 }
 
 // Add adds the file f to the index under the given name.
-// It logs errors using package log.
+// It logs errors using package slog.
 func (ix *IndexWriter) Add(name string, f io.Reader) {
-	ix.trigram.Reset()
+	ix.add(name, f, time.Time{})
+}
+
+// add adds the file f, last modified at mtime, to the index under the given name.
+func (ix *IndexWriter) add(name string, f io.Reader, mtime time.Time) {
+	r := ix.scanReader(ix.scan, name, f, mtime, ix.work != nil)
+	if ix.work != nil {
+		ix.work.addResult(r)
+		return
+	}
+	if r != nil {
+		ix.commit(r)
+	}
+}
+
+// limits returns the limits on file length, line length, and
+// number of distinct trigrams to apply when scanning files.
+func (ix *IndexWriter) limits() (maxFile int64, maxLine, maxTrigrams int) {
+	maxFile, maxLine, maxTrigrams = ix.MaxFileLen, ix.MaxLineLen, ix.MaxTextTrigrams
+	switch {
+	case maxFile == 0:
+		maxFile = maxFileLen
+	case maxFile < 0:
+		maxFile = math.MaxInt64
+	}
+	switch {
+	case maxLine == 0:
+		maxLine = maxLineLen
+	case maxLine < 0:
+		maxLine = math.MaxInt
+	}
+	switch {
+	case maxTrigrams == 0:
+		maxTrigrams = maxTextTrigrams
+	case maxTrigrams < 0:
+		maxTrigrams = math.MaxInt
+	}
+	return
+}
+
+// scanFile opens and scans the named file using s.
+// If keep is true, the result does not share storage with s.
+func (ix *IndexWriter) scanFile(s *scanner, name string, keep bool) *scanResult {
+	f, err := os.Open(name)
+	if err != nil {
+		slog.Warn("cannot read", "path", name, "error", err)
+		ix.logSkip(name, SkipUnreadable)
+		return nil
+	}
+	defer f.Close()
+	var mtime time.Time
+	if info, err := f.Stat(); err == nil {
+		mtime = info.ModTime()
+	}
+	return ix.scanReader(s, name, f, mtime, keep)
+}
+
+// scanReader computes the trigrams in f using s.
+// It returns nil if f cannot be read or does not look like text.
+// If keep is true, the result does not share storage with s.
+func (ix *IndexWriter) scanReader(s *scanner, name string, f io.Reader, mtime time.Time, keep bool) *scanResult {
+	s.trigram.Reset()
+	maxFile, maxLine, maxTrigrams := ix.limits()
+	// A compressed file is of the language of the file it holds.
+	lang := detectLanguage(UncompressedName(name))
+	wantSyms := ix.Symbols && hasSymbols(lang)
+	wantIdents := ix.Identifiers && hasSyntax(lang)
+	wantRegions := ix.Regions && hasSyntax(lang)
+	wantData := wantSyms || wantIdents || wantRegions || ix.StoreContent
+	s.data = s.data[:0]
+	raw := &countingReader{r: f}
+	text, err := extract(name, raw)
+	if err != nil {
+		slog.Warn("cannot extract text", "path", name, "error", err)
+		ix.logSkip(name, SkipUnreadable)
+		return nil
+	}
+	s.text.Reset(text)
+	f = newTextReader(s.text)
+	if ix.Normalize {
+		f = normReader(f)
+	}
 	var (
 		c       = byte(0)
 		i       = 0
-		buf     = ix.inbuf[:0]
+		buf     = s.inbuf[:0]
 		tv      = uint32(0)
 		n       = int64(0)
 		linelen = 0
+		first   = true
+
+		// Segments, if ix.ChunkLen is set.
+		segEnd   = ix.ChunkLen // offset of the end of the current segment
+		segStart = 0           // number of trigrams before it
+		tooMany  = false       // whether a segment added too many trigrams
 	)
 	for {
 		tv = (tv << 8) & (1<<24 - 1)
@@ -134,104 +525,263 @@ func (ix *IndexWriter) Add(name string, f io.Reader) {
 					if err == io.EOF {
 						break
 					}
-					log.Printf("%s: %v\n", name, err)
-					return
+					slog.Warn("cannot read", "path", name, "error", err)
+					ix.logSkip(name, SkipUnreadable)
+					return nil
 				}
-				log.Printf("%s: 0-length read\n", name)
-				return
+				slog.Warn("cannot read", "path", name, "error", "0-length read")
+				ix.logSkip(name, SkipUnreadable)
+				return nil
 			}
 			buf = buf[:n]
+			if first {
+				// Look for hints of the language
+				// in the beginning of the file.
+				first = false
+				if l := detectContentLanguage(UncompressedName(name), lang, buf); l != lang {
+					lang = l
+					wantSyms = ix.Symbols && hasSymbols(lang)
+					wantIdents = ix.Identifiers && hasSyntax(lang)
+					wantRegions = ix.Regions && hasSyntax(lang)
+					wantData = wantSyms || wantIdents || wantRegions || ix.StoreContent
+				}
+			}
 			i = 0
+			if wantData {
+				s.data = append(s.data, buf...)
+			}
 		}
 		c = buf[i]
 		i++
 		tv |= uint32(c)
 		if n++; n >= 3 {
-			ix.trigram.Add(tv)
+			s.trigram.Add(tv)
 		}
-		if !validUTF8((tv>>8)&0xFF, tv&0xFF) {
-			if ix.LogSkip {
-				log.Printf("%s: invalid UTF-8, ignoring\n", name)
-			}
-			return
+		if !ix.AllowInvalidUTF8 && !validUTF8((tv>>8)&0xFF, tv&0xFF) {
+			ix.logSkip(name, SkipInvalidUTF8)
+			return nil
 		}
-		if n > maxFileLen {
-			if ix.LogSkip {
-				log.Printf("%s: too long, ignoring\n", name)
+		if n > maxFile {
+			if ix.ChunkLen <= 0 {
+				ix.logSkip(name, SkipTooLarge)
+				return nil
+			}
+			if tooMany {
+				ix.logSkip(name, SkipBinary)
+				return nil
 			}
-			return
 		}
-		if linelen++; linelen > maxLineLen {
-			if ix.LogSkip {
-				log.Printf("%s: very long lines, ignoring\n", name)
+		if n == segEnd {
+			if s.trigram.Len()-segStart > maxTrigrams {
+				tooMany = true
 			}
-			return
+			segStart = s.trigram.Len()
+			segEnd += ix.ChunkLen
+		}
+		if linelen++; linelen > maxLine {
+			ix.logSkip(name, SkipLongLines)
+			return nil
 		}
 		if c == '\n' {
 			linelen = 0
 		}
 	}
-	if ix.trigram.Len() > maxTextTrigrams {
-		if ix.LogSkip {
-			log.Printf("%s: too many trigrams, probably not text, ignoring\n", name)
+	if n > maxFile {
+		// Scanned in segments; check the last.
+		if tooMany || s.trigram.Len()-segStart > maxTrigrams {
+			ix.logSkip(name, SkipBinary)
+			return nil
 		}
-		return
+	} else if s.trigram.Len() > maxTrigrams {
+		ix.logSkip(name, SkipBinary)
+		return nil
+	}
+	r := &scanResult{
+		name:    name,
+		trigram: s.trigram.Dense(),
+		meta:    FileMeta{Size: raw.n, ModTime: mtime, Hash: raw.hash, Lang: lang},
+	}
+	if wantSyms {
+		r.symbols = extractSymbols(name, lang, s.data)
+	}
+	if wantIdents {
+		r.idents = fileIdentWords(lang, s.data)
+	}
+	if wantRegions {
+		r.regions = encodeRegions(FileRegions(lang, s.data))
+	}
+	if ix.StoreContent {
+		r.content = compressContent(s.data)
+	}
+	if keep {
+		r.trigram = append([]uint32(nil), r.trigram...)
 	}
-	ix.totalBytes += n
+	return r
+}
+
+// A countingReader records the length and CRC-64 of the data read from r.
+type countingReader struct {
+	r    io.Reader
+	n    int64
+	hash uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	c.hash = crc64.Update(c.hash, crcTable, p[:n])
+	return n, err
+}
+
+// commit adds the scanned file r to the index.
+func (ix *IndexWriter) commit(r *scanResult) {
+	ix.totalBytes += r.meta.Size
 
 	if ix.Verbose {
-		log.Printf("%d %d %s\n", n, ix.trigram.Len(), name)
+		slog.Info("indexed", "path", r.name, "size", r.meta.Size, "trigrams", len(r.trigram))
 	}
 
-	fileid := ix.addName(name)
-	for _, trigram := range ix.trigram.Dense() {
-		if len(ix.post) >= cap(ix.post) {
+	fileid := ix.addName(r.name)
+	r.meta.Repo = ix.repo(r.name)
+	ix.meta.write(r.meta)
+	for _, sym := range r.symbols {
+		ix.syms.add(sym.name, fileid, sym.line)
+	}
+	for _, word := range r.idents {
+		ix.idents.add(word, fileid)
+	}
+	if ix.StoreContent {
+		ix.contentList().add(r.content)
+	}
+	if ix.Regions {
+		ix.regionList().add(r.regions)
+	}
+	if ix.Dedupe {
+		if canon, ok := ix.dupe(r, fileid); ok {
+			ix.aliases = append(ix.aliases, [2]uint32{fileid, canon})
+			r.trigram = nil
+		}
+	}
+	if ix.post == nil && !ix.mem {
+		ix.post = make([]postEntry, 0, ix.maxPost())
+	}
+	for _, trigram := range r.trigram {
+		if len(ix.post) >= ix.maxPost() && !ix.mem {
 			ix.flushPost()
 		}
 		ix.post = append(ix.post, makePostEntry(trigram, fileid))
 	}
+
+	ix.checkBytes += r.meta.Size
+	if ix.Checkpoint != nil && ix.CheckpointBytes > 0 && ix.checkBytes >= ix.CheckpointBytes && !ix.mem {
+		ix.checkpoint(r.name)
+	}
 }
 
 // Flush flushes the index entry to the target file.
 func (ix *IndexWriter) Flush() {
-	ix.addName("")
+	if ix.work != nil {
+		ix.work.wait()
+		ix.work = nil
+	}
+	ix.write()
 
-	var off [5]uint32
-	ix.main.writeString(magic)
+	if ix.mem {
+		// An index built in memory is a detail of the command
+		// building it, not worth reporting.
+		return
+	}
+	slog.Info("wrote index", "data_bytes", ix.totalBytes, "index_bytes", ix.main.offset())
+	ix.main.commit(ix.file)
+	ix.unlock()
+}
+
+// write writes the index of the files added so far to ix.main
+// and removes the writer's temporary files.
+func (ix *IndexWriter) write() {
+	ix.nameList().finish()
+
+	var off [6]uint32
+	if ix.Compress {
+		ix.main.writeString(magicV4)
+	} else {
+		ix.main.writeString(magic)
+	}
+	var sums []uint32
 	off[0] = ix.main.offset()
+	ix.main.startSum()
 	for _, p := range ix.paths {
 		ix.main.writeString(p)
 		ix.main.writeString("\x00")
 	}
 	ix.main.writeString("\x00")
 	off[1] = ix.main.offset()
+	sums = append(sums, ix.main.sum())
 	copyFile(ix.main, ix.nameData)
 	off[2] = ix.main.offset()
+	sums = append(sums, ix.main.sum())
 	ix.mergePost(ix.main)
 	off[3] = ix.main.offset()
+	sums = append(sums, ix.main.sum())
 	copyFile(ix.main, ix.nameIndex)
 	off[4] = ix.main.offset()
+	sums = append(sums, ix.main.sum())
 	copyFile(ix.main, ix.postIndex)
+	off[5] = ix.main.offset()
+	sums = append(sums, ix.main.sum())
+	secs := ix.meta.sections()
+	if ix.Symbols {
+		secs = append(secs, ix.syms.section())
+	}
+	if ix.Identifiers {
+		secs = append(secs, ix.idents.section())
+	}
+	if ix.StoreContent {
+		secs = append(secs, ix.contentList().section())
+	}
+	if ix.Regions {
+		secs = append(secs, ix.regionList().section())
+	}
+	if ix.NameTrigrams {
+		secs = append(secs, ix.nameTrigrams().section())
+	}
+	if ix.Excludes != nil {
+		secs = append(secs, excludeSectionData(ix.Excludes))
+	}
+	if ix.StopFraction > 0 {
+		secs = append(secs, stopSectionData(ix.StopFraction, ix.stop))
+	}
+	if ix.GitRef != "" {
+		secs = append(secs, gitRefSectionData(ix.GitRef))
+	}
+	if ix.Normalize {
+		secs = append(secs, normSectionData())
+	}
+	if ix.Dedupe {
+		secs = append(secs, aliasSectionData(ix.aliases))
+	}
+	writeSections(ix.main, secs, sums)
 	for _, v := range off {
 		ix.main.writeUint32(v)
 	}
 	ix.main.writeString(trailerMagic)
 
-	os.Remove(ix.nameData.name)
+	ix.nameData.remove()
 	for _, f := range ix.postFile {
+		f.Close()
 		os.Remove(f.Name())
 	}
-	os.Remove(ix.nameIndex.name)
-	os.Remove(ix.postIndex.name)
-
-	log.Printf("%d data bytes, %d index bytes", ix.totalBytes, ix.main.offset())
-
-	ix.main.flush()
+	ix.nameIndex.remove()
+	ix.postIndex.remove()
 }
 
 func copyFile(dst, src *bufWriter) {
 	dst.flush()
-	_, err := io.Copy(dst.file, src.finish())
+	var w io.Writer = dst.file
+	if dst.crc != nil {
+		w = io.MultiWriter(dst.file, dst.crc)
+	}
+	_, err := io.Copy(w, src.finish())
 	if err != nil {
 		log.Fatalf("copying %s to %s: %v", src.name, dst.name, err)
 	}
@@ -244,39 +794,138 @@ func (ix *IndexWriter) addName(name string) uint32 {
 		log.Fatalf("%q: file has NUL byte in name", name)
 	}
 
-	ix.nameIndex.writeUint32(ix.nameData.offset())
-	ix.nameData.writeString(name)
-	ix.nameData.writeByte(0)
+	ix.nameList().add(slashName(name))
+	if ix.NameTrigrams {
+		ix.nameTrigrams().add(slashName(name))
+	}
 	id := ix.numName
 	ix.numName++
 	return uint32(id)
 }
 
+// nameList returns the writer for the list of names,
+// creating it on first use so that it sees ix.Compress.
+func (ix *IndexWriter) nameList() *nameListWriter {
+	if ix.names == nil {
+		ix.names = newNameListWriter(ix.nameData, ix.nameIndex, ix.Compress)
+	}
+	return ix.names
+}
+
+// nameTrigrams returns the writer for the trigrams of the names,
+// creating it on first use.
+func (ix *IndexWriter) nameTrigrams() *nameTrigramWriter {
+	if ix.nameTris == nil {
+		ix.nameTris = newNameTrigramWriter()
+	}
+	return ix.nameTris
+}
+
+// contentList returns the writer for the stored contents,
+// creating it on first use.
+func (ix *IndexWriter) contentList() *contentWriter {
+	if ix.content == nil {
+		ix.content = newContentWriter(ix.mem)
+	}
+	return ix.content
+}
+
+// regionList returns the writer for the regions,
+// creating it on first use.
+func (ix *IndexWriter) regionList() *contentWriter {
+	if ix.regions == nil {
+		ix.regions = newRegionWriter(ix.mem)
+	}
+	return ix.regions
+}
+
+// maxMem returns the memory the writer may use for post entries.
+func (ix *IndexWriter) maxMem() int64 {
+	if ix.MaxMem > 0 {
+		return ix.MaxMem
+	}
+	return defaultMaxMem
+}
+
+// maxPost returns how many post entries the writer holds
+// before flushing them, which sorting them doubles.
+func (ix *IndexWriter) maxPost() int {
+	return int(max(ix.maxMem()/4/8, postBuf))
+}
+
+// maxRuns returns how many flushed files of post entries
+// the writer merges at once, each read postBuf entries at a time.
+func (ix *IndexWriter) maxRuns() int {
+	return int(max(ix.maxMem()/2/(postBuf*8), 2))
+}
+
 // flushPost writes ix.post to a new temporary file and
-// clears the slice.
+// clears the slice.  If that makes too many files to merge
+// at once, it merges them into one.
 func (ix *IndexWriter) flushPost() {
 	w, err := ioutil.TempFile("", "csearch-index")
 	if err != nil {
 		log.Fatal(err)
 	}
 	if ix.Verbose {
-		log.Printf("flush %d entries to %s", len(ix.post), w.Name())
+		slog.Info("flush", "entries", len(ix.post), "file", w.Name())
 	}
 	sortPost(ix.post)
 
 	// Write the raw ix.post array to disk as is.
 	// This process is the one reading it back in, so byte order is not a concern.
-	data := (*[npost * 8]byte)(unsafe.Pointer(&ix.post[0]))[:len(ix.post)*8]
+	writePostEntries(w, ix.post)
+
+	ix.post = ix.post[:0]
+	w.Seek(0, 0)
+	ix.postFile = append(ix.postFile, w)
+	if len(ix.postFile) >= ix.maxRuns() {
+		ix.mergeRuns()
+	}
+}
+
+// writePostEntries writes the raw entries to w.
+func writePostEntries(w *os.File, entries []postEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&entries[0])), len(entries)*8)
 	if n, err := w.Write(data); err != nil || n < len(data) {
 		if err != nil {
 			log.Fatal(err)
 		}
 		log.Fatalf("short write writing %s", w.Name())
 	}
+}
 
-	ix.post = ix.post[:0]
+// mergeRuns merges the flushed files of post entries into one.
+func (ix *IndexWriter) mergeRuns() {
+	w, err := ioutil.TempFile("", "csearch-index")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ix.Verbose {
+		slog.Info("merge flushed entries", "files", len(ix.postFile), "file", w.Name())
+	}
+	var h postHeap
+	for _, f := range ix.postFile {
+		h.addFile(f)
+	}
+	buf := make([]postEntry, 0, postBuf)
+	for !h.empty() {
+		buf = append(buf, h.next())
+		if len(buf) == cap(buf) {
+			writePostEntries(w, buf)
+			buf = buf[:0]
+		}
+	}
+	writePostEntries(w, buf)
+	for _, f := range ix.postFile {
+		f.Close()
+		os.Remove(f.Name())
+	}
 	w.Seek(0, 0)
-	ix.postFile = append(ix.postFile, w)
+	ix.postFile = append(ix.postFile[:0], w)
 }
 
 // mergePost reads the flushed index entries and merges them
@@ -284,34 +933,44 @@ func (ix *IndexWriter) flushPost() {
 func (ix *IndexWriter) mergePost(out *bufWriter) {
 	var h postHeap
 
-	log.Printf("merge %d files + mem", len(ix.postFile))
+	if !ix.mem {
+		slog.Info("merge posting lists", "files", len(ix.postFile))
+	}
 	for _, f := range ix.postFile {
 		h.addFile(f)
 	}
 	sortPost(ix.post)
 	h.addMem(ix.post)
 
+	var ids []uint32
+	var buf []byte
 	npost := 0
+	limit := stopLimit(ix.StopFraction, ix.numName)
+	if ix.Partial {
+		limit = math.MaxInt
+	}
 	e := h.next()
 	offset0 := out.offset()
 	for {
+		trigram := e.trigram()
+		ids = ids[:0]
+		for ; e.trigram() == trigram && trigram != 1<<24-1; e = h.next() {
+			ids = append(ids, e.fileid())
+		}
+		if len(ids) > limit {
+			ix.stop = append(ix.stop, trigram)
+			continue
+		}
+
+		// posting list
 		npost++
 		offset := out.offset() - offset0
-		trigram := e.trigram()
 		ix.buf[0] = byte(trigram >> 16)
 		ix.buf[1] = byte(trigram >> 8)
 		ix.buf[2] = byte(trigram)
-
-		// posting list
-		fileid := ^uint32(0)
-		nfile := uint32(0)
 		out.write(ix.buf[:3])
-		for ; e.trigram() == trigram && trigram != 1<<24-1; e = h.next() {
-			out.writeUvarint(e.fileid() - fileid)
-			fileid = e.fileid()
-			nfile++
-		}
-		out.writeUvarint(0)
+		buf = writePostList(out, ids, buf)
+		nfile := uint32(len(ids))
 
 		// index entry
 		ix.postIndex.write(ix.buf[:3])
@@ -325,10 +984,34 @@ func (ix *IndexWriter) mergePost(out *bufWriter) {
 }
 
 // A postChunk represents a chunk of post entries flushed to disk or
-// still in memory.
+// still in memory.  The entries of a chunk on disk are read into
+// memory postBuf at a time.
 type postChunk struct {
-	e postEntry   // next entry
-	m []postEntry // remaining entries after e
+	e   postEntry   // next entry
+	m   []postEntry // remaining entries after e
+	f   *os.File    // file holding the entries after m, if any
+	buf []postEntry // buffer for reading f
+}
+
+// refill reads the next entries of ch from its file into ch.m.
+// It returns false if there are none.
+func (ch *postChunk) refill() bool {
+	if ch.f == nil {
+		return false
+	}
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&ch.buf[0])), len(ch.buf)*8)
+	n, err := io.ReadFull(ch.f, data)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		log.Fatal(err)
+	}
+	if n%8 != 0 {
+		log.Fatalf("short read reading %s", ch.f.Name())
+	}
+	if n < len(data) {
+		ch.f = nil
+	}
+	ch.m = ch.buf[:n/8]
+	return len(ch.m) > 0
 }
 
 const postBuf = 4096
@@ -339,9 +1022,7 @@ type postHeap struct {
 }
 
 func (h *postHeap) addFile(f *os.File) {
-	data := mmapFile(f).d
-	m := (*[npost]postEntry)(unsafe.Pointer(&data[0]))[:len(data)/8]
-	h.addMem(m)
+	h.add(&postChunk{f: f, buf: make([]postEntry, postBuf)})
 }
 
 func (h *postHeap) addMem(x []postEntry) {
@@ -368,7 +1049,7 @@ func (h *postHeap) step(ch *postChunk) bool {
 // add adds the chunk to the postHeap.
 // All adds must be called before the first call to next.
 func (h *postHeap) add(ch *postChunk) {
-	if len(ch.m) > 0 {
+	if len(ch.m) > 0 || ch.refill() {
 		ch.e = ch.m[0]
 		ch.m = ch.m[1:]
 		h.push(ch)
@@ -389,6 +1070,9 @@ func (h *postHeap) next() postEntry {
 	ch := h.ch[0]
 	e := ch.e
 	m := ch.m
+	if len(m) == 0 && ch.refill() {
+		m = ch.m
+	}
 	if len(m) == 0 {
 		h.pop()
 	} else {
@@ -452,9 +1136,10 @@ func (h *postHeap) siftUp(j int) {
 // A bufWriter is a convenience wrapper: a closeable bufio.Writer.
 type bufWriter struct {
 	name string
-	file *os.File
+	file bufFile
 	buf  []byte
 	tmp  [8]byte
+	crc  hash.Hash32 // checksum of the data written, if computing one
 }
 
 // bufCreate creates a new file with the given name and returns a
@@ -480,14 +1165,177 @@ func bufCreate(name string) *bufWriter {
 	}
 }
 
+// bufCreateTemp creates a new temporary file in the same directory
+// as file, to be renamed to file by commit, and returns a corresponding
+// bufWriter.
+func bufCreateTemp(file string) *bufWriter {
+	f, err := createTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &bufWriter{
+		name: f.Name(),
+		buf:  make([]byte, 0, 256<<10),
+		file: f,
+	}
+}
+
+// createTemp creates a new temporary file in dir, whose name begins
+// with prefix, as ioutil.TempFile does, but with the mode 0666 less the
+// umask that os.Create gives rather than 0600.  The file is renamed into
+// place as an index, which users other than its writer may need to read.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// keepMode gives f, a temporary file to be renamed to file, the mode of
+// the index it replaces: file or, if file is a name ending in ~, which
+// is renamed in turn over the name without the ~s, that file.  If there
+// is no such index, f keeps the mode createTemp gave it.
+func keepMode(f *os.File, file string) error {
+	info, err := os.Stat(file)
+	if err != nil && strings.HasSuffix(file, "~") {
+		info, err = os.Stat(strings.TrimRight(file, "~"))
+	}
+	if err != nil {
+		return nil
+	}
+	return f.Chmod(info.Mode().Perm())
+}
+
+// A bufFile holds the data written to a bufWriter:
+// a file, or a memFile for an index built in memory.
+type bufFile interface {
+	io.ReadWriteSeeker
+}
+
+// bufCreateMem returns a new bufWriter that keeps its data in memory.
+func bufCreateMem() *bufWriter {
+	return &bufWriter{
+		name: "memory",
+		buf:  make([]byte, 0, 4<<10),
+		file: new(memFile),
+	}
+}
+
+// newTempBuf returns a new bufWriter for temporary data,
+// kept in memory if mem is set and otherwise in a temporary file.
+func newTempBuf(mem bool) *bufWriter {
+	if mem {
+		return bufCreateMem()
+	}
+	return bufCreate("")
+}
+
+// A memFile is a bufFile held in memory.
+type memFile struct {
+	data []byte
+	off  int64
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if n := f.off + int64(len(p)); n > int64(len(f.data)) {
+		if f.off == int64(len(f.data)) {
+			f.data = append(f.data, p...)
+			f.off = n
+			return len(p), nil
+		}
+		f.data = append(f.data, make([]byte, n-int64(len(f.data)))...)
+	}
+	copy(f.data[f.off:], p)
+	f.off += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// remove removes the temporary file holding b's data, if any.
+func (b *bufWriter) remove() {
+	if f, ok := b.file.(*os.File); ok {
+		os.Remove(f.Name())
+	}
+}
+
+// commit flushes b to stable storage and closes it, and then renames
+// it to file, atomically replacing any existing file.  B must have been
+// created by bufCreateTemp(file).
+func (b *bufWriter) commit(file string) {
+	b.flush()
+	f := b.file.(*os.File)
+	if err := f.Sync(); err != nil {
+		log.Fatalf("writing %s: %v", b.name, err)
+	}
+	if err := keepMode(f, file); err != nil {
+		log.Fatalf("writing %s: %v", b.name, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("writing %s: %v", b.name, err)
+	}
+	if err := Rename(b.name, file); err != nil {
+		os.Remove(b.name)
+		log.Fatal(err)
+	}
+}
+
+// startSum starts computing the checksum of the data written to b.
+func (b *bufWriter) startSum() {
+	b.flush()
+	b.crc = crc32.New(castagnoli)
+}
+
+// sum returns the checksum of the data written to b since the last
+// call to startSum or sum, and starts a new checksum.
+func (b *bufWriter) sum() uint32 {
+	b.flush()
+	s := b.crc.Sum32()
+	b.crc.Reset()
+	return s
+}
+
+// writeFile writes x to the file underlying b.
+func (b *bufWriter) writeFile(x []byte) {
+	if _, err := b.file.Write(x); err != nil {
+		log.Fatalf("writing %s: %v", b.name, err)
+	}
+	if b.crc != nil {
+		b.crc.Write(x)
+	}
+}
+
 func (b *bufWriter) write(x []byte) {
 	n := cap(b.buf) - len(b.buf)
 	if len(x) > n {
 		b.flush()
 		if len(x) >= cap(b.buf) {
-			if _, err := b.file.Write(x); err != nil {
-				log.Fatalf("writing %s: %v", b.name, err)
-			}
+			b.writeFile(x)
 			return
 		}
 	}
@@ -506,9 +1354,7 @@ func (b *bufWriter) writeString(s string) {
 	if len(s) > n {
 		b.flush()
 		if len(s) >= cap(b.buf) {
-			if _, err := b.file.WriteString(s); err != nil {
-				log.Fatalf("writing %s: %v", b.name, err)
-			}
+			b.writeFile([]byte(s))
 			return
 		}
 	}
@@ -529,15 +1375,12 @@ func (b *bufWriter) flush() {
 	if len(b.buf) == 0 {
 		return
 	}
-	_, err := b.file.Write(b.buf)
-	if err != nil {
-		log.Fatalf("writing %s: %v", b.name, err)
-	}
+	b.writeFile(b.buf)
 	b.buf = b.buf[:0]
 }
 
 // finish flushes the file to disk and returns an open file ready for reading.
-func (b *bufWriter) finish() *os.File {
+func (b *bufWriter) finish() bufFile {
 	b.flush()
 	f := b.file
 	f.Seek(0, 0)
@@ -558,6 +1401,11 @@ func (b *bufWriter) writeUint32(x uint32) {
 	b.buf = append(b.buf, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
 }
 
+func (b *bufWriter) writeUint64(x uint64) {
+	b.writeUint32(uint32(x >> 32))
+	b.writeUint32(uint32(x))
+}
+
 func (b *bufWriter) writeUvarint(x uint32) {
 	if cap(b.buf)-len(b.buf) < 5 {
 		b.flush()
@@ -6,8 +6,13 @@ package index
 
 import (
 	"bytes"
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"testing"
@@ -24,12 +29,37 @@ var trivialFiles = map[string]string{
 
 var trivialIndex = join(
 	// header
-	"csearch index 1\n",
+	"csearch index 3\n",
 
-	// list of paths
-	"\x00",
+	trivialPathList,
+	trivialNameList,
+	trivialPostLists,
+	trivialNameIndex,
+	trivialPostIndex,
+	trivialSectionIndex,
+	trivialMetaSection,
+
+	// crc section
+	checksums(trivialPathList, trivialNameList, trivialPostLists,
+		trivialNameIndex, trivialPostIndex, trivialSectionIndex,
+		trivialMetaSection, "", ""),
+
+	// trailer
+	u32(16),
+	u32(16+1),
+	u32(16+1+38),
+	u32(16+1+38+62),
+	u32(16+1+38+62+28),
+	u32(16+1+38+62+28+132),
 
-	// list of names
+	"\ncsearch trailr\n",
+)
+
+// list of paths
+var trivialPathList = "\x00"
+
+// list of names
+var trivialNameList = join(
 	"afile4\x00",
 	"f0\x00",
 	"file1\x00",
@@ -37,8 +67,10 @@ var trivialIndex = join(
 	"file5\x00",
 	"thefile2\x00",
 	"\x00",
+)
 
-	// list of posting lists
+// list of posting lists
+var trivialPostLists = join(
 	"\na\n", fileList(2), // file1
 	"\nab", fileList(3, 5), // file3, thefile2
 	"\nda", fileList(0), // afile4
@@ -51,8 +83,10 @@ var trivialIndex = join(
 	"yzw", fileList(4), // file5
 	"zw\n", fileList(4), // file5
 	"\xff\xff\xff", fileList(),
+)
 
-	// name index
+// name index
+var trivialNameIndex = join(
 	u32(0),
 	u32(6+1),
 	u32(6+1+2+1),
@@ -60,8 +94,10 @@ var trivialIndex = join(
 	u32(6+1+2+1+5+1+5+1),
 	u32(6+1+2+1+5+1+5+1+5+1),
 	u32(6+1+2+1+5+1+5+1+5+1+8+1),
+)
 
-	// posting list index,
+// posting list index
+var trivialPostIndex = join(
 	"\na\n", u32(1), u32(0),
 	"\nab", u32(2), u32(5),
 	"\nda", u32(1), u32(5+6),
@@ -74,15 +110,26 @@ var trivialIndex = join(
 	"yzw", u32(1), u32(5+6+5+5+5+6+6+5+5),
 	"zw\n", u32(1), u32(5+6+5+5+5+6+6+5+5+5),
 	"\xff\xff\xff", u32(0), u32(5+6+5+5+5+6+6+5+5+5+5),
+)
 
-	// trailer
-	u32(16),
-	u32(16+1),
-	u32(16+1+38),
-	u32(16+1+38+62),
-	u32(16+1+38+62+28),
+// section index
+var trivialSectionIndex = join(
+	"meta\x00", u32(16+1+38+62+28+132+52), u32(4+6*32),
+	"lang\x00", u32(16+1+38+62+28+132+52+4+6*32), u32(0),
+	"repo\x00", u32(16+1+38+62+28+132+52+4+6*32), u32(0),
+	"crc\x00", u32(16+1+38+62+28+132+52+4+6*32), u32(9*4),
+	"\x00",
+)
 
-	"\ncsearch trailr\n",
+// meta section
+var trivialMetaSection = join(
+	u32(32),
+	metaRecord(trivialFiles["afile4"]),
+	metaRecord(trivialFiles["f0"]),
+	metaRecord(trivialFiles["file1"]),
+	metaRecord(trivialFiles["file3"]),
+	metaRecord(trivialFiles["file5"]),
+	metaRecord(trivialFiles["thefile2"]),
 )
 
 func join(s ...string) string {
@@ -98,6 +145,26 @@ func u32(x uint32) string {
 	return string(buf[:])
 }
 
+func u64(x uint64) string {
+	return u32(uint32(x>>32)) + u32(uint32(x))
+}
+
+// metaRecord returns the meta section record for a file
+// with the given content, no modification time, no language,
+// and no repository.
+func metaRecord(data string) string {
+	return u64(uint64(len(data))) + u64(0) + u64(crc64.Checksum([]byte(data), crcTable)) + u32(0) + u32(0)
+}
+
+// checksums returns the crc section for an index with the given parts.
+func checksums(parts ...string) string {
+	var s string
+	for _, p := range parts {
+		s += u32(crc32.Checksum([]byte(p), castagnoli))
+	}
+	return s
+}
+
 func fileList(list ...uint32) string {
 	var buf []byte
 
@@ -118,14 +185,7 @@ func fileList(list ...uint32) string {
 func buildFlushIndex(out string, paths []string, doFlush bool, fileData map[string]string) {
 	ix := Create(out)
 	ix.AddPaths(paths)
-	var files []string
-	for name := range fileData {
-		files = append(files, name)
-	}
-	sort.Strings(files)
-	for _, name := range files {
-		ix.Add(name, strings.NewReader(fileData[name]))
-	}
+	addFiles(ix, fileData)
 	if doFlush {
 		ix.flushPost()
 	}
@@ -136,6 +196,30 @@ func buildIndex(name string, paths []string, fileData map[string]string) {
 	buildFlushIndex(name, paths, false, fileData)
 }
 
+// buildIndexWith is like buildIndex but first passes the new
+// IndexWriter to set, if not nil, to turn on the options under test.
+func buildIndexWith(out string, paths []string, fileData map[string]string, set func(ix *IndexWriter)) {
+	ix := Create(out)
+	if set != nil {
+		set(ix)
+	}
+	ix.AddPaths(paths)
+	addFiles(ix, fileData)
+	ix.Flush()
+}
+
+// addFiles adds the files in fileData to ix in order by name.
+func addFiles(ix *IndexWriter, fileData map[string]string) {
+	var files []string
+	for name := range fileData {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		ix.Add(name, strings.NewReader(fileData[name]))
+	}
+}
+
 func testTrivialWrite(t *testing.T, doFlush bool) {
 	f, _ := ioutil.TempFile("", "index-test")
 	defer os.Remove(f.Name())
@@ -164,6 +248,97 @@ func TestTrivialWriteDisk(t *testing.T) {
 	testTrivialWrite(t, true)
 }
 
+func TestMemWrite(t *testing.T) {
+	// Any attempt to create a temporary file fails.
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+
+	ix := NewMemWriter()
+	var files []string
+	for name := range trivialFiles {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		ix.Add(name, strings.NewReader(trivialFiles[name]))
+	}
+	ix.Flush()
+	data := ix.Bytes()
+	if want := []byte(trivialIndex); !bytes.Equal(data, want) {
+		t.Fatalf("wrong index:\nhave: %q\nwant: %q", data, want)
+	}
+
+	r := OpenBytes(data)
+	if n := r.NumFiles(); n != len(files) {
+		t.Errorf("NumFiles() = %d, want %d", n, len(files))
+	}
+	if name := r.Name(0); name != "afile4" {
+		t.Errorf("Name(0) = %q, want afile4", name)
+	}
+	if l := r.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(abc) = %v, want [0 3]", l)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	// The optional sections are built in memory too.
+	ix = NewMemWriter()
+	ix.Symbols = true
+	ix.StoreContent = true
+	ix.Add("x.go", strings.NewReader("package x\n\nfunc Hello() {}\n"))
+	ix.Flush()
+	r = OpenBytes(ix.Bytes())
+	if data, ok := r.Content(0); !ok || !strings.Contains(string(data), "Hello") {
+		t.Errorf("Content(0) = %q, %v, want the file", data, ok)
+	}
+	if !r.HasSymbols() {
+		t.Errorf("HasSymbols() = false, want true")
+	}
+}
+
+func TestWriteMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mode := func(file string) os.FileMode {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+
+	// A new index gets the mode os.Create would give it.
+	ref := filepath.Join(dir, "ref")
+	f, err := os.Create(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	out := filepath.Join(dir, "index")
+	buildIndex(out, nil, trivialFiles)
+	if have, want := mode(out), mode(ref); have != want {
+		t.Errorf("new index has mode %v, want %v", have, want)
+	}
+
+	// An index replacing another, directly or by way of
+	// a file~ renamed over it, keeps the other's mode.
+	if runtime.GOOS == "windows" {
+		return
+	}
+	os.Chmod(out, 0640)
+	buildIndex(out, nil, trivialFiles)
+	buildIndex(ref, []string{"/src"}, map[string]string{"/src/x": "hello"})
+	Merge(out+"~", out, ref)
+	for _, file := range []string{out, out + "~"} {
+		if have := mode(file); have != 0640 {
+			t.Errorf("%s has mode %v, want %v", filepath.Base(file), have, os.FileMode(0640))
+		}
+	}
+}
+
 func TestHeap(t *testing.T) {
 	h := &postHeap{}
 	es := []postEntry{7, 4, 3, 2, 4}
@@ -179,3 +354,208 @@ func TestHeap(t *testing.T) {
 		}
 	}
 }
+
+func TestConcurrentWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []string
+	for name, data := range trivialFiles {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	build := func(out string, n int) []byte {
+		ix := Create(out)
+		ix.SetConcurrency(n)
+		for _, file := range files {
+			ix.AddFile(file)
+		}
+		ix.Flush()
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	serial := build(filepath.Join(dir, "serial.idx"), 1)
+	parallel := build(filepath.Join(dir, "parallel.idx"), 4)
+	if !bytes.Equal(serial, parallel) {
+		t.Fatalf("concurrent index differs from serial index:\nhave: %q\nwant: %q", parallel, serial)
+	}
+}
+
+func TestWriteLimits(t *testing.T) {
+	files := map[string]string{
+		"/a/long":    strings.Repeat("x", 3000) + "\n",
+		"/a/invalid": "hello \x00\xff world\n",
+		"/a/short":   "hello world\n",
+	}
+	tests := []struct {
+		set  func(ix *IndexWriter)
+		want []string
+	}{
+		{func(ix *IndexWriter) {}, []string{"/a/short"}},
+		{func(ix *IndexWriter) { ix.MaxLineLen = -1 }, []string{"/a/long", "/a/short"}},
+		{func(ix *IndexWriter) { ix.MaxLineLen = 5000 }, []string{"/a/long", "/a/short"}},
+		{func(ix *IndexWriter) { ix.AllowInvalidUTF8 = true }, []string{"/a/invalid", "/a/short"}},
+		{func(ix *IndexWriter) { ix.MaxFileLen = 10 }, nil},
+		{func(ix *IndexWriter) { ix.MaxTextTrigrams = 5 }, nil},
+		{func(ix *IndexWriter) { ix.MaxTextTrigrams = -1; ix.MaxLineLen = -1 }, []string{"/a/long", "/a/short"}},
+	}
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	for i, tt := range tests {
+		ix := Create(f.Name())
+		tt.set(ix)
+		for _, name := range []string{"/a/invalid", "/a/long", "/a/short"} {
+			ix.Add(name, strings.NewReader(files[name]))
+		}
+		ix.Flush()
+		r := Open(f.Name())
+		var names []string
+		for id := 0; id < r.NumFiles(); id++ {
+			names = append(names, r.Name(uint32(id)))
+		}
+		if !equalStrings(names, tt.want) {
+			t.Errorf("#%d: indexed %v, want %v", i, names, tt.want)
+		}
+	}
+}
+
+func TestWriteChunks(t *testing.T) {
+	// 800 bytes with 224 distinct trigrams,
+	// at most 40 of them new in each 100 bytes.
+	var big strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&big, "word%03d\n", i)
+	}
+	tests := []struct {
+		chunk       int64
+		maxTrigrams int
+		indexed     bool
+	}{
+		{0, 60, false},
+		{100, 60, true},
+		{100, 20, false},
+		{800, 60, false},
+		{800, 300, true},
+	}
+	for _, tt := range tests {
+		ix := NewMemWriter()
+		ix.MaxFileLen = 100
+		ix.MaxTextTrigrams = tt.maxTrigrams
+		ix.ChunkLen = tt.chunk
+		ix.Add("/a/big", strings.NewReader(big.String()))
+		ix.Flush()
+		r := OpenBytes(ix.Bytes())
+		if indexed := r.NumFiles() == 1; indexed != tt.indexed {
+			t.Errorf("ChunkLen=%d MaxTextTrigrams=%d: indexed=%v, want %v", tt.chunk, tt.maxTrigrams, indexed, tt.indexed)
+			continue
+		}
+		if tt.indexed && len(r.PostingList(uint32('0')<<16|uint32('9')<<8|uint32('9'))) != 1 {
+			t.Errorf("ChunkLen=%d: trigram of last segment not indexed", tt.chunk)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tree := filepath.Join(dir, "tree")
+	if err := os.Mkdir(tree, 0777); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	var wantBytes int64
+	for name, data := range trivialFiles {
+		file := filepath.Join(tree, name)
+		if err := ioutil.WriteFile(file, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, file)
+		wantBytes += int64(len(data))
+	}
+	// A binary file is counted and reported, though not indexed.
+	bin := filepath.Join(tree, "zbinary")
+	if err := ioutil.WriteFile(bin, []byte("\x00\xff\xfe"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, bin)
+	wantBytes += 3
+	sort.Strings(want)
+
+	out := filepath.Join(dir, "index")
+	for _, n := range []int{1, 4} {
+		ix := Create(out)
+		ix.SetConcurrency(n)
+		files, bytes := ix.CountTree(tree)
+		if files != len(want) || bytes != wantBytes {
+			t.Errorf("CountTree = %d, %d, want %d, %d", files, bytes, len(want), wantBytes)
+		}
+		var names []string
+		var total int64
+		ix.Progress = func(name string, size int64) {
+			names = append(names, name)
+			total += size
+		}
+		ix.AddTree(tree)
+		ix.Flush()
+		if !equalStrings(names, want) || total != wantBytes {
+			t.Errorf("concurrency %d: Progress reported %v, %d bytes, want %v, %d bytes", n, names, total, want, wantBytes)
+		}
+	}
+}
+
+func TestMaxMem(t *testing.T) {
+	// 300 files of about 100 trigrams each make several batches of
+	// entries at the smallest bound, merged two files at a time.
+	files := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		var b strings.Builder
+		for j := 0; j < 20; j++ {
+			fmt.Fprintf(&b, "%d:%d\n", i, j*7)
+		}
+		files[fmt.Sprintf("/src/f%03d", i)] = b.String()
+	}
+	dir := t.TempDir()
+	build := func(out string, maxMem int64) []byte {
+		ix := Create(out)
+		ix.MaxMem = maxMem
+		if maxMem > 0 && (ix.maxPost() != postBuf || ix.maxRuns() != 2) {
+			t.Fatalf("MaxMem %d: maxPost %d, maxRuns %d; want %d, 2", maxMem, ix.maxPost(), ix.maxRuns(), postBuf)
+		}
+		ix.AddPaths([]string{"/src"})
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ix.Add(name, strings.NewReader(files[name]))
+		}
+		if maxMem > 0 && len(ix.postFile) != 1 {
+			t.Errorf("MaxMem %d: %d flushed files before Flush, want 1", maxMem, len(ix.postFile))
+		}
+		ix.Flush()
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	want := build(filepath.Join(dir, "index"), 0)
+	got := build(filepath.Join(dir, "small"), 1)
+	if !bytes.Equal(got, want) {
+		t.Errorf("index written with MaxMem 1 differs from the default")
+	}
+}
@@ -5,16 +5,23 @@
 package regexp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"regexp/syntax"
 	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/google/codesearch/sparse"
+	"golang.org/x/text/unicode/norm"
 )
 
 // A matcher holds the state for running regular expression search.
@@ -358,10 +365,124 @@ type Grep struct {
 	C bool // C flag - print count of matches
 	N bool // N flag - print line numbers
 	H bool // H flag - do not print file names
+	A int  // A flag - print lines of trailing context
+	B int  // B flag - print lines of leading context
+	V bool // V flag - select non-matching lines
+	O bool // O flag - print only the matching parts of lines
+
+	// CountMatches makes C mode count each match, rather than
+	// each matching line.  Matches do not overlap.
+	CountMatches bool
+
+	// Color highlights the output using ANSI escape sequences, as
+	// grep --color does: file names, line numbers, separators, and
+	// the matches in each matching line are printed in color.
+	Color bool
+
+	// Heading prints the name of each file once, on a line of its own
+	// before the first line printed from the file, instead of at the
+	// start of every line, as ripgrep --heading does.  The lines are
+	// printed with line numbers, as if N were set, and the files are
+	// separated by blank lines rather than by context separators.
+	// Heading does not apply in L or C mode, or if H is set.
+	Heading bool
+
+	// MaxColumns, if positive, truncates each printed line longer than
+	// MaxColumns bytes, as from minified files, to a part that long
+	// around its first match, or, for a context line, its start.
+	// An ellipsis marks each end that was cut off, and the columns
+	// printed follow the line in brackets, as in
+	//
+	//	app.min.js:1:…function(){return a.b.hello(c)}…  [columns 10201-10400 of 524288]
+	//
+	// Columns are counted in bytes, starting at 1.  MaxColumns does not
+	// apply to OnMatch, which sees the whole line.
+	MaxColumns int
+
+	// Template, if not empty, is printed in O mode for each match in
+	// place of the text of the match, with variables such as $1 and
+	// ${name} replaced by the text of the groups of the regexp in the
+	// match, as by Regexp.Expand, so that a search can extract the
+	// parts of the lines it matches.  The output is not colored.
+	Template string
+
+	// In V mode, the lines that do not match the regexp are reported,
+	// with no Spans, and Multiline is ignored.  In O mode, each
+	// non-empty match is printed on its own line, and context lines
+	// are not printed.
+
+	// Multiline matches the regexp against the whole file at once,
+	// so that a match may span several lines, all of which are printed.
+	// Context lines are not printed in this mode.
+	Multiline bool
+
+	// Normalize reads the text in Unicode normalization form NFC,
+	// as an index written with index.IndexWriter.Normalize holds it,
+	// so that a regexp in that form matches accented letters however
+	// they are written.  Matching lines are printed normalized.
+	Normalize bool
+
+	// OnMatch, if non-nil, is called for each matching line
+	// instead of printing it.
+	OnMatch func(m *Match)
+
+	// FirstLine and LastLine, if positive, restrict the lines reported
+	// to those numbered from FirstLine through LastLine, such as the
+	// first lines of files, which hold their license headers and package
+	// declarations.  Reader stops reading a file after LastLine.  In
+	// Multiline mode, a match must begin in the range and cannot extend
+	// past it.  Context lines may lie outside the range.
+	FirstLine int
+	LastLine  int
+
+	// Lines, if non-nil, further restricts the lines reported to those
+	// whose numbers it returns true for, such as the lines a patch adds
+	// to a file.  Like FirstLine, it applies to the line on which a
+	// Multiline match begins, and context lines may lie outside it.
+	Lines func(lineno int) bool
+
+	// Offsets, if non-nil, restricts the matches reported to those
+	// beginning at a byte offset in the file for which it returns true,
+	// such as those in the comments of a file.  A line is reported if
+	// any of its matches is, and only those matches are highlighted or
+	// counted.  In Multiline mode, it applies to the start of each
+	// match.  In V mode, it is ignored.
+	Offsets func(off int64) bool
+
+	// Max, if positive, limits the number of matching lines
+	// reported, in total across all the files searched using g.
+	// Once the limit is reached, Reader stops reading, after
+	// printing any trailing context, and Done returns true.
+	// In L mode, each file listed counts as one match.
+	Max int
+
+	// Context, if non-nil, bounds the search: once it is done, as when
+	// its deadline passes, Reader stops reading, as if the file had
+	// ended there, and Done returns true.
+	Context context.Context
 
 	Match bool
 
-	buf []byte
+	buf     []byte
+	out     []byte // line being printed
+	count   int    // matching lines reported, for Max
+	printed bool   // printed a group of lines with context
+	heading string // file whose name was printed last, in Heading mode
+}
+
+// A Match describes a line matched by Grep.
+// In multiline mode, Line may hold several lines, separated by newlines.
+// The Line slice is only valid during the call to OnMatch.
+type Match struct {
+	Name   string // name of file containing the match
+	Lineno int    // line number, starting at 1
+	Line   []byte // text of matching line, without the final newline
+	Offset int64  // byte offset of the start of the line in the file
+	Column int    // byte offset of the first match in Line, plus 1
+
+	// Spans holds the [start, end) byte offsets in Line
+	// of each non-overlapping match on the line.
+	Spans [][]int
 }
 
 func (g *Grep) AddFlags() {
@@ -369,6 +490,218 @@ func (g *Grep) AddFlags() {
 	flag.BoolVar(&g.C, "c", false, "print match counts only")
 	flag.BoolVar(&g.N, "n", false, "show line numbers")
 	flag.BoolVar(&g.H, "h", false, "omit file names")
+	flag.IntVar(&g.A, "A", 0, "print `n` lines of trailing context after matches")
+	flag.IntVar(&g.B, "B", 0, "print `n` lines of leading context before matches")
+	flag.Var(contextFlag{g}, "C", "print `n` lines of context around matches")
+	flag.Var(lineRangeFlag{g}, "line-range", "report only matches in lines `m:n` (or m, m:, or :n)")
+	flag.Var(countMatchesFlag{g}, "count-matches", "print counts of matches, not of matching lines")
+	flag.BoolVar(&g.Heading, "heading", false, "print each file name once, above the file's lines")
+	flag.IntVar(&g.MaxColumns, "max-columns", 0, "truncate printed lines longer than `n` bytes around the match")
+	flag.Var(colorFlag{g}, "color", "color the output: `when` is auto, always, or never")
+}
+
+// contextFlag implements the -C flag, which sets both A and B.
+type contextFlag struct {
+	g *Grep
+}
+
+func (f contextFlag) String() string {
+	if f.g == nil {
+		return "0"
+	}
+	return fmt.Sprint(f.g.A)
+}
+
+func (f contextFlag) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid context length %q", s)
+	}
+	f.g.A = n
+	f.g.B = n
+	return nil
+}
+
+// lineRangeFlag implements the -line-range flag,
+// which sets FirstLine and LastLine.
+type lineRangeFlag struct {
+	g *Grep
+}
+
+func (f lineRangeFlag) String() string {
+	if f.g == nil || f.g.FirstLine <= 0 && f.g.LastLine <= 0 {
+		return ""
+	}
+	s := ""
+	if f.g.FirstLine > 0 {
+		s = strconv.Itoa(f.g.FirstLine)
+	}
+	s += ":"
+	if f.g.LastLine > 0 {
+		s += strconv.Itoa(f.g.LastLine)
+	}
+	return s
+}
+
+func (f lineRangeFlag) Set(s string) error {
+	first, last, ok := strings.Cut(s, ":")
+	if !ok {
+		last = first
+	}
+	parse := func(s string) (int, bool) {
+		if s == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(s)
+		return n, err == nil && n > 0
+	}
+	m, ok1 := parse(first)
+	n, ok2 := parse(last)
+	if !ok1 || !ok2 || s == ":" || n > 0 && m > n {
+		return fmt.Errorf("invalid line range %q: want m:n, m, m:, or :n, counting from 1", s)
+	}
+	f.g.FirstLine, f.g.LastLine = m, n
+	return nil
+}
+
+// limitLines reports whether FirstLine or Lines
+// rules out some lines before LastLine.
+func (g *Grep) limitLines() bool {
+	return g.FirstLine > 1 || g.Lines != nil
+}
+
+// skipLine reports whether FirstLine or Lines rules out
+// reporting a match on line lineno.
+func (g *Grep) skipLine(lineno int) bool {
+	return lineno < g.FirstLine || g.Lines != nil && !g.Lines(lineno)
+}
+
+// keptSpans returns the matches in line, which begins at byte offset
+// off in the file, that g.Offsets keeps, or nil if there are none.
+func (g *Grep) keptSpans(line []byte, off int64) [][]int {
+	var kept [][]int
+	for _, sp := range g.Regexp.FindAllIndex(line, -1) {
+		if g.Offsets(off + int64(sp[0])) {
+			kept = append(kept, sp)
+		}
+	}
+	return kept
+}
+
+// A lineLimitReader reads from r, stopping after n lines.
+type lineLimitReader struct {
+	r io.Reader
+	n int // lines left
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	n, err := l.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			if l.n--; l.n == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+	return n, err
+}
+
+// A contextReader reads from r until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, io.EOF
+	}
+	return c.r.Read(p)
+}
+
+// countMatchesFlag implements the -count-matches flag,
+// which sets both C and CountMatches.
+type countMatchesFlag struct {
+	g *Grep
+}
+
+func (f countMatchesFlag) IsBoolFlag() bool { return true }
+
+func (f countMatchesFlag) String() string {
+	if f.g == nil {
+		return "false"
+	}
+	return strconv.FormatBool(f.g.CountMatches)
+}
+
+func (f countMatchesFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid boolean value %q", s)
+	}
+	f.g.C = v
+	f.g.CountMatches = v
+	return nil
+}
+
+// colorFlag implements the -color flag, which sets Color.
+// Given as -color, with no value, it means auto.
+type colorFlag struct {
+	g *Grep
+}
+
+func (f colorFlag) IsBoolFlag() bool { return true }
+
+func (f colorFlag) String() string {
+	if f.g != nil && f.g.Color {
+		return "always"
+	}
+	return "never"
+}
+
+func (f colorFlag) Set(s string) error {
+	switch s {
+	case "always":
+		f.g.Color = true
+	case "never", "false":
+		f.g.Color = false
+	case "auto", "true":
+		f.g.Color = isTerminal(f.g.Stdout) && os.Getenv("TERM") != "dumb"
+	default:
+		return fmt.Errorf("invalid color setting %q: want auto, always, or never", s)
+	}
+	return nil
+}
+
+// isTerminal reports whether w is a terminal, or at least
+// a character device, which is as close as package os gets.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Reset clears the state that g carries from one call of Reader
+// to the next: Match, the count of matching lines for Max, and
+// whether context lines and file headings have been printed.
+// It keeps g's buffer.
+func (g *Grep) Reset() {
+	g.Match = false
+	g.count = 0
+	g.printed = false
+	g.heading = ""
+}
+
+// Done reports whether g has reported Max matching lines
+// or its Context is done.
+func (g *Grep) Done() bool {
+	return g.Max > 0 && g.count >= g.Max || g.Context != nil && g.Context.Err() != nil
 }
 
 func (g *Grep) File(name string) {
@@ -397,74 +730,255 @@ func countNL(b []byte) int {
 }
 
 func (g *Grep) Reader(r io.Reader, name string) {
+	if g.Done() {
+		return
+	}
+	if g.Normalize {
+		r = norm.NFC.Reader(r)
+	}
+	if g.LastLine > 0 {
+		r = &lineLimitReader{r, g.LastLine}
+	}
+	if g.Context != nil {
+		r = &contextReader{g.Context, r}
+	}
+	if g.V {
+		g.readerInvert(r, name)
+		return
+	}
+	if g.Multiline {
+		g.readerMultiline(r, name)
+		return
+	}
 	if g.buf == nil {
 		g.buf = make([]byte, 1<<20)
 	}
+	if g.C && !g.L && g.OnMatch == nil && g.Max <= 0 && !g.limitLines() && g.Offsets == nil {
+		g.readerCount(r, name)
+		return
+	}
 	var (
 		buf        = g.buf[:0]
-		needLineno = g.N
+		ctx        = (g.A > 0 || g.B > 0) && !g.L && !g.C && !g.O && g.OnMatch == nil
+		needLineno = g.N || g.Heading || g.OnMatch != nil || ctx || g.limitLines()
 		lineno     = 1
 		count      = 0
-		prefix     = ""
 		beginText  = true
 		endText    = false
+		start      = 0 // start of unprocessed text in buf
+		bufLineno  = 1 // line number of buf[0], if ctx
+		last       = 0 // line number of last line printed, if ctx
+		after      = 0 // number of trailing context lines left to print
 	)
-	if !g.H {
-		prefix = name + ":"
+	var bufOffset int64 // file offset of buf[0]
+	var stop bool       // reached g.Max
+
+	// printContext prints the lines in buf[i:j], the first of which
+	// has line number n, as context lines.
+	printContext := func(i, j, n int) {
+		for i < j {
+			e := bytes.IndexByte(buf[i:j], '\n') + 1 + i
+			if e <= i {
+				e = j
+			}
+			g.printLine(name, '-', n, bytes.TrimSuffix(buf[i:e], nl), nil)
+			last = n
+			n++
+			i = e
+		}
 	}
+
+	// printAfter prints up to after lines of trailing context
+	// from buf[i:j], the first of which has line number n.
+	printAfter := func(i, j, n int) {
+		for ; after > 0 && i < j; after-- {
+			e := bytes.IndexByte(buf[i:j], '\n') + 1 + i
+			if e <= i {
+				e = j
+			}
+			printContext(i, e, n)
+			n++
+			i = e
+		}
+	}
+
 	for {
 		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
 		buf = buf[:len(buf)+n]
 		end := len(buf)
 		if err == nil {
-			i := bytes.LastIndex(buf, nl)
+			i := bytes.LastIndex(buf[start:], nl)
 			if i >= 0 {
-				end = i + 1
+				end = start + i + 1
 			}
 		} else {
 			endText = true
 		}
-		chunkStart := 0
-		for chunkStart < end {
+		chunkStart := start
+		for !stop && chunkStart < end {
 			m1 := g.Regexp.Match(buf[chunkStart:end], beginText, endText) + chunkStart
 			beginText = false
 			if m1 < chunkStart {
 				break
 			}
-			g.Match = true
-			if g.L {
-				fmt.Fprintf(g.Stdout, "%s\n", name)
-				return
+			if g.limitLines() && g.skipLine(lineno+countNL(buf[chunkStart:m1])) {
+				// The matching line is outside the range.
+				lineEnd := min(m1+1, end)
+				lineno += countNL(buf[chunkStart:lineEnd])
+				chunkStart = lineEnd
+				continue
 			}
 			lineStart := bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
 			lineEnd := m1 + 1
 			if lineEnd > end {
 				lineEnd = end
 			}
+			var kept [][]int // matches on the line kept by g.Offsets
+			if g.Offsets != nil {
+				kept = g.keptSpans(bytes.TrimSuffix(buf[lineStart:lineEnd], nl), bufOffset+int64(lineStart))
+				if kept == nil {
+					lineno += countNL(buf[chunkStart:lineEnd])
+					chunkStart = lineEnd
+					continue
+				}
+			}
+			g.Match = true
+			if g.L {
+				g.count++
+				g.printName(name)
+				return
+			}
+			if ctx {
+				printAfter(chunkStart, lineStart, lineno)
+			}
 			if needLineno {
 				lineno += countNL(buf[chunkStart:lineStart])
 			}
-			line := buf[lineStart:lineEnd]
-			nl := ""
-			if len(line) == 0 || line[len(line)-1] != '\n' {
-				nl = "\n"
+			if ctx {
+				// Find the leading context lines, going back
+				// no further than the last line printed and the
+				// beginning of the buffer.
+				i := lineStart
+				first := lineno
+				for first > bufLineno && first > last+1 && first > lineno-g.B {
+					i = bytes.LastIndex(buf[:i-1], nl) + 1
+					first--
+				}
+				if last > 0 && first > last+1 || last == 0 && g.printed && !g.Heading {
+					g.printSeparator()
+				}
+				printContext(i, lineStart, first)
+				last = lineno
+				after = g.A
+				g.printed = true
 			}
+			text := bytes.TrimSuffix(buf[lineStart:lineEnd], nl)
 			switch {
+			case g.C && g.CountMatches && kept != nil:
+				count += len(kept)
+			case g.C && g.CountMatches:
+				count += len(g.Regexp.FindAllIndex(text, -1))
 			case g.C:
 				count++
-			case g.N:
-				fmt.Fprintf(g.Stdout, "%s%d:%s%s", prefix, lineno, line, nl)
+			case g.OnMatch != nil:
+				m := &Match{Name: name, Lineno: lineno, Line: text, Offset: bufOffset + int64(lineStart), Column: 1}
+				m.Spans = kept
+				if m.Spans == nil {
+					m.Spans = g.Regexp.FindAllIndex(text, -1)
+				}
+				if len(m.Spans) > 0 {
+					m.Column = m.Spans[0][0] + 1
+				}
+				g.OnMatch(m)
+			case g.O:
+				g.printOnly(name, lineno, text, kept)
 			default:
-				fmt.Fprintf(g.Stdout, "%s%s%s", prefix, line, nl)
+				spans := kept
+				if (g.Color || g.MaxColumns > 0) && spans == nil {
+					spans = g.Regexp.FindAllIndex(text, -1)
+				}
+				g.printLine(name, ':', lineno, text, spans)
 			}
 			if needLineno {
 				lineno++
 			}
 			chunkStart = lineEnd
+			g.count++
+			stop = g.Done()
+		}
+		if ctx {
+			printAfter(chunkStart, end, lineno)
 		}
 		if needLineno && err == nil {
 			lineno += countNL(buf[chunkStart:end])
 		}
+		if stop && after == 0 {
+			break
+		}
+
+		// Keep up to g.B already processed lines at the
+		// beginning of the buffer for use as leading context.
+		keep := end
+		if ctx {
+			for i := 0; i < g.B && keep > 0 && end-keep < cap(buf)/2; i++ {
+				keep = bytes.LastIndex(buf[:keep-1], nl) + 1
+			}
+			bufLineno = lineno - countNL(buf[keep:end])
+		}
+		n = copy(buf, buf[keep:])
+		buf = buf[:n]
+		bufOffset += int64(keep)
+		start = end - keep
+		if len(buf) == start && err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
+			}
+			break
+		}
+	}
+	if g.C && count > 0 {
+		g.printCount(name, count)
+	}
+}
+
+// readerCount is Reader for C mode when only the count of each file
+// is needed, as when there is no Max.  It finds each matching line and
+// skips to the next one, without tracking line numbers or formatting
+// any lines.  In CountMatches mode, it counts the matches on each
+// matching line.
+func (g *Grep) readerCount(r io.Reader, name string) {
+	var (
+		buf       = g.buf[:0]
+		count     = 0
+		beginText = true
+		endText   = false
+	)
+	for {
+		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		end := len(buf)
+		if err == nil {
+			if i := bytes.LastIndex(buf, nl); i >= 0 {
+				end = i + 1
+			}
+		} else {
+			endText = true
+		}
+		for start := 0; start < end; {
+			m1 := g.Regexp.Match(buf[start:end], beginText, endText) + start
+			beginText = false
+			if m1 < start {
+				break
+			}
+			lineEnd := min(m1+1, end)
+			if g.CountMatches {
+				lineStart := bytes.LastIndex(buf[start:m1], nl) + 1 + start
+				count += len(g.Regexp.FindAllIndex(bytes.TrimSuffix(buf[lineStart:lineEnd], nl), -1))
+			} else {
+				count++
+			}
+			start = lineEnd
+		}
 		n = copy(buf, buf[end:])
 		buf = buf[:n]
 		if len(buf) == 0 && err != nil {
@@ -474,7 +988,365 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			break
 		}
 	}
+	if count > 0 {
+		g.Match = true
+		g.printCount(name, count)
+	}
+}
+
+// readerMultiline is Reader for g.Multiline.  It reads the whole file
+// and reports each group of lines spanned by a match, skipping matches
+// that begin on lines already reported.
+func (g *Grep) readerMultiline(r io.Reader, name string) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
+	}
+	var (
+		count  = 0
+		pos    = 0 // start of first line not yet reported
+		lineno = 1 // line number of data[pos]
+	)
+	for _, m := range g.Regexp.FindAllIndex(data, -1) {
+		start := bytes.LastIndex(data[:m[0]], nl) + 1
+		if start < pos {
+			start = pos
+		}
+		// A match ending in a newline ends on that line, not the next.
+		end := m[1]
+		if end > m[0] && data[end-1] == '\n' {
+			end--
+		}
+		if i := bytes.IndexByte(data[end:], '\n'); i >= 0 {
+			end += i
+		} else {
+			end = len(data)
+		}
+		if start > end {
+			continue
+		}
+		if g.limitLines() && g.skipLine(lineno+countNL(data[pos:start])) {
+			continue
+		}
+		if g.Offsets != nil && !g.Offsets(int64(m[0])) {
+			continue
+		}
+		g.Match = true
+		if g.L {
+			g.count++
+			g.printName(name)
+			return
+		}
+		lineno += countNL(data[pos:start])
+		text := data[start:end]
+		switch {
+		case g.C:
+			count++
+		case g.O:
+			if m[0] < m[1] {
+				g.printOnly(name, lineno+countNL(data[start:m[0]]), data[m[0]:m[1]], nil)
+			}
+		case g.OnMatch != nil:
+			ms, me := m[0]-start, m[1]-start
+			if ms < 0 {
+				ms = 0
+			}
+			if me > len(text) {
+				me = len(text)
+			}
+			g.OnMatch(&Match{Name: name, Lineno: lineno, Line: text, Offset: int64(start), Column: ms + 1, Spans: [][]int{{ms, me}}})
+		default:
+			// Highlight the part of the match on each line.
+			ms, me := m[0]-start, m[1]-start
+			off := 0
+			for i, line := range bytes.Split(text, nl) {
+				var spans [][]int
+				if s, e := max(ms-off, 0), min(me-off, len(line)); (g.Color || g.MaxColumns > 0) && s < e {
+					spans = [][]int{{s, e}}
+				}
+				g.printLine(name, ':', lineno+i, line, spans)
+				off += len(line) + 1
+			}
+		}
+		lineno += countNL(text) + 1
+		pos = end + 1
+		if g.count++; g.Done() {
+			break
+		}
+	}
+	if g.C && count > 0 {
+		g.printCount(name, count)
+	}
+}
+
+// printOnly prints the non-empty matches in line, which is in the
+// named file and has the given line number, for O mode, or
+// g.Template expanded for each of them.
+// If spans is non-nil, it lists the matches to print.
+func (g *Grep) printOnly(name string, lineno int, line []byte, spans [][]int) {
+	if spans == nil {
+		spans = g.Regexp.FindAllIndex(line, -1)
+	}
+	var subs [][]int
+	if g.Template != "" {
+		subs = g.Regexp.FindAllSubmatchIndex(line, -1)
+	}
+	for _, m := range spans {
+		if m[0] == m[1] {
+			continue
+		}
+		if g.Template != "" {
+			g.printLine(name, ':', lineno, g.expand(line, m, subs), nil)
+			continue
+		}
+		var spans [][]int
+		if g.Color || g.MaxColumns > 0 {
+			spans = [][]int{{0, m[1] - m[0]}}
+		}
+		g.printLine(name, ':', lineno, line[m[0]:m[1]], spans)
+	}
+}
+
+// expand returns g.Template expanded for the match m in line, taking
+// the groups from the one of subs, as found by FindAllSubmatchIndex,
+// that starts with m.  If there is none, only $0 expands to the match.
+func (g *Grep) expand(line []byte, m []int, subs [][]int) []byte {
+	match := m
+	for _, s := range subs {
+		if s[0] == m[0] {
+			match = s
+			break
+		}
+	}
+	return g.Regexp.Expand(nil, []byte(g.Template), line, match)
+}
+
+// The ANSI escape sequences used in Color mode,
+// with the same colors as GNU grep.
+const (
+	colorName  = "\x1b[35m"
+	colorLine  = "\x1b[32m"
+	colorSep   = "\x1b[36m"
+	colorMatch = "\x1b[1;31m"
+	colorReset = "\x1b[m"
+)
+
+// appendColor appends s to b, in the given color if g.Color is set.
+func (g *Grep) appendColor(b []byte, color, s string) []byte {
+	if !g.Color {
+		return append(b, s...)
+	}
+	b = append(b, color...)
+	b = append(b, s...)
+	return append(b, colorReset...)
+}
+
+// printLine prints line, which is in the named file and has the given
+// line number, preceded by the file name, unless g.H is set, and the
+// line number, if g.N is set, each followed by sep: ':' for a matching
+// line or '-' for a context line.  In Color mode, it highlights the
+// parts of line given by spans, which must be in order.  In Heading
+// mode, the file name is printed instead on a line of its own, when
+// it differs from that of the last line printed.  If g.MaxColumns is
+// set, a longer line is truncated around the first of spans.
+func (g *Grep) printLine(name string, sep byte, lineno int, line []byte, spans [][]int) {
+	b := g.out[:0]
+	heading := g.Heading && !g.H
+	if heading && name != g.heading {
+		if g.heading != "" {
+			b = append(b, '\n')
+		}
+		b = g.appendColor(b, colorName, name)
+		b = append(b, '\n')
+		g.heading = name
+	}
+	if !g.H && !heading {
+		b = g.appendColor(b, colorName, name)
+		b = g.appendColor(b, colorSep, string(sep))
+	}
+	if g.N || heading {
+		b = g.appendColor(b, colorLine, strconv.Itoa(lineno))
+		b = g.appendColor(b, colorSep, string(sep))
+	}
+	n, lo, hi := len(line), 0, len(line)
+	if g.MaxColumns > 0 && n > g.MaxColumns {
+		lo, hi = g.columns(line, spans)
+		spans = clipSpans(spans, lo, hi)
+		line = line[lo:hi]
+		if lo > 0 {
+			b = append(b, ellipsis...)
+		}
+	}
+	pos := 0
+	for _, sp := range spans {
+		if !g.Color || sp[0] >= sp[1] {
+			continue
+		}
+		b = append(b, line[pos:sp[0]]...)
+		b = append(b, colorMatch...)
+		b = append(b, line[sp[0]:sp[1]]...)
+		b = append(b, colorReset...)
+		pos = sp[1]
+	}
+	b = append(b, line[pos:]...)
+	if lo > 0 || hi < n {
+		if hi < n {
+			b = append(b, ellipsis...)
+		}
+		b = g.appendColor(b, colorSep, fmt.Sprintf("  [columns %d-%d of %d]", lo+1, hi, n))
+	}
+	b = append(b, '\n')
+	g.Stdout.Write(b)
+	g.out = b
+}
+
+// ellipsis marks the ends of a line cut off by MaxColumns.
+const ellipsis = "…"
+
+// columns returns the byte offsets [lo, hi) of the part of line,
+// at most g.MaxColumns bytes long, that printLine prints: the part
+// centered on the first non-empty match in spans, or starting with it
+// if it is too long, or else the start of the line.  Both ends fall
+// at the start of a UTF-8 sequence.
+func (g *Grep) columns(line []byte, spans [][]int) (lo, hi int) {
+	n := g.MaxColumns
+	for _, sp := range spans {
+		if sp[0] < sp[1] {
+			lo = sp[0] - max(n-(sp[1]-sp[0]), 0)/2
+			break
+		}
+	}
+	lo = max(min(lo, len(line)-n), 0)
+	for lo > 0 && !utf8.RuneStart(line[lo]) {
+		lo--
+	}
+	hi = min(lo+n, len(line))
+	for hi < len(line) && hi > lo && !utf8.RuneStart(line[hi]) {
+		hi--
+	}
+	return lo, hi
+}
+
+// clipSpans returns the parts of spans within [lo, hi),
+// as offsets from lo.
+func clipSpans(spans [][]int, lo, hi int) [][]int {
+	var clipped [][]int
+	for _, sp := range spans {
+		if s, e := max(sp[0], lo), min(sp[1], hi); s < e {
+			clipped = append(clipped, []int{s - lo, e - lo})
+		}
+	}
+	return clipped
+}
+
+// printName prints the name of a matching file, for L mode.
+func (g *Grep) printName(name string) {
+	b := g.appendColor(g.out[:0], colorName, name)
+	b = append(b, '\n')
+	g.Stdout.Write(b)
+	g.out = b
+}
+
+// printCount prints the count of matching lines in the named file,
+// for C mode.
+func (g *Grep) printCount(name string, count int) {
+	b := g.appendColor(g.out[:0], colorName, name)
+	b = g.appendColor(b, colorSep, ":")
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(count), 10)
+	b = append(b, '\n')
+	g.Stdout.Write(b)
+	g.out = b
+}
+
+// printSeparator prints the line that separates
+// groups of lines with context.
+func (g *Grep) printSeparator() {
+	b := g.appendColor(g.out[:0], colorSep, "--")
+	b = append(b, '\n')
+	g.Stdout.Write(b)
+	g.out = b
+}
+
+// readerInvert is Reader for g.V.  It reads the input a line at a time,
+// reporting the lines that do not match, with any context lines requested.
+func (g *Grep) readerInvert(r io.Reader, name string) {
+	var (
+		br        = bufio.NewReaderSize(r, 64<<10)
+		ctx    = (g.A > 0 || g.B > 0) && !g.L && !g.C && !g.O && g.OnMatch == nil
+		count  = 0
+		offset int64
+		before [][]byte // up to g.B unreported lines before this one
+		last   = 0      // line number of last line printed, if ctx
+		after  = 0      // number of trailing context lines left to print
+	)
+	printLine := func(sep byte, n int, line []byte) {
+		g.printLine(name, sep, n, line, nil)
+		last = n
+	}
+	for lineno := 1; ; lineno++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 {
+			if err != nil && err != io.EOF {
+				fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
+			}
+			break
+		}
+		lineOffset := offset
+		offset += int64(len(line))
+		text := bytes.TrimSuffix(line, nl)
+		if g.skipLine(lineno) || g.Regexp.Match(text, true, true) >= 0 {
+			// A matching line, or one outside the range, is only context.
+			switch {
+			case !ctx:
+			case after > 0:
+				printLine('-', lineno, text)
+				after--
+			case g.B > 0:
+				if len(before) == g.B {
+					before = before[1:]
+				}
+				before = append(before, text)
+			}
+			if g.Done() && after == 0 {
+				break
+			}
+			continue
+		}
+		if g.Done() {
+			break
+		}
+		g.Match = true
+		if g.L {
+			g.count++
+			g.printName(name)
+			return
+		}
+		if ctx {
+			first := lineno - len(before)
+			if last > 0 && first > last+1 || last == 0 && g.printed && !g.Heading {
+				g.printSeparator()
+			}
+			for i, b := range before {
+				printLine('-', first+i, b)
+			}
+			before = before[:0]
+			after = g.A
+			g.printed = true
+		}
+		switch {
+		case g.C:
+			count++
+		case g.OnMatch != nil:
+			g.OnMatch(&Match{Name: name, Lineno: lineno, Line: text, Offset: lineOffset, Column: 1})
+		case g.O:
+			// There are no matches to print.
+		default:
+			printLine(':', lineno, text)
+		}
+		g.count++
+	}
 	if g.C && count > 0 {
-		fmt.Fprintf(g.Stdout, "%s: %d\n", name, count)
+		g.printCount(name, count)
 	}
 }
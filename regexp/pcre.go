@@ -0,0 +1,465 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// PCRE compatibility.
+//
+// RE2 syntax is nearly that of PCRE, which grep -P, ripgrep, and most
+// editors use, but not quite.  TranslatePCRE rewrites the PCRE
+// constructs that RE2 lacks but can express some other way:
+//
+//	(?<name>re), (?'name're)   (?P<name>re)
+//	(?x) and (?x:re)           the same, without the x, after
+//	                           removing unescaped spaces and # comments
+//	(?#comment)                removed
+//	\h, \H                     horizontal space and its complement
+//	\v, \V, \R                 vertical space, its complement, a line break
+//	\N                         [^\n]
+//	\e, \cX, \o{17}            the same characters, as \x escapes
+//	\Z                         \z
+//	\b in a class              backspace, \x08
+//	{,n}                       {0,n}
+//
+// The constructs that RE2 cannot express at all, because matching them
+// needs backtracking, are rejected with an error explaining what to do
+// instead: lookahead and lookbehind, backreferences, atomic groups and
+// possessive quantifiers, recursion, conditionals, \K, \G, and
+// backtracking control verbs.  Everything else is left for Compile to
+// parse as usual.
+
+// TranslatePCRE returns the RE2 equivalent of the PCRE regular
+// expression expr, or an error if expr uses a construct that RE2
+// cannot express.
+func TranslatePCRE(expr string) (string, error) {
+	t := &pcreTranslator{expr: expr}
+	if err := t.translate(); err != nil {
+		return "", err
+	}
+	return t.out.String(), nil
+}
+
+// A pcreTranslator holds the state of TranslatePCRE.
+type pcreTranslator struct {
+	expr  string
+	i     int // offset of the next byte of expr to translate
+	out   strings.Builder
+	ext   bool   // in (?x) mode
+	stack []bool // ext of each enclosing group
+	quant bool   // just wrote a quantifier, which may be followed by ? but not +
+}
+
+// pcreError returns an error about the construct found in
+// t.expr[start:t.i], which RE2 cannot express.
+func (t *pcreTranslator) pcreError(start int, advice string) error {
+	return fmt.Errorf("unsupported PCRE syntax `%s`: %s", t.expr[start:t.i], advice)
+}
+
+const (
+	pcreLookaround = "RE2 has no lookahead or lookbehind; match the surrounding text as part of the regexp instead"
+	pcreBackref    = "RE2 has no backreferences; repeat the group's regexp instead, as in (a|b)x(a|b)"
+	pcreBacktrack  = "RE2 never backtracks, so it has no atomic groups or possessive quantifiers; use a plain group or quantifier, which may match more"
+	pcreRecursion  = "RE2 has no recursion or subroutine calls; write out the regexp they refer to, to the depth needed"
+
+	// pcreSpace and pcreVSpace are the characters matched by \h and \v,
+	// for use inside a class.
+	pcreSpace  = `\t\p{Zs}`
+	pcreVSpace = `\n\x0B\f\r\x{85}\x{2028}\x{2029}`
+)
+
+func (t *pcreTranslator) translate() error {
+	for t.i < len(t.expr) {
+		start := t.i
+		c := t.expr[t.i]
+		if t.quant {
+			t.quant = false
+			if c == '?' {
+				t.i++
+				t.out.WriteByte(c)
+				continue
+			}
+			if c == '+' {
+				t.i++
+				return t.pcreError(start-1, pcreBacktrack)
+			}
+		}
+		if t.ext && (c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v') {
+			t.i++
+			continue
+		}
+		if t.ext && c == '#' {
+			if n := strings.IndexByte(t.expr[t.i:], '\n'); n >= 0 {
+				t.i += n + 1
+			} else {
+				t.i = len(t.expr)
+			}
+			continue
+		}
+		switch c {
+		case '\\':
+			if err := t.escape(false); err != nil {
+				return err
+			}
+		case '[':
+			if err := t.class(); err != nil {
+				return err
+			}
+		case '(':
+			if err := t.group(); err != nil {
+				return err
+			}
+		case ')':
+			t.i++
+			t.out.WriteByte(c)
+			if n := len(t.stack); n > 0 {
+				t.ext = t.stack[n-1]
+				t.stack = t.stack[:n-1]
+			}
+		case '*', '+', '?':
+			t.i++
+			t.out.WriteByte(c)
+			t.quant = true
+		case '{':
+			t.repeat()
+		default:
+			_, size := utf8.DecodeRuneInString(t.expr[t.i:])
+			t.out.WriteString(t.expr[t.i : t.i+size])
+			t.i += size
+		}
+	}
+	return nil
+}
+
+// repeat translates the { at t.i, which begins a counted repetition
+// such as {2,5} or else is a literal {.
+func (t *pcreTranslator) repeat() {
+	end := strings.IndexByte(t.expr[t.i:], '}')
+	if end < 0 {
+		t.i++
+		t.out.WriteByte('{')
+		return
+	}
+	body := t.expr[t.i+1 : t.i+end]
+	lo, hi := body, ""
+	comma := strings.IndexByte(body, ',')
+	if comma >= 0 {
+		lo, hi = body[:comma], body[comma+1:]
+	}
+	if !isDigits(lo) && !(comma >= 0 && lo == "" && hi != "") || hi != "" && !isDigits(hi) {
+		t.i++
+		t.out.WriteByte('{')
+		return
+	}
+	if lo == "" {
+		lo = "0"
+	}
+	t.i += end + 1
+	t.out.WriteString("{" + lo)
+	if comma >= 0 {
+		t.out.WriteString("," + hi)
+	}
+	t.out.WriteByte('}')
+	t.quant = true
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// group translates the ( at t.i and, if it is one, the group's
+// flags or name.
+func (t *pcreTranslator) group() error {
+	start := t.i
+	rest := t.expr[t.i:]
+	switch {
+	case strings.HasPrefix(rest, "(*"):
+		t.i += 2
+		return t.pcreError(start, "RE2 has no backtracking control verbs or start-of-pattern options; remove it")
+	case strings.HasPrefix(rest, "(?#"):
+		end := strings.IndexByte(rest, ')')
+		if end < 0 {
+			t.i = len(t.expr)
+			return t.pcreError(start, "the comment is missing its closing )")
+		}
+		t.i += end + 1
+		return nil
+	case !strings.HasPrefix(rest, "(?"):
+		t.i++
+		t.out.WriteByte('(')
+		t.stack = append(t.stack, t.ext)
+		return nil
+	}
+
+	t.i += 2
+	rest = rest[2:]
+	switch {
+	case strings.HasPrefix(rest, "="), strings.HasPrefix(rest, "!"):
+		t.i++
+		return t.pcreError(start, pcreLookaround)
+	case strings.HasPrefix(rest, "<="), strings.HasPrefix(rest, "<!"):
+		t.i += 2
+		return t.pcreError(start, pcreLookaround)
+	case strings.HasPrefix(rest, ">"):
+		t.i++
+		return t.pcreError(start, pcreBacktrack)
+	case strings.HasPrefix(rest, "|"):
+		t.i++
+		return t.pcreError(start, "RE2 has no branch reset groups; use a plain group (?:...), numbering each alternative's groups separately")
+	case strings.HasPrefix(rest, "("):
+		t.i++
+		return t.pcreError(start, "RE2 has no conditional groups; use an alternation a|b instead")
+	case strings.HasPrefix(rest, "C"):
+		t.i++
+		return t.pcreError(start, "RE2 has no callouts; remove it")
+	case strings.HasPrefix(rest, "R"), strings.HasPrefix(rest, "&"), strings.HasPrefix(rest, "P>"),
+		rest != "" && (rest[0] >= '0' && rest[0] <= '9' || (rest[0] == '+' || rest[0] == '-') && len(rest) > 1 && rest[1] >= '0' && rest[1] <= '9'):
+		t.i++
+		return t.pcreError(start, pcreRecursion)
+	case strings.HasPrefix(rest, "P=") || strings.HasPrefix(rest, "P<") || strings.HasPrefix(rest, "<") || strings.HasPrefix(rest, "'"):
+		// Named group.
+		close := byte('>')
+		skip := 1
+		switch {
+		case rest[0] == '\'':
+			close = '\''
+		case rest[0] == 'P':
+			if rest[1] == '=' {
+				t.i += 2
+				return t.pcreError(start, pcreBackref)
+			}
+			skip = 2
+		}
+		end := strings.IndexByte(rest[skip:], close)
+		if end < 0 {
+			// Leave the error for Compile to report.
+			t.out.WriteString("(?")
+			t.stack = append(t.stack, t.ext)
+			return nil
+		}
+		t.out.WriteString("(?P<" + rest[skip:skip+end] + ">")
+		t.i += skip + end + 1
+		t.stack = append(t.stack, t.ext)
+		return nil
+	}
+
+	// Flags: (?flags) or (?flags:re).
+	end := strings.IndexAny(rest, ":)")
+	if end < 0 {
+		t.out.WriteString("(?")
+		t.stack = append(t.stack, t.ext)
+		return nil
+	}
+	t.i += end + 1
+	ext := t.ext
+	var on, off strings.Builder
+	flags := &on
+	for j := 0; j < end; j++ {
+		switch f := rest[j]; f {
+		case '-':
+			flags = &off
+		case 'x':
+			ext = flags == &on
+		case 'i', 'm', 's', 'U':
+			flags.WriteByte(f)
+		case '^':
+			// (?^) resets the flags, as far as RE2 can.
+			ext = false
+			off.WriteString("ims")
+		case 'n':
+			return t.pcreError(start, "RE2 has no n flag; write (?:...) for groups that should not capture")
+		case 'J':
+			return t.pcreError(start, "RE2 does not allow duplicate group names; give each group a different name")
+		default:
+			// Leave the error for Compile to report.
+			flags.WriteByte(f)
+		}
+	}
+	group := rest[end] == ':'
+	if group {
+		t.stack = append(t.stack, t.ext)
+	}
+	t.ext = ext
+	if on.Len() == 0 && off.Len() == 0 {
+		if group {
+			t.out.WriteString("(?:")
+		}
+		return nil
+	}
+	t.out.WriteString("(?" + on.String())
+	if off.Len() > 0 {
+		t.out.WriteString("-" + off.String())
+	}
+	t.out.WriteByte(rest[end])
+	return nil
+}
+
+// class translates the character class beginning with the [ at t.i.
+func (t *pcreTranslator) class() error {
+	t.i++
+	t.out.WriteByte('[')
+	if strings.HasPrefix(t.expr[t.i:], "^") {
+		t.i++
+		t.out.WriteByte('^')
+	}
+	if strings.HasPrefix(t.expr[t.i:], "]") {
+		t.i++
+		t.out.WriteByte(']')
+	}
+	for t.i < len(t.expr) {
+		rest := t.expr[t.i:]
+		switch {
+		case rest[0] == ']':
+			t.i++
+			t.out.WriteByte(']')
+			return nil
+		case rest[0] == '\\':
+			if err := t.escape(true); err != nil {
+				return err
+			}
+		case strings.HasPrefix(rest, "[:"):
+			end := strings.Index(rest, ":]")
+			if end < 0 {
+				end = 0
+			}
+			t.out.WriteString(rest[:end+2])
+			t.i += end + 2
+		default:
+			_, size := utf8.DecodeRuneInString(rest)
+			t.out.WriteString(rest[:size])
+			t.i += size
+		}
+	}
+	return nil
+}
+
+// escape translates the escape sequence beginning with the \ at t.i,
+// which is inside a character class if inClass is set.
+func (t *pcreTranslator) escape(inClass bool) error {
+	start := t.i
+	t.i++
+	if t.i >= len(t.expr) {
+		t.out.WriteByte('\\')
+		return nil
+	}
+	c := t.expr[t.i]
+	t.i++
+	rest := t.expr[t.i:]
+
+	// negated writes the complement of the class chars,
+	// which cannot be written inside another class.
+	negated := func(chars string) error {
+		if inClass {
+			return t.pcreError(start, fmt.Sprintf("RE2 cannot negate part of a class; write [^%s] separately and use an alternation", chars))
+		}
+		t.out.WriteString("[^" + chars + "]")
+		return nil
+	}
+	// set writes the class chars.
+	set := func(chars string) {
+		if inClass {
+			t.out.WriteString(chars)
+		} else {
+			t.out.WriteString("[" + chars + "]")
+		}
+	}
+
+	switch {
+	case c == 'Q':
+		// Quoted text is copied through, ignoring (?x).
+		end := strings.Index(rest, `\E`)
+		if end < 0 {
+			end = len(rest)
+		} else {
+			end += 2
+		}
+		t.out.WriteString(t.expr[start : t.i+end])
+		t.i += end
+	case c >= '1' && c <= '9' && (rest == "" || rest[0] < '0' || rest[0] > '9'):
+		return t.pcreError(start, pcreBackref)
+	case c == 'g' && rest != "" && strings.ContainsRune("0123456789{<'-+", rune(rest[0])),
+		c == 'k' && rest != "" && strings.ContainsRune("{<'", rune(rest[0])):
+		if c == 'g' && (rest[0] == '<' || rest[0] == '\'') {
+			return t.pcreError(start, pcreRecursion)
+		}
+		return t.pcreError(start, pcreBackref)
+	case c == 'h':
+		set(pcreSpace)
+	case c == 'H':
+		return negated(pcreSpace)
+	case c == 'v':
+		set(pcreVSpace)
+	case c == 'V':
+		return negated(pcreVSpace)
+	case c == 'R':
+		if inClass {
+			return t.pcreError(start, "\\R matches a line break, which may be two characters; move it out of the class")
+		}
+		t.out.WriteString(`(?:\r\n|[` + pcreVSpace + `])`)
+	case c == 'N' && !strings.HasPrefix(rest, "{"):
+		if inClass {
+			return t.pcreError(start, "\\N is not allowed in a class")
+		}
+		t.out.WriteString(`[^\n]`)
+	case c == 'e':
+		t.out.WriteString(`\x1B`)
+	case c == 'c':
+		if rest == "" || rest[0] >= utf8.RuneSelf {
+			return t.pcreError(start, "\\c must be followed by an ASCII character")
+		}
+		t.i++
+		x := rest[0]
+		if 'a' <= x && x <= 'z' {
+			x -= 'a' - 'A'
+		}
+		fmt.Fprintf(&t.out, `\x%02X`, x^0x40)
+	case c == 'o' && strings.HasPrefix(rest, "{"):
+		end := strings.IndexByte(rest, '}')
+		var n uint64
+		if end < 0 || end == 1 {
+			return t.pcreError(start, "\\o{...} must hold an octal number")
+		}
+		for _, d := range rest[1:end] {
+			if d < '0' || d > '7' {
+				return t.pcreError(start, "\\o{...} must hold an octal number")
+			}
+			if n = n*8 + uint64(d-'0'); n > utf8.MaxRune {
+				t.i += end + 1
+				return t.pcreError(start, "\\o{...} must be no greater than \\o{4177777}")
+			}
+		}
+		t.i += end + 1
+		fmt.Fprintf(&t.out, `\x{%X}`, n)
+	case c == 'Z':
+		t.out.WriteString(`\z`)
+	case c == 'b' && inClass:
+		t.out.WriteString(`\x08`)
+	case c == 'K':
+		return t.pcreError(start, "RE2 has no \\K; match the whole text, and use a group to pick out the part you want")
+	case c == 'G':
+		return t.pcreError(start, "RE2 has no \\G; anchor the regexp with ^ or \\A instead")
+	case c == 'X':
+		return t.pcreError(start, "RE2 has no \\X; use \\P{M}\\p{M}* to match a character and its combining marks")
+	case c == 'C':
+		return t.pcreError(start, "RE2 has no \\C; use . to match a character")
+	default:
+		// Copy the escape through for Compile, including any
+		// multibyte character it escapes.
+		t.i = start + 1
+		_, size := utf8.DecodeRuneInString(t.expr[t.i:])
+		t.i += size
+		t.out.WriteString(t.expr[start:t.i])
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"strings"
+	"testing"
+)
+
+var translatePCRETests = []struct {
+	pcre string
+	re2  string
+}{
+	{`\bfoo\b`, `\bfoo\b`},
+	{`(?i)foo|bar`, `(?i)foo|bar`},
+	{`(?<year>\d{4})-(?'month'\d\d)`, `(?P<year>\d{4})-(?P<month>\d\d)`},
+	{`(?P<x>a)`, `(?P<x>a)`},
+	{`a{,3}b{2,}c{1}`, `a{0,3}b{2,}c{1}`},
+	{`a{x}{,}`, `a{x}{,}`},
+	{`a*?b+?c??`, `a*?b+?c??`},
+	{`(?#a comment)x`, `x`},
+	{`\h+\H`, `[\t\p{Zs}]+[^\t\p{Zs}]`},
+	{`[\h,]`, `[\t\p{Zs},]`},
+	{`\R`, `(?:\r\n|[\n\x0B\f\r\x{85}\x{2028}\x{2029}])`},
+	{`\N+`, `[^\n]+`},
+	{`\e\cA\cz\o{101}`, `\x1B\x01\x1A\x{41}`},
+	{`x\Z`, `x\z`},
+	{`[\b\w]`, `[\x08\w]`},
+	{`[]a]\]`, `[]a]\]`},
+	{`[[:alpha:]\d]`, `[[:alpha:]\d]`},
+	{`\Q(?=x) a+\E+`, `\Q(?=x) a+\E+`},
+	{`\12`, `\12`},
+	{"(?x) a b # comment\n c", `abc`},
+	{"(?x: a b ) c", `(?:ab) c`},
+	{"(?ix) a\\ b [ ]", `(?i)a\ b[ ]`},
+	{"(?x)( a (?-x) b ) c", `(a b )c`},
+	{"(?x)a(?-x: b )c", `a(?: b )c`},
+	{"(?^)x", `(?-ims)x`},
+	{`é\é`, `é\é`},
+}
+
+func TestTranslatePCRE(t *testing.T) {
+	for _, tt := range translatePCRETests {
+		re2, err := TranslatePCRE(tt.pcre)
+		if err != nil {
+			t.Errorf("TranslatePCRE(%#q): %v", tt.pcre, err)
+			continue
+		}
+		if re2 != tt.re2 {
+			t.Errorf("TranslatePCRE(%#q) = %#q, want %#q", tt.pcre, re2, tt.re2)
+		}
+	}
+}
+
+var translatePCREErrorTests = []struct {
+	pcre string
+	err  string
+}{
+	{`foo(?=bar)`, "`(?=`: RE2 has no lookahead"},
+	{`(?!x)`, "`(?!`: RE2 has no lookahead"},
+	{`(?<=x)`, "`(?<=`: RE2 has no lookahead"},
+	{`(?<!x)`, "`(?<!`: RE2 has no lookahead"},
+	{`(a)\1`, "`\\1`: RE2 has no backreferences"},
+	{`(?<n>a)\k<n>`, "`\\k`: RE2 has no backreferences"},
+	{`(a)\g{1}`, "`\\g`: RE2 has no backreferences"},
+	{`(?P=n)`, "`(?P=`: RE2 has no backreferences"},
+	{`(?>a+)`, "`(?>`: RE2 never backtracks"},
+	{`a++`, "`++`: RE2 never backtracks"},
+	{`a{2}+`, "`}+`: RE2 never backtracks"},
+	{`(?R)`, "`(?R`: RE2 has no recursion"},
+	{`(a(?1))`, "`(?1`: RE2 has no recursion"},
+	{`(?(1)a|b)`, "`(?(`: RE2 has no conditional"},
+	{`(*UTF8)x`, "`(*`: RE2 has no backtracking control verbs"},
+	{`foo\Kbar`, "`\\K`: RE2 has no \\K"},
+	{`\Gx`, "`\\G`: RE2 has no \\G"},
+	{`[\H]`, "`\\H`: RE2 cannot negate part of a class"},
+	{`(?n)(a)`, "`(?n)`: RE2 has no n flag"},
+}
+
+func TestTranslatePCREError(t *testing.T) {
+	for _, tt := range translatePCREErrorTests {
+		re2, err := TranslatePCRE(tt.pcre)
+		if err == nil {
+			t.Errorf("TranslatePCRE(%#q) = %#q, want error", tt.pcre, re2)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("TranslatePCRE(%#q): %v, want error containing %q", tt.pcre, err, tt.err)
+		}
+	}
+}
@@ -6,7 +6,12 @@
 // use in grep-like programs.
 package regexp
 
-import "regexp/syntax"
+import (
+	"bytes"
+	stdregexp "regexp"
+	"regexp/syntax"
+	"strings"
+)
 
 func bug() {
 	panic("codesearch/regexp: internal error")
@@ -18,6 +23,11 @@ type Regexp struct {
 	Syntax *syntax.Regexp
 	expr   string // original expression
 	m      matcher
+	std    *stdregexp.Regexp // for FindAllIndex, compiled on first use
+
+	// literal, if non-nil, is the fixed string matched by a Regexp
+	// made by CompileLiteral, which has no matcher.
+	literal []byte
 }
 
 // String returns the source text used to compile the regular expression.
@@ -50,10 +60,129 @@ func Compile(expr string) (*Regexp, error) {
 	return r, nil
 }
 
+// CompileLiteral returns a Regexp that matches the string s literally.
+// It does not build the automaton that Compile does: instead the
+// Regexp searches for s directly, which is faster.
+func CompileLiteral(s string) *Regexp {
+	return &Regexp{
+		Syntax:  &syntax.Regexp{Op: syntax.OpLiteral, Rune: []rune(s)},
+		expr:    stdregexp.QuoteMeta(s),
+		literal: []byte(s),
+	}
+}
+
 func (r *Regexp) Match(b []byte, beginText, endText bool) (end int) {
+	if r.literal != nil {
+		return matchLiteral(b, r.literal, bytes.Index(b, r.literal))
+	}
 	return r.m.match(b, beginText, endText)
 }
 
 func (r *Regexp) MatchString(s string, beginText, endText bool) (end int) {
+	if r.literal != nil {
+		return matchLiteral([]byte(s), r.literal, strings.Index(s, string(r.literal)))
+	}
 	return r.m.matchString(s, beginText, endText)
 }
+
+// matchLiteral returns the end of the line in b containing the literal
+// lit found at index i, or -1 if there is no such line, as Match does.
+func matchLiteral(b, lit []byte, i int) (end int) {
+	if i < 0 || bytes.IndexByte(lit, '\n') >= 0 {
+		// A single line cannot contain a newline.
+		return -1
+	}
+	if j := bytes.IndexByte(b[i+len(lit):], '\n'); j >= 0 {
+		return i + len(lit) + j
+	}
+	return len(b)
+}
+
+// FindAllIndex returns the start and end offsets of successive
+// non-overlapping matches of r in b, which is usually a single line
+// already found to match, as for the standard regexp package.
+// If n >= 0, it returns at most n matches.
+func (r *Regexp) FindAllIndex(b []byte, n int) [][]int {
+	if r.literal != nil {
+		return findAllLiteral(b, r.literal, n)
+	}
+	std := r.stdRegexp()
+	if std == nil {
+		return nil
+	}
+	return std.FindAllIndex(b, n)
+}
+
+// FindAllSubmatchIndex is like FindAllIndex, but each match is followed
+// by the start and end offsets of each parenthesized group of r within
+// it, or -1 and -1 for a group that did not match, as for the standard
+// regexp package.
+func (r *Regexp) FindAllSubmatchIndex(b []byte, n int) [][]int {
+	if r.literal != nil {
+		return findAllLiteral(b, r.literal, n)
+	}
+	std := r.stdRegexp()
+	if std == nil {
+		return nil
+	}
+	return std.FindAllSubmatchIndex(b, n)
+}
+
+// NumSubexp returns the number of parenthesized groups in r.
+func (r *Regexp) NumSubexp() int {
+	if std := r.stdRegexp(); std != nil {
+		return std.NumSubexp()
+	}
+	return 0
+}
+
+// SubexpNames returns the names of the parenthesized groups in r,
+// as for the standard regexp package: the name of the first group
+// is at index 1, and a group without a name has the empty string.
+func (r *Regexp) SubexpNames() []string {
+	if std := r.stdRegexp(); std != nil {
+		return std.SubexpNames()
+	}
+	return []string{""}
+}
+
+// Expand appends template to dst, replacing variables such as $1 and
+// ${name} with the text in src of the corresponding groups of match,
+// as returned by FindAllSubmatchIndex, and returns the result.
+// The syntax is that of the Expand method of the standard regexp
+// package: $0 stands for the whole match, and $$ for a dollar sign.
+func (r *Regexp) Expand(dst, template, src []byte, match []int) []byte {
+	if std := r.stdRegexp(); std != nil {
+		return std.Expand(dst, template, src, match)
+	}
+	return dst
+}
+
+// stdRegexp returns r compiled by the standard regexp package,
+// compiling it on first use, or nil if it cannot be compiled.
+func (r *Regexp) stdRegexp() *stdregexp.Regexp {
+	if r.std == nil {
+		std, err := stdregexp.Compile(r.expr)
+		if err != nil {
+			return nil
+		}
+		r.std = std
+	}
+	return r.std
+}
+
+func findAllLiteral(b, lit []byte, n int) [][]int {
+	var m [][]int
+	for pos := 0; pos <= len(b) && (n < 0 || len(m) < n); {
+		i := bytes.Index(b[pos:], lit)
+		if i < 0 {
+			break
+		}
+		m = append(m, []int{pos + i, pos + i + len(lit)})
+		pos += i + len(lit)
+		if len(lit) == 0 {
+			pos++
+		}
+	}
+	return m
+}
@@ -6,6 +6,10 @@ package regexp
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"strings"
 	"testing"
@@ -197,6 +201,201 @@ var grepTests = []struct {
 }{
 	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input:abc\ninput:ghalloo\n"},
 	{re: `x.*y`, s: "xay\nxa\ny\n", out: "input:xay\n"},
+	{re: `m`, s: "1\n2\nm3\n4\n5\n6\n7\nm8\n9\n", g: Grep{N: true, A: 1, B: 1},
+		out: "input-2-2\ninput:3:m3\ninput-4-4\n--\ninput-7-7\ninput:8:m8\ninput-9-9\n"},
+	{re: `m`, s: "m1\n2\nm3\n4\n", g: Grep{H: true, A: 2},
+		out: "m1\n2\nm3\n4\n"},
+	{re: `m`, s: "1\n2\n3\nm4\nm5", g: Grep{N: true, B: 2},
+		out: "input-2-2\ninput-3-3\ninput:4:m4\ninput:5:m5\n"},
+	{re: `m`, s: "1\nm2\n3\n4\n5\n6\nm7\n", g: Grep{H: true, A: 5},
+		out: "m2\n3\n4\n5\n6\nm7\n"},
+	{re: `b\nc`, s: "a\nb\nc\nd\n", g: Grep{N: true, Multiline: true},
+		out: "input:2:b\ninput:3:c\n"},
+	{re: `x\s*\n`, s: "ax\nb\nx  \nx\nc", g: Grep{N: true, Multiline: true},
+		out: "input:1:ax\ninput:3:x  \ninput:4:x\n"},
+	{re: `(?s)x.*?y`, s: "x1\ny x\n2\n3y\ny\n", g: Grep{N: true, Multiline: true},
+		out: "input:1:x1\ninput:2:y x\ninput:3:2\ninput:4:3y\n"},
+	{re: `b$`, s: "b\nab\nc", g: Grep{C: true, Multiline: true},
+		out: "input: 2\n"},
+	{re: `c\nd`, s: "a\nb\nc\nd", g: Grep{L: true, Multiline: true},
+		out: "input\n"},
+	{re: `m`, s: "m1\nm2\nm3\n", g: Grep{Max: 2},
+		out: "input:m1\ninput:m2\n"},
+	{re: `m`, s: "m1\nm2\nm3\n", g: Grep{C: true, Max: 2},
+		out: "input: 2\n"},
+	{re: `m`, s: "mm1\nx\nm2m", g: Grep{C: true, CountMatches: true},
+		out: "input: 4\n"},
+	{re: `m`, s: "mm1\nm2\nm3\n", g: Grep{C: true, CountMatches: true, Max: 2},
+		out: "input: 3\n"},
+	{re: `^m|x$`, s: "mx\nam\nm", g: Grep{C: true},
+		out: "input: 2\n"},
+	{re: `m`, s: "x\ny\n", g: Grep{C: true},
+		out: ""},
+	{re: `m`, s: "m1\nm2\nm3\nm4\n", g: Grep{N: true, FirstLine: 2, LastLine: 3},
+		out: "input:2:m2\ninput:3:m3\n"},
+	{re: `m`, s: "m1\nm2\nm3\n", g: Grep{H: true, LastLine: 1},
+		out: "m1\n"},
+	{re: `^m`, s: "m1\n2\nm3\nm4", g: Grep{H: true, FirstLine: 3},
+		out: "m3\nm4\n"},
+	{re: `m`, s: "m1\nm2\nm3\nm4\n", g: Grep{C: true, FirstLine: 2, LastLine: 3},
+		out: "input: 2\n"},
+	{re: `m`, s: "m1\nm2\n3\n", g: Grep{L: true, FirstLine: 3},
+		out: ""},
+	{re: `m`, s: "m1\n2\nm3\n", g: Grep{N: true, B: 1, FirstLine: 2},
+		out: "input-2-2\ninput:3:m3\n"},
+	{re: `m\nm`, s: "m\nx\nm\nm\nm\n", g: Grep{N: true, Multiline: true, FirstLine: 2, LastLine: 4},
+		out: "input:3:m\ninput:4:m\n"},
+	{re: `m`, s: "1\nm2\n3\n4\n", g: Grep{N: true, V: true, FirstLine: 2, LastLine: 3},
+		out: "input:3:3\n"},
+	{re: `m`, s: "m1\nm2\nm3\nm4\n", g: Grep{N: true, Lines: oddLines},
+		out: "input:1:m1\ninput:3:m3\n"},
+	{re: `m`, s: "m1\nm2\nm3\nm4\n", g: Grep{C: true, FirstLine: 2, Lines: oddLines},
+		out: "input: 1\n"},
+	{re: `m`, s: "m1\n2\nm3\n", g: Grep{N: true, A: 1, Lines: oddLines},
+		out: "input:1:m1\ninput-2-2\ninput:3:m3\n"},
+	{re: `m`, s: "m1\nm2\n", g: Grep{N: true, Offsets: lateOffsets},
+		out: "input:2:m2\n"},
+	{re: `m`, s: "m1m\nm2\n", g: Grep{N: true, Offsets: lateOffsets},
+		out: "input:1:m1m\ninput:2:m2\n"},
+	{re: `m`, s: "m\nm\nm\n", g: Grep{C: true, Offsets: lateOffsets},
+		out: "input: 2\n"},
+	{re: `m`, s: "mmm\n", g: Grep{C: true, CountMatches: true, Offsets: lateOffsets},
+		out: "input: 1\n"},
+	{re: `m`, s: "mxm\n", g: Grep{H: true, Color: true, Offsets: lateOffsets},
+		out: "mx\x1b[1;31mm\x1b[m\n"},
+	{re: `m+`, s: "mxm\n", g: Grep{H: true, O: true, Offsets: lateOffsets},
+		out: "m\n"},
+	{re: `m\nm`, s: "m\nm\nx\nm\nm\n", g: Grep{N: true, Multiline: true, Offsets: lateOffsets},
+		out: "input:4:m\ninput:5:m\n"},
+	{re: `m`, s: "m1\n2\nm3\n4\n", g: Grep{H: true, A: 1, Max: 1},
+		out: "m1\n2\n"},
+	{re: `m\n`, s: "m\nm\nm\n", g: Grep{N: true, Multiline: true, Max: 2},
+		out: "input:1:m\ninput:2:m\n"},
+	{re: `m`, s: "m1\n2\nm3\n4", g: Grep{N: true, V: true},
+		out: "input:2:2\ninput:4:4\n"},
+	{re: `[b-d]`, s: "a\nb\nc\nd\ne\nf\ng\n", g: Grep{H: true, N: true, V: true, A: 1, B: 1},
+		out: "1:a\n2-b\n--\n4-d\n5:e\n6:f\n7:g\n"},
+	{re: `m`, s: "m1\n2\n3\nm4\n", g: Grep{C: true, V: true},
+		out: "input: 2\n"},
+	{re: `m`, s: "m1\n2\n3\n", g: Grep{H: true, V: true, Max: 1},
+		out: "2\n"},
+	{re: `m`, s: "m\nm\n", g: Grep{L: true, V: true},
+		out: ""},
+	{re: `a+`, s: "xaxaa\ny\naaa", g: Grep{N: true, O: true, A: 1},
+		out: "input:1:a\ninput:1:aa\ninput:3:aaa\n"},
+	{re: `b\nc+`, s: "a\nb\ncc\n", g: Grep{H: true, O: true, Multiline: true},
+		out: "b\ncc\n"},
+	{re: `o+`, s: "foo boo\nbar\n", g: Grep{N: true, Color: true},
+		out: "\x1b[35minput\x1b[m\x1b[36m:\x1b[m\x1b[32m1\x1b[m\x1b[36m:\x1b[mf\x1b[1;31moo\x1b[m b\x1b[1;31moo\x1b[m\n"},
+	{re: `b`, s: "a\nb\nc\n", g: Grep{H: true, A: 1, Color: true},
+		out: "\x1b[1;31mb\x1b[m\nc\n"},
+	{re: `b`, s: "b\nb\n", g: Grep{C: true, Color: true},
+		out: "\x1b[35minput\x1b[m\x1b[36m:\x1b[m 2\n"},
+	{re: `b`, s: "b\n", g: Grep{L: true, Color: true},
+		out: "\x1b[35minput\x1b[m\n"},
+	{re: `ab\nc`, s: "xab\ncd\n", g: Grep{H: true, Multiline: true, Color: true},
+		out: "x\x1b[1;31mab\x1b[m\n\x1b[1;31mc\x1b[md\n"},
+	{re: `a+`, s: "baab\n", g: Grep{H: true, O: true, Color: true},
+		out: "\x1b[1;31maa\x1b[m\n"},
+	{re: `m`, s: "m1\n2\nm3\n", g: Grep{Heading: true},
+		out: "input\n1:m1\n3:m3\n"},
+	{re: `m`, s: "1\nm2\n3\n4\n5\nm6\n", g: Grep{Heading: true, A: 1},
+		out: "input\n2:m2\n3-3\n--\n6:m6\n"},
+	{re: `m`, s: "m1\n", g: Grep{Heading: true, H: true},
+		out: "m1\n"},
+	{re: `m`, s: "m1\nm2\n", g: Grep{Heading: true, C: true},
+		out: "input: 2\n"},
+	{re: `m`, s: "m1\n", g: Grep{Heading: true, Color: true},
+		out: "\x1b[35minput\x1b[m\n\x1b[32m1\x1b[m\x1b[36m:\x1b[m\x1b[1;31mm\x1b[m1\n"},
+	{re: `m`, s: "abcdefghijmklmnopqrst\n", g: Grep{H: true, MaxColumns: 5},
+		out: "…ijmkl…  [columns 9-13 of 21]\n"},
+	{re: `m`, s: "mabcdefgh\nshort\n", g: Grep{H: true, MaxColumns: 5},
+		out: "mabcd…  [columns 1-5 of 9]\n"},
+	{re: `m`, s: "abcdefghm\n", g: Grep{H: true, MaxColumns: 5},
+		out: "…efghm  [columns 5-9 of 9]\n"},
+	{re: `cdefgh`, s: "abcdefghij\n", g: Grep{H: true, MaxColumns: 4},
+		out: "…cdef…  [columns 3-6 of 10]\n"},
+	{re: `m`, s: "mxy\n", g: Grep{H: true, MaxColumns: 5},
+		out: "mxy\n"},
+	{re: `m`, s: "0123456789\nabcdem\n", g: Grep{H: true, B: 1, MaxColumns: 4},
+		out: "0123…  [columns 1-4 of 10]\n…cdem  [columns 3-6 of 6]\n"},
+	{re: `m`, s: "ééémééé\n", g: Grep{H: true, MaxColumns: 4},
+		out: "…ém…  [columns 5-7 of 13]\n"},
+	{re: `m`, s: "abcdmefgh\n", g: Grep{H: true, MaxColumns: 3, Color: true},
+		out: "…d\x1b[1;31mm\x1b[me…\x1b[36m  [columns 4-6 of 9]\x1b[m\n"},
+	{re: `bc\nd`, s: "xxxxxxabc\ndef\n", g: Grep{H: true, Multiline: true, MaxColumns: 4},
+		out: "…xabc  [columns 6-9 of 9]\ndef\n"},
+	{re: `(\w+)=(\d+)`, s: "a=1 b=22\nc\nd=x\n", g: Grep{N: true, O: true, Template: "$2:$1"},
+		out: "input:1:1:a\ninput:1:22:b\n"},
+	{re: `(?P<key>\w+)=(\d+)?`, s: "a= b=2\n", g: Grep{H: true, O: true, Template: "${key} [$2] $$0=$0", Color: true},
+		out: "a [] $0=a=\nb [2] $0=b=2\n"},
+	{re: `b=`, s: "a=1 b=22\n", g: Grep{H: true, O: true, Template: "<$0$1>"},
+		out: "<b=>\n"},
+	{re: `(a)(b)?`, s: "xab\nya\n", g: Grep{H: true, O: true, Multiline: true, Template: "$1-$2"},
+		out: "a-b\na-\n"},
+}
+
+func TestGrepContextChunks(t *testing.T) {
+	// Grep the same input with buffers of different sizes
+	// to check context handling across buffer refills.
+	var input bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&input, "line %d%s\n", i, strings.Repeat("x", i%7))
+		if i%13 == 0 {
+			fmt.Fprintf(&input, "match %d\n", i)
+		}
+	}
+	re, err := Compile(`(?m)match`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(size int) string {
+		var out bytes.Buffer
+		g := Grep{Regexp: re, Stdout: &out, Stderr: &out, N: true, A: 3, B: 4}
+		if size > 0 {
+			g.buf = make([]byte, size)
+		}
+		g.Reader(bytes.NewReader(input.Bytes()), "input")
+		return out.String()
+	}
+	want := run(0)
+	for _, size := range []int{160, 200, 301} {
+		if have := run(size); have != want {
+			t.Errorf("buffer size %d: output differs:\nhave:\n%s\nwant:\n%s", size, have, want)
+		}
+	}
+}
+
+func TestGrepCountChunks(t *testing.T) {
+	// Count with buffers of different sizes, and compare with the
+	// counts made with Max set, which report every matching line.
+	var input bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&input, "line %d %s\n", i, strings.Repeat("ab", i%11))
+	}
+	re, err := Compile(`(?m)b(a|$)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(g Grep, size int) string {
+		var out bytes.Buffer
+		g.Regexp, g.Stdout, g.Stderr = re, &out, &out
+		if size > 0 {
+			g.buf = make([]byte, size)
+		}
+		g.Reader(bytes.NewReader(input.Bytes()), "input")
+		return out.String()
+	}
+	for _, g := range []Grep{{C: true}, {C: true, CountMatches: true}} {
+		g1 := g
+		g1.Max = 1 << 30
+		want := run(g1, 0)
+		for _, size := range []int{0, 40, 64, 301} {
+			if have := run(g, size); have != want {
+				t.Errorf("%+v, buffer size %d: count %q, want %q", g, size, have, want)
+			}
+		}
+	}
 }
 
 func TestGrep(t *testing.T) {
@@ -217,3 +416,225 @@ func TestGrep(t *testing.T) {
 		}
 	}
 }
+
+func TestGrepHeading(t *testing.T) {
+	re, err := Compile(`(?m)m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files are separated by blank lines, even with context,
+	// and files without matches print nothing.
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, Heading: true, B: 1}
+	g.Reader(strings.NewReader("1\nm2\n"), "a")
+	g.Reader(strings.NewReader("x\n"), "b")
+	g.Reader(strings.NewReader("m1\n"), "c")
+	want := "a\n1-1\n2:m2\n\nc\n1:m1\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestGrepNormalize(t *testing.T) {
+	re, err := Compile("(?m)caf\u00e9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, Normalize: true}
+	g.Reader(strings.NewReader("cafe\u0301\n"), "a")
+	g.Reader(strings.NewReader("caf\u00e9\n"), "b")
+	want := "a:caf\u00e9\nb:caf\u00e9\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+var lineRangeTests = []struct {
+	s           string
+	first, last int
+	ok          bool
+}{
+	{"1:200", 1, 200, true},
+	{"5", 5, 5, true},
+	{"5:", 5, 0, true},
+	{":20", 0, 20, true},
+	{"3:2", 0, 0, false},
+	{"0:2", 0, 0, false},
+	{":", 0, 0, false},
+	{"a:b", 0, 0, false},
+}
+
+func TestLineRangeFlag(t *testing.T) {
+	for _, tt := range lineRangeTests {
+		var g Grep
+		err := lineRangeFlag{&g}.Set(tt.s)
+		if (err == nil) != tt.ok || tt.ok && (g.FirstLine != tt.first || g.LastLine != tt.last) {
+			t.Errorf("Set(%q) = %d, %d, %v, want %d, %d, ok=%v", tt.s, g.FirstLine, g.LastLine, err, tt.first, tt.last, tt.ok)
+		}
+	}
+}
+
+// A failReader reads data and then fails the test if read again.
+type failReader struct {
+	t    *testing.T
+	data string
+}
+
+func (r *failReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		r.t.Errorf("read past the line range")
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestGrepLineRangeStops(t *testing.T) {
+	re, err := Compile(`(?m)m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, H: true, LastLine: 2}
+	g.buf = make([]byte, 4)
+	g.Reader(&failReader{t, "m1\nm2\n"}, "input")
+	if want := "m1\nm2\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestGrepMax(t *testing.T) {
+	re, err := Compile(`(?m)m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The limit applies across files, and trailing context
+	// is printed even if it needs another read.
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, H: true, A: 2, Max: 3}
+	g.buf = make([]byte, 8)
+	g.Reader(strings.NewReader("m1\nm2\n"), "a")
+	if g.Done() {
+		t.Errorf("Done() = true after 2 matches, want false")
+	}
+	g.Reader(strings.NewReader("x\nm3\n4\n5\n6\nm7\n"), "b")
+	if !g.Done() {
+		t.Errorf("Done() = false after 3 matches, want true")
+	}
+	g.Reader(strings.NewReader("m8\n"), "c")
+	want := "m1\nm2\n--\nm3\n4\n5\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+	g.Reset()
+	if g.Done() || g.Match {
+		t.Errorf("after Reset, Done() = %v, Match = %v, want false, false", g.Done(), g.Match)
+	}
+}
+
+// A cancelReader returns one line per read,
+// calling cancel after the first.
+type cancelReader struct {
+	lines  []string
+	cancel func()
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	if len(r.lines) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.lines[0])
+	r.lines = r.lines[1:]
+	r.cancel()
+	return n, nil
+}
+
+func TestGrepContext(t *testing.T) {
+	re, err := Compile(`(?m)m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once the context is done, Reader stops reading, and Done
+	// keeps any more files from being read.
+	ctx, cancel := context.WithCancel(context.Background())
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, H: true, Context: ctx}
+	g.buf = make([]byte, 8)
+	if g.Done() {
+		t.Errorf("Done() = true before cancel, want false")
+	}
+	g.Reader(&cancelReader{[]string{"m1\n", "m2\n", "m3\n"}, cancel}, "a")
+	if !g.Done() {
+		t.Errorf("Done() = false after cancel, want true")
+	}
+	g.Reader(strings.NewReader("m4\n"), "b")
+	if want := "m1\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestGrepOnMatch(t *testing.T) {
+	re, err := Compile(`(?m)b+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "abba\nccc\nxbyb\n"
+	for _, size := range []int{0, 8} {
+		var ms []Match
+		g := Grep{Regexp: re, Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+		if size > 0 {
+			g.buf = make([]byte, size)
+		}
+		g.OnMatch = func(m *Match) {
+			m1 := *m
+			m1.Line = append([]byte(nil), m.Line...)
+			ms = append(ms, m1)
+		}
+		g.Reader(strings.NewReader(input), "input")
+		want := []Match{
+			{Name: "input", Lineno: 1, Line: []byte("abba"), Offset: 0, Column: 2, Spans: [][]int{{1, 3}}},
+			{Name: "input", Lineno: 3, Line: []byte("xbyb"), Offset: 9, Column: 2, Spans: [][]int{{1, 2}, {3, 4}}},
+		}
+		if !reflect.DeepEqual(ms, want) {
+			t.Errorf("buffer size %d: matches = %+v, want %+v", size, ms, want)
+		}
+	}
+}
+
+var literalTests = []struct {
+	lit string
+	s   string
+	m   []int
+}{
+	{"abc", "abc", []int{1}},
+	{"abc", "xabcx\nab\nc\nabc\n", []int{1, 4}},
+	{"a.c", "abc\na.c", []int{2}},
+	{"", "x\ny\n", []int{1, 2}},
+	{"b\nc", "ab\ncd\n", nil},
+}
+
+func TestCompileLiteral(t *testing.T) {
+	for _, tt := range literalTests {
+		re := CompileLiteral(tt.lit)
+		lines := grep(re, []byte(tt.s))
+		if !reflect.DeepEqual(lines, tt.m) {
+			t.Errorf("grep(literal %q, %q) = %v, want %v", tt.lit, tt.s, lines, tt.m)
+		}
+	}
+	re := CompileLiteral("ab")
+	if m := re.FindAllIndex([]byte("abcabab"), -1); !reflect.DeepEqual(m, [][]int{{0, 2}, {3, 5}, {5, 7}}) {
+		t.Errorf("FindAllIndex = %v", m)
+	}
+	if m := re.FindAllSubmatchIndex([]byte("xab"), -1); !reflect.DeepEqual(m, [][]int{{1, 3}}) || re.NumSubexp() != 0 {
+		t.Errorf("FindAllSubmatchIndex = %v, NumSubexp = %d", m, re.NumSubexp())
+	}
+	if out := re.Expand(nil, []byte("[$0$1]"), []byte("xab"), []int{1, 3}); string(out) != "[ab]" {
+		t.Errorf("Expand = %q, want %q", out, "[ab]")
+	}
+}
+
+func oddLines(lineno int) bool { return lineno%2 == 1 }
+
+func lateOffsets(off int64) bool { return off >= 2 }
@@ -0,0 +1,156 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sort"
+
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+	"golang.org/x/text/unicode/norm"
+)
+
+// A batchQuery is the state of one query in a batch.
+type batchQuery struct {
+	q    *Query
+	g    regexp.Grep
+	n    int  // matches sent
+	stop bool // reached MaxResults
+}
+
+// RunBatch searches ix for all of qs at once and returns an iterator
+// over the matching lines, in which the Query field of each match gives
+// the index in qs of the query it matches.  RunBatch finds the candidate
+// files of every query and reads each file only once, however many of
+// the queries select it, so that running many queries together, as when
+// scanning for dozens of signatures, costs little more than running the
+// slowest.  The matches are in order by file, and then by query.
+//
+// If keep is non-nil, RunBatch searches only the files in ix
+// whose IDs keep returns true for, as for access control.
+// The MaxResults and MaxCandidates options of each query limit its own
+// matches and candidate files, and the smallest MaxBytes option of the
+// queries limits the bytes read for them all.
+// Once RunBatch has been called, the queries must not be used until
+// the search finishes or is closed.
+func RunBatch(ctx context.Context, ix *index.Index, qs []*Query, keep func(fileid uint32) bool) *Results {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Results{c: make(chan Match, 64), cancel: cancel}
+	go r.runBatch(ctx, ix, qs, keep)
+	return r
+}
+
+func (r *Results) runBatch(ctx context.Context, ix *index.Index, qs []*Query, keep func(fileid uint32) bool) {
+	defer close(r.c)
+	batch := make([]*batchQuery, len(qs))
+	r.stopped = make([]bool, len(qs))
+	stopped := 0
+	for i, q := range qs {
+		i, b := i, &batchQuery{q: q}
+		b.g = regexp.Grep{
+			Regexp:    q.Regexp,
+			Stdout:    ioutil.Discard,
+			Stderr:    ioutil.Discard,
+			Multiline: q.opts.Multiline,
+			Normalize: q.opts.Normalize,
+			Context:   ctx,
+			OnMatch: func(m *regexp.Match) {
+				if b.stop || ctx.Err() != nil {
+					return
+				}
+				if q.opts.MaxResults > 0 && b.n >= q.opts.MaxResults {
+					r.truncated = true
+					r.stopped[i] = true
+					b.stop = true
+					stopped++
+					return
+				}
+				b.n++
+				select {
+				case r.c <- Match{File: m.Name, Line: m.Lineno, Text: string(m.Line), Offset: m.Offset, Column: m.Column, Spans: m.Spans, Query: i}:
+				case <-ctx.Done():
+				}
+			},
+		}
+		batch[i] = b
+	}
+
+	// The queries selecting each candidate file.
+	byFile := make(map[uint32][]*batchQuery)
+	var ids []uint32
+	var maxBytes int64
+	for _, b := range batch {
+		list, _ := b.q.candidates(ctx, ix)
+		n := 0
+		for _, fileid := range list {
+			if keep != nil && !keep(fileid) {
+				continue
+			}
+			n++
+			if byFile[fileid] == nil {
+				ids = append(ids, fileid)
+			}
+			byFile[fileid] = append(byFile[fileid], b)
+		}
+		if max := b.q.opts.MaxCandidates; max > 0 && n > max {
+			r.err = ErrTooManyCandidates
+			return
+		}
+		if m := b.q.opts.MaxBytes; m > 0 && (maxBytes == 0 || m < maxBytes) {
+			maxBytes = m
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	limit := newBudget(maxBytes)
+	for _, fileid := range ids {
+		if stopped == len(batch) || ctx.Err() != nil || limit.spent() {
+			break
+		}
+		name := ix.Name(fileid)
+		var data, normData []byte
+		read := false
+		for _, b := range byFile[fileid] {
+			if b.stop {
+				continue
+			}
+			if !read {
+				f, err := b.q.open(ix, fileid, name)
+				if err != nil {
+					break
+				}
+				data, err = ioutil.ReadAll(limit.reader(f))
+				f.Close()
+				if err != nil {
+					break
+				}
+				read = true
+				r.files++
+			}
+			text := data
+			if b.q.opts.Normalize {
+				if normData == nil {
+					normData = norm.NFC.Bytes(data)
+				}
+				text = normData
+			}
+			if b.q.NeedContent() && !b.q.KeepContent(ix, fileid, text) {
+				continue
+			}
+			b.g.Reader(bytes.NewReader(text), name)
+		}
+	}
+	switch {
+	case stopped == len(batch):
+		// Every query stopped at its MaxResults, as asked.
+	case limit.spent():
+		r.err = ErrTooManyBytes
+	case !r.truncated:
+		r.err = ctx.Err()
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunBatch(t *testing.T) {
+	dir, ix := buildTree(t)
+	defer os.RemoveAll(dir)
+
+	var qs []*Query
+	for _, c := range []struct {
+		pattern string
+		opts    *Options
+	}{
+		{"hello", nil},
+		{"func", &Options{File: `\.go$`}},
+		{"world", nil},
+		{"l+", &Options{MaxResults: 1}},
+	} {
+		q, err := Compile(c.pattern, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qs = append(qs, q)
+	}
+
+	run := func(keep func(fileid uint32) bool) ([]string, int) {
+		r := RunBatch(context.Background(), ix, qs, keep)
+		defer r.Close()
+		var have []string
+		for r.Next() {
+			m := r.Match()
+			rel, _ := filepath.Rel(dir, m.File)
+			have = append(have, fmt.Sprintf("%d:%s:%d", m.Query, filepath.ToSlash(rel), m.Line))
+		}
+		if r.Err() != nil {
+			t.Errorf("RunBatch: %v", r.Err())
+		}
+		if !r.Truncated() || !r.QueryTruncated(3) || r.QueryTruncated(0) {
+			t.Errorf("RunBatch: Truncated = %v, QueryTruncated = %v, %v, want true, true, false", r.Truncated(), r.QueryTruncated(3), r.QueryTruncated(0))
+		}
+		return have, r.Files()
+	}
+
+	// Each file is read once, however many queries select it.
+	have, files := run(nil)
+	want := []string{"0:a.go:5", "1:a.go:3", "1:a.go:5", "3:a.go:3", "0:b.py:1", "0:c/d.txt:2", "2:c/d.txt:2"}
+	if fmt.Sprint(have) != fmt.Sprint(want) || files != 3 {
+		t.Errorf("RunBatch matched %v in %d files, want %v in 3", have, files, want)
+	}
+
+	have, files = run(func(fileid uint32) bool { return !strings.HasSuffix(ix.Name(fileid), ".py") })
+	want = []string{"0:a.go:5", "1:a.go:3", "1:a.go:5", "3:a.go:3", "0:c/d.txt:2", "2:c/d.txt:2"}
+	if fmt.Sprint(have) != fmt.Sprint(want) || files != 2 {
+		t.Errorf("RunBatch with keep matched %v in %d files, want %v in 2", have, files, want)
+	}
+}
@@ -0,0 +1,572 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"fmt"
+	stdregexp "regexp"
+	"strings"
+	"unicode"
+
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+)
+
+// Query expressions.
+//
+// CompileQuery accepts a small query language combining several
+// patterns and restrictions on the files searched:
+//
+//	mutex lock              files matching both mutex and lock
+//	mutex AND lock          the same
+//	mutex OR rwlock         files matching either
+//	mutex -test             files matching mutex but not test
+//	NOT test                files not matching test
+//	(foo OR bar) baz        parentheses group terms
+//	"a b"                   quotes allow spaces in a pattern
+//	content:mutex           the same as mutex
+//	file:^src/              files whose names match ^src/
+//	lang:go,python          files in either language (see Options.Langs)
+//	repo:kernel             files in the named repository
+//	pkg://net/...           files in the named Bazel packages (see below)
+//
+// AND binds more tightly than OR, and a term written next to another
+// is ANDed with it.  Content patterns and file patterns are regular
+// expressions, or fixed strings if Options.Literal is set; inside
+// quotes, \" stands for a quote and other backslashes are kept.  A
+// parenthesis that belongs to a regular expression, as in (a|b)c,
+// is taken as part of it: a word is split on parentheses only when
+// they do not balance within it.
+//
+// A pkg term lists Bazel packages by label, as recorded by
+// index.Index.BazelPackage, such as //net/http or @dep//x; a label
+// ending in /... also names the packages beneath, as in Bazel target
+// patterns, and one without // or @ is taken to begin with //.
+//
+// A file matches the query if the expression is true of it, where a
+// content term is true of a file if the pattern matches somewhere in
+// its text.  The lines printed for a matching file are those matching
+// any content pattern that is not negated; if there are none, every
+// line matches.
+
+// An exprOp is the kind of an expr.
+type exprOp int
+
+const (
+	exprTerm exprOp = iota
+	exprAnd
+	exprOr
+	exprNot
+)
+
+// An expr is a parsed query expression.
+type expr struct {
+	op    exprOp
+	sub   []*expr
+	field string // for a term: content, file, lang, repo, or pkg
+	value string
+
+	re    *regexp.Regexp // content and file patterns
+	q     *index.Query   // trigram query for content and file patterns
+	names []string       // lang, repo, and pkg names
+}
+
+// exprFields lists the fields that may prefix a term.
+var exprFields = []string{"content", "file", "lang", "repo", "pkg"}
+
+// A tri is the value of an expression that may depend on
+// information not yet known.
+type tri int
+
+const (
+	no tri = iota
+	maybe
+	yes
+)
+
+// A token is a lexical token of a query expression.
+type token struct {
+	kind  byte // 'w' for a word, '(' or ')', '&' for AND, '|' for OR, '!' for NOT
+	field string
+	value string
+}
+
+// lexExpr splits the query s into tokens.
+func lexExpr(s string) ([]token, error) {
+	var toks []token
+	for i := 0; ; {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) {
+			return toks, nil
+		}
+		switch c := s[i]; {
+		case c == ')':
+			toks = append(toks, token{kind: ')'})
+			i++
+			continue
+		case c == '(':
+			if end, ok := scanWord(s, i); !ok || end == i+1 {
+				toks = append(toks, token{kind: '('})
+				i++
+				continue
+			}
+		case c == '-' && i+1 < len(s) && !isSpace(s[i+1]):
+			toks = append(toks, token{kind: '!'})
+			i++
+			continue
+		}
+
+		field, explicit := "content", false
+		for _, f := range exprFields {
+			if strings.HasPrefix(s[i:], f+":") {
+				field, explicit = f, true
+				i += len(f) + 1
+				break
+			}
+		}
+		var value string
+		if i < len(s) && s[i] == '"' {
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) && s[j+1] == '"' {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated quoted string in query")
+			}
+			value = b.String()
+			i = j + 1
+		} else {
+			end, _ := scanWord(s, i)
+			value = s[i:end]
+			i = end
+			if !explicit {
+				switch value {
+				case "AND":
+					toks = append(toks, token{kind: '&'})
+					continue
+				case "OR":
+					toks = append(toks, token{kind: '|'})
+					continue
+				case "NOT":
+					toks = append(toks, token{kind: '!'})
+					continue
+				}
+			}
+		}
+		if value == "" {
+			return nil, fmt.Errorf("missing value for %s: in query", field)
+		}
+		toks = append(toks, token{kind: 'w', field: field, value: value})
+	}
+}
+
+// scanWord returns the end of the word beginning at s[i], which ends
+// at a space or at a closing parenthesis without a matching opening
+// one, and reports whether the word's parentheses balance.
+// Escaped characters and characters in classes do not count.
+func scanWord(s string, i int) (end int, balanced bool) {
+	depth := 0
+	for ; i < len(s) && !isSpace(s[i]); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			i++
+			if i < len(s) && s[i] == '^' {
+				i++
+			}
+			if i < len(s) && s[i] == ']' {
+				i++
+			}
+			for i < len(s) && s[i] != ']' {
+				if s[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return i, true
+			}
+			depth--
+		}
+	}
+	if i > len(s) {
+		i = len(s)
+	}
+	return i, depth == 0
+}
+
+func isSpace(c byte) bool {
+	return c < 0x80 && unicode.IsSpace(rune(c))
+}
+
+// An exprParser parses a list of tokens.
+type exprParser struct {
+	toks []token
+}
+
+// parseExpr parses the query expression s.
+func parseExpr(s string) (*expr, error) {
+	toks, err := lexExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	p := &exprParser{toks: toks}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.toks) > 0 {
+		return nil, fmt.Errorf("unexpected %s in query", p.toks[0])
+	}
+	return e, nil
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case 'w':
+		return fmt.Sprintf("%q", t.value)
+	case '&':
+		return "AND"
+	case '|':
+		return "OR"
+	case '!':
+		return "NOT"
+	}
+	return string(t.kind)
+}
+
+func (p *exprParser) peek() byte {
+	if len(p.toks) == 0 {
+		return 0
+	}
+	return p.toks[0].kind
+}
+
+func (p *exprParser) or() (*expr, error) {
+	e, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == '|' {
+		p.toks = p.toks[1:]
+		f, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		e = combineExpr(exprOr, e, f)
+	}
+	return e, nil
+}
+
+func (p *exprParser) and() (*expr, error) {
+	e, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case '&':
+			p.toks = p.toks[1:]
+		case 'w', '(', '!':
+		default:
+			return e, nil
+		}
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		e = combineExpr(exprAnd, e, f)
+	}
+}
+
+func (p *exprParser) unary() (*expr, error) {
+	if len(p.toks) == 0 {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	t := p.toks[0]
+	p.toks = p.toks[1:]
+	switch t.kind {
+	case 'w':
+		return &expr{op: exprTerm, field: t.field, value: t.value}, nil
+	case '!':
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &expr{op: exprNot, sub: []*expr{e}}, nil
+	case '(':
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) in query")
+		}
+		p.toks = p.toks[1:]
+		return e, nil
+	}
+	return nil, fmt.Errorf("unexpected %s in query", t)
+}
+
+// combineExpr returns e op f, flattening nested uses of op.
+func combineExpr(op exprOp, e, f *expr) *expr {
+	if e.op == op {
+		e.sub = append(e.sub, f)
+		return e
+	}
+	return &expr{op: op, sub: []*expr{e, f}}
+}
+
+// String returns a fully parenthesized form of e, for debugging.
+func (e *expr) String() string {
+	switch e.op {
+	case exprNot:
+		return "NOT " + e.sub[0].String()
+	case exprAnd, exprOr:
+		sep := " AND "
+		if e.op == exprOr {
+			sep = " OR "
+		}
+		var parts []string
+		for _, s := range e.sub {
+			parts = append(parts, s.String())
+		}
+		return "(" + strings.Join(parts, sep) + ")"
+	}
+	return fmt.Sprintf("%s:%q", e.field, e.value)
+}
+
+// compile compiles the patterns in e's terms according to opts.
+func (e *expr) compile(opts *Options) error {
+	for _, s := range e.sub {
+		if err := s.compile(opts); err != nil {
+			return err
+		}
+	}
+	if e.op != exprTerm {
+		return nil
+	}
+	var err error
+	switch e.field {
+	case "content":
+		e.re, e.q, err = compilePattern(e.value, opts)
+	case "file":
+		pat := e.value
+		if opts.Literal {
+			pat = stdregexp.QuoteMeta(pat)
+		} else if pat, err = translate(pat, opts); err != nil {
+			return err
+		}
+		if e.re, err = regexp.Compile(pat); err == nil {
+			e.q = index.RegexpQuery(e.re.Syntax)
+		}
+	case "lang":
+		e.names, err = lookupLanguages(strings.Split(e.value, ","))
+	case "repo":
+		e.names = strings.Split(e.value, ",")
+	case "pkg":
+		for _, p := range strings.Split(e.value, ",") {
+			if !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "@") {
+				p = "//" + p
+			}
+			e.names = append(e.names, p)
+		}
+	}
+	return err
+}
+
+// query returns the trigram query for the files that might match e.
+// It must be called only once, after compile.
+func (e *expr) query() *index.Query {
+	switch e.op {
+	case exprTerm:
+		if e.field == "content" {
+			return e.q
+		}
+	case exprAnd, exprOr:
+		q := e.sub[0].query()
+		for _, s := range e.sub[1:] {
+			if e.op == exprAnd {
+				q = q.And(s.query())
+			} else {
+				q = q.Or(s.query())
+			}
+		}
+		return q
+	}
+	// A negated term can match any file.
+	return &index.Query{Op: index.QAll}
+}
+
+// nameQuery returns the trigram query for the names of the files
+// that might match e, or nil if e does not restrict the names.
+func (e *expr) nameQuery() *index.Query {
+	switch e.op {
+	case exprTerm:
+		if e.field == "file" {
+			return e.q
+		}
+	case exprAnd, exprOr:
+		q := e.sub[0].nameQuery()
+		for _, s := range e.sub[1:] {
+			if q1 := s.nameQuery(); e.op == exprAnd {
+				q = andQuery(q, q1)
+			} else if q == nil || q1 == nil {
+				return nil
+			} else {
+				q = q.Or(q1)
+			}
+		}
+		return q
+	}
+	return nil
+}
+
+// patterns returns the content patterns in e that are not negated.
+func (e *expr) patterns() []string {
+	switch e.op {
+	case exprTerm:
+		if e.field == "content" {
+			return []string{e.value}
+		}
+	case exprAnd, exprOr:
+		var pats []string
+		for _, s := range e.sub {
+			pats = append(pats, s.patterns()...)
+		}
+		return pats
+	}
+	return nil
+}
+
+// A fileAttrs holds what the index records about a file,
+// for evaluating query expressions.
+type fileAttrs struct {
+	name string
+	lang string
+	repo string
+	pkg  string // Bazel package, if the expression has pkg terms
+}
+
+// evalFile evaluates e for the file with the given attributes.
+// The value is maybe if it depends on the file's content.
+func (e *expr) evalFile(f *fileAttrs) tri {
+	switch e.op {
+	case exprNot:
+		return yes - e.sub[0].evalFile(f)
+	case exprAnd, exprOr:
+		// AND is false if any term is false, and OR true if any is true.
+		stop, v := no, yes
+		if e.op == exprOr {
+			stop, v = yes, no
+		}
+		for _, s := range e.sub {
+			switch s.evalFile(f) {
+			case stop:
+				return stop
+			case maybe:
+				v = maybe
+			}
+		}
+		return v
+	}
+	switch e.field {
+	case "file":
+		return truth(e.re.MatchString(f.name, true, true) >= 0)
+	case "lang":
+		return truth(hasString(e.names, f.lang))
+	case "repo":
+		return truth(hasString(e.names, f.repo))
+	case "pkg":
+		return truth(matchPackage(e.names, f.pkg))
+	}
+	return maybe
+}
+
+// eval evaluates e for a file with the given attributes and content.
+func (e *expr) eval(f *fileAttrs, data []byte) bool {
+	switch e.op {
+	case exprNot:
+		return !e.sub[0].eval(f, data)
+	case exprAnd:
+		for _, s := range e.sub {
+			if !s.eval(f, data) {
+				return false
+			}
+		}
+		return true
+	case exprOr:
+		for _, s := range e.sub {
+			if s.eval(f, data) {
+				return true
+			}
+		}
+		return false
+	}
+	if e.field == "content" {
+		return e.re.Match(data, true, true) >= 0
+	}
+	return e.evalFile(f) == yes
+}
+
+// hasField reports whether e has a term for field.
+func (e *expr) hasField(field string) bool {
+	if e.op == exprTerm {
+		return e.field == field
+	}
+	for _, s := range e.sub {
+		if s.hasField(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPackage reports whether the Bazel package pkg
+// is one of those named by the labels in list.
+func matchPackage(list []string, pkg string) bool {
+	if pkg == "" {
+		return false
+	}
+	for _, p := range list {
+		if base, ok := strings.CutSuffix(p, "/..."); ok {
+			if pkg == base || strings.HasPrefix(pkg, base+"/") {
+				return true
+			}
+		} else if p == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+func truth(b bool) tri {
+	if b {
+		return yes
+	}
+	return no
+}
+
+func hasString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/codesearch/index"
+)
+
+var parseExprTests = []struct {
+	query string
+	want  string
+}{
+	{"foo", `content:"foo"`},
+	{"foo bar", `(content:"foo" AND content:"bar")`},
+	{"foo AND bar baz", `(content:"foo" AND content:"bar" AND content:"baz")`},
+	{"foo OR bar baz", `(content:"foo" OR (content:"bar" AND content:"baz"))`},
+	{"foo -bar", `(content:"foo" AND NOT content:"bar")`},
+	{"NOT foo", `NOT content:"foo"`},
+	{"(foo OR bar) baz", `((content:"foo" OR content:"bar") AND content:"baz")`},
+	{"( foo OR bar )", `(content:"foo" OR content:"bar")`},
+	{"(a|b)c", `content:"(a|b)c"`},
+	{`func\( x`, `(content:"func\\(" AND content:"x")`},
+	{"([)]x OR y)", `(content:"[)]x" OR content:"y")`},
+	{`"a b" "say \"hi\""`, `(content:"a b" AND content:"say \"hi\"")`},
+	{`file:^src/ lang:go content:"mutex"`, `(file:"^src/" AND lang:"go" AND content:"mutex")`},
+	{"-file:_test content:AND", `(NOT file:"_test" AND content:"AND")`},
+	{"http://x", `content:"http://x"`},
+	{"a - b", `(content:"a" AND content:"-" AND content:"b")`},
+	{"x pkg://net/...,@dep//y", `(content:"x" AND pkg:"//net/...,@dep//y")`},
+}
+
+var parseExprErrors = []string{
+	"",
+	"   ",
+	"foo AND",
+	"(foo",
+	"foo)",
+	`"foo`,
+	"file:",
+	"OR foo",
+}
+
+func TestParseExpr(t *testing.T) {
+	for _, tt := range parseExprTests {
+		e, err := parseExpr(tt.query)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.query, err)
+			continue
+		}
+		if s := e.String(); s != tt.want {
+			t.Errorf("parseExpr(%q) = %s, want %s", tt.query, s, tt.want)
+		}
+	}
+	for _, query := range parseExprErrors {
+		if e, err := parseExpr(query); err == nil {
+			t.Errorf("parseExpr(%q) = %s, want error", query, e)
+		}
+	}
+}
+
+var queryTests = []struct {
+	query string
+	opts  *Options
+	want  []string
+}{
+	{"hello", nil, []string{"a.go:5", "b.py:1", "c/d.txt:2"}},
+	{"hello package", nil, []string{"a.go:1", "a.go:5"}},
+	{"hello -package", nil, []string{"b.py:1", "c/d.txt:2"}},
+	{"Hello OR world", nil, []string{"a.go:3", "c/d.txt:2"}},
+	{"hello (def OR nothing)", nil, []string{"b.py:1", "c/d.txt:1", "c/d.txt:2"}},
+	{"hello lang:go,py", nil, []string{"a.go:5", "b.py:1"}},
+	{"hello lang:golang,python", nil, []string{"a.go:5", "b.py:1"}},
+	{"hello -lang:go", nil, []string{"b.py:1", "c/d.txt:2"}},
+	{`hello file:\.txt$`, nil, []string{"c/d.txt:2"}},
+	{"hello repo:c", nil, []string{"c/d.txt:2"}},
+	{"file:b.py OR world", nil, []string{"c/d.txt:2"}},
+	{"lang:py", nil, []string{"b.py:1", "b.py:2"}},
+	{"HELLO()", &Options{Literal: true, IgnoreCase: true}, []string{"a.go:3", "a.go:5", "b.py:1"}},
+	{"hello -(world OR pass)", nil, []string{"a.go:5"}},
+}
+
+var nameQueryTests = []struct {
+	query string
+	names string // trigram query for the names, or "" for none
+}{
+	{"hello", ""},
+	{"hello file:_test", `"_te" "est" "tes"`},
+	{"file:abc OR file:xyz", `("abc"|"xyz")`},
+	{"file:abc OR world", ""},
+	{"hello -file:abc", ""},
+	{"(file:abc OR file:xyz) file:def", `"def" ("abc"|"xyz")`},
+}
+
+func TestNameQuery(t *testing.T) {
+	for _, tt := range nameQueryTests {
+		q, err := CompileQuery(tt.query, nil)
+		if err != nil {
+			t.Errorf("CompileQuery(%q): %v", tt.query, err)
+			continue
+		}
+		names := ""
+		if q.Names != nil {
+			names = q.Names.String()
+		}
+		if names != tt.names {
+			t.Errorf("CompileQuery(%q).Names = %s, want %s", tt.query, names, tt.names)
+		}
+	}
+}
+
+var matchPackageTests = []struct {
+	pkg  string
+	want bool
+}{
+	{"//net", true},
+	{"//net/http", true},
+	{"//network", false},
+	{"//", false},
+	{"//x", true},
+	{"//x/y", false},
+	{"@dep//", true},
+	{"@dep//a/b", true},
+	{"@other//net", false},
+	{"", false},
+}
+
+func TestMatchPackage(t *testing.T) {
+	e, err := parseExpr("pkg://net/...,x,@dep//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.compile(&Options{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range matchPackageTests {
+		if got := matchPackage(e.names, tt.pkg); got != tt.want {
+			t.Errorf("matchPackage(%q, %q) = %v, want %v", e.names, tt.pkg, got, tt.want)
+		}
+	}
+}
+
+func TestCompileQuery(t *testing.T) {
+	for _, nameTris := range []bool{false, true} {
+		dir, ix := buildTreeWith(t, func(w *index.IndexWriter) { w.NameTrigrams = nameTris })
+		defer os.RemoveAll(dir)
+
+		for _, tt := range queryTests {
+			q, err := CompileQuery(tt.query, tt.opts)
+			if err != nil {
+				t.Errorf("CompileQuery(%q): %v", tt.query, err)
+				continue
+			}
+			r := q.Run(context.Background(), ix)
+			var have []string
+			for r.Next() {
+				m := r.Match()
+				rel, _ := filepath.Rel(dir, m.File)
+				have = append(have, fmt.Sprintf("%s:%d", filepath.ToSlash(rel), m.Line))
+			}
+			r.Close()
+			if fmt.Sprint(have) != fmt.Sprint(tt.want) {
+				t.Errorf("name trigrams %v: CompileQuery(%q, %+v) = %v, want %v", nameTris, tt.query, tt.opts, have, tt.want)
+			}
+		}
+	}
+	if _, err := CompileQuery("foo lang:nosuchlang", nil); err == nil {
+		t.Errorf("CompileQuery with unknown language succeeded")
+	}
+	if _, err := CompileQuery("foo file:(", nil); err == nil {
+		t.Errorf("CompileQuery with bad file regexp succeeded")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"errors"
+	"io"
+)
+
+// The errors that Results.Err returns for a search
+// stopped by its MaxCandidates or MaxBytes option.
+var (
+	ErrTooManyCandidates = errors.New("search: too many candidate files")
+	ErrTooManyBytes      = errors.New("search: too many bytes to read")
+)
+
+// A budget limits the bytes of files that a search reads,
+// as the MaxBytes option directs.  A nil budget has no limit.
+type budget struct {
+	left int64 // bytes left to read
+	over bool  // a file went on past the end of the budget
+}
+
+// newBudget returns a budget of max bytes, or nil if max is not positive.
+func newBudget(max int64) *budget {
+	if max <= 0 {
+		return nil
+	}
+	return &budget{left: max}
+}
+
+// reader returns a reader for r that counts the bytes read against b
+// and reports EOF once b is spent.
+func (b *budget) reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &budgetReader{r, b}
+}
+
+// spent reports whether a search has tried to read past the end of b.
+func (b *budget) spent() bool {
+	return b != nil && b.over
+}
+
+// A budgetReader reads from r within a budget.
+type budgetReader struct {
+	r io.Reader
+	b *budget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	if r.b.left <= 0 {
+		// The budget is spent: the search is over it
+		// unless the file ends here.
+		var c [1]byte
+		if n, _ := io.ReadFull(r.r, c[:]); n > 0 {
+			r.b.over = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.b.left {
+		p = p[:r.b.left]
+	}
+	n, err := r.r.Read(p)
+	r.b.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,612 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package search implements searching a trigram index as csearch does,
+// for programs that want to search without running csearch.
+//
+// A search compiles the pattern into a regexp and a trigram query,
+// uses the query to find the indexed files that might match,
+// and then searches those files for the regexp:
+//
+//	r, err := search.Run(ctx, index.Open(index.File()), `func \w+\(`, nil)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer r.Close()
+//	for r.Next() {
+//		m := r.Match()
+//		fmt.Printf("%s:%d:%s\n", m.File, m.Line, m.Text)
+//	}
+//	if err := r.Err(); err != nil {
+//		log.Fatal(err)
+//	}
+package search
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdregexp "regexp"
+	"strings"
+
+	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/regexp"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Options control a search.  A nil *Options is equivalent to
+// a zero Options.
+type Options struct {
+	IgnoreCase bool   // match without regard to case
+	Literal    bool   // treat the pattern as a fixed string, not a regexp
+	File       string // if non-empty, search only files whose names match this regexp
+
+	// PCRECompat takes the regexps to be PCRE regular expressions,
+	// as grep -P and ripgrep do, translating them to RE2 with
+	// regexp.TranslatePCRE.
+	PCRECompat bool
+
+	// Types, if non-empty, limits the search to files of these types,
+	// as defined by FileTypes, or index.DefaultFileTypes if FileTypes is nil.
+	Types     []string
+	FileTypes index.FileTypes
+
+	// Globs, if non-empty, limits the search to files whose names
+	// pass the include and exclude patterns, as for index.GlobFilter.
+	Globs []string
+
+	// Langs, if non-empty, limits the search to files in these
+	// languages, as recorded in the index by the IndexWriter.
+	// Languages may be given by other common names, such as python
+	// for py (see index.LookupLanguage).
+	Langs []string
+
+	// Repos, if non-empty, limits the search to files in these
+	// repositories, as recorded in the index by IndexWriter.SetRepo.
+	Repos []string
+
+	// MaxResults, if positive, stops the search after that many
+	// matching lines.
+	MaxResults int
+
+	// MaxCandidates, if positive, fails a search for which the index
+	// selects more than that many candidate files, before it reads
+	// any of them, with ErrTooManyCandidates.
+	MaxCandidates int
+
+	// MaxBytes, if positive, stops the search once it has read that
+	// many bytes of files, failing it with ErrTooManyBytes if there
+	// was more to read.  The matches found by then are still returned.
+	MaxBytes int64
+
+	// Brute searches every indexed file, ignoring the trigram query.
+	Brute bool
+
+	// ForceIndex always uses the trigram query to choose the files
+	// to search.  Otherwise a search ignores the query, as Brute does,
+	// if the index estimates that searching every file would take less
+	// time than reading the query's posting lists (see IndexQuery).
+	ForceIndex bool
+
+	// Stored searches the text of files as stored in the index, for
+	// files whose text it stores (see index.IndexWriter.StoreContent),
+	// instead of reading the files themselves.
+	Stored bool
+
+	// Multiline matches the pattern against whole files rather than
+	// single lines, so that it can match text spanning several lines.
+	// Each Match then holds all the lines the matching text spans.
+	Multiline bool
+
+	// Normalize puts the pattern, and the text of each file searched,
+	// in Unicode normalization form NFC, for searching indexes that
+	// hold the trigrams of normalized text (see index.Index.Normalized).
+	Normalize bool
+}
+
+// A Query is a compiled search.
+// A Query is NOT SAFE for concurrent use by multiple goroutines.
+type Query struct {
+	Regexp *regexp.Regexp // regexp to search for in files
+	Index  *index.Query   // trigram query selecting candidate files
+	Names  *index.Query   // trigram query selecting candidate file names, or nil
+
+	opts      Options
+	file      *regexp.Regexp
+	fileTypes index.FileTypes
+	globs     *index.GlobFilter
+	langs     []string // languages, named as in the index
+	expr      *expr    // query expression, if compiled by CompileQuery
+}
+
+// Compile compiles the search for pattern, an RE2 regular expression
+// (or a fixed string, if opts.Literal is set) matched against each
+// line of the indexed files, or against whole files if opts.Multiline
+// is set.
+func Compile(pattern string, opts *Options) (*Query, error) {
+	q := new(Query)
+	if opts != nil {
+		q.opts = *opts
+	}
+	if q.opts.Normalize {
+		pattern = norm.NFC.String(pattern)
+	}
+	var err error
+	q.Regexp, q.Index, err = compilePattern(pattern, &q.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.init(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// CompileQuery compiles the search for query, an expression in the
+// query language described in expr.go, such as
+//
+//	mutex -file:_test\.go lang:go
+//
+// The options apply to every pattern in the query.
+func CompileQuery(query string, opts *Options) (*Query, error) {
+	q := new(Query)
+	if opts != nil {
+		q.opts = *opts
+	}
+	if q.opts.Normalize {
+		query = norm.NFC.String(query)
+	}
+	e, err := parseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.compile(&q.opts); err != nil {
+		return nil, err
+	}
+	q.expr = e
+	q.Index = e.query()
+	q.Names = e.nameQuery()
+
+	// Print the lines matching any of the content patterns.
+	var alts []string
+	for _, pat := range e.patterns() {
+		if q.opts.Literal {
+			pat = stdregexp.QuoteMeta(pat)
+		} else if pat, err = translate(pat, &q.opts); err != nil {
+			return nil, err
+		}
+		alts = append(alts, "(?:"+pat+")")
+	}
+	pat := "(?m)" + strings.Join(alts, "|")
+	if q.opts.IgnoreCase {
+		pat = "(?i)" + pat
+	}
+	q.Regexp, err = regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.init(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// compilePattern compiles pattern according to opts, returning the
+// regexp matching lines and the trigram query for files it may match.
+func compilePattern(pattern string, opts *Options) (*regexp.Regexp, *index.Query, error) {
+	if opts.Literal && !opts.IgnoreCase {
+		return regexp.CompileLiteral(pattern), index.LiteralQuery(pattern), nil
+	}
+	if opts.Literal {
+		pattern = stdregexp.QuoteMeta(pattern)
+	} else if p, err := translate(pattern, opts); err != nil {
+		return nil, nil, err
+	} else {
+		pattern = p
+	}
+	pat := "(?m)" + pattern
+	if opts.IgnoreCase {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, nil, err
+	}
+	return re, index.RegexpQuery(re.Syntax), nil
+}
+
+// translate returns the RE2 form of the regexp pat,
+// translating it from PCRE if opts.PCRECompat is set.
+func translate(pat string, opts *Options) (string, error) {
+	if !opts.PCRECompat {
+		return pat, nil
+	}
+	return regexp.TranslatePCRE(pat)
+}
+
+// init compiles the restrictions on the files searched.
+func (q *Query) init() error {
+	var err error
+	if q.langs, err = lookupLanguages(q.opts.Langs); err != nil {
+		return err
+	}
+	if q.opts.Brute {
+		q.Index = &index.Query{Op: index.QAll}
+	}
+	if q.opts.File != "" {
+		pat, err := translate(q.opts.File, &q.opts)
+		if err != nil {
+			return err
+		}
+		q.file, err = regexp.Compile(pat)
+		if err != nil {
+			return err
+		}
+		q.Names = andQuery(q.Names, index.RegexpQuery(q.file.Syntax))
+	}
+	if len(q.opts.Globs) > 0 {
+		q.globs, err = index.NewGlobFilter(q.opts.Globs)
+		if err != nil {
+			return err
+		}
+	}
+	if len(q.opts.Types) > 0 {
+		q.fileTypes = q.opts.FileTypes
+		if q.fileTypes == nil {
+			q.fileTypes = index.DefaultFileTypes()
+		}
+		for _, typ := range q.opts.Types {
+			if _, ok := q.fileTypes[typ]; !ok {
+				return fmt.Errorf("unknown file type %q", typ)
+			}
+		}
+	}
+	return nil
+}
+
+// andQuery returns the query q AND r,
+// where a nil query stands for one matching every file.
+func andQuery(q, r *index.Query) *index.Query {
+	switch {
+	case q == nil:
+		return r
+	case r == nil:
+		return q
+	}
+	return q.And(r)
+}
+
+// lookupLanguages returns the names used in the index
+// for the languages in list.
+func lookupLanguages(list []string) ([]string, error) {
+	var langs []string
+	for _, name := range list {
+		lang, ok := index.LookupLanguage(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown language %q", name)
+		}
+		langs = append(langs, lang)
+	}
+	return langs, nil
+}
+
+// Keep reports whether a file with the given name passes the
+// file name, type, and glob restrictions of the search.
+func (q *Query) Keep(name string) bool {
+	if q.file != nil && q.file.MatchString(name, true, true) < 0 {
+		return false
+	}
+	if q.fileTypes != nil && !q.fileTypes.Match(name, q.opts.Types) {
+		return false
+	}
+	if q.globs != nil && !q.globs.Match(name) {
+		return false
+	}
+	return true
+}
+
+// KeepRepo reports whether the file with the given fileid in ix
+// passes the repository restriction of the search.
+func (q *Query) KeepRepo(ix *index.Index, fileid uint32) bool {
+	if len(q.opts.Repos) == 0 {
+		return true
+	}
+	repo := ix.Meta(fileid).Repo
+	for _, r := range q.opts.Repos {
+		if r == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// KeepFile reports whether the file with the given fileid in ix
+// passes the restrictions of the search that depend only on what the
+// index records about the file: its repository, its language, and,
+// for a search compiled by CompileQuery, the query's terms other than
+// content.  Files for which the query also depends on content are kept.
+func (q *Query) KeepFile(ix *index.Index, fileid uint32) bool {
+	if !q.KeepRepo(ix, fileid) {
+		return false
+	}
+	if q.langs == nil && q.expr == nil {
+		return true
+	}
+	m := ix.Meta(fileid)
+	if q.langs != nil && !hasString(q.langs, m.Lang) {
+		return false
+	}
+	return q.expr == nil || q.expr.evalFile(q.attrs(ix, fileid, m)) != no
+}
+
+// attrs returns the attributes of the file with the given fileid in
+// ix, whose metadata is m, for evaluating the query expression.
+func (q *Query) attrs(ix *index.Index, fileid uint32, m index.FileMeta) *fileAttrs {
+	f := &fileAttrs{name: ix.Name(fileid), lang: m.Lang, repo: m.Repo}
+	if q.expr.hasField("pkg") {
+		f.pkg = ix.BazelPackage(f.name)
+	}
+	return f
+}
+
+// NeedContent reports whether the search must consult KeepContent
+// before searching each file, as it must for searches compiled
+// by CompileQuery.
+func (q *Query) NeedContent() bool {
+	return q.expr != nil
+}
+
+// KeepContent reports whether the file with the given fileid in ix,
+// whose text is data, matches the query expression of a search
+// compiled by CompileQuery.  It returns true for other searches.
+func (q *Query) KeepContent(ix *index.Index, fileid uint32, data []byte) bool {
+	if q.expr == nil {
+		return true
+	}
+	return q.expr.eval(q.attrs(ix, fileid, ix.Meta(fileid)), data)
+}
+
+// Candidates returns the names of the files in ix that might match q,
+// in the order of their file IDs.
+func (q *Query) Candidates(ix *index.Index) []string {
+	var names []string
+	ids, _ := q.candidates(context.Background(), ix)
+	for _, fileid := range ids {
+		names = append(names, ix.Name(fileid))
+	}
+	return names
+}
+
+// CandidateIDs returns the IDs of the files in ix that might match q,
+// in increasing order, for use with RunCandidates.
+func (q *Query) CandidateIDs(ix *index.Index) []uint32 {
+	ids, _ := q.CandidateIDsContext(context.Background(), ix)
+	return ids
+}
+
+// CandidateIDsContext is like CandidateIDs, but it gives up and
+// returns ctx.Err() if ctx is done before the index query finishes.
+func (q *Query) CandidateIDsContext(ctx context.Context, ix *index.Index) ([]uint32, error) {
+	ids, err := q.candidates(ctx, ix)
+	if err != nil {
+		return nil, err
+	}
+	if ids == nil {
+		ids = []uint32{}
+	}
+	return ids, nil
+}
+
+// candidates returns the file IDs of the files in ix that might match q.
+func (q *Query) candidates(ctx context.Context, ix *index.Index) ([]uint32, error) {
+	list, err := ix.PostingQueryNamesContext(ctx, q.IndexQuery(ix.EstimateQuery), q.Names)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, fileid := range list {
+		if q.Keep(ix.Name(fileid)) && q.KeepFile(ix, fileid) {
+			ids = append(ids, fileid)
+		}
+	}
+	return ids, nil
+}
+
+// IndexQuery returns the trigram query to run against an index whose
+// EstimateQuery method is estimate: q.Index, or, if searching every
+// file looks cheaper and opts.ForceIndex is not set, a query for
+// every file.
+func (q *Query) IndexQuery(estimate func(*index.Query) index.QueryCost) *index.Query {
+	if q.opts.ForceIndex || q.Index.Op == index.QAll || !estimate(q.Index).ScanCheaper() {
+		return q.Index
+	}
+	return &index.Query{Op: index.QAll}
+}
+
+// open opens the file with the given fileid in ix for searching.
+func (q *Query) open(ix *index.Index, fileid uint32, name string) (io.ReadCloser, error) {
+	if q.opts.Stored {
+		if data, ok := ix.Content(fileid); ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	return index.OpenFile(name)
+}
+
+// A Match is a line matched by a search.
+type Match struct {
+	File string // name of file containing the match
+	Line int    // line number, starting at 1
+	Text string // text of matching line, without the final newline
+
+	Offset int64   // byte offset of the start of the line in the file
+	Column int     // byte offset of the first match in Text, plus 1
+	Spans  [][]int // [start, end) byte offsets in Text of each match
+
+	// Query is the index of the query matched, among
+	// those searched for together by RunBatch.
+	Query int
+}
+
+// Results is an iterator over the matches found by a search,
+// which runs in its own goroutine.
+type Results struct {
+	c         chan Match
+	cancel    context.CancelFunc
+	m         Match
+	err       error
+	files     int
+	truncated bool
+	stopped   []bool // queries of a batch stopped at MaxResults
+}
+
+// Run searches ix for pattern and returns an iterator over the
+// matching lines.  The search stops early if ctx is canceled.
+// The caller must call Close when done with the results.
+func Run(ctx context.Context, ix *index.Index, pattern string, opts *Options) (*Results, error) {
+	q, err := Compile(pattern, opts)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run(ctx, ix), nil
+}
+
+// Run searches ix for q and returns an iterator over the matching
+// lines, as for the top-level function Run.  Once Run has been called,
+// q must not be used until the search finishes or is closed.
+func (q *Query) Run(ctx context.Context, ix *index.Index) *Results {
+	return q.RunCandidates(ctx, ix, nil)
+}
+
+// RunCandidates is like Run but searches only the files in ix with the
+// given IDs, as returned by q.CandidateIDs, saving the work of finding
+// them again.  If ids is nil, RunCandidates finds them, as Run does.
+func (q *Query) RunCandidates(ctx context.Context, ix *index.Index, ids []uint32) *Results {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Results{c: make(chan Match, 64), cancel: cancel}
+	go r.run(ctx, q, ix, ids)
+	return r
+}
+
+func (r *Results) run(ctx context.Context, q *Query, ix *index.Index, ids []uint32) {
+	defer close(r.c)
+	n := 0
+	stop := false
+	g := regexp.Grep{
+		Regexp:    q.Regexp,
+		Stdout:    ioutil.Discard,
+		Stderr:    ioutil.Discard,
+		Multiline: q.opts.Multiline,
+		Normalize: q.opts.Normalize,
+		Context:   ctx,
+		OnMatch: func(m *regexp.Match) {
+			if stop {
+				return
+			}
+			if q.opts.MaxResults > 0 && n >= q.opts.MaxResults {
+				r.truncated = true
+				stop = true
+				return
+			}
+			n++
+			select {
+			case r.c <- Match{File: m.Name, Line: m.Lineno, Text: string(m.Line), Offset: m.Offset, Column: m.Column, Spans: m.Spans}:
+			case <-ctx.Done():
+				stop = true
+			}
+		},
+	}
+	if ids == nil {
+		ids, _ = q.candidates(ctx, ix)
+	}
+	if max := q.opts.MaxCandidates; max > 0 && len(ids) > max {
+		r.err = ErrTooManyCandidates
+		return
+	}
+	b := newBudget(q.opts.MaxBytes)
+	for _, fileid := range ids {
+		if stop || ctx.Err() != nil || b.spent() {
+			break
+		}
+		name := ix.Name(fileid)
+		f, err := q.open(ix, fileid, name)
+		if err != nil {
+			continue
+		}
+		r.files++
+		rd := b.reader(f)
+		if q.NeedContent() {
+			data, err := ioutil.ReadAll(rd)
+			f.Close()
+			if q.opts.Normalize {
+				data = norm.NFC.Bytes(data)
+			}
+			if err != nil || !q.KeepContent(ix, fileid, data) {
+				continue
+			}
+			g.Reader(bytes.NewReader(data), name)
+			continue
+		}
+		g.Reader(rd, name)
+		f.Close()
+	}
+	switch {
+	case r.truncated:
+		// Stopped at MaxResults, as asked.
+	case b.spent():
+		r.err = ErrTooManyBytes
+	default:
+		r.err = ctx.Err()
+	}
+}
+
+// Next advances to the next match, which is then available
+// from Match.  It returns false at the end of the results.
+func (r *Results) Next() bool {
+	m, ok := <-r.c
+	r.m = m
+	return ok
+}
+
+// Match returns the current match.
+func (r *Results) Match() Match {
+	return r.m
+}
+
+// Err returns the error, if any, that ended the search early,
+// such as the cancellation of its context.  It must only be called
+// after Next has returned false.
+func (r *Results) Err() error {
+	return r.err
+}
+
+// Files returns the number of candidate files searched.
+// It must only be called after Next has returned false.
+func (r *Results) Files() int {
+	return r.files
+}
+
+// Truncated reports whether the search stopped at MaxResults
+// matches even though there were more.
+// It must only be called after Next has returned false.
+func (r *Results) Truncated() bool {
+	return r.truncated
+}
+
+// QueryTruncated reports whether the query with index i among those
+// searched for by RunBatch stopped at its MaxResults matches even
+// though there were more.
+// It must only be called after Next has returned false.
+func (r *Results) QueryTruncated(i int) bool {
+	return i < len(r.stopped) && r.stopped[i]
+}
+
+// Close stops the search and releases its resources.
+func (r *Results) Close() {
+	r.cancel()
+	for range r.c {
+	}
+}
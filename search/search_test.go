@@ -0,0 +1,245 @@
+// Copyright 2011 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/codesearch/index"
+)
+
+var searchFiles = map[string]string{
+	"a.go":    "package a\n\nfunc Hello() {}\n\nfunc hello() {}\n",
+	"b.py":    "def hello():\n    pass\n",
+	"c/d.txt": "nothing to see\nhello, world\n",
+}
+
+func buildTree(t *testing.T) (dir string, ix *index.Index) {
+	return buildTreeWith(t, nil)
+}
+
+// buildTreeWith is like buildTree but lets set, if not nil,
+// adjust the writer of the tree's index before it indexes the tree.
+func buildTreeWith(t *testing.T, set func(w *index.IndexWriter)) (dir string, ix *index.Index) {
+	dir, err := ioutil.TempDir("", "search-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range searchFiles {
+		file := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(file), 0777)
+		if err := ioutil.WriteFile(file, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(dir, "index")
+	w := index.Create(file)
+	if set != nil {
+		set(w)
+	}
+	w.AddPaths([]string{dir})
+	w.SetRepo(dir, "top")
+	w.SetRepo(filepath.Join(dir, "c"), "c")
+	for _, name := range []string{"a.go", "b.py", "c/d.txt"} {
+		w.AddFile(filepath.Join(dir, name))
+	}
+	w.Flush()
+	return dir, index.Open(file)
+}
+
+var runTests = []struct {
+	pattern string
+	opts    *Options
+	want    []string
+}{
+	{"hello", nil, []string{"a.go:5", "b.py:1", "c/d.txt:2"}},
+	{"hello", &Options{IgnoreCase: true}, []string{"a.go:3", "a.go:5", "b.py:1", "c/d.txt:2"}},
+	{"hello", &Options{File: `\.go$`}, []string{"a.go:5"}},
+	{"hello", &Options{Types: []string{"py", "txt"}}, []string{"b.py:1", "c/d.txt:2"}},
+	{"hello", &Options{Globs: []string{"*.go", "c/*.txt"}}, []string{"a.go:5", "c/d.txt:2"}},
+	{"hello", &Options{Globs: []string{"!c/**"}}, []string{"a.go:5", "b.py:1"}},
+	{"hello", &Options{Repos: []string{"c"}}, []string{"c/d.txt:2"}},
+	{"hello", &Options{Repos: []string{"top", "c"}}, []string{"a.go:5", "b.py:1", "c/d.txt:2"}},
+	{"hello", &Options{Repos: []string{"nosuchrepo"}}, nil},
+	{"hello", &Options{Langs: []string{"python", "go"}}, []string{"a.go:5", "b.py:1"}},
+	{"hello", &Options{MaxResults: 2}, []string{"a.go:5", "b.py:1"}},
+	{"goodbye", nil, nil},
+	{"hello()", &Options{Literal: true}, []string{"a.go:5", "b.py:1"}},
+	{"HELLO()", &Options{Literal: true, IgnoreCase: true}, []string{"a.go:3", "a.go:5", "b.py:1"}},
+	{"(", &Options{Literal: true}, []string{"a.go:3", "a.go:5", "b.py:1"}},
+}
+
+func TestRun(t *testing.T) {
+	dir, ix := buildTree(t)
+	defer os.RemoveAll(dir)
+
+	for _, tt := range runTests {
+		r, err := Run(context.Background(), ix, tt.pattern, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		for r.Next() {
+			m := r.Match()
+			rel, _ := filepath.Rel(dir, m.File)
+			have = append(have, fmt.Sprintf("%s:%d", filepath.ToSlash(rel), m.Line))
+		}
+		if r.Err() != nil {
+			t.Errorf("Run(%q, %+v): %v", tt.pattern, tt.opts, r.Err())
+		}
+		if fmt.Sprint(have) != fmt.Sprint(tt.want) {
+			t.Errorf("Run(%q, %+v) = %v, want %v", tt.pattern, tt.opts, have, tt.want)
+		}
+		if tt.opts != nil && tt.opts.MaxResults > 0 && !r.Truncated() {
+			t.Errorf("Run(%q, %+v) not truncated", tt.pattern, tt.opts)
+		}
+		r.Close()
+	}
+
+	if _, err := Run(context.Background(), ix, "hello", &Options{Types: []string{"nosuchtype"}}); err == nil {
+		t.Errorf("Run with unknown type succeeded")
+	}
+	if _, err := Run(context.Background(), ix, "hello", &Options{Langs: []string{"nosuchlang"}}); err == nil {
+		t.Errorf("Run with unknown language succeeded")
+	}
+	if _, err := Run(context.Background(), ix, "hello", &Options{Globs: []string{"!"}}); err == nil {
+		t.Errorf("Run with empty glob succeeded")
+	}
+	if _, err := Run(context.Background(), ix, "(", nil); err == nil {
+		t.Errorf("Run with bad regexp succeeded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _ := Run(ctx, ix, "hello", nil)
+	for r.Next() {
+	}
+	if r.Err() != context.Canceled {
+		t.Errorf("canceled Run: Err() = %v, want %v", r.Err(), context.Canceled)
+	}
+	r.Close()
+}
+
+func TestRunCandidates(t *testing.T) {
+	dir, ix := buildTree(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Compile("hello", &Options{Langs: []string{"go", "python"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := q.CandidateIDs(ix)
+	if len(ids) != 2 {
+		t.Fatalf("CandidateIDs = %v, want 2 files", ids)
+	}
+	// Searching only the second candidate finds only its match.
+	r := q.RunCandidates(context.Background(), ix, ids[1:])
+	var have []string
+	for r.Next() {
+		rel, _ := filepath.Rel(dir, r.Match().File)
+		have = append(have, filepath.ToSlash(rel))
+	}
+	r.Close()
+	if want := []string{"b.py"}; fmt.Sprint(have) != fmt.Sprint(want) || r.Files() != 1 {
+		t.Errorf("RunCandidates matched %v in %d files, want %v in 1", have, r.Files(), want)
+	}
+
+	q, _ = Compile("goodbye", nil)
+	if ids := q.CandidateIDs(ix); ids == nil || len(ids) != 0 {
+		t.Errorf("CandidateIDs(goodbye) = %#v, want empty list", ids)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ids, err := q.CandidateIDsContext(ctx, ix); ids != nil || err != context.Canceled {
+		t.Errorf("canceled CandidateIDsContext = %v, %v, want nil, %v", ids, err, context.Canceled)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	dir, ix := buildTree(t)
+	defer os.RemoveAll(dir)
+
+	// hello selects all three files, which hold 98 bytes.
+	for _, tt := range []struct {
+		opts  *Options
+		err   error
+		files int
+	}{
+		{&Options{MaxCandidates: 3, MaxBytes: 98}, nil, 3},
+		{&Options{MaxCandidates: 2}, ErrTooManyCandidates, 0},
+		{&Options{MaxBytes: 60}, ErrTooManyBytes, 2},
+	} {
+		r, err := Run(context.Background(), ix, "hello", tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+		}
+		r.Close()
+		if r.Err() != tt.err || r.Files() != tt.files {
+			t.Errorf("Run with %+v: Err() = %v, Files() = %d, want %v, %d", *tt.opts, r.Err(), r.Files(), tt.err, tt.files)
+		}
+
+		q, _ := Compile("hello", tt.opts)
+		br := RunBatch(context.Background(), ix, []*Query{q}, nil)
+		for br.Next() {
+		}
+		br.Close()
+		if br.Err() != tt.err {
+			t.Errorf("RunBatch with %+v: Err() = %v, want %v", *tt.opts, br.Err(), tt.err)
+		}
+	}
+}
+
+func TestStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a.go")
+	b := filepath.Join(dir, "b.go")
+	ioutil.WriteFile(a, []byte("package a\n\nfunc hello() {}\n"), 0666)
+	ioutil.WriteFile(b, []byte("package b\n// hello\n"), 0666)
+	file := filepath.Join(dir, "index")
+	w := index.Create(file)
+	w.StoreContent = true
+	w.AddPaths([]string{dir})
+	w.AddFile(a)
+	w.AddFile(b)
+	w.Flush()
+	ix := index.Open(file)
+
+	// The stored text is searched even after the files change or go away.
+	ioutil.WriteFile(a, []byte("package a\n"), 0666)
+	os.Remove(b)
+	for _, tt := range []struct {
+		opts *Options
+		want []string
+	}{
+		{&Options{Stored: true}, []string{"a.go:3", "b.go:2"}},
+		{nil, nil},
+	} {
+		r, err := Run(context.Background(), ix, "hello", tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		for r.Next() {
+			m := r.Match()
+			have = append(have, fmt.Sprintf("%s:%d", filepath.Base(m.File), m.Line))
+		}
+		r.Close()
+		if fmt.Sprint(have) != fmt.Sprint(tt.want) {
+			t.Errorf("Run(hello, %+v) = %v, want %v", tt.opts, have, tt.want)
+		}
+	}
+}